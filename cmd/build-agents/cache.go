@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buildCacheFile records the inputs each agent in build/agent was built from
+const buildCacheFile = ".build-cache.json"
+
+// buildCacheEntry is the build of one target
+type buildCacheEntry struct {
+	Key     string    `json:"key"`
+	Version string    `json:"version,omitempty"`
+	Commit  string    `json:"commit,omitempty"`
+	BuiltAt time.Time `json:"built_at"`
+}
+
+// buildCache lets targets whose inputs haven't changed skip the rebuild
+type buildCache struct {
+	mu      sync.Mutex
+	entries map[string]buildCacheEntry // key is the binary name
+	path    string
+}
+
+// loadBuildCache loads the cache at path. A missing or unreadable cache is
+// empty, which only means every target is rebuilt.
+func loadBuildCache(path string) *buildCache {
+	cache := &buildCache{
+		entries: make(map[string]buildCacheEntry),
+		path:    path,
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &cache.entries)
+	}
+	return cache
+}
+
+// upToDate reports whether the target's binary exists and was built from
+// inputs with key
+func (c *buildCache) upToDate(target BuildTarget, key, outPath string) bool {
+	c.mu.Lock()
+	entry, exists := c.entries[target.Binary()]
+	c.mu.Unlock()
+	if !exists || entry.Key != key {
+		return false
+	}
+	info, err := os.Stat(outPath)
+	return err == nil && info.Size() > 0
+}
+
+// record remembers that a target was built from inputs with key
+func (c *buildCache) record(target BuildTarget, key string, info buildInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[target.Binary()] = buildCacheEntry{
+		Key:     key,
+		Version: info.Version,
+		Commit:  info.Commit,
+		BuiltAt: time.Now(),
+	}
+}
+
+// save writes the cache to disk
+func (c *buildCache) save() error {
+	c.mu.Lock()
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal build cache: %w", err)
+	}
+
+	// Write to temp file first, then atomically rename
+	tempFile := c.path + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write temp build cache: %w", err)
+	}
+	if err := os.Rename(tempFile, c.path); err != nil {
+		return fmt.Errorf("failed to rename build cache: %w", err)
+	}
+	return nil
+}
+
+// inputsKey hashes everything an agent build depends on: the Go version,
+// the target, the stamped version, go.mod and go.sum, and the source files
+// of the project's packages the agent imports for that target. Dependencies
+// outside the project are covered by go.sum.
+func inputsKey(projectRoot, srcPath string, target BuildTarget, info buildInfo) (string, error) {
+	goVersion, err := goCommand(projectRoot, target, "env", "GOVERSION")
+	if err != nil {
+		return "", err
+	}
+
+	// List the files of non-standard packages in the build, with the build
+	// constraints of the target applied
+	const format = `{{if not .Standard}}{{$dir := .Dir}}` +
+		`{{range .GoFiles}}{{$dir}}/{{.}}{{"\n"}}{{end}}` +
+		`{{range .SFiles}}{{$dir}}/{{.}}{{"\n"}}{{end}}` +
+		`{{range .EmbedFiles}}{{$dir}}/{{.}}{{"\n"}}{{end}}{{end}}`
+	listed, err := goCommand(projectRoot, target, "list", "-deps", "-f", format, srcPath)
+	if err != nil {
+		return "", err
+	}
+
+	files := []string{filepath.Join(projectRoot, "go.mod"), filepath.Join(projectRoot, "go.sum")}
+	for _, file := range strings.Split(listed, "\n") {
+		if file != "" && strings.HasPrefix(file, projectRoot+string(filepath.Separator)) {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files[2:])
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n%s\n", strings.TrimSpace(goVersion), target, info.ldflags())
+	for _, file := range files {
+		rel, _ := filepath.Rel(projectRoot, file)
+		fmt.Fprintf(hash, "%s\n", filepath.ToSlash(rel))
+		if err := hashFile(hash, file); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// goCommand runs the go command for a target and returns its output
+func goCommand(projectRoot string, target BuildTarget, args ...string) (string, error) {
+	cmd := exec.Command("go", args...)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("GOOS=%s", target.GOOS),
+		fmt.Sprintf("GOARCH=%s", target.GOARCH),
+		"CGO_ENABLED=0",
+	)
+	cmd.Dir = projectRoot
+
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("go %s: %w\nOutput: %s", args[0], err, exitErr.Stderr)
+		}
+		return "", fmt.Errorf("go %s: %w", args[0], err)
+	}
+	return string(output), nil
+}
+
+// hashFile writes the content of a file to hash
+func hashFile(hash io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(hash, file)
+	return err
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"sync"
 )
 
@@ -14,6 +16,19 @@ type BuildTarget struct {
 	GOARCH string
 }
 
+// Binary returns the file name of the target's agent binary
+func (t BuildTarget) Binary() string {
+	name := fmt.Sprintf("taskfly-agent-%s-%s", t.GOOS, t.GOARCH)
+	if t.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+func (t BuildTarget) String() string {
+	return t.GOOS + "/" + t.GOARCH
+}
+
 var targets = []BuildTarget{
 	{"linux", "amd64"},
 	{"linux", "arm64"},
@@ -22,7 +37,31 @@ var targets = []BuildTarget{
 	{"windows", "amd64"},
 }
 
+// buildInfo is stamped into the agent binaries
+type buildInfo struct {
+	Version string
+	Commit  string
+}
+
+// ldflags returns the linker flags of an agent build
+func (b buildInfo) ldflags() string {
+	flags := []string{"-s", "-w"}
+	if b.Version != "" {
+		flags = append(flags, "-X", "main.Version="+b.Version)
+	}
+	if b.Commit != "" {
+		flags = append(flags, "-X", "main.Commit="+b.Commit)
+	}
+	return strings.Join(flags, " ")
+}
+
 func main() {
+	targetList := flag.String("targets", os.Getenv("TASKFLY_AGENT_TARGETS"), "Comma-separated os/arch targets to build, e.g. linux/amd64,linux/arm64 (default: all)")
+	configPath := flag.String("config", "", "Only build the targets the deployment in this taskfly.yml needs")
+	version := flag.String("version", os.Getenv("TASKFLY_VERSION"), "Version to stamp into the agents (default: git describe --tags)")
+	force := flag.Bool("force", false, "Rebuild targets whose inputs haven't changed")
+	flag.Parse()
+
 	log.Println("🚀 Building TaskFly agent binaries...")
 
 	// Get project root - walk up from current directory until we find go.mod
@@ -33,15 +72,47 @@ func main() {
 
 	log.Printf("Project root: %s", projectRoot)
 
+	selected := targets
+	switch {
+	case *configPath != "":
+		if selected, err = targetsForConfig(*configPath); err != nil {
+			log.Fatalf("Failed to read targets from %s: %v", *configPath, err)
+		}
+	case *targetList != "":
+		if selected, err = parseTargets(*targetList); err != nil {
+			log.Fatalf("Invalid targets: %v", err)
+		}
+	}
+	if len(selected) < len(targets) {
+		log.Printf("Building %d of %d targets: %v", len(selected), len(targets), selected)
+	}
+
+	info := buildInfo{
+		Version: *version,
+		Commit:  gitOutput(projectRoot, "rev-parse", "--short", "HEAD"),
+	}
+	if info.Version == "" {
+		info.Version = gitOutput(projectRoot, "describe", "--tags")
+	}
+	if info.Version != "" || info.Commit != "" {
+		log.Printf("Stamping version %q, commit %q", info.Version, info.Commit)
+	}
+
+	outDir := filepath.Join(projectRoot, "build", "agent")
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		log.Fatalf("Failed to create output directory: %v", err)
+	}
+	cache := loadBuildCache(filepath.Join(outDir, buildCacheFile))
+
 	// Build agents concurrently
 	var wg sync.WaitGroup
-	errors := make(chan error, len(targets))
+	errors := make(chan error, len(selected))
 
-	for _, target := range targets {
+	for _, target := range selected {
 		wg.Add(1)
 		go func(t BuildTarget) {
 			defer wg.Done()
-			if err := buildAgent(projectRoot, t); err != nil {
+			if err := buildAgent(projectRoot, t, info, cache, *force); err != nil {
 				errors <- err
 			}
 		}(target)
@@ -57,13 +128,18 @@ func main() {
 		failed = true
 	}
 
+	// Keep the keys of the targets that did build, so they aren't rebuilt
+	if err := cache.save(); err != nil {
+		log.Printf("Failed to save build cache: %v", err)
+	}
+
 	if failed {
 		os.Exit(1)
 	}
 
 	// Copy agents to cmd/taskflyd/agents for embedding
 	log.Println("Copying agents to cmd/taskflyd/agents for embedding...")
-	if err := copyAgentsForEmbedding(projectRoot); err != nil {
+	if err := copyAgentsForEmbedding(projectRoot, selected); err != nil {
 		log.Fatalf("Failed to copy agents for embedding: %v", err)
 	}
 
@@ -92,26 +168,39 @@ func findProjectRoot() (string, error) {
 	}
 }
 
-func buildAgent(projectRoot string, target BuildTarget) error {
-	log.Printf("Building agent for %s/%s...", target.GOOS, target.GOARCH)
-
-	// Create output directory
-	outDir := filepath.Join(projectRoot, "build", "agent")
-	if err := os.MkdirAll(outDir, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
+// gitOutput runs git in the project and returns its trimmed output, or an
+// empty string if it fails, e.g. outside a git checkout
+func gitOutput(projectRoot string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = projectRoot
+	output, err := cmd.Output()
+	if err != nil {
+		return ""
 	}
+	return strings.TrimSpace(string(output))
+}
 
+func buildAgent(projectRoot string, target BuildTarget, info buildInfo, cache *buildCache, force bool) error {
 	// Output binary path - format: taskfly-agent-{os}-{arch}
-	outPath := filepath.Join(outDir, fmt.Sprintf("taskfly-agent-%s-%s", target.GOOS, target.GOARCH))
-	if target.GOOS == "windows" {
-		outPath += ".exe"
-	}
+	outPath := filepath.Join(projectRoot, "build", "agent", target.Binary())
 
 	// Source directory (build the whole package, not just main.go)
 	srcPath := filepath.Join(projectRoot, "cmd", "taskfly-agent")
 
+	// Skip targets built from the same inputs before
+	key, err := inputsKey(projectRoot, srcPath, target, info)
+	if err != nil {
+		return fmt.Errorf("failed to hash inputs of %s: %w", target, err)
+	}
+	if !force && cache.upToDate(target, key, outPath) {
+		log.Printf("✓ Agent for %s is up to date", target)
+		return nil
+	}
+
+	log.Printf("Building agent for %s...", target)
+
 	// Build command
-	cmd := exec.Command("go", "build", "-ldflags=-s -w", "-o", outPath, srcPath)
+	cmd := exec.Command("go", "build", "-ldflags="+info.ldflags(), "-o", outPath, srcPath)
 	cmd.Env = append(os.Environ(),
 		fmt.Sprintf("GOOS=%s", target.GOOS),
 		fmt.Sprintf("GOARCH=%s", target.GOARCH),
@@ -122,14 +211,19 @@ func buildAgent(projectRoot string, target BuildTarget) error {
 	// Capture output
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to build %s/%s: %w\nOutput: %s", target.GOOS, target.GOARCH, err, string(output))
+		return fmt.Errorf("failed to build %s: %w\nOutput: %s", target, err, string(output))
 	}
 
-	log.Printf("✓ Built agent for %s/%s", target.GOOS, target.GOARCH)
+	cache.record(target, key, info)
+	log.Printf("✓ Built agent for %s", target)
 	return nil
 }
 
-func copyAgentsForEmbedding(projectRoot string) error {
+// copyAgentsForEmbedding copies the built agents to cmd/taskflyd/agents.
+// Targets that weren't built keep their previous binary there; if they have
+// none, an empty placeholder keeps the daemon compiling, and the daemon
+// won't offer that agent.
+func copyAgentsForEmbedding(projectRoot string, built []BuildTarget) error {
 	srcDir := filepath.Join(projectRoot, "build", "agent")
 	destDir := filepath.Join(projectRoot, "cmd", "taskflyd", "agents")
 
@@ -139,13 +233,9 @@ func copyAgentsForEmbedding(projectRoot string) error {
 	}
 
 	// Copy each agent binary
-	for _, target := range targets {
-		srcFile := filepath.Join(srcDir, fmt.Sprintf("taskfly-agent-%s-%s", target.GOOS, target.GOARCH))
-		destFile := filepath.Join(destDir, fmt.Sprintf("taskfly-agent-%s-%s", target.GOOS, target.GOARCH))
-		if target.GOOS == "windows" {
-			srcFile += ".exe"
-			destFile += ".exe"
-		}
+	for _, target := range built {
+		srcFile := filepath.Join(srcDir, target.Binary())
+		destFile := filepath.Join(destDir, target.Binary())
 
 		data, err := os.ReadFile(srcFile)
 		if err != nil {
@@ -157,5 +247,15 @@ func copyAgentsForEmbedding(projectRoot string) error {
 		}
 	}
 
+	for _, target := range targets {
+		destFile := filepath.Join(destDir, target.Binary())
+		if _, err := os.Stat(destFile); os.IsNotExist(err) {
+			log.Printf("No agent for %s, embedding an empty placeholder", target)
+			if err := os.WriteFile(destFile, nil, 0755); err != nil {
+				return fmt.Errorf("failed to write %s: %w", destFile, err)
+			}
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/JustinTimperio/TaskFly/internal/cloud"
+	"gopkg.in/yaml.v2"
+)
+
+// parseTargets parses a comma-separated list of os/arch targets, which must
+// be among the supported ones
+func parseTargets(list string) ([]BuildTarget, error) {
+	var selected []BuildTarget
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		target, err := findTarget(name)
+		if err != nil {
+			return nil, err
+		}
+		selected = addTarget(selected, target)
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no targets given")
+	}
+	return selected, nil
+}
+
+// findTarget returns the supported target named os/arch
+func findTarget(name string) (BuildTarget, error) {
+	for _, target := range targets {
+		if target.String() == name {
+			return target, nil
+		}
+	}
+	supported := make([]string, len(targets))
+	for i, target := range targets {
+		supported[i] = target.String()
+	}
+	return BuildTarget{}, fmt.Errorf("unsupported target %q, supported: %s", name, strings.Join(supported, ", "))
+}
+
+// targetsForConfig returns the targets the nodes of a deployment run on:
+// target_os and target_arch of local hosts, or the architecture of the AWS
+// instance type. The platform of this host is always included, since
+// simulated deployments run their agents on the daemon host.
+func targetsForConfig(path string) ([]BuildTarget, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		CloudProvider  string                            `yaml:"cloud_provider"`
+		InstanceConfig map[string]map[string]interface{} `yaml:"instance_config"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	var selected []BuildTarget
+	instanceConfig := config.InstanceConfig[config.CloudProvider]
+	switch config.CloudProvider {
+	case "local":
+		targetOS, _ := instanceConfig["target_os"].(string)
+		targetArch, _ := instanceConfig["target_arch"].(string)
+		if targetOS == "" {
+			targetOS = "linux"
+		}
+		if targetArch == "" {
+			targetArch = "amd64"
+		}
+		target, err := findTarget(targetOS + "/" + targetArch)
+		if err != nil {
+			return nil, err
+		}
+		selected = addTarget(selected, target)
+	case "aws":
+		instanceType, _ := instanceConfig["instance_type"].(string)
+		selected = addTarget(selected, BuildTarget{"linux", cloud.DetectArchFromInstanceType(instanceType)})
+	}
+
+	if host, err := findTarget(runtime.GOOS + "/" + runtime.GOARCH); err == nil {
+		selected = addTarget(selected, host)
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no supported targets for cloud provider %q", config.CloudProvider)
+	}
+	return selected, nil
+}
+
+// addTarget appends target unless it is already selected
+func addTarget(selected []BuildTarget, target BuildTarget) []BuildTarget {
+	for _, existing := range selected {
+		if existing == target {
+			return selected
+		}
+	}
+	return append(selected, target)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/units"
+)
+
+// artifactClient relays artifact transfers. It has no overall timeout since
+// artifacts can be large; transfers end with the workload's request.
+var artifactClient = &http.Client{}
+
+// handleArtifact relays artifact transfers between the workload and the
+// daemon's per-deployment artifact cache:
+//
+//	curl -fsS -T app.bin "$TASKFLY_ARTIFACTS_URL/app.bin"               # store
+//	curl -fsS -o app.bin "$TASKFLY_ARTIFACTS_URL/app.bin?wait=10m"      # fetch
+//
+// A fetch with wait blocks until another node stores the artifact or the
+// time runs out, so one node can build what the others reuse.
+func (a *Agent) handleArtifact(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/artifacts/")
+	if key == "" || strings.Contains(key, "/") {
+		http.Error(w, "use /artifacts/<key>", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut, http.MethodPost:
+		a.storeArtifact(w, r, key)
+	case http.MethodGet:
+		a.fetchArtifact(w, r, key)
+	default:
+		http.Error(w, "use PUT to store and GET to fetch", http.StatusMethodNotAllowed)
+	}
+}
+
+// storeArtifact uploads the request body as an artifact. The body is spooled
+// to a temp file first, since the request signature covers its digest.
+func (a *Agent) storeArtifact(w http.ResponseWriter, r *http.Request, key string) {
+	spool, err := os.CreateTemp("", "taskfly-artifact-*")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to buffer artifact: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, hash), r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read artifact: %v", err), http.StatusBadRequest)
+		return
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, fmt.Sprintf("failed to buffer artifact: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPut, a.artifactsURL+"/"+url.PathEscape(key), spool)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	a.authorizeDigest(req, hash.Sum(nil))
+
+	resp, err := artifactClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to store artifact %s: %v", key, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		log.Printf("Stored artifact %s (%s)", key, units.FormatSize(size))
+	} else {
+		log.Printf("Failed to store artifact %s: daemon answered %d", key, resp.StatusCode)
+	}
+	relayResponse(w, resp)
+}
+
+// fetchArtifact downloads an artifact. The daemon bounds how long a request
+// waits, so longer waits are spread over several requests.
+func (a *Agent) fetchArtifact(w http.ResponseWriter, r *http.Request, key string) {
+	var wait time.Duration
+	if value := r.URL.Query().Get("wait"); value != "" {
+		var err error
+		if wait, err = time.ParseDuration(value); err != nil || wait < 0 {
+			http.Error(w, "wait must be a duration such as 30s or 10m", http.StatusBadRequest)
+			return
+		}
+	}
+	deadline := time.Now().Add(wait)
+
+	for {
+		remaining := max(time.Until(deadline), 0).Round(time.Second)
+		target := a.artifactsURL + "/" + url.PathEscape(key) + "?wait=" + remaining.String()
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		a.authorize(req, nil)
+
+		resp, err := artifactClient.Do(req)
+		if err != nil {
+			log.Printf("Failed to fetch artifact %s: %v", key, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if resp.StatusCode == http.StatusNotFound && time.Until(deadline) > time.Second {
+			resp.Body.Close()
+			a.debugf("Still waiting for artifact %s", key)
+			continue
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK {
+			a.debugf("Fetched artifact %s stored by %s", key, resp.Header.Get("X-TaskFly-Artifact-Node"))
+		}
+		relayResponse(w, resp)
+		return
+	}
+}
+
+// relayResponse copies the daemon's response to the workload
+func relayResponse(w http.ResponseWriter, resp *http.Response) {
+	for _, header := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "Last-Modified", "X-TaskFly-Artifact-SHA256", "X-TaskFly-Artifact-Node"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Printf("Failed to relay artifact: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxCachedBundles is how many bundles the cache keeps, the least recently
+// used are evicted first. The daemon remembers as many per host.
+const maxCachedBundles = 5
+
+// bundleSuffix is the suffix of cached bundles, which are named by the
+// sha256 of their content
+const bundleSuffix = ".tar.gz"
+
+// bundleCache keeps downloaded bundles by digest, so agents deployed to the
+// same host again can skip the download. A nil cache caches nothing.
+type bundleCache struct {
+	dir string
+}
+
+// newBundleCache creates a cache in dir, or returns nil if dir is empty
+func newBundleCache(dir string) *bundleCache {
+	if dir == "" {
+		return nil
+	}
+	return &bundleCache{dir: dir}
+}
+
+// defaultBundleCacheDir returns the per-user cache directory of bundles,
+// falling back to the temporary directory
+func defaultBundleCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "taskfly-bundles")
+	}
+	return filepath.Join(dir, "taskfly", "bundles")
+}
+
+func (c *bundleCache) path(digest string) string {
+	return filepath.Join(c.dir, digest+bundleSuffix)
+}
+
+// digests lists the cached bundles, most recently used last
+func (c *bundleCache) digests() []string {
+	digests := []string{}
+	if c == nil {
+		return digests
+	}
+	for _, entry := range c.entries() {
+		digests = append(digests, strings.TrimSuffix(entry.Name(), bundleSuffix))
+	}
+	return digests
+}
+
+// entries returns the cached bundles sorted by last use
+func (c *bundleCache) entries() []os.FileInfo {
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil
+	}
+	var entries []os.FileInfo
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if !dirEntry.Type().IsRegular() || !strings.HasSuffix(name, bundleSuffix) || !validDigest(strings.TrimSuffix(name, bundleSuffix)) {
+			continue
+		}
+		if info, err := dirEntry.Info(); err == nil {
+			entries = append(entries, info)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	return entries
+}
+
+// fetch copies a cached bundle to dest and reports whether it was cached.
+// A cached bundle that doesn't match its digest is removed.
+func (c *bundleCache) fetch(digest, dest string) bool {
+	if c == nil || !validDigest(digest) {
+		return false
+	}
+	cached := c.path(digest)
+	if _, err := os.Stat(cached); err != nil {
+		return false
+	}
+
+	actual, err := copyFile(cached, dest)
+	if err != nil {
+		log.Printf("Failed to use cached bundle %s: %v", digest, err)
+		os.Remove(dest)
+		return false
+	}
+	if actual != digest {
+		log.Printf("Cached bundle %s is corrupt, downloading it again", digest)
+		os.Remove(cached)
+		os.Remove(dest)
+		return false
+	}
+
+	now := time.Now()
+	os.Chtimes(cached, now, now)
+	return true
+}
+
+// store adds a downloaded bundle to the cache and evicts the least recently
+// used bundles beyond maxCachedBundles
+func (c *bundleCache) store(digest, src string) error {
+	if c == nil || !validDigest(digest) {
+		return nil
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create bundle cache: %w", err)
+	}
+
+	// Copy to a temp file first, then atomically rename, so agents sharing
+	// the cache never see a partial bundle
+	temp, err := os.CreateTemp(c.dir, ".bundle-*")
+	if err != nil {
+		return fmt.Errorf("failed to create cached bundle: %w", err)
+	}
+	temp.Close()
+	if _, err := copyFile(src, temp.Name()); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := os.Rename(temp.Name(), c.path(digest)); err != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("failed to rename cached bundle: %w", err)
+	}
+
+	entries := c.entries()
+	for len(entries) > maxCachedBundles {
+		os.Remove(filepath.Join(c.dir, entries[0].Name()))
+		entries = entries[1:]
+	}
+	return nil
+}
+
+// copyFile copies src to dst and returns the digest of the copied content
+func copyFile(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", dst, err)
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), in); err != nil {
+		return "", fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// validDigest reports whether a digest is a hex encoded sha256, which keeps
+// digests from the daemon from naming paths outside the cache
+func validDigest(digest string) bool {
+	if len(digest) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(digest)
+	return err == nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/JustinTimperio/TaskFly/internal/metadata"
+)
+
+// configDirName is the directory in the working directory that holds the
+// node configuration as files
+const configDirName = ".taskfly-config"
+
+// Files the whole node configuration is written to, next to the files of the
+// keys listed in nodes.file_keys
+const (
+	configEnvFile     = "config.env"  // export KEY='value' lines for sh
+	configJSONFile    = "config.json" // the exported keys as a JSON object
+	configVersionFile = "version"     // incremented by each config update
+)
+
+// configDir returns the directory the node configuration is written to
+func (a *Agent) configDir() string {
+	return filepath.Join(a.workDir, configDirName)
+}
+
+// currentConfig returns the node configuration and its version, which
+// heartbeats may replace while the workload runs
+func (a *Agent) currentConfig() (map[string]interface{}, int) {
+	a.configMutex.Lock()
+	defer a.configMutex.Unlock()
+	return a.nodeConfig, a.configVersion
+}
+
+// writeConfigFiles writes the node configuration to the config directory.
+// Each file-delivered key is written to a file named after the key, strings
+// as they are and other values JSON encoded. All keys are also written to
+// config.env and config.json, so long-running workloads can reload them
+// after an update. Files are replaced atomically and only readable by the
+// agent's user.
+func (a *Agent) writeConfigFiles() error {
+	a.configWriteMutex.Lock()
+	defer a.configWriteMutex.Unlock()
+	config, version := a.currentConfig()
+
+	dir := a.configDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	if err := restrictToOwner(dir); err != nil {
+		return fmt.Errorf("failed to restrict access to config directory: %w", err)
+	}
+
+	for key := range a.configFiles {
+		// The daemon validates keys, but never write outside the directory
+		if filepath.Base(key) != key || key == "." || key == ".." {
+			return fmt.Errorf("config key '%s' is not a valid file name", key)
+		}
+		path := filepath.Join(dir, key)
+		value, ok := config[key]
+		if !ok {
+			// Removed by an update
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove config key '%s': %w", key, err)
+			}
+			continue
+		}
+		if err := writeConfigFile(path, []byte(metadata.EnvValue(value))); err != nil {
+			return fmt.Errorf("failed to write config key '%s': %w", key, err)
+		}
+		a.debugf("Wrote config key %s to %s", key, path)
+	}
+
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		if !reservedConfigKeys[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var env strings.Builder
+	exported := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		exported[key] = config[key]
+		fmt.Fprintf(&env, "export %s=%s\n", metadata.EnvName(key), shellQuote(metadata.EnvValue(config[key])))
+	}
+	data, err := json.MarshalIndent(exported, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	// The version goes last, so a workload watching it sees complete files
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{configEnvFile, []byte(env.String())},
+		{configJSONFile, append(data, '\n')},
+		{configVersionFile, []byte(strconv.Itoa(version) + "\n")},
+	}
+	for _, file := range files {
+		if err := writeConfigFile(filepath.Join(dir, file.name), file.data); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file.name, err)
+		}
+	}
+
+	log.Printf("Wrote config version %d to %s", version, dir)
+	return nil
+}
+
+// writeConfigFile replaces a file in the config directory through a temp
+// file, so readers never see it half written
+func writeConfigFile(path string, data []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), ".config-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// shellQuote quotes a value for sh
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// applyConfig switches to a config update the daemon sent with a heartbeat
+// and rewrites the config files. The environment of a running workload can't
+// change, so long-running workloads reload config.env or config.json when
+// the version file changes. Telemetry hooks get the new values on their next
+// run.
+func (a *Agent) applyConfig(config map[string]interface{}, version int) {
+	a.configMutex.Lock()
+	if version <= a.configVersion {
+		a.configMutex.Unlock()
+		return
+	}
+	changed := changedKeys(a.nodeConfig, config)
+	a.nodeConfig = config
+	a.configVersion = version
+	a.configMutex.Unlock()
+
+	log.Printf("Applying config version %d, changed keys: %s", version, strings.Join(changed, ", "))
+	if err := a.writeConfigFiles(); err != nil {
+		log.Printf("Failed to write config version %d: %v", version, err)
+	}
+}
+
+// changedKeys lists the keys added, removed or changed between two configs
+func changedKeys(old, updated map[string]interface{}) []string {
+	var keys []string
+	for key, value := range updated {
+		if previous, ok := old[key]; !ok || metadata.EnvValue(previous) != metadata.EnvValue(value) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range old {
+		if _, ok := updated[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
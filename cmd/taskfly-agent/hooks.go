@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// TelemetryHooksSpec configures executables the agent runs periodically to
+// report custom metrics and health checks (telemetry_hooks in taskfly.yml)
+type TelemetryHooksSpec struct {
+	Dir      string `json:"dir"`      // relative to the working directory
+	Interval int    `json:"interval"` // seconds between runs
+	Timeout  int    `json:"timeout"`  // seconds per hook run
+}
+
+// HealthCheck is the result of a hook that reported a status
+type HealthCheck struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"` // ok, warning or critical
+	Message   string    `json:"message,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// hookOutput is the JSON document a hook prints to stdout
+type hookOutput struct {
+	Metrics map[string]float64 `json:"metrics"`
+	Status  string             `json:"status"`
+	Message string             `json:"message"`
+}
+
+const (
+	defaultHookInterval = 15 * time.Second
+	defaultHookTimeout  = 10 * time.Second
+)
+
+// telemetryLoop runs the telemetry hooks until the agent shuts down. Results
+// are attached to the following heartbeats.
+func (a *Agent) telemetryLoop() {
+	if a.hooks.Dir == "" {
+		return
+	}
+	if !filepath.IsLocal(a.hooks.Dir) {
+		log.Printf("Ignoring telemetry hooks: %q must be a relative path inside the working directory", a.hooks.Dir)
+		return
+	}
+	dir := filepath.Join(a.workDir, a.hooks.Dir)
+
+	interval := defaultHookInterval
+	if a.hooks.Interval > 0 {
+		interval = time.Duration(a.hooks.Interval) * time.Second
+	}
+	timeout := defaultHookTimeout
+	if a.hooks.Timeout > 0 {
+		timeout = time.Duration(a.hooks.Timeout) * time.Second
+	}
+
+	log.Printf("Running telemetry hooks from %s every %s", dir, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		a.runHooks(dir, timeout)
+
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runHooks runs every hook in dir once and replaces the reported telemetry
+func (a *Agent) runHooks(dir string, timeout time.Duration) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Failed to read telemetry hooks directory: %v", err)
+		return
+	}
+
+	metrics := make(map[string]float64)
+	var checks []HealthCheck
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !isHook(info) {
+			continue
+		}
+
+		output, check := a.runHook(filepath.Join(dir, entry.Name()), timeout)
+		for name, value := range output.Metrics {
+			metrics[name] = value
+		}
+		if check != nil {
+			checks = append(checks, *check)
+		}
+	}
+
+	a.debugf("Telemetry hooks reported %d metrics and %d health checks", len(metrics), len(checks))
+
+	a.telemetryMutex.Lock()
+	a.customMetrics = metrics
+	a.healthChecks = checks
+	a.telemetryMutex.Unlock()
+}
+
+// runHook executes a single hook. A health check is returned when the hook
+// reported a status or failed; failures are always critical.
+func (a *Agent) runHook(path string, timeout time.Duration) (hookOutput, *HealthCheck) {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	check := &HealthCheck{Name: name, Status: "critical", CheckedAt: time.Now()}
+
+	ctx, cancel := context.WithTimeout(a.ctx, timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	command, err := interpretedCommand("", path, nil)
+	if err == nil && command != nil {
+		cmd = exec.CommandContext(ctx, command[0], command[1:]...)
+	} else if err == nil {
+		cmd, err = scriptCommand(ctx, path)
+	}
+	if err != nil {
+		check.Message = err.Error()
+		return hookOutput{}, check
+	}
+	cmd.Dir = a.workDir
+	cmd.Env = append(os.Environ(), a.nodeEnv()...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			check.Message = fmt.Sprintf("timed out after %s", timeout)
+		} else {
+			check.Message = strings.TrimSpace(fmt.Sprintf("%v: %s", err, firstLine(stderr.String())))
+		}
+		return hookOutput{}, check
+	}
+
+	var output hookOutput
+	if err := json.Unmarshal(bytes.TrimSpace(stdout.Bytes()), &output); err != nil {
+		check.Message = fmt.Sprintf("invalid output: %v", err)
+		return hookOutput{}, check
+	}
+
+	switch output.Status {
+	case "":
+		return output, nil
+	case "ok", "warning", "critical":
+		check.Status = output.Status
+		check.Message = output.Message
+	default:
+		check.Message = fmt.Sprintf("unknown status %q", output.Status)
+	}
+
+	return output, check
+}
+
+// isHook reports whether a file can be run as a hook. Windows has no
+// executable bit, so the extension decides there.
+func isHook(info fs.FileInfo) bool {
+	if runtime.GOOS == "windows" {
+		switch strings.ToLower(filepath.Ext(info.Name())) {
+		case ".exe", ".bat", ".cmd", ".ps1":
+			return true
+		}
+		return false
+	}
+	return info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0
+}
+
+// firstLine returns the first non-empty line of s
+func firstLine(s string) string {
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+// telemetry returns the latest hook results for a heartbeat
+func (a *Agent) telemetry() (map[string]float64, []HealthCheck) {
+	a.telemetryMutex.Lock()
+	defer a.telemetryMutex.Unlock()
+	return a.customMetrics, a.healthChecks
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// namedInterpreter is an interpreter remote_script_interpreter can name
+// instead of spelling out a command line. The first candidate found in PATH
+// is used, so scripts run on hosts that only have an alternative.
+type namedInterpreter struct {
+	candidates [][]string
+	crlf       bool // the interpreter trips over CRLF line endings
+}
+
+// namedInterpreters are the interpreters known by name
+var namedInterpreters = map[string]namedInterpreter{
+	"bash":    {candidates: [][]string{{"bash"}}, crlf: true},
+	"sh":      {candidates: [][]string{{"sh"}, {"bash"}}, crlf: true},
+	"python3": {candidates: [][]string{{"python3"}, {"python"}, {"py", "-3"}}, crlf: true},
+	"pwsh": {candidates: [][]string{
+		{"pwsh", "-NoProfile", "-NonInteractive", "-File"},
+		{"powershell.exe", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File"},
+	}},
+}
+
+// extensionInterpreters name the interpreter of scripts without a shebang
+var extensionInterpreters = map[string]string{
+	".sh":   "bash",
+	".bash": "bash",
+	".py":   "python3",
+	".ps1":  "pwsh",
+}
+
+// scriptHeadSize is how much of a script is read to detect its kind
+const scriptHeadSize = 8192
+
+// resolveNamedInterpreter returns the command line of a named interpreter,
+// or nil if name isn't one
+func resolveNamedInterpreter(name string) ([]string, bool, error) {
+	named, ok := namedInterpreters[name]
+	if !ok {
+		return nil, false, nil
+	}
+	for _, candidate := range named.candidates {
+		if _, err := exec.LookPath(candidate[0]); err == nil {
+			return candidate, named.crlf, nil
+		}
+	}
+	return nil, false, fmt.Errorf("interpreter %s is not installed", name)
+}
+
+// scriptInterpreter returns the command line a script is passed to, or nil
+// if the script is run directly. A configured interpreter is either one of
+// namedInterpreters or a command line. Without one, binaries and scripts
+// with a shebang run directly, except on Windows, which ignores shebangs.
+// Other scripts are run by the interpreter for their extension, or by sh,
+// which is what a shell does with them; on Windows, scriptCommand decides.
+// crlf reports whether the script's line endings have to be normalized.
+func scriptInterpreter(configured, path string) (interpreter []string, crlf bool, err error) {
+	if configured != "" {
+		if interpreter, crlf, err := resolveNamedInterpreter(configured); interpreter != nil || err != nil {
+			return interpreter, crlf, err
+		}
+		// A command line such as "/usr/bin/env python3 -u"
+		return strings.Fields(configured), true, nil
+	}
+
+	head, err := readHead(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if isBinary(head) {
+		return nil, false, nil
+	}
+	if honorsShebang && bytes.HasPrefix(head, []byte("#!")) {
+		// CR at the end of the shebang line makes the kernel look for
+		// "bash\r"
+		return nil, true, nil
+	}
+
+	if name, ok := extensionInterpreters[strings.ToLower(filepath.Ext(path))]; ok {
+		return resolveNamedInterpreter(name)
+	}
+	if honorsShebang {
+		return resolveNamedInterpreter("sh")
+	}
+	return nil, false, nil
+}
+
+// readHead reads the start of a file
+func readHead(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	head := make([]byte, scriptHeadSize)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// isBinary reports whether the start of a file looks like an executable or
+// other binary rather than a script
+func isBinary(head []byte) bool {
+	return bytes.IndexByte(head, 0) >= 0
+}
+
+// normalizeLineEndings rewrites a script with CRLF line endings, as saved by
+// many Windows editors, to LF. It reports whether the file was changed.
+func normalizeLineEndings(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Contains(data, []byte("\r\n")) || isBinary(data) {
+		return false, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	normalized := bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	if err := os.WriteFile(path, normalized, info.Mode().Perm()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// interpretedCommand returns the program and arguments that run a script:
+// its interpreter if scriptInterpreter names one, normalizing CRLF line
+// endings the interpreter would trip over first. A nil result means the
+// script is run directly.
+func interpretedCommand(configured, path string, args []string) ([]string, error) {
+	interpreter, crlf, err := scriptInterpreter(configured, path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	if crlf {
+		if changed, err := normalizeLineEndings(path); err != nil {
+			return nil, fmt.Errorf("failed to normalize line endings of %s: %w", filepath.Base(path), err)
+		} else if changed {
+			log.Printf("Converted CRLF line endings of %s to LF", filepath.Base(path))
+		}
+	}
+	if len(interpreter) == 0 {
+		return nil, nil
+	}
+	return append(append(append([]string{}, interpreter...), path), args...), nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/units"
+)
+
+// limitGracePeriod is how long a workload that exceeded a limit has to exit
+// after being asked to before it is killed
+const limitGracePeriod = 10 * time.Second
+
+// LimitsSpec caps what the workload may write, as configured under limits in
+// taskfly.yml. Zero means no limit.
+type LimitsSpec struct {
+	MaxWorkdirBytes int64 `json:"max_workdir_bytes"`
+	MaxOutputBytes  int64 `json:"max_output_bytes"`
+	CheckInterval   int   `json:"check_interval"` // seconds between working directory measurements
+}
+
+// workdirLimitLoop measures the working directory until the workload exits
+// and stops the workload once it grows past max_workdir_size
+func (a *Agent) workdirLimitLoop(done <-chan struct{}) {
+	if a.limits.MaxWorkdirBytes <= 0 {
+		return
+	}
+
+	interval := time.Duration(a.limits.CheckInterval) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		size, err := dirSize(a.workDir)
+		if err != nil {
+			log.Printf("Failed to measure working directory: %v", err)
+		} else if size > a.limits.MaxWorkdirBytes {
+			a.exceedLimit(fmt.Sprintf("Working directory %s grew to %s, over the max_workdir_size limit of %s",
+				a.workDir, units.FormatSize(size), units.FormatSize(a.limits.MaxWorkdirBytes)))
+			return
+		} else {
+			a.debugf("Working directory uses %s of %s", units.FormatSize(size), units.FormatSize(a.limits.MaxWorkdirBytes))
+		}
+
+		select {
+		case <-done:
+			return
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recordOutput counts a line of workload output against max_output_size. It
+// reports whether the line is within the limit and should be kept.
+func (a *Agent) recordOutput(line string) bool {
+	if a.limits.MaxOutputBytes <= 0 {
+		return true
+	}
+	total := a.outputBytes.Add(int64(len(line) + 1))
+	if total <= a.limits.MaxOutputBytes {
+		return true
+	}
+	a.exceedLimit(fmt.Sprintf("Output exceeded the max_output_size limit of %s, later output was dropped",
+		units.FormatSize(a.limits.MaxOutputBytes)))
+	return false
+}
+
+// exceedLimit records the first limit the workload exceeded and stops it,
+// killing it if it doesn't exit within limitGracePeriod
+func (a *Agent) exceedLimit(reason string) {
+	a.limitMutex.Lock()
+	if a.limitExceeded != "" {
+		a.limitMutex.Unlock()
+		return
+	}
+	a.limitExceeded = reason
+	a.limitMutex.Unlock()
+
+	log.Printf("Limit exceeded: %s", reason)
+	a.addLog(reason, "stderr")
+
+	cmd, done := a.setupCmd, a.setupDone
+	if cmd == nil || cmd.Process == nil {
+		return
+	}
+	if err := terminateProcess(cmd.Process); err != nil {
+		log.Printf("Failed to stop workload: %v", err)
+	}
+	go func() {
+		select {
+		case <-done:
+		case <-time.After(limitGracePeriod):
+			log.Printf("Workload still running %s after exceeding a limit, killing it", limitGracePeriod)
+			cmd.Process.Kill()
+		}
+	}()
+}
+
+// exceededLimit returns the limit the workload exceeded, if any
+func (a *Agent) exceededLimit() string {
+	a.limitMutex.Lock()
+	defer a.limitMutex.Unlock()
+	return a.limitExceeded
+}
+
+// dirSize returns the total size of the regular files under dir. Files
+// removed while it walks are skipped.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,94 @@
+//go:build darwin
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Mach calls go through libSystem trampolines (mach_darwin_*.s), the same
+// way golang.org/x/sys/unix reaches libc, so agents keep building without cgo
+
+//go:linkname syscall_syscall syscall.syscall
+func syscall_syscall(fn, a1, a2, a3 uintptr) (r1, r2 uintptr, err syscall.Errno)
+
+//go:linkname syscall_syscall6 syscall.syscall6
+func syscall_syscall6(fn, a1, a2, a3, a4, a5, a6 uintptr) (r1, r2 uintptr, err syscall.Errno)
+
+var libc_mach_host_self_trampoline_addr uintptr
+
+//go:cgo_import_dynamic libc_mach_host_self mach_host_self "/usr/lib/libSystem.B.dylib"
+
+var libc_task_self_trap_trampoline_addr uintptr
+
+//go:cgo_import_dynamic libc_task_self_trap task_self_trap "/usr/lib/libSystem.B.dylib"
+
+var libc_host_processor_info_trampoline_addr uintptr
+
+//go:cgo_import_dynamic libc_host_processor_info host_processor_info "/usr/lib/libSystem.B.dylib"
+
+var libc_vm_deallocate_trampoline_addr uintptr
+
+//go:cgo_import_dynamic libc_vm_deallocate vm_deallocate "/usr/lib/libSystem.B.dylib"
+
+const (
+	processorCPULoadInfo = 2 // PROCESSOR_CPU_LOAD_INFO
+	cpuStateMax          = 4 // CPU_STATE_MAX: user, system, idle, nice
+	cpuStateIdle         = 2
+)
+
+// machPorts caches the host and task ports. Every lookup adds a reference to
+// the port, so they are fetched once per process.
+var machPorts struct {
+	sync.Once
+	host, task uintptr
+}
+
+// readProcessorTicks reads cumulative per-core CPU ticks from
+// host_processor_info, prefixed with the aggregate across all cores
+func readProcessorTicks() ([]cpuTimes, error) {
+	machPorts.Do(func() {
+		host, _, _ := syscall_syscall(libc_mach_host_self_trampoline_addr, 0, 0, 0)
+		task, _, _ := syscall_syscall(libc_task_self_trap_trampoline_addr, 0, 0, 0)
+		machPorts.host = uintptr(uint32(host))
+		machPorts.task = uintptr(uint32(task))
+	})
+
+	var count, infoCount uint32
+	var info *uint32
+	ret, _, _ := syscall_syscall6(libc_host_processor_info_trampoline_addr,
+		machPorts.host, processorCPULoadInfo,
+		uintptr(unsafe.Pointer(&count)), uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&infoCount)), 0)
+	if kr := int32(ret); kr != 0 {
+		return nil, fmt.Errorf("host_processor_info failed: kern_return %d", kr)
+	}
+	if info == nil {
+		return nil, fmt.Errorf("host_processor_info returned no data")
+	}
+	defer syscall_syscall(libc_vm_deallocate_trampoline_addr,
+		machPorts.task, uintptr(unsafe.Pointer(info)), uintptr(infoCount)*unsafe.Sizeof(*info))
+
+	ticks := unsafe.Slice(info, infoCount)
+	if uint32(len(ticks)) < count*cpuStateMax {
+		return nil, fmt.Errorf("host_processor_info returned %d ticks for %d cores", len(ticks), count)
+	}
+
+	times := make([]cpuTimes, 1, count+1)
+	for cpu := range int(count) {
+		var core cpuTimes
+		for state, tick := range ticks[cpu*cpuStateMax : (cpu+1)*cpuStateMax] {
+			core.total += uint64(tick)
+			if state != cpuStateIdle {
+				core.busy += uint64(tick)
+			}
+		}
+		times[0].busy += core.busy
+		times[0].total += core.total
+		times = append(times, core)
+	}
+
+	return times, nil
+}
@@ -0,0 +1,23 @@
+// Trampolines into libSystem for the Mach calls in mach_darwin.go
+
+#include "textflag.h"
+
+TEXT libc_mach_host_self_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	libc_mach_host_self(SB)
+GLOBL	·libc_mach_host_self_trampoline_addr(SB), RODATA, $8
+DATA	·libc_mach_host_self_trampoline_addr(SB)/8, $libc_mach_host_self_trampoline<>(SB)
+
+TEXT libc_task_self_trap_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	libc_task_self_trap(SB)
+GLOBL	·libc_task_self_trap_trampoline_addr(SB), RODATA, $8
+DATA	·libc_task_self_trap_trampoline_addr(SB)/8, $libc_task_self_trap_trampoline<>(SB)
+
+TEXT libc_host_processor_info_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	libc_host_processor_info(SB)
+GLOBL	·libc_host_processor_info_trampoline_addr(SB), RODATA, $8
+DATA	·libc_host_processor_info_trampoline_addr(SB)/8, $libc_host_processor_info_trampoline<>(SB)
+
+TEXT libc_vm_deallocate_trampoline<>(SB),NOSPLIT,$0-0
+	JMP	libc_vm_deallocate(SB)
+GLOBL	·libc_vm_deallocate_trampoline_addr(SB), RODATA, $8
+DATA	·libc_vm_deallocate_trampoline_addr(SB)/8, $libc_vm_deallocate_trampoline<>(SB)
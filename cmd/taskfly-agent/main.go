@@ -1,12 +1,11 @@
 package main
 
 import (
-	"archive/tar"
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -16,49 +15,104 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/bundle"
+	"github.com/JustinTimperio/TaskFly/internal/metadata"
 )
 
-const (
+// Version and Commit are stamped by cmd/build-agents with -ldflags -X
+var (
 	Version = "0.1.0"
+	Commit  = ""
 )
 
+// agentVersion returns the version reported to the daemon, with the commit
+// the agent was built from if it is known
+func agentVersion() string {
+	if Commit == "" {
+		return Version
+	}
+	return fmt.Sprintf("%s (%s)", Version, Commit)
+}
+
 type Config struct {
-	Token     string
-	DaemonURL string
-	WorkDir   string
+	Token             string
+	DaemonURL         string
+	DaemonFallbackURL string
+	WorkDir           string
+	WorkDirFromFlag   bool // --workdir was given explicitly and overrides remote_dest_dir
+	BundleCacheDir    string
 }
 
 type RegistrationResponse struct {
-	NodeID       string                 `json:"node_id"`
-	AuthToken    string                 `json:"auth_token"`
-	AssetsURL    string                 `json:"assets_url"`
-	StatusURL    string                 `json:"status_url"`
-	HeartbeatURL string                 `json:"heartbeat_url"`
-	LogsURL      string                 `json:"logs_url"`
-	Config       map[string]interface{} `json:"config"`
+	NodeID         string                 `json:"node_id"`
+	AuthToken      string                 `json:"auth_token"`
+	RefreshToken   string                 `json:"refresh_token"`
+	TokenExpiresAt *time.Time             `json:"token_expires_at"`
+	TokenURL       string                 `json:"token_url"`
+	SigningSecret  string                 `json:"signing_secret"`
+	AssetsURL      string                 `json:"assets_url"`
+	StatusURL      string                 `json:"status_url"`
+	HeartbeatURL   string                 `json:"heartbeat_url"`
+	LogsURL        string                 `json:"logs_url"`
+	ProgressURL    string                 `json:"progress_url"`
+	ArtifactsURL   string                 `json:"artifacts_url"`
+	Config         map[string]interface{} `json:"config"`
+	ConfigVersion  int                    `json:"config_version"`
+	ConfigFiles    []string               `json:"config_files"`
+	RemoteDestDir  string                 `json:"remote_dest_dir"`
+	Script         ScriptSpec             `json:"script"`
+	TelemetryHooks TelemetryHooksSpec     `json:"telemetry_hooks"`
+	Limits         LimitsSpec             `json:"limits"`
+	Debug          bool                   `json:"debug"`
+	BundleDigest   string                 `json:"bundle_digest"`
+}
+
+// ScriptSpec describes the entry script configured via remote_script_to_run.
+// Command, when set from the node's entry_command, replaces the script entirely.
+type ScriptSpec struct {
+	Name        string   `json:"name"`
+	Args        []string `json:"args"`
+	Interpreter string   `json:"interpreter"`
+	Command     []string `json:"command"`
+}
+
+// reservedConfigKeys are node config keys consumed by the agent rather than
+// exported to the workload environment
+var reservedConfigKeys = map[string]bool{
+	"script_args":   true,
+	"entry_command": true,
 }
 
 type StatusUpdate struct {
-	Status  string `json:"status"`
-	Message string `json:"message"`
+	Status   string `json:"status"`
+	Message  string `json:"message"`
+	ExitCode *int   `json:"exit_code,omitempty"`
 }
 
 type SystemMetrics struct {
-	CPUCores    int     `json:"cpu_cores"`
-	CPUUsage    float64 `json:"cpu_usage"`    // percentage
-	MemoryTotal uint64  `json:"memory_total"` // bytes
-	MemoryUsed  uint64  `json:"memory_used"`  // bytes
-	LoadAvg1    float64 `json:"load_avg_1"`   // 1 minute load average
-	LoadAvg5    float64 `json:"load_avg_5"`   // 5 minute load average
-	LoadAvg15   float64 `json:"load_avg_15"`  // 15 minute load average
+	CPUCores    int       `json:"cpu_cores"`
+	CPUUsage    float64   `json:"cpu_usage"`              // percentage
+	CPUPerCore  []float64 `json:"cpu_per_core,omitempty"` // percentage per core
+	MemoryTotal uint64    `json:"memory_total"`           // bytes
+	MemoryUsed  uint64    `json:"memory_used"`            // bytes
+	LoadAvg1    float64   `json:"load_avg_1"`             // 1 minute load average
+	LoadAvg5    float64   `json:"load_avg_5"`             // 5 minute load average
+	LoadAvg15   float64   `json:"load_avg_15"`            // 15 minute load average
+
+	Custom map[string]float64 `json:"custom,omitempty"` // metrics reported by telemetry hooks
 }
 
 type Heartbeat struct {
-	Metrics *SystemMetrics `json:"metrics,omitempty"`
+	Metrics       *SystemMetrics `json:"metrics,omitempty"`
+	HealthChecks  []HealthCheck  `json:"health_checks,omitempty"`
+	ConfigVersion int            `json:"config_version"` // the node config version applied
 }
 
 type LogEntry struct {
@@ -71,25 +125,67 @@ type LogEntry struct {
 type Agent struct {
 	config       Config
 	nodeID       string
-	authToken    string
 	statusURL    string
 	heartbeatURL string
 	logsURL      string
+	progressURL  string
+	artifactsURL string // empty when the daemon has no artifact cache
 	nodeConfig   map[string]interface{}
+	configFiles  map[string]bool // config keys written to files instead of exported
+	destDir      string
+	script       ScriptSpec
 	client       *http.Client
 	workDir      string
 	setupCmd     *exec.Cmd
+	setupDone    chan struct{} // closed once the setup command exited
 	ctx          context.Context
 	cancel       context.CancelFunc
 	logBuffer    []LogEntry
 	logMutex     sync.Mutex
+	logRetryAt   time.Time  // the daemon asked to hold logs until then
+	logsDropped  int        // oldest lines dropped while the buffer was full
+	prevCPUTimes []cpuTimes // previous CPU sample for usage deltas
+	systemInfo   *SystemInfo
+	bundles      *bundleCache
+	bundleDigest string // sha256 of the deployment's bundle, empty with older daemons
+
+	// Credentials, replaced whenever the auth token is refreshed
+	tokenMutex     sync.RWMutex
+	authToken      string
+	refreshToken   string
+	tokenExpiresAt time.Time // zero if the auth token doesn't expire
+	tokenURL       string
+	signingSecret  string // signs requests to the daemon, empty with older daemons
+
+	// debug is set by the deployment's debug: true. It turns on verbose
+	// logging and keeps the working directory.
+	debug          bool
+	createdWorkDir bool // the agent created the working directory
+	completed      bool // the workload finished successfully
+
+	hooks          TelemetryHooksSpec
+	telemetryMutex sync.Mutex
+	customMetrics  map[string]float64
+	healthChecks   []HealthCheck
+
+	limits        LimitsSpec
+	outputBytes   atomic.Int64 // workload output counted against max_output_size
+	limitMutex    sync.Mutex
+	limitExceeded string // the first limit the workload exceeded
+
+	// Node configuration updates arrive with heartbeats
+	configMutex      sync.Mutex
+	configVersion    int
+	configWriteMutex sync.Mutex // serializes writes of the config files
 }
 
 func main() {
 	var config Config
 	flag.StringVar(&config.Token, "token", "", "Provision token")
 	flag.StringVar(&config.DaemonURL, "daemon", "", "Daemon URL")
-	flag.StringVar(&config.WorkDir, "workdir", "", "Working directory (default: /tmp/taskfly-<token>)")
+	flag.StringVar(&config.DaemonFallbackURL, "daemon-fallback", "", "Fallback daemon URL (e.g. internal address for private subnets)")
+	flag.StringVar(&config.WorkDir, "workdir", "", "Working directory, overrides remote_dest_dir (default: remote_dest_dir or taskfly-<token> in the temp directory, the cache directory on Windows)")
+	flag.StringVar(&config.BundleCacheDir, "bundle-cache", defaultBundleCacheDir(), "Directory caching downloaded bundles by digest, empty disables the cache")
 	flag.Parse()
 
 	if config.Token == "" || config.DaemonURL == "" {
@@ -97,13 +193,17 @@ func main() {
 	}
 
 	if config.WorkDir == "" {
-		config.WorkDir = fmt.Sprintf("/tmp/taskfly-%s", config.Token)
+		config.WorkDir = defaultWorkDir(config.Token)
+	} else {
+		config.WorkDirFromFlag = true
 	}
 
-	log.Printf("TaskFly Agent v%s starting...", Version)
+	log.Printf("TaskFly Agent v%s starting...", agentVersion())
 	log.Printf("Daemon URL: %s", config.DaemonURL)
+	if config.DaemonFallbackURL != "" {
+		log.Printf("Fallback Daemon URL: %s", config.DaemonFallbackURL)
+	}
 	log.Printf("Provision Token: %s", config.Token)
-	log.Printf("Working Directory: %s", config.WorkDir)
 
 	agent := NewAgent(config)
 	if err := agent.Run(); err != nil {
@@ -118,8 +218,9 @@ func NewAgent(config Config) *Agent {
 		client: &http.Client{
 			Timeout: 60 * time.Second,
 		},
-		ctx:    ctx,
-		cancel: cancel,
+		ctx:     ctx,
+		cancel:  cancel,
+		bundles: newBundleCache(config.BundleCacheDir),
 	}
 }
 
@@ -130,11 +231,8 @@ func (a *Agent) Run() error {
 
 	defer a.cleanup()
 
-	// Create working directory
-	if err := os.MkdirAll(a.config.WorkDir, 0755); err != nil {
-		return fmt.Errorf("failed to create working directory: %w", err)
-	}
-	a.workDir = a.config.WorkDir
+	// Gather static host facts reported once at registration
+	a.systemInfo = a.collectSystemInfo()
 
 	// Register with daemon
 	log.Println("Registering with daemon...")
@@ -143,19 +241,28 @@ func (a *Agent) Run() error {
 	}
 	log.Printf("Successfully registered as node: %s", a.nodeID)
 
+	// Create working directory, honoring remote_dest_dir from taskfly.yml
+	a.workDir = a.resolveWorkDir()
+	log.Printf("Working Directory: %s", a.workDir)
+
 	// Start heartbeat goroutine
 	go a.heartbeatLoop()
 
+	// Refresh the auth token before it expires
+	go a.tokenRefreshLoop()
+
 	// Start log pushing goroutine
 	go a.logPushLoop()
 
-	// Download bundle
+	// Download bundle, unless this host has it cached
 	if err := a.updateStatus("downloading_assets", "Downloading deployment bundle"); err != nil {
 		log.Printf("Failed to update status: %v", err)
 	}
 
 	bundlePath := filepath.Join(a.workDir, "bundle.tar.gz")
-	if err := a.downloadBundle(bundlePath); err != nil {
+	if a.bundles.fetch(a.bundleDigest, bundlePath) {
+		log.Printf("Using cached bundle %s", a.bundleDigest)
+	} else if err := a.downloadBundle(bundlePath); err != nil {
 		a.updateStatus("failed", fmt.Sprintf("Failed to download bundle: %v", err))
 		return fmt.Errorf("failed to download bundle: %w", err)
 	}
@@ -170,9 +277,23 @@ func (a *Agent) Run() error {
 		return fmt.Errorf("failed to extract bundle: %w", err)
 	}
 
-	// Execute setup script if it exists
-	setupScript := filepath.Join(a.workDir, "setup.sh")
-	if _, err := os.Stat(setupScript); err == nil {
+	// Write the node configuration files before anything reads them
+	if err := a.writeConfigFiles(); err != nil {
+		a.updateStatus("failed", err.Error())
+		return err
+	}
+
+	// Start telemetry hooks shipped in the bundle
+	go a.telemetryLoop()
+
+	// Execute the configured deployment script or entry command
+	setupScript, err := a.resolveScript()
+	if err != nil {
+		a.updateStatus("failed", err.Error())
+		return err
+	}
+
+	if setupScript != "" || len(a.script.Command) > 0 {
 		if err := a.updateStatus("running", "Executing deployment script"); err != nil {
 			log.Printf("Failed to update status: %v", err)
 		}
@@ -182,13 +303,12 @@ func (a *Agent) Run() error {
 			return fmt.Errorf("setup script failed: %w", err)
 		}
 
-		// Monitor setup process
+		// Monitor setup process, which reports how it failed
 		if err := a.monitorSetup(); err != nil {
-			a.updateStatus("failed", fmt.Sprintf("Setup monitoring failed: %v", err))
 			return fmt.Errorf("setup monitoring failed: %w", err)
 		}
 	} else {
-		log.Println("No setup.sh found in bundle, marking as completed")
+		log.Println("No deployment script configured, marking as completed")
 		if err := a.updateStatus("completed", "No deployment script found, node ready"); err != nil {
 			log.Printf("Failed to update status: %v", err)
 		}
@@ -206,9 +326,49 @@ func (a *Agent) Run() error {
 	return nil
 }
 
+// registrationError is a registration the daemon answered with an error status
+type registrationError struct {
+	status int
+	body   string
+}
+
+func (e *registrationError) Error() string {
+	return fmt.Sprintf("registration failed with status %d: %s", e.status, e.body)
+}
+
+// register tries the primary daemon URL first and falls back to the internal URL,
+// sticking with whichever address answered for the rest of the agent's lifetime.
+// A daemon that rejected the provision token or found it already used is not
+// asked again through the fallback.
 func (a *Agent) register() error {
-	payload := map[string]string{
+	err := a.registerWith(a.config.DaemonURL)
+	if err == nil || a.config.DaemonFallbackURL == "" {
+		return err
+	}
+	var rejected *registrationError
+	if errors.As(err, &rejected) && (rejected.status == http.StatusUnauthorized || rejected.status == http.StatusConflict) {
+		return err
+	}
+
+	log.Printf("Registration via %s failed (%v), trying fallback %s", a.config.DaemonURL, err, a.config.DaemonFallbackURL)
+	if fallbackErr := a.registerWith(a.config.DaemonFallbackURL); fallbackErr != nil {
+		return fmt.Errorf("%v; fallback: %w", err, fallbackErr)
+	}
+
+	a.config.DaemonURL = a.config.DaemonFallbackURL
+	return nil
+}
+
+func (a *Agent) registerWith(daemonURL string) error {
+	payload := map[string]interface{}{
 		"provision_token": a.config.Token,
+		"system_info":     a.systemInfo,
+		"cached_bundles":  a.bundles.digests(),
+	}
+	if a.systemInfo != nil && a.systemInfo.Cloud != nil && a.systemInfo.Cloud.Provider == "aws" {
+		if identity := a.getInstanceIdentity(); identity != nil {
+			payload["instance_identity"] = identity
+		}
 	}
 
 	data, err := json.Marshal(payload)
@@ -217,7 +377,7 @@ func (a *Agent) register() error {
 	}
 
 	req, err := http.NewRequestWithContext(a.ctx, "POST",
-		fmt.Sprintf("%s/api/v1/nodes/register", a.config.DaemonURL),
+		fmt.Sprintf("%s/api/v1/nodes/register", daemonURL),
 		bytes.NewReader(data),
 	)
 	if err != nil {
@@ -233,7 +393,7 @@ func (a *Agent) register() error {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("registration failed with status %d: %s", resp.StatusCode, string(body))
+		return &registrationError{status: resp.StatusCode, body: string(body)}
 	}
 
 	var regResp RegistrationResponse
@@ -242,29 +402,128 @@ func (a *Agent) register() error {
 	}
 
 	a.nodeID = regResp.NodeID
-	a.authToken = regResp.AuthToken
+	a.setCredentials(regResp.AuthToken, regResp.RefreshToken, regResp.SigningSecret, regResp.TokenExpiresAt)
 	a.statusURL = regResp.StatusURL
 	a.heartbeatURL = regResp.HeartbeatURL
 	a.nodeConfig = regResp.Config
+	a.configVersion = regResp.ConfigVersion
+	a.configFiles = make(map[string]bool, len(regResp.ConfigFiles))
+	for _, key := range regResp.ConfigFiles {
+		a.configFiles[key] = true
+	}
+	a.destDir = regResp.RemoteDestDir
+	a.script = regResp.Script
+	a.hooks = regResp.TelemetryHooks
+	a.limits = regResp.Limits
+	a.bundleDigest = regResp.BundleDigest
+	if regResp.Debug {
+		a.debug = true
+		log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+		log.Println("Debug logging enabled by the deployment")
+	}
 
 	// Set logs URL (construct if not provided for backward compatibility)
 	if regResp.LogsURL != "" {
 		a.logsURL = regResp.LogsURL
 	} else {
-		a.logsURL = fmt.Sprintf("%s/api/v1/nodes/logs", a.config.DaemonURL)
+		a.logsURL = fmt.Sprintf("%s/api/v1/nodes/logs", daemonURL)
+	}
+	if regResp.TokenURL != "" {
+		a.tokenURL = regResp.TokenURL
+	} else {
+		a.tokenURL = fmt.Sprintf("%s/api/v1/nodes/token", daemonURL)
 	}
+	if regResp.ProgressURL != "" {
+		a.progressURL = regResp.ProgressURL
+	} else {
+		a.progressURL = fmt.Sprintf("%s/api/v1/nodes/progress", daemonURL)
+	}
+	a.artifactsURL = regResp.ArtifactsURL
 
 	log.Printf("Received node configuration with %d keys", len(a.nodeConfig))
+	a.debugf("Registered via %s: remote_dest_dir %q, script %+v, telemetry hooks %+v", daemonURL, a.destDir, a.script, a.hooks)
+	a.debugf("Node configuration: %v", a.nodeConfig)
+	if !a.tokenExpiresAt.IsZero() {
+		a.debugf("Auth token expires at %s", a.tokenExpiresAt.Format(time.RFC3339))
+	}
 
 	return nil
 }
 
+// validateDestDir checks that a configured destination is an absolute,
+// non-system path
+func validateDestDir(dir string) (string, error) {
+	if !filepath.IsAbs(dir) {
+		return "", fmt.Errorf("remote_dest_dir must be an absolute path: %s", dir)
+	}
+
+	cleaned := filepath.Clean(dir)
+	for _, unsafe := range unsafeDestDirs {
+		if samePath(cleaned, unsafe) {
+			return "", fmt.Errorf("remote_dest_dir points at a system directory: %s", cleaned)
+		}
+	}
+
+	return cleaned, nil
+}
+
+// resolveWorkDir picks and creates the working directory. An explicit --workdir
+// wins, then remote_dest_dir from the deployment, then the default temp path.
+// If the configured destination is unusable the agent falls back to the default.
+func (a *Agent) resolveWorkDir() string {
+	candidates := []string{}
+	if a.config.WorkDirFromFlag {
+		candidates = append(candidates, a.config.WorkDir)
+	} else if a.destDir != "" {
+		if dir, err := validateDestDir(a.destDir); err != nil {
+			log.Printf("Ignoring remote_dest_dir: %v", err)
+			a.addLog(fmt.Sprintf("Ignoring remote_dest_dir: %v", err), "stderr")
+		} else {
+			candidates = append(candidates, dir)
+		}
+	}
+	candidates = append(candidates, defaultWorkDir(a.config.Token))
+
+	for i, dir := range candidates {
+		_, statErr := os.Stat(dir)
+		err := os.MkdirAll(dir, 0755)
+		if err == nil {
+			err = checkWritable(dir)
+		}
+		if err == nil {
+			a.createdWorkDir = os.IsNotExist(statErr)
+			return dir
+		}
+		if i < len(candidates)-1 {
+			log.Printf("Working directory %s is not usable (%v), falling back", dir, err)
+			a.addLog(fmt.Sprintf("Working directory %s is not usable (%v), falling back", dir, err), "stderr")
+		}
+	}
+
+	// The last candidate is the default temp path; let later steps surface the error
+	return candidates[len(candidates)-1]
+}
+
+// checkWritable verifies the agent can create files in dir
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".taskfly-write-test-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
 func (a *Agent) updateStatus(status, message string) error {
-	update := StatusUpdate{
+	return a.sendStatus(StatusUpdate{
 		Status:  status,
 		Message: message,
-	}
+	})
+}
 
+// sendStatus posts a status update to the daemon
+func (a *Agent) sendStatus(update StatusUpdate) error {
 	data, err := json.Marshal(update)
 	if err != nil {
 		return fmt.Errorf("failed to marshal status update: %w", err)
@@ -276,7 +535,7 @@ func (a *Agent) updateStatus(status, message string) error {
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", a.authToken))
+	a.authorize(req, data)
 
 	resp, err := a.client.Do(req)
 	if err != nil {
@@ -289,7 +548,7 @@ func (a *Agent) updateStatus(status, message string) error {
 		return fmt.Errorf("status update failed with status %d: %s", resp.StatusCode, string(body))
 	}
 
-	log.Printf("Status updated: %s - %s", status, message)
+	log.Printf("Status updated: %s - %s", update.Status, update.Message)
 	return nil
 }
 
@@ -317,9 +576,16 @@ func (a *Agent) heartbeatLoop() {
 func (a *Agent) sendHeartbeat() error {
 	// Collect system metrics
 	metrics := a.collectMetrics()
+	custom, checks := a.telemetry()
+	if metrics != nil {
+		metrics.Custom = custom
+	}
 
+	_, configVersion := a.currentConfig()
 	hb := Heartbeat{
-		Metrics: metrics,
+		Metrics:       metrics,
+		HealthChecks:  checks,
+		ConfigVersion: configVersion,
 	}
 
 	data, err := json.Marshal(hb)
@@ -333,7 +599,7 @@ func (a *Agent) sendHeartbeat() error {
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", a.authToken))
+	token := a.authorize(req, data)
 
 	resp, err := a.client.Do(req)
 	if err != nil {
@@ -342,7 +608,11 @@ func (a *Agent) sendHeartbeat() error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusUnauthorized {
-		// 401 means our auth token is invalid - deployment was likely terminated
+		if token != a.currentAuthToken() {
+			// The token was refreshed while this heartbeat was in flight
+			return fmt.Errorf("heartbeat sent with a superseded auth token")
+		}
+		// 401 means our auth token is invalid - deployment was likely terminated or the node revoked
 		log.Printf("Heartbeat rejected (401), deployment likely terminated. Shutting down...")
 		a.cancel() // Trigger graceful shutdown
 		return nil
@@ -352,16 +622,29 @@ func (a *Agent) sendHeartbeat() error {
 		return fmt.Errorf("heartbeat failed with status %d", resp.StatusCode)
 	}
 
-	// Parse heartbeat response to check for shutdown signal
+	// Parse heartbeat response to check for shutdown signal and config updates
 	var hbResp struct {
-		Status   string `json:"status"`
-		Shutdown bool   `json:"shutdown"`
+		Status        string                 `json:"status"`
+		Shutdown      bool                   `json:"shutdown"`
+		Config        map[string]interface{} `json:"config"`
+		ConfigVersion int                    `json:"config_version"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&hbResp); err != nil {
 		log.Printf("Warning: failed to decode heartbeat response: %v", err)
 		return nil
 	}
 
+	if metrics != nil {
+		a.debugf("Heartbeat sent: CPU %.1f%%, load %.2f, memory %dMB/%dMB, %d health checks",
+			metrics.CPUUsage, metrics.LoadAvg1, metrics.MemoryUsed/1024/1024, metrics.MemoryTotal/1024/1024, len(checks))
+	} else {
+		a.debugf("Heartbeat sent without metrics, %d health checks", len(checks))
+	}
+
+	if hbResp.Config != nil && hbResp.ConfigVersion > configVersion {
+		a.applyConfig(hbResp.Config, hbResp.ConfigVersion)
+	}
+
 	// If daemon signals shutdown, initiate graceful shutdown
 	if hbResp.Shutdown {
 		log.Println("Received shutdown signal from daemon, initiating graceful shutdown...")
@@ -383,8 +666,12 @@ func (a *Agent) collectMetrics() *SystemMetrics {
 	// Get memory usage
 	metrics.MemoryTotal, metrics.MemoryUsed = a.getMemoryUsage()
 
-	// Get CPU usage (simple approximation based on load avg)
-	if metrics.CPUCores > 0 {
+	// Get CPU usage sampled since the last heartbeat, falling back to an
+	// approximation based on load avg until a second sample exists
+	if usage, perCore, ok := a.getCPUUsage(); ok {
+		metrics.CPUUsage = usage
+		metrics.CPUPerCore = perCore
+	} else if metrics.CPUCores > 0 {
 		metrics.CPUUsage = (metrics.LoadAvg1 / float64(metrics.CPUCores)) * 100
 		if metrics.CPUUsage > 100 {
 			metrics.CPUUsage = 100
@@ -405,7 +692,7 @@ func (a *Agent) downloadBundle(path string) error {
 		return fmt.Errorf("failed to create download request: %w", err)
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", a.authToken))
+	a.authorize(req, nil)
 
 	resp, err := a.client.Do(req)
 	if err != nil {
@@ -430,111 +717,146 @@ func (a *Agent) downloadBundle(path string) error {
 	}
 
 	log.Printf("Bundle downloaded successfully (%d bytes)", written)
+
+	// Older daemons don't send the digest, and their bundles aren't cached
+	if a.bundleDigest == "" {
+		return nil
+	}
+	digest, err := bundle.Digest(path)
+	if err != nil {
+		return fmt.Errorf("failed to hash bundle: %w", err)
+	}
+	if digest != a.bundleDigest {
+		return fmt.Errorf("bundle digest %s does not match %s", digest, a.bundleDigest)
+	}
+	if err := a.bundles.store(digest, path); err != nil {
+		log.Printf("Failed to cache bundle: %v", err)
+	}
 	return nil
 }
 
 func (a *Agent) extractBundle(path string) error {
 	log.Printf("Extracting bundle from: %s", path)
 
-	file, err := os.Open(path)
-	if err != nil {
-		return fmt.Errorf("failed to open bundle: %w", err)
+	// Symlinks, hardlinks, modes and modification times are restored; entries
+	// escaping the working directory fail the extraction
+	extracted, warnings, err := bundle.Extract(path, a.workDir)
+	for _, warning := range warnings {
+		log.Printf("Bundle warning: %s", warning)
+		a.addLog(fmt.Sprintf("Bundle warning: %s", warning), "stderr")
 	}
-	defer file.Close()
-
-	gzr, err := gzip.NewReader(file)
 	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %w", err)
+		return err
 	}
-	defer gzr.Close()
-
-	tr := tar.NewReader(gzr)
 
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("failed to read tar header: %w", err)
-		}
+	log.Printf("Bundle extracted successfully (%d files)", len(extracted))
+	return nil
+}
 
-		target := filepath.Join(a.workDir, header.Name)
+// resolveScript returns the path of the script to execute. A configured
+// remote_script_to_run must exist in the bundle; without one the agent falls
+// back to running setup.sh if present. An empty path means no script to run.
+func (a *Agent) resolveScript() (string, error) {
+	if len(a.script.Command) > 0 {
+		// The node's entry_command replaces the script
+		return "", nil
+	}
 
-		// Ensure the target is within workDir (prevent path traversal)
-		if !filepath.HasPrefix(target, filepath.Clean(a.workDir)+string(os.PathSeparator)) {
-			return fmt.Errorf("illegal file path in archive: %s", header.Name)
+	if a.script.Name == "" {
+		legacy := filepath.Join(a.workDir, "setup.sh")
+		if _, err := os.Stat(legacy); err == nil {
+			return legacy, nil
 		}
+		return "", nil
+	}
 
-		switch header.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(target, 0755); err != nil {
-				return fmt.Errorf("failed to create directory %s: %w", target, err)
-			}
-		case tar.TypeReg:
-			// Ensure parent directory exists
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				return fmt.Errorf("failed to create parent directory for %s: %w", target, err)
-			}
+	scriptPath := filepath.Join(a.workDir, a.script.Name)
+	if !withinDir(a.workDir, scriptPath) {
+		return "", fmt.Errorf("remote_script_to_run '%s' escapes the working directory", a.script.Name)
+	}
 
-			outFile, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
-			if err != nil {
-				return fmt.Errorf("failed to create file %s: %w", target, err)
-			}
+	// The bundle may contain symlinks, so check where the script really lives
+	resolved, err := filepath.EvalSymlinks(scriptPath)
+	if err != nil {
+		return "", fmt.Errorf("remote_script_to_run '%s' not found in bundle", a.script.Name)
+	}
+	workDir, err := filepath.EvalSymlinks(a.workDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve working directory: %w", err)
+	}
+	if !withinDir(workDir, resolved) {
+		return "", fmt.Errorf("remote_script_to_run '%s' escapes the working directory", a.script.Name)
+	}
 
-			if _, err := io.Copy(outFile, tr); err != nil {
-				outFile.Close()
-				return fmt.Errorf("failed to write file %s: %w", target, err)
-			}
-			outFile.Close()
-		default:
-			log.Printf("Skipping unsupported file type %c for %s", header.Typeflag, header.Name)
-		}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", fmt.Errorf("remote_script_to_run '%s' not found in bundle", a.script.Name)
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("remote_script_to_run '%s' is a directory", a.script.Name)
 	}
 
-	log.Println("Bundle extracted successfully")
-	return nil
+	return scriptPath, nil
+}
+
+// withinDir reports whether path lies strictly below dir
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || filepath.IsAbs(rel) {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
 
 func (a *Agent) executeSetup(scriptPath string) error {
-	log.Printf("Executing setup script: %s", scriptPath)
+	if len(a.script.Command) > 0 {
+		log.Printf("Executing entry command: %s", strings.Join(a.script.Command, " "))
+	} else {
+		log.Printf("Executing setup script: %s", scriptPath)
 
-	// Make script executable
-	if err := os.Chmod(scriptPath, 0755); err != nil {
-		return fmt.Errorf("failed to chmod setup script: %w", err)
+		// Make script executable
+		if err := makeExecutable(scriptPath); err != nil {
+			return fmt.Errorf("failed to chmod setup script: %w", err)
+		}
 	}
 
-	// Execute setup script
-	cmd := exec.CommandContext(a.ctx, scriptPath)
+	// Execute the node's entry command, or the setup script through the
+	// configured interpreter or the one its kind calls for
+	var cmd *exec.Cmd
+	if len(a.script.Command) > 0 {
+		args := append(append([]string{}, a.script.Command[1:]...), a.script.Args...)
+		cmd = exec.CommandContext(a.ctx, a.script.Command[0], args...)
+	} else {
+		command, err := interpretedCommand(a.script.Interpreter, scriptPath, a.script.Args)
+		if err != nil {
+			return err
+		}
+		if command != nil {
+			cmd = exec.CommandContext(a.ctx, command[0], command[1:]...)
+		} else if cmd, err = scriptCommand(a.ctx, scriptPath, a.script.Args...); err != nil {
+			return err
+		}
+	}
 	cmd.Dir = a.workDir
+	a.debugf("Running %v in %s", cmd.Args, cmd.Dir)
 
-	// Start with the current environment
+	// Start with the current environment and add the node configuration
 	env := os.Environ()
+	for _, variable := range a.nodeEnv() {
+		env = append(env, variable)
+		log.Printf("Setting env var: %s", variable)
+	}
 
-	// Add node configuration as environment variables
-	// Convert keys to uppercase for consistency
-	for key, value := range a.nodeConfig {
-		// Convert value to string
-		var strValue string
-		switch v := value.(type) {
-		case string:
-			strValue = v
-		case int, int64, float64, bool:
-			strValue = fmt.Sprintf("%v", v)
-		default:
-			// For complex types, try JSON encoding
-			if jsonBytes, err := json.Marshal(v); err == nil {
-				strValue = string(jsonBytes)
-			} else {
-				strValue = fmt.Sprintf("%v", v)
-			}
+	// Let the workload report its progress and share artifacts
+	if serverURL, err := a.startWorkloadServer(); err != nil {
+		log.Printf("Progress reporting unavailable: %v", err)
+	} else {
+		env = append(env, "TASKFLY_PROGRESS_URL="+serverURL+"/progress")
+		log.Printf("Setting env var: TASKFLY_PROGRESS_URL=%s/progress", serverURL)
+		if a.artifactsURL != "" {
+			env = append(env, "TASKFLY_ARTIFACTS_URL="+serverURL+"/artifacts")
+			log.Printf("Setting env var: TASKFLY_ARTIFACTS_URL=%s/artifacts", serverURL)
 		}
-
-		// Convert key to uppercase for environment variable
-		upperKey := strings.ToUpper(key)
-
-		env = append(env, fmt.Sprintf("%s=%s", upperKey, strValue))
-		log.Printf("Setting env var: %s=%s", upperKey, strValue)
 	}
 
 	cmd.Env = env
@@ -555,13 +877,19 @@ func (a *Agent) executeSetup(scriptPath string) error {
 	}
 
 	a.setupCmd = cmd
+	a.setupDone = make(chan struct{})
 	log.Printf("Setup script started with PID: %d", cmd.Process.Pid)
 
+	go a.workdirLimitLoop(a.setupDone)
+
 	// Stream stdout
 	go func() {
 		scanner := bufio.NewScanner(stdoutPipe)
 		for scanner.Scan() {
 			line := scanner.Text()
+			if !a.recordOutput(line) {
+				continue
+			}
 			log.Printf("[STDOUT] %s", line) // Also log locally
 			a.addLog(line, "stdout")
 		}
@@ -572,6 +900,9 @@ func (a *Agent) executeSetup(scriptPath string) error {
 		scanner := bufio.NewScanner(stderrPipe)
 		for scanner.Scan() {
 			line := scanner.Text()
+			if !a.recordOutput(line) {
+				continue
+			}
 			log.Printf("[STDERR] %s", line) // Also log locally
 			a.addLog(line, "stderr")
 		}
@@ -580,13 +911,41 @@ func (a *Agent) executeSetup(scriptPath string) error {
 	return nil
 }
 
+// nodeEnv converts the node configuration to KEY=value environment variables
+// for the workload and telemetry hooks. Keys are upper-cased for consistency
+// and lists are JSON encoded. Keys delivered as files are exported as
+// KEY_FILE with the path of their file instead.
+func (a *Agent) nodeEnv() []string {
+	var env []string
+	config, _ := a.currentConfig()
+	for key, value := range config {
+		if reservedConfigKeys[key] {
+			continue
+		}
+		if a.configFiles[key] {
+			env = append(env, fmt.Sprintf("%s=%s", metadata.FileEnvName(key), filepath.Join(a.configDir(), key)))
+			continue
+		}
+		env = append(env, fmt.Sprintf("%s=%s", metadata.EnvName(key), metadata.EnvValue(value)))
+	}
+	return append(env, "TASKFLY_CONFIG_DIR="+a.configDir())
+}
+
 func (a *Agent) monitorSetup() error {
 	if a.setupCmd == nil {
+		a.updateStatus("failed", "Setup monitoring failed: no setup command to monitor")
 		return fmt.Errorf("no setup command to monitor")
 	}
 
 	// Wait for setup to complete
 	err := a.setupCmd.Wait()
+	close(a.setupDone)
+
+	var exitCode *int
+	if a.setupCmd.ProcessState != nil {
+		code := a.setupCmd.ProcessState.ExitCode()
+		exitCode = &code
+	}
 
 	// Give goroutines a moment to finish reading remaining output
 	time.Sleep(500 * time.Millisecond)
@@ -594,6 +953,16 @@ func (a *Agent) monitorSetup() error {
 	// Push any remaining logs immediately
 	a.pushLogs()
 
+	// A workload stopped for exceeding a limit failed, whatever it exited with
+	if reason := a.exceededLimit(); reason != "" {
+		a.sendStatus(StatusUpdate{
+			Status:   "failed",
+			Message:  reason,
+			ExitCode: exitCode,
+		})
+		return errors.New(reason)
+	}
+
 	if err != nil {
 		// Check if context was cancelled
 		if a.ctx.Err() != nil {
@@ -602,12 +971,21 @@ func (a *Agent) monitorSetup() error {
 		}
 
 		log.Printf("Setup script failed with error: %v", err)
-		a.updateStatus("failed", fmt.Sprintf("Setup script failed: %v", err))
+		a.sendStatus(StatusUpdate{
+			Status:   "failed",
+			Message:  fmt.Sprintf("Setup script failed: %v", err),
+			ExitCode: exitCode,
+		})
 		return fmt.Errorf("setup script exited with error: %w", err)
 	}
 
 	log.Println("Setup script completed successfully")
-	if err := a.updateStatus("completed", "Deployment completed successfully"); err != nil {
+	a.completed = true
+	if err := a.sendStatus(StatusUpdate{
+		Status:   "completed",
+		Message:  "Deployment completed successfully",
+		ExitCode: exitCode,
+	}); err != nil {
 		log.Printf("Warning: Failed to update completion status: %v", err)
 		// Don't return error here as the script itself succeeded
 	}
@@ -633,10 +1011,14 @@ func (a *Agent) logPushLoop() {
 
 func (a *Agent) pushLogs() {
 	a.logMutex.Lock()
-	if len(a.logBuffer) == 0 {
+	if len(a.logBuffer) == 0 || time.Now().Before(a.logRetryAt) {
 		a.logMutex.Unlock()
 		return
 	}
+	if a.logsDropped > 0 {
+		log.Printf("Warning: dropped %d log lines while the daemon wasn't accepting them", a.logsDropped)
+		a.logsDropped = 0
+	}
 
 	// Copy buffer and clear it
 	logsToPush := make([]LogEntry, len(a.logBuffer))
@@ -664,7 +1046,7 @@ func (a *Agent) pushLogs() {
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", a.authToken))
+	a.authorize(req, data)
 
 	resp, err := a.client.Do(req)
 	if err != nil {
@@ -673,7 +1055,12 @@ func (a *Agent) pushLogs() {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		// The daemon is short on memory; keep the lines and back off
+		delay := retryAfter(resp, 30*time.Second)
+		a.requeueLogs(logsToPush, delay)
+		log.Printf("Daemon log buffers are full, holding %d log entries for %s", len(logsToPush), delay)
+	} else if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		log.Printf("Log push failed with status %d: %s", resp.StatusCode, string(body))
 	} else {
@@ -691,12 +1078,56 @@ func (a *Agent) addLog(message, stream string) {
 		Message:   message,
 		Stream:    stream,
 	})
+	a.trimLogBuffer()
+}
+
+// maxBufferedLogs bounds the log lines held while the daemon rejects pushes
+const maxBufferedLogs = 50000
+
+// requeueLogs puts lines the daemon rejected back in front of the buffer and
+// holds them for delay
+func (a *Agent) requeueLogs(logs []LogEntry, delay time.Duration) {
+	a.logMutex.Lock()
+	defer a.logMutex.Unlock()
+
+	a.logBuffer = append(logs, a.logBuffer...)
+	a.logRetryAt = time.Now().Add(delay)
+	a.trimLogBuffer()
+}
+
+// trimLogBuffer drops the oldest lines beyond maxBufferedLogs. Must be called
+// with logMutex held.
+func (a *Agent) trimLogBuffer() {
+	if excess := len(a.logBuffer) - maxBufferedLogs; excess > 0 {
+		a.logBuffer = append(a.logBuffer[:0], a.logBuffer[excess:]...)
+		a.logsDropped += excess
+	}
+}
+
+// retryAfter returns the delay a response's Retry-After header asks for in
+// seconds, or fallback without a usable one
+func retryAfter(resp *http.Response, fallback time.Duration) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// debugf logs a message only when the deployment is debugged
+func (a *Agent) debugf(format string, args ...interface{}) {
+	if a.debug {
+		log.Printf("[DEBUG] "+format, args...)
+	}
 }
 
 func (a *Agent) cleanup() {
 	log.Println("Cleaning up agent resources...")
 
-	// Push any remaining logs
+	// Push any remaining logs, even if the daemon asked to hold them
+	a.logMutex.Lock()
+	a.logRetryAt = time.Time{}
+	a.logMutex.Unlock()
 	a.pushLogs()
 
 	a.cancel()
@@ -704,7 +1135,7 @@ func (a *Agent) cleanup() {
 	// Kill setup process if still running
 	if a.setupCmd != nil && a.setupCmd.Process != nil {
 		log.Printf("Terminating setup process (PID: %d)...", a.setupCmd.Process.Pid)
-		a.setupCmd.Process.Signal(syscall.SIGTERM)
+		terminateProcess(a.setupCmd.Process)
 
 		// Give it 5 seconds to terminate gracefully
 		time.Sleep(5 * time.Second)
@@ -716,10 +1147,18 @@ func (a *Agent) cleanup() {
 		}
 	}
 
-	// Optionally clean up working directory
-	// Commented out for debugging, but you can enable this
-	// log.Printf("Removing working directory: %s", a.workDir)
-	// os.RemoveAll(a.workDir)
+	// Remove the working directory of a successful run if the agent created
+	// it. Failed runs and debugged deployments keep theirs for inspection.
+	if a.completed && a.createdWorkDir {
+		if a.debug {
+			log.Printf("Keeping working directory %s for debugging", a.workDir)
+		} else {
+			log.Printf("Removing working directory: %s", a.workDir)
+			if err := os.RemoveAll(a.workDir); err != nil {
+				log.Printf("Failed to remove working directory: %v", err)
+			}
+		}
+	}
 
 	log.Println("Cleanup complete")
 }
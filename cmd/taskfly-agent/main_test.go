@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveScriptStaysInWorkDir(t *testing.T) {
+	root := t.TempDir()
+	workDir := filepath.Join(root, "work")
+	require.NoError(t, os.MkdirAll(filepath.Join(workDir, "scripts"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(workDir, "scripts", "run.sh"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "outside.sh"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.Symlink("scripts/run.sh", filepath.Join(workDir, "inside.sh")))
+	require.NoError(t, os.Symlink("../outside.sh", filepath.Join(workDir, "escape.sh")))
+	require.NoError(t, os.Symlink("..", filepath.Join(workDir, "up")))
+
+	tests := []struct {
+		name    string
+		script  string
+		wantErr string
+	}{
+		{name: "nested script", script: "scripts/run.sh"},
+		{name: "symlink inside", script: "inside.sh"},
+		{name: "dot dot", script: "../outside.sh", wantErr: "escapes the working directory"},
+		{name: "symlink outside", script: "escape.sh", wantErr: "escapes the working directory"},
+		{name: "symlinked parent", script: "up/outside.sh", wantErr: "escapes the working directory"},
+		{name: "work dir itself", script: ".", wantErr: "escapes the working directory"},
+		{name: "missing", script: "missing.sh", wantErr: "not found in bundle"},
+		{name: "directory", script: "scripts", wantErr: "is a directory"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := &Agent{workDir: workDir, script: ScriptSpec{Name: tt.script}}
+			path, err := agent.resolveScript()
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, filepath.Join(workDir, tt.script), path)
+		})
+	}
+}
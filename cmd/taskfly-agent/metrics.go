@@ -14,3 +14,45 @@ func (a *Agent) getCPUCount() int {
 
 // getMemoryUsage returns total and used memory in bytes
 // Platform-specific implementations in metrics_*.go files
+
+// getCPUUsage returns total and per-core CPU usage percentages since the
+// previous heartbeat, and false when no measurement is available yet
+// Platform-specific implementations in metrics_*.go files
+
+// cpuTimes holds cumulative busy and total CPU time for a single core or,
+// at index 0 of a sample, for all cores combined
+type cpuTimes struct {
+	busy  uint64
+	total uint64
+}
+
+// cpuUsageFromTimes stores the current sample and computes usage against the
+// previous one. The first call only primes the sampler and returns false.
+func (a *Agent) cpuUsageFromTimes(current []cpuTimes) (float64, []float64, bool) {
+	previous := a.prevCPUTimes
+	a.prevCPUTimes = current
+
+	if len(previous) == 0 || len(previous) != len(current) {
+		return 0, nil, false
+	}
+
+	usage := make([]float64, len(current))
+	for i := range current {
+		usage[i] = cpuPercent(previous[i], current[i])
+	}
+
+	return usage[0], usage[1:], true
+}
+
+// cpuPercent returns the busy percentage between two samples of the same CPU
+func cpuPercent(prev, cur cpuTimes) float64 {
+	if cur.total <= prev.total || cur.busy < prev.busy {
+		return 0
+	}
+
+	percent := float64(cur.busy-prev.busy) / float64(cur.total-prev.total) * 100
+	if percent > 100 {
+		percent = 100
+	}
+	return percent
+}
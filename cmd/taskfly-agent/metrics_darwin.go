@@ -98,3 +98,12 @@ func parseVMStatLine(line string) uint64 {
 	}
 	return 0
 }
+
+// getCPUUsage returns total and per-core CPU usage from Mach processor ticks
+func (a *Agent) getCPUUsage() (float64, []float64, bool) {
+	times, err := readProcessorTicks()
+	if err != nil {
+		return 0, nil, false
+	}
+	return a.cpuUsageFromTimes(times)
+}
@@ -82,3 +82,50 @@ func (a *Agent) getMemoryUsage() (uint64, uint64) {
 
 	return memTotal, memUsed
 }
+
+// getCPUUsage returns total and per-core CPU usage sampled from /proc/stat
+func (a *Agent) getCPUUsage() (float64, []float64, bool) {
+	times, err := readProcStat()
+	if err != nil {
+		return 0, nil, false
+	}
+	return a.cpuUsageFromTimes(times)
+}
+
+// readProcStat reads cumulative CPU times from /proc/stat. The aggregate "cpu"
+// line comes first, followed by one "cpuN" line per core.
+func readProcStat() ([]cpuTimes, error) {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var times []cpuTimes
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+
+		// user nice system idle iowait irq softirq steal (guest time is already in user)
+		var t cpuTimes
+		for i, field := range fields[1:] {
+			if i >= 8 {
+				break
+			}
+			value, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				continue
+			}
+			t.total += value
+			if i != 3 && i != 4 { // idle and iowait
+				t.busy += value
+			}
+		}
+		times = append(times, t)
+	}
+
+	return times, scanner.Err()
+}
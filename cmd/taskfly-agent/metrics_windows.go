@@ -3,57 +3,142 @@
 package main
 
 import (
-	"os/exec"
-	"strconv"
-	"strings"
+	"math"
+	"runtime"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
 )
 
-// getLoadAverages returns the system load averages
-// Windows doesn't have a direct equivalent, so we return 0s
+// memoryStatusEx mirrors MEMORYSTATUSEX
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+var procGlobalMemoryStatusEx = windows.NewLazySystemDLL("kernel32.dll").NewProc("GlobalMemoryStatusEx")
+
+// loadEstimator emulates Unix load averages from processor time, since
+// Windows has no run-queue based equivalent
+var loadEstimator struct {
+	sync.Mutex
+	prev                 cpuTimes
+	lastSample           time.Time
+	load1, load5, load15 float64
+}
+
+// getLoadAverages returns exponentially decayed averages of busy cores over
+// 1, 5 and 15 minutes, matching the scale of Unix load averages
 func (a *Agent) getLoadAverages() (float64, float64, float64) {
-	// Windows doesn't have load averages in the Unix sense
-	// Could potentially use performance counters, but for now return 0s
-	return 0, 0, 0
+	times, err := readProcessorTimes()
+	if err != nil {
+		return 0, 0, 0
+	}
+
+	loadEstimator.Lock()
+	defer loadEstimator.Unlock()
+
+	now := time.Now()
+	if !loadEstimator.lastSample.IsZero() {
+		busyCores := cpuPercent(loadEstimator.prev, times[0]) / 100 * float64(len(times)-1)
+		elapsed := now.Sub(loadEstimator.lastSample).Seconds()
+		loadEstimator.load1 = decayLoad(loadEstimator.load1, busyCores, elapsed, 60)
+		loadEstimator.load5 = decayLoad(loadEstimator.load5, busyCores, elapsed, 300)
+		loadEstimator.load15 = decayLoad(loadEstimator.load15, busyCores, elapsed, 900)
+	}
+	loadEstimator.prev = times[0]
+	loadEstimator.lastSample = now
+
+	return loadEstimator.load1, loadEstimator.load5, loadEstimator.load15
 }
 
-// getMemoryUsage returns total and used memory in bytes using wmic
+// decayLoad folds a new observation into an exponentially decayed average
+func decayLoad(current, observed, elapsed, window float64) float64 {
+	factor := math.Exp(-elapsed / window)
+	return current*factor + observed*(1-factor)
+}
+
+// getMemoryUsage returns total and used memory in bytes using GlobalMemoryStatusEx
 func (a *Agent) getMemoryUsage() (uint64, uint64) {
-	// Get total physical memory
-	totalCmd := exec.Command("wmic", "ComputerSystem", "get", "TotalPhysicalMemory")
-	totalOutput, err := totalCmd.Output()
-	if err != nil {
+	var status memoryStatusEx
+	status.Length = uint32(unsafe.Sizeof(status))
+
+	ret, _, _ := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status)))
+	if ret == 0 {
 		return 0, 0
 	}
 
-	var memTotal uint64
-	lines := strings.Split(string(totalOutput), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line != "" && line != "TotalPhysicalMemory" {
-			memTotal, _ = strconv.ParseUint(line, 10, 64)
-			break
-		}
-	}
+	return status.TotalPhys, status.TotalPhys - status.AvailPhys
+}
+
+// systemProcessorPerformanceInformation mirrors SYSTEM_PROCESSOR_PERFORMANCE_INFORMATION.
+// Times are cumulative in 100ns units and KernelTime includes IdleTime.
+type systemProcessorPerformanceInformation struct {
+	IdleTime       int64
+	KernelTime     int64
+	UserTime       int64
+	DpcTime        int64
+	InterruptTime  int64
+	InterruptCount uint32
+}
+
+// systemProcessorPerformanceInformationClass is the SYSTEM_INFORMATION_CLASS
+// value for per-processor time accounting
+const systemProcessorPerformanceInformationClass = 8
 
-	// Get available memory
-	availCmd := exec.Command("wmic", "OS", "get", "FreePhysicalMemory")
-	availOutput, err := availCmd.Output()
+// getCPUUsage returns total and per-core CPU usage from processor time counters
+func (a *Agent) getCPUUsage() (float64, []float64, bool) {
+	times, err := readProcessorTimes()
 	if err != nil {
-		return memTotal, 0
+		return 0, nil, false
 	}
+	return a.cpuUsageFromTimes(times)
+}
+
+// readProcessorTimes reads cumulative per-core CPU times, prefixed with the
+// aggregate across all cores
+func readProcessorTimes() ([]cpuTimes, error) {
+	infos := make([]systemProcessorPerformanceInformation, processorCount())
+	size := uint32(len(infos)) * uint32(unsafe.Sizeof(infos[0]))
+
+	var returned uint32
+	if err := windows.NtQuerySystemInformation(systemProcessorPerformanceInformationClass,
+		unsafe.Pointer(&infos[0]), size, &returned); err != nil {
+		return nil, err
+	}
+	infos = infos[:returned/uint32(unsafe.Sizeof(infos[0]))]
 
-	var memFree uint64
-	lines = strings.Split(string(availOutput), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line != "" && line != "FreePhysicalMemory" {
-			// FreePhysicalMemory is in KB, convert to bytes
-			memFreeKB, _ := strconv.ParseUint(line, 10, 64)
-			memFree = memFreeKB * 1024
-			break
+	times := make([]cpuTimes, 1, len(infos)+1)
+	for _, info := range infos {
+		total := uint64(info.KernelTime + info.UserTime)
+		idle := uint64(info.IdleTime)
+		core := cpuTimes{total: total}
+		if total > idle {
+			core.busy = total - idle
 		}
+		times[0].busy += core.busy
+		times[0].total += core.total
+		times = append(times, core)
 	}
 
-	memUsed := memTotal - memFree
-	return memTotal, memUsed
+	return times, nil
+}
+
+// processorCount returns the number of logical processors to query. Processor
+// groups beyond 64 cores are not covered by the legacy information class.
+func processorCount() int {
+	cores := runtime.NumCPU()
+	if cores > 64 {
+		cores = 64
+	}
+	return cores
 }
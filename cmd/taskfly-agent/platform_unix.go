@@ -0,0 +1,51 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// honorsShebang is whether the kernel runs scripts by their shebang line
+const honorsShebang = true
+
+// unsafeDestDirs are system locations a deployment must never be extracted into
+var unsafeDestDirs = []string{"/", "/bin", "/boot", "/dev", "/etc", "/lib", "/lib64",
+	"/proc", "/root", "/sbin", "/sys", "/usr", "/usr/bin", "/usr/lib", "/usr/sbin", "/var"}
+
+// defaultWorkDir returns the per-token working directory used when no
+// destination is configured
+func defaultWorkDir(token string) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("taskfly-%s", token))
+}
+
+// samePath reports whether two cleaned paths name the same location
+func samePath(a, b string) bool {
+	return a == b
+}
+
+// makeExecutable sets the executable bits of a script shipped in the bundle
+func makeExecutable(path string) error {
+	return os.Chmod(path, 0755)
+}
+
+// restrictToOwner limits access to a file or directory to the agent's user.
+// The permissions it was created with already do that.
+func restrictToOwner(path string) error {
+	return nil
+}
+
+// scriptCommand builds the command running a script or executable directly
+func scriptCommand(ctx context.Context, path string, args ...string) (*exec.Cmd, error) {
+	return exec.CommandContext(ctx, path, args...), nil
+}
+
+// terminateProcess asks a process to stop
+func terminateProcess(process *os.Process) error {
+	return process.Signal(syscall.SIGTERM)
+}
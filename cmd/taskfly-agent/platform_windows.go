@@ -0,0 +1,103 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// honorsShebang is whether Windows ignores shebang lines and runs scripts by extension
+const honorsShebang = false
+
+// unsafeDestDirs are system locations a deployment must never be extracted into
+var unsafeDestDirs = windowsSystemDirs()
+
+// windowsSystemDirs lists the drive root and the system directories of the
+// host, falling back to their usual locations
+func windowsSystemDirs() []string {
+	drive := os.Getenv("SystemDrive")
+	if drive == "" {
+		drive = "C:"
+	}
+	dirs := []string{drive + `\`}
+	for variable, fallback := range map[string]string{
+		"SystemRoot":        `\Windows`,
+		"ProgramFiles":      `\Program Files`,
+		"ProgramFiles(x86)": `\Program Files (x86)`,
+		"ProgramData":       `\ProgramData`,
+	} {
+		dir := os.Getenv(variable)
+		if dir == "" {
+			dir = drive + fallback
+		}
+		dirs = append(dirs, filepath.Clean(dir))
+	}
+	return append(dirs, filepath.Join(drive+`\`, "Users"))
+}
+
+// defaultWorkDir returns the per-token working directory used when no
+// destination is configured. It lives in the user's cache directory, since
+// the temp directory of service accounts is shared and often cleaned.
+func defaultWorkDir(token string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "taskfly", fmt.Sprintf("taskfly-%s", token))
+}
+
+// samePath reports whether two cleaned paths name the same location; Windows
+// paths are case-insensitive
+func samePath(a, b string) bool {
+	return strings.EqualFold(a, b)
+}
+
+// makeExecutable does nothing, Windows decides by extension what runs
+func makeExecutable(path string) error {
+	return nil
+}
+
+// restrictToOwner limits access to a file or directory to the agent's user.
+// Windows ignores permission bits, so inherited ACL entries are replaced with
+// one granting the user full control.
+func restrictToOwner(path string) error {
+	current, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("failed to look up current user: %w", err)
+	}
+	output, err := exec.Command("icacls", path, "/inheritance:r", "/grant:r", current.Username+":(OI)(CI)F").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("icacls failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// scriptCommand builds the command running a script or executable. PowerShell
+// scripts run through powershell.exe, shell scripts through bash (Git Bash,
+// MSYS2 or WSL) if it is installed. Executables, .bat and .cmd files run
+// directly.
+func scriptCommand(ctx context.Context, path string, args ...string) (*exec.Cmd, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ps1":
+		return exec.CommandContext(ctx, "powershell.exe", append([]string{"-NoProfile", "-ExecutionPolicy", "Bypass", "-File", path}, args...)...), nil
+	case ".sh":
+		bash, err := exec.LookPath("bash")
+		if err != nil {
+			return nil, fmt.Errorf("%s is a shell script, but bash is not installed; install Git Bash or set remote_script_interpreter", filepath.Base(path))
+		}
+		return exec.CommandContext(ctx, bash, append([]string{filepath.ToSlash(path)}, args...)...), nil
+	}
+	return exec.CommandContext(ctx, path, args...), nil
+}
+
+// terminateProcess stops a process. Windows can't deliver SIGTERM, so the
+// process is killed.
+func terminateProcess(process *os.Process) error {
+	return process.Kill()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ProgressUpdate is a completion percentage reported by the workload
+type ProgressUpdate struct {
+	Progress float64 `json:"progress"`
+	Message  string  `json:"message,omitempty"`
+}
+
+// startWorkloadServer listens on the loopback interface for progress updates
+// and artifact transfers from the workload and returns its base URL, which
+// TASKFLY_PROGRESS_URL and TASKFLY_ARTIFACTS_URL are built from. Scripts
+// don't need the node's auth token; the agent adds it when relaying requests
+// to the daemon.
+func (a *Agent) startWorkloadServer() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("failed to listen for progress updates: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/progress", a.handleProgress)
+	mux.HandleFunc("/artifacts/", a.handleArtifact)
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		<-a.ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Workload server stopped: %v", err)
+		}
+	}()
+
+	return "http://" + listener.Addr().String(), nil
+}
+
+// handleProgress accepts a JSON body ({"progress": 42, "message": "..."}) or
+// form values (progress=42&message=...) and relays them to the daemon
+func (a *Agent) handleProgress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	update, err := parseProgress(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := a.sendProgress(update); err != nil {
+		log.Printf("Failed to report progress: %v", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	a.debugf("Relayed progress %.1f%%: %s", update.Progress, update.Message)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseProgress reads a progress update from a request
+func parseProgress(r *http.Request) (ProgressUpdate, error) {
+	var update ProgressUpdate
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var body struct {
+			Progress *float64 `json:"progress"`
+			Message  string   `json:"message"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&body); err != nil {
+			return update, fmt.Errorf("invalid JSON: %v", err)
+		}
+		if body.Progress == nil {
+			return update, fmt.Errorf("progress is required")
+		}
+		update.Progress = *body.Progress
+		update.Message = body.Message
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return update, fmt.Errorf("invalid form: %v", err)
+		}
+		value, err := strconv.ParseFloat(strings.TrimSuffix(r.Form.Get("progress"), "%"), 64)
+		if err != nil {
+			return update, fmt.Errorf("progress must be a number between 0 and 100")
+		}
+		update.Progress = value
+		update.Message = r.Form.Get("message")
+	}
+
+	if update.Progress < 0 || update.Progress > 100 {
+		return update, fmt.Errorf("progress must be between 0 and 100")
+	}
+	return update, nil
+}
+
+// sendProgress posts a progress update to the daemon
+func (a *Agent) sendProgress(update ProgressUpdate) error {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return fmt.Errorf("failed to marshal progress update: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(a.ctx, "POST", a.progressURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create progress request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	a.authorize(req, data)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("progress request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("progress update failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// SystemInfo holds static host facts reported once at registration
+type SystemInfo struct {
+	Hostname      string         `json:"hostname,omitempty"`
+	OS            string         `json:"os"`
+	OSVersion     string         `json:"os_version,omitempty"`
+	KernelVersion string         `json:"kernel_version,omitempty"`
+	Arch          string         `json:"arch"`
+	CPUModel      string         `json:"cpu_model,omitempty"`
+	CPUCores      int            `json:"cpu_cores"`
+	MemoryTotal   uint64         `json:"memory_total"` // bytes
+	DiskTotal     uint64         `json:"disk_total"`   // bytes, root filesystem
+	BootTime      time.Time      `json:"boot_time,omitzero"`
+	AgentVersion  string         `json:"agent_version,omitempty"`
+	Cloud         *CloudMetadata `json:"cloud,omitempty"`
+}
+
+// CloudMetadata describes the cloud instance the agent is running on
+type CloudMetadata struct {
+	Provider         string `json:"provider"`
+	InstanceID       string `json:"instance_id,omitempty"`
+	InstanceType     string `json:"instance_type,omitempty"`
+	Region           string `json:"region,omitempty"`
+	AvailabilityZone string `json:"availability_zone,omitempty"`
+	ImageID          string `json:"image_id,omitempty"`
+}
+
+// InstanceIdentity is the EC2 instance identity document and its base64
+// RSA-SHA256 signature
+type InstanceIdentity struct {
+	Document  string `json:"document"`
+	Signature string `json:"signature"`
+}
+
+// ec2MetadataURL is the EC2 instance metadata service endpoint
+const ec2MetadataURL = "http://169.254.169.254/latest"
+
+// collectSystemInfo gathers host inventory. Every field is best effort, so a
+// fact that cannot be read is simply left empty.
+func (a *Agent) collectSystemInfo() *SystemInfo {
+	memTotal, _ := a.getMemoryUsage()
+	hostname, _ := os.Hostname()
+
+	return &SystemInfo{
+		Hostname:      hostname,
+		OS:            runtime.GOOS,
+		OSVersion:     getOSVersion(),
+		KernelVersion: getKernelVersion(),
+		Arch:          runtime.GOARCH,
+		CPUModel:      getCPUModel(),
+		CPUCores:      a.getCPUCount(),
+		MemoryTotal:   memTotal,
+		DiskTotal:     getDiskTotal(),
+		BootTime:      getBootTime(),
+		AgentVersion:  agentVersion(),
+		Cloud:         a.getCloudMetadata(),
+	}
+}
+
+// Platform-specific implementations in sysinfo_*.go files:
+// getOSVersion, getKernelVersion, getCPUModel, getBootTime and getDiskTotal
+
+// getCloudMetadata queries the EC2 instance metadata service (IMDSv2) and
+// returns nil when the agent is not running on EC2
+func (a *Agent) getCloudMetadata() *CloudMetadata {
+	ctx, cancel := context.WithTimeout(a.ctx, 2*time.Second)
+	defer cancel()
+
+	read, ok := ec2Metadata(ctx)
+	if !ok {
+		return nil
+	}
+	get := func(path string) string { return strings.TrimSpace(read(path)) }
+
+	return &CloudMetadata{
+		Provider:         "aws",
+		InstanceID:       get("meta-data/instance-id"),
+		InstanceType:     get("meta-data/instance-type"),
+		Region:           get("meta-data/placement/region"),
+		AvailabilityZone: get("meta-data/placement/availability-zone"),
+		ImageID:          get("meta-data/ami-id"),
+	}
+}
+
+// getInstanceIdentity fetches the signed instance identity document, which
+// lets the daemon verify the agent runs on the instance launched for its node
+func (a *Agent) getInstanceIdentity() *InstanceIdentity {
+	ctx, cancel := context.WithTimeout(a.ctx, 2*time.Second)
+	defer cancel()
+
+	get, ok := ec2Metadata(ctx)
+	if !ok {
+		return nil
+	}
+
+	identity := &InstanceIdentity{
+		Document:  get("dynamic/instance-identity/document"),
+		Signature: get("dynamic/instance-identity/signature"),
+	}
+	if identity.Document == "" || identity.Signature == "" {
+		return nil
+	}
+	return identity
+}
+
+// ec2Metadata requests an IMDSv2 session token and returns a function reading
+// paths below /latest. Values are returned as served, since the identity
+// signature covers the exact document. ok is false when the agent is not
+// running on EC2.
+func ec2Metadata(ctx context.Context) (get func(path string) string, ok bool) {
+	client := &http.Client{}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", ec2MetadataURL+"/api/token", nil)
+	if err != nil {
+		return nil, false
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return nil, false
+	}
+	token := string(body)
+
+	get = func(path string) string {
+		req, err := http.NewRequestWithContext(ctx, "GET", ec2MetadataURL+"/"+path, nil)
+		if err != nil {
+			return ""
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return ""
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return ""
+		}
+		value, _ := io.ReadAll(resp.Body)
+		return string(value)
+	}
+	return get, true
+}
@@ -0,0 +1,56 @@
+//go:build darwin
+
+package main
+
+import (
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getOSVersion returns the macOS product version using sw_vers
+func getOSVersion() string {
+	output, err := exec.Command("sw_vers", "-productVersion").Output()
+	if err != nil {
+		return ""
+	}
+	return "macOS " + strings.TrimSpace(string(output))
+}
+
+// getKernelVersion returns the Darwin kernel release using sysctl
+func getKernelVersion() string {
+	return sysctlString("kern.osrelease")
+}
+
+// getCPUModel returns the processor brand string using sysctl
+func getCPUModel() string {
+	return sysctlString("machdep.cpu.brand_string")
+}
+
+// bootTimePattern extracts seconds from "{ sec = 1700000000, usec = 0 } ..."
+var bootTimePattern = regexp.MustCompile(`sec = (\d+)`)
+
+// getBootTime returns when the system booted using sysctl kern.boottime
+func getBootTime() time.Time {
+	match := bootTimePattern.FindStringSubmatch(sysctlString("kern.boottime"))
+	if match == nil {
+		return time.Time{}
+	}
+
+	seconds, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+// sysctlString reads a single sysctl value
+func sysctlString(name string) string {
+	output, err := exec.Command("sysctl", "-n", name).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
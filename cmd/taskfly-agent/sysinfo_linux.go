@@ -0,0 +1,85 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getOSVersion returns the distribution name from /etc/os-release
+func getOSVersion() string {
+	file, err := os.Open("/etc/os-release")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "PRETTY_NAME="); ok {
+			return strings.Trim(value, `"`)
+		}
+	}
+
+	return ""
+}
+
+// getKernelVersion returns the running kernel release
+func getKernelVersion() string {
+	data, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// getCPUModel returns the processor name from /proc/cpuinfo
+func getCPUModel() string {
+	file, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+
+		// x86 reports "model name", most ARM kernels only "Model" or "Hardware"
+		switch strings.TrimSpace(key) {
+		case "model name", "Model", "Hardware":
+			return strings.TrimSpace(value)
+		}
+	}
+
+	return ""
+}
+
+// getBootTime returns when the system booted from the btime line of /proc/stat
+func getBootTime() time.Time {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "btime "); ok {
+			seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return time.Time{}
+			}
+			return time.Unix(seconds, 0)
+		}
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package main
+
+import "syscall"
+
+// getDiskTotal returns the size of the root filesystem in bytes
+func getDiskTotal() uint64 {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs("/", &stat); err != nil {
+		return 0
+	}
+	return stat.Blocks * uint64(stat.Bsize)
+}
@@ -0,0 +1,75 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+var procGetTickCount64 = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetTickCount64")
+
+// getOSVersion returns the Windows product name from the registry
+func getOSVersion() string {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\Windows NT\CurrentVersion`, registry.QUERY_VALUE)
+	if err != nil {
+		return ""
+	}
+	defer key.Close()
+
+	name, _, err := key.GetStringValue("ProductName")
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// getKernelVersion returns the NT version and build number using RtlGetVersion
+func getKernelVersion() string {
+	info := windows.RtlGetVersion()
+	return fmt.Sprintf("%d.%d.%d", info.MajorVersion, info.MinorVersion, info.BuildNumber)
+}
+
+// getCPUModel returns the processor name from the registry
+func getCPUModel() string {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `HARDWARE\DESCRIPTION\System\CentralProcessor\0`, registry.QUERY_VALUE)
+	if err != nil {
+		return ""
+	}
+	defer key.Close()
+
+	name, _, err := key.GetStringValue("ProcessorNameString")
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// getBootTime derives when the system booted from GetTickCount64
+func getBootTime() time.Time {
+	ticks, _, _ := procGetTickCount64.Call()
+	return time.Now().Add(-time.Duration(ticks) * time.Millisecond).Truncate(time.Second)
+}
+
+// getDiskTotal returns the size of the system drive in bytes
+func getDiskTotal() uint64 {
+	drive := os.Getenv("SystemDrive")
+	if drive == "" {
+		drive = "C:"
+	}
+
+	path, err := windows.UTF16PtrFromString(drive + `\`)
+	if err != nil {
+		return 0
+	}
+
+	var freeAvailable, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &freeAvailable, &total, &totalFree); err != nil {
+		return 0
+	}
+	return total
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/signing"
+)
+
+// tokenRetryInterval is how long to wait after a failed token refresh
+const tokenRetryInterval = 30 * time.Second
+
+// setCredentials replaces the node's credentials. expiresAt is nil when the
+// daemon doesn't expire auth tokens.
+func (a *Agent) setCredentials(authToken, refreshToken, signingSecret string, expiresAt *time.Time) {
+	a.tokenMutex.Lock()
+	defer a.tokenMutex.Unlock()
+
+	a.authToken = authToken
+	a.refreshToken = refreshToken
+	a.signingSecret = signingSecret
+	a.tokenExpiresAt = time.Time{}
+	if expiresAt != nil {
+		a.tokenExpiresAt = *expiresAt
+	}
+}
+
+// currentAuthToken returns the auth token requests are currently sent with
+func (a *Agent) currentAuthToken() string {
+	a.tokenMutex.RLock()
+	defer a.tokenMutex.RUnlock()
+	return a.authToken
+}
+
+// authorize adds the auth token and, when the daemon issued a signing secret,
+// the signature headers to a request to the daemon. body must be the request's
+// body, or nil for requests without one. Returns the auth token used.
+func (a *Agent) authorize(req *http.Request, body []byte) string {
+	a.tokenMutex.RLock()
+	defer a.tokenMutex.RUnlock()
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", a.authToken))
+	if a.signingSecret != "" {
+		signing.SignRequest(req, a.signingSecret, body, time.Now())
+	}
+	return a.authToken
+}
+
+// authorizeDigest is authorize for a body streamed from disk, signed by its
+// SHA-256
+func (a *Agent) authorizeDigest(req *http.Request, bodyHash []byte) string {
+	a.tokenMutex.RLock()
+	defer a.tokenMutex.RUnlock()
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", a.authToken))
+	if a.signingSecret != "" {
+		signing.SignRequestDigest(req, a.signingSecret, bodyHash, time.Now())
+	}
+	return a.authToken
+}
+
+// tokenRefreshLoop refreshes the auth token before it expires. Daemons that
+// don't expire tokens never issue an expiry, and the loop exits immediately.
+func (a *Agent) tokenRefreshLoop() {
+	for {
+		a.tokenMutex.RLock()
+		expiresAt := a.tokenExpiresAt
+		a.tokenMutex.RUnlock()
+		if expiresAt.IsZero() {
+			return
+		}
+
+		// Refresh with a fifth of the lifetime to spare, so heartbeats never
+		// race the expiry
+		wait := time.Until(expiresAt) * 4 / 5
+		a.debugf("Refreshing auth token in %s", wait.Round(time.Second))
+
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if err := a.refreshAuthToken(); err != nil {
+			log.Printf("Failed to refresh auth token: %v", err)
+
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-time.After(tokenRetryInterval):
+			}
+			continue
+		}
+		log.Printf("Refreshed auth token")
+	}
+}
+
+// refreshAuthToken exchanges the refresh token for a new set of credentials.
+// The request is signed with the current signing secret, and the refresh
+// token it returns replaces the one used.
+func (a *Agent) refreshAuthToken() error {
+	a.tokenMutex.RLock()
+	data, err := json.Marshal(map[string]string{"refresh_token": a.refreshToken})
+	a.tokenMutex.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal refresh request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(a.ctx, "POST", a.tokenURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create refresh request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	a.authorize(req, data)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("refresh request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("refresh failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var token struct {
+		AuthToken      string     `json:"auth_token"`
+		RefreshToken   string     `json:"refresh_token"`
+		TokenExpiresAt *time.Time `json:"token_expires_at"`
+		SigningSecret  string     `json:"signing_secret"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("failed to decode refresh response: %w", err)
+	}
+
+	a.setCredentials(token.AuthToken, token.RefreshToken, token.SigningSecret, token.TokenExpiresAt)
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/pterm/pterm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// exportDeploymentCommand downloads a deployment archive: the deployment's
+// taskfly.yml, application files and metadata, ready for import-deployment
+func exportDeploymentCommand(c *cli.Context) error {
+	if c.Bool("verbose") {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	id := c.String("id")
+	resp, err := http.Get(getDaemonURL(c) + "/api/v1/deployments/" + url.PathEscape(id) + "/archive")
+	if err != nil {
+		return fmt.Errorf("failed to export deployment: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusNotFound {
+			return notFoundError("deployment", id)
+		}
+		return fmt.Errorf("failed to export deployment: %s", string(body))
+	}
+
+	output := c.String("out")
+	if output == "" {
+		output = id + ".taskfly.tar.gz"
+	}
+	file, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	pterm.Success.Printfln("Exported deployment %s to %s", id, output)
+	pterm.Info.Printfln("Run it on another daemon with: taskfly --context <name> import-deployment %s", output)
+	return nil
+}
+
+// importDeploymentCommand uploads a deployment archive, creating a new
+// deployment with the exported configuration and files on fresh nodes
+func importDeploymentCommand(c *cli.Context) error {
+	if c.Bool("verbose") {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	if c.NArg() != 1 {
+		return fmt.Errorf("usage: taskfly import-deployment [--keep-failed 2h] [--var name=value] <archive>")
+	}
+	archivePath := c.Args().First()
+	if _, err := os.Stat(archivePath); err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	// Archives carry the values of their variables, except sensitive ones
+	opts := uploadFlags(c)
+	vars, err := givenVariables(c, nil)
+	if err != nil {
+		return configError(err)
+	}
+	if len(vars) > 0 {
+		opts.Variables = vars
+	}
+
+	fmt.Println("⬆️ Uploading deployment archive to daemon...")
+	resp, err := uploadBundle(context.Background(), getDaemonURL(c), archivePath, opts)
+	if err != nil {
+		return fmt.Errorf("failed to upload archive: %w", err)
+	}
+	if message, ok := resp["error"].(string); ok {
+		return withExitCode(exitRejected, fmt.Errorf("failed to import deployment: %s", message))
+	}
+
+	fmt.Printf("✅ Deployment created: %s\n", resp["deployment_id"])
+	if source, ok := resp["imported_from"].(map[string]interface{}); ok {
+		fmt.Printf("📥 Imported from: %s\n", formatImportSource(source))
+	} else {
+		pterm.Warning.Println("The archive has no export metadata, it was deployed as a plain bundle")
+	}
+	fmt.Printf("📊 Status URL: %s\n", resp["status_url"])
+	if warnings, ok := resp["policy_warnings"].([]interface{}); ok {
+		for _, warning := range warnings {
+			pterm.Warning.Printfln("Policy: %v", warning)
+		}
+	}
+	return nil
+}
+
+// formatImportSource describes the deployment an imported one was exported
+// from, e.g. "dep_123 on http://10.0.0.1:8080"
+func formatImportSource(source map[string]interface{}) string {
+	text := fmt.Sprintf("%v", source["deployment_id"])
+	if daemon, ok := source["daemon"].(string); ok && daemon != "" {
+		text += " on " + daemon
+	}
+	return text
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/units"
+	"github.com/pterm/pterm"
+	"github.com/urfave/cli/v2"
+)
+
+// artifactsListCommand lists the artifacts the nodes of a deployment stored
+func artifactsListCommand(c *cli.Context) error {
+	id := c.String("id")
+
+	resp, err := http.Get(getDaemonURL(c) + "/api/v1/deployments/" + url.PathEscape(id) + "/artifacts")
+	if err != nil {
+		return fmt.Errorf("failed to list artifacts: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var result struct {
+		Artifacts []struct {
+			Key       string    `json:"key"`
+			Size      int64     `json:"size"`
+			NodeID    string    `json:"node_id"`
+			CreatedAt time.Time `json:"created_at"`
+			ExpiresAt time.Time `json:"expires_at"`
+		} `json:"artifacts"`
+		UsedBytes int64  `json:"used_bytes"`
+		MaxBytes  int64  `json:"max_bytes"`
+		Storage   string `json:"storage"`
+		Error     string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return notFoundError("deployment", id)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to list artifacts: %s", result.Error)
+	}
+
+	if quiet {
+		for _, artifact := range result.Artifacts {
+			printIDs(artifact.Key)
+		}
+		return nil
+	}
+
+	if len(result.Artifacts) == 0 {
+		pterm.Info.Println("The deployment stored no artifacts")
+		return nil
+	}
+
+	tableData := pterm.TableData{{"Key", "Size", "Node", "Stored", "Expires"}}
+	for _, artifact := range result.Artifacts {
+		tableData = append(tableData, []string{
+			artifact.Key,
+			units.FormatSize(artifact.Size),
+			artifact.NodeID,
+			artifact.CreatedAt.Local().Format("2006-01-02 15:04:05"),
+			artifact.ExpiresAt.Local().Format("2006-01-02 15:04:05"),
+		})
+	}
+	if err := renderTable(tableData); err != nil {
+		return err
+	}
+
+	fmt.Printf("\n%s of %s used, kept in %s\n", units.FormatSize(result.UsedBytes), units.FormatSize(result.MaxBytes), result.Storage)
+	return nil
+}
+
+// artifactsURLCommand prints a signed URL anyone can download an artifact
+// from until it expires, for handing results to other tools
+func artifactsURLCommand(c *cli.Context) error {
+	id, key := c.String("id"), c.String("key")
+
+	query := url.Values{"ttl": {c.Duration("ttl").String()}}
+	resp, err := http.Get(getDaemonURL(c) + "/api/v1/deployments/" + url.PathEscape(id) + "/artifacts/" + url.PathEscape(key) + "/url?" + query.Encode())
+	if err != nil {
+		return fmt.Errorf("failed to get artifact URL: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var result struct {
+		URL       string    `json:"url"`
+		ExpiresAt time.Time `json:"expires_at"`
+		Error     string    `json:"error"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return withExitCode(exitNotFound, fmt.Errorf("failed to get artifact URL: %s", result.Error))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get artifact URL: %s", result.Error)
+	}
+
+	// Written past --quiet, which leaves only the URL for scripts
+	fmt.Fprintln(stdout, result.URL)
+	pterm.Info.Printfln("Valid until %s", result.ExpiresAt.Local().Format("2006-01-02 15:04:05"))
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/pterm/pterm"
+	"github.com/urfave/cli/v2"
+)
+
+// bakeCommand snapshots a node of a deployment into a machine image that
+// later deployments can use as image_id
+func bakeCommand(c *cli.Context) error {
+	id := c.String("id")
+	node := c.String("node")
+
+	form := url.Values{}
+	form.Set("node", node)
+	form.Set("name", c.String("name"))
+	form.Set("reboot", strconv.FormatBool(c.Bool("reboot")))
+
+	resp, err := http.PostForm(getDaemonURL(c)+"/api/v1/deployments/"+url.PathEscape(id)+"/bake", form)
+	if err != nil {
+		return fmt.Errorf("failed to bake image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var result map[string]string
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("failed to bake image: %s", result["error"])
+	}
+
+	pterm.Success.Printfln("Baking image %s from node %s (instance %s)", result["image_id"], result["node_id"], result["instance_id"])
+	pterm.Info.Println("The image is usable once its snapshots complete, which takes several minutes")
+	fmt.Printf("\nUse it in taskfly.yml:\n  image_id: \"%s\"\n", result["image_id"])
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/JustinTimperio/TaskFly/internal/bundle"
+	"github.com/JustinTimperio/TaskFly/internal/units"
+	"github.com/pterm/pterm"
+	"github.com/urfave/cli/v2"
+)
+
+// bundleBuildCommand creates the bundle taskfly up would upload, without
+// deploying it
+func bundleBuildCommand(c *cli.Context) error {
+	config, err := loadConfig("taskfly.yml")
+	if err != nil {
+		return configError(fmt.Errorf("failed to load config: %w", err))
+	}
+
+	bundlePath, err := createBundle(config, bundle.Format(c.String("format")))
+	if err != nil {
+		return fmt.Errorf("failed to create bundle: %w", err)
+	}
+
+	manifest, err := bundle.Inspect(bundlePath)
+	if err != nil {
+		return err
+	}
+
+	pterm.Success.Printfln("Created %s", bundlePath)
+	fmt.Printf("Files: %d\n", len(manifest.Files))
+	fmt.Printf("Size: %s\n", units.FormatSize(manifest.Size))
+	fmt.Printf("SHA-256: %s\n", manifest.SHA256)
+	return nil
+}
+
+// bundleInspectCommand lists the files of a local bundle, or of the bundle
+// stored for a deployment with --id
+func bundleInspectCommand(c *cli.Context) error {
+	id := c.String("id")
+	path := c.Args().First()
+	if (id == "") == (path == "") {
+		return fmt.Errorf("pass either a bundle file or --id <deployment-id>")
+	}
+
+	var manifest *bundle.Manifest
+	var err error
+	if id != "" {
+		manifest, err = fetchBundleManifest(c, id)
+		pterm.DefaultSection.Printfln("Bundle of deployment %s", id)
+	} else {
+		manifest, err = bundle.Inspect(path)
+		pterm.DefaultSection.Printfln("Bundle %s", path)
+	}
+	if err != nil {
+		return err
+	}
+
+	tableData := pterm.TableData{{"Path", "Size", "Mode", "SHA-256"}}
+	for _, file := range manifest.Files {
+		if file.Link != "" {
+			tableData = append(tableData, []string{file.Path + " -> " + file.Link, "-", file.Mode, "-"})
+			continue
+		}
+		tableData = append(tableData, []string{file.Path, units.FormatSize(file.Size), file.Mode, file.SHA256})
+	}
+	if err := renderTable(tableData); err != nil {
+		return err
+	}
+
+	fmt.Printf("\n%d files, %s compressed\n", len(manifest.Files), units.FormatSize(manifest.Size))
+	fmt.Printf("Bundle SHA-256: %s\n", manifest.SHA256)
+	if id != "" {
+		pterm.Info.Println("The daemon stores the bundle without taskfly.yml, so its digest differs from the bundle that was uploaded. Compare file digests instead.")
+	}
+	return nil
+}
+
+// bundleExtractCommand unpacks a local bundle
+func bundleExtractCommand(c *cli.Context) error {
+	path := c.Args().First()
+	if path == "" {
+		return fmt.Errorf("missing bundle file")
+	}
+	dest := c.String("dest")
+
+	extracted, warnings, err := bundle.Extract(path, dest)
+	for _, warning := range warnings {
+		pterm.Warning.Println(warning)
+	}
+	if err != nil {
+		return err
+	}
+
+	pterm.Success.Printfln("Extracted %d files from %s to %s", len(extracted), path, dest)
+	return nil
+}
+
+// fetchBundleManifest returns the manifest of the bundle stored for a
+// deployment
+func fetchBundleManifest(c *cli.Context, id string) (*bundle.Manifest, error) {
+	resp, err := http.Get(getDaemonURL(c) + "/api/v1/deployments/" + url.PathEscape(id) + "/bundle/manifest")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch bundle manifest: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var result struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &result) == nil && result.Error != "" {
+			return nil, fmt.Errorf("failed to fetch bundle manifest: %s", result.Error)
+		}
+		return nil, fmt.Errorf("failed to fetch bundle manifest: %s", strings.TrimSpace(string(body)))
+	}
+
+	var manifest bundle.Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &manifest, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// contextTimeout bounds each daemon request of a federated view, so one
+// unreachable daemon doesn't hold up the others
+const contextTimeout = 5 * time.Second
+
+// DaemonContext is a named daemon from the contexts list in
+// ~/.taskfly/taskfly.yml, e.g. one per region or environment
+type DaemonContext struct {
+	Name       string `yaml:"name"`
+	DaemonIP   string `yaml:"daemon_ip"`
+	DaemonPort string `yaml:"daemon_port"`
+	APIKey     string `yaml:"api_key"`
+	Namespace  string `yaml:"namespace"`
+	Satellite  string `yaml:"satellite"` // reach a satellite relaying through the daemon
+}
+
+// URL returns the base URL of the context's daemon
+func (d DaemonContext) URL() string {
+	ip, port := d.DaemonIP, d.DaemonPort
+	if ip == "" {
+		ip = "localhost"
+	}
+	if port == "" {
+		port = "8080"
+	}
+	return daemonURL(ip, port, d.Satellite)
+}
+
+// daemonContexts are the contexts configured in ~/.taskfly/taskfly.yml
+var daemonContexts []DaemonContext
+
+// findContext returns the configured context with the given name
+func findContext(name string) (*DaemonContext, error) {
+	for i := range daemonContexts {
+		if daemonContexts[i].Name == name {
+			return &daemonContexts[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown context %q, configure it under contexts in ~/.taskfly/taskfly.yml", name)
+}
+
+// selectContext points the global daemon and identity flags at the context
+// chosen with --context. Flags and environment variables still override the
+// context's settings.
+func selectContext(c *cli.Context) error {
+	name := c.String("context")
+	if name == "" {
+		return nil
+	}
+	ctx, err := findContext(name)
+	if err != nil {
+		return err
+	}
+
+	settings := map[string]string{
+		"daemon-ip":   ctx.DaemonIP,
+		"daemon-port": ctx.DaemonPort,
+		"api-key":     ctx.APIKey,
+		"namespace":   ctx.Namespace,
+		"satellite":   ctx.Satellite,
+	}
+	for flag, value := range settings {
+		if value == "" || c.IsSet(flag) {
+			continue
+		}
+		if err := c.Set(flag, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contextResult is the response of one daemon to a federated request
+type contextResult struct {
+	Context string
+	Body    []byte
+	Err     error
+}
+
+// fetchAllContexts GETs path from every configured daemon concurrently and
+// returns the responses in the order the contexts are configured. Contexts
+// without an API key or namespace use the global ones.
+func fetchAllContexts(c *cli.Context, path string) ([]contextResult, error) {
+	if len(daemonContexts) == 0 {
+		return nil, fmt.Errorf("no contexts configured, add them under contexts in ~/.taskfly/taskfly.yml")
+	}
+
+	// Each context attaches its own identity, not the global one
+	base := http.DefaultTransport
+	if identity, ok := base.(*identityTransport); ok {
+		base = identity.base
+	}
+
+	results := make([]contextResult, len(daemonContexts))
+	var wg sync.WaitGroup
+	for i, ctx := range daemonContexts {
+		wg.Add(1)
+		go func(i int, ctx DaemonContext) {
+			defer wg.Done()
+
+			transport := &identityTransport{base: base, apiKey: ctx.APIKey, namespace: ctx.Namespace}
+			if transport.apiKey == "" {
+				transport.apiKey = c.String("api-key")
+			}
+			if transport.namespace == "" {
+				transport.namespace = c.String("namespace")
+			}
+			client := &http.Client{Transport: transport, Timeout: contextTimeout}
+
+			results[i] = contextResult{Context: ctx.Name}
+			results[i].Body, results[i].Err = getBody(client, ctx.URL()+path)
+		}(i, ctx)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// getBody GETs a URL and returns the body of a successful response
+func getBody(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var result struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &result) == nil && result.Error != "" {
+			return nil, fmt.Errorf("%s", result.Error)
+		}
+		return nil, fmt.Errorf("daemon returned %s", resp.Status)
+	}
+	return body, nil
+}
+
+// fetchAllDeployments lists the deployments of every configured daemon. Each
+// deployment gets a "daemon" key naming its context. Daemons that fail are
+// returned in errs by context name, so callers can show partial results.
+func fetchAllDeployments(c *cli.Context) (deployments []map[string]interface{}, errs map[string]error, err error) {
+	results, err := fetchAllContexts(c, "/api/v1/deployments")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	errs = make(map[string]error)
+	for _, result := range results {
+		if result.Err != nil {
+			errs[result.Context] = result.Err
+			continue
+		}
+		var list []map[string]interface{}
+		if err := json.Unmarshal(result.Body, &list); err != nil {
+			errs[result.Context] = fmt.Errorf("failed to parse response: %w", err)
+			continue
+		}
+		for _, dep := range list {
+			dep["daemon"] = result.Context
+		}
+		deployments = append(deployments, list...)
+	}
+	return deployments, errs, nil
+}
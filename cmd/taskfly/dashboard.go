@@ -7,6 +7,9 @@ import (
 	"net/http"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pterm/pterm"
@@ -19,30 +22,64 @@ type MetricsResponse struct {
 		TotalMemoryGB     float64 `json:"total_memory_gb"`
 		TotalMemoryUsedGB float64 `json:"total_memory_used_gb"`
 		AvgLoad           float64 `json:"avg_load"`
+		AvgCPUUsage       float64 `json:"avg_cpu_usage"`
 		NodesWithMetrics  int     `json:"nodes_with_metrics"`
 	} `json:"summary"`
+	Deployments []struct {
+		DeploymentID        string  `json:"deployment_id"`
+		TotalCores          int     `json:"total_cores"`
+		TotalMemoryGB       float64 `json:"total_memory_gb"`
+		TotalMemoryUsedGB   float64 `json:"total_memory_used_gb"`
+		AvgLoad             float64 `json:"avg_load"`
+		AvgCPUUsage         float64 `json:"avg_cpu_usage"`
+		Nodes               int     `json:"nodes"`
+		NodesWithMetrics    int     `json:"nodes_with_metrics"`
+		NodesWithoutMetrics int     `json:"nodes_without_metrics"`
+	} `json:"deployments"`
 	Nodes []struct {
-		NodeID     string `json:"node_id"`
-		IPAddress  string `json:"ip_address"`
-		Status     string `json:"status"`
-		LastUpdate string `json:"last_update"`
-		Metrics    *struct {
-			CPUCores    int     `json:"cpu_cores"`
-			CPUUsage    float64 `json:"cpu_usage"`
-			MemoryTotal uint64  `json:"memory_total"`
-			MemoryUsed  uint64  `json:"memory_used"`
-			LoadAvg1    float64 `json:"load_avg_1"`
-			LoadAvg5    float64 `json:"load_avg_5"`
-			LoadAvg15   float64 `json:"load_avg_15"`
+		NodeID           string `json:"node_id"`
+		DeploymentID     string `json:"deployment_id"`
+		IPAddress        string `json:"ip_address"`
+		PrivateIPAddress string `json:"private_ip_address"`
+		Status           string `json:"status"`
+		NoData           bool   `json:"no_data"`
+		LastUpdate       string `json:"last_update"`
+		Metrics          *struct {
+			CPUCores    int       `json:"cpu_cores"`
+			CPUUsage    float64   `json:"cpu_usage"`
+			CPUPerCore  []float64 `json:"cpu_per_core"`
+			MemoryTotal uint64    `json:"memory_total"`
+			MemoryUsed  uint64    `json:"memory_used"`
+			LoadAvg1    float64   `json:"load_avg_1"`
+			LoadAvg5    float64   `json:"load_avg_5"`
+			LoadAvg15   float64   `json:"load_avg_15"`
+
+			Custom map[string]float64 `json:"custom"`
 		} `json:"metrics"`
+		HealthChecks []HealthCheck `json:"health_checks"`
+		Progress     *struct {
+			Percent float64 `json:"percent"`
+			Message string  `json:"message"`
+		} `json:"progress"`
 	} `json:"nodes"`
 }
 
 func dashboardCommand(c *cli.Context) error {
 	// Check if TUI mode is requested
 	if c.Bool("tui") {
+		if c.Bool("all-contexts") {
+			return fmt.Errorf("--all-contexts is not supported with --tui")
+		}
 		return runDashboardTUI(c)
 	}
+	if c.Bool("all-contexts") {
+		for {
+			if err := showFederatedDashboard(c); err != nil {
+				return err
+			}
+			time.Sleep(1 * time.Second)
+		}
+	}
 
 	// Default to simple dashboard
 	// Auto-refresh every 3 seconds
@@ -118,7 +155,7 @@ func showDashboard(c *cli.Context) error {
 	renderDeploymentSummary(deployments, stats)
 	renderRecentDeployments(deployments)
 
-	if metrics.Summary.NodesWithMetrics > 0 {
+	if len(metrics.Nodes) > 0 {
 		renderNodeMetrics(metrics)
 	}
 
@@ -128,6 +165,119 @@ func showDashboard(c *cli.Context) error {
 	return nil
 }
 
+// showFederatedDashboard renders the deployments and resources of every
+// configured daemon, with a row per daemon and the merged recent deployments
+func showFederatedDashboard(c *cli.Context) error {
+	var deployments []map[string]interface{}
+	var deploymentErrs map[string]error
+	var metricsResults []contextResult
+	var deploymentsErr, metricsErr error
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		deployments, deploymentErrs, deploymentsErr = fetchAllDeployments(c)
+	}()
+	go func() {
+		defer wg.Done()
+		metricsResults, metricsErr = fetchAllContexts(c, "/api/v1/metrics")
+	}()
+	wg.Wait()
+	if deploymentsErr != nil {
+		return deploymentsErr
+	}
+	if metricsErr != nil {
+		return metricsErr
+	}
+
+	// Add up the resources of all daemons, weighting CPU usage and load by
+	// the nodes reporting them
+	var total MetricsResponse
+	metrics := make(map[string]MetricsResponse)
+	for _, result := range metricsResults {
+		if result.Err != nil {
+			continue
+		}
+		var m MetricsResponse
+		if err := json.Unmarshal(result.Body, &m); err != nil {
+			continue
+		}
+		metrics[result.Context] = m
+
+		n := float64(m.Summary.NodesWithMetrics)
+		total.Summary.TotalCores += m.Summary.TotalCores
+		total.Summary.TotalMemoryGB += m.Summary.TotalMemoryGB
+		total.Summary.TotalMemoryUsedGB += m.Summary.TotalMemoryUsedGB
+		total.Summary.AvgCPUUsage += m.Summary.AvgCPUUsage * n
+		total.Summary.AvgLoad += m.Summary.AvgLoad * n
+		total.Summary.NodesWithMetrics += m.Summary.NodesWithMetrics
+	}
+	if total.Summary.NodesWithMetrics > 0 {
+		total.Summary.AvgCPUUsage /= float64(total.Summary.NodesWithMetrics)
+		total.Summary.AvgLoad /= float64(total.Summary.NodesWithMetrics)
+	}
+
+	fmt.Print("\033[H\033[2J\033[3J")
+	fmt.Print("\033[H")
+
+	pterm.DefaultHeader.WithFullWidth().Printfln("TaskFly Dashboard (%d daemons)", len(daemonContexts))
+
+	renderSystemMetrics(total)
+	renderDeploymentSummary(deployments, nil)
+	renderDaemons(deployments, deploymentErrs, metrics)
+	renderRecentDeployments(deployments)
+
+	os.Stdout.Sync()
+
+	return nil
+}
+
+// renderDaemons shows a row per configured daemon with its deployments and
+// resources, or why it could not be reached
+func renderDaemons(deployments []map[string]interface{}, errs map[string]error, metrics map[string]MetricsResponse) {
+	fmt.Println()
+	pterm.FgCyan.Println("Daemons:")
+
+	running := make(map[string]int)
+	count := make(map[string]int)
+	for _, dep := range deployments {
+		daemon := fmt.Sprintf("%v", dep["daemon"])
+		count[daemon]++
+		if dep["status"] == "running" {
+			running[daemon]++
+		}
+	}
+
+	tableData := pterm.TableData{
+		{"Daemon", "URL", "Deployments", "Running", "Nodes", "CPU", "Memory"},
+	}
+	for _, ctx := range daemonContexts {
+		if err, ok := errs[ctx.Name]; ok {
+			tableData = append(tableData, []string{ctx.Name, ctx.URL(), pterm.FgRed.Sprintf("unreachable: %v", err), "", "", "", ""})
+			continue
+		}
+
+		nodes, cpu, memory := "-", "-", "-"
+		if m, ok := metrics[ctx.Name]; ok {
+			nodes = fmt.Sprintf("%d", m.Summary.NodesWithMetrics)
+			cpu = fmt.Sprintf("%d cores (%.0f%%)", m.Summary.TotalCores, m.Summary.AvgCPUUsage)
+			memory = fmt.Sprintf("%.1f/%.1fGB", m.Summary.TotalMemoryUsedGB, m.Summary.TotalMemoryGB)
+		}
+		tableData = append(tableData, []string{
+			ctx.Name,
+			ctx.URL(),
+			fmt.Sprintf("%d", count[ctx.Name]),
+			pterm.FgGreen.Sprintf("%d", running[ctx.Name]),
+			nodes,
+			cpu,
+			memory,
+		})
+	}
+
+	renderTable(tableData)
+}
+
 func renderSystemMetrics(metrics MetricsResponse) {
 	// Calculate colors
 	loadColor := pterm.FgGreen
@@ -154,9 +304,18 @@ func renderSystemMetrics(metrics MetricsResponse) {
 	}
 
 	// Compact single-line display
-	fmt.Printf("%s  CPU: %s  Load: %s  Memory: %s  Nodes: %s\n",
+	cpuColor := pterm.FgGreen
+	if metrics.Summary.AvgCPUUsage > 70 {
+		cpuColor = pterm.FgYellow
+	}
+	if metrics.Summary.AvgCPUUsage > 90 {
+		cpuColor = pterm.FgRed
+	}
+
+	fmt.Printf("%s  CPU: %s %s  Load: %s  Memory: %s  Nodes: %s\n",
 		pterm.FgCyan.Sprint("System:"),
 		pterm.Bold.Sprintf("%d cores", metrics.Summary.TotalCores),
+		cpuColor.Sprintf("(%.0f%%)", metrics.Summary.AvgCPUUsage),
 		loadColor.Sprintf("%.2f", metrics.Summary.AvgLoad),
 		memColor.Sprintf("%.1f/%.1fGB (%.0f%%)", memUsedGB, memTotalGB, memPercent),
 		pterm.Bold.Sprintf("%d", metrics.Summary.NodesWithMetrics),
@@ -212,9 +371,15 @@ func renderRecentDeployments(deployments []map[string]interface{}) {
 		deployments = deployments[:5]
 	}
 
+	// Federated deployments name the daemon they run on
+	_, federated := deployments[0]["daemon"]
+
 	tableData := pterm.TableData{
 		{"ID", "Status", "Progress", "Created"},
 	}
+	if federated {
+		tableData[0] = append([]string{"Daemon"}, tableData[0]...)
+	}
 
 	for _, dep := range deployments {
 		id := fmt.Sprintf("%v", dep["deployment_id"])
@@ -223,20 +388,12 @@ func renderRecentDeployments(deployments []map[string]interface{}) {
 		completed := fmt.Sprintf("%v", dep["nodes_completed"])
 		failed := fmt.Sprintf("%v", dep["nodes_failed"])
 
-		// Compact progress bar
+		// Compact progress bar of the workload progress reported by all nodes
 		total, _ := dep["total_nodes"].(float64)
-		comp, _ := dep["nodes_completed"].(float64)
+		percent, _ := dep["progress"].(float64)
 		progress := ""
 		if total > 0 {
-			percent := int((comp / total) * 10)
-			for i := 0; i < 10; i++ {
-				if i < percent {
-					progress += "█"
-				} else {
-					progress += "░"
-				}
-			}
-			progress = fmt.Sprintf("[%s] %s/%s", progress, completed, totalNodes)
+			progress = fmt.Sprintf("[%s] %3.0f%% %s/%s", progressBar(percent, 10), percent, completed, totalNodes)
 		} else {
 			progress = fmt.Sprintf("%s/%s", completed, totalNodes)
 		}
@@ -253,15 +410,19 @@ func renderRecentDeployments(deployments []map[string]interface{}) {
 			}
 		}
 
-		tableData = append(tableData, []string{
+		row := []string{
 			id,
 			formatStatus(status),
 			progress,
 			created,
-		})
+		}
+		if federated {
+			row = append([]string{fmt.Sprintf("%v", dep["daemon"])}, row...)
+		}
+		tableData = append(tableData, row)
 	}
 
-	pterm.DefaultTable.WithHasHeader().WithBoxed(false).WithData(tableData).Render()
+	renderTable(tableData)
 }
 
 func renderNodeMetrics(metrics MetricsResponse) {
@@ -269,16 +430,46 @@ func renderNodeMetrics(metrics MetricsResponse) {
 	pterm.FgCyan.Println("Node Metrics:")
 
 	if len(metrics.Nodes) == 0 {
-		fmt.Println("  No nodes with metrics")
+		fmt.Println("  No nodes")
 		return
 	}
 
+	if len(metrics.Deployments) > 1 {
+		subtotalData := pterm.TableData{{"Deployment", "Nodes", "Cores", "CPU", "Avg Load", "Memory"}}
+		for _, dep := range metrics.Deployments {
+			nodes := fmt.Sprintf("%d", dep.Nodes)
+			if dep.NodesWithoutMetrics > 0 {
+				nodes += pterm.Gray(fmt.Sprintf(" (%d no data)", dep.NodesWithoutMetrics))
+			}
+			subtotalData = append(subtotalData, []string{
+				dep.DeploymentID,
+				nodes,
+				fmt.Sprintf("%d", dep.TotalCores),
+				fmt.Sprintf("%.0f%%", dep.AvgCPUUsage),
+				fmt.Sprintf("%.2f", dep.AvgLoad),
+				fmt.Sprintf("%.1fGB/%.1fGB", dep.TotalMemoryUsedGB, dep.TotalMemoryGB),
+			})
+		}
+		renderTable(subtotalData)
+		fmt.Println()
+	}
+
 	tableData := pterm.TableData{
-		{"Node", "IP Address", "CPUs", "Load", "Memory", "Updated"},
+		{"Node", "IP Address", "Private IP", "CPUs", "CPU", "Load", "Memory", "Health", "Progress", "Updated"},
 	}
+	customData := pterm.TableData{{"Node", "Custom Metrics"}}
 
 	for _, node := range metrics.Nodes {
-		if node.Metrics == nil {
+		if node.NoData || node.Metrics == nil {
+			ipAddr := node.IPAddress
+			if ipAddr == "" {
+				ipAddr = "pending"
+			}
+			noData := pterm.Gray(fmt.Sprintf("no data (%s)", node.Status))
+			tableData = append(tableData, []string{
+				node.NodeID, ipAddr, "-", "-", noData, "-", "-",
+				summarizeHealth(node.HealthChecks), "-", "-",
+			})
 			continue
 		}
 
@@ -296,6 +487,23 @@ func renderNodeMetrics(metrics MetricsResponse) {
 			memStr = pterm.FgYellow.Sprint(memStr)
 		}
 
+		// Format CPU usage, noting the busiest core when per-core data exists
+		cpuStr := fmt.Sprintf("%.0f%%", m.CPUUsage)
+		if len(m.CPUPerCore) > 0 {
+			hottest := 0.0
+			for _, core := range m.CPUPerCore {
+				if core > hottest {
+					hottest = core
+				}
+			}
+			cpuStr += fmt.Sprintf(" (max %.0f%%)", hottest)
+		}
+		if m.CPUUsage > 90 {
+			cpuStr = pterm.FgRed.Sprint(cpuStr)
+		} else if m.CPUUsage > 70 {
+			cpuStr = pterm.FgYellow.Sprint(cpuStr)
+		}
+
 		// Format load
 		loadPercent := (m.LoadAvg1 / float64(m.CPUCores)) * 100
 		loadStr := fmt.Sprintf("%.2f", m.LoadAvg1)
@@ -323,16 +531,64 @@ func renderNodeMetrics(metrics MetricsResponse) {
 		if ipAddr == "" {
 			ipAddr = "pending"
 		}
+		privateIP := node.PrivateIPAddress
+		if privateIP == "" {
+			privateIP = "-"
+		}
+
+		// Format workload progress
+		progress := "-"
+		if node.Progress != nil {
+			progress = fmt.Sprintf("[%s] %.0f%%", progressBar(node.Progress.Percent, 10), node.Progress.Percent)
+		} else if node.Status == "completed" {
+			progress = fmt.Sprintf("[%s] 100%%", progressBar(100, 10))
+		}
 
 		tableData = append(tableData, []string{
 			node.NodeID,
 			ipAddr,
+			privateIP,
 			fmt.Sprintf("%d", m.CPUCores),
+			cpuStr,
 			loadStr,
 			memStr,
+			summarizeHealth(node.HealthChecks),
+			progress,
 			lastUpdate,
 		})
+
+		if len(m.Custom) > 0 {
+			pairs := make([]string, 0, len(m.Custom))
+			for _, name := range sortedKeys(m.Custom) {
+				pairs = append(pairs, fmt.Sprintf("%s=%s", name, strconv.FormatFloat(m.Custom[name], 'f', -1, 64)))
+			}
+			customData = append(customData, []string{node.NodeID, strings.Join(pairs, " ")})
+		}
+	}
+
+	renderTable(tableData)
+
+	if len(customData) > 1 {
+		fmt.Println()
+		renderTable(customData)
+	}
+}
+
+// summarizeHealth reduces a node's health checks to its worst status
+func summarizeHealth(checks []HealthCheck) string {
+	if len(checks) == 0 {
+		return "-"
 	}
 
-	pterm.DefaultTable.WithHasHeader().WithBoxed(false).WithData(tableData).Render()
+	counts := map[string]int{}
+	for _, check := range checks {
+		counts[check.Status]++
+	}
+	if n := counts["critical"]; n > 0 {
+		return pterm.FgRed.Sprintf("%d critical", n)
+	}
+	if n := counts["warning"]; n > 0 {
+		return pterm.FgYellow.Sprintf("%d warning", n)
+	}
+	return formatHealth("ok")
 }
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -147,7 +148,7 @@ func runDashboardTUI(c *cli.Context) error {
 	builder.Add(
 		// Top section - Cluster Statistics (30%)
 		grid.RowHeightPerc(30,
-			grid.ColWidthPerc(25, grid.Widget(dash.cpuChart, container.Border(linestyle.Light), container.BorderTitle("CPU Load %"))),
+			grid.ColWidthPerc(25, grid.Widget(dash.cpuChart, container.Border(linestyle.Light), container.BorderTitle("CPU Usage %"))),
 			grid.ColWidthPerc(25, grid.Widget(dash.memChart, container.Border(linestyle.Light), container.BorderTitle("Memory Usage %"))),
 			grid.ColWidthPerc(25, grid.Widget(dash.loadChart, container.Border(linestyle.Light), container.BorderTitle("Load Avg (% of Cores)"))),
 			grid.ColWidthPerc(25,
@@ -390,6 +391,9 @@ func (d *DashboardTUI) collectClusterMetrics() {
 			// Track actual load average (not percentage)
 			d.loadHistory.Add(summary.AvgLoad)
 
+			// Track sampled CPU usage across all cores
+			d.cpuHistory.Add(summary.AvgCPUUsage)
+
 			// Track actual memory used in GB
 			d.memHistory.Add(summary.TotalMemoryUsedGB)
 
@@ -398,18 +402,9 @@ func (d *DashboardTUI) collectClusterMetrics() {
 
 			// Update charts with normalized data
 
-			// For CPU chart: show load as percentage of total cores (0-100% scale)
-			cpuData := make([]float64, 0, 100)
+			// For CPU chart: show sampled usage (already a 0-100% scale)
+			cpuData := d.cpuHistory.GetData()
 			loadData := d.loadHistory.GetData()
-			for _, load := range loadData {
-				if d.totalCores > 0 {
-					// Convert load to percentage of total cores
-					cpuPercent := (load / float64(d.totalCores)) * 100
-					cpuData = append(cpuData, cpuPercent)
-				} else {
-					cpuData = append(cpuData, 0)
-				}
-			}
 
 			// CPU shows 0-100% scale
 			d.cpuChart.Series("cpu", cpuData,
@@ -456,6 +451,7 @@ func (d *DashboardTUI) collectClusterMetrics() {
 			d.statsText.Reset()
 			d.statsText.Write(fmt.Sprintf("Total Cores: %d\n", summary.TotalCores))
 			d.statsText.Write(fmt.Sprintf("Memory: %.1f/%.1fGB\n", summary.TotalMemoryUsedGB, summary.TotalMemoryGB))
+			d.statsText.Write(fmt.Sprintf("Avg CPU: %.1f%%\n", summary.AvgCPUUsage))
 			d.statsText.Write(fmt.Sprintf("Avg Load: %.2f\n", summary.AvgLoad))
 			d.statsText.Write(fmt.Sprintf("Active Nodes: %d", summary.NodesWithMetrics))
 		}
@@ -560,11 +556,8 @@ func (d *DashboardTUI) updateDeploymentsDisplay(deployments []map[string]interfa
 		nodesCompleted, _ := dep["nodes_completed"].(float64)
 		nodesFailed, _ := dep["nodes_failed"].(float64)
 
-		// Calculate progress
-		progress := 0
-		if totalNodes > 0 {
-			progress = int((nodesCompleted / totalNodes) * 100)
-		}
+		// Workload progress averaged over all nodes
+		progress, _ := dep["progress"].(float64)
 
 		// Format creation time
 		createdAt := ""
@@ -585,17 +578,6 @@ func (d *DashboardTUI) updateDeploymentsDisplay(deployments []map[string]interfa
 		d.deploymentsText.Write(fmt.Sprintf("\n%s", id), text.WriteCellOpts(cell.FgColor(cell.ColorCyan), cell.Bold()))
 		d.deploymentsText.Write(fmt.Sprintf(" (%s)\n", createdAt), text.WriteCellOpts(cell.FgColor(cell.ColorGray)))
 
-		// Progress bar
-		progressBar := ""
-		progressFilled := progress / 10
-		for i := 0; i < 10; i++ {
-			if i < progressFilled {
-				progressBar += "█"
-			} else {
-				progressBar += "░"
-			}
-		}
-
 		progressColor := cell.ColorGreen
 		if nodesFailed > 0 {
 			progressColor = cell.ColorRed
@@ -604,8 +586,8 @@ func (d *DashboardTUI) updateDeploymentsDisplay(deployments []map[string]interfa
 		}
 
 		d.deploymentsText.Write("Progress: [")
-		d.deploymentsText.Write(progressBar, text.WriteCellOpts(cell.FgColor(progressColor)))
-		d.deploymentsText.Write(fmt.Sprintf("] %d%% - %.0f/%.0f nodes", progress, nodesCompleted, totalNodes))
+		d.deploymentsText.Write(progressBar(progress, 10), text.WriteCellOpts(cell.FgColor(progressColor)))
+		d.deploymentsText.Write(fmt.Sprintf("] %.0f%% - %.0f/%.0f nodes", progress, nodesCompleted, totalNodes))
 
 		if nodesFailed > 0 {
 			d.deploymentsText.Write(fmt.Sprintf(" (%.0f failed)", nodesFailed), text.WriteCellOpts(cell.FgColor(cell.ColorRed)))
@@ -658,6 +640,15 @@ func (d *DashboardTUI) displayNodeInfo(deployment map[string]interface{}) {
 			}
 		}
 
+		// Get private address (private subnets / dual-stack)
+		privateIP := ""
+		if n["private_ip_address"] != nil {
+			privStr := fmt.Sprintf("%v", n["private_ip_address"])
+			if privStr != ipAddress && privStr != "<nil>" {
+				privateIP = privStr
+			}
+		}
+
 		// Get instance ID
 		instanceID := "-"
 		if n["instance_id"] != nil {
@@ -689,11 +680,78 @@ func (d *DashboardTUI) displayNodeInfo(deployment map[string]interface{}) {
 		d.deploymentsText.Write(shortNodeID, text.WriteCellOpts(cell.FgColor(cell.ColorCyan)))
 		d.deploymentsText.Write("] ")
 		d.deploymentsText.Write(fmt.Sprintf("%-12s", nodeStatus), text.WriteCellOpts(cell.FgColor(statusColor)))
+		if liveness, ok := n["liveness"].(string); ok {
+			livenessColor := cell.ColorRed
+			switch {
+			case nodeStatus == "completed" || nodeStatus == "failed" || nodeStatus == "terminated":
+				livenessColor = cell.ColorGray
+			case liveness == "online":
+				livenessColor = cell.ColorGreen
+			case liveness == "stale":
+				livenessColor = cell.ColorYellow
+			}
+			d.deploymentsText.Write(fmt.Sprintf(" %-8s", liveness), text.WriteCellOpts(cell.FgColor(livenessColor)))
+		}
+		if percent, _, ok := nodeProgress(n); ok {
+			d.deploymentsText.Write(" [")
+			d.deploymentsText.Write(progressBar(percent, 10), text.WriteCellOpts(cell.FgColor(statusColor)))
+			d.deploymentsText.Write(fmt.Sprintf("] %3.0f%%", percent))
+		}
 		d.deploymentsText.Write(" | IP: ")
 		d.deploymentsText.Write(fmt.Sprintf("%-15s", ipAddress), text.WriteCellOpts(cell.FgColor(cell.ColorWhite)))
+		if privateIP != "" {
+			d.deploymentsText.Write(" | Private: ")
+			d.deploymentsText.Write(fmt.Sprintf("%-15s", privateIP), text.WriteCellOpts(cell.FgColor(cell.ColorWhite)))
+		}
 		d.deploymentsText.Write(" | ")
 		d.deploymentsText.Write(instanceID, text.WriteCellOpts(cell.FgColor(cell.ColorGray)))
 		d.deploymentsText.Write("\n")
+
+		d.displayNodeTelemetry(n)
+	}
+}
+
+// displayNodeTelemetry writes the progress message, custom metrics and failing
+// health checks a node reported below its node line
+func (d *DashboardTUI) displayNodeTelemetry(n map[string]interface{}) {
+	if _, message, ok := nodeProgress(n); ok && message != "" {
+		d.deploymentsText.Write("      "+message+"\n", text.WriteCellOpts(cell.FgColor(cell.ColorGray)))
+	}
+
+	if metrics, ok := n["metrics"].(map[string]interface{}); ok {
+		if custom, ok := metrics["custom"].(map[string]interface{}); ok && len(custom) > 0 {
+			names := make([]string, 0, len(custom))
+			for name := range custom {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			pairs := make([]string, 0, len(names))
+			for _, name := range names {
+				pairs = append(pairs, fmt.Sprintf("%s=%v", name, custom[name]))
+			}
+			d.deploymentsText.Write("      ")
+			d.deploymentsText.Write(strings.Join(pairs, " "), text.WriteCellOpts(cell.FgColor(cell.ColorCyan)))
+			d.deploymentsText.Write("\n")
+		}
+	}
+
+	checks, _ := n["health_checks"].([]interface{})
+	for _, item := range checks {
+		check, ok := item.(map[string]interface{})
+		if !ok || check["status"] == "ok" {
+			continue
+		}
+
+		color := cell.ColorYellow
+		if check["status"] == "critical" {
+			color = cell.ColorRed
+		}
+		d.deploymentsText.Write(fmt.Sprintf("      %v: %v", check["name"], check["status"]), text.WriteCellOpts(cell.FgColor(color)))
+		if message, ok := check["message"].(string); ok && message != "" {
+			d.deploymentsText.Write(" - " + message)
+		}
+		d.deploymentsText.Write("\n")
 	}
 }
 
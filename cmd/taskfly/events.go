@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/report"
+	"github.com/pterm/pterm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func eventsCommand(c *cli.Context) error {
+	if c.Bool("verbose") {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	id := c.String("id")
+	follow := c.Bool("follow")
+
+	pterm.DefaultSection.Printfln("Events for deployment %s", id)
+
+	// Each node keeps its color, cycling like taskfly logs
+	colors := []func(...interface{}) string{
+		pterm.FgLightCyan.Sprint,
+		pterm.FgLightGreen.Sprint,
+		pterm.FgLightYellow.Sprint,
+		pterm.FgLightMagenta.Sprint,
+		pterm.FgLightBlue.Sprint,
+	}
+	nodeColors := make(map[string]func(...interface{}) string)
+
+	var cursor eventCursor
+	printed := 0
+	for {
+		events, err := fetchEvents(c, id, cursor.since())
+		if err != nil {
+			return err
+		}
+
+		finished := false
+		for _, event := range events {
+			if !cursor.advance(event) {
+				continue
+			}
+			source := "deployment"
+			color := pterm.Bold.Sprint
+			if event.NodeID != "" {
+				source = event.NodeID
+				if _, ok := nodeColors[source]; !ok {
+					nodeColors[source] = colors[len(nodeColors)%len(colors)]
+				}
+				color = nodeColors[source]
+			} else if event.Status != report.EventCreated {
+				finished = true
+			}
+
+			line := fmt.Sprintf("%s  %s  %s",
+				pterm.Gray(event.Time.Local().Format("2006-01-02 15:04:05")),
+				color(source),
+				formatStatus(event.Status))
+			if event.PreviousStatus != "" {
+				line += pterm.Gray(fmt.Sprintf(" after %s in %s",
+					(time.Duration(event.PreviousSeconds) * time.Second).Round(time.Second), event.PreviousStatus))
+			}
+			if event.Message != "" {
+				line += "  " + event.Message
+			}
+			fmt.Println(line)
+			printed++
+		}
+
+		if !follow || finished {
+			break
+		}
+		time.Sleep(3 * time.Second)
+	}
+
+	if printed == 0 {
+		pterm.Info.Println("No events recorded yet")
+	}
+	return nil
+}
+
+// eventCursor tracks how far a followed timeline was printed: the time of
+// the last event and the events already printed at that time. Several
+// events can share a time, and more of them may be recorded after a poll,
+// so polls ask for the last time again and skip what was printed.
+type eventCursor struct {
+	last time.Time
+	seen map[string]bool
+}
+
+// since returns the time to poll from, just before the last event so the
+// events at its time are returned again
+func (c *eventCursor) since() time.Time {
+	if c.last.IsZero() {
+		return c.last
+	}
+	return c.last.Add(-time.Nanosecond)
+}
+
+// advance records an event, reporting false if it was already printed
+func (c *eventCursor) advance(event report.Event) bool {
+	key := fmt.Sprintf("%s|%s|%s|%s", event.NodeID, event.Status, event.PreviousStatus, event.Message)
+	switch {
+	case event.Time.Before(c.last):
+		return false
+	case event.Time.After(c.last):
+		c.last = event.Time
+		c.seen = map[string]bool{}
+	case c.seen[key]:
+		return false
+	}
+	c.seen[key] = true
+	return true
+}
+
+// fetchEvents returns the events of a deployment recorded after since
+func fetchEvents(c *cli.Context, id string, since time.Time) ([]report.Event, error) {
+	query := url.Values{}
+	if !since.IsZero() {
+		query.Set("since", since.Format(time.RFC3339Nano))
+	}
+
+	resp, err := http.Get(getDaemonURL(c) + "/api/v1/deployments/" + url.PathEscape(id) + "/events?" + query.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch events: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, notFoundError("deployment", id)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch events: %s", string(body))
+	}
+
+	var result struct {
+		Events []report.Event `json:"events"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return result.Events, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// Exit codes of the CLI. They are documented in the README and stable, so
+// scripts can branch on them; add new codes rather than renumbering.
+const (
+	exitOK                = 0
+	exitError             = 1   // any failure not covered below
+	exitConfigInvalid     = 2   // taskfly.yml is missing, unparsable or invalid
+	exitDaemonUnreachable = 3   // the daemon couldn't be connected to or didn't answer
+	exitDeploymentFailed  = 4   // the deployment failed without any node completing
+	exitPartialFailure    = 5   // the deployment finished with some nodes failed
+	exitRejected          = 6   // the daemon refused the request, e.g. by policy
+	exitNotFound          = 7   // the deployment, node or upload doesn't exist
+	exitInterrupted       = 130 // interrupted with Ctrl-C, like shells report SIGINT
+)
+
+// cliError is an error that exits the CLI with a specific code
+type cliError struct {
+	code int
+	err  error
+}
+
+func (e *cliError) Error() string {
+	return e.err.Error()
+}
+
+func (e *cliError) Unwrap() error {
+	return e.err
+}
+
+// withExitCode makes the CLI exit with code if err ends the command
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &cliError{code: code, err: err}
+}
+
+// configError marks err as caused by an invalid configuration
+func configError(err error) error {
+	return withExitCode(exitConfigInvalid, err)
+}
+
+// notFoundError reports that the daemon doesn't know an object, e.g. a
+// deployment
+func notFoundError(kind, id string) error {
+	return withExitCode(exitNotFound, fmt.Errorf("%s %s not found", kind, id))
+}
+
+// deploymentOutcome returns an error with the exit code of a failed
+// deployment as returned by the daemon, or nil if it didn't fail
+func deploymentOutcome(deployment map[string]interface{}) error {
+	if status, _ := deployment["status"].(string); status != "failed" {
+		return nil
+	}
+
+	completed, _ := deployment["nodes_completed"].(float64)
+	failed, _ := deployment["nodes_failed"].(float64)
+	if completed > 0 {
+		return withExitCode(exitPartialFailure, fmt.Errorf("deployment %v failed on %.0f of %.0f finished nodes",
+			deployment["deployment_id"], failed, completed+failed))
+	}
+	if message, _ := deployment["error_message"].(string); message != "" {
+		return withExitCode(exitDeploymentFailed, fmt.Errorf("deployment %v failed: %s", deployment["deployment_id"], message))
+	}
+	return withExitCode(exitDeploymentFailed, fmt.Errorf("deployment %v failed", deployment["deployment_id"]))
+}
+
+// exitCode returns the code the CLI exits with after a command returned err.
+// Errors without an explicit code are classified by their cause: failed HTTP
+// requests mean the daemon is unreachable.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	var cliErr *cliError
+	if errors.As(err, &cliErr) {
+		return cliErr.code
+	}
+	if errors.Is(err, context.Canceled) {
+		return exitInterrupted
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && urlErr.Op != "parse" {
+		return exitDaemonUnreachable
+	}
+	return exitError
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/pterm/pterm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func exportCommand(c *cli.Context) error {
+	if c.Bool("verbose") {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	id := c.String("id")
+	what := c.String("what")
+	format := c.String("format")
+
+	if what != "metrics" && what != "results" {
+		return fmt.Errorf("invalid --what %q, must be metrics or results", what)
+	}
+	if format != "csv" && format != "parquet" {
+		return fmt.Errorf("invalid format %q, must be csv or parquet", format)
+	}
+
+	query := url.Values{}
+	query.Set("what", what)
+	query.Set("format", format)
+	if node := c.String("node"); node != "" {
+		query.Set("node", node)
+	}
+
+	resp, err := http.Get(getDaemonURL(c) + "/api/v1/deployments/" + url.PathEscape(id) + "/export?" + query.Encode())
+	if err != nil {
+		return fmt.Errorf("failed to export %s: %w", what, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusNotFound {
+			return notFoundError("deployment", id)
+		}
+		return fmt.Errorf("failed to export %s: %s", what, string(body))
+	}
+
+	output := c.String("output")
+	if output == "" {
+		output = fmt.Sprintf("%s_%s.%s", id, what, format)
+	}
+
+	// "-" streams CSV straight to stdout for piping
+	if output == "-" {
+		_, err := io.Copy(stdout, resp.Body)
+		return err
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+
+	pterm.Success.Printfln("Exported %s for deployment %s to %s", what, id, output)
+	return nil
+}
@@ -1,20 +1,26 @@
 package main
 
 import (
-	"archive/tar"
 	"bytes"
-	"compress/gzip"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/JustinTimperio/TaskFly/internal/bundle"
 	"github.com/JustinTimperio/TaskFly/internal/validation"
+	"github.com/JustinTimperio/TaskFly/internal/variables"
 	"github.com/chzyer/readline"
 	"github.com/pterm/pterm"
 	"github.com/sirupsen/logrus"
@@ -32,13 +38,17 @@ type NodesConfig struct {
 
 // TaskFlyConfig represents the taskfly.yml configuration
 type TaskFlyConfig struct {
-	CloudProvider     string                            `yaml:"cloud_provider"`
-	InstanceConfig    map[string]map[string]interface{} `yaml:"instance_config"`
-	ApplicationFiles  []string                          `yaml:"application_files"`
-	RemoteDestDir     string                            `yaml:"remote_dest_dir"`
-	RemoteScriptToRun string                            `yaml:"remote_script_to_run"`
-	BundleName        string                            `yaml:"bundle_name"`
-	Nodes             NodesConfig                       `yaml:"nodes"`
+	CloudProvider           string                            `yaml:"cloud_provider"`
+	InstanceConfig          map[string]map[string]interface{} `yaml:"instance_config"`
+	ApplicationFiles        []string                          `yaml:"application_files"`
+	RemoteDestDir           string                            `yaml:"remote_dest_dir"`
+	RemoteScriptToRun       string                            `yaml:"remote_script_to_run"`
+	RemoteScriptArgs        []string                          `yaml:"remote_script_args"`
+	RemoteScriptInterpreter string                            `yaml:"remote_script_interpreter"`
+	BundleName              string                            `yaml:"bundle_name"`
+	PreserveMtimes          bool                              `yaml:"preserve_mtimes"`
+	NetworkMode             string                            `yaml:"network_mode"`
+	Nodes                   NodesConfig                       `yaml:"nodes"`
 }
 
 // CLIConfig represents the ~/.taskfly/taskfly.yml configuration
@@ -46,6 +56,13 @@ type CLIConfig struct {
 	DaemonIP   string `yaml:"daemon_ip"`
 	DaemonPort string `yaml:"daemon_port"`
 	Verbose    bool   `yaml:"verbose"`
+	APIKey     string `yaml:"api_key"`
+	Namespace  string `yaml:"namespace"`
+
+	// Contexts name other daemons, selected with --context or queried
+	// together with --all-contexts
+	Contexts []DaemonContext `yaml:"contexts"`
+	Context  string          `yaml:"context"` // default for --context
 }
 
 // loadCLIConfig loads the CLI configuration from ~/.taskfly/taskfly.yml
@@ -97,6 +114,7 @@ func main() {
 	if cliConfig.Verbose {
 		verbose = cliConfig.Verbose
 	}
+	daemonContexts = cliConfig.Contexts
 
 	app := &cli.App{
 		Name:  "taskfly",
@@ -123,12 +141,73 @@ func main() {
 				Value:   verbose,
 				EnvVars: []string{"TASKFLY_VERBOSE"},
 			},
+			&cli.StringFlag{
+				Name:    "api-key",
+				Usage:   "API key usage is accounted to on shared daemons, also the access token when the daemon requires one",
+				Value:   cliConfig.APIKey,
+				EnvVars: []string{"TASKFLY_API_KEY"},
+			},
+			&cli.StringFlag{
+				Name:    "namespace",
+				Aliases: []string{"n"},
+				Usage:   "Namespace usage is accounted to (default: \"default\")",
+				Value:   cliConfig.Namespace,
+				EnvVars: []string{"TASKFLY_NAMESPACE"},
+			},
+			&cli.StringFlag{
+				Name:    "satellite",
+				Usage:   "Manage the satellite daemon with this name through the daemon it relays through",
+				EnvVars: []string{"TASKFLY_SATELLITE"},
+			},
+			&cli.StringFlag{
+				Name:    "context",
+				Usage:   "Named daemon from contexts in ~/.taskfly/taskfly.yml",
+				Value:   cliConfig.Context,
+				EnvVars: []string{"TASKFLY_CONTEXT"},
+			},
+			&cli.BoolFlag{
+				Name:    "quiet",
+				Aliases: []string{"q"},
+				Usage:   "Print only IDs, one per line, for piping into xargs",
+				EnvVars: []string{"TASKFLY_QUIET"},
+			},
+			&cli.BoolFlag{
+				Name:  "no-color",
+				Usage: "Disable colors, also when NO_COLOR is set",
+			},
+		},
+		Before: func(c *cli.Context) error {
+			if err := configureOutput(c); err != nil {
+				return err
+			}
+			if err := selectContext(c); err != nil {
+				return err
+			}
+			return installIdentity(c)
 		},
 		Commands: []*cli.Command{
 			{
 				Name:   "up",
 				Usage:  "Deploy and run a new deployment",
 				Action: deployCommand,
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "keep-failed",
+						Usage: "Keep instances of failed nodes this long for debugging, e.g. 2h (overrides keep_failed in taskfly.yml, max 24h)",
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Bundle format: tar.gz or zip (default: from bundle_name, else tar.gz)",
+					},
+					&cli.BoolFlag{
+						Name:  "simulate",
+						Usage: "Run the nodes as local agent processes on the daemon host instead of the configured provider",
+					},
+					&cli.StringSliceFlag{
+						Name:  "var",
+						Usage: "Set an input variable taskfly.yml declares, as name=value (repeatable; else from TASKFLY_VAR_<name>, the default or a prompt)",
+					},
+				},
 			},
 			{
 				Name:   "validate",
@@ -141,12 +220,26 @@ func main() {
 						Usage:   "Path to taskfly.yml config file",
 						Value:   "taskfly.yml",
 					},
+					&cli.BoolFlag{
+						Name:  "offline",
+						Usage: "Skip right-sizing suggestions from past runs on the daemon",
+					},
+					&cli.StringSliceFlag{
+						Name:  "var",
+						Usage: "Set an input variable taskfly.yml declares, as name=value (repeatable; else from TASKFLY_VAR_<name> or the default)",
+					},
 				},
 			},
 			{
 				Name:   "list",
 				Usage:  "List all deployments",
 				Action: listCommand,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "all-contexts",
+						Usage: "List the deployments of every configured context, with a daemon column",
+					},
+				},
 			},
 			{
 				Name:   "status",
@@ -181,6 +274,402 @@ func main() {
 					},
 				},
 			},
+			{
+				Name:   "watch",
+				Usage:  "Watch a deployment's status, node metrics and logs live",
+				Action: watchCommand,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "id",
+						Usage:    "Deployment ID",
+						Required: true,
+					},
+				},
+			},
+			{
+				Name:   "events",
+				Usage:  "Show the timeline of a deployment and its nodes",
+				Action: eventsCommand,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "id",
+						Usage:    "Deployment ID",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:    "follow",
+						Aliases: []string{"f"},
+						Usage:   "Keep printing new events until the deployment finishes",
+					},
+				},
+			},
+			{
+				Name:   "report",
+				Usage:  "Show the completion summary of a deployment",
+				Action: reportCommand,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "id",
+						Usage:    "Deployment ID",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Report format: json, markdown or html",
+						Value: "markdown",
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Write the report to a file instead of stdout",
+					},
+				},
+			},
+			{
+				Name:   "export",
+				Usage:  "Export node metrics or results as CSV or Parquet",
+				Action: exportCommand,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "id",
+						Usage:    "Deployment ID",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "what",
+						Usage:    "Data to export: metrics or results",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Output format: csv or parquet",
+						Value: "csv",
+					},
+					&cli.StringFlag{
+						Name:  "node",
+						Usage: "Only export metrics of this node (optional)",
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Output file, - for stdout (default: <id>_<what>.<format>)",
+					},
+				},
+			},
+			{
+				Name:   "metrics",
+				Usage:  "Show CPU, memory and load sparklines per node",
+				Action: metricsCommand,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "id",
+						Usage:    "Deployment ID",
+						Required: true,
+					},
+					&cli.IntFlag{
+						Name:  "minutes",
+						Usage: "How many minutes of history to show",
+						Value: 15,
+					},
+					&cli.StringFlag{
+						Name:  "node",
+						Usage: "Only show this node (optional)",
+					},
+				},
+			},
+			{
+				Name:   "bake",
+				Usage:  "Snapshot a node into a machine image to use as image_id of later deployments",
+				Action: bakeCommand,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "id",
+						Usage:    "Deployment ID",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "node",
+						Usage:    "Node ID or index to snapshot",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "Image name (default: taskfly-<deployment>-node<index>-<timestamp>)",
+					},
+					&cli.BoolFlag{
+						Name:  "reboot",
+						Usage: "Reboot the instance for a consistent filesystem (interrupts running workloads)",
+					},
+				},
+			},
+			{
+				Name:      "search",
+				Usage:     "Search deployments, nodes and recent logs",
+				ArgsUsage: "<query>",
+				Action:    searchCommand,
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "limit",
+						Usage: "Maximum number of log lines to return (at most 1000)",
+						Value: 50,
+					},
+				},
+			},
+			{
+				Name:   "usage",
+				Usage:  "Show requests, bundle uploads, node hours and estimated spend per API key, namespace and label",
+				Action: usageCommand,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "window",
+						Usage: "Time window, e.g. 12h, 7d or 30d",
+						Value: "24h",
+					},
+					&cli.StringFlag{
+						Name:  "month",
+						Usage: "Report a calendar month (UTC) instead of a window, e.g. 2024-06",
+					},
+					&cli.StringFlag{
+						Name:  "filter-namespace",
+						Usage: "Only show this namespace",
+					},
+				},
+			},
+			{
+				Name:  "node",
+				Usage: "Inspect and debug individual nodes",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "describe",
+						Usage:  "Show host inventory and uptime of a node",
+						Action: nodeDescribeCommand,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "id",
+								Usage:    "Node ID",
+								Required: true,
+							},
+						},
+					},
+					{
+						Name:   "config",
+						Usage:  "Show the config a node received and where each key came from",
+						Action: nodeConfigCommand,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "id",
+								Usage:    "Deployment ID",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "node",
+								Usage:    "Node ID or index",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:  "format",
+								Usage: "Output format: table or json",
+								Value: "table",
+							},
+						},
+					},
+					{
+						Name:   "quarantine",
+						Usage:  "Keep a failed node alive for debugging before it is shut down",
+						Action: nodeQuarantineCommand,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "id",
+								Usage:    "Node ID",
+								Required: true,
+							},
+							&cli.DurationFlag{
+								Name:  "duration",
+								Usage: "How long to keep the node, at most 24h",
+								Value: 2 * time.Hour,
+							},
+						},
+					},
+					{
+						Name:   "revoke",
+						Usage:  "Invalidate a node's credentials so its agent can no longer reach the daemon",
+						Action: nodeRevokeCommand,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "id",
+								Usage:    "Node ID",
+								Required: true,
+							},
+						},
+					},
+				},
+			},
+			{
+				Name:   "reconfigure",
+				Usage:  "Change the config of a running deployment's nodes without redeploying",
+				Action: reconfigureCommand,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "id",
+						Usage:    "Deployment ID",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "node",
+						Usage: "Only change this node (optional)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "set",
+						Usage: "Set a config key, as key=value (repeatable)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "unset",
+						Usage: "Remove a config key (repeatable)",
+					},
+				},
+			},
+			{
+				Name:   "export-deployment",
+				Usage:  "Export a deployment's config, files and metadata to rerun it on another daemon",
+				Action: exportDeploymentCommand,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "id",
+						Usage:    "Deployment ID",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "out",
+						Usage: "Archive file to write (default: <id>.taskfly.tar.gz)",
+					},
+				},
+			},
+			{
+				Name:  "pending",
+				Usage: "Resume or clean up uploads taskfly up didn't hear back about",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "List the pending uploads",
+						Action: pendingListCommand,
+					},
+					{
+						Name:      "resume",
+						Usage:     "Upload a pending bundle again, creating its deployment unless the daemon already did",
+						ArgsUsage: "<upload-id>",
+						Action:    pendingResumeCommand,
+					},
+					{
+						Name:      "clean",
+						Usage:     "Drop one or all pending uploads without deploying them",
+						ArgsUsage: "[upload-id]",
+						Action:    pendingCleanCommand,
+					},
+				},
+			},
+			{
+				Name:      "import-deployment",
+				Usage:     "Create a new deployment from an exported deployment archive",
+				ArgsUsage: "<archive>",
+				Action:    importDeploymentCommand,
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "keep-failed",
+						Usage: "Keep instances of failed nodes this long for debugging, e.g. 2h (overrides keep_failed in taskfly.yml, max 24h)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "var",
+						Usage: "Set an input variable, as name=value (repeatable; overrides the archive's values, required for sensitive variables)",
+					},
+				},
+			},
+			{
+				Name:  "artifacts",
+				Usage: "List the artifacts of a deployment and share them with signed URLs",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "List the artifacts the nodes of a deployment stored",
+						Action: artifactsListCommand,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "id",
+								Usage:    "Deployment ID",
+								Required: true,
+							},
+						},
+					},
+					{
+						Name:   "url",
+						Usage:  "Print a URL anyone can download an artifact from until it expires",
+						Action: artifactsURLCommand,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "id",
+								Usage:    "Deployment ID",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "key",
+								Usage:    "Artifact key",
+								Required: true,
+							},
+							&cli.DurationFlag{
+								Name:  "ttl",
+								Usage: "How long the URL stays valid, at most 168h",
+								Value: time.Hour,
+							},
+						},
+					},
+				},
+			},
+			{
+				Name:   "satellites",
+				Usage:  "List the satellite daemons relaying through the daemon",
+				Action: satellitesCommand,
+			},
+			{
+				Name:  "bundle",
+				Usage: "Build, inspect and extract application bundles",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "build",
+						Usage:  "Create the bundle taskfly up would upload, without deploying it",
+						Action: bundleBuildCommand,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "format",
+								Usage: "Bundle format: tar.gz or zip (default: from bundle_name, else tar.gz)",
+							},
+						},
+					},
+					{
+						Name:      "inspect",
+						Usage:     "List the files, sizes and digests of a bundle file or a deployment's stored bundle",
+						ArgsUsage: "[bundle.tar.gz|bundle.zip]",
+						Action:    bundleInspectCommand,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "id",
+								Usage: "Deployment ID, to inspect the bundle stored by the daemon",
+							},
+						},
+					},
+					{
+						Name:      "extract",
+						Usage:     "Unpack a bundle file",
+						ArgsUsage: "<bundle.tar.gz|bundle.zip>",
+						Action:    bundleExtractCommand,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "dest",
+								Usage: "Directory to extract to",
+								Value: "taskfly_bundle",
+							},
+						},
+					},
+				},
+			},
 			{
 				Name:   "down",
 				Usage:  "Terminate a deployment",
@@ -209,21 +698,37 @@ func main() {
 						Usage:   "Use the enhanced TUI dashboard with charts and gauges",
 						Aliases: []string{"t"},
 					},
+					&cli.BoolFlag{
+						Name:  "all-contexts",
+						Usage: "Show every configured context at once (not with --tui)",
+					},
 				},
 			},
 		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
-		logrus.Fatal(err)
+		logrus.Error(err)
+		os.Exit(exitCode(err))
 	}
 }
 
-// getDaemonURL constructs the daemon URL from the IP and port flags
+// getDaemonURL constructs the daemon URL from the IP and port flags. With
+// --satellite, it is the relay path of that satellite on the daemon.
 func getDaemonURL(c *cli.Context) string {
 	ip := c.String("daemon-ip")
 	port := c.String("daemon-port")
-	return fmt.Sprintf("http://%s:%s", ip, port)
+	return daemonURL(ip, port, c.String("satellite"))
+}
+
+// daemonURL returns the base URL of a daemon, or of a satellite relaying
+// through it
+func daemonURL(ip, port, satellite string) string {
+	base := fmt.Sprintf("http://%s", net.JoinHostPort(ip, port))
+	if satellite != "" {
+		base += "/api/v1/satellites/" + url.PathEscape(satellite)
+	}
+	return base
 }
 
 func validateCommand(c *cli.Context) error {
@@ -235,14 +740,30 @@ func validateCommand(c *cli.Context) error {
 	// Check if config file exists
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
 		pterm.Error.Printfln("Config file not found: %s", configPath)
-		return fmt.Errorf("config file not found")
+		return configError(fmt.Errorf("config file not found"))
+	}
+
+	// Collect values of the input variables, the validator reports missing
+	// ones instead of prompting
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return configError(err)
+	}
+	declared, err := variables.Declared(data)
+	if err != nil {
+		pterm.Error.Printfln("Failed to parse config: %v", err)
+		return configError(err)
+	}
+	vars, err := givenVariables(c, declared)
+	if err != nil {
+		return configError(err)
 	}
 
 	// Create validator
-	validator, err := validation.NewValidator(configPath)
+	validator, err := validation.NewValidator(configPath, vars)
 	if err != nil {
 		pterm.Error.Printfln("Failed to parse config: %v", err)
-		return err
+		return configError(err)
 	}
 
 	// Run validation
@@ -277,6 +798,10 @@ func validateCommand(c *cli.Context) error {
 		fmt.Println()
 	}
 
+	if !c.Bool("offline") {
+		showRecommendations(c, configPath)
+	}
+
 	// Summary
 	if result.Valid && !hasIssues {
 		pterm.Success.Println("✓ Configuration is valid! No issues found.")
@@ -288,7 +813,7 @@ func validateCommand(c *cli.Context) error {
 	} else {
 		pterm.Error.Printfln("✗ Configuration is invalid (%d errors, %d warnings)",
 			len(result.Errors), len(result.Warnings))
-		return fmt.Errorf("validation failed")
+		return configError(fmt.Errorf("validation failed"))
 	}
 }
 
@@ -302,34 +827,84 @@ func deployCommand(c *cli.Context) error {
 		fmt.Printf("🔧 Using daemon URL: %s\n", getDaemonURL(c))
 	}
 
-	// Load configuration
-	config, err := loadConfig("taskfly.yml")
+	// Load configuration, with the values of its input variables
+	data, err := os.ReadFile("taskfly.yml")
 	if err != nil {
-		return fmt.Errorf("failed to load config: %w", err)
+		return configError(fmt.Errorf("failed to load config: %w", err))
 	}
+	vars, data, err := resolveVariables(c, data)
+	if err != nil {
+		return configError(fmt.Errorf("failed to load config: %w", err))
+	}
+	var config TaskFlyConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return configError(fmt.Errorf("failed to load config: %w", err))
+	}
+
+	// Deal with uploads an earlier run didn't hear back about first
+	reconcilePendingUploads(c)
 
 	// Create bundle
 	fmt.Println("📦 Creating application bundle...")
-	bundlePath, err := createBundle(config)
+	bundlePath, err := createBundle(&config, bundle.Format(c.String("format")))
 	if err != nil {
 		return fmt.Errorf("failed to create bundle: %w", err)
 	}
 	defer os.Remove(bundlePath) // Clean up
 
+	// Journal the upload until the daemon answers, so an interrupted upload
+	// can be resumed without deploying twice
+	opts := uploadFlags(c)
+	opts.Variables = vars
+	if opts.UploadID, err = newUploadID(); err != nil {
+		return err
+	}
+	upload, err := journalUpload(getDaemonURL(c), bundlePath, opts)
+	if err != nil {
+		return fmt.Errorf("failed to journal upload: %w", err)
+	}
+
 	// Upload to daemon
 	fmt.Println("⬆️ Uploading bundle to daemon...")
-	resp, err := uploadBundle(c, bundlePath)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	resp, err := upload.upload(ctx)
 	if err != nil {
+		if ctx.Err() != nil {
+			pterm.Warning.Println("Upload interrupted")
+		}
+		pterm.Info.Printfln("The bundle was kept, resume with 'taskfly pending resume %s' or drop it with 'taskfly pending clean %s'", opts.UploadID, opts.UploadID)
 		return fmt.Errorf("failed to upload bundle: %w", err)
 	}
+	if message, ok := resp["error"].(string); ok {
+		return withExitCode(exitRejected, fmt.Errorf("deployment rejected: %s", message))
+	}
 
 	fmt.Printf("✅ Deployment created: %s\n", resp["deployment_id"])
 	fmt.Printf("📊 Status URL: %s\n", resp["status_url"])
+	if quiet {
+		printIDs(fmt.Sprintf("%v", resp["deployment_id"]))
+	}
+	if warnings, ok := resp["policy_warnings"].([]interface{}); ok {
+		for _, warning := range warnings {
+			pterm.Warning.Printfln("Policy: %v", warning)
+		}
+	}
+	if simulated, _ := resp["simulated"].(bool); simulated {
+		fmt.Printf("🧪 Simulating %v nodes as agent processes on the daemon host\n", resp["nodes"])
+		fmt.Printf("📜 Follow the scripts' output with: taskfly logs --id %s --follow\n", resp["deployment_id"])
+	} else if c.Bool("simulate") {
+		pterm.Warning.Println("The daemon doesn't support --simulate, the deployment uses the configured provider")
+	}
 
 	return nil
 }
 
 func listCommand(c *cli.Context) error {
+	if c.Bool("all-contexts") {
+		return listAllContextsCommand(c)
+	}
+
 	pterm.Info.Println("Fetching deployments...")
 
 	resp, err := http.Get(getDaemonURL(c) + "/api/v1/deployments")
@@ -352,10 +927,16 @@ func listCommand(c *cli.Context) error {
 		pterm.Info.Println("No deployments found")
 		return nil
 	}
+	if quiet {
+		for _, dep := range deployments {
+			printIDs(fmt.Sprintf("%v", dep["deployment_id"]))
+		}
+		return nil
+	}
 
 	// Create table data
 	tableData := pterm.TableData{
-		{"ID", "Status", "Nodes", "Completed", "Failed", "Created"},
+		{"ID", "Status", "Nodes", "Completed", "Failed", "Created", "ETA"},
 	}
 
 	for _, dep := range deployments {
@@ -376,14 +957,77 @@ func listCommand(c *cli.Context) error {
 			fmt.Sprintf("%v", dep["nodes_completed"]),
 			fmt.Sprintf("%v", dep["nodes_failed"]),
 			created,
+			valueOrDash(formatEstimate(dep["estimate"])),
 		})
 	}
 
-	pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+	renderTable(tableData)
+
+	return nil
+}
+
+// listAllContextsCommand lists the deployments of every configured daemon
+// in one table. Daemons that can't be reached are reported and skipped.
+func listAllContextsCommand(c *cli.Context) error {
+	pterm.Info.Printfln("Fetching deployments from %d contexts...", len(daemonContexts))
+
+	deployments, errs, err := fetchAllDeployments(c)
+	if err != nil {
+		return err
+	}
+	for _, ctx := range daemonContexts {
+		if err, ok := errs[ctx.Name]; ok {
+			pterm.Warning.Printfln("%s (%s): %v", ctx.Name, ctx.URL(), err)
+		}
+	}
+
+	if len(deployments) == 0 {
+		pterm.Info.Println("No deployments found")
+	} else {
+		renderContextDeployments(deployments)
+	}
 
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d contexts could not be reached", len(errs), len(daemonContexts))
+	}
 	return nil
 }
 
+// renderContextDeployments renders deployments of several daemons as a
+// table with a daemon column
+func renderContextDeployments(deployments []map[string]interface{}) {
+	if quiet {
+		for _, dep := range deployments {
+			printIDs(fmt.Sprintf("%v", dep["deployment_id"]))
+		}
+		return
+	}
+	tableData := pterm.TableData{
+		{"Daemon", "ID", "Status", "Nodes", "Completed", "Failed", "Created", "ETA"},
+	}
+	for _, dep := range deployments {
+		created := ""
+		if createdAt, ok := dep["created_at"].(string); ok {
+			if t, err := time.Parse(time.RFC3339, createdAt); err == nil {
+				created = t.Format("2006-01-02 15:04:05")
+			}
+		}
+
+		tableData = append(tableData, []string{
+			fmt.Sprintf("%v", dep["daemon"]),
+			fmt.Sprintf("%v", dep["deployment_id"]),
+			formatStatus(fmt.Sprintf("%v", dep["status"])),
+			fmt.Sprintf("%v", dep["total_nodes"]),
+			fmt.Sprintf("%v", dep["nodes_completed"]),
+			fmt.Sprintf("%v", dep["nodes_failed"]),
+			created,
+			valueOrDash(formatEstimate(dep["estimate"])),
+		})
+	}
+
+	renderTable(tableData)
+}
+
 func formatStatus(status string) string {
 	switch status {
 	case "running":
@@ -401,6 +1045,63 @@ func formatStatus(status string) string {
 	}
 }
 
+// formatLiveness renders a node's liveness with how long ago its last
+// heartbeat arrived. Silence is only highlighted while the node is meant to be
+// working; finished nodes are expected to go offline.
+func formatLiveness(liveness, lastHeartbeat, status string) string {
+	text := liveness
+	if t, err := time.Parse(time.RFC3339, lastHeartbeat); err == nil && liveness != "online" {
+		text += fmt.Sprintf(" (%s)", time.Since(t).Round(time.Second))
+	}
+	switch {
+	case liveness == "":
+		return "-"
+	case status == "completed" || status == "failed" || status == "terminated":
+		return pterm.FgGray.Sprint(text)
+	case liveness == "online":
+		return pterm.FgGreen.Sprint(text)
+	case liveness == "stale":
+		return pterm.FgYellow.Sprint(text)
+	default:
+		return pterm.FgRed.Sprint(text)
+	}
+}
+
+// progressBar renders a completion percentage as a bar of width cells
+func progressBar(percent float64, width int) string {
+	filled := min(max(int(percent/100*float64(width)), 0), width)
+	return strings.Repeat("█", filled) + strings.Repeat("░", width-filled)
+}
+
+// formatEstimate renders a deployment's completion estimate as the local
+// time it is expected to finish and how long that is from now
+func formatEstimate(value interface{}) string {
+	estimate, ok := value.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	completesAt, err := time.Parse(time.RFC3339, fmt.Sprintf("%v", estimate["completes_at"]))
+	if err != nil {
+		return ""
+	}
+	remaining, _ := estimate["remaining_seconds"].(float64)
+	return fmt.Sprintf("%s (in %s)", completesAt.Local().Format("15:04"), formatUptime(time.Duration(remaining)*time.Second))
+}
+
+// nodeProgress returns the progress a node's workload reported. Completed
+// nodes count as done even if their workload never reported any.
+func nodeProgress(n map[string]interface{}) (float64, string, bool) {
+	if progress, ok := n["progress"].(map[string]interface{}); ok {
+		percent, _ := progress["percent"].(float64)
+		message, _ := progress["message"].(string)
+		return percent, message, true
+	}
+	if n["status"] == "completed" {
+		return 100, "", true
+	}
+	return 0, "", false
+}
+
 func statusCommand(c *cli.Context) error {
 	if c.Bool("verbose") {
 		logrus.SetLevel(logrus.DebugLevel)
@@ -427,7 +1128,7 @@ func statusCommand(c *cli.Context) error {
 
 	// Handle case where deployment doesn't exist
 	if deployment["deployment_id"] == nil {
-		return fmt.Errorf("deployment %s not found", id)
+		return notFoundError("deployment", id)
 	}
 
 	// Display deployment info
@@ -436,30 +1137,63 @@ func statusCommand(c *cli.Context) error {
 	fmt.Printf("Status: %s\n", formatStatus(status))
 	fmt.Printf("Cloud Provider: %v\n", deployment["cloud_provider"])
 	fmt.Printf("Total Nodes: %v\n", deployment["total_nodes"])
-	fmt.Printf("Completed: %v | Failed: %v\n\n", deployment["nodes_completed"], deployment["nodes_failed"])
+	fmt.Printf("Completed: %v | Failed: %v\n", deployment["nodes_completed"], deployment["nodes_failed"])
+	if progress, ok := deployment["progress"].(float64); ok {
+		fmt.Printf("Progress: [%s] %.0f%%\n", progressBar(progress, 20), progress)
+	}
+	if eta := formatEstimate(deployment["estimate"]); eta != "" {
+		source, _ := deployment["estimate"].(map[string]interface{})["source"].(string)
+		fmt.Printf("ETA: %s, from %s\n", eta, source)
+	}
+	if keepUntil, ok := deployment["keep_failed_until"].(string); ok {
+		if t, err := time.Parse(time.RFC3339, keepUntil); err == nil {
+			fmt.Printf("Failed nodes kept until: %s\n", t.Local().Format("2006-01-02 15:04:05"))
+		}
+	} else if keepFailed, ok := deployment["keep_failed"].(float64); ok {
+		fmt.Printf("Failed nodes kept for: %s\n", time.Duration(keepFailed)*time.Second)
+	}
+	if source, ok := deployment["imported_from"].(map[string]interface{}); ok {
+		fmt.Printf("Imported from: %s\n", formatImportSource(source))
+	}
+	if debug, _ := deployment["debug"].(bool); debug {
+		fmt.Println("Debug: on, agents log verbosely and keep their working directories")
+	}
+	if vars, ok := deployment["variables"].(map[string]interface{}); ok {
+		fmt.Printf("Variables: %s\n", formatVariables(vars))
+	}
+	fmt.Println()
 
 	// Safely handle nodes array
 	if deployment["nodes"] == nil {
 		pterm.Info.Println("No nodes found for this deployment")
-		return nil
+		return deploymentOutcome(deployment)
 	}
 
 	nodes, ok := deployment["nodes"].([]interface{})
 	if !ok {
 		pterm.Error.Println("Invalid nodes data format")
-		return nil
+		return deploymentOutcome(deployment)
 	}
 
 	if len(nodes) == 0 {
 		pterm.Info.Println("No nodes found for this deployment")
-		return nil
+		return deploymentOutcome(deployment)
+	}
+	if quiet {
+		for _, node := range nodes {
+			if n, ok := node.(map[string]interface{}); ok {
+				printIDs(fmt.Sprintf("%v", n["node_id"]))
+			}
+		}
+		return deploymentOutcome(deployment)
 	}
 
 	// Create nodes table
 	tableData := pterm.TableData{
-		{"Node ID", "Status", "IP Address", "Instance ID"},
+		{"Node ID", "Status", "Liveness", "Progress", "IP Address", "Private IP", "Instance ID", "Zone"},
 	}
 
+	zones := make(map[string]int)
 	for _, node := range nodes {
 		n := node.(map[string]interface{})
 		nodeID := fmt.Sprintf("%v", n["node_id"])
@@ -471,22 +1205,57 @@ func statusCommand(c *cli.Context) error {
 				ip = ipStr
 			}
 		}
+		privateIP := "-"
+		if n["private_ip_address"] != nil {
+			privateIP = fmt.Sprintf("%v", n["private_ip_address"])
+		}
+		if n["ipv6_address"] != nil && n["ipv6_address"] != n["ip_address"] {
+			privateIP += fmt.Sprintf(" / %v", n["ipv6_address"])
+		}
 		instanceID := "-"
 		if n["instance_id"] != nil {
 			instanceID = fmt.Sprintf("%v", n["instance_id"])
 		}
+		zone, _ := n["availability_zone"].(string)
+		if zone != "" {
+			zones[zone]++
+		}
+		progress := "-"
+		if percent, message, ok := nodeProgress(n); ok {
+			progress = fmt.Sprintf("[%s] %3.0f%%", progressBar(percent, 10), percent)
+			if message != "" {
+				progress += " " + message
+			}
+		}
+
+		liveness, _ := n["liveness"].(string)
+		lastHeartbeat, _ := n["last_heartbeat"].(string)
 
 		tableData = append(tableData, []string{
 			nodeID,
 			formatStatus(nodeStatus),
+			formatLiveness(liveness, lastHeartbeat, nodeStatus),
+			progress,
 			ip,
+			privateIP,
 			instanceID,
+			valueOrDash(zone),
 		})
 	}
 
-	pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+	renderTable(tableData)
 
-	return nil
+	if len(zones) > 0 {
+		spread := make([]string, 0, len(zones))
+		for _, zone := range sortedKeys(zones) {
+			spread = append(spread, fmt.Sprintf("%s: %d", zone, zones[zone]))
+		}
+		fmt.Printf("\nZone spread: %s\n", strings.Join(spread, ", "))
+	}
+
+	// A failed deployment fails the command, so scripts can check the
+	// outcome by exit code
+	return deploymentOutcome(deployment)
 }
 
 func logsCommand(c *cli.Context) error {
@@ -581,7 +1350,7 @@ func logsCommand(c *cli.Context) error {
 				message = pterm.FgRed.Sprint(message)
 			}
 
-			fmt.Printf("%s %s\n", nodeLabel, message)
+			fmt.Fprintf(stdout, "%s %s\n", nodeLabel, message)
 		}
 
 		if !follow {
@@ -620,6 +1389,11 @@ func loadConfig(filename string) (*TaskFlyConfig, error) {
 		return nil, err
 	}
 
+	// Input variables get their defaults, there is nothing to deploy
+	if data, err = substituteDefaults(data); err != nil {
+		return nil, err
+	}
+
 	var config TaskFlyConfig
 	if err := yaml.Unmarshal(data, &config); err != nil {
 		return nil, err
@@ -628,29 +1402,26 @@ func loadConfig(filename string) (*TaskFlyConfig, error) {
 	return &config, nil
 }
 
-func createBundle(config *TaskFlyConfig) (string, error) {
+// createBundle packs taskfly.yml and the application files into a
+// deterministic bundle, so unchanged inputs always give the same digest.
+// Without a format, a bundle_name ending in .zip selects zip.
+func createBundle(config *TaskFlyConfig, format bundle.Format) (string, error) {
+	if format == "" && strings.HasSuffix(strings.ToLower(config.BundleName), ".zip") {
+		format = bundle.FormatZip
+	}
+	if format != "" && format != bundle.FormatTarGz && format != bundle.FormatZip {
+		return "", fmt.Errorf("unsupported bundle format %q, must be %s or %s", format, bundle.FormatTarGz, bundle.FormatZip)
+	}
+
 	bundleName := config.BundleName
 	if bundleName == "" {
 		bundleName = "taskfly_bundle.tar.gz"
+		if format == bundle.FormatZip {
+			bundleName = "taskfly_bundle.zip"
+		}
 	}
 
-	// Create tar.gz file
-	file, err := os.Create(bundleName)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	gzipWriter := gzip.NewWriter(file)
-	defer gzipWriter.Close()
-
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer tarWriter.Close()
-
-	// Add taskfly.yml first
-	if err := addFileToTar(tarWriter, "taskfly.yml"); err != nil {
-		return "", fmt.Errorf("failed to add taskfly.yml: %w", err)
-	}
+	files := []bundle.File{{Name: "taskfly.yml", Path: "taskfly.yml"}}
 
 	// Add application files
 	for _, pattern := range config.ApplicationFiles {
@@ -679,7 +1450,7 @@ func createBundle(config *TaskFlyConfig) (string, error) {
 						return err
 					}
 					if !info.IsDir() {
-						return addFileToTar(tarWriter, path)
+						files = append(files, bundle.File{Name: path, Path: path})
 					}
 					return nil
 				})
@@ -688,43 +1459,35 @@ func createBundle(config *TaskFlyConfig) (string, error) {
 				}
 			} else {
 				// Add single file
-				if err := addFileToTar(tarWriter, filePath); err != nil {
-					return "", fmt.Errorf("failed to add %s: %w", filePath, err)
-				}
+				files = append(files, bundle.File{Name: filePath, Path: filePath})
 			}
 		}
 	}
 
-	return bundleName, nil
-}
-
-func addFileToTar(tarWriter *tar.Writer, filename string) error {
-	file, err := os.Open(filename)
-	if err != nil {
-		return err
+	// Don't pack a previous bundle into the new one
+	if abs, err := filepath.Abs(bundleName); err == nil {
+		kept := files[:0]
+		for _, file := range files {
+			if path, err := filepath.Abs(file.Path); err != nil || path != abs {
+				kept = append(kept, file)
+			}
+		}
+		files = kept
 	}
-	defer file.Close()
 
-	info, err := file.Stat()
-	if err != nil {
-		return err
+	warnings, err := bundle.Create(bundleName, files, bundle.Options{Format: format, PreserveModTimes: config.PreserveMtimes})
+	for _, warning := range warnings {
+		pterm.Warning.Println(warning)
 	}
-
-	header, err := tar.FileInfoHeader(info, info.Name())
 	if err != nil {
-		return err
-	}
-	header.Name = filename
-
-	if err := tarWriter.WriteHeader(header); err != nil {
-		return err
+		return "", err
 	}
-
-	_, err = io.Copy(tarWriter, file)
-	return err
+	return bundleName, nil
 }
 
-func uploadBundle(c *cli.Context, bundlePath string) (map[string]interface{}, error) {
+// uploadBundle posts a bundle to the daemon to create a deployment and
+// returns the daemon's response, including rejections
+func uploadBundle(ctx context.Context, daemonURL, bundlePath string, opts uploadOptions) (map[string]interface{}, error) {
 	// Open the bundle file
 	file, err := os.Open(bundlePath)
 	if err != nil {
@@ -735,6 +1498,30 @@ func uploadBundle(c *cli.Context, bundlePath string) (map[string]interface{}, er
 	// Create multipart form
 	var b bytes.Buffer
 	writer := multipart.NewWriter(&b)
+	if opts.KeepFailed > 0 {
+		if err := writer.WriteField("keep_failed", opts.KeepFailed.String()); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Simulate {
+		if err := writer.WriteField("simulate", "true"); err != nil {
+			return nil, err
+		}
+	}
+	if opts.UploadID != "" {
+		if err := writer.WriteField("upload_id", opts.UploadID); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.Variables) > 0 {
+		vars, err := json.Marshal(opts.Variables)
+		if err != nil {
+			return nil, err
+		}
+		if err := writer.WriteField("variables", string(vars)); err != nil {
+			return nil, err
+		}
+	}
 	part, err := writer.CreateFormFile("bundle", filepath.Base(bundlePath))
 	if err != nil {
 		return nil, err
@@ -751,7 +1538,7 @@ func uploadBundle(c *cli.Context, bundlePath string) (map[string]interface{}, er
 	}
 
 	// Create and send request
-	req, err := http.NewRequest("POST", getDaemonURL(c)+"/api/v1/deployments", &b)
+	req, err := http.NewRequestWithContext(ctx, "POST", daemonURL+"/api/v1/deployments", &b)
 	if err != nil {
 		return nil, err
 	}
@@ -773,6 +1560,9 @@ func uploadBundle(c *cli.Context, bundlePath string) (map[string]interface{}, er
 	if err := json.Unmarshal(body, &result); err != nil {
 		return nil, err
 	}
+	if resp.StatusCode == http.StatusConflict {
+		return nil, withExitCode(exitRejected, fmt.Errorf("%w: %v", errUploadInProgress, result["error"]))
+	}
 
 	return result, nil
 }
@@ -837,6 +1627,93 @@ func shellCommand(c *cli.Context) error {
 				pterm.Error.Println(err)
 			}
 
+		case "report":
+			if len(parts) < 2 {
+				pterm.Error.Println("Usage: report <deployment-id> [json|markdown|html]")
+				continue
+			}
+			format := "markdown"
+			if len(parts) > 2 {
+				format = parts[2]
+			}
+			set := flag.NewFlagSet("report", flag.ContinueOnError)
+			set.String("id", parts[1], "")
+			set.String("format", format, "")
+			set.String("output", "", "")
+			set.Bool("verbose", c.Bool("verbose"), "")
+			tempCtx := cli.NewContext(c.App, set, c)
+			set.Parse([]string{})
+
+			if err := reportCommand(tempCtx); err != nil {
+				pterm.Error.Println(err)
+			}
+
+		case "export":
+			if len(parts) < 3 {
+				pterm.Error.Println("Usage: export <deployment-id> <metrics|results> [csv|parquet]")
+				continue
+			}
+			format := "csv"
+			if len(parts) > 3 {
+				format = parts[3]
+			}
+			set := flag.NewFlagSet("export", flag.ContinueOnError)
+			set.String("id", parts[1], "")
+			set.String("what", parts[2], "")
+			set.String("format", format, "")
+			set.String("node", "", "")
+			set.String("output", "", "")
+			set.Bool("verbose", c.Bool("verbose"), "")
+			tempCtx := cli.NewContext(c.App, set, c)
+			set.Parse([]string{})
+
+			if err := exportCommand(tempCtx); err != nil {
+				pterm.Error.Println(err)
+			}
+
+		case "search":
+			if len(parts) < 2 {
+				pterm.Error.Println("Usage: search <query>")
+				continue
+			}
+			set := flag.NewFlagSet("search", flag.ContinueOnError)
+			set.Int("limit", 50, "")
+			set.Bool("verbose", c.Bool("verbose"), "")
+			set.Parse(parts[1:])
+			tempCtx := cli.NewContext(c.App, set, c)
+
+			if err := searchCommand(tempCtx); err != nil {
+				pterm.Error.Println(err)
+			}
+
+		case "node":
+			if len(parts) >= 4 && parts[1] == "config" {
+				set := flag.NewFlagSet("node config", flag.ContinueOnError)
+				set.String("id", parts[2], "")
+				set.String("node", parts[3], "")
+				set.String("format", "table", "")
+				tempCtx := cli.NewContext(c.App, set, c)
+				set.Parse([]string{})
+
+				if err := nodeConfigCommand(tempCtx); err != nil {
+					pterm.Error.Println(err)
+				}
+				continue
+			}
+			if len(parts) < 3 || parts[1] != "describe" {
+				pterm.Error.Println("Usage: node describe <node-id> | node config <deployment-id> <node>")
+				continue
+			}
+			set := flag.NewFlagSet("node describe", flag.ContinueOnError)
+			set.String("id", parts[2], "")
+			set.Bool("verbose", c.Bool("verbose"), "")
+			tempCtx := cli.NewContext(c.App, set, c)
+			set.Parse([]string{})
+
+			if err := nodeDescribeCommand(tempCtx); err != nil {
+				pterm.Error.Println(err)
+			}
+
 		case "logs":
 			if len(parts) < 2 {
 				pterm.Error.Println("Usage: logs <deployment-id> [--node <node-id>] [--follow]")
@@ -936,6 +1813,11 @@ func printShellHelp() {
 		{"list, ls", "List all deployments"},
 		{"status <id>", "Show detailed status of a deployment"},
 		{"logs <id> [--node <node-id>] [--follow]", "View logs from a deployment"},
+		{"report <id> [json|markdown|html]", "Show the completion summary of a deployment"},
+		{"export <id> <metrics|results> [csv|parquet]", "Export node metrics or results to a file"},
+		{"search <query>", "Search deployments, nodes and recent logs"},
+		{"node describe <node-id>", "Show host inventory and uptime of a node"},
+		{"node config <id> <node>", "Show the config a node received and where each key came from"},
 		{"up, deploy", "Deploy from taskfly.yml in current directory"},
 		{"validate [config]", "Validate taskfly.yml configuration"},
 		{"down <id>", "Terminate a deployment"},
@@ -949,7 +1831,7 @@ func printShellHelp() {
 		data = append(data, cmd)
 	}
 
-	pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+	renderTable(data)
 }
 
 func splitShellCommand(line string) []string {
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/pterm/pterm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// sparkTicks are the bar heights of a sparkline, lowest first
+var sparkTicks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkWidth is the number of columns of each sparkline
+const sparkWidth = 40
+
+func metricsCommand(c *cli.Context) error {
+	if c.Bool("verbose") {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	id := c.String("id")
+	minutes := c.Int("minutes")
+	if minutes <= 0 {
+		return fmt.Errorf("invalid --minutes %d, must be positive", minutes)
+	}
+
+	now := time.Now()
+	since := now.Add(-time.Duration(minutes) * time.Minute)
+
+	query := url.Values{}
+	query.Set("since", since.UTC().Format(time.RFC3339))
+	if node := c.String("node"); node != "" {
+		query.Set("node", node)
+	}
+
+	resp, err := http.Get(getDaemonURL(c) + "/api/v1/deployments/" + url.PathEscape(id) + "/metrics?" + query.Encode())
+	if err != nil {
+		return fmt.Errorf("failed to fetch metrics: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return notFoundError("deployment", id)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch metrics: %s", string(body))
+	}
+
+	var result struct {
+		Samples []state.MetricsSample `json:"samples"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	pterm.DefaultSection.Printfln("Metrics for %s (last %d minutes)", id, minutes)
+	if len(result.Samples) == 0 {
+		pterm.Info.Println("No metrics reported in this window")
+		return nil
+	}
+
+	byNode := make(map[string][]state.MetricsSample)
+	for _, sample := range result.Samples {
+		byNode[sample.NodeID] = append(byNode[sample.NodeID], sample)
+	}
+	nodeIDs := make([]string, 0, len(byNode))
+	for nodeID := range byNode {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+
+	for _, nodeID := range nodeIDs {
+		samples := byNode[nodeID]
+		sort.Slice(samples, func(i, j int) bool { return samples[i].Timestamp.Before(samples[j].Timestamp) })
+		latest := samples[len(samples)-1]
+
+		// Load is drawn against the core count so a saturated node fills the bar
+		loadScale := float64(latest.CPUCores)
+		for _, sample := range samples {
+			loadScale = math.Max(loadScale, sample.LoadAvg1)
+		}
+
+		fmt.Printf("%s  %s\n", pterm.Bold.Sprint(nodeID),
+			pterm.Gray(fmt.Sprintf("%d samples, last %s ago", len(samples), now.Sub(latest.Timestamp).Round(time.Second))))
+		fmt.Printf("  CPU  %s %5.1f%%\n",
+			pterm.FgRed.Sprint(renderSparkline(samples, since, now, sparkWidth, 100, func(m state.SystemMetrics) float64 { return m.CPUUsage })),
+			latest.CPUUsage)
+		fmt.Printf("  MEM  %s %5.1f%%\n",
+			pterm.FgGreen.Sprint(renderSparkline(samples, since, now, sparkWidth, 100, memoryPercent)),
+			memoryPercent(latest.SystemMetrics))
+		fmt.Printf("  LOAD %s %5.2f / %d cores\n",
+			pterm.FgYellow.Sprint(renderSparkline(samples, since, now, sparkWidth, loadScale, func(m state.SystemMetrics) float64 { return m.LoadAvg1 })),
+			latest.LoadAvg1, latest.CPUCores)
+		fmt.Println()
+	}
+
+	return nil
+}
+
+// memoryPercent returns the share of a node's memory in use
+func memoryPercent(m state.SystemMetrics) float64 {
+	if m.MemoryTotal == 0 {
+		return 0
+	}
+	return float64(m.MemoryUsed) / float64(m.MemoryTotal) * 100
+}
+
+// renderSparkline renders samples between from and to as width columns, each
+// the mean of the samples in its slice of time scaled against scale. Columns
+// without samples are left blank so reporting gaps stand out.
+func renderSparkline(samples []state.MetricsSample, from, to time.Time, width int, scale float64, value func(state.SystemMetrics) float64) string {
+	sums := make([]float64, width)
+	counts := make([]int, width)
+	span := to.Sub(from)
+	for _, sample := range samples {
+		column := int(float64(sample.Timestamp.Sub(from)) / float64(span) * float64(width))
+		if column < 0 || column > width {
+			continue
+		}
+		if column == width {
+			column--
+		}
+		sums[column] += value(sample.SystemMetrics)
+		counts[column]++
+	}
+
+	var b strings.Builder
+	for i := range sums {
+		if counts[i] == 0 {
+			b.WriteRune(' ')
+			continue
+		}
+		level := 0
+		if scale > 0 {
+			level = int(sums[i] / float64(counts[i]) / scale * float64(len(sparkTicks)-1))
+		}
+		level = max(0, min(len(sparkTicks)-1, level))
+		b.WriteRune(sparkTicks[level])
+	}
+	return b.String()
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/pterm/pterm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// NodeDetails represents the response from /api/v1/nodes/:id
+type NodeDetails struct {
+	NodeID           string     `json:"node_id"`
+	NodeIndex        int        `json:"node_index"`
+	DeploymentID     string     `json:"deployment_id"`
+	Status           string     `json:"status"`
+	IPAddress        string     `json:"ip_address"`
+	PrivateIPAddress string     `json:"private_ip_address"`
+	IPv6Address      string     `json:"ipv6_address"`
+	InstanceID       string     `json:"instance_id"`
+	AvailabilityZone string     `json:"availability_zone"`
+	LastUpdate       time.Time  `json:"last_update"`
+	LastHeartbeat    string     `json:"last_heartbeat"`
+	Liveness         string     `json:"liveness"`
+	RegisteredAt     *time.Time `json:"registered_at"`
+	RegisteredFrom   string     `json:"registered_from"`
+	ClaimDeadline    *time.Time `json:"claim_deadline"`
+	ErrorMessage     string     `json:"error_message"`
+	ShutdownReason   string     `json:"shutdown_reason"`
+	QuarantinedUntil *time.Time `json:"quarantined_until"`
+	Phases           []struct {
+		Status  string    `json:"status"`
+		At      time.Time `json:"at"`
+		Message string    `json:"message"`
+	} `json:"phases"`
+	UptimeSeconds int64 `json:"uptime_seconds"`
+	Metrics       *struct {
+		Custom map[string]float64 `json:"custom"`
+	} `json:"metrics"`
+	HealthChecks []HealthCheck `json:"health_checks"`
+	SystemInfo   *struct {
+		Hostname      string    `json:"hostname"`
+		OS            string    `json:"os"`
+		OSVersion     string    `json:"os_version"`
+		KernelVersion string    `json:"kernel_version"`
+		Arch          string    `json:"arch"`
+		CPUModel      string    `json:"cpu_model"`
+		CPUCores      int       `json:"cpu_cores"`
+		MemoryTotal   uint64    `json:"memory_total"`
+		DiskTotal     uint64    `json:"disk_total"`
+		BootTime      time.Time `json:"boot_time"`
+		AgentVersion  string    `json:"agent_version"`
+		Cloud         *struct {
+			Provider         string `json:"provider"`
+			InstanceID       string `json:"instance_id"`
+			InstanceType     string `json:"instance_type"`
+			Region           string `json:"region"`
+			AvailabilityZone string `json:"availability_zone"`
+			ImageID          string `json:"image_id"`
+		} `json:"cloud"`
+	} `json:"system_info"`
+}
+
+func nodeDescribeCommand(c *cli.Context) error {
+	if c.Bool("verbose") {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	id := c.String("id")
+
+	resp, err := http.Get(getDaemonURL(c) + "/api/v1/nodes/" + id)
+	if err != nil {
+		return fmt.Errorf("failed to get node: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return notFoundError("node", id)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get node: %s", string(body))
+	}
+
+	var node NodeDetails
+	if err := json.Unmarshal(body, &node); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	pterm.DefaultSection.Printfln("Node: %s", node.NodeID)
+	fmt.Printf("Deployment: %s (index %d)\n", node.DeploymentID, node.NodeIndex)
+	fmt.Printf("Status: %s\n", formatStatus(node.Status))
+	fmt.Printf("Last Update: %s\n", node.LastUpdate.Format("2006-01-02 15:04:05"))
+	fmt.Printf("Liveness: %s\n", formatLiveness(node.Liveness, node.LastHeartbeat, node.Status))
+	if node.RegisteredAt != nil {
+		fmt.Printf("Registered: %s from %s\n", node.RegisteredAt.Local().Format("2006-01-02 15:04:05"), node.RegisteredFrom)
+	} else if node.ClaimDeadline != nil {
+		fmt.Printf("Registration deadline: %s\n", node.ClaimDeadline.Local().Format("2006-01-02 15:04:05"))
+	}
+	if node.ErrorMessage != "" {
+		fmt.Printf("Message: %s\n", node.ErrorMessage)
+	}
+	if node.QuarantinedUntil != nil && node.ShutdownReason == "" {
+		fmt.Printf("Quarantined until: %s\n", node.QuarantinedUntil.Local().Format("2006-01-02 15:04:05"))
+	}
+	if node.ShutdownReason != "" {
+		fmt.Printf("Shut down: %s\n", node.ShutdownReason)
+	}
+	fmt.Println()
+
+	data := pterm.TableData{
+		{"Property", "Value"},
+		{"Instance ID", valueOrDash(node.InstanceID)},
+		{"Public IP", valueOrDash(node.IPAddress)},
+		{"Private IP", valueOrDash(node.PrivateIPAddress)},
+		{"IPv6", valueOrDash(node.IPv6Address)},
+		{"Zone", valueOrDash(node.AvailabilityZone)},
+	}
+
+	info := node.SystemInfo
+	if info == nil {
+		renderTable(data)
+		pterm.Info.Println("No host inventory reported yet (node has not registered or runs an older agent)")
+		if err := renderPhases(node); err != nil {
+			return err
+		}
+		return renderTelemetry(node)
+	}
+
+	uptime := "-"
+	if node.UptimeSeconds > 0 {
+		uptime = formatUptime(time.Duration(node.UptimeSeconds) * time.Second)
+	}
+
+	data = append(data,
+		[]string{"Hostname", valueOrDash(info.Hostname)},
+		[]string{"OS", valueOrDash(strings.TrimSpace(info.OS + " " + info.OSVersion))},
+		[]string{"Kernel", valueOrDash(info.KernelVersion)},
+		[]string{"Architecture", valueOrDash(info.Arch)},
+		[]string{"CPU", fmt.Sprintf("%s (%d cores)", valueOrDash(info.CPUModel), info.CPUCores)},
+		[]string{"Memory", fmt.Sprintf("%.1f GB", float64(info.MemoryTotal)/1024/1024/1024)},
+		[]string{"Disk", fmt.Sprintf("%.1f GB", float64(info.DiskTotal)/1024/1024/1024)},
+		[]string{"Uptime", uptime},
+		[]string{"Agent Version", valueOrDash(info.AgentVersion)},
+	)
+
+	if cloud := info.Cloud; cloud != nil {
+		data = append(data,
+			[]string{"Cloud Provider", valueOrDash(cloud.Provider)},
+			[]string{"Instance Type", valueOrDash(cloud.InstanceType)},
+			[]string{"Region", valueOrDash(cloud.Region)},
+			[]string{"Availability Zone", valueOrDash(cloud.AvailabilityZone)},
+			[]string{"Image ID", valueOrDash(cloud.ImageID)},
+		)
+	}
+
+	if err := renderTable(data); err != nil {
+		return err
+	}
+	if err := renderPhases(node); err != nil {
+		return err
+	}
+	return renderTelemetry(node)
+}
+
+// renderPhases prints the lifecycle phases a node went through and how long
+// it spent in each. The current phase runs until now, unless it is final.
+func renderPhases(node NodeDetails) error {
+	if len(node.Phases) == 0 {
+		return nil
+	}
+
+	fmt.Println()
+	pterm.DefaultSection.WithLevel(2).Println("Phase History")
+	data := pterm.TableData{{"Phase", "Entered", "Duration", "Message"}}
+	for i, phase := range node.Phases {
+		duration := "-"
+		if i+1 < len(node.Phases) {
+			duration = node.Phases[i+1].At.Sub(phase.At).Round(time.Second).String()
+		} else if phase.Status != "completed" && phase.Status != "failed" && phase.Status != "terminated" {
+			duration = time.Since(phase.At).Round(time.Second).String()
+		}
+		data = append(data, []string{
+			formatStatus(phase.Status),
+			phase.At.Local().Format("2006-01-02 15:04:05"),
+			duration,
+			valueOrDash(phase.Message),
+		})
+	}
+	return renderTable(data)
+}
+
+// HealthCheck is a custom health check result reported by a telemetry hook
+type HealthCheck struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	Message   string    `json:"message"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// renderTelemetry prints the custom metrics and health checks reported by a
+// node's telemetry hooks
+func renderTelemetry(node NodeDetails) error {
+	if node.Metrics != nil && len(node.Metrics.Custom) > 0 {
+		fmt.Println()
+		pterm.DefaultSection.WithLevel(2).Println("Custom Metrics")
+		data := pterm.TableData{{"Metric", "Value"}}
+		for _, name := range sortedKeys(node.Metrics.Custom) {
+			data = append(data, []string{name, strconv.FormatFloat(node.Metrics.Custom[name], 'f', -1, 64)})
+		}
+		if err := renderTable(data); err != nil {
+			return err
+		}
+	}
+
+	if len(node.HealthChecks) > 0 {
+		fmt.Println()
+		pterm.DefaultSection.WithLevel(2).Println("Health Checks")
+		data := pterm.TableData{{"Check", "Status", "Message", "Checked"}}
+		for _, check := range node.HealthChecks {
+			data = append(data, []string{
+				check.Name,
+				formatHealth(check.Status),
+				valueOrDash(check.Message),
+				check.CheckedAt.Format("15:04:05"),
+			})
+		}
+		if err := renderTable(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// formatHealth colors a health check status
+func formatHealth(status string) string {
+	switch status {
+	case "ok":
+		return pterm.FgGreen.Sprint(status)
+	case "warning":
+		return pterm.FgYellow.Sprint(status)
+	case "critical":
+		return pterm.FgRed.Sprint(status)
+	default:
+		return status
+	}
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatUptime renders a duration as days, hours and minutes
+func formatUptime(d time.Duration) string {
+	days := int(d.Hours()) / 24
+	hours := int(d.Hours()) % 24
+	minutes := int(d.Minutes()) % 60
+
+	if days > 0 {
+		return fmt.Sprintf("%dd %dh %dm", days, hours, minutes)
+	}
+	if hours > 0 {
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
+
+// valueOrDash returns "-" for empty values in tables
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// nodeQuarantineCommand keeps a failed node alive so it can be inspected
+// before it is shut down
+func nodeQuarantineCommand(c *cli.Context) error {
+	id := c.String("id")
+
+	form := url.Values{}
+	form.Set("duration", c.Duration("duration").String())
+
+	resp, err := http.PostForm(getDaemonURL(c)+"/api/v1/nodes/"+url.PathEscape(id)+"/quarantine", form)
+	if err != nil {
+		return fmt.Errorf("failed to quarantine node: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var result struct {
+		NodeID           string    `json:"node_id"`
+		InstanceID       string    `json:"instance_id"`
+		IPAddress        string    `json:"ip_address"`
+		PrivateIPAddress string    `json:"private_ip_address"`
+		QuarantinedUntil time.Time `json:"quarantined_until"`
+		Error            string    `json:"error"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to quarantine node: %s", result.Error)
+	}
+
+	pterm.Success.Printfln("Node %s (instance %s) quarantined until %s",
+		result.NodeID, result.InstanceID, result.QuarantinedUntil.Local().Format("2006-01-02 15:04:05"))
+	address := result.IPAddress
+	if address == "" {
+		address = result.PrivateIPAddress
+	}
+	if address != "" {
+		fmt.Printf("Inspect it with: ssh <user>@%s\n", address)
+	}
+	pterm.Info.Println("The node is shut down when the quarantine ends. Run this command again to extend it.")
+	return nil
+}
+
+// nodeRevokeCommand invalidates a node's credentials, for example when an
+// instance is suspected to be compromised
+func nodeRevokeCommand(c *cli.Context) error {
+	id := c.String("id")
+
+	resp, err := http.Post(getDaemonURL(c)+"/api/v1/nodes/"+url.PathEscape(id)+"/revoke", "application/json", nil)
+	if err != nil {
+		return fmt.Errorf("failed to revoke node: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var result struct {
+		NodeID string `json:"node_id"`
+		Error  string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to revoke node: %s", result.Error)
+	}
+
+	pterm.Success.Printfln("Revoked the credentials of node %s", result.NodeID)
+	pterm.Info.Println("The agent shuts down on its next request. The instance keeps running until the deployment is torn down.")
+	return nil
+}
+
+// NodeConfigKey is a key of a node's config as returned by
+// /api/v1/deployments/:id/nodes/:node/config
+type NodeConfigKey struct {
+	Key        string              `json:"key"`
+	Value      interface{}         `json:"value"`
+	Source     *state.ConfigSource `json:"source"`
+	ExportedAs string              `json:"exported_as"`
+	File       bool                `json:"file"`
+}
+
+// maxConfigValueWidth is how much of a value the config table shows
+const maxConfigValueWidth = 60
+
+// nodeConfigCommand shows the config a node received, where each key came
+// from and the variable the agent exports it as
+func nodeConfigCommand(c *cli.Context) error {
+	id := c.String("id")
+	node := c.String("node")
+
+	resp, err := http.Get(getDaemonURL(c) + "/api/v1/deployments/" + url.PathEscape(id) + "/nodes/" + url.PathEscape(node) + "/config")
+	if err != nil {
+		return fmt.Errorf("failed to get node config: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var result struct {
+		NodeID        string          `json:"node_id"`
+		NodeIndex     int             `json:"node_index"`
+		DeploymentID  string          `json:"deployment_id"`
+		Status        string          `json:"status"`
+		ConfigVersion int             `json:"config_version"`
+		Keys          []NodeConfigKey `json:"keys"`
+		Error         string          `json:"error"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return notFoundError("node", node)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get node config: %s", result.Error)
+	}
+
+	if c.String("format") == "json" {
+		output, err := json.MarshalIndent(result.Keys, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, string(output))
+		return nil
+	}
+
+	pterm.DefaultSection.Printfln("Config of node: %s", result.NodeID)
+	fmt.Printf("Deployment: %s (index %d)\n", result.DeploymentID, result.NodeIndex)
+	fmt.Printf("Status: %s\n", formatStatus(result.Status))
+	if result.ConfigVersion > 0 {
+		fmt.Printf("Config version: %d (reconfigured while running)\n", result.ConfigVersion)
+	}
+	fmt.Println()
+
+	if len(result.Keys) == 0 {
+		pterm.Info.Println("The node received no config keys")
+		return nil
+	}
+
+	truncated := false
+	data := pterm.TableData{{"Key", "Value", "Source", "Exported As"}}
+	for _, key := range result.Keys {
+		value := formatConfigValue(key.Value)
+		if len(value) > maxConfigValueWidth {
+			value = value[:maxConfigValueWidth-3] + "..."
+			truncated = true
+		}
+		exportedAs := key.ExportedAs
+		if key.File {
+			exportedAs += " (file)"
+		}
+		data = append(data, []string{key.Key, value, formatConfigSource(key.Source), exportedAs})
+	}
+	if err := renderTable(data); err != nil {
+		return err
+	}
+	if truncated {
+		pterm.Info.Println("Long values were shortened, use --format json to see them in full")
+	}
+	return nil
+}
+
+// formatConfigValue renders a config value the way the agent exports it
+func formatConfigValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
+
+// formatConfigSource describes where a config key came from
+func formatConfigSource(source *state.ConfigSource) string {
+	if source == nil {
+		return "-"
+	}
+
+	description := source.From
+	switch source.From {
+	case state.ConfigFromDistributedLists:
+		items := make([]string, len(source.Items))
+		for i, item := range source.Items {
+			items[i] = strconv.Itoa(item)
+		}
+		description = fmt.Sprintf("distributed_lists, item %s", strings.Join(items, ", "))
+		if len(items) > 1 {
+			description = fmt.Sprintf("distributed_lists, items %s", strings.Join(items, ", "))
+		}
+	case state.ConfigFromConfigTemplate:
+		description = fmt.Sprintf("config_template %s", formatConfigValue(source.Template))
+	case state.ConfigFromReconfigure:
+		description = fmt.Sprintf("reconfigure, version %d", source.Version)
+	}
+	if source.Overrides != "" {
+		description += fmt.Sprintf(" (overrides %s)", source.Overrides)
+	}
+	return description
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-runewidth"
+	"github.com/pterm/pterm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+)
+
+// minColumnWidth is how narrow a column gets before columns are hidden
+const minColumnWidth = 8
+
+// tableSeparator matches the separator of pterm.DefaultTable
+const tableSeparator = " | "
+
+var (
+	// quiet is set by --quiet. Commands that list things print only their
+	// IDs, one per line, and everything else is silenced.
+	quiet bool
+
+	// stdout receives what scripts read: IDs in quiet mode and output asked
+	// for explicitly, such as a report or an export to "-". --quiet points
+	// os.Stdout elsewhere, so writes meant to survive it go here.
+	stdout = os.Stdout
+)
+
+// configureOutput applies --quiet and --no-color. NO_COLOR is honored with
+// any non-empty value, see https://no-color.org.
+func configureOutput(c *cli.Context) error {
+	if c.Bool("no-color") || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		pterm.DisableColor()
+		logrus.SetFormatter(&logrus.TextFormatter{DisableColors: true})
+	}
+
+	quiet = c.Bool("quiet")
+	if !quiet {
+		return nil
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", os.DevNull, err)
+	}
+	pterm.DisableOutput()
+	os.Stdout = devNull
+	return nil
+}
+
+// printIDs prints one ID per line for piping into xargs and the like
+func printIDs(ids ...string) {
+	for _, id := range ids {
+		if id != "" {
+			fmt.Fprintln(stdout, id)
+		}
+	}
+}
+
+// renderTable renders a table with a header row, fitted to the output width
+func renderTable(data pterm.TableData) error {
+	data, hidden := fitTable(data, outputWidth())
+	if err := pterm.DefaultTable.WithHasHeader().WithData(data).Render(); err != nil {
+		return err
+	}
+	if len(hidden) > 0 {
+		pterm.Println(pterm.Gray(fmt.Sprintf("Hidden to fit the width: %s (widen the terminal or set COLUMNS)", strings.Join(hidden, ", "))))
+	}
+	return nil
+}
+
+// outputWidth returns the width tables have to fit in: COLUMNS when set,
+// else the terminal's width. Zero means unlimited, when writing to a pipe or
+// file.
+func outputWidth() int {
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return columns
+	}
+	if !term.IsTerminal(int(stdout.Fd())) {
+		return 0
+	}
+	width, _, err := term.GetSize(int(stdout.Fd()))
+	if err != nil {
+		return 0
+	}
+	return width
+}
+
+// fitTable shrinks a table with a header row to width. The widest columns are
+// truncated first, down to minColumnWidth; if that isn't enough, columns are
+// dropped from the right and their headers returned. The first column holds
+// the IDs people copy, so it is never truncated or dropped. Widths are
+// measured in terminal cells, so wide characters and colors are accounted
+// for.
+func fitTable(data pterm.TableData, width int) (pterm.TableData, []string) {
+	if width <= 0 || len(data) == 0 {
+		return data, nil
+	}
+
+	widths := make([]int, len(data[0]))
+	for _, row := range data {
+		for i, value := range row {
+			if i < len(widths) {
+				widths[i] = max(widths[i], cellWidth(value))
+			}
+		}
+	}
+	total := func() int {
+		sum := runewidth.StringWidth(tableSeparator) * (len(widths) - 1)
+		for _, w := range widths {
+			sum += w
+		}
+		return sum
+	}
+	if total() <= width {
+		return data, nil
+	}
+
+	// Take one cell at a time from the widest column that can give one
+	for total() > width {
+		widest := -1
+		for i, w := range widths {
+			if i > 0 && w > minColumnWidth && (widest < 0 || w > widths[widest]) {
+				widest = i
+			}
+		}
+		if widest < 0 {
+			break
+		}
+		widths[widest]--
+	}
+
+	var hidden []string
+	for total() > width && len(widths) > 1 {
+		hidden = append([]string{pterm.RemoveColorFromString(data[0][len(widths)-1])}, hidden...)
+		widths = widths[:len(widths)-1]
+	}
+
+	fitted := make(pterm.TableData, len(data))
+	for r, row := range data {
+		fitted[r] = make([]string, 0, len(widths))
+		for i, value := range row {
+			if i >= len(widths) {
+				break
+			}
+			fitted[r] = append(fitted[r], truncateCell(value, widths[i]))
+		}
+	}
+	return fitted, hidden
+}
+
+// cellWidth returns the widest line of a cell in terminal cells
+func cellWidth(value string) int {
+	width := 0
+	for _, line := range strings.Split(pterm.RemoveColorFromString(value), "\n") {
+		width = max(width, runewidth.StringWidth(line))
+	}
+	return width
+}
+
+// truncateCell elides the lines of a cell that are wider than width. Colors
+// are kept on the lines that fit.
+func truncateCell(value string, width int) string {
+	lines := strings.Split(value, "\n")
+	for i, line := range lines {
+		plain := pterm.RemoveColorFromString(line)
+		if runewidth.StringWidth(plain) > width {
+			lines[i] = runewidth.Truncate(plain, width, "…")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+)
+
+// pendingFile is the journal entry of a pending upload, next to its bundle
+const pendingFile = "upload.json"
+
+// errUploadInProgress is returned when the daemon is still processing an
+// earlier attempt of the same upload
+var errUploadInProgress = errors.New("upload in progress")
+
+// uploadOptions are sent along with a bundle when creating a deployment
+type uploadOptions struct {
+	KeepFailed time.Duration `json:"keep_failed,omitempty"`
+	Simulate   bool          `json:"simulate,omitempty"`
+	UploadID   string        `json:"upload_id,omitempty"`
+
+	// Variables are the values of taskfly.yml's input variables that were
+	// given or prompted for, the daemon applies the defaults
+	Variables map[string]string `json:"variables,omitempty"`
+}
+
+// uploadFlags returns the upload options set by the flags of a command
+func uploadFlags(c *cli.Context) uploadOptions {
+	return uploadOptions{
+		KeepFailed: c.Duration("keep-failed"),
+		Simulate:   c.Bool("simulate"),
+	}
+}
+
+// pendingUpload is a bundle taskfly up started uploading without hearing
+// back from the daemon. It is journaled under ~/.taskfly/pending until the
+// daemon answers, so an interrupted upload can be resumed or cleaned up.
+type pendingUpload struct {
+	uploadOptions
+	DaemonURL string    `json:"daemon_url"`
+	Directory string    `json:"directory"` // where taskfly up was run
+	Bundle    string    `json:"bundle"`    // file name of the bundle in the entry
+	StartedAt time.Time `json:"started_at"`
+
+	dir string
+}
+
+// pendingDir returns the directory pending uploads are journaled in
+func pendingDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".taskfly", "pending"), nil
+}
+
+// newUploadID returns a random ID the daemon recognizes a retried upload by
+func newUploadID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate upload ID: %w", err)
+	}
+	return "up_" + hex.EncodeToString(id), nil
+}
+
+// journalUpload moves a bundle into the pending journal before it is
+// uploaded, and records where and how it is being deployed
+func journalUpload(daemonURL, bundlePath string, opts uploadOptions) (*pendingUpload, error) {
+	root, err := pendingDir()
+	if err != nil {
+		return nil, err
+	}
+	workDir, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get working directory: %w", err)
+	}
+
+	upload := &pendingUpload{
+		uploadOptions: opts,
+		DaemonURL:     daemonURL,
+		Directory:     workDir,
+		Bundle:        filepath.Base(bundlePath),
+		StartedAt:     time.Now(),
+		dir:           filepath.Join(root, opts.UploadID),
+	}
+	if err := os.MkdirAll(upload.dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create pending upload: %w", err)
+	}
+
+	// The bundle is usually on the same filesystem, copy it when it isn't
+	if err := os.Rename(bundlePath, upload.bundlePath()); err != nil {
+		if err := copyLocalFile(bundlePath, upload.bundlePath()); err != nil {
+			upload.remove()
+			return nil, err
+		}
+		os.Remove(bundlePath)
+	}
+
+	data, err := json.MarshalIndent(upload, "", "  ")
+	if err != nil {
+		upload.remove()
+		return nil, fmt.Errorf("failed to marshal pending upload: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(upload.dir, pendingFile), data, 0600); err != nil {
+		upload.remove()
+		return nil, fmt.Errorf("failed to write pending upload: %w", err)
+	}
+	return upload, nil
+}
+
+// loadPendingUploads returns the journaled uploads, oldest first. Entries
+// whose journal or bundle is missing were left by an interrupted journaling
+// and are removed.
+func loadPendingUploads() ([]*pendingUpload, error) {
+	root, err := pendingDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pending uploads: %w", err)
+	}
+
+	var uploads []*pendingUpload
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		upload := &pendingUpload{dir: dir}
+		data, err := os.ReadFile(filepath.Join(dir, pendingFile))
+		if err == nil {
+			err = json.Unmarshal(data, upload)
+		}
+		if err == nil {
+			_, err = os.Stat(upload.bundlePath())
+		}
+		if err != nil || upload.UploadID != entry.Name() {
+			os.RemoveAll(dir)
+			continue
+		}
+		uploads = append(uploads, upload)
+	}
+
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].StartedAt.Before(uploads[j].StartedAt)
+	})
+	return uploads, nil
+}
+
+// findPendingUpload returns the journaled upload with an ID
+func findPendingUpload(uploadID string) (*pendingUpload, error) {
+	uploads, err := loadPendingUploads()
+	if err != nil {
+		return nil, err
+	}
+	for _, upload := range uploads {
+		if upload.UploadID == uploadID {
+			return upload, nil
+		}
+	}
+	return nil, withExitCode(exitNotFound, fmt.Errorf("no pending upload %s, see taskfly pending list", uploadID))
+}
+
+func (p *pendingUpload) bundlePath() string {
+	return filepath.Join(p.dir, p.Bundle)
+}
+
+// remove drops the upload and its bundle from the journal
+func (p *pendingUpload) remove() {
+	if err := os.RemoveAll(p.dir); err != nil {
+		pterm.Warning.Printfln("Failed to remove pending upload %s: %v", p.UploadID, err)
+	}
+}
+
+// upload sends the journaled bundle to the daemon and drops it from the
+// journal once the daemon answered, whether it created a deployment or not.
+// The daemon returns the deployment an earlier attempt created instead of
+// creating another one.
+func (p *pendingUpload) upload(ctx context.Context) (map[string]interface{}, error) {
+	resp, err := uploadBundle(ctx, p.DaemonURL, p.bundlePath(), p.uploadOptions)
+	if err != nil {
+		return nil, err
+	}
+	p.remove()
+	return resp, nil
+}
+
+// createdDeployment asks the daemon whether the upload created a deployment
+// before it was interrupted and returns its ID
+func (p *pendingUpload) createdDeployment() (string, error) {
+	resp, err := http.Get(p.DaemonURL + "/api/v1/deployments")
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch deployments: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+	var deployments []struct {
+		ID       string `json:"deployment_id"`
+		UploadID string `json:"upload_id"`
+	}
+	if err := json.Unmarshal(body, &deployments); err != nil {
+		return "", fmt.Errorf("failed to parse response: %w", err)
+	}
+	for _, deployment := range deployments {
+		if deployment.UploadID == p.UploadID {
+			return deployment.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// copyLocalFile copies src to dst
+func copyLocalFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dst, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	return out.Close()
+}
+
+// interactive reports whether the CLI can prompt on its standard input
+func interactive() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// reconcilePendingUploads handles uploads to the daemon that a previous
+// taskfly up didn't hear back about. Uploads that created a deployment are
+// reported and dropped, for the others the user is offered to resume or
+// discard them.
+func reconcilePendingUploads(c *cli.Context) {
+	uploads, err := loadPendingUploads()
+	if err != nil {
+		pterm.Warning.Printfln("Failed to check pending uploads: %v", err)
+		return
+	}
+
+	daemonURL := getDaemonURL(c)
+	for _, upload := range uploads {
+		if upload.DaemonURL != daemonURL {
+			continue
+		}
+
+		deploymentID, err := upload.createdDeployment()
+		if err != nil {
+			pterm.Warning.Printfln("Failed to check pending upload %s: %v", upload.UploadID, err)
+			continue
+		}
+		if deploymentID != "" {
+			pterm.Info.Printfln("Interrupted upload %s from %s created deployment %s", upload.UploadID, upload.Directory, deploymentID)
+			upload.remove()
+			continue
+		}
+
+		pterm.Warning.Printfln("Upload %s from %s was interrupted %s ago before the daemon answered",
+			upload.UploadID, upload.Directory, time.Since(upload.StartedAt).Round(time.Second))
+		if !interactive() {
+			pterm.Info.Printfln("Resume it with 'taskfly pending resume %s' or drop it with 'taskfly pending clean %s'", upload.UploadID, upload.UploadID)
+			continue
+		}
+
+		choice, err := pterm.DefaultInteractiveSelect.
+			WithOptions([]string{"Resume it", "Discard it", "Keep it for later"}).
+			WithDefaultText("What should happen to the interrupted upload?").
+			Show()
+		if err != nil {
+			continue
+		}
+		switch choice {
+		case "Resume it":
+			if err := resumeUpload(upload); err != nil {
+				pterm.Error.Printfln("Failed to resume upload %s: %v", upload.UploadID, err)
+			}
+		case "Discard it":
+			upload.remove()
+			pterm.Info.Printfln("Discarded upload %s", upload.UploadID)
+		}
+	}
+}
+
+// resumeUpload uploads a pending bundle again and reports the deployment
+func resumeUpload(upload *pendingUpload) error {
+	fmt.Printf("⬆️ Resuming upload %s to %s...\n", upload.UploadID, upload.DaemonURL)
+	resp, err := upload.upload(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to upload bundle: %w", err)
+	}
+	if message, ok := resp["error"].(string); ok {
+		return withExitCode(exitRejected, fmt.Errorf("deployment rejected: %s", message))
+	}
+
+	if existing, _ := resp["existing"].(bool); existing {
+		fmt.Printf("✅ The upload had already created deployment %s\n", resp["deployment_id"])
+	} else {
+		fmt.Printf("✅ Deployment created: %s\n", resp["deployment_id"])
+	}
+	fmt.Printf("📊 Status URL: %s\n", resp["status_url"])
+	return nil
+}
+
+// pendingListCommand lists the uploads that didn't hear back from a daemon
+func pendingListCommand(c *cli.Context) error {
+	uploads, err := loadPendingUploads()
+	if err != nil {
+		return err
+	}
+	if len(uploads) == 0 {
+		pterm.Info.Println("No pending uploads")
+		return nil
+	}
+
+	tableData := pterm.TableData{{"Upload ID", "Daemon", "Directory", "Bundle", "Started"}}
+	for _, upload := range uploads {
+		if quiet {
+			printIDs(upload.UploadID)
+			continue
+		}
+		tableData = append(tableData, []string{
+			upload.UploadID,
+			upload.DaemonURL,
+			upload.Directory,
+			upload.Bundle,
+			upload.StartedAt.Local().Format("2006-01-02 15:04:05"),
+		})
+	}
+	if quiet {
+		return nil
+	}
+	return renderTable(tableData)
+}
+
+// pendingResumeCommand uploads a pending bundle to the daemon it was meant for
+func pendingResumeCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("usage: taskfly pending resume <upload-id>")
+	}
+	upload, err := findPendingUpload(c.Args().First())
+	if err != nil {
+		return err
+	}
+	return resumeUpload(upload)
+}
+
+// pendingCleanCommand drops one or all pending uploads without deploying them
+func pendingCleanCommand(c *cli.Context) error {
+	if c.NArg() > 1 {
+		return fmt.Errorf("usage: taskfly pending clean [upload-id]")
+	}
+	if c.NArg() == 1 {
+		upload, err := findPendingUpload(c.Args().First())
+		if err != nil {
+			return err
+		}
+		upload.remove()
+		pterm.Success.Printfln("Removed pending upload %s", upload.UploadID)
+		return nil
+	}
+
+	uploads, err := loadPendingUploads()
+	if err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		upload.remove()
+	}
+	pterm.Success.Printfln("Removed %d pending uploads", len(uploads))
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// RecommendationsResponse represents the response from /api/v1/recommendations
+type RecommendationsResponse struct {
+	Recommendations []struct {
+		InstanceType  string  `json:"instance_type"`
+		SuggestedType string  `json:"suggested_type"`
+		HourlySavings float64 `json:"hourly_savings_usd"`
+		Message       string  `json:"message"`
+	} `json:"recommendations"`
+	Deployments int `json:"deployments"`
+	Nodes       int `json:"nodes"`
+}
+
+// showRecommendations prints right-sizing suggestions for the configured
+// instance type based on past runs on the daemon. The daemon is optional for
+// validation, so any failure to reach it is only logged.
+func showRecommendations(c *cli.Context, configPath string) {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return
+	}
+	instanceType, _ := config.InstanceConfig[config.CloudProvider]["instance_type"].(string)
+	if instanceType == "" {
+		return
+	}
+
+	query := url.Values{}
+	query.Set("provider", config.CloudProvider)
+	query.Set("instance_type", instanceType)
+	if ns := c.String("namespace"); ns != "" {
+		query.Set("namespace", ns)
+	}
+
+	client := &http.Client{Timeout: 3 * time.Second}
+	resp, err := client.Get(getDaemonURL(c) + "/api/v1/recommendations?" + query.Encode())
+	if err != nil {
+		logrus.Debugf("Skipping right-sizing suggestions: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		logrus.Debugf("Skipping right-sizing suggestions: daemon returned %s", resp.Status)
+		return
+	}
+
+	var result RecommendationsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		logrus.Debugf("Skipping right-sizing suggestions: %v", err)
+		return
+	}
+	if len(result.Recommendations) == 0 {
+		return
+	}
+
+	pterm.DefaultSection.WithLevel(2).Println("Right-Sizing")
+	for _, rec := range result.Recommendations {
+		pterm.Info.Printf("  %s: %s\n", pterm.FgCyan.Sprintf("instance_config.%s.instance_type", config.CloudProvider), rec.Message)
+	}
+	pterm.Info.Printfln("  Based on %d node(s) from %d past deployment(s)", result.Nodes, result.Deployments)
+	fmt.Println()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// reconfigureCommand changes the config of a running deployment, or of one of
+// its nodes. The agents apply it with their next heartbeat.
+func reconfigureCommand(c *cli.Context) error {
+	changes := make(map[string]interface{})
+	for _, assignment := range c.StringSlice("set") {
+		key, value, ok := strings.Cut(assignment, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("invalid --set %q, expected key=value", assignment)
+		}
+		// Values are read as YAML, like global_metadata, so numbers, booleans
+		// and lists keep their type. Anything else is a string.
+		var parsed interface{}
+		if err := yaml.Unmarshal([]byte(value), &parsed); err != nil {
+			parsed = value
+		}
+		switch parsed.(type) {
+		case nil, map[interface{}]interface{}:
+			parsed = value
+		}
+		changes[key] = parsed
+	}
+	for _, key := range c.StringSlice("unset") {
+		changes[key] = nil
+	}
+	if len(changes) == 0 {
+		return fmt.Errorf("nothing to change, use --set key=value or --unset key")
+	}
+
+	path := "/api/v1/deployments/" + url.PathEscape(c.String("id")) + "/config"
+	if node := c.String("node"); node != "" {
+		path = "/api/v1/nodes/" + url.PathEscape(node) + "/config"
+	}
+
+	data, err := json.Marshal(map[string]interface{}{"config": changes})
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPatch, getDaemonURL(c)+path, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reconfigure: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var result struct {
+		ConfigVersions map[string]int `json:"config_versions"`
+		Error          string         `json:"error"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to reconfigure: %s", result.Error)
+	}
+
+	nodes := make([]string, 0, len(result.ConfigVersions))
+	for node := range result.ConfigVersions {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		pterm.Success.Printfln("Node %s: config version %d", node, result.ConfigVersions[node])
+	}
+	pterm.Info.Println("Agents apply the new config with their next heartbeat. Running workloads see it in $TASKFLY_CONFIG_DIR.")
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/pterm/pterm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func reportCommand(c *cli.Context) error {
+	if c.Bool("verbose") {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	id := c.String("id")
+	format := c.String("format")
+	switch format {
+	case "json", "markdown", "html":
+	case "md":
+		format = "markdown"
+	default:
+		return fmt.Errorf("invalid format %q, must be json, markdown or html", format)
+	}
+
+	resp, err := http.Get(getDaemonURL(c) + "/api/v1/deployments/" + url.PathEscape(id) + "/report?format=" + format)
+	if err != nil {
+		return fmt.Errorf("failed to get deployment report: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return notFoundError("deployment", id)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get deployment report: %s", string(body))
+	}
+
+	if format == "json" {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, body, "", "  "); err == nil {
+			body = append(indented.Bytes(), '\n')
+		}
+	}
+
+	output := c.String("output")
+	if output == "" {
+		_, err := stdout.Write(body)
+		return err
+	}
+
+	if err := os.WriteFile(output, body, 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	pterm.Success.Printfln("Report for deployment %s written to %s", id, output)
+	return nil
+}
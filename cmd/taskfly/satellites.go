@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/urfave/cli/v2"
+)
+
+// satellitesCommand lists the satellite daemons relaying through the daemon
+func satellitesCommand(c *cli.Context) error {
+	// Ask the daemon itself, not a satellite chosen with --satellite
+	resp, err := http.Get(daemonURL(c.String("daemon-ip"), c.String("daemon-port"), "") + "/api/v1/satellites")
+	if err != nil {
+		return fmt.Errorf("failed to fetch satellites: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var result struct {
+		Satellites []struct {
+			Name     string    `json:"name"`
+			Address  string    `json:"address"`
+			LastSeen time.Time `json:"last_seen"`
+			Online   bool      `json:"online"`
+		} `json:"satellites"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch satellites: %s", result.Error)
+	}
+
+	if len(result.Satellites) == 0 {
+		pterm.Info.Println("No satellites have registered")
+		return nil
+	}
+
+	if quiet {
+		for _, satellite := range result.Satellites {
+			printIDs(satellite.Name)
+		}
+		return nil
+	}
+
+	tableData := pterm.TableData{{"Name", "Status", "Address", "Last Seen"}}
+	for _, satellite := range result.Satellites {
+		status := pterm.FgRed.Sprint("offline")
+		if satellite.Online {
+			status = pterm.FgGreen.Sprint("online")
+		}
+		tableData = append(tableData, []string{
+			satellite.Name,
+			status,
+			satellite.Address,
+			satellite.LastSeen.Local().Format("2006-01-02 15:04:05"),
+		})
+	}
+	if err := renderTable(tableData); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nUse --satellite <name> to manage a satellite's deployments through this daemon\n")
+	return nil
+}
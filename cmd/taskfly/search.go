@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// SearchResponse represents the response from /api/v1/search
+type SearchResponse struct {
+	Query       string        `json:"query"`
+	Deployments []SearchMatch `json:"deployments"`
+	Nodes       []SearchMatch `json:"nodes"`
+	Logs        []struct {
+		Timestamp    time.Time `json:"timestamp"`
+		NodeID       string    `json:"node_id"`
+		DeploymentID string    `json:"deployment_id"`
+		Message      string    `json:"message"`
+	} `json:"logs"`
+}
+
+// SearchMatch is a deployment or node whose field matched the query
+type SearchMatch struct {
+	DeploymentID string `json:"deployment_id"`
+	NodeID       string `json:"node_id"`
+	Status       string `json:"status"`
+	Field        string `json:"field"`
+	Value        string `json:"value"`
+}
+
+func searchCommand(c *cli.Context) error {
+	if c.Bool("verbose") {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	query := strings.Join(c.Args().Slice(), " ")
+	if query == "" {
+		return fmt.Errorf("usage: taskfly search <query>")
+	}
+
+	params := url.Values{}
+	params.Set("q", query)
+	params.Set("limit", fmt.Sprintf("%d", c.Int("limit")))
+
+	resp, err := http.Get(getDaemonURL(c) + "/api/v1/search?" + params.Encode())
+	if err != nil {
+		return fmt.Errorf("failed to search: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("search failed: %s", string(body))
+	}
+
+	var result SearchResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	if len(result.Deployments)+len(result.Nodes)+len(result.Logs) == 0 {
+		pterm.Info.Printfln("No matches for %q", query)
+		return nil
+	}
+
+	if quiet {
+		for _, m := range result.Deployments {
+			printIDs(m.DeploymentID)
+		}
+		for _, m := range result.Nodes {
+			printIDs(m.NodeID)
+		}
+		return nil
+	}
+
+	if len(result.Deployments) > 0 {
+		pterm.DefaultSection.Printfln("Deployments (%d)", len(result.Deployments))
+		data := pterm.TableData{{"Deployment ID", "Status", "Matched", "Value"}}
+		for _, m := range result.Deployments {
+			data = append(data, []string{m.DeploymentID, formatStatus(m.Status), m.Field, m.Value})
+		}
+		renderTable(data)
+	}
+
+	if len(result.Nodes) > 0 {
+		pterm.DefaultSection.Printfln("Nodes (%d)", len(result.Nodes))
+		data := pterm.TableData{{"Node ID", "Deployment ID", "Status", "Matched", "Value"}}
+		for _, m := range result.Nodes {
+			data = append(data, []string{m.NodeID, m.DeploymentID, formatStatus(m.Status), m.Field, m.Value})
+		}
+		renderTable(data)
+	}
+
+	if len(result.Logs) > 0 {
+		pterm.DefaultSection.Printfln("Logs (%d most recent)", len(result.Logs))
+		for _, entry := range result.Logs {
+			fmt.Printf("%s %s %s\n",
+				pterm.FgGray.Sprint(entry.Timestamp.Local().Format("2006-01-02 15:04:05")),
+				pterm.FgCyan.Sprintf("[%s]", entry.NodeID),
+				entry.Message)
+		}
+	}
+
+	return nil
+}
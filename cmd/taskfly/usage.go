@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/pterm/pterm"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// identityTransport attaches the configured API key and namespace to every
+// request so the daemon can account usage to them
+type identityTransport struct {
+	base      http.RoundTripper
+	apiKey    string
+	namespace string
+}
+
+func (t *identityTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if t.apiKey != "" {
+		req.Header.Set("X-TaskFly-API-Key", t.apiKey)
+	}
+	if t.namespace != "" {
+		req.Header.Set("X-TaskFly-Namespace", t.namespace)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// installIdentity wraps the default transport, which every daemon request in
+// the CLI goes through
+func installIdentity(c *cli.Context) error {
+	if c.String("api-key") == "" && c.String("namespace") == "" {
+		return nil
+	}
+	http.DefaultTransport = &identityTransport{
+		base:      http.DefaultTransport,
+		apiKey:    c.String("api-key"),
+		namespace: c.String("namespace"),
+	}
+	return nil
+}
+
+// UsageResponse represents the response from /api/v1/usage
+type UsageResponse struct {
+	Usage     []UsageEntry    `json:"usage"`
+	Instances []InstanceUsage `json:"instances"`
+	Labels    []LabelUsage    `json:"labels"`
+	Totals    UsageEntry      `json:"totals"`
+}
+
+// UsageEntry is the usage of one API key and namespace
+type UsageEntry struct {
+	APIKeyID          string  `json:"api_key_id"`
+	Namespace         string  `json:"namespace"`
+	Requests          int64   `json:"requests"`
+	BundleBytes       int64   `json:"bundle_bytes"`
+	NodeHours         float64 `json:"node_hours"`
+	EstimatedCost     float64 `json:"estimated_cost_usd"`
+	UnpricedNodeHours float64 `json:"unpriced_node_hours"`
+}
+
+// InstanceUsage is the node time of one provider and instance type
+type InstanceUsage struct {
+	Provider      string   `json:"provider"`
+	InstanceType  string   `json:"instance_type"`
+	NodeHours     float64  `json:"node_hours"`
+	EstimatedCost *float64 `json:"estimated_cost_usd"`
+}
+
+// LabelUsage is the node time of deployments carrying one label
+type LabelUsage struct {
+	Label             string  `json:"label"`
+	Value             string  `json:"value"`
+	NodeHours         float64 `json:"node_hours"`
+	EstimatedCost     float64 `json:"estimated_cost_usd"`
+	UnpricedNodeHours float64 `json:"unpriced_node_hours"`
+}
+
+func usageCommand(c *cli.Context) error {
+	if c.Bool("verbose") {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	query := url.Values{}
+	title := fmt.Sprintf("Usage over the last %s", c.String("window"))
+	if month := c.String("month"); month != "" {
+		query.Set("month", month)
+		title = fmt.Sprintf("Usage for %s", month)
+	} else {
+		query.Set("window", c.String("window"))
+	}
+	if ns := c.String("filter-namespace"); ns != "" {
+		query.Set("namespace", ns)
+	}
+
+	resp, err := http.Get(getDaemonURL(c) + "/api/v1/usage?" + query.Encode())
+	if err != nil {
+		return fmt.Errorf("failed to get usage: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get usage: %s", string(body))
+	}
+
+	var result UsageResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	pterm.DefaultSection.Println(title)
+	if len(result.Usage) == 0 {
+		pterm.Info.Println("No usage recorded in this period")
+		return nil
+	}
+
+	data := pterm.TableData{{"Namespace", "API Key", "Requests", "Bundle Uploads", "Node Hours", "Est. Cost"}}
+	for _, entry := range append(result.Usage, result.Totals) {
+		namespace := entry.Namespace
+		if entry.APIKeyID == "" {
+			namespace = pterm.Bold.Sprint("Total")
+		}
+		data = append(data, []string{
+			namespace,
+			entry.APIKeyID,
+			fmt.Sprintf("%d", entry.Requests),
+			fmt.Sprintf("%.1f MB", float64(entry.BundleBytes)/1024/1024),
+			fmt.Sprintf("%.2f", entry.NodeHours),
+			formatCost(entry.EstimatedCost, entry.UnpricedNodeHours),
+		})
+	}
+
+	if err := renderTable(data); err != nil {
+		return err
+	}
+
+	if len(result.Instances) > 0 {
+		fmt.Println()
+		pterm.DefaultSection.WithLevel(2).Println("By instance type")
+		data = pterm.TableData{{"Provider", "Instance Type", "Node Hours", "Est. Cost"}}
+		for _, instance := range result.Instances {
+			cost := "unknown"
+			if instance.EstimatedCost != nil {
+				cost = fmt.Sprintf("$%.2f", *instance.EstimatedCost)
+			}
+			data = append(data, []string{
+				instance.Provider,
+				valueOrDash(instance.InstanceType),
+				fmt.Sprintf("%.2f", instance.NodeHours),
+				cost,
+			})
+		}
+		if err := renderTable(data); err != nil {
+			return err
+		}
+	}
+
+	if len(result.Labels) > 0 {
+		fmt.Println()
+		pterm.DefaultSection.WithLevel(2).Println("By label")
+		data = pterm.TableData{{"Label", "Value", "Node Hours", "Est. Cost"}}
+		for _, label := range result.Labels {
+			data = append(data, []string{
+				label.Label,
+				valueOrDash(label.Value),
+				fmt.Sprintf("%.2f", label.NodeHours),
+				formatCost(label.EstimatedCost, label.UnpricedNodeHours),
+			})
+		}
+		if err := renderTable(data); err != nil {
+			return err
+		}
+	}
+
+	if result.Totals.UnpricedNodeHours > 0 {
+		pterm.Warning.Printfln("%.2f node hours ran on instance types without a known price and are not included in the estimate",
+			result.Totals.UnpricedNodeHours)
+	}
+
+	return nil
+}
+
+// formatCost renders an estimated spend, marking estimates that leave out
+// unpriced node hours
+func formatCost(cost, unpricedHours float64) string {
+	if unpricedHours > 0 {
+		return fmt.Sprintf("$%.2f*", cost)
+	}
+	return fmt.Sprintf("$%.2f", cost)
+}
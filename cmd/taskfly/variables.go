@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/JustinTimperio/TaskFly/internal/variables"
+	"github.com/pterm/pterm"
+	"github.com/urfave/cli/v2"
+)
+
+// varEnvPrefix prefixes environment variables holding values of input
+// variables, TASKFLY_VAR_dataset sets ${var.dataset}
+const varEnvPrefix = "TASKFLY_VAR_"
+
+// givenVariables returns the values of the variables taskfly.yml declares
+// that were set with --var name=value or in the environment, flags first
+func givenVariables(c *cli.Context, declared []variables.Variable) (map[string]string, error) {
+	given := make(map[string]string)
+	for _, flag := range c.StringSlice("var") {
+		name, value, ok := strings.Cut(flag, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid --var %q, use name=value", flag)
+		}
+		given[name] = value
+	}
+	for _, variable := range declared {
+		if _, ok := given[variable.Name]; ok {
+			continue
+		}
+		if value, ok := os.LookupEnv(varEnvPrefix + variable.Name); ok {
+			given[variable.Name] = value
+		}
+	}
+	return given, nil
+}
+
+// resolveVariables resolves the variables taskfly.yml declares for a
+// deployment and returns the values to send to the daemon along with the
+// configuration they were substituted into. Required variables without a
+// value are prompted for on a terminal.
+func resolveVariables(c *cli.Context, data []byte) (map[string]string, []byte, error) {
+	declared, err := variables.Declared(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	given, err := givenVariables(c, declared)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values, err := variables.Resolve(declared, given)
+	var missing *variables.MissingError
+	if errors.As(err, &missing) && interactive() && !quiet {
+		for _, variable := range declared {
+			if values[variable.Name] != nil {
+				continue
+			}
+			text, err := promptVariable(variable)
+			if err != nil {
+				return nil, nil, err
+			}
+			given[variable.Name] = text
+		}
+		values, err = variables.Resolve(declared, given)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err = variables.Substitute(data, values)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(given) == 0 {
+		given = nil
+	}
+	return given, data, nil
+}
+
+// promptVariable asks for the value of a required variable until a valid
+// one is entered
+func promptVariable(variable variables.Variable) (string, error) {
+	label := variable.Name
+	if variable.Description != "" {
+		label += " (" + variable.Description + ")"
+	}
+
+	if len(variable.Options) > 0 || variable.Type == variables.TypeBool {
+		options := []string{"true", "false"}
+		if len(variable.Options) > 0 {
+			options = make([]string, len(variable.Options))
+			for i, option := range variable.Options {
+				options[i] = variables.Format(option)
+			}
+		}
+		return pterm.DefaultInteractiveSelect.WithOptions(options).WithDefaultText(label).Show()
+	}
+
+	if variable.Type != variables.TypeString {
+		label += " [" + variable.Type + "]"
+	}
+	input := pterm.DefaultInteractiveTextInput.WithDefaultText(label)
+	if variable.Sensitive {
+		input = input.WithMask("*")
+	}
+	for {
+		text, err := input.Show()
+		if err != nil {
+			return "", err
+		}
+		if _, err := variable.Parse(text); err != nil {
+			pterm.Warning.Printfln("Invalid %s: %v", variable.Name, err)
+			continue
+		}
+		return text, nil
+	}
+}
+
+// substituteDefaults substitutes variables into taskfly.yml for commands that
+// only read it: values from the environment, else defaults, else zero values
+func substituteDefaults(data []byte) ([]byte, error) {
+	declared, err := variables.Declared(data)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{}, len(declared))
+	for _, variable := range declared {
+		value := variable.Default
+		if text, ok := os.LookupEnv(varEnvPrefix + variable.Name); ok {
+			if parsed, err := variable.Parse(text); err == nil {
+				value = parsed
+			}
+		}
+		if value == nil {
+			value = variable.Zero()
+		}
+		values[variable.Name] = value
+	}
+	return variables.Substitute(data, values)
+}
+
+// formatVariables formats the variables a deployment recorded as
+// name=value pairs sorted by name
+func formatVariables(vars map[string]interface{}) string {
+	pairs := make([]string, 0, len(vars))
+	for name, value := range vars {
+		pairs = append(pairs, name+"="+variables.Format(value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/mum4k/termdash"
+	"github.com/mum4k/termdash/cell"
+	"github.com/mum4k/termdash/container"
+	"github.com/mum4k/termdash/container/grid"
+	"github.com/mum4k/termdash/keyboard"
+	"github.com/mum4k/termdash/linestyle"
+	"github.com/mum4k/termdash/terminal/tcell"
+	"github.com/mum4k/termdash/terminal/terminalapi"
+	"github.com/mum4k/termdash/widgets/text"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// watchWindow is how far back the node sparklines of taskfly watch reach
+	watchWindow = 5 * time.Minute
+
+	// watchSparkWidth is the number of columns of each node sparkline
+	watchSparkWidth = 16
+
+	// watchCostInterval is how often the cost estimate is refreshed, since
+	// the daemon builds a full report for it
+	watchCostInterval = 15 * time.Second
+)
+
+// DeploymentWatch is the live view of a single deployment: a header with its
+// status, progress, cost and ETA, a line of metrics per node and its logs
+type DeploymentWatch struct {
+	ctx       context.Context
+	daemonURL string
+	id        string
+
+	header    *text.Text
+	nodesText *text.Text
+	logViewer *text.Text
+
+	// Log stream
+	lastLog    time.Time
+	seenLogs   map[string]bool
+	nodeColors map[string]cell.Color
+
+	// Cost estimate, refreshed every watchCostInterval
+	cost          string
+	costUpdatedAt time.Time
+}
+
+func watchCommand(c *cli.Context) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watch := &DeploymentWatch{
+		ctx:        ctx,
+		daemonURL:  getDaemonURL(c),
+		id:         c.String("id"),
+		seenLogs:   make(map[string]bool),
+		nodeColors: make(map[string]cell.Color),
+		cost:       "-",
+	}
+
+	// Fail before taking over the terminal if the deployment doesn't exist
+	if _, err := watch.fetchDeployment(); err != nil {
+		return err
+	}
+
+	terminal, err := tcell.New()
+	if err != nil {
+		return fmt.Errorf("failed to create terminal: %w", err)
+	}
+	defer terminal.Close()
+
+	if watch.header, err = text.New(); err != nil {
+		return fmt.Errorf("failed to create widgets: %w", err)
+	}
+	if watch.nodesText, err = text.New(); err != nil {
+		return fmt.Errorf("failed to create widgets: %w", err)
+	}
+	if watch.logViewer, err = text.New(text.RollContent()); err != nil {
+		return fmt.Errorf("failed to create widgets: %w", err)
+	}
+
+	builder := grid.New()
+	builder.Add(
+		grid.RowHeightFixed(5, grid.Widget(watch.header, container.Border(linestyle.Light), container.BorderTitle(watch.id+" (q to quit)"))),
+		grid.RowHeightPerc(40, grid.Widget(watch.nodesText, container.Border(linestyle.Light), container.BorderTitle("Nodes"))),
+		grid.RowHeightPerc(60, grid.Widget(watch.logViewer, container.Border(linestyle.Light), container.BorderTitle("Logs"))),
+	)
+	gridOpts, err := builder.Build()
+	if err != nil {
+		return fmt.Errorf("failed to build grid: %w", err)
+	}
+	cont, err := container.New(terminal, gridOpts...)
+	if err != nil {
+		return fmt.Errorf("failed to create container: %w", err)
+	}
+
+	go watch.run()
+
+	quitter := func(k *terminalapi.Keyboard) {
+		if k.Key == keyboard.KeyEsc || k.Key == 'q' {
+			cancel()
+		}
+	}
+	if err := termdash.Run(ctx, terminal, cont, termdash.KeyboardSubscriber(quitter), termdash.RedrawInterval(250*time.Millisecond)); err != nil {
+		return fmt.Errorf("termdash run failed: %w", err)
+	}
+	return nil
+}
+
+// run refreshes the view until the watch is quit
+func (w *DeploymentWatch) run() {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		w.refresh()
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh fetches the deployment, its recent metrics and new logs and
+// redraws the view. Failed requests keep the previous content.
+func (w *DeploymentWatch) refresh() {
+	deployment, err := w.fetchDeployment()
+	if err != nil {
+		w.header.Write(fmt.Sprintf(" %v\n", err), text.WriteReplace(), text.WriteCellOpts(cell.FgColor(cell.ColorRed)))
+		return
+	}
+	if time.Since(w.costUpdatedAt) >= watchCostInterval {
+		w.refreshCost()
+	}
+	w.drawHeader(deployment)
+
+	now := time.Now()
+	samples, _ := w.fetchSamples(now.Add(-watchWindow))
+	w.drawNodes(deployment, samples, now)
+
+	w.fetchLogs()
+}
+
+// fetchDeployment returns the deployment's details, including its nodes
+func (w *DeploymentWatch) fetchDeployment() (map[string]interface{}, error) {
+	var deployment map[string]interface{}
+	status, err := w.getJSON("/api/v1/deployments/"+url.PathEscape(w.id), &deployment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deployment status: %w", err)
+	}
+	if status == http.StatusNotFound || deployment["deployment_id"] == nil {
+		return nil, notFoundError("deployment", w.id)
+	}
+	return deployment, nil
+}
+
+// fetchSamples returns the metrics samples the deployment's nodes reported
+// since a time
+func (w *DeploymentWatch) fetchSamples(since time.Time) (map[string][]state.MetricsSample, error) {
+	var result struct {
+		Samples []state.MetricsSample `json:"samples"`
+	}
+	query := url.Values{"since": {since.UTC().Format(time.RFC3339)}}
+	if _, err := w.getJSON("/api/v1/deployments/"+url.PathEscape(w.id)+"/metrics?"+query.Encode(), &result); err != nil {
+		return nil, err
+	}
+
+	byNode := make(map[string][]state.MetricsSample)
+	for _, sample := range result.Samples {
+		byNode[sample.NodeID] = append(byNode[sample.NodeID], sample)
+	}
+	for _, samples := range byNode {
+		sort.Slice(samples, func(i, j int) bool { return samples[i].Timestamp.Before(samples[j].Timestamp) })
+	}
+	return byNode, nil
+}
+
+// refreshCost updates the cost estimate from the deployment's report
+func (w *DeploymentWatch) refreshCost() {
+	var summary state.DeploymentReport
+	if _, err := w.getJSON("/api/v1/deployments/"+url.PathEscape(w.id)+"/report?format=json", &summary); err != nil {
+		return
+	}
+	w.costUpdatedAt = time.Now()
+	if summary.EstimatedCost != nil {
+		w.cost = fmt.Sprintf("$%.4f", *summary.EstimatedCost)
+	} else {
+		w.cost = "unknown"
+	}
+}
+
+// fetchLogs appends the log lines pushed since the last refresh
+func (w *DeploymentWatch) fetchLogs() {
+	path := "/api/v1/deployments/" + url.PathEscape(w.id) + "/logs?limit=1000"
+	if !w.lastLog.IsZero() {
+		path += "&since=" + url.QueryEscape(w.lastLog.Format(time.RFC3339))
+	}
+	var result struct {
+		Logs []struct {
+			Timestamp time.Time `json:"timestamp"`
+			NodeID    string    `json:"node_id"`
+			Message   string    `json:"message"`
+			Stream    string    `json:"stream"`
+		} `json:"logs"`
+	}
+	if _, err := w.getJSON(path, &result); err != nil {
+		return
+	}
+
+	colors := []cell.Color{cell.ColorCyan, cell.ColorGreen, cell.ColorYellow, cell.ColorMagenta, cell.ColorBlue}
+	for _, entry := range result.Logs {
+		// since has second precision, so the last second is fetched again
+		key := fmt.Sprintf("%s|%s|%s|%s", entry.NodeID, entry.Timestamp.Format(time.RFC3339Nano), entry.Stream, entry.Message)
+		if w.seenLogs[key] {
+			continue
+		}
+		w.seenLogs[key] = true
+		if entry.Timestamp.After(w.lastLog) {
+			w.lastLog = entry.Timestamp
+		}
+
+		color, ok := w.nodeColors[entry.NodeID]
+		if !ok {
+			color = colors[len(w.nodeColors)%len(colors)]
+			w.nodeColors[entry.NodeID] = color
+		}
+		w.logViewer.Write("["+w.shortNodeID(entry.NodeID)+"] ", text.WriteCellOpts(cell.FgColor(color)))
+		if entry.Stream == "stderr" {
+			w.logViewer.Write(entry.Message+"\n", text.WriteCellOpts(cell.FgColor(cell.ColorRed)))
+		} else {
+			w.logViewer.Write(entry.Message + "\n")
+		}
+	}
+
+	// Keys only matter for lines of the last second, which are fetched again
+	if len(w.seenLogs) > 5000 {
+		w.seenLogs = make(map[string]bool)
+	}
+}
+
+// drawHeader writes the deployment's status, progress, ETA and cost
+func (w *DeploymentWatch) drawHeader(deployment map[string]interface{}) {
+	status := fmt.Sprintf("%v", deployment["status"])
+	totalNodes, _ := deployment["total_nodes"].(float64)
+	nodesCompleted, _ := deployment["nodes_completed"].(float64)
+	nodesFailed, _ := deployment["nodes_failed"].(float64)
+	progress, _ := deployment["progress"].(float64)
+
+	started := ""
+	if created, err := time.Parse(time.RFC3339, fmt.Sprintf("%v", deployment["created_at"])); err == nil {
+		started = fmt.Sprintf(" | started %s ago", formatUptime(time.Since(created)))
+	}
+
+	w.header.Write(" Status: ", text.WriteReplace())
+	w.header.Write(status, text.WriteCellOpts(cell.FgColor(watchStatusColor(status)), cell.Bold()))
+	w.header.Write(fmt.Sprintf(" | %v%s\n", deployment["cloud_provider"], started), text.WriteCellOpts(cell.FgColor(cell.ColorGray)))
+
+	progressColor := cell.ColorGreen
+	if nodesFailed > 0 {
+		progressColor = cell.ColorRed
+	}
+	w.header.Write(" Progress: [")
+	w.header.Write(progressBar(progress, 20), text.WriteCellOpts(cell.FgColor(progressColor)))
+	w.header.Write(fmt.Sprintf("] %.0f%% - %.0f/%.0f nodes", progress, nodesCompleted, totalNodes))
+	if nodesFailed > 0 {
+		w.header.Write(fmt.Sprintf(" (%.0f failed)", nodesFailed), text.WriteCellOpts(cell.FgColor(cell.ColorRed)))
+	}
+	w.header.Write("\n")
+
+	eta := "-"
+	if formatted := formatEstimate(deployment["estimate"]); formatted != "" {
+		source, _ := deployment["estimate"].(map[string]interface{})["source"].(string)
+		eta = fmt.Sprintf("%s, from %s", formatted, source)
+	}
+	w.header.Write(fmt.Sprintf(" ETA: %s | Cost: %s", eta, w.cost))
+	if message, ok := deployment["error_message"].(string); ok && message != "" {
+		w.header.Write(" | "+message, text.WriteCellOpts(cell.FgColor(cell.ColorRed)))
+	}
+}
+
+// drawNodes writes a line per node with its status, progress and sparklines
+// of its CPU and memory use over the watch window
+func (w *DeploymentWatch) drawNodes(deployment map[string]interface{}, samples map[string][]state.MetricsSample, now time.Time) {
+	items, _ := deployment["nodes"].([]interface{})
+	nodes := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		if n, ok := item.(map[string]interface{}); ok {
+			nodes = append(nodes, n)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		a, _ := nodes[i]["node_index"].(float64)
+		b, _ := nodes[j]["node_index"].(float64)
+		return a < b
+	})
+
+	if len(nodes) == 0 {
+		w.nodesText.Write(" No nodes yet\n", text.WriteReplace())
+		return
+	}
+
+	from := now.Add(-watchWindow)
+	for i, n := range nodes {
+		opts := []text.WriteOption{}
+		if i == 0 {
+			opts = append(opts, text.WriteReplace())
+		}
+		nodeID := fmt.Sprintf("%v", n["node_id"])
+		nodeStatus := fmt.Sprintf("%v", n["status"])
+		w.nodesText.Write(fmt.Sprintf(" %-10s ", w.shortNodeID(nodeID)), append(opts, text.WriteCellOpts(cell.FgColor(cell.ColorCyan)))...)
+		w.nodesText.Write(fmt.Sprintf("%-12s", nodeStatus), text.WriteCellOpts(cell.FgColor(watchStatusColor(nodeStatus))))
+		if liveness, ok := n["liveness"].(string); ok && liveness != "online" {
+			w.nodesText.Write(fmt.Sprintf(" %-8s", liveness), text.WriteCellOpts(cell.FgColor(cell.ColorYellow)))
+		} else {
+			w.nodesText.Write(fmt.Sprintf(" %-8s", ""))
+		}
+
+		if percent, _, ok := nodeProgress(n); ok {
+			w.nodesText.Write(fmt.Sprintf(" [%s] %3.0f%%", progressBar(percent, 10), percent))
+		} else {
+			w.nodesText.Write(fmt.Sprintf(" %17s", ""))
+		}
+
+		if nodeSamples := samples[nodeID]; len(nodeSamples) > 0 {
+			latest := nodeSamples[len(nodeSamples)-1]
+			loadScale := float64(latest.CPUCores)
+			for _, sample := range nodeSamples {
+				loadScale = math.Max(loadScale, sample.LoadAvg1)
+			}
+			w.nodesText.Write("  CPU ")
+			w.nodesText.Write(renderSparkline(nodeSamples, from, now, watchSparkWidth, 100, func(m state.SystemMetrics) float64 { return m.CPUUsage }), text.WriteCellOpts(cell.FgColor(cell.ColorRed)))
+			w.nodesText.Write(fmt.Sprintf(" %5.1f%%  MEM ", latest.CPUUsage))
+			w.nodesText.Write(renderSparkline(nodeSamples, from, now, watchSparkWidth, 100, memoryPercent), text.WriteCellOpts(cell.FgColor(cell.ColorGreen)))
+			w.nodesText.Write(fmt.Sprintf(" %5.1f%%  LOAD %.2f/%d", memoryPercent(latest.SystemMetrics), latest.LoadAvg1, latest.CPUCores))
+		}
+		w.nodesText.Write("\n")
+
+		if message, ok := n["error_message"].(string); ok && message != "" {
+			w.nodesText.Write("            "+message+"\n", text.WriteCellOpts(cell.FgColor(cell.ColorRed)))
+		} else if _, message, ok := nodeProgress(n); ok && message != "" {
+			w.nodesText.Write("            "+message+"\n", text.WriteCellOpts(cell.FgColor(cell.ColorGray)))
+		}
+	}
+}
+
+// shortNodeID drops the deployment ID node IDs start with, which the title
+// already shows
+func (w *DeploymentWatch) shortNodeID(nodeID string) string {
+	return strings.TrimPrefix(nodeID, w.id+"_")
+}
+
+// getJSON fetches a daemon endpoint and decodes its JSON response
+func (w *DeploymentWatch) getJSON(path string, v interface{}) (int, error) {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodGet, w.daemonURL+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return resp.StatusCode, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("daemon returned %d: %s", resp.StatusCode, string(body))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return resp.StatusCode, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return resp.StatusCode, nil
+}
+
+// watchStatusColor returns the color of a deployment or node status
+func watchStatusColor(status string) cell.Color {
+	switch status {
+	case "running", "completed":
+		return cell.ColorGreen
+	case "pending", "provisioning", "booting", "registering", "downloading_assets", "extracting", "terminating":
+		return cell.ColorYellow
+	case "failed":
+		return cell.ColorRed
+	}
+	return cell.ColorWhite
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/artifacts"
+	"github.com/JustinTimperio/TaskFly/internal/signing"
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/labstack/echo/v4"
+)
+
+// artifactCache holds the blobs nodes share within their deployment. Nil
+// when disabled with --artifact-cache-size 0.
+var artifactCache *artifacts.Cache
+
+// artifactStorageAllowed are the locations deployments may choose to keep
+// their artifacts in with artifact_storage, besides the daemon's
+var artifactStorageAllowed []artifacts.Location
+
+// artifactURLKey signs the download URLs of artifacts kept on the daemon
+var artifactURLKey []byte
+
+// defaultArtifactURLTTL is how long signed download URLs stay valid unless
+// asked otherwise
+const defaultArtifactURLTTL = time.Hour
+
+// maxArtifactWait bounds how long a download waits for another node to store
+// the artifact. Agents retry for workloads that wait longer.
+const maxArtifactWait = 50 * time.Second
+
+// artifactsURL returns the URL agents store and fetch artifacts under, or
+// nothing when the cache is disabled
+func artifactsURL(callbackURL string) string {
+	if artifactCache == nil {
+		return ""
+	}
+	return callbackURL + "/api/v1/nodes/artifacts"
+}
+
+// setupArtifactStorage sets where artifacts are kept and which locations
+// deployments may choose, and loads the key download URLs of artifacts kept
+// on the daemon are signed with
+func setupArtifactStorage(location string, allowed []string, keyPath string) error {
+	if err := artifactCache.SetStorage(context.Background(), location); err != nil {
+		return err
+	}
+	for _, value := range allowed {
+		loc, err := artifacts.ParseLocation(value)
+		if err != nil {
+			return fmt.Errorf("invalid --artifact-storage-allow: %w", err)
+		}
+		if loc.Local() {
+			return fmt.Errorf("invalid --artifact-storage-allow: %q is not a bucket", value)
+		}
+		artifactStorageAllowed = append(artifactStorageAllowed, loc)
+	}
+
+	key, err := os.ReadFile(keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return fmt.Errorf("failed to generate artifact URL key: %w", err)
+		}
+		err = os.WriteFile(keyPath, key, 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load artifact URL key: %w", err)
+	}
+	artifactURLKey = key
+	return nil
+}
+
+// checkArtifactStorage lets a deployment keep its artifacts in a location the
+// daemon's storage or --artifact-storage-allow covers, if the daemon has
+// credentials for it
+func checkArtifactStorage(location string) error {
+	loc, err := artifacts.ParseLocation(location)
+	if err != nil {
+		return err
+	}
+	allowed := loc.Within(artifactCache.Storage())
+	for _, prefix := range artifactStorageAllowed {
+		allowed = allowed || loc.Within(prefix)
+	}
+	if !allowed {
+		return fmt.Errorf("%s is not allowed by this daemon's --artifact-storage-allow", loc)
+	}
+	return artifactCache.CheckStorage(context.Background(), location)
+}
+
+// deploymentArtifactStorage returns the artifact storage a deployment chose,
+// empty for the daemon's
+func deploymentArtifactStorage(dep *state.Deployment) string {
+	location, _ := dep.Config["artifact_storage"].(string)
+	return location
+}
+
+// artifactNode finds the node making an artifact request by its auth token
+func artifactNode(c echo.Context) (*state.Node, *state.Deployment, error) {
+	authToken := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+	if authToken == "" {
+		return nil, nil, c.JSON(http.StatusUnauthorized, map[string]string{"error": "Missing auth token"})
+	}
+	node, dep, err := store.FindNodeByAuthToken(authToken)
+	if err != nil {
+		return nil, nil, c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid auth token"})
+	}
+	return node, dep, nil
+}
+
+// putArtifact stores an artifact for the other nodes of the deployment. The
+// body is streamed to disk, so the signature is checked against its digest
+// instead of going through agentSignatureMiddleware.
+func putArtifact(c echo.Context) error {
+	if artifactCache == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Artifact cache is disabled"})
+	}
+	node, dep, err := artifactNode(c)
+	if node == nil {
+		return err
+	}
+	log := deploymentLog(dep)
+
+	var signatureErr error
+	verify := func(sum []byte) error {
+		err := signing.ErrUnsigned
+		if node.SigningSecret != "" {
+			err = agentSignatures.VerifyDigest(c.Request(), node.SigningSecret, sum, time.Now())
+		}
+		if errors.Is(err, signing.ErrUnsigned) && !requireAgentSignatures {
+			return nil
+		}
+		signatureErr = err
+		return err
+	}
+
+	key := c.Param("key")
+	entry, err := artifactCache.Put(c.Request().Context(), dep.ID, deploymentArtifactStorage(dep), key, node.NodeID, c.Request().Body, verify)
+	switch {
+	case signatureErr != nil:
+		logger.Warnf("Rejected artifact %s from node %s: %v", key, node.NodeID, signatureErr)
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Invalid request signature: " + signatureErr.Error()})
+	case errors.Is(err, artifacts.ErrInvalidKey):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, artifacts.ErrFull):
+		log.Warnf("Node %s could not store artifact %s: %v", node.NodeID, key, err)
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": err.Error()})
+	case err != nil:
+		log.Errorf("Failed to store artifact %s of node %s: %v", key, node.NodeID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store artifact"})
+	}
+
+	if entry.Storage != "" {
+		log.Infof("Node %s stored artifact %s (%d bytes) in %s", node.NodeID, key, entry.Size, entry.Storage)
+	} else {
+		log.Infof("Node %s stored artifact %s (%d bytes)", node.NodeID, key, entry.Size)
+	}
+	return c.JSON(http.StatusOK, entry)
+}
+
+// getArtifact serves an artifact of the node's deployment. With ?wait=30s it
+// waits for another node to store it first.
+func getArtifact(c echo.Context) error {
+	if artifactCache == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Artifact cache is disabled"})
+	}
+	node, dep, err := artifactNode(c)
+	if node == nil {
+		return err
+	}
+
+	var wait time.Duration
+	if value := c.QueryParam("wait"); value != "" {
+		if wait, err = time.ParseDuration(value); err != nil || wait < 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid wait duration"})
+		}
+	}
+	wait = min(wait, maxArtifactWait)
+
+	deploymentLog(dep).Debugf("Node %s downloads artifact %s", node.NodeID, c.Param("key"))
+	return serveArtifact(c, dep, c.Param("key"), wait)
+}
+
+// serveArtifact sends an artifact's contents. Artifacts kept on the daemon
+// support range requests, those in buckets are streamed through whole.
+func serveArtifact(c echo.Context, dep *state.Deployment, key string, wait time.Duration) error {
+	body, entry, err := artifactCache.Open(c.Request().Context(), dep.ID, key, wait)
+	switch {
+	case errors.Is(err, artifacts.ErrInvalidKey):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, artifacts.ErrNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Artifact not found"})
+	case err != nil:
+		deploymentLog(dep).Errorf("Failed to open artifact %s: %v", key, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to open artifact"})
+	}
+	defer body.Close()
+
+	c.Response().Header().Set("X-TaskFly-Artifact-SHA256", entry.SHA256)
+	c.Response().Header().Set("X-TaskFly-Artifact-Node", entry.NodeID)
+	c.Response().Header().Set(echo.HeaderContentType, "application/octet-stream")
+	if file, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(c.Response(), c.Request(), key, entry.CreatedAt, file)
+		return nil
+	}
+	c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(entry.Size, 10))
+	c.Response().Header().Set(echo.HeaderLastModified, entry.CreatedAt.UTC().Format(http.TimeFormat))
+	c.Response().WriteHeader(http.StatusOK)
+	if _, err := io.Copy(c.Response(), body); err != nil {
+		deploymentLog(dep).Warnf("Failed to send artifact %s from %s: %v", key, entry.Storage, err)
+	}
+	return nil
+}
+
+// getArtifactURL returns a URL anyone can download an artifact from for
+// ?ttl= (default 1h, at most 7 days): a signed bucket URL for artifacts kept
+// in a bucket, a signed daemon URL for those kept on the daemon
+func getArtifactURL(c echo.Context) error {
+	dep, err := store.GetDeployment(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+	}
+	if artifactCache == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Artifact cache is disabled"})
+	}
+
+	ttl := defaultArtifactURLTTL
+	if value := c.QueryParam("ttl"); value != "" {
+		if ttl, err = time.ParseDuration(value); err != nil || ttl < time.Second || ttl > artifacts.MaxSignedURLTTL {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Invalid ttl, use 1s to %s", artifacts.MaxSignedURLTTL)})
+		}
+	}
+
+	key := c.Param("key")
+	signed, entry, err := artifactCache.SignedURL(c.Request().Context(), dep.ID, key, ttl)
+	expires := time.Now().Add(ttl)
+	if errors.Is(err, artifacts.ErrNotSignable) {
+		signed, err = c.Scheme()+"://"+c.Request().Host+localArtifactPath(dep.ID, key, expires), nil
+	}
+	switch {
+	case errors.Is(err, artifacts.ErrInvalidKey):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, artifacts.ErrNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Artifact not found"})
+	case err != nil:
+		deploymentLog(dep).Errorf("Failed to sign URL of artifact %s: %v", key, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to sign artifact URL"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"deployment_id": dep.ID,
+		"key":           key,
+		"url":           signed,
+		"expires_at":    expires.UTC().Truncate(time.Second),
+		"size":          entry.Size,
+		"sha256":        entry.SHA256,
+		"storage":       entry.Storage,
+	})
+}
+
+// localArtifactPath returns the path of the signed download URL of an
+// artifact kept on the daemon
+func localArtifactPath(deploymentID, key string, expires time.Time) string {
+	unix := strconv.FormatInt(expires.Unix(), 10)
+	query := url.Values{
+		"expires":   {unix},
+		"signature": {localArtifactSignature(deploymentID, key, unix)},
+	}
+	return "/api/v1/artifacts/" + url.PathEscape(deploymentID) + "/" + url.PathEscape(key) + "?" + query.Encode()
+}
+
+// localArtifactSignature signs an artifact and the expiry of a download URL
+func localArtifactSignature(deploymentID, key, expires string) string {
+	mac := hmac.New(sha256.New, artifactURLKey)
+	mac.Write([]byte(deploymentID + "/" + key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// downloadSignedArtifact serves an artifact kept on the daemon to whoever
+// holds an unexpired URL from getArtifactURL. The signature stands in for
+// the API token.
+func downloadSignedArtifact(c echo.Context) error {
+	if artifactCache == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Artifact cache is disabled"})
+	}
+	deploymentID, key := c.Param("id"), c.Param("key")
+	expires := c.QueryParam("expires")
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	signature := localArtifactSignature(deploymentID, key, expires)
+	if err != nil || !hmac.Equal([]byte(signature), []byte(c.QueryParam("signature"))) {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Invalid signature"})
+	}
+	if time.Now().Unix() > unix {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "URL expired"})
+	}
+
+	dep, err := store.GetDeployment(deploymentID)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+	}
+	return serveArtifact(c, dep, key, 0)
+}
+
+// listArtifacts lists the artifacts the nodes of a deployment stored
+func listArtifacts(c echo.Context) error {
+	dep, err := store.GetDeployment(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+	}
+
+	entries := []artifacts.Entry{}
+	var used int64
+	if artifactCache != nil {
+		for _, entry := range artifactCache.List(dep.ID) {
+			entries = append(entries, entry)
+			used += entry.Size
+		}
+	}
+	storage := deploymentArtifactStorage(dep)
+	if storage == "" && artifactCache != nil {
+		storage = artifactCache.Storage().String()
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"deployment_id": dep.ID,
+		"artifacts":     entries,
+		"used_bytes":    used,
+		"max_bytes":     maxArtifactBytes(),
+		"storage":       storage,
+	})
+}
+
+// maxArtifactBytes returns how much each deployment may store, zero when the
+// cache is disabled
+func maxArtifactBytes() int64 {
+	if artifactCache == nil {
+		return 0
+	}
+	return artifactCache.MaxBytes()
+}
+
+// expireArtifacts removes expired artifacts and those of deployments that no
+// longer exist
+func expireArtifacts() {
+	if artifactCache == nil {
+		return
+	}
+	if count := artifactCache.Expire(); count > 0 {
+		logger.Infof("Artifact cache: %d expired artifacts removed", count)
+	}
+	for _, id := range artifactCache.Deployments() {
+		if _, err := store.GetDeployment(id); err == nil {
+			continue
+		}
+		if err := artifactCache.DeleteDeployment(id); err != nil {
+			logger.Warnf("Artifact cache: %v", err)
+		} else {
+			logger.Infof("Artifact cache: removed artifacts of deleted deployment %s", id)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/auth"
+	"github.com/JustinTimperio/TaskFly/internal/cloud"
+	"github.com/JustinTimperio/TaskFly/internal/notify"
+	"github.com/JustinTimperio/TaskFly/internal/signing"
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/labstack/echo/v4"
+)
+
+// apiTokens are the tokens API requests must present. Without tokens the API
+// is open to anyone who can reach the daemon.
+var apiTokens *auth.Tokens
+
+// requestAPIKey returns the API key of a request, sent either in the API key
+// header or as a bearer token
+func requestAPIKey(c echo.Context) string {
+	if key := c.Request().Header.Get(apiKeyHeader); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+}
+
+// authMiddleware rejects API requests without a valid token or outside the
+// token's scope. Agent routes authenticate with node tokens instead.
+func authMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if apiTokens == nil || agentRoutes[c.Path()] {
+			return next(c)
+		}
+
+		token, ok := apiTokens.Lookup(requestAPIKey(c))
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]string{
+				"error": "Missing or invalid API token",
+			})
+		}
+		if !token.Scope.Allows(c.Request().Method, c.Path()) {
+			logger.Warnf("Token %s (scope %s) denied %s %s", token.Name, token.Scope, c.Request().Method, c.Path())
+			return c.JSON(http.StatusForbidden, map[string]string{
+				"error": fmt.Sprintf("Token %s has %s scope and may not %s %s", token.Name, token.Scope, c.Request().Method, c.Path()),
+			})
+		}
+		return next(c)
+	}
+}
+
+var (
+	// agentSignatures verifies signed agent requests and remembers their
+	// signatures to reject replays
+	agentSignatures = signing.NewVerifier()
+
+	// requireAgentSignatures rejects unsigned requests from agents, such as
+	// older agents that ignore the signing secret
+	requireAgentSignatures bool
+)
+
+// agentSignatureMiddleware verifies the signature of agent callbacks made with
+// a node's auth token, or for token refreshes its refresh token. Invalid
+// tokens are left to the handlers. Signature failures answer 403, since
+// agents take 401 as their deployment being gone.
+func agentSignatureMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var node *state.Node
+		var body []byte
+		var err error
+		if c.Path() == tokenRoute {
+			// The auth token may have expired already, the refresh token
+			// names the node
+			if body, err = readBody(c); err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read request body"})
+			}
+			var req struct {
+				RefreshToken string `json:"refresh_token"`
+			}
+			json.Unmarshal(body, &req)
+			node, _ = findNodeByRefreshToken(req.RefreshToken)
+		} else {
+			authToken := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+			node, _, _ = store.FindNodeByAuthToken(authToken)
+			if node != nil {
+				if body, err = readBody(c); err != nil {
+					return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read request body"})
+				}
+			}
+		}
+		if node == nil {
+			return next(c)
+		}
+
+		err = signing.ErrUnsigned
+		if node.SigningSecret != "" {
+			err = agentSignatures.Verify(c.Request(), node.SigningSecret, body, time.Now())
+		}
+		if errors.Is(err, signing.ErrUnsigned) && !requireAgentSignatures {
+			return next(c)
+		}
+		if err != nil {
+			logger.Warnf("Rejected %s %s from node %s: %v", c.Request().Method, c.Path(), node.NodeID, err)
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Invalid request signature: " + err.Error()})
+		}
+		return next(c)
+	}
+}
+
+// readBody reads a request's body and puts it back for the handler
+func readBody(c echo.Context) ([]byte, error) {
+	if c.Request().Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return nil, err
+	}
+	c.Request().Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// tokenRoute is where agents exchange their refresh token
+const tokenRoute = "/api/v1/nodes/token"
+
+// nodeTokenTTL is how long node auth tokens are valid before agents must
+// refresh them. Refresh tokens stay valid for another nodeTokenTTL after
+// their auth token expired, so agents that couldn't reach the daemon for a
+// while can still refresh. Zero means neither expires.
+var nodeTokenTTL time.Duration
+
+// newNodeToken creates fresh credentials for a node
+func newNodeToken() (state.NodeToken, error) {
+	var token state.NodeToken
+	var err error
+	if token.AuthToken, err = randomToken("auth-"); err != nil {
+		return token, err
+	}
+	if token.RefreshToken, err = randomToken("refresh-"); err != nil {
+		return token, err
+	}
+	if token.SigningSecret, err = signing.NewSecret(); err != nil {
+		return token, err
+	}
+	if nodeTokenTTL > 0 {
+		expires := time.Now().Add(nodeTokenTTL)
+		refreshExpires := expires.Add(nodeTokenTTL)
+		token.ExpiresAt = &expires
+		token.RefreshExpiresAt = &refreshExpires
+	}
+	return token, nil
+}
+
+// randomToken returns a random token with a prefix naming its kind
+func randomToken(prefix string) (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
+
+// nodeTokenResponse is the part of the registration and refresh responses
+// that carries a node's credentials
+func nodeTokenResponse(token state.NodeToken) map[string]interface{} {
+	response := map[string]interface{}{
+		"auth_token":     token.AuthToken,
+		"refresh_token":  token.RefreshToken,
+		"signing_secret": token.SigningSecret,
+	}
+	if token.ExpiresAt != nil {
+		response["token_expires_at"] = token.ExpiresAt
+	}
+	return response
+}
+
+// alertProvisionTokenReused is the kind of notification sent when a provision
+// token is replayed
+const alertProvisionTokenReused = "provision_token_reused"
+
+// reportedTokenReuse holds the IDs of nodes whose provision token reuse was
+// already sent to the webhooks, so a client replaying a token can't flood them
+var reportedTokenReuse sync.Map
+
+// reportProvisionTokenReuse logs a registration with the provision token of an
+// already registered node and alerts the notify webhooks once per node
+func reportProvisionTokenReuse(node *state.Node, remoteAddr string) {
+	registered := "before this daemon tracked registrations"
+	if node.RegisteredAt != nil {
+		registered = fmt.Sprintf("from %s at %s", node.RegisteredFrom, node.RegisteredAt.Format(time.RFC3339))
+	}
+	logger.Warnf("Security: provision token of node %s in deployment %s reused from %s, node registered %s",
+		node.NodeID, node.DeploymentID, remoteAddr, registered)
+
+	if _, reported := reportedTokenReuse.LoadOrStore(node.NodeID, true); reported {
+		return
+	}
+	event := notify.Event{
+		Kind:         alertProvisionTokenReused,
+		DeploymentID: node.DeploymentID,
+		NodeID:       node.NodeID,
+		Summary:      fmt.Sprintf("Provision token of node %s (deployment %s) was reused from %s", node.NodeID, node.DeploymentID, remoteAddr),
+		Hint:         fmt.Sprintf("The node registered %s. If that wasn't this node's agent, revoke it with taskfly node revoke --id %s.", registered, node.NodeID),
+	}
+	go func() {
+		if err := notifier.Send(context.Background(), event); err != nil {
+			logger.Warnf("Failed to send provision token reuse alert: %v", err)
+		}
+	}()
+}
+
+// instanceIdentityCerts are the AWS certificates instance identity documents
+// are verified against. Without them AWS nodes register with their provision
+// token alone.
+var instanceIdentityCerts []*x509.Certificate
+
+// instanceIdentity is the signed identity document an agent on EC2 sends
+// with its registration
+type instanceIdentity struct {
+	Document  string `json:"document"`
+	Signature string `json:"signature"`
+}
+
+// verifyInstanceIdentity checks that a node of an AWS deployment registers
+// from the instance the daemon launched for it, reporting whether it did.
+// Other providers and daemons without identity certificates skip the check.
+func verifyInstanceIdentity(node *state.Node, dep *state.Deployment, identity *instanceIdentity) (bool, error) {
+	if len(instanceIdentityCerts) == 0 || dep.CloudProvider != "aws" {
+		return false, nil
+	}
+	if identity == nil {
+		return false, fmt.Errorf("instance identity document is required")
+	}
+
+	verified, err := cloud.VerifyInstanceIdentity(identity.Document, identity.Signature, instanceIdentityCerts)
+	if err != nil {
+		return false, err
+	}
+	if node.InstanceID == "" {
+		return false, fmt.Errorf("no instance has been launched for node %s yet", node.NodeID)
+	}
+	if verified.InstanceID != node.InstanceID {
+		return false, fmt.Errorf("instance %s does not match %s launched for node %s", verified.InstanceID, node.InstanceID, node.NodeID)
+	}
+	return true, nil
+}
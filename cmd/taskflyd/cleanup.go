@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/orchestrator"
+	"github.com/labstack/echo/v4"
+	"github.com/urfave/cli/v2"
+)
+
+// cleanupPolicyFlags reads the cleanup policy from --cleanup-interval,
+// --cleanup-files-after, --cleanup-state and --cleanup-state-after
+func cleanupPolicyFlags(c *cli.Context) orchestrator.CleanupPolicy {
+	return orchestrator.CleanupPolicy{
+		Interval:    c.Duration("cleanup-interval"),
+		FilesAfter:  c.Duration("cleanup-files-after"),
+		RemoveState: c.Bool("cleanup-state"),
+		StateAfter:  c.Duration("cleanup-state-after"),
+	}
+}
+
+// cleanupPolicyResponse is the JSON form of the cleanup policy, with
+// durations as text such as "1h0m0s"
+func cleanupPolicyResponse() map[string]interface{} {
+	policy, lastRun := orch.CleanupPolicy()
+	response := map[string]interface{}{
+		"interval":     policy.Interval.String(),
+		"files_after":  policy.FilesAfter.String(),
+		"remove_state": policy.RemoveState,
+		"state_after":  policy.StateAfter.String(),
+	}
+	if lastRun != nil {
+		response["last_run"] = lastRun
+	}
+	return response
+}
+
+func getCleanupPolicy(c echo.Context) error {
+	return c.JSON(http.StatusOK, cleanupPolicyResponse())
+}
+
+// updateCleanupPolicy changes the cleanup policy until the daemon restarts.
+// Fields left out of the request keep their value, durations are text such
+// as "24h".
+func updateCleanupPolicy(c echo.Context) error {
+	var request struct {
+		Interval    *string `json:"interval"`
+		FilesAfter  *string `json:"files_after"`
+		RemoveState *bool   `json:"remove_state"`
+		StateAfter  *string `json:"state_after"`
+	}
+	if err := c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request body",
+		})
+	}
+
+	policy, _ := orch.CleanupPolicy()
+	for _, field := range []struct {
+		name  string
+		text  *string
+		value *time.Duration
+	}{
+		{"interval", request.Interval, &policy.Interval},
+		{"files_after", request.FilesAfter, &policy.FilesAfter},
+		{"state_after", request.StateAfter, &policy.StateAfter},
+	} {
+		if field.text == nil {
+			continue
+		}
+		duration, err := time.ParseDuration(*field.text)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("Invalid %s: %v", field.name, err),
+			})
+		}
+		*field.value = duration
+	}
+	if request.RemoveState != nil {
+		policy.RemoveState = *request.RemoveState
+	}
+
+	if err := orch.SetCleanupPolicy(policy); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	logger.Infof("Cleanup policy changed: every %s, files after %s, state removed %t after %s",
+		policy.Interval, policy.FilesAfter, policy.RemoveState, policy.StateAfter)
+	return c.JSON(http.StatusOK, cleanupPolicyResponse())
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetDeploymentRedactsSensitiveVariables(t *testing.T) {
+	setupTestDaemon(t)
+	require.NoError(t, store.CreateDeployment(&state.Deployment{
+		ID:                 "dep_1",
+		Status:             state.StatusRunning,
+		Variables:          map[string]interface{}{"dataset": "sample", "api_key": "hunter2"},
+		SensitiveVariables: []string{"api_key"},
+	}))
+
+	e := echo.New()
+	e.GET("/api/v1/deployments/:id", getDeployment)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/deployments/dep_1", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var body struct {
+		Variables map[string]interface{} `json:"variables"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, map[string]interface{}{"dataset": "sample", "api_key": state.SensitiveValue}, body.Variables)
+	assert.NotContains(t, rec.Body.String(), "hunter2")
+
+	// The stored values are untouched
+	deployment, err := store.GetDeployment("dep_1")
+	require.NoError(t, err)
+	assert.Equal(t, "hunter2", deployment.Variables["api_key"])
+}
+
+func TestListDeploymentsRedactsSensitiveVariables(t *testing.T) {
+	setupTestDaemon(t)
+	require.NoError(t, store.CreateDeployment(&state.Deployment{
+		ID:                 "dep_1",
+		Status:             state.StatusRunning,
+		Variables:          map[string]interface{}{"dataset": "sample", "api_key": "hunter2"},
+		SensitiveVariables: []string{"api_key"},
+		Config: map[string]interface{}{
+			"nodes": map[string]interface{}{
+				"instance_config": map[string]interface{}{"user_data": "export API_KEY=hunter2"},
+				"labels":          map[string]interface{}{"dataset": "sample"},
+			},
+		},
+	}))
+
+	e := echo.New()
+	e.GET("/api/v1/deployments", listDeployments)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/deployments", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "hunter2")
+
+	var body []struct {
+		Variables map[string]interface{} `json:"variables"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	require.Len(t, body, 1)
+	assert.Equal(t, map[string]interface{}{"dataset": "sample", "api_key": state.SensitiveValue}, body[0].Variables)
+}
@@ -1,20 +1,39 @@
 package main
 
-//go:generate go run ../build-agents/main.go
+//go:generate go run ../build-agents
 
 import (
+	"bytes"
 	"context"
 	_ "embed"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/JustinTimperio/TaskFly/internal/artifacts"
+	"github.com/JustinTimperio/TaskFly/internal/auth"
+	"github.com/JustinTimperio/TaskFly/internal/bundle"
+	"github.com/JustinTimperio/TaskFly/internal/cloud"
+	"github.com/JustinTimperio/TaskFly/internal/export"
+	"github.com/JustinTimperio/TaskFly/internal/metadata"
+	"github.com/JustinTimperio/TaskFly/internal/notify"
 	"github.com/JustinTimperio/TaskFly/internal/orchestrator"
+	"github.com/JustinTimperio/TaskFly/internal/policy"
+	"github.com/JustinTimperio/TaskFly/internal/relay"
+	"github.com/JustinTimperio/TaskFly/internal/report"
 	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/JustinTimperio/TaskFly/internal/trace"
+	"github.com/JustinTimperio/TaskFly/internal/usage"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/sirupsen/logrus"
@@ -40,12 +59,20 @@ var agentWindowsAmd64 []byte
 
 // Global instances
 var (
-	store         state.StateStore
-	orch          *orchestrator.Orchestrator
-	logger        *logrus.Logger
-	deploymentDir string
-	daemonIP      string
-	startTime     time.Time
+	store             state.StateStore
+	orch              *orchestrator.Orchestrator
+	logger            *logrus.Logger
+	deploymentDir     string
+	daemonIP          string
+	daemonInternalURL string
+	startTime         time.Time
+	timings           *report.Timings
+	finishes          *export.FinishCounter
+	notifier          *notify.Notifier
+
+	// allowSimulate lets clients run deployments as agent processes on this
+	// host, which executes their scripts here
+	allowSimulate bool
 )
 
 func main() {
@@ -80,6 +107,11 @@ func main() {
 				Value:   "8080",
 				EnvVars: []string{"TASKFLY_DAEMON_PORT"},
 			},
+			&cli.StringFlag{
+				Name:    "daemon-internal-ip",
+				Usage:   "Internal IP address nodes in private subnets fall back to when the daemon IP is unreachable",
+				EnvVars: []string{"TASKFLY_DAEMON_INTERNAL_IP"},
+			},
 			&cli.BoolFlag{
 				Name:    "verbose",
 				Aliases: []string{"v"},
@@ -92,6 +124,193 @@ func main() {
 				Value:   getDefaultDeploymentDir(),
 				EnvVars: []string{"TASKFLY_DEPLOYMENT_DIR"},
 			},
+			&cli.StringFlag{
+				Name:    "state-dir",
+				Usage:   "Directory to persist daemon state (default: ~/.taskfly/state)",
+				EnvVars: []string{"TASKFLY_STATE_DIR"},
+			},
+			&cli.StringFlag{
+				Name:    "agent-dir",
+				Usage:   "Directory to extract embedded agent binaries to, and to load agents for platforms not embedded from (default: serve agents from memory only)",
+				EnvVars: []string{"TASKFLY_AGENT_DIR"},
+			},
+			&cli.StringFlag{
+				Name:    "env-policy",
+				Usage:   "YAML file restricting the environment variable names and values deployments may distribute to nodes",
+				EnvVars: []string{"TASKFLY_ENV_POLICY"},
+			},
+			&cli.StringFlag{
+				Name:    "opa-url",
+				Usage:   "Open Policy Agent decision URL new deployments are evaluated against, e.g. http://localhost:8181/v1/data/taskfly/admission",
+				EnvVars: []string{"TASKFLY_OPA_URL"},
+			},
+			&cli.DurationFlag{
+				Name:    "opa-timeout",
+				Usage:   "Timeout for admission policy queries",
+				Value:   5 * time.Second,
+				EnvVars: []string{"TASKFLY_OPA_TIMEOUT"},
+			},
+			&cli.BoolFlag{
+				Name:    "opa-fail-open",
+				Usage:   "Admit deployments with a warning when OPA cannot be reached instead of rejecting them",
+				EnvVars: []string{"TASKFLY_OPA_FAIL_OPEN"},
+			},
+			&cli.StringFlag{
+				Name:    "api-tokens",
+				Usage:   "YAML file of scoped API tokens (admin, read, logs) requests must present; without it the API is open",
+				EnvVars: []string{"TASKFLY_API_TOKENS"},
+			},
+			&cli.DurationFlag{
+				Name:    "node-token-ttl",
+				Usage:   "How long node auth tokens are valid before agents must refresh them (0 = no expiry)",
+				EnvVars: []string{"TASKFLY_NODE_TOKEN_TTL"},
+			},
+			&cli.DurationFlag{
+				Name:    "provision-token-ttl",
+				Usage:   "How long agents have to register once their node was provisioned before the node fails, its instance is terminated and its provision token expires (0 = no expiry)",
+				Value:   orchestrator.DefaultClaimTimeout,
+				EnvVars: []string{"TASKFLY_PROVISION_TOKEN_TTL"},
+			},
+			&cli.DurationFlag{
+				Name:    "cleanup-interval",
+				Usage:   "How often finished deployments are cleaned up (0 = never)",
+				Value:   orchestrator.DefaultCleanupPolicy.Interval,
+				EnvVars: []string{"TASKFLY_CLEANUP_INTERVAL"},
+			},
+			&cli.DurationFlag{
+				Name:    "cleanup-files-after",
+				Usage:   "Remove the bundle and files of deployments finished this long ago; they stay listed but can't be exported",
+				Value:   orchestrator.DefaultCleanupPolicy.FilesAfter,
+				EnvVars: []string{"TASKFLY_CLEANUP_FILES_AFTER"},
+			},
+			&cli.BoolFlag{
+				Name:    "cleanup-state",
+				Usage:   "Also remove finished deployments and their nodes from the state, after --cleanup-state-after (--cleanup-state=false keeps their history)",
+				Value:   orchestrator.DefaultCleanupPolicy.RemoveState,
+				EnvVars: []string{"TASKFLY_CLEANUP_STATE"},
+			},
+			&cli.DurationFlag{
+				Name:    "cleanup-state-after",
+				Usage:   "How long after they finished deployments are removed from the state with --cleanup-state",
+				Value:   orchestrator.DefaultCleanupPolicy.StateAfter,
+				EnvVars: []string{"TASKFLY_CLEANUP_STATE_AFTER"},
+			},
+			&cli.StringFlag{
+				Name:    "artifact-cache-size",
+				Usage:   "How much each deployment may store in the artifact cache its nodes share, e.g. 1GiB (0 = disabled)",
+				Value:   "1GiB",
+				EnvVars: []string{"TASKFLY_ARTIFACT_CACHE_SIZE"},
+			},
+			&cli.DurationFlag{
+				Name:    "artifact-cache-ttl",
+				Usage:   "How long artifacts stay in the cache after they were stored",
+				Value:   24 * time.Hour,
+				EnvVars: []string{"TASKFLY_ARTIFACT_CACHE_TTL"},
+			},
+			&cli.StringFlag{
+				Name:    "artifact-storage",
+				Usage:   "Where artifacts are kept: local, s3://bucket/prefix, gs://bucket/prefix or azblob://account/container/prefix",
+				Value:   "local",
+				EnvVars: []string{"TASKFLY_ARTIFACT_STORAGE"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "artifact-storage-allow",
+				Usage:   "Bucket location deployments may keep their artifacts in or below with artifact_storage (repeatable)",
+				EnvVars: []string{"TASKFLY_ARTIFACT_STORAGE_ALLOW"},
+			},
+			&cli.StringFlag{
+				Name:    "log-buffer-size",
+				Usage:   "Memory the log buffers of all deployments may take before log pushes are rejected with 429, e.g. 512MiB (0 = unlimited)",
+				Value:   "512MiB",
+				EnvVars: []string{"TASKFLY_LOG_BUFFER_SIZE"},
+			},
+			&cli.StringFlag{
+				Name:    "deployment-log-buffer-size",
+				Usage:   "Memory the log buffer of one deployment may take before its oldest lines are dropped, e.g. 64MiB (0 = unlimited)",
+				Value:   "64MiB",
+				EnvVars: []string{"TASKFLY_DEPLOYMENT_LOG_BUFFER_SIZE"},
+			},
+			&cli.BoolFlag{
+				Name:    "require-agent-signatures",
+				Usage:   "Reject agent requests that are not signed with the node's signing secret",
+				EnvVars: []string{"TASKFLY_REQUIRE_AGENT_SIGNATURES"},
+			},
+			&cli.StringFlag{
+				Name:    "aws-identity-certs",
+				Usage:   "PEM file of AWS instance identity certificates; AWS nodes must then prove their instance at registration",
+				EnvVars: []string{"TASKFLY_AWS_IDENTITY_CERTS"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "notify-webhook",
+				Usage:   "URL that alerts are POSTed to as JSON (repeatable)",
+				EnvVars: []string{"TASKFLY_NOTIFY_WEBHOOKS"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "notify-transitions",
+				Usage:   "Status changes POSTed to --notify-webhook, as deployment:<status> or node:<status> with * for any status (repeatable)",
+				EnvVars: []string{"TASKFLY_NOTIFY_TRANSITIONS"},
+			},
+			&cli.DurationFlag{
+				Name:    "watchdog-pending",
+				Usage:   "Alert when a deployment stays pending or provisioning longer than this (0 disables)",
+				Value:   15 * time.Minute,
+				EnvVars: []string{"TASKFLY_WATCHDOG_PENDING"},
+			},
+			&cli.DurationFlag{
+				Name:    "watchdog-stalled",
+				Usage:   "Alert when a node keeps its status or sends no heartbeat for longer than this (0 disables)",
+				Value:   30 * time.Minute,
+				EnvVars: []string{"TASKFLY_WATCHDOG_STALLED"},
+			},
+			&cli.StringFlag{
+				Name:    "relay-satellites",
+				Usage:   "YAML file of the satellite daemons allowed to relay through this daemon, each with its own secret; enables relaying API requests to satellites",
+				EnvVars: []string{"TASKFLY_RELAY_SATELLITES"},
+			},
+			&cli.StringFlag{
+				Name:    "relay-secret",
+				Usage:   "Secret this satellite authenticates with at the central daemon of --relay-to, issued for it in the central daemon's --relay-satellites",
+				EnvVars: []string{"TASKFLY_RELAY_SECRET"},
+			},
+			&cli.StringFlag{
+				Name:    "relay-to",
+				Usage:   "URL of a central daemon to register with as a satellite and serve this daemon's API through, e.g. https://hq.example.com:8080",
+				EnvVars: []string{"TASKFLY_RELAY_TO"},
+			},
+			&cli.StringFlag{
+				Name:    "relay-api-key",
+				Usage:   "API token from this satellite's --api-tokens that requests relayed from the central daemon are made with",
+				EnvVars: []string{"TASKFLY_RELAY_API_KEY"},
+			},
+			&cli.BoolFlag{
+				Name:    "allow-simulate",
+				Usage:   "Accept taskfly up --simulate, which runs the nodes' scripts as local processes of the daemon's user",
+				EnvVars: []string{"TASKFLY_ALLOW_SIMULATE"},
+			},
+			&cli.StringFlag{
+				Name:    "record-dir",
+				Usage:   "Record the node API traffic of every deployment to a trace file in this directory, for taskflyd replay",
+				EnvVars: []string{"TASKFLY_RECORD_DIR"},
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:      "replay",
+				Usage:     "Replay a deployment trace recorded with --record-dir against an in-memory daemon",
+				ArgsUsage: "<trace file>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "stop-on-divergence",
+						Usage: "Stop at the first request whose outcome differs from the recording",
+					},
+					&cli.BoolFlag{
+						Name:    "verbose",
+						Aliases: []string{"v"},
+						Usage:   "Show the daemon's log while replaying",
+					},
+				},
+				Action: replayTrace,
+			},
 		},
 		Action: runDaemon,
 	}
@@ -101,24 +320,53 @@ func main() {
 	}
 }
 
-// extractEmbeddedAgents writes the embedded agent binaries to the build/agent directory
-func extractEmbeddedAgents() error {
-	agentDir := "build/agent"
-	if err := os.MkdirAll(agentDir, 0755); err != nil {
-		return fmt.Errorf("failed to create agent directory: %w", err)
+// embeddedAgent is an agent binary embedded in the daemon
+type embeddedAgent struct {
+	goos, goarch string
+	data         []byte
+}
+
+// embeddedAgents returns the agent binaries embedded in the daemon
+func embeddedAgents() []embeddedAgent {
+	return []embeddedAgent{
+		{"darwin", "amd64", agentDarwinAmd64},
+		{"darwin", "arm64", agentDarwinArm64},
+		{"linux", "amd64", agentLinuxAmd64},
+		{"linux", "arm64", agentLinuxArm64},
+		{"windows", "amd64", agentWindowsAmd64},
+	}
+}
+
+// registerEmbeddedAgents makes the embedded agent binaries available from
+// memory
+func registerEmbeddedAgents() {
+	for _, agent := range embeddedAgents() {
+		// build-agents embeds an empty placeholder for targets it didn't build
+		if len(agent.data) == 0 {
+			logger.Debugf("Agent for %s/%s isn't embedded in this daemon", agent.goos, agent.goarch)
+			continue
+		}
+		cloud.RegisterAgentBinary(agent.goos, agent.goarch, agent.data)
 	}
+}
 
-	agents := map[string][]byte{
-		"taskfly-agent-darwin-amd64":      agentDarwinAmd64,
-		"taskfly-agent-darwin-arm64":      agentDarwinArm64,
-		"taskfly-agent-linux-amd64":       agentLinuxAmd64,
-		"taskfly-agent-linux-arm64":       agentLinuxArm64,
-		"taskfly-agent-windows-amd64.exe": agentWindowsAmd64,
+// extractEmbeddedAgents writes the embedded agent binaries to the agent
+// directory, for tools that expect them on disk
+func extractEmbeddedAgents(agentDir string) error {
+	if err := os.MkdirAll(agentDir, 0755); err != nil {
+		return fmt.Errorf("failed to create agent directory: %w", err)
 	}
 
-	for name, data := range agents {
+	for _, agent := range embeddedAgents() {
+		if len(agent.data) == 0 {
+			continue
+		}
+		name := fmt.Sprintf("taskfly-agent-%s-%s", agent.goos, agent.goarch)
+		if agent.goos == "windows" {
+			name += ".exe"
+		}
 		path := filepath.Join(agentDir, name)
-		if err := os.WriteFile(path, data, 0755); err != nil {
+		if err := os.WriteFile(path, agent.data, 0755); err != nil {
 			return fmt.Errorf("failed to write agent %s: %w", name, err)
 		}
 		logger.Debugf("Extracted embedded agent: %s", path)
@@ -130,7 +378,10 @@ func extractEmbeddedAgents() error {
 func runDaemon(c *cli.Context) error {
 	// Setup and initialization
 	startTime = time.Now()
-	daemonIP = fmt.Sprintf("http://%s:%s", c.String("daemon-ip"), c.String("daemon-port"))
+	daemonIP = buildDaemonURL(c.String("daemon-ip"), c.String("daemon-port"))
+	if internalIP := c.String("daemon-internal-ip"); internalIP != "" {
+		daemonInternalURL = buildDaemonURL(internalIP, c.String("daemon-port"))
+	}
 
 	// Initialize logger
 	logger = logrus.New()
@@ -140,10 +391,14 @@ func runDaemon(c *cli.Context) error {
 	logger.SetLevel(logrus.InfoLevel)
 	logger.Infof("Starting TaskFlyd daemon...")
 
-	// Extract embedded agent binaries
-	logger.Info("Extracting embedded agent binaries...")
-	if err := extractEmbeddedAgents(); err != nil {
-		logger.Fatalf("Failed to extract agent binaries: %v", err)
+	// Serve embedded agent binaries from memory. An agent directory supplies
+	// agents for other platforms, and gets the embedded ones extracted to it.
+	registerEmbeddedAgents()
+	if cloud.AgentDir = c.String("agent-dir"); cloud.AgentDir != "" {
+		logger.Infof("Extracting embedded agent binaries to %s...", cloud.AgentDir)
+		if err := extractEmbeddedAgents(cloud.AgentDir); err != nil {
+			logger.Fatalf("Failed to extract agent binaries: %v", err)
+		}
 	}
 
 	// Create deployment working directory
@@ -158,30 +413,172 @@ func runDaemon(c *cli.Context) error {
 	logger.Infof("Using deployment directory: %s", deploymentDir)
 
 	// Initialize disk-backed state store
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		logger.Fatalf("Failed to get user home directory: %v", err)
+	stateDir := c.String("state-dir")
+	if stateDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			logger.Fatalf("Failed to get user home directory: %v", err)
+		}
+		stateDir = filepath.Join(homeDir, ".taskfly", "state")
 	}
-	stateDir := filepath.Join(homeDir, ".taskfly", "state")
-	store, err = state.NewDiskStore(stateDir)
+	diskStore, err := state.NewDiskStore(stateDir)
 	if err != nil {
 		logger.Fatalf("Failed to initialize state store: %v", err)
 	}
+	for _, name := range diskStore.SkippedFiles() {
+		logger.Warnf("Skipped unreadable state file %s, renamed to %s.corrupt", name, name)
+	}
+	store = diskStore
 	logger.Infof("State store initialized at %s", stateDir)
 
+	// Bound the memory node logs take
+	logLimits, err := parseLogLimits(c)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	store.SetLogLimits(logLimits)
+
+	// Initialize usage accounting next to the state
+	usageTracker, err = usage.NewTracker(filepath.Join(stateDir, "usage.json"))
+	if err != nil {
+		logger.Fatalf("Failed to initialize usage tracker: %v", err)
+	}
+	nodeLedger, err = usage.NewLedger(filepath.Join(stateDir, "node_ledger.json"))
+	if err != nil {
+		logger.Fatalf("Failed to initialize node ledger: %v", err)
+	}
+	go trackNodeTime(time.Minute)
+
+	// Load the optional environment variable policy
+	var envPolicy *policy.EnvPolicy
+	if policyPath := c.String("env-policy"); policyPath != "" {
+		envPolicy, err = policy.LoadEnvPolicy(policyPath)
+		if err != nil {
+			logger.Fatalf("Failed to load env policy: %v", err)
+		}
+		logger.Infof("Enforcing env policy from %s", policyPath)
+	}
+
+	// Load the optional API tokens
+	if tokensPath := c.String("api-tokens"); tokensPath != "" {
+		apiTokens, err = auth.LoadTokens(tokensPath)
+		if err != nil {
+			logger.Fatalf("Failed to load API tokens: %v", err)
+		}
+		logger.Infof("Requiring API tokens from %s", tokensPath)
+	} else {
+		logger.Warn("No API tokens configured, anyone who can reach the daemon can use the API")
+	}
+
+	nodeTokenTTL = c.Duration("node-token-ttl")
+	if nodeTokenTTL > 0 && nodeTokenTTL < 5*time.Minute {
+		logger.Fatalf("--node-token-ttl must be at least 5m, got %s", nodeTokenTTL)
+	}
+	requireAgentSignatures = c.Bool("require-agent-signatures")
+	if requireAgentSignatures {
+		logger.Info("Requiring signed agent requests")
+	}
+	if certsPath := c.String("aws-identity-certs"); certsPath != "" {
+		instanceIdentityCerts, err = cloud.LoadIdentityCertificates(certsPath)
+		if err != nil {
+			logger.Fatalf("Failed to load AWS identity certificates: %v", err)
+		}
+		logger.Infof("Verifying AWS instance identity documents against %d certificates from %s", len(instanceIdentityCerts), certsPath)
+	}
+
+	allowSimulate = c.Bool("allow-simulate")
+	if allowSimulate {
+		logger.Warn("Simulated deployments are allowed, their scripts run on this host")
+	}
+	if recordDir := c.String("record-dir"); recordDir != "" {
+		recorder, err = trace.NewRecorder(recordDir)
+		if err != nil {
+			logger.Fatalf("Failed to initialize trace recording: %v", err)
+		}
+		logger.Warnf("Recording node API traffic to %s, traces include node credentials", recordDir)
+	}
+
+	// Relay API requests to satellites, or register with a central daemon
+	relaySecret := c.String("relay-secret")
+	relayTo := c.String("relay-to")
+	if relayTo != "" {
+		if relaySecret == "" {
+			logger.Fatal("--relay-to requires --relay-secret")
+		}
+		if apiTokens != nil {
+			if _, ok := apiTokens.Lookup(c.String("relay-api-key")); !ok {
+				logger.Fatal("--relay-to with --api-tokens requires --relay-api-key set to one of the API tokens")
+			}
+		}
+	} else if relaySecret != "" {
+		logger.Fatal("--relay-secret requires --relay-to, central daemons list their satellites with --relay-satellites")
+	}
+	if satellitesPath := c.String("relay-satellites"); satellitesPath != "" {
+		if relayTo != "" {
+			logger.Fatal("A satellite can't relay for other satellites, use either --relay-to or --relay-satellites")
+		}
+		relaySecrets, err = relay.LoadSecrets(satellitesPath)
+		if err != nil {
+			logger.Fatalf("Failed to load relay satellites: %v", err)
+		}
+		relayHub = relay.NewHub(2 * relay.PollWait)
+		logger.Infof("Relaying API requests to satellite daemons from %s", satellitesPath)
+	}
+
+	// Set up the optional admission policy
+	var admission *policy.OPA
+	if opaURL := c.String("opa-url"); opaURL != "" {
+		admission = policy.NewOPA(opaURL, c.Duration("opa-timeout"), c.Bool("opa-fail-open"))
+		logger.Infof("Evaluating new deployments against admission policy at %s", opaURL)
+	}
+
 	// Initialize orchestrator
-	orch = orchestrator.NewOrchestrator(store, deploymentDir, daemonIP)
-	logger.Info("Orchestrator initialized")
+	// Keep node durations per template for completion estimates
+	timings, err = report.NewTimings(filepath.Join(stateDir, "timings.json"))
+	if err != nil {
+		logger.Fatalf("Failed to initialize timing history: %v", err)
+	}
 
-	// Start periodic cleanup goroutine
-	go func() {
-		ticker := time.NewTicker(1 * time.Hour)
-		defer ticker.Stop()
-		for range ticker.C {
-			logger.Info("Running periodic cleanup...")
-			orch.CleanupCompletedDeployments()
+	// Remember which bundles agents on static hosts have cached
+	bundles, err := cloud.NewBundleIndex(filepath.Join(stateDir, "bundle_cache.json"))
+	if err != nil {
+		logger.Fatalf("Failed to initialize bundle cache index: %v", err)
+	}
+
+	// Let the nodes of a deployment share artifacts
+	var artifactCacheSize int64
+	if size := c.String("artifact-cache-size"); size != "0" {
+		if artifactCacheSize, err = orchestrator.ParseSize(size); err != nil {
+			logger.Fatalf("Invalid --artifact-cache-size: %v", err)
 		}
-	}()
+	}
+	if artifactCacheSize > 0 {
+		artifactCache, err = artifacts.New(filepath.Join(stateDir, "artifacts"), artifactCacheSize, c.Duration("artifact-cache-ttl"))
+		if err != nil {
+			logger.Fatalf("Failed to initialize artifact cache: %v", err)
+		}
+		if err := setupArtifactStorage(c.String("artifact-storage"), c.StringSlice("artifact-storage-allow"), filepath.Join(stateDir, "artifact_url.key")); err != nil {
+			logger.Fatalf("Failed to initialize artifact storage: %v", err)
+		}
+		logger.Infof("Artifact cache allows %s per deployment, kept for %s in %s", c.String("artifact-cache-size"), c.Duration("artifact-cache-ttl"), artifactCache.Storage())
+	}
+
+	orch = orchestrator.NewOrchestrator(store, deploymentDir, daemonIP, daemonInternalURL, envPolicy, admission, timings, bundles)
+	orch.SetClaimTimeout(c.Duration("provision-token-ttl"))
+	if artifactCache != nil {
+		orch.SetArtifactStorage(checkArtifactStorage)
+	}
+	finishes = export.NewFinishCounter(store.GetAllDeployments())
+	logger.Info("Orchestrator initialized")
+	if daemonInternalURL != "" {
+		logger.Infof("Agents will fall back to internal callback URL %s", daemonInternalURL)
+	}
+
+	// Clean up finished deployments by the policy, which the API can change
+	if err := orch.SetCleanupPolicy(cleanupPolicyFlags(c)); err != nil {
+		logger.Fatalf("Invalid cleanup policy: %v", err)
+	}
+	go orch.RunCleanup(context.Background())
 
 	// Initialize Echo
 	e := echo.New()
@@ -190,6 +587,9 @@ func runDaemon(c *cli.Context) error {
 	// Middleware
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
+	e.Use(authMiddleware)
+	e.Use(usageMiddleware)
+	e.Use(recordMiddleware)
 
 	// API routes
 	api := e.Group("/api/v1")
@@ -200,40 +600,126 @@ func runDaemon(c *cli.Context) error {
 	api.GET("/deployments/:id", getDeployment)
 	api.DELETE("/deployments/:id", deleteDeployment)
 	api.GET("/deployments/:id/logs", getDeploymentLogs)
+	api.GET("/deployments/:id/report", getDeploymentReport)
+	api.GET("/deployments/:id/events", getDeploymentEvents)
+	api.GET("/deployments/:id/bundle/manifest", getBundleManifest)
+	api.GET("/deployments/:id/archive", getDeploymentArchive)
+	api.GET("/deployments/:id/export", exportDeployment)
+	api.GET("/deployments/:id/metrics", getDeploymentMetrics)
+	api.POST("/deployments/:id/bake", bakeImage)
+	api.PATCH("/deployments/:id/config", reconfigureDeployment)
+	api.GET("/deployments/:id/artifacts", listArtifacts)
+	api.GET("/deployments/:id/artifacts/:key/url", getArtifactURL)
+	api.GET("/artifacts/:id/:key", downloadSignedArtifact)
+	api.GET("/deployments/:id/nodes/:node/config", getNodeConfig)
+	api.GET("/recommendations", getRecommendations)
 
 	// Node endpoints
-	api.POST("/nodes/register", registerNode)
-	api.GET("/nodes/assets", getNodeAssets)
-	api.POST("/nodes/heartbeat", nodeHeartbeat)
-	api.POST("/nodes/status", updateNodeStatus)
-	api.POST("/nodes/logs", pushNodeLogs)
+	agentNodeRoutes(api)
+	api.GET("/nodes/:id", getNodeDetails)
+	api.POST("/nodes/:id/quarantine", quarantineNode)
+	api.POST("/nodes/:id/revoke", revokeNodeToken)
+	api.PATCH("/nodes/:id/config", reconfigureNode)
+	api.GET("/nodes/by-instance/:id", findNodesByInstance)
+	api.GET("/nodes/by-ip/:ip", findNodesByIP)
 
 	// Health and stats endpoints
 	api.GET("/health", healthCheck)
 	api.GET("/stats", getStats)
 	api.GET("/metrics", getMetrics)
+	api.GET("/metrics/prometheus", getPrometheusMetrics)
+	api.GET("/search", search)
+	api.GET("/usage", getUsage)
 
 	// Cleanup endpoints
 	api.POST("/deployments/:id/cleanup", cleanupDeployment)
 	api.POST("/cleanup/all", cleanupAllCompleted)
+	api.GET("/cleanup/policy", getCleanupPolicy)
+	api.PATCH("/cleanup/policy", updateCleanupPolicy)
 
-	// Start periodic cleanup routine
+	// Satellite relay endpoints
+	api.POST("/relay/poll", relayPoll)
+	api.POST("/relay/respond", relayRespond)
+	api.GET("/satellites", listSatellites)
+	api.Any("/satellites/:name/*", proxySatellite)
+
+	// Count finished deployments for the Prometheus metrics before cleanup
+	// removes them
 	go func() {
-		ticker := time.NewTicker(10 * time.Minute) // Cleanup every 10 minutes
+		ticker := time.NewTicker(time.Minute)
 		defer ticker.Stop()
 
 		for range ticker.C {
-			cleaned, failed, err := orch.CleanupAllCompleted()
-			if err != nil {
-				logger.Errorf("Periodic cleanup failed: %v", err)
-			} else if cleaned > 0 || failed > 0 {
-				logger.Infof("Periodic cleanup: %d cleaned, %d failed", cleaned, failed)
+			deployments, nodes := allDeploymentNodes()
+			finishes.Observe(deployments, nodes)
+		}
+	}()
+
+	// Shut down nodes that have nothing left to do
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if count := orch.ShutdownIdleNodes(); count > 0 {
+				logger.Infof("Idle shutdown: %d nodes shut down", count)
+			}
+		}
+	}()
+
+	// Fail nodes whose agent never registered
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if count := orch.ExpireUnclaimedNodes(); count > 0 {
+				logger.Warnf("Provision tokens: %d unclaimed nodes failed", count)
+			}
+		}
+	}()
+
+	// Drop expired artifacts and those of deleted deployments
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			expireArtifacts()
+		}
+	}()
+
+	// Warn before the log buffers fill up
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			checkMemory()
+		}
+	}()
+
+	// Alert on deployments and nodes that stop making progress
+	notifier = notify.New(c.StringSlice("notify-webhook"), 10*time.Second)
+	transitions, err := parseTransitionFilter(c.StringSlice("notify-transitions"))
+	if err != nil {
+		logger.Fatalf("Invalid --notify-transitions: %v", err)
+	}
+	watchTransitions(store, notifier, transitions)
+	watchdog := orchestrator.NewWatchdog(store, notifier, c.Duration("watchdog-pending"), c.Duration("watchdog-stalled"))
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			if count := watchdog.Check(now); count > 0 {
+				logger.Warnf("Watchdog: %d new alerts", count)
 			}
 		}
 	}()
 
 	// Start server
-	listenAddr := fmt.Sprintf("%s:%s", c.String("listen-ip"), c.String("listen-port"))
+	listenAddr := net.JoinHostPort(c.String("listen-ip"), c.String("listen-port"))
 	logger.Infof("Starting server on %s", listenAddr)
 	go func() {
 		if err := e.Start(listenAddr); err != nil && err != http.ErrServerClosed {
@@ -241,15 +727,30 @@ func runDaemon(c *cli.Context) error {
 		}
 	}()
 
+	// Serve this daemon's API through the central daemon
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	defer stopRelay()
+	if relayTo != "" {
+		runSatellite(relayCtx, relayTo, relaySecret, localAPIURL(c.String("listen-ip"), c.String("listen-port")), c.String("relay-api-key"))
+	}
+
 	// Wait for interrupt signal to gracefully shutdown the server with a timeout of 10 seconds.
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 	<-quit
+	stopRelay()
+	if relayHub != nil {
+		relayHub.Close()
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	if err := e.Shutdown(ctx); err != nil {
 		logger.Fatal(err)
 	}
+	if err := store.Close(); err != nil {
+		logger.Errorf("Failed to write state: %v", err)
+	}
+	cloud.RemoveAgentExecutables()
 
 	return nil
 }
@@ -258,6 +759,29 @@ func runDaemon(c *cli.Context) error {
 func createDeployment(c echo.Context) error {
 	logger.Info("Received deployment request")
 
+	// A client retrying an interrupted upload gets the deployment the first
+	// attempt created rather than a second one
+	owner := requestOwner(c)
+	uploadID := c.FormValue("upload_id")
+	if uploadID != "" {
+		if !uploadIDPattern.MatchString(uploadID) {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid upload_id",
+			})
+		}
+		if _, busy := pendingUploads.LoadOrStore(uploadID, true); busy {
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error": fmt.Sprintf("Upload %s is still being processed", uploadID),
+			})
+		}
+		defer pendingUploads.Delete(uploadID)
+
+		if deployment := uploadedDeployment(owner, uploadID); deployment != nil {
+			logger.Infof("Upload %s already created deployment %s", uploadID, deployment.ID)
+			return c.JSON(http.StatusOK, deploymentResponse(deployment, true))
+		}
+	}
+
 	// Get the uploaded file
 	file, err := c.FormFile("bundle")
 	if err != nil {
@@ -300,8 +824,42 @@ func createDeployment(c echo.Context) error {
 		})
 	}
 
+	keepFailed, err := orchestrator.ParseKeepFailed(c.FormValue("keep_failed"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("Invalid keep_failed: %v", err),
+		})
+	}
+
+	simulate := false
+	if value := c.FormValue("simulate"); value != "" {
+		if simulate, err = strconv.ParseBool(value); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("Invalid simulate: %v", err),
+			})
+		}
+	}
+	if simulate && !allowSimulate {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error": "Simulated deployments are disabled, start the daemon with --allow-simulate",
+		})
+	}
+
+	// Values of the input variables taskfly.yml declares, as a JSON object
+	// of strings
+	var vars map[string]string
+	if value := c.FormValue("variables"); value != "" {
+		if err := json.Unmarshal([]byte(value), &vars); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("Invalid variables: %v", err),
+			})
+		}
+	}
+
+	usageTracker.RecordBundle(owner, file.Size)
+
 	// Process the deployment
-	deployment, err := orch.ProcessDeployment(bundlePath)
+	deployment, err := orch.ProcessDeployment(bundlePath, owner, keepFailed, simulate, uploadID, vars)
 	if err != nil {
 		logger.Errorf("Failed to process deployment: %v", err)
 		return c.JSON(http.StatusBadRequest, map[string]string{
@@ -311,18 +869,26 @@ func createDeployment(c echo.Context) error {
 
 	logger.Infof("Created deployment %s with %d nodes", deployment.ID, deployment.TotalNodes)
 
-	return c.JSON(http.StatusAccepted, map[string]interface{}{
-		"deployment_id": deployment.ID,
-		"message":       fmt.Sprintf("Deployment accepted. Provisioning %d nodes.", deployment.TotalNodes),
-		"status_url":    fmt.Sprintf("/api/v1/deployments/%s", deployment.ID),
-		"nodes":         deployment.TotalNodes,
-		"status":        deployment.Status,
-	})
+	return c.JSON(http.StatusAccepted, deploymentResponse(deployment, false))
 }
 
 func listDeployments(c echo.Context) error {
+	type deploymentEntry struct {
+		*state.Deployment
+		Estimate *report.Estimate `json:"estimate,omitempty"`
+	}
+
+	now := time.Now()
 	deployments := store.GetAllDeployments()
-	return c.JSON(http.StatusOK, deployments)
+	entries := make([]deploymentEntry, len(deployments))
+	for i, deployment := range deployments {
+		entries[i] = deploymentEntry{Deployment: deployment.Redacted()}
+		if nodes, err := store.GetNodesByDeployment(deployment.ID); err == nil {
+			entries[i].Estimate = report.EstimateCompletion(deployment, nodes, timings, now)
+		}
+	}
+
+	return c.JSON(http.StatusOK, entries)
 }
 
 func getDeployment(c echo.Context) error {
@@ -348,6 +914,7 @@ func getDeployment(c echo.Context) error {
 
 	// Convert nodes to response format
 	logger.Debugf("Found %d nodes for deployment %s", len(nodes), id)
+	now := time.Now()
 	nodeResponses := make([]map[string]interface{}, len(nodes))
 	for i, node := range nodes {
 		logger.Debugf("Node %s: status=%s, last_update=%s", node.NodeID, node.Status, node.LastUpdate)
@@ -356,16 +923,38 @@ func getDeployment(c echo.Context) error {
 			"node_index":  node.NodeIndex,
 			"status":      node.Status,
 			"last_update": node.LastUpdate,
+			"liveness":    state.NodeLiveness(node, now),
+		}
+		if node.LastHeartbeat != nil {
+			nodeResponse["last_heartbeat"] = node.LastHeartbeat
 		}
 		if node.IPAddress != "" {
 			nodeResponse["ip_address"] = node.IPAddress
 		}
+		if node.PrivateIPAddress != "" {
+			nodeResponse["private_ip_address"] = node.PrivateIPAddress
+		}
+		if node.IPv6Address != "" {
+			nodeResponse["ipv6_address"] = node.IPv6Address
+		}
 		if node.InstanceID != "" {
 			nodeResponse["instance_id"] = node.InstanceID
 		}
+		if node.AvailabilityZone != "" {
+			nodeResponse["availability_zone"] = node.AvailabilityZone
+		}
 		if node.ErrorMessage != "" {
 			nodeResponse["error_message"] = node.ErrorMessage
 		}
+		if node.Progress != nil {
+			nodeResponse["progress"] = node.Progress
+		}
+		if node.Metrics != nil && len(node.Metrics.Custom) > 0 {
+			nodeResponse["metrics"] = map[string]interface{}{"custom": node.Metrics.Custom}
+		}
+		if len(node.HealthChecks) > 0 {
+			nodeResponse["health_checks"] = node.HealthChecks
+		}
 		nodeResponses[i] = nodeResponse
 	}
 
@@ -376,6 +965,7 @@ func getDeployment(c echo.Context) error {
 		"total_nodes":     deployment.TotalNodes,
 		"nodes_completed": deployment.NodesCompleted,
 		"nodes_failed":    deployment.NodesFailed,
+		"progress":        deployment.Progress,
 		"created_at":      deployment.CreatedAt,
 		"updated_at":      deployment.UpdatedAt,
 		"nodes":           nodeResponses,
@@ -387,106 +977,657 @@ func getDeployment(c echo.Context) error {
 	if deployment.ErrorMessage != "" {
 		response["error_message"] = deployment.ErrorMessage
 	}
+	if deployment.KeepFailed > 0 {
+		response["keep_failed"] = deployment.KeepFailed
+	}
+	if deployment.KeepFailedUntil != nil {
+		response["keep_failed_until"] = deployment.KeepFailedUntil
+	}
+	if deployment.ImportedFrom != nil {
+		response["imported_from"] = deployment.ImportedFrom
+	}
+	if deployment.Debug {
+		response["debug"] = true
+	}
+	if len(deployment.Variables) > 0 {
+		response["variables"] = deployment.Redacted().Variables
+	}
+	if estimate := report.EstimateCompletion(deployment, nodes, timings, now); estimate != nil {
+		response["estimate"] = estimate
+	}
 
 	return c.JSON(http.StatusOK, response)
 }
 
-func deleteDeployment(c echo.Context) error {
+// getNodeDetails returns a single node including the host inventory it
+// reported at registration
+func getNodeDetails(c echo.Context) error {
 	id := c.Param("id")
-	logger.Infof("Terminating deployment: %s", id)
 
-	// Check if deployment exists
-	_, err := store.GetDeployment(id)
+	node, err := store.GetNode(id)
 	if err != nil {
 		return c.JSON(http.StatusNotFound, map[string]string{
-			"error": "Deployment not found",
-		})
-	}
-
-	// Initiate termination
-	if err := orch.TerminateDeployment(id); err != nil {
-		logger.Errorf("Failed to terminate deployment %s: %v", id, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to initiate termination",
+			"error": "Node not found",
 		})
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "Deployment termination initiated"})
+	return c.JSON(http.StatusOK, nodeDetails(node))
 }
 
-func registerNode(c echo.Context) error {
-	logger.Info("Received registration request from a node")
+// quarantineNode keeps a failed node alive for debugging. The duration
+// defaults to two hours.
+func quarantineNode(c echo.Context) error {
+	id := c.Param("id")
 
-	// Parse the registration request
 	var req struct {
-		ProvisionToken string `json:"provision_token"`
-		IP             string `json:"ip"`
+		Duration string `json:"duration" form:"duration"`
 	}
 	if err := c.Bind(&req); err != nil {
-		logger.Errorf("Failed to parse registration request: %v", err)
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
-	logger.Infof("Registration attempt from IP %s with token %s", req.IP, req.ProvisionToken)
 
-	// Find node by provision token
-	// For now, we'll search through all nodes - in production this would be indexed
-	var (
-		foundNode *state.Node
-		foundDep  *state.Deployment
-	)
-
-	deps := store.GetAllDeployments()
-	for _, dep := range deps {
-		nodes, _ := store.GetNodesByDeployment(dep.ID)
-		for _, node := range nodes {
-			if node.ProvisionToken == req.ProvisionToken {
-				foundNode = node
-				foundDep = dep
-				break
-			}
-		}
-		if foundNode != nil {
-			break
+	duration := orchestrator.DefaultQuarantine
+	if req.Duration != "" {
+		parsed, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Invalid duration: %v", err)})
 		}
+		duration = parsed
 	}
 
-	if foundNode == nil {
-		logger.Warnf("Invalid provision token received: %s", req.ProvisionToken)
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid provision token"})
-	}
-	logger.Infof("Found node %s for deployment %s", foundNode.NodeID, foundDep.ID)
-
-	// Generate auth token for this node
-	authToken := "auth-" + foundNode.NodeID
-
-	// Update node with auth token and status
-	err := store.UpdateNodeAuthToken(foundDep.ID, foundNode.NodeID, authToken)
+	node, err := store.GetNode(id)
 	if err != nil {
-		logger.Errorf("Failed to update auth token for node %s: %v", foundNode.NodeID, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update node auth token"})
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Node not found"})
+	}
+
+	until, err := orch.QuarantineNode(node, duration)
+	if errors.Is(err, orchestrator.ErrNotQuarantinable) {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": fmt.Sprintf("Node %s cannot be quarantined (status: %s): %v", node.NodeID, node.Status, err),
+		})
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"node_id":            node.NodeID,
+		"instance_id":        node.InstanceID,
+		"ip_address":         node.IPAddress,
+		"private_ip_address": node.PrivateIPAddress,
+		"quarantined_until":  until,
+	})
+}
+
+// findDeploymentNode returns the node of a deployment given by ID or index,
+// or nil
+func findDeploymentNode(nodes []*state.Node, ref string) *state.Node {
+	for _, node := range nodes {
+		if node.NodeID == ref || strconv.Itoa(node.NodeIndex) == ref {
+			return node
+		}
+	}
+	return nil
+}
+
+// getNodeConfig returns the config a node of a deployment received, given by
+// ID or index, with where each key came from and how the agent passes it to
+// the workload
+func getNodeConfig(c echo.Context) error {
+	id := c.Param("id")
+
+	deployment, err := store.GetDeployment(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+	}
+	nodes, err := store.GetNodesByDeployment(id)
+	if err != nil {
+		logger.Errorf("Failed to get nodes for deployment %s: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get deployment nodes"})
+	}
+	node := findDeploymentNode(nodes, c.Param("node"))
+	if node == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": fmt.Sprintf("Node %s not found in deployment", c.Param("node"))})
+	}
+
+	fileKeys := make(map[string]bool)
+	for _, key := range toStringSlice(deployment.Config["config_files"]) {
+		fileKeys[key] = true
+	}
+
+	keys := make([]map[string]interface{}, 0, len(node.Config))
+	for _, key := range sortedConfigKeys(node.Config) {
+		var exportedAs string
+		switch {
+		case key == metadata.ScriptArgsKey || key == metadata.EntryCommandKey:
+			exportedAs = "command line"
+		case fileKeys[key]:
+			exportedAs = metadata.FileEnvName(key)
+		default:
+			exportedAs = metadata.EnvName(key)
+		}
+		entry := map[string]interface{}{
+			"key":         key,
+			"value":       node.Config[key],
+			"exported_as": exportedAs,
+			"file":        fileKeys[key],
+		}
+		// Nodes created before sources were recorded have none
+		if source, ok := node.ConfigSources[key]; ok {
+			entry["source"] = source
+		}
+		keys = append(keys, entry)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"deployment_id":  deployment.ID,
+		"node_id":        node.NodeID,
+		"node_index":     node.NodeIndex,
+		"status":         node.Status,
+		"config_version": node.ConfigVersion,
+		"keys":           keys,
+	})
+}
+
+// sortedConfigKeys returns the keys of a node's config in order
+func sortedConfigKeys(config map[string]interface{}) []string {
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// bakeImage snapshots a node of a deployment into a machine image. The node
+// is given by ID or index.
+func bakeImage(c echo.Context) error {
+	id := c.Param("id")
+
+	var req struct {
+		Node   string `json:"node" form:"node"`
+		Name   string `json:"name" form:"name"`
+		Reboot bool   `json:"reboot" form:"reboot"`
+	}
+	if err := c.Bind(&req); err != nil || req.Node == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request, node is required"})
+	}
+
+	deployment, err := store.GetDeployment(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+	}
+
+	nodes, err := store.GetNodesByDeployment(id)
+	if err != nil {
+		logger.Errorf("Failed to get nodes for deployment %s: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get deployment nodes"})
+	}
+	node := findDeploymentNode(nodes, req.Node)
+	if node == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": fmt.Sprintf("Node %s not found in deployment", req.Node)})
+	}
+
+	if node.InstanceID == "" || node.ShouldShutdown || node.Status == state.NodeStatusTerminating || node.Status == state.NodeStatusTerminated {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": fmt.Sprintf("Node %s has no running instance to bake (status: %s)", node.NodeID, node.Status),
+		})
+	}
+
+	imageID, err := orch.BakeImage(deployment, node, req.Name, req.Reboot)
+	if errors.Is(err, orchestrator.ErrBakeUnsupported) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		logger.Errorf("Failed to bake image of node %s: %v", node.NodeID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]string{
+		"image_id":    imageID,
+		"node_id":     node.NodeID,
+		"instance_id": node.InstanceID,
+	})
+}
+
+// nodeDetails builds the API representation of a single node
+func nodeDetails(node *state.Node) map[string]interface{} {
+	response := map[string]interface{}{
+		"node_id":            node.NodeID,
+		"node_index":         node.NodeIndex,
+		"deployment_id":      node.DeploymentID,
+		"status":             node.Status,
+		"ip_address":         node.IPAddress,
+		"private_ip_address": node.PrivateIPAddress,
+		"ipv6_address":       node.IPv6Address,
+		"instance_id":        node.InstanceID,
+		"availability_zone":  node.AvailabilityZone,
+		"last_update":        node.LastUpdate,
+		"liveness":           state.NodeLiveness(node, time.Now()),
+	}
+	if node.LastHeartbeat != nil {
+		response["last_heartbeat"] = node.LastHeartbeat
+	}
+	if node.RegisteredAt != nil {
+		response["registered_at"] = node.RegisteredAt
+		response["registered_from"] = node.RegisteredFrom
+	} else if node.ClaimDeadline != nil {
+		response["claim_deadline"] = node.ClaimDeadline
+	}
+	if node.ErrorMessage != "" {
+		response["error_message"] = node.ErrorMessage
+	}
+	if node.Metrics != nil {
+		response["metrics"] = node.Metrics
+	}
+	if len(node.HealthChecks) > 0 {
+		response["health_checks"] = node.HealthChecks
+	}
+	if node.Progress != nil {
+		response["progress"] = node.Progress
+	}
+	if node.ShutdownReason != "" {
+		response["shutdown_reason"] = node.ShutdownReason
+		response["shutdown_at"] = node.ShutdownAt
+	}
+	if node.QuarantinedUntil != nil {
+		response["quarantined_until"] = node.QuarantinedUntil
+	}
+	if len(node.Phases) > 0 {
+		response["phases"] = node.Phases
+	}
+	if node.SystemInfo != nil {
+		response["system_info"] = node.SystemInfo
+		if !node.SystemInfo.BootTime.IsZero() {
+			response["uptime_seconds"] = int64(time.Since(node.SystemInfo.BootTime).Seconds())
+		}
+	}
+
+	return response
+}
+
+// findNodesByInstance returns the nodes that ran on a cloud instance, most
+// recently updated first. Pooled instances can appear in several deployments.
+func findNodesByInstance(c echo.Context) error {
+	instanceID := c.Param("id")
+	return findNodes(c, func(node *state.Node) bool {
+		return node.InstanceID == instanceID
+	})
+}
+
+// findNodesByIP returns the nodes with a matching public, private or IPv6
+// address, most recently updated first
+func findNodesByIP(c echo.Context) error {
+	ip := c.Param("ip")
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+	return findNodes(c, func(node *state.Node) bool {
+		return node.IPAddress == ip || node.PrivateIPAddress == ip || node.IPv6Address == ip
+	})
+}
+
+func findNodes(c echo.Context, matches func(node *state.Node) bool) error {
+	var found []*state.Node
+	for _, dep := range store.GetAllDeployments() {
+		nodes, _ := store.GetNodesByDeployment(dep.ID)
+		for _, node := range nodes {
+			if matches(node) {
+				found = append(found, node)
+			}
+		}
+	}
+
+	if len(found) == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "No matching node found"})
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].LastUpdate.After(found[j].LastUpdate)
+	})
+
+	results := make([]map[string]interface{}, len(found))
+	for i, node := range found {
+		results[i] = nodeDetails(node)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"nodes": results,
+		"count": len(results),
+	})
+}
+
+func deleteDeployment(c echo.Context) error {
+	id := c.Param("id")
+	logger.Infof("Terminating deployment: %s", id)
+
+	// Check if deployment exists
+	_, err := store.GetDeployment(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Deployment not found",
+		})
+	}
+
+	// Initiate termination
+	if err := orch.TerminateDeployment(id); err != nil {
+		logger.Errorf("Failed to terminate deployment %s: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to initiate termination",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Deployment termination initiated"})
+}
+
+// agentNodeRoutes registers the endpoints agents call for their node, which
+// replays of recorded traces are served by as well
+func agentNodeRoutes(api *echo.Group) {
+	api.POST("/nodes/register", registerNode)
+	api.POST("/nodes/token", refreshNodeToken, agentSignatureMiddleware)
+	api.GET("/nodes/agent", getNodeAgent)
+	api.GET("/nodes/assets", getNodeAssets, agentSignatureMiddleware)
+	api.POST("/nodes/heartbeat", nodeHeartbeat, agentSignatureMiddleware)
+	api.POST("/nodes/status", updateNodeStatus, agentSignatureMiddleware)
+	api.POST("/nodes/logs", pushNodeLogs, agentSignatureMiddleware)
+	api.POST("/nodes/progress", updateNodeProgress, agentSignatureMiddleware)
+	api.PUT("/nodes/artifacts/:key", putArtifact)
+	api.GET("/nodes/artifacts/:key", getArtifact, agentSignatureMiddleware)
+}
+
+func registerNode(c echo.Context) error {
+	logger.Info("Received registration request from a node")
+
+	// Parse the registration request
+	var req struct {
+		ProvisionToken   string            `json:"provision_token"`
+		IP               string            `json:"ip"`
+		SystemInfo       *state.SystemInfo `json:"system_info"`
+		InstanceIdentity *instanceIdentity `json:"instance_identity"`
+		CachedBundles    []string          `json:"cached_bundles"`
+	}
+	if err := c.Bind(&req); err != nil {
+		logger.Errorf("Failed to parse registration request: %v", err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	logger.Infof("Registration attempt from IP %s with token %s", req.IP, req.ProvisionToken)
+
+	// Find node by provision token
+	foundNode, foundDep := findNodeByProvisionToken(req.ProvisionToken)
+	if foundNode == nil {
+		logger.Warnf("Invalid provision token received: %s", req.ProvisionToken)
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid provision token"})
+	}
+	logger.Infof("Found node %s for deployment %s", foundNode.NodeID, foundDep.ID)
+	log := deploymentLog(foundDep)
+	log.Debugf("Node %s registers from %s with system info %+v", foundNode.NodeID, c.RealIP(), req.SystemInfo)
+
+	// On AWS, optionally make sure the agent runs on the instance launched for
+	// this node, so a leaked provision token can't be used off-cloud
+	instanceVerified, err := verifyInstanceIdentity(foundNode, foundDep, req.InstanceIdentity)
+	if err != nil {
+		log.Warnf("Rejected registration of node %s from %s: %v", foundNode.NodeID, c.RealIP(), err)
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Instance identity verification failed: " + err.Error()})
+	}
+
+	// A node that already failed or was terminated, e.g. after its
+	// provisioning timed out, can't join its deployment anymore
+	if !state.CanTransitionNode(foundNode.Status, state.NodeStatusRegistering) {
+		err := &state.TransitionError{DeploymentID: foundDep.ID, NodeID: foundNode.NodeID, From: string(foundNode.Status), To: string(state.NodeStatusRegistering)}
+		log.Warnf("Rejected registration of node %s from %s: %v", foundNode.NodeID, c.RealIP(), err)
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+
+	// Generate the auth and refresh tokens of this node, and a secret the
+	// agent signs its requests with
+	token, err := newNodeToken()
+	if err != nil {
+		log.Errorf("Failed to create credentials for node %s: %v", foundNode.NodeID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create node credentials"})
+	}
+
+	// Provision tokens are single use, so a replayed token can't take over
+	// the node. An agent whose registration response was lost may retry
+	// shortly after from the same address or its verified instance, and
+	// gets fresh credentials.
+	err = store.RegisterNode(foundDep.ID, foundNode.NodeID, token, c.RealIP())
+	if errors.Is(err, state.ErrAlreadyRegistered) {
+		err = store.RetryRegistration(foundDep.ID, foundNode.NodeID, token, c.RealIP(), instanceVerified)
+		if errors.Is(err, state.ErrAlreadyRegistered) {
+			reportProvisionTokenReuse(foundNode, c.RealIP())
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Provision token already used"})
+		}
+		if err == nil {
+			log.Infof("Node %s registered again from %s, replacing its credentials", foundNode.NodeID, c.RealIP())
+		}
+	}
+	if errors.Is(err, state.ErrProvisionTokenExpired) {
+		log.Warnf("Rejected registration of node %s from %s: provision token expired at %s", foundNode.NodeID, c.RealIP(), foundNode.ClaimDeadline.Format(time.RFC3339))
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Provision token expired"})
+	}
+	if err != nil {
+		log.Errorf("Failed to update auth token for node %s: %v", foundNode.NodeID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update node auth token"})
 	}
 
 	// Update node status to registered
 	err = store.UpdateNodeStatus(foundDep.ID, foundNode.NodeID, state.NodeStatusRegistering)
 	if err != nil {
-		logger.Errorf("Failed to update status for node %s: %v", foundNode.NodeID, err)
+		log.Errorf("Failed to update status for node %s: %v", foundNode.NodeID, err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update node status"})
 	}
 
-	logger.Infof("Successfully registered node %s", foundNode.NodeID)
+	// Record host inventory; older agents don't send it
+	if req.SystemInfo != nil {
+		if err := store.UpdateNodeSystemInfo(foundDep.ID, foundNode.NodeID, req.SystemInfo); err != nil {
+			log.Warnf("Failed to store system info for node %s: %v", foundNode.NodeID, err)
+		}
+	}
+
+	// Remember the bundles cached on the host; older agents don't cache them
+	if req.CachedBundles != nil {
+		log.Debugf("Node %s has %d bundles cached", foundNode.NodeID, len(req.CachedBundles))
+		orch.RecordCachedBundles(foundDep, foundNode, req.CachedBundles)
+	}
+
+	// Hand back URLs on whichever callback address the agent managed to reach
+	callbackURL := callbackURLForRequest(c)
+
+	log.Infof("Successfully registered node %s", foundNode.NodeID)
+	response := map[string]interface{}{
+		"deployment_id":   foundDep.ID,
+		"node_id":         foundNode.NodeID,
+		"message":         "Node registered successfully",
+		"assets_url":      fmt.Sprintf("%s/api/v1/nodes/assets", callbackURL),
+		"heartbeat_url":   fmt.Sprintf("%s/api/v1/nodes/heartbeat", callbackURL),
+		"status_url":      fmt.Sprintf("%s/api/v1/nodes/status", callbackURL),
+		"logs_url":        fmt.Sprintf("%s/api/v1/nodes/logs", callbackURL),
+		"progress_url":    fmt.Sprintf("%s/api/v1/nodes/progress", callbackURL),
+		"token_url":       fmt.Sprintf("%s/api/v1/nodes/token", callbackURL),
+		"artifacts_url":   artifactsURL(callbackURL),
+		"config":          foundNode.Config, // Send node configuration
+		"config_version":  foundNode.ConfigVersion,
+		"config_files":    toStringSlice(foundDep.Config["config_files"]),
+		"remote_dest_dir": foundDep.Config["remote_dest_dir"],
+		"telemetry_hooks": foundDep.Config["telemetry_hooks"],
+		"limits":          foundDep.Config["limits"],
+		"debug":           foundDep.Debug,
+		"bundle_digest":   foundDep.BundleDigest,
+		"script": map[string]interface{}{
+			"name":        foundDep.Config["remote_script_to_run"],
+			"args":        append(toStringSlice(foundDep.Config["remote_script_args"]), toStringSlice(foundNode.Config[metadata.ScriptArgsKey])...),
+			"interpreter": foundDep.Config["remote_script_interpreter"],
+			"command":     toStringSlice(foundNode.Config[metadata.EntryCommandKey]),
+		},
+	}
+	for key, value := range nodeTokenResponse(token) {
+		response[key] = value
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// refreshNodeToken exchanges a node's refresh token for new credentials. The
+// old auth token, refresh token and signing secret stop working, so each
+// refresh token works once, and only until it expires.
+func refreshNodeToken(c echo.Context) error {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	token, err := newNodeToken()
+	if err != nil {
+		logger.Errorf("Failed to create node credentials: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create node credentials"})
+	}
+	node, err := store.RotateNodeToken(req.RefreshToken, token)
+	if errors.Is(err, state.ErrInvalidRefreshToken) {
+		logger.Warnf("Token refresh from %s rejected: %v", c.RealIP(), err)
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid refresh token"})
+	}
+	if err != nil {
+		logger.Errorf("Failed to update auth token: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update node auth token"})
+	}
+
+	logger.Infof("Refreshed auth token of node %s", node.NodeID)
+	return c.JSON(http.StatusOK, nodeTokenResponse(token))
+}
+
+// reconfigRequest is the body of the config update endpoints. Keys set to
+// null are removed.
+type reconfigRequest struct {
+	Config map[string]interface{} `json:"config"`
+}
+
+// reconfigureNode changes the config of a running node
+func reconfigureNode(c echo.Context) error {
+	var req reconfigRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	node, err := store.GetNode(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Node not found"})
+	}
+	dep, err := store.GetDeployment(node.DeploymentID)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+	}
+
+	return reconfigure(c, dep, []*state.Node{node}, req.Config)
+}
+
+// reconfigureDeployment changes the config of every node of a deployment
+// that hasn't finished
+func reconfigureDeployment(c echo.Context) error {
+	var req reconfigRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	dep, err := store.GetDeployment(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+	}
+	nodes, err := store.GetNodesByDeployment(dep.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get nodes"})
+	}
+
+	var active []*state.Node
+	for _, node := range nodes {
+		if orchestrator.Reconfigurable(node) {
+			active = append(active, node)
+		}
+	}
+	if len(active) == 0 {
+		return c.JSON(http.StatusConflict, map[string]string{"error": fmt.Sprintf("Deployment %s has no nodes left to reconfigure", dep.ID)})
+	}
+
+	return reconfigure(c, dep, active, req.Config)
+}
+
+// reconfigure applies config changes to nodes and answers with their new
+// config versions
+func reconfigure(c echo.Context, dep *state.Deployment, nodes []*state.Node, changes map[string]interface{}) error {
+	versions, err := orch.ReconfigureNodes(dep, nodes, changes)
+	if errors.Is(err, orchestrator.ErrNotReconfigurable) {
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+	if err != nil && len(versions) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		logger.Errorf("Failed to reconfigure deployment %s: %v", dep.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{"error": err.Error(), "config_versions": versions})
+	}
+
 	return c.JSON(http.StatusOK, map[string]interface{}{
-		"auth_token":    authToken,
-		"deployment_id": foundDep.ID,
-		"node_id":       foundNode.NodeID,
-		"message":       "Node registered successfully",
-		"assets_url":    fmt.Sprintf("%s/api/v1/nodes/assets", daemonIP),
-		"heartbeat_url": fmt.Sprintf("%s/api/v1/nodes/heartbeat", daemonIP),
-		"status_url":    fmt.Sprintf("%s/api/v1/nodes/status", daemonIP),
-		"logs_url":      fmt.Sprintf("%s/api/v1/nodes/logs", daemonIP),
-		"config":        foundNode.Config, // Send node configuration
+		"deployment_id":   dep.ID,
+		"config_versions": versions,
 	})
 }
 
+// revokeNodeToken invalidates a node's credentials immediately. The agent is
+// rejected on its next request and shuts down; the instance is left running.
+func revokeNodeToken(c echo.Context) error {
+	node, err := store.GetNode(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Node not found"})
+	}
+
+	if err := store.UpdateNodeAuthToken(node.DeploymentID, node.NodeID, state.NodeToken{}); err != nil {
+		logger.Errorf("Failed to revoke auth token of node %s: %v", node.NodeID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke node token"})
+	}
+
+	logger.Warnf("Revoked auth token of node %s", node.NodeID)
+	return c.JSON(http.StatusOK, map[string]string{
+		"node_id": node.NodeID,
+		"status":  "revoked",
+	})
+}
+
+// getNodeAgent serves the agent binary to nodes bootstrapping themselves in
+// egress-only mode. Only nodes that have not registered yet may download it.
+func getNodeAgent(c echo.Context) error {
+	token := c.QueryParam("token")
+	goos := c.QueryParam("os")
+	goarch := c.QueryParam("arch")
+	if goos == "" {
+		goos = "linux"
+	}
+	if goarch == "" {
+		goarch = "amd64"
+	}
+
+	node, dep := findNodeByProvisionToken(token)
+	if node == nil {
+		logger.Warnf("Agent download with invalid provision token: %s", token)
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid provision token"})
+	}
+
+	switch node.Status {
+	case state.NodeStatusPending, state.NodeStatusProvisioning, state.NodeStatusBooting:
+	default:
+		logger.Warnf("Agent download for node %s rejected in status %s", node.NodeID, node.Status)
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Node is not awaiting bootstrap"})
+	}
+
+	agentBinary, err := cloud.GetAgentBinary(goos, goarch)
+	if err != nil {
+		logger.Errorf("Failed to load agent binary for %s/%s: %v", goos, goarch, err)
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Agent binary not available for platform"})
+	}
+
+	logger.Infof("Node %s in deployment %s is downloading the %s/%s agent", node.NodeID, dep.ID, goos, goarch)
+	return c.Blob(http.StatusOK, "application/octet-stream", agentBinary)
+}
+
 func getNodeAssets(c echo.Context) error {
 	authHeader := c.Request().Header.Get("Authorization")
 	logger.Infof("Received asset request with auth header: %s", authHeader)
@@ -514,34 +1655,39 @@ func getNodeAssets(c echo.Context) error {
 		logger.Warnf("Asset request with invalid auth token: %s", authToken)
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid auth token"})
 	}
-	logger.Infof("Asset request validated for node %s in deployment %s", node.NodeID, dep.ID)
+	log := deploymentLog(dep)
+	log.Infof("Asset request validated for node %s in deployment %s", node.NodeID, dep.ID)
 
 	// Validate the auth token matches the node
 	if node.AuthToken != authToken {
-		logger.Errorf("CRITICAL: Auth token mismatch for node %s. This should not happen.", node.NodeID)
+		log.Errorf("CRITICAL: Auth token mismatch for node %s. This should not happen.", node.NodeID)
 		return c.JSON(http.StatusForbidden, map[string]string{"error": "Auth token mismatch"})
 	}
 
 	// Get the deployment to find the bundle path
 	deployment, err := store.GetDeployment(dep.ID)
 	if err != nil {
-		logger.Errorf("Failed to get deployment %s for node %s: %v", dep.ID, node.NodeID, err)
+		log.Errorf("Failed to get deployment %s for node %s: %v", dep.ID, node.NodeID, err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get deployment"})
 	}
 
 	// Check if bundle file exists
 	bundlePath := deployment.BundlePath
 	if _, err := os.Stat(bundlePath); os.IsNotExist(err) {
-		logger.Errorf("Bundle file not found for deployment %s: %s", deployment.ID, bundlePath)
+		log.Errorf("Bundle file not found for deployment %s: %s", deployment.ID, bundlePath)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Bundle file not found"})
 	}
 
 	// Update node status to downloading
 	store.UpdateNodeStatus(deployment.ID, node.NodeID, state.NodeStatusDownloading)
-	logger.Infof("Node %s is downloading assets for deployment %s", node.NodeID, deployment.ID)
+	log.Infof("Node %s is downloading assets for deployment %s", node.NodeID, deployment.ID)
 
-	// Serve the bundle file
-	return c.File(bundlePath)
+	// Serve the bundle file, which the agent caches
+	if err := c.File(bundlePath); err != nil {
+		return err
+	}
+	orch.RecordBundleServed(deployment, node)
+	return nil
 }
 
 func nodeHeartbeat(c echo.Context) error {
@@ -569,57 +1715,142 @@ func nodeHeartbeat(c echo.Context) error {
 		logger.Warnf("Heartbeat with invalid auth token: %s", authToken)
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid auth token"})
 	}
+	log := deploymentLog(dep)
 
 	// Parse heartbeat request body (may include metrics)
 	var req struct {
-		Metrics *state.SystemMetrics `json:"metrics"`
+		Metrics       *state.SystemMetrics `json:"metrics"`
+		HealthChecks  []state.HealthCheck  `json:"health_checks"`
+		ConfigVersion int                  `json:"config_version"`
 	}
-	if err := c.Bind(&req); err == nil && req.Metrics != nil {
+	bindErr := c.Bind(&req)
+	if bindErr == nil && req.Metrics != nil {
 		// Store metrics
 		if err := store.UpdateNodeMetrics(dep.ID, node.NodeID, req.Metrics); err != nil {
-			logger.Errorf("Failed to update metrics for node %s: %v", node.NodeID, err)
+			log.Errorf("Failed to update metrics for node %s: %v", node.NodeID, err)
 		} else {
-			logger.Debugf("Updated metrics for node %s: CPU=%d cores, Load=%.2f, Mem=%dMB/%dMB",
+			log.Debugf("Updated metrics for node %s: CPU=%d cores, Load=%.2f, Mem=%dMB/%dMB",
 				node.NodeID, req.Metrics.CPUCores, req.Metrics.LoadAvg1,
 				req.Metrics.MemoryUsed/1024/1024, req.Metrics.MemoryTotal/1024/1024)
 		}
 	}
 
+	// Store results of the node's telemetry hooks
+	if bindErr == nil && req.HealthChecks != nil {
+		if err := store.UpdateNodeHealthChecks(dep.ID, node.NodeID, req.HealthChecks); err != nil {
+			log.Errorf("Failed to update health checks for node %s: %v", node.NodeID, err)
+		}
+	}
+
 	// Update last seen time
 	err = store.UpdateNodeLastSeen(dep.ID, node.NodeID)
 	if err != nil {
-		logger.Errorf("Failed to update last seen for node %s: %v", node.NodeID, err)
+		log.Errorf("Failed to update last seen for node %s: %v", node.NodeID, err)
 		// Non-critical, so we don't return an error to the agent
 	}
 
-	// Update node status to running if it's not already in a terminal state
-	// Don't overwrite completed/failed/terminated states
-	if node.Status != state.NodeStatusRunning &&
-		node.Status != state.NodeStatusCompleted &&
-		node.Status != state.NodeStatusFailed &&
-		node.Status != state.NodeStatusTerminated {
-		err = store.UpdateNodeStatus(dep.ID, node.NodeID, state.NodeStatusRunning)
-		if err != nil {
-			logger.Errorf("Failed to update status to running for node %s: %v", node.NodeID, err)
-		} else {
-			logger.Infof("Node %s is now running", node.NodeID)
-		}
-	}
+	// Heartbeats only prove liveness. The lifecycle phase is left to explicit
+	// status updates from the agent and to the orchestrator.
 
 	// Return shutdown signal if node should shutdown
-	return c.JSON(http.StatusOK, map[string]interface{}{
+	log.Debugf("Heartbeat from node %s in status %s, shutdown %t", node.NodeID, node.Status, node.ShouldShutdown)
+	response := map[string]interface{}{
 		"status":   "ok",
 		"shutdown": node.ShouldShutdown,
-	})
+	}
+
+	// Hand out config changes the agent hasn't applied yet
+	if bindErr == nil && node.ConfigVersion > req.ConfigVersion {
+		log.Infof("Sending config version %d to node %s, which has version %d", node.ConfigVersion, node.NodeID, req.ConfigVersion)
+		response["config"] = node.Config
+		response["config_version"] = node.ConfigVersion
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+func updateNodeStatus(c echo.Context) error {
+	authHeader := c.Request().Header.Get("Authorization")
+	logger.Debugf("Received status update with auth header: %s", authHeader)
+
+	// Validate auth token
+	if authHeader == "" {
+		logger.Warn("Status update received with no auth token")
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Missing auth token"})
+	}
+
+	// Extract token from "Bearer <token>" format
+	var authToken string
+	if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
+		authToken = authHeader[7:]
+	} else {
+		logger.Warnf("Invalid authorization header format: %s", authHeader)
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid authorization header format"})
+	}
+
+	// Parse status update request
+	var req struct {
+		Status   state.NodeStatus `json:"status"`
+		Message  string           `json:"message"`
+		ExitCode *int             `json:"exit_code"`
+	}
+	if err := c.Bind(&req); err != nil {
+		logger.Errorf("Failed to parse status update request: %v", err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	logger.Infof("Node status update: %s, message: %s", req.Status, req.Message)
+	if !state.ValidNodeStatus(req.Status) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Unknown node status %q", req.Status)})
+	}
+
+	// Find node by auth token
+	node, dep, err := store.FindNodeByAuthToken(authToken)
+	if err != nil {
+		logger.Warnf("Status update with invalid auth token: %s", authToken)
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid auth token"})
+	}
+	log := deploymentLog(dep)
+	if req.ExitCode != nil {
+		log.Debugf("Node %s reports %s with exit code %d (was %s): %s", node.NodeID, req.Status, *req.ExitCode, node.Status, req.Message)
+	} else {
+		log.Debugf("Node %s reports %s (was %s): %s", node.NodeID, req.Status, node.Status, req.Message)
+	}
+
+	// Update node status, recording the message with the phase change
+	var message []string
+	if req.Message != "" {
+		message = append(message, req.Message)
+	}
+	err = store.UpdateNodeStatus(dep.ID, node.NodeID, req.Status, message...)
+	if errors.Is(err, state.ErrInvalidTransition) {
+		log.Warnf("Rejected status update of node %s: %v", node.NodeID, err)
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		log.Errorf("Failed to update status for node %s: %v", node.NodeID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update node status"})
+	}
+
+	if req.ExitCode != nil {
+		if err := store.UpdateNodeExitCode(dep.ID, node.NodeID, *req.ExitCode); err != nil {
+			log.Errorf("Failed to update exit code for node %s: %v", node.NodeID, err)
+		}
+	}
+
+	// Snapshot the summary report if this was the last node to finish
+	orch.RecordCompletionReport(dep.ID)
+
+	log.Infof("Successfully updated status for node %s to %s", node.NodeID, req.Status)
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
 }
 
-func updateNodeStatus(c echo.Context) error {
+// updateNodeProgress records the completion percentage a node's workload
+// reported through the agent
+func updateNodeProgress(c echo.Context) error {
 	authHeader := c.Request().Header.Get("Authorization")
-	logger.Debugf("Received status update with auth header: %s", authHeader)
 
 	// Validate auth token
 	if authHeader == "" {
-		logger.Warn("Status update received with no auth token")
+		logger.Warn("Progress update received with no auth token")
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Missing auth token"})
 	}
 
@@ -628,136 +1859,295 @@ func updateNodeStatus(c echo.Context) error {
 	if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
 		authToken = authHeader[7:]
 	} else {
-		logger.Warnf("Invalid authorization header format: %s", authHeader)
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid authorization header format"})
 	}
 
-	// Parse status update request
-	var req struct {
-		Status  state.NodeStatus `json:"status"`
-		Message string           `json:"message"`
-	}
-	if err := c.Bind(&req); err != nil {
-		logger.Errorf("Failed to parse status update request: %v", err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
-	}
-	logger.Infof("Node status update: %s, message: %s", req.Status, req.Message)
-
 	// Find node by auth token
 	node, dep, err := store.FindNodeByAuthToken(authToken)
 	if err != nil {
-		logger.Warnf("Status update with invalid auth token: %s", authToken)
+		logger.Warnf("Progress update with invalid auth token: %s", authToken)
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid auth token"})
 	}
+	log := deploymentLog(dep)
 
-	// Update node status
-	err = store.UpdateNodeStatus(dep.ID, node.NodeID, req.Status)
-	if err != nil {
-		logger.Errorf("Failed to update status for node %s: %v", node.NodeID, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update node status"})
+	var req struct {
+		Progress *float64 `json:"progress" form:"progress"`
+		Message  string   `json:"message" form:"message"`
+	}
+	if err := c.Bind(&req); err != nil || req.Progress == nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request, progress is required"})
+	}
+	if *req.Progress < 0 || *req.Progress > 100 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Progress must be between 0 and 100"})
 	}
 
-	// If there's a message, update that as well
-	if req.Message != "" {
-		err = store.UpdateNodeMessage(dep.ID, node.NodeID, req.Message)
-		if err != nil {
-			logger.Errorf("Failed to update message for node %s: %v", node.NodeID, err)
-			// Non-critical, so we don't return an error
-		}
+	if err := store.UpdateNodeProgress(dep.ID, node.NodeID, *req.Progress, req.Message); err != nil {
+		log.Errorf("Failed to update progress for node %s: %v", node.NodeID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update progress"})
 	}
 
-	logger.Infof("Successfully updated status for node %s to %s", node.NodeID, req.Status)
+	log.Debugf("Node %s reported %.1f%% progress: %s", node.NodeID, *req.Progress, req.Message)
 	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
 }
 
-func getStats(c echo.Context) error {
-	stats := store.GetStats()
-	stats["uptime"] = time.Since(startTime).String()
-	return c.JSON(http.StatusOK, stats)
-}
+// maxSearchLogs caps the log lines one search returns
+const maxSearchLogs = 1000
 
-func getMetrics(c echo.Context) error {
-	deployments := store.GetAllDeployments()
+// search matches a query against deployments, their labels, nodes and recent
+// log lines. Matching is a case-insensitive substring search; labels match as
+// key=value.
+func search(c echo.Context) error {
+	query := strings.TrimSpace(c.QueryParam("q"))
+	if query == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Missing search query"})
+	}
+	needle := strings.ToLower(query)
 
-	var totalCores int
-	var totalMemory, totalMemoryUsed uint64
-	var avgLoad float64
-	nodeCount := 0
+	logLimit := 50
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid 'limit' parameter, must be a positive integer"})
+		}
+		logLimit = min(limit, maxSearchLogs)
+	}
 
-	type NodeMetrics struct {
-		NodeID     string               `json:"node_id"`
-		IPAddress  string               `json:"ip_address"`
-		Status     state.NodeStatus     `json:"status"`
-		Metrics    *state.SystemMetrics `json:"metrics"`
-		LastUpdate string               `json:"last_update"`
+	type match struct {
+		DeploymentID string `json:"deployment_id"`
+		NodeID       string `json:"node_id,omitempty"`
+		Status       string `json:"status"`
+		Field        string `json:"field"`
+		Value        string `json:"value"`
 	}
 
-	// Use a map to deduplicate nodes by IP address (keep track of time.Time for comparison)
-	type nodeEntry struct {
-		metrics    NodeMetrics
-		lastUpdate time.Time
+	// firstMatch returns the name and value of the first field containing the query
+	firstMatch := func(fields [][2]string) (string, string, bool) {
+		for _, field := range fields {
+			if field[1] != "" && strings.Contains(strings.ToLower(field[1]), needle) {
+				return field[0], field[1], true
+			}
+		}
+		return "", "", false
 	}
-	nodesByIP := make(map[string]nodeEntry)
+
+	deploymentMatches := []match{}
+	nodeMatches := []match{}
+	logMatches := []state.LogEntry{}
+
+	deployments := store.GetAllDeployments()
+	sort.Slice(deployments, func(i, j int) bool {
+		return deployments[i].CreatedAt.After(deployments[j].CreatedAt)
+	})
 
 	for _, dep := range deployments {
+		bundleName, _ := dep.Config["bundle_name"].(string)
+		fields := [][2]string{
+			{"deployment_id", dep.ID},
+			{"bundle_name", bundleName},
+			{"error_message", dep.ErrorMessage},
+		}
+		labels := report.Labels(dep)
+		keys := make([]string, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fields = append(fields, [2]string{"label", key + "=" + labels[key]})
+		}
+		if field, value, ok := firstMatch(fields); ok {
+			deploymentMatches = append(deploymentMatches, match{
+				DeploymentID: dep.ID,
+				Status:       string(dep.Status),
+				Field:        field,
+				Value:        value,
+			})
+		}
+
 		nodes, _ := store.GetNodesByDeployment(dep.ID)
 		for _, node := range nodes {
-			// Skip nodes without IP addresses
-			if node.IPAddress == "" {
-				continue
+			fields := [][2]string{
+				{"node_id", node.NodeID},
+				{"instance_id", node.InstanceID},
+				{"ip_address", node.IPAddress},
+				{"private_ip_address", node.PrivateIPAddress},
+				{"ipv6_address", node.IPv6Address},
+			}
+			if node.SystemInfo != nil {
+				fields = append(fields, [2]string{"hostname", node.SystemInfo.Hostname})
 			}
+			if field, value, ok := firstMatch(fields); ok {
+				nodeMatches = append(nodeMatches, match{
+					DeploymentID: dep.ID,
+					NodeID:       node.NodeID,
+					Status:       string(node.Status),
+					Field:        field,
+					Value:        value,
+				})
+			}
+		}
 
-			// Check if we already have this IP, keep the one with the most recent update
-			existing, exists := nodesByIP[node.IPAddress]
-			if !exists || node.LastUpdate.After(existing.lastUpdate) {
-				nodesByIP[node.IPAddress] = nodeEntry{
-					metrics: NodeMetrics{
-						NodeID:     node.NodeID,
-						IPAddress:  node.IPAddress,
-						Status:     node.Status,
-						Metrics:    node.Metrics,
-						LastUpdate: node.LastUpdate.Format(time.RFC3339),
-					},
-					lastUpdate: node.LastUpdate,
-				}
+		// Scan logs newest first until the limit is reached
+		if len(logMatches) >= logLimit {
+			continue
+		}
+		logs, _ := store.GetLogs(dep.ID, "", time.Time{}, 0)
+		for i := len(logs) - 1; i >= 0 && len(logMatches) < logLimit; i-- {
+			if strings.Contains(strings.ToLower(logs[i].Message), needle) {
+				logMatches = append(logMatches, logs[i])
 			}
 		}
 	}
 
-	// Convert map to slice and calculate totals
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"query":       query,
+		"deployments": deploymentMatches,
+		"nodes":       nodeMatches,
+		"logs":        logMatches,
+	})
+}
+
+func getStats(c echo.Context) error {
+	stats := store.GetStats()
+	stats["uptime"] = time.Since(startTime).String()
+	stats["memory"] = store.MemoryUsage()
+	stats["heap_bytes"] = heapBytes()
+	stats["rejected_log_pushes"] = rejectedLogPushes.Load()
+	return c.JSON(http.StatusOK, stats)
+}
+
+func getMetrics(c echo.Context) error {
+	deployments := store.GetAllDeployments()
+	sort.Slice(deployments, func(i, j int) bool { return deployments[i].ID < deployments[j].ID })
+
+	type NodeMetrics struct {
+		NodeID           string               `json:"node_id"`
+		DeploymentID     string               `json:"deployment_id"`
+		IPAddress        string               `json:"ip_address"`
+		PrivateIPAddress string               `json:"private_ip_address,omitempty"`
+		Status           state.NodeStatus     `json:"status"`
+		Metrics          *state.SystemMetrics `json:"metrics"`
+		NoData           bool                 `json:"no_data"`
+		HealthChecks     []state.HealthCheck  `json:"health_checks,omitempty"`
+		Progress         *state.NodeProgress  `json:"progress,omitempty"`
+		LastUpdate       string               `json:"last_update"`
+	}
+
+	// Every node is listed by its own ID; nodes behind NAT or on the same
+	// local host share an IP but are still distinct nodes
+	fleet := &metricsTotals{}
+	var subtotals []map[string]interface{}
 	allNodes := []NodeMetrics{}
-	for _, entry := range nodesByIP {
-		if entry.metrics.Metrics != nil {
-			totalCores += entry.metrics.Metrics.CPUCores
-			totalMemory += entry.metrics.Metrics.MemoryTotal
-			totalMemoryUsed += entry.metrics.Metrics.MemoryUsed
-			avgLoad += entry.metrics.Metrics.LoadAvg1
-			nodeCount++
+	for _, dep := range deployments {
+		nodes, _ := store.GetNodesByDeployment(dep.ID)
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].NodeIndex < nodes[j].NodeIndex })
+
+		totals := &metricsTotals{}
+		for _, node := range nodes {
+			totals.add(node.Metrics)
+			fleet.add(node.Metrics)
+			allNodes = append(allNodes, NodeMetrics{
+				NodeID:           node.NodeID,
+				DeploymentID:     dep.ID,
+				IPAddress:        node.IPAddress,
+				PrivateIPAddress: node.PrivateIPAddress,
+				Status:           node.Status,
+				Metrics:          node.Metrics,
+				NoData:           node.Metrics == nil,
+				HealthChecks:     node.HealthChecks,
+				Progress:         node.Progress,
+				LastUpdate:       node.LastUpdate.Format(time.RFC3339),
+			})
+		}
+		if len(nodes) > 0 {
+			subtotal := totals.summary()
+			subtotal["deployment_id"] = dep.ID
+			subtotals = append(subtotals, subtotal)
 		}
-		allNodes = append(allNodes, entry.metrics)
 	}
 
-	// Sort nodes by IP address for deterministic ordering
-	sort.Slice(allNodes, func(i, j int) bool {
-		return allNodes[i].IPAddress < allNodes[j].IPAddress
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"summary":     fleet.summary(),
+		"deployments": subtotals,
+		"nodes":       allNodes,
 	})
+}
+
+// metricsTotals sums the latest metrics of a set of nodes
+type metricsTotals struct {
+	nodes, withMetrics int
+	cores              int
+	memory, memoryUsed uint64
+	load, busyCores    float64
+}
+
+func (t *metricsTotals) add(metrics *state.SystemMetrics) {
+	t.nodes++
+	if metrics == nil {
+		return
+	}
+	t.withMetrics++
+	t.cores += metrics.CPUCores
+	t.memory += metrics.MemoryTotal
+	t.memoryUsed += metrics.MemoryUsed
+	t.load += metrics.LoadAvg1
+	t.busyCores += metrics.CPUUsage / 100 * float64(metrics.CPUCores)
+}
 
-	if nodeCount > 0 {
-		avgLoad /= float64(nodeCount)
+// summary returns the totals as reported by the metrics endpoint. Averages
+// only cover nodes that reported metrics.
+func (t *metricsTotals) summary() map[string]interface{} {
+	avgLoad := 0.0
+	if t.withMetrics > 0 {
+		avgLoad = t.load / float64(t.withMetrics)
 	}
 
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"summary": map[string]interface{}{
-			"total_cores":          totalCores,
-			"total_memory_gb":      float64(totalMemory) / 1024 / 1024 / 1024,
-			"total_memory_used_gb": float64(totalMemoryUsed) / 1024 / 1024 / 1024,
-			"avg_load":             avgLoad,
-			"nodes_with_metrics":   nodeCount,
-		},
-		"nodes": allNodes,
+	// CPU usage weighted by each node's core count
+	avgCPUUsage := 0.0
+	if t.cores > 0 {
+		avgCPUUsage = t.busyCores / float64(t.cores) * 100
+	}
+
+	return map[string]interface{}{
+		"total_cores":           t.cores,
+		"total_memory_gb":       float64(t.memory) / 1024 / 1024 / 1024,
+		"total_memory_used_gb":  float64(t.memoryUsed) / 1024 / 1024 / 1024,
+		"avg_load":              avgLoad,
+		"avg_cpu_usage":         avgCPUUsage,
+		"nodes":                 t.nodes,
+		"nodes_with_metrics":    t.withMetrics,
+		"nodes_without_metrics": t.nodes - t.withMetrics,
+	}
+}
+
+// getPrometheusMetrics exposes deployment, node and fleet metrics in the
+// Prometheus text format
+func getPrometheusMetrics(c echo.Context) error {
+	deployments, nodes := allDeploymentNodes()
+	finishes.Observe(deployments, nodes)
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+	if err := export.WritePrometheus(c.Response(), deployments, nodes, finishes); err != nil {
+		return err
+	}
+	return export.WriteMemoryMetrics(c.Response(), export.DaemonMemory{
+		Usage:             store.MemoryUsage(),
+		HeapBytes:         heapBytes(),
+		RejectedLogPushes: rejectedLogPushes.Load(),
 	})
 }
 
+// allDeploymentNodes returns all deployments and their nodes by deployment ID
+func allDeploymentNodes() ([]*state.Deployment, map[string][]*state.Node) {
+	deployments := store.GetAllDeployments()
+	nodes := make(map[string][]*state.Node, len(deployments))
+	for _, dep := range deployments {
+		nodes[dep.ID], _ = store.GetNodesByDeployment(dep.ID)
+	}
+	return deployments, nodes
+}
+
 func cleanupDeployment(c echo.Context) error {
 	id := c.Param("id")
 	logger.Infof("Cleaning up deployment: %s", id)
@@ -779,8 +2169,15 @@ func cleanupDeployment(c echo.Context) error {
 		})
 	}
 
-	// Cleanup deployment files
-	if err := orch.CleanupDeployment(id); err != nil {
+	// Terminate the instances, then remove files and state
+	err = orch.CleanupDeployment(id)
+	if errors.Is(err, orchestrator.ErrTerminationUnconfirmed) {
+		logger.Warnf("Keeping deployment %s: %v", id, err)
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": fmt.Sprintf("Deployment kept because %v. Check the instances with your cloud provider and retry.", err),
+		})
+	}
+	if err != nil {
 		logger.Errorf("Failed to cleanup deployment %s: %v", id, err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": "Failed to cleanup deployment",
@@ -837,13 +2234,14 @@ func pushNodeLogs(c echo.Context) error {
 		logger.Warnf("Log push with invalid auth token: %s", authToken)
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid auth token"})
 	}
+	log := deploymentLog(dep)
 
 	// Parse log entries
 	var req struct {
 		Logs []state.LogEntry `json:"logs"`
 	}
 	if err := c.Bind(&req); err != nil {
-		logger.Errorf("Failed to parse log push request: %v", err)
+		log.Errorf("Failed to parse log push request: %v", err)
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
 
@@ -854,12 +2252,17 @@ func pushNodeLogs(c echo.Context) error {
 	}
 
 	// Store logs
-	if err := store.AppendLogs(dep.ID, req.Logs); err != nil {
-		logger.Errorf("Failed to store logs for node %s: %v", node.NodeID, err)
+	err = store.AppendLogs(dep.ID, req.Logs)
+	if errors.Is(err, state.ErrLogBufferFull) {
+		return rejectLogPush(c, node.NodeID, err)
+	}
+	if err != nil {
+		log.Errorf("Failed to store logs for node %s: %v", node.NodeID, err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store logs"})
 	}
+	acceptedLogPush()
 
-	logger.Debugf("Received %d log entries from node %s", len(req.Logs), node.NodeID)
+	log.Debugf("Received %d log entries from node %s", len(req.Logs), node.NodeID)
 	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
 }
 
@@ -899,6 +2302,356 @@ func getDeploymentLogs(c echo.Context) error {
 	})
 }
 
+// getDeploymentEvents returns the timeline of a deployment and its nodes in
+// chronological order, optionally only the events after since
+func getDeploymentEvents(c echo.Context) error {
+	id := c.Param("id")
+
+	var since time.Time
+	if sinceStr := c.QueryParam("since"); sinceStr != "" {
+		parsed, err := time.Parse(time.RFC3339, sinceStr)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid 'since' parameter, must be RFC3339 format"})
+		}
+		since = parsed
+	}
+
+	deployment, err := store.GetDeployment(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+	}
+	nodes, err := store.GetNodesByDeployment(id)
+	if err != nil {
+		logger.Errorf("Failed to get nodes for deployment %s: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get deployment nodes"})
+	}
+
+	events := []report.Event{}
+	for _, event := range report.Timeline(deployment, nodes) {
+		if event.Time.After(since) {
+			events = append(events, event)
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"deployment_id": id,
+		"status":        deployment.Status,
+		"events":        events,
+		"count":         len(events),
+	})
+}
+
+// getBundleManifest lists the files of the bundle a deployment's nodes
+// download, with their sizes and digests
+func getBundleManifest(c echo.Context) error {
+	id := c.Param("id")
+
+	deployment, err := store.GetDeployment(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+	}
+	if deployment.BundlePath == "" {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Deployment has no bundle"})
+	}
+
+	manifest, err := bundle.Inspect(deployment.BundlePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Bundle is no longer stored, the deployment was cleaned up"})
+	}
+	if err != nil {
+		logger.Errorf("Failed to inspect bundle of deployment %s: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to inspect bundle"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"deployment_id": id,
+		"sha256":        manifest.SHA256,
+		"size":          manifest.Size,
+		"files":         manifest.Files,
+		"count":         len(manifest.Files),
+	})
+}
+
+// getDeploymentArchive exports a deployment's configuration, application
+// files and metadata as a bundle that another daemon can deploy again
+func getDeploymentArchive(c echo.Context) error {
+	id := c.Param("id")
+	if _, err := store.GetDeployment(id); err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+	}
+
+	archive, err := os.CreateTemp("", "taskfly-archive-*.tar.gz")
+	if err != nil {
+		logger.Errorf("Failed to create archive file: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to export deployment"})
+	}
+	archive.Close()
+	defer os.Remove(archive.Name())
+
+	_, err = orch.ExportDeployment(id, archive.Name())
+	if errors.Is(err, orchestrator.ErrArchiveUnavailable) {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": "Deployment files are no longer stored, it was cleaned up or created before exports were supported",
+		})
+	}
+	if err != nil {
+		logger.Errorf("Failed to export deployment %s: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to export deployment"})
+	}
+
+	logger.Infof("Exported deployment %s", id)
+	return c.Attachment(archive.Name(), id+".taskfly.tar.gz")
+}
+
+// getDeploymentReport returns the completion summary of a deployment as JSON,
+// Markdown or HTML. Deployments that are still running get a live report.
+func getDeploymentReport(c echo.Context) error {
+	id := c.Param("id")
+	format := c.QueryParam("format")
+	if format == "" {
+		format = report.FormatJSON
+	}
+
+	deployment, err := store.GetDeployment(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+	}
+
+	summary := deployment.Report
+	if summary == nil {
+		nodes, err := store.GetNodesByDeployment(id)
+		if err != nil {
+			logger.Errorf("Failed to get nodes for deployment %s: %v", id, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get deployment nodes"})
+		}
+		summary = report.Build(deployment, nodes, daemonIP, time.Now())
+	}
+
+	switch format {
+	case report.FormatJSON:
+		return c.JSON(http.StatusOK, summary)
+	case report.FormatMarkdown:
+		return c.Blob(http.StatusOK, "text/markdown; charset=utf-8", []byte(report.Markdown(summary)))
+	case report.FormatHTML:
+		page, err := report.HTML(summary)
+		if err != nil {
+			logger.Errorf("Failed to render report for deployment %s: %v", id, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to render report"})
+		}
+		return c.HTML(http.StatusOK, page)
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid format, must be json, markdown or html"})
+	}
+}
+
+// getDeploymentMetrics returns the retained metrics samples of a deployment,
+// optionally limited to one node and to samples taken after since
+func getDeploymentMetrics(c echo.Context) error {
+	id := c.Param("id")
+
+	var since time.Time
+	if sinceStr := c.QueryParam("since"); sinceStr != "" {
+		parsed, err := time.Parse(time.RFC3339, sinceStr)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid 'since' parameter, must be RFC3339 format"})
+		}
+		since = parsed
+	}
+
+	samples, err := store.GetMetricsHistory(id, c.QueryParam("node"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+	}
+
+	filtered := make([]state.MetricsSample, 0, len(samples))
+	for _, sample := range samples {
+		if sample.Timestamp.After(since) {
+			filtered = append(filtered, sample)
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"deployment_id": id,
+		"samples":       filtered,
+		"count":         len(filtered),
+	})
+}
+
+// exportDeployment streams node metrics samples or per-node results as a CSV
+// or Parquet table
+func exportDeployment(c echo.Context) error {
+	id := c.Param("id")
+	what := c.QueryParam("what")
+	format := c.QueryParam("format")
+	if format == "" {
+		format = export.FormatCSV
+	}
+
+	var contentType string
+	switch format {
+	case export.FormatCSV:
+		contentType = "text/csv; charset=utf-8"
+	case export.FormatParquet:
+		contentType = "application/vnd.apache.parquet"
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid format, must be csv or parquet"})
+	}
+
+	deployment, err := store.GetDeployment(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+	}
+
+	var buf bytes.Buffer
+	switch what {
+	case "metrics":
+		samples, err := store.GetMetricsHistory(id, c.QueryParam("node"))
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Deployment not found"})
+		}
+		err = export.Metrics(&buf, format, samples)
+	case "results":
+		summary := deployment.Report
+		if summary == nil {
+			nodes, err := store.GetNodesByDeployment(id)
+			if err != nil {
+				logger.Errorf("Failed to get nodes for deployment %s: %v", id, err)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get deployment nodes"})
+			}
+			summary = report.Build(deployment, nodes, daemonIP, time.Now())
+		}
+		err = export.Results(&buf, format, summary)
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid export, must be metrics or results"})
+	}
+	if err != nil {
+		logger.Errorf("Failed to export %s for deployment %s: %v", what, id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to export " + what})
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition,
+		fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%s_%s.%s", id, what, format)))
+	return c.Blob(http.StatusOK, contentType, buf.Bytes())
+}
+
+// getRecommendations suggests instance types from the completion reports of
+// past deployments on a provider, optionally limited to one instance type and
+// namespace
+func getRecommendations(c echo.Context) error {
+	provider := c.QueryParam("provider")
+	if provider == "" {
+		provider = "aws"
+	}
+	instanceType := c.QueryParam("instance_type")
+	namespace := c.QueryParam("namespace")
+
+	deploymentCount := 0
+	var nodes []state.NodeReport
+	for _, deployment := range store.GetAllDeployments() {
+		if deployment.Report == nil || deployment.CloudProvider != provider {
+			continue
+		}
+		if namespace != "" && deployment.Namespace != namespace {
+			continue
+		}
+
+		matched := false
+		for _, node := range deployment.Report.Nodes {
+			if instanceType != "" && node.InstanceType != instanceType {
+				continue
+			}
+			nodes = append(nodes, node)
+			matched = true
+		}
+		if matched {
+			deploymentCount++
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"recommendations": report.Recommend(provider, nodes),
+		"deployments":     deploymentCount,
+		"nodes":           len(nodes),
+	})
+}
+
+// findNodeByProvisionToken looks up a node and its deployment by provision token
+// For now, we'll search through all nodes - in production this would be indexed
+func findNodeByProvisionToken(token string) (*state.Node, *state.Deployment) {
+	if token == "" {
+		return nil, nil
+	}
+
+	for _, dep := range store.GetAllDeployments() {
+		nodes, _ := store.GetNodesByDeployment(dep.ID)
+		for _, node := range nodes {
+			if node.ProvisionToken == token {
+				return node, dep
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// deploymentLog returns the daemon's log entry for a deployment, which logs
+// debug messages for deployments with debug: true
+func deploymentLog(dep *state.Deployment) *logrus.Entry {
+	return orchestrator.DeploymentLog(logger, dep.ID, dep.Debug)
+}
+
+// findNodeByRefreshToken finds a registered node by its refresh token
+func findNodeByRefreshToken(token string) (*state.Node, *state.Deployment) {
+	if token == "" {
+		return nil, nil
+	}
+
+	for _, dep := range store.GetAllDeployments() {
+		nodes, _ := store.GetNodesByDeployment(dep.ID)
+		for _, node := range nodes {
+			if node.RefreshToken == token {
+				return node, dep
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// toStringSlice converts a stored list (a []string in memory, a []interface{}
+// once reloaded from disk) to strings
+func toStringSlice(value interface{}) []string {
+	switch v := value.(type) {
+	case []string:
+		return append([]string(nil), v...)
+	case []interface{}:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			result = append(result, fmt.Sprintf("%v", item))
+		}
+		return result
+	default:
+		return nil
+	}
+}
+
+// buildDaemonURL formats a callback URL, bracketing IPv6 literals as needed
+func buildDaemonURL(host, port string) string {
+	return fmt.Sprintf("http://%s", net.JoinHostPort(host, port))
+}
+
+// callbackURLForRequest returns the internal callback URL when the request arrived on the
+// internal address, and the public daemon URL otherwise
+func callbackURLForRequest(c echo.Context) string {
+	if daemonInternalURL == "" {
+		return daemonIP
+	}
+	if internal, err := url.Parse(daemonInternalURL); err == nil && internal.Host == c.Request().Host {
+		return daemonInternalURL
+	}
+	return daemonIP
+}
+
 // getDefaultDeploymentDir returns ~/.taskfly/deployments
 func getDefaultDeploymentDir() string {
 	homeDir, err := os.UserHomeDir()
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+// setupTestDaemon gives the handlers an empty in-memory store and a silent
+// logger
+func setupTestDaemon(t *testing.T) {
+	t.Helper()
+	logger = logrus.New()
+	logger.SetOutput(io.Discard)
+	store = state.NewStore()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/orchestrator"
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/JustinTimperio/TaskFly/internal/units"
+	"github.com/labstack/echo/v4"
+	"github.com/urfave/cli/v2"
+)
+
+// logPushRetryAfter is how long agents are asked to hold their logs when the
+// log buffers are full
+const logPushRetryAfter = 30 * time.Second
+
+// logBufferWarnRatio is the share of the total log buffer limit at which the
+// daemon starts warning
+const logBufferWarnRatio = 0.8
+
+var (
+	// rejectedLogPushes counts log pushes answered with 429
+	rejectedLogPushes atomic.Int64
+
+	// logBuffersFull is set while log pushes are rejected, so the daemon
+	// warns once per episode instead of once per push
+	logBuffersFull atomic.Bool
+
+	// logBuffersHigh is set while the log buffers are above the warning ratio
+	logBuffersHigh bool
+)
+
+// parseLogLimits reads --log-buffer-size and --deployment-log-buffer-size.
+// "0" disables a limit.
+func parseLogLimits(c *cli.Context) (state.LogLimits, error) {
+	var limits state.LogLimits
+	for _, limit := range []struct {
+		flag  string
+		value *int64
+	}{
+		{"log-buffer-size", &limits.Total},
+		{"deployment-log-buffer-size", &limits.PerDeployment},
+	} {
+		size := c.String(limit.flag)
+		if size == "0" {
+			continue
+		}
+		parsed, err := orchestrator.ParseSize(size)
+		if err != nil {
+			return limits, fmt.Errorf("invalid --%s: %w", limit.flag, err)
+		}
+		*limit.value = parsed
+	}
+	return limits, nil
+}
+
+// rejectLogPush asks an agent to retry a log push the log buffers have no
+// room for. The agent keeps the lines until then.
+func rejectLogPush(c echo.Context, nodeID string, err error) error {
+	rejectedLogPushes.Add(1)
+	if logBuffersFull.CompareAndSwap(false, true) {
+		logger.Warnf("Log buffers are full, asking agents to retry log pushes in %s (first from node %s): %v", logPushRetryAfter, nodeID, err)
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(logPushRetryAfter.Seconds())))
+	return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "Log buffers are full, retry later"})
+}
+
+// acceptedLogPush notes that log pushes are accepted again after rejections
+func acceptedLogPush() {
+	if logBuffersFull.CompareAndSwap(true, false) {
+		logger.Infof("Log buffers accept pushes again, %d rejected so far", rejectedLogPushes.Load())
+	}
+}
+
+// checkMemory warns when the log buffers come close to their total limit,
+// naming the deployments holding the most
+func checkMemory() {
+	usage := store.MemoryUsage()
+	limit := usage.LogLimits.Total
+	if limit <= 0 {
+		return
+	}
+
+	high := float64(usage.LogBytes) >= logBufferWarnRatio*float64(limit)
+	switch {
+	case high && !logBuffersHigh:
+		var largest []string
+		for _, id := range usage.TopDeployments(3) {
+			largest = append(largest, fmt.Sprintf("%s (%s)", id, units.FormatSize(usage.ByDeployment[id].LogBytes)))
+		}
+		logger.Warnf("Log buffers hold %s of %s (heap %s), log pushes are rejected once full. Largest: %s. Clean up finished deployments or raise --log-buffer-size.",
+			units.FormatSize(usage.LogBytes), units.FormatSize(limit), units.FormatSize(int64(heapBytes())), strings.Join(largest, ", "))
+	case !high && logBuffersHigh:
+		logger.Infof("Log buffers are back to %s of %s", units.FormatSize(usage.LogBytes), units.FormatSize(limit))
+	}
+	logBuffersHigh = high
+}
+
+// heapBytes returns the bytes of allocated heap objects
+func heapBytes() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// register posts a registration with the provision token from remoteAddr
+func register(t *testing.T, e *echo.Echo, remoteAddr string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/nodes/register", strings.NewReader(`{"provision_token": "prov-0"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.RemoteAddr = remoteAddr + ":40000"
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	return rec.Code, body
+}
+
+func TestRegisterNodeRetry(t *testing.T) {
+	setupTestDaemon(t)
+	require.NoError(t, store.CreateDeployment(&state.Deployment{ID: "dep_1", Status: state.StatusProvisioning, TotalNodes: 1, Config: map[string]interface{}{}}))
+	require.NoError(t, store.CreateNode(&state.Node{NodeID: "node_0", DeploymentID: "dep_1", Status: state.NodeStatusBooting, ProvisionToken: "prov-0"}))
+
+	e := echo.New()
+	e.POST("/api/v1/nodes/register", registerNode)
+
+	code, first := register(t, e, "10.0.0.5")
+	require.Equal(t, http.StatusOK, code)
+
+	// The response was lost, so the agent registers again and gets fresh
+	// credentials
+	code, retried := register(t, e, "10.0.0.5")
+	require.Equal(t, http.StatusOK, code)
+	assert.NotEqual(t, first["auth_token"], retried["auth_token"])
+	node, err := store.GetNode("node_0")
+	require.NoError(t, err)
+	assert.Equal(t, retried["auth_token"], node.AuthToken)
+	assert.Equal(t, "10.0.0.5", node.RegisteredFrom)
+
+	// Other addresses can't reuse the token
+	code, _ = register(t, e, "10.0.0.6")
+	assert.Equal(t, http.StatusConflict, code)
+
+	// Nor can the same address once the node used its credentials
+	require.NoError(t, store.UpdateNodeLastSeen("dep_1", "node_0"))
+	code, _ = register(t, e, "10.0.0.5")
+	assert.Equal(t, http.StatusConflict, code)
+	node, err = store.GetNode("node_0")
+	require.NoError(t, err)
+	assert.Equal(t, retried["auth_token"], node.AuthToken)
+}
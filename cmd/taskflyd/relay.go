@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/relay"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// relayTimeout bounds a request relayed to a satellite, including the
+	// satellite processing an uploaded bundle
+	relayTimeout = 2 * time.Minute
+
+	// maxRelayBody limits the request and response bodies relayed through
+	// the central daemon, which are held in memory
+	maxRelayBody = 64 << 20
+
+	// relayWorkers is how many requests a satellite relays at once
+	relayWorkers = 4
+)
+
+var (
+	// relayHub holds the satellites polling this daemon. It is nil unless a
+	// relay secret is configured.
+	relayHub *relay.Hub
+
+	// relaySecrets are the satellites allowed to relay through this daemon
+	// and their secrets
+	relaySecrets *relay.Secrets
+)
+
+// hopHeaders are not passed on to or back from a satellite
+var hopHeaders = []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade", "Content-Length", relay.SecretHeader}
+
+// relaySatellite authenticates a satellite's relay call and returns its name,
+// the name its secret was issued for
+func relaySatellite(c echo.Context) (string, error) {
+	if relayHub == nil {
+		return "", c.JSON(http.StatusNotFound, map[string]string{"error": "Satellite relay is not enabled"})
+	}
+	name, ok := relaySecrets.Lookup(c.Request().Header.Get(relay.SecretHeader))
+	if !ok {
+		logger.Warnf("Rejected relay request from %s: invalid relay secret", c.RealIP())
+		return "", c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid relay secret"})
+	}
+	return name, nil
+}
+
+// relayPoll hands a satellite the next request relayed to it, or answers 204
+// when none arrives while the poll is held open
+func relayPoll(c echo.Context) error {
+	name, err := relaySatellite(c)
+	if name == "" {
+		return err
+	}
+
+	req := relayHub.Poll(c.Request().Context(), name, c.RealIP(), relay.PollWait)
+	if req == nil {
+		return c.NoContent(http.StatusNoContent)
+	}
+	return c.JSON(http.StatusOK, req)
+}
+
+// relayRespond takes a satellite's response to a relayed request
+func relayRespond(c echo.Context) error {
+	name, err := relaySatellite(c)
+	if name == "" {
+		return err
+	}
+
+	var resp relay.Response
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, 2*maxRelayBody)
+	if err := c.Bind(&resp); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid relay response"})
+	}
+	if err := relayHub.Respond(name, &resp); err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// listSatellites lists the satellites registered with this daemon
+func listSatellites(c echo.Context) error {
+	if relayHub == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Satellite relay is not enabled"})
+	}
+	satellites := relayHub.Satellites()
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"satellites": satellites,
+		"count":      len(satellites),
+	})
+}
+
+// proxySatellite relays an API request to a satellite, e.g.
+// /api/v1/satellites/lab/api/v1/deployments to /api/v1/deployments on the
+// satellite named lab
+func proxySatellite(c echo.Context) error {
+	if relayHub == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Satellite relay is not enabled"})
+	}
+	name := c.Param("name")
+	path := "/" + c.Param("*")
+	if !strings.HasPrefix(path, "/api/") {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Only API paths can be relayed"})
+	}
+	if query := c.Request().URL.RawQuery; query != "" {
+		path += "?" + query
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxRelayBody+1))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read request body"})
+	}
+	if len(body) > maxRelayBody {
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{
+			"error": fmt.Sprintf("Relayed requests are limited to %d MiB", maxRelayBody>>20),
+		})
+	}
+
+	// The caller's credentials are for this daemon only. The satellite runs
+	// the request with its own relay API key.
+	header := c.Request().Header.Clone()
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+	header.Del("Authorization")
+	header.Del(apiKeyHeader)
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), relayTimeout)
+	defer cancel()
+	resp, err := relayHub.Do(ctx, name, &relay.Request{
+		Method: c.Request().Method,
+		Path:   path,
+		Header: header,
+		Body:   body,
+	})
+	switch {
+	case errors.Is(err, relay.ErrSatelliteOffline):
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": fmt.Sprintf("Satellite %s is offline", name)})
+	case errors.Is(err, relay.ErrTimeout):
+		return c.JSON(http.StatusGatewayTimeout, map[string]string{"error": fmt.Sprintf("Satellite %s did not respond in time", name)})
+	case err != nil:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	for key, values := range resp.Header {
+		for _, value := range values {
+			c.Response().Header().Add(key, value)
+		}
+	}
+	for _, name := range hopHeaders {
+		c.Response().Header().Del(name)
+	}
+	c.Response().WriteHeader(resp.Status)
+	_, err = c.Response().Write(resp.Body)
+	return err
+}
+
+// runSatellite relays requests from the central daemon to this daemon's API
+// at localURL, made with the API token apiKey, until ctx ends
+func runSatellite(ctx context.Context, centralURL, secret, localURL, apiKey string) {
+	client := relay.NewClient(strings.TrimSuffix(centralURL, "/"), secret, localURL, apiKey, relayTimeout)
+	logger.Infof("Relaying API requests from %s", centralURL)
+
+	for i := 0; i < relayWorkers; i++ {
+		go func() {
+			backoff := time.Second
+			for ctx.Err() == nil {
+				req, err := client.Poll(ctx)
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					logger.Warnf("Satellite relay: failed to poll %s: %v (retrying in %s)", centralURL, err, backoff)
+					select {
+					case <-time.After(backoff):
+					case <-ctx.Done():
+						return
+					}
+					backoff = min(2*backoff, time.Minute)
+					continue
+				}
+				backoff = time.Second
+				if req == nil {
+					continue
+				}
+
+				logger.Debugf("Satellite relay: %s %s", req.Method, req.Path)
+				resp := client.Forward(ctx, req)
+				if err := client.Respond(ctx, resp); err != nil {
+					logger.Warnf("Satellite relay: failed to return response to %s %s: %v", req.Method, req.Path, err)
+				}
+			}
+		}()
+	}
+}
+
+// localAPIURL returns the URL this daemon's own API is reachable at from
+// the same host
+func localAPIURL(listenIP, listenPort string) string {
+	switch listenIP {
+	case "", "0.0.0.0":
+		listenIP = "127.0.0.1"
+	case "::":
+		listenIP = "::1"
+	}
+	return "http://" + net.JoinHostPort(listenIP, listenPort)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchMatchesLabels(t *testing.T) {
+	setupTestDaemon(t)
+	require.NoError(t, store.CreateDeployment(&state.Deployment{
+		ID:     "dep_1",
+		Status: state.StatusRunning,
+		Config: map[string]interface{}{"labels": map[string]string{"team": "vision", "env": "prod"}},
+	}))
+	require.NoError(t, store.CreateDeployment(&state.Deployment{
+		ID:     "dep_2",
+		Status: state.StatusRunning,
+		Config: map[string]interface{}{"labels": map[string]interface{}{"team": "search"}},
+	}))
+
+	e := echo.New()
+	e.GET("/api/v1/search", search)
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/search?"+query, nil))
+		return rec
+	}
+
+	rec := get("q=vision")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var body struct {
+		Deployments []struct {
+			DeploymentID string `json:"deployment_id"`
+			Field        string `json:"field"`
+			Value        string `json:"value"`
+		} `json:"deployments"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	require.Len(t, body.Deployments, 1)
+	assert.Equal(t, "dep_1", body.Deployments[0].DeploymentID)
+	assert.Equal(t, "label", body.Deployments[0].Field)
+	assert.Equal(t, "team=vision", body.Deployments[0].Value)
+
+	// Label keys match too, on deployments loaded from disk as well
+	rec = get("q=team")
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Len(t, body.Deployments, 2)
+
+	for _, limit := range []string{"abc", "0", "-5"} {
+		assert.Equal(t, http.StatusBadRequest, get("q=x&limit="+limit).Code, limit)
+	}
+	assert.Equal(t, http.StatusOK, get("q=x&limit=1000000").Code)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/orchestrator"
+	"github.com/JustinTimperio/TaskFly/internal/report"
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/JustinTimperio/TaskFly/internal/trace"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// recorder writes the node API traffic of deployments to trace files. It is
+// nil unless recording is enabled.
+var recorder *trace.Recorder
+
+// recordedRoutes are the node routes whose traffic is recorded, and whether
+// their response is a download that is left out of the trace
+var recordedRoutes = map[string]bool{
+	"/api/v1/nodes/register":  false,
+	"/api/v1/nodes/token":     false,
+	"/api/v1/nodes/assets":    true,
+	"/api/v1/nodes/heartbeat": false,
+	"/api/v1/nodes/status":    false,
+	"/api/v1/nodes/logs":      false,
+	"/api/v1/nodes/progress":  false,
+}
+
+// responseCapture keeps a copy of the response written to a node
+type responseCapture struct {
+	http.ResponseWriter
+	body     bytes.Buffer
+	download bool
+}
+
+func (w *responseCapture) Write(b []byte) (int, error) {
+	if !w.download {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// recordMiddleware appends node requests, the daemon's responses and the
+// resulting node state to the trace of the node's deployment. Requests that
+// can't be attributed to a node, such as ones with unknown tokens, are not
+// recorded.
+func recordMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		download, recorded := recordedRoutes[c.Path()]
+		if recorder == nil || !recorded {
+			return next(c)
+		}
+
+		var body []byte
+		if c.Request().Body != nil {
+			var err error
+			body, err = io.ReadAll(c.Request().Body)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read request body"})
+			}
+			c.Request().Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		node, dep := recordedNode(c, body)
+		if node == nil {
+			return next(c)
+		}
+		if err := recorder.Begin(dep.ID, func() (*trace.Snapshot, error) { return snapshotDeployment(dep.ID) }); err != nil {
+			logger.Warnf("Failed to start trace of deployment %s: %v", dep.ID, err)
+			return next(c)
+		}
+
+		at := time.Now()
+		capture := &responseCapture{ResponseWriter: c.Response().Writer, download: download}
+		c.Response().Writer = capture
+		err := next(c)
+		c.Response().Writer = capture.ResponseWriter
+
+		entry := &trace.Entry{
+			At: at,
+			Request: &trace.Request{
+				Method:        c.Request().Method,
+				Path:          c.Request().URL.Path,
+				Query:         c.Request().URL.RawQuery,
+				Authorization: c.Request().Header.Get("Authorization"),
+				ContentType:   c.Request().Header.Get(echo.HeaderContentType),
+				Body:          dep.Redact(string(body)),
+				Status:        c.Response().Status,
+				Response:      dep.Redact(capture.body.String()),
+			},
+			After: trace.Capture(store, dep.ID, node.NodeID),
+		}
+		if err := recorder.Record(dep.ID, entry); err != nil {
+			logger.Warnf("Failed to record %s %s of node %s: %v", c.Request().Method, c.Path(), node.NodeID, err)
+		}
+		return err
+	}
+}
+
+// recordedNode finds the node making a request by the credential the route
+// authenticates with
+func recordedNode(c echo.Context, body []byte) (*state.Node, *state.Deployment) {
+	var req struct {
+		ProvisionToken string `json:"provision_token"`
+		RefreshToken   string `json:"refresh_token"`
+	}
+	switch c.Path() {
+	case "/api/v1/nodes/register":
+		json.Unmarshal(body, &req)
+		return findNodeByProvisionToken(req.ProvisionToken)
+	case "/api/v1/nodes/token":
+		json.Unmarshal(body, &req)
+		return findNodeByRefreshToken(req.RefreshToken)
+	}
+
+	authToken := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+	node, dep, err := store.FindNodeByAuthToken(authToken)
+	if err != nil {
+		return nil, nil
+	}
+	return node, dep
+}
+
+// snapshotDeployment returns the stored state of a deployment and its nodes
+func snapshotDeployment(deploymentID string) (*trace.Snapshot, error) {
+	dep, err := store.GetDeployment(deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := store.GetNodesByDeployment(deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	return &trace.Snapshot{Deployment: dep, Nodes: nodes}, nil
+}
+
+// replayTrace replays a recorded trace against the node API of an in-memory
+// daemon and reports where the outcome differs from the recording. Only the
+// node traffic is replayed: state changes the orchestrator made between
+// requests, such as a node being marked lost, show up as differences.
+func replayTrace(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("usage: taskflyd replay [--stop-on-divergence] <trace file>")
+	}
+	entries, err := trace.ReadFile(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	logger = logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+	if c.Bool("verbose") {
+		logger.SetLevel(logrus.DebugLevel)
+	}
+
+	// Asset downloads are served an empty bundle in place of the original
+	workDir, err := os.MkdirTemp("", "taskfly-replay-")
+	if err != nil {
+		return fmt.Errorf("failed to create replay directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+	bundlePath := filepath.Join(workDir, "bundle.tar.gz")
+	if err := os.WriteFile(bundlePath, nil, 0644); err != nil {
+		return fmt.Errorf("failed to create replay bundle: %w", err)
+	}
+
+	memory := state.NewStore()
+	store = memory
+	timings, err = report.NewTimings(filepath.Join(workDir, "timings.json"))
+	if err != nil {
+		return err
+	}
+	orch = orchestrator.NewOrchestrator(store, workDir, daemonIP, "", nil, nil, timings, nil)
+
+	e := echo.New()
+	agentNodeRoutes(e.Group("/api/v1"))
+	replayer := trace.NewReplayer(memory, e, bundlePath)
+
+	diverged := 0
+	start := entries[0].At
+	for i, entry := range entries {
+		result, err := replayer.Step(entry)
+		if err != nil {
+			return fmt.Errorf("failed to replay entry %d: %w", i+1, err)
+		}
+		printReplayResult(i+1, entry.At.Sub(start), result)
+		if len(result.Diffs) > 0 {
+			diverged++
+			if c.Bool("stop-on-divergence") {
+				break
+			}
+		}
+	}
+
+	if diverged > 0 {
+		return fmt.Errorf("%d of %d trace entries diverged from the recording", diverged, len(entries))
+	}
+	fmt.Printf("Replayed %d trace entries, all matched the recording\n", len(entries))
+	return nil
+}
+
+// printReplayResult prints one replayed trace entry and its differences
+func printReplayResult(number int, offset time.Duration, result *trace.Result) {
+	prefix := fmt.Sprintf("#%-5d +%-9s", number, offset.Round(time.Millisecond))
+	if snap := result.Entry.Snapshot; snap != nil {
+		fmt.Printf("%s snapshot of %s: %d nodes, deployment %s\n", prefix, snap.Deployment.ID, len(snap.Nodes), snap.Deployment.Status)
+		return
+	}
+
+	req := result.Entry.Request
+	line := fmt.Sprintf("%s %-4s %-24s %d", prefix, req.Method, req.Path, result.Status)
+	if result.After != nil {
+		line += fmt.Sprintf("  %s %s", result.After.NodeID, result.After.NodeStatus)
+	}
+	fmt.Println(line)
+	for _, diff := range result.Diffs {
+		fmt.Printf("       ✗ %s\n", diff)
+	}
+}
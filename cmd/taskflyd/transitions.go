@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/JustinTimperio/TaskFly/internal/notify"
+	"github.com/JustinTimperio/TaskFly/internal/state"
+)
+
+// transitionFilter selects the status changes sent to the webhooks. Entries
+// are "deployment:<status>" or "node:<status>", where the status may be "*".
+type transitionFilter map[string]bool
+
+// parseTransitionFilter parses the entries of --notify-transitions
+func parseTransitionFilter(entries []string) (transitionFilter, error) {
+	filter := make(transitionFilter)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kind, status, ok := strings.Cut(entry, ":")
+		if !ok || (kind != "deployment" && kind != "node") {
+			return nil, fmt.Errorf("%q must be deployment:<status> or node:<status>", entry)
+		}
+		valid := status == "*" ||
+			(kind == "deployment" && state.ValidDeploymentStatus(state.DeploymentStatus(status))) ||
+			(kind == "node" && state.ValidNodeStatus(state.NodeStatus(status)))
+		if !valid {
+			return nil, fmt.Errorf("%q names no %s status", entry, kind)
+		}
+		filter[kind+":"+status] = true
+	}
+	return filter, nil
+}
+
+// matches reports whether a transition is selected
+func (f transitionFilter) matches(transition state.Transition) bool {
+	kind := "deployment"
+	if transition.NodeID != "" {
+		kind = "node"
+	}
+	return f[kind+":"+transition.To] || f[kind+":*"]
+}
+
+// transitionEvent describes a status change as a notification of kind
+// deployment_<status> or node_<status>
+func transitionEvent(transition state.Transition) notify.Event {
+	event := notify.Event{
+		Kind:         "deployment_" + transition.To,
+		DeploymentID: transition.DeploymentID,
+		NodeID:       transition.NodeID,
+		Summary:      fmt.Sprintf("Deployment %s changed from %s to %s", transition.DeploymentID, transition.From, transition.To),
+		Time:         transition.At,
+	}
+	if transition.NodeID != "" {
+		event.Kind = "node_" + transition.To
+		event.Summary = fmt.Sprintf("Node %s (deployment %s) changed from %s to %s", transition.NodeID, transition.DeploymentID, transition.From, transition.To)
+	}
+	if transition.Message != "" {
+		event.Summary += ": " + transition.Message
+	}
+	return event
+}
+
+// watchTransitions logs every status change and POSTs the ones filter
+// selects to the notifier's webhooks
+func watchTransitions(store state.StateStore, notifier *notify.Notifier, filter transitionFilter) {
+	store.OnTransition(func(transition state.Transition) {
+		log := logger.WithField("deployment_id", transition.DeploymentID)
+		if transition.NodeID != "" {
+			log.Debugf("Node %s changed from %s to %s", transition.NodeID, transition.From, transition.To)
+		} else {
+			log.Infof("Deployment %s changed from %s to %s", transition.DeploymentID, transition.From, transition.To)
+		}
+
+		if notifier == nil || !filter.matches(transition) {
+			return
+		}
+		event := transitionEvent(transition)
+		go func() {
+			if err := notifier.Send(context.Background(), event); err != nil {
+				log.Warnf("Failed to send status change notification: %v", err)
+			}
+		}()
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/JustinTimperio/TaskFly/internal/cloud"
+	"github.com/JustinTimperio/TaskFly/internal/state"
+)
+
+// uploadIDPattern limits the upload IDs clients name their uploads with
+var uploadIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// pendingUploads holds the upload IDs being processed, so a client retrying
+// an upload while the first attempt is still running doesn't deploy twice
+var pendingUploads sync.Map
+
+// uploadedDeployment returns the deployment an owner already created with an
+// upload ID, or nil if the upload didn't create one
+func uploadedDeployment(owner state.Owner, uploadID string) *state.Deployment {
+	if uploadID == "" {
+		return nil
+	}
+	for _, deployment := range store.GetAllDeployments() {
+		if deployment.UploadID == uploadID && deployment.Owner == owner {
+			return deployment
+		}
+	}
+	return nil
+}
+
+// deploymentResponse is the response to an upload that created deployment.
+// existing is set when a retried upload found the deployment already created.
+func deploymentResponse(deployment *state.Deployment, existing bool) map[string]interface{} {
+	return map[string]interface{}{
+		"deployment_id":   deployment.ID,
+		"message":         fmt.Sprintf("Deployment accepted. Provisioning %d nodes.", deployment.TotalNodes),
+		"status_url":      fmt.Sprintf("/api/v1/deployments/%s", deployment.ID),
+		"nodes":           deployment.TotalNodes,
+		"status":          deployment.Status,
+		"policy_warnings": deployment.PolicyWarnings,
+		"imported_from":   deployment.ImportedFrom,
+		"simulated":       deployment.CloudProvider == cloud.ProviderSimulate,
+		"existing":        existing,
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/report"
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/JustinTimperio/TaskFly/internal/usage"
+	"github.com/labstack/echo/v4"
+)
+
+// Headers identifying the API key and namespace a request is accounted to
+const (
+	apiKeyHeader    = "X-TaskFly-API-Key"
+	namespaceHeader = "X-TaskFly-Namespace"
+
+	defaultNamespace = "default"
+)
+
+// usageTracker accounts requests and bundle bytes per owner, nodeLedger
+// records node lifetimes for node hours and spend
+var (
+	usageTracker *usage.Tracker
+	nodeLedger   *usage.Ledger
+)
+
+// namespacePattern limits namespaces to short, path-safe names
+var namespacePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,62}$`)
+
+// agentRoutes are called by agents and satellite daemons rather than API
+// clients, or by holders of signed URLs. They authenticate on their own and
+// are not counted as API usage.
+var agentRoutes = map[string]bool{
+	"/api/v1/nodes/register":       true,
+	"/api/v1/nodes/token":          true,
+	"/api/v1/nodes/agent":          true,
+	"/api/v1/nodes/assets":         true,
+	"/api/v1/nodes/heartbeat":      true,
+	"/api/v1/nodes/status":         true,
+	"/api/v1/nodes/logs":           true,
+	"/api/v1/nodes/progress":       true,
+	"/api/v1/nodes/artifacts/:key": true,
+	"/api/v1/artifacts/:id/:key":   true,
+	"/api/v1/health":               true,
+	"/api/v1/relay/poll":           true,
+	"/api/v1/relay/respond":        true,
+}
+
+// activeNodeStatuses are the node states that occupy an instance
+var activeNodeStatuses = map[state.NodeStatus]bool{
+	state.NodeStatusProvisioning: true,
+	state.NodeStatusBooting:      true,
+	state.NodeStatusRegistering:  true,
+	state.NodeStatusDownloading:  true,
+	state.NodeStatusExtracting:   true,
+	state.NodeStatusRunning:      true,
+	state.NodeStatusTerminating:  true,
+}
+
+// requestOwner returns the API key and namespace a request is accounted to
+func requestOwner(c echo.Context) state.Owner {
+	namespace := c.Request().Header.Get(namespaceHeader)
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	return state.Owner{
+		APIKeyID:  usage.KeyID(requestAPIKey(c)),
+		Namespace: namespace,
+	}
+}
+
+// usageMiddleware validates the namespace header and counts API requests
+func usageMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if agentRoutes[c.Path()] {
+			return next(c)
+		}
+
+		owner := requestOwner(c)
+		if !namespacePattern.MatchString(owner.Namespace) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid namespace"})
+		}
+
+		usageTracker.RecordRequest(owner)
+		return next(c)
+	}
+}
+
+// trackNodeTime periodically records which nodes occupy an instance in the
+// node ledger and persists the usage data
+func trackNodeTime(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		var active []usage.ActiveNode
+		for _, dep := range store.GetAllDeployments() {
+			nodes, _ := store.GetNodesByDeployment(dep.ID)
+			for _, node := range nodes {
+				if !activeNodeStatuses[node.Status] {
+					continue
+				}
+				active = append(active, usage.ActiveNode{
+					NodeID:       node.NodeID,
+					DeploymentID: dep.ID,
+					Owner:        dep.Owner,
+					Provider:     dep.CloudProvider,
+					InstanceType: report.InstanceType(dep, node),
+					Labels:       report.Labels(dep),
+				})
+			}
+		}
+		nodeLedger.Observe(now, active)
+
+		if err := nodeLedger.Save(); err != nil {
+			logger.Errorf("Failed to save node ledger: %v", err)
+		}
+		if err := usageTracker.Save(); err != nil {
+			logger.Errorf("Failed to save usage: %v", err)
+		}
+	}
+}
+
+// getUsage returns usage per API key and namespace and node hours per
+// instance type and per deployment label over a time window, given as ?month=2024-06, ?window=24h|7d
+// or RFC3339 ?since= and ?until= bounds
+func getUsage(c echo.Context) error {
+	until := time.Now()
+	if untilStr := c.QueryParam("until"); untilStr != "" {
+		parsed, err := time.Parse(time.RFC3339, untilStr)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid 'until' parameter, must be RFC3339 format"})
+		}
+		until = parsed
+	}
+
+	since := until.Add(-24 * time.Hour)
+	if monthStr := c.QueryParam("month"); monthStr != "" {
+		month, err := time.ParseInLocation("2006-01", monthStr, time.UTC)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid 'month' parameter, must be YYYY-MM"})
+		}
+		since = month
+		until = month.AddDate(0, 1, 0)
+	} else if sinceStr := c.QueryParam("since"); sinceStr != "" {
+		parsed, err := time.Parse(time.RFC3339, sinceStr)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid 'since' parameter, must be RFC3339 format"})
+		}
+		since = parsed
+	} else if windowStr := c.QueryParam("window"); windowStr != "" {
+		window, err := parseWindow(windowStr)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid 'window' parameter, use e.g. 12h or 7d"})
+		}
+		since = until.Add(-window)
+	}
+
+	owners, instances, labels := usage.Summarize(usageTracker, nodeLedger, since, until, c.QueryParam("namespace"))
+
+	entries := []usage.Entry{}
+	var totals usage.Entry
+	for _, entry := range owners {
+		entries = append(entries, entry)
+		totals.Requests += entry.Requests
+		totals.BundleBytes += entry.BundleBytes
+		totals.NodeHours += entry.NodeHours
+		totals.EstimatedCost += entry.EstimatedCost
+		totals.UnpricedNodeHours += entry.UnpricedNodeHours
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"since":     since,
+		"until":     until,
+		"usage":     entries,
+		"instances": instances,
+		"labels":    labels,
+		"totals":    totals,
+	})
+}
+
+// parseWindow parses a Go duration, additionally accepting a day suffix
+func parseWindow(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, strconv.ErrSyntax
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	window, err := time.ParseDuration(value)
+	if err != nil || window <= 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return window, nil
+}
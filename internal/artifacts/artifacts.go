@@ -0,0 +1,482 @@
+// Package artifacts keeps blobs the nodes of a deployment share or produce,
+// such as a binary one node builds and the others download instead of
+// building it again, or result files. Their contents are kept in the
+// daemon's directory or in a bucket, see Backend.
+package artifacts
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound   = errors.New("artifact not found")
+	ErrInvalidKey = errors.New("artifact keys are 1-128 letters, digits, '.', '_' and '-', not starting with '.'")
+	ErrFull       = errors.New("artifact cache of the deployment is full")
+)
+
+// keyPattern limits keys to names that are safe as file names
+var keyPattern = regexp.MustCompile(`^[a-zA-Z0-9_-][a-zA-Z0-9._-]{0,127}$`)
+
+// indexFile lists the entries of a deployment in its directory. Keys can't
+// start with '.', so it never clashes with an artifact.
+const indexFile = ".index.json"
+
+// Entry describes a stored artifact
+type Entry struct {
+	Key       string    `json:"key"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	NodeID    string    `json:"node_id"` // node that stored it
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Storage   string    `json:"storage,omitempty"` // bucket URL, empty when kept on the daemon
+}
+
+// Cache indexes artifacts on disk in a directory per deployment and keeps
+// their contents there or in a bucket. Each deployment may store up to
+// maxBytes, and artifacts expire ttl after they were stored. Expired
+// artifacts are removed from the daemon's directory; objects in buckets are
+// only dropped from the index and left to the bucket's lifecycle rules, since
+// pipelines may read them long after the deployment is gone.
+type Cache struct {
+	dir      string
+	maxBytes int64
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu          sync.Mutex
+	deployments map[string]map[string]*Entry
+	waiters     map[string]chan struct{} // closed when the key is stored
+
+	local       dirBackend
+	storage     Location           // where deployments without an override keep artifacts
+	backends    map[string]Backend // bucket backends by location
+	openBackend func(context.Context, Location) (Backend, error)
+}
+
+// New opens the cache in dir, keeping the unexpired artifacts stored before a
+// restart
+func New(dir string, maxBytes int64, ttl time.Duration) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create artifact directory: %w", err)
+	}
+	c := &Cache{
+		dir:         dir,
+		maxBytes:    maxBytes,
+		ttl:         ttl,
+		now:         time.Now,
+		deployments: make(map[string]map[string]*Entry),
+		waiters:     make(map[string]chan struct{}),
+		local:       dirBackend{dir: dir},
+		backends:    make(map[string]Backend),
+		openBackend: OpenBackend,
+	}
+
+	dirs, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read artifact directory: %w", err)
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, d.Name(), indexFile))
+		if err != nil {
+			continue
+		}
+		var entries map[string]*Entry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			continue
+		}
+		c.deployments[d.Name()] = entries
+	}
+	c.Expire()
+	return c, nil
+}
+
+// MaxBytes returns how much each deployment may store
+func (c *Cache) MaxBytes() int64 {
+	return c.maxBytes
+}
+
+// SetStorage sets where deployments that don't choose a location keep their
+// artifacts, checking that the backend's credentials are available
+func (c *Cache) SetStorage(ctx context.Context, location string) error {
+	loc, err := ParseLocation(location)
+	if err != nil {
+		return err
+	}
+	if _, err := c.backend(ctx, loc); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.storage = loc
+	return nil
+}
+
+// Storage returns where deployments keep their artifacts unless they choose
+// a location
+func (c *Cache) Storage() Location {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.storage
+}
+
+// CheckStorage checks that a location parses and its backend's credentials
+// are available, before a deployment is created with it
+func (c *Cache) CheckStorage(ctx context.Context, location string) error {
+	loc, err := ParseLocation(location)
+	if err != nil {
+		return err
+	}
+	_, err = c.backend(ctx, loc)
+	return err
+}
+
+// backend returns the backend of a location, opening bucket backends once
+func (c *Cache) backend(ctx context.Context, loc Location) (Backend, error) {
+	if loc.Local() {
+		return c.local, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if backend, ok := c.backends[loc.String()]; ok {
+		return backend, nil
+	}
+	backend, err := c.openBackend(ctx, loc)
+	if err != nil {
+		return nil, err
+	}
+	c.backends[loc.String()] = backend
+	return backend, nil
+}
+
+// Put stores an artifact read from body, replacing one with the same key.
+// storage is the location the deployment chose, empty for the cache's.
+// verify is called with the SHA-256 of the body before the artifact becomes
+// visible, so a request whose signature covers the body can be checked
+// without holding it in memory.
+func (c *Cache) Put(ctx context.Context, deploymentID, storage, key, nodeID string, body io.Reader, verify func(sum []byte) error) (Entry, error) {
+	if !keyPattern.MatchString(key) {
+		return Entry{}, ErrInvalidKey
+	}
+	loc := c.Storage()
+	if storage != "" {
+		parsed, err := ParseLocation(storage)
+		if err != nil {
+			return Entry{}, err
+		}
+		loc = parsed
+	}
+	backend, err := c.backend(ctx, loc)
+	if err != nil {
+		return Entry{}, err
+	}
+	dir := filepath.Join(c.dir, deploymentID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return Entry{}, fmt.Errorf("failed to create artifact directory: %w", err)
+	}
+
+	temp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to create artifact file: %w", err)
+	}
+	defer os.Remove(temp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(temp, hash), io.LimitReader(body, c.maxBytes+1))
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to store artifact: %w", err)
+	}
+	if size > c.maxBytes {
+		return Entry{}, fmt.Errorf("%w: artifacts may be at most %d bytes", ErrFull, c.maxBytes)
+	}
+	sum := hash.Sum(nil)
+	if verify != nil {
+		if err := verify(sum); err != nil {
+			return Entry{}, err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.checkSpace(deploymentID, key, size); err != nil {
+		return Entry{}, err
+	}
+	if loc.Local() {
+		if err := backend.Put(ctx, deploymentID+"/"+key, temp, size, sum); err != nil {
+			return Entry{}, fmt.Errorf("failed to store artifact: %w", err)
+		}
+	} else {
+		// Uploads take a while, other artifacts shouldn't wait for them.
+		// Concurrent uploads of a deployment may overshoot its limit by
+		// what they store together.
+		c.mu.Unlock()
+		err := c.upload(ctx, backend, deploymentID+"/"+key, temp.Name(), size, sum)
+		c.mu.Lock()
+		if err != nil {
+			return Entry{}, fmt.Errorf("failed to store artifact: %w", err)
+		}
+	}
+
+	now := c.now()
+	entries := c.deployments[deploymentID]
+	entry := &Entry{
+		Key:       key,
+		Size:      size,
+		SHA256:    hex.EncodeToString(sum),
+		NodeID:    nodeID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(c.ttl),
+	}
+	if !loc.Local() {
+		entry.Storage = loc.String()
+	}
+	if entries == nil {
+		entries = make(map[string]*Entry)
+		c.deployments[deploymentID] = entries
+	}
+	entries[key] = entry
+	if err := c.writeIndex(deploymentID); err != nil {
+		return Entry{}, err
+	}
+
+	if waiter, ok := c.waiters[deploymentID+"/"+key]; ok {
+		close(waiter)
+		delete(c.waiters, deploymentID+"/"+key)
+	}
+	return *entry, nil
+}
+
+// checkSpace returns ErrFull if storing size bytes under key would take a
+// deployment past its limit. Must be called with the lock held.
+func (c *Cache) checkSpace(deploymentID, key string, size int64) error {
+	now := c.now()
+	var used int64
+	for _, entry := range c.deployments[deploymentID] {
+		if entry.Key != key && now.Before(entry.ExpiresAt) {
+			used += entry.Size
+		}
+	}
+	if used+size > c.maxBytes {
+		return fmt.Errorf("%w: %d of %d bytes used, %d more requested", ErrFull, used, c.maxBytes, size)
+	}
+	return nil
+}
+
+// upload hands a spooled artifact to a bucket backend
+func (c *Cache) upload(ctx context.Context, backend Backend, name, path string, size int64, sum []byte) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return backend.Put(ctx, name, file, size, sum)
+}
+
+// Open returns an artifact for reading. If it isn't stored yet, Open waits up
+// to wait for another node to store it before returning ErrNotFound.
+// Artifacts kept on the daemon are returned as *os.File.
+func (c *Cache) Open(ctx context.Context, deploymentID, key string, wait time.Duration) (io.ReadCloser, Entry, error) {
+	if !keyPattern.MatchString(key) {
+		return nil, Entry{}, ErrInvalidKey
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		c.mu.Lock()
+		entry, ok := c.deployments[deploymentID][key]
+		if ok && c.now().Before(entry.ExpiresAt) {
+			found := *entry
+			c.mu.Unlock()
+			return c.open(ctx, found, deploymentID)
+		}
+		waiter, ok := c.waiters[deploymentID+"/"+key]
+		if !ok {
+			waiter = make(chan struct{})
+			c.waiters[deploymentID+"/"+key] = waiter
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-waiter:
+		case <-timer.C:
+			return nil, Entry{}, ErrNotFound
+		case <-ctx.Done():
+			return nil, Entry{}, ErrNotFound
+		}
+	}
+}
+
+// open opens a found artifact, in the daemon's directory or its bucket
+func (c *Cache) open(ctx context.Context, entry Entry, deploymentID string) (io.ReadCloser, Entry, error) {
+	name := deploymentID + "/" + entry.Key
+	if entry.Storage == "" {
+		// A replacement renamed over the file between the lookup and this
+		// open is a complete artifact too, only its entry is newer
+		file, err := c.local.Open(ctx, name)
+		if err != nil {
+			return nil, Entry{}, fmt.Errorf("failed to open artifact: %w", err)
+		}
+		return file, entry, nil
+	}
+
+	backend, err := c.entryBackend(ctx, entry)
+	if err != nil {
+		return nil, Entry{}, err
+	}
+	body, err := backend.Open(ctx, name)
+	if err != nil {
+		return nil, Entry{}, fmt.Errorf("failed to open artifact: %w", err)
+	}
+	return body, entry, nil
+}
+
+// entryBackend returns the bucket backend an artifact was stored in
+func (c *Cache) entryBackend(ctx context.Context, entry Entry) (Backend, error) {
+	loc, err := ParseLocation(entry.Storage)
+	if err != nil {
+		return nil, err
+	}
+	return c.backend(ctx, loc)
+}
+
+// SignedURL returns a URL anyone can download an artifact kept in a bucket
+// from for ttl. Artifacts kept on the daemon return ErrNotSignable.
+func (c *Cache) SignedURL(ctx context.Context, deploymentID, key string, ttl time.Duration) (string, Entry, error) {
+	if !keyPattern.MatchString(key) {
+		return "", Entry{}, ErrInvalidKey
+	}
+	c.mu.Lock()
+	entry, ok := c.deployments[deploymentID][key]
+	now := c.now()
+	if !ok || !now.Before(entry.ExpiresAt) {
+		c.mu.Unlock()
+		return "", Entry{}, ErrNotFound
+	}
+	found := *entry
+	c.mu.Unlock()
+
+	if found.Storage == "" {
+		return "", found, ErrNotSignable
+	}
+	backend, err := c.entryBackend(ctx, found)
+	if err != nil {
+		return "", found, err
+	}
+	signed, err := backend.SignedURL(deploymentID+"/"+key, ttl)
+	return signed, found, err
+}
+
+// List returns the unexpired artifacts of a deployment by key
+func (c *Cache) List(deploymentID string) []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	var entries []Entry
+	for _, entry := range c.deployments[deploymentID] {
+		if now.Before(entry.ExpiresAt) {
+			entries = append(entries, *entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+// Deployments returns the IDs of the deployments holding artifacts
+func (c *Cache) Deployments() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ids := make([]string, 0, len(c.deployments))
+	for id := range c.deployments {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// DeleteDeployment removes all artifacts of a deployment, keeping the objects
+// of those stored in a bucket
+func (c *Cache) DeleteDeployment(deploymentID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.deployments, deploymentID)
+	for key := range c.waiters {
+		if strings.HasPrefix(key, deploymentID+"/") {
+			delete(c.waiters, key)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(c.dir, deploymentID)); err != nil {
+		return fmt.Errorf("failed to remove artifacts of deployment %s: %w", deploymentID, err)
+	}
+	return nil
+}
+
+// Expire removes expired artifacts and returns how many were removed
+func (c *Cache) Expire() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	removed := 0
+	for deploymentID, entries := range c.deployments {
+		changed := false
+		for key, entry := range entries {
+			if now.Before(entry.ExpiresAt) {
+				continue
+			}
+			if entry.Storage == "" {
+				os.Remove(filepath.Join(c.dir, deploymentID, key))
+			}
+			delete(entries, key)
+			changed = true
+			removed++
+		}
+		if len(entries) == 0 {
+			delete(c.deployments, deploymentID)
+			os.RemoveAll(filepath.Join(c.dir, deploymentID))
+		} else if changed {
+			c.writeIndex(deploymentID)
+		}
+	}
+	return removed
+}
+
+// writeIndex writes the entries of a deployment to its index file. Must be
+// called with the lock held.
+func (c *Cache) writeIndex(deploymentID string) error {
+	data, err := json.Marshal(c.deployments[deploymentID])
+	if err != nil {
+		return fmt.Errorf("failed to encode artifact index: %w", err)
+	}
+	path := filepath.Join(c.dir, deploymentID, indexFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to write artifact index: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write artifact index: %w", err)
+	}
+	return nil
+}
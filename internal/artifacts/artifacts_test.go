@@ -0,0 +1,104 @@
+package artifacts
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readArtifact opens an artifact without waiting and returns its contents
+func readArtifact(t *testing.T, c *Cache, deploymentID, key string) string {
+	file, _, err := c.Open(context.Background(), deploymentID, key, 0)
+	require.NoError(t, err)
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestCachePutAndOpen(t *testing.T) {
+	c, err := New(t.TempDir(), 10, time.Hour)
+	require.NoError(t, err)
+
+	entry, err := c.Put(context.Background(), "dep_1", "", "app.bin", "node_0", strings.NewReader("abc"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), entry.Size)
+	assert.Equal(t, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", entry.SHA256)
+	assert.Equal(t, "abc", readArtifact(t, c, "dep_1", "app.bin"))
+
+	// Artifacts are per deployment
+	_, _, err = c.Open(context.Background(), "dep_2", "app.bin", 0)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// A replacement only counts once against the limit
+	_, err = c.Put(context.Background(), "dep_1", "", "app.bin", "node_1", strings.NewReader("abcdefgh"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefgh", readArtifact(t, c, "dep_1", "app.bin"))
+	_, err = c.Put(context.Background(), "dep_1", "", "other", "node_1", strings.NewReader("abc"), nil)
+	assert.ErrorIs(t, err, ErrFull)
+	_, err = c.Put(context.Background(), "dep_2", "", "huge", "node_1", strings.NewReader(strings.Repeat("x", 11)), nil)
+	assert.ErrorIs(t, err, ErrFull)
+
+	_, err = c.Put(context.Background(), "dep_1", "", "../escape", "node_0", strings.NewReader("abc"), nil)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	_, err = c.Put(context.Background(), "dep_1", "", indexFile, "node_0", strings.NewReader("abc"), nil)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+
+	// Rejected signatures leave the previous artifact in place
+	rejected := errors.New("bad signature")
+	_, err = c.Put(context.Background(), "dep_1", "", "app.bin", "node_2", strings.NewReader("xyz"), func(sum []byte) error { return rejected })
+	assert.ErrorIs(t, err, rejected)
+	assert.Equal(t, "abcdefgh", readArtifact(t, c, "dep_1", "app.bin"))
+}
+
+func TestCacheOpenWaitsForPut(t *testing.T) {
+	c, err := New(t.TempDir(), 1024, time.Hour)
+	require.NoError(t, err)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.Put(context.Background(), "dep_1", "", "app.bin", "node_0", strings.NewReader("built"), nil)
+	}()
+	file, entry, err := c.Open(context.Background(), "dep_1", "app.bin", 5*time.Second)
+	require.NoError(t, err)
+	file.Close()
+	assert.Equal(t, "node_0", entry.NodeID)
+
+	_, _, err = c.Open(context.Background(), "dep_1", "missing", 10*time.Millisecond)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestCacheExpiresAndSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, 1024, time.Hour)
+	require.NoError(t, err)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	_, err = c.Put(context.Background(), "dep_1", "", "old", "node_0", strings.NewReader("old"), nil)
+	require.NoError(t, err)
+	now = now.Add(30 * time.Minute)
+	_, err = c.Put(context.Background(), "dep_1", "", "new", "node_0", strings.NewReader("new"), nil)
+	require.NoError(t, err)
+
+	reopened, err := New(dir, 1024, time.Hour)
+	require.NoError(t, err)
+	assert.Len(t, reopened.List("dep_1"), 2)
+
+	now = now.Add(45 * time.Minute)
+	assert.Len(t, c.List("dep_1"), 1)
+	assert.Equal(t, 1, c.Expire())
+	assert.NoFileExists(t, dir+"/dep_1/old")
+
+	require.NoError(t, c.DeleteDeployment("dep_1"))
+	assert.Empty(t, c.Deployments())
+	_, err = os.Stat(dir + "/dep_1")
+	assert.True(t, os.IsNotExist(err))
+}
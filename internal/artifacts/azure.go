@@ -0,0 +1,149 @@
+package artifacts
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// azureSASVersion is the storage service version SAS tokens are signed for
+const azureSASVersion = "2022-11-02"
+
+// azureBackend keeps artifacts in an Azure Blob Storage container. Every
+// request carries a service SAS signed with the account key, so the same
+// code makes uploads, downloads and the URLs handed out.
+type azureBackend struct {
+	loc       Location
+	account   string
+	container string
+	prefix    string   // blob name prefix within the container
+	base      *url.URL // the container is addressed under it
+	key       []byte
+	client    *http.Client
+	now       func() time.Time
+}
+
+// newAzureBackend signs with the account key in AZURE_STORAGE_KEY. With
+// ?endpoint= the container is addressed under that URL instead, such as
+// http://127.0.0.1:10000/devstoreaccount1 for Azurite.
+func newAzureBackend(loc Location) (*azureBackend, error) {
+	encoded := os.Getenv("AZURE_STORAGE_KEY")
+	if encoded == "" {
+		return nil, fmt.Errorf("artifact storage %s needs the storage account key in AZURE_STORAGE_KEY", loc)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("artifact storage %s: AZURE_STORAGE_KEY is not base64: %w", loc, err)
+	}
+
+	container, prefix, _ := strings.Cut(loc.Prefix, "/")
+	endpoint := loc.Query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://" + loc.Bucket + ".blob.core.windows.net"
+	}
+	base, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("artifact storage %s: invalid endpoint %q", loc, endpoint)
+	}
+	return &azureBackend{
+		loc:       loc,
+		account:   loc.Bucket,
+		container: container,
+		prefix:    prefix,
+		base:      base,
+		key:       key,
+		client:    &http.Client{},
+		now:       time.Now,
+	}, nil
+}
+
+// blob returns the name of an artifact's blob within the container
+func (b *azureBackend) blob(name string) string {
+	if b.prefix == "" {
+		return name
+	}
+	return b.prefix + "/" + name
+}
+
+// sasURL returns the URL of an artifact's blob with a SAS granting
+// permissions until expires
+func (b *azureBackend) sasURL(name, permissions string, expires time.Time) string {
+	blob := b.blob(name)
+	expiry := expires.UTC().Format(time.RFC3339)
+	protocol := "https,http"
+	if b.base.Scheme == "https" {
+		protocol = "https"
+	}
+
+	// The fields of a service SAS for version 2020-12-06 and later, in order
+	stringToSign := strings.Join([]string{
+		permissions,
+		"", // start, valid immediately
+		expiry,
+		"/blob/" + b.account + "/" + b.container + "/" + blob,
+		"", // stored access policy
+		"", // IP range
+		protocol,
+		azureSASVersion,
+		"b",                // the resource is a blob
+		"",                 // snapshot time
+		"",                 // encryption scope
+		"", "", "", "", "", // response header overrides
+	}, "\n")
+	mac := hmac.New(sha256.New, b.key)
+	mac.Write([]byte(stringToSign))
+
+	query := url.Values{
+		"sv":  {azureSASVersion},
+		"sr":  {"b"},
+		"sp":  {permissions},
+		"se":  {expiry},
+		"spr": {protocol},
+		"sig": {base64.StdEncoding.EncodeToString(mac.Sum(nil))},
+	}
+	u := *b.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.container + "/" + blob
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (b *azureBackend) Put(ctx context.Context, name string, file *os.File, size int64, sum []byte) error {
+	target := b.sasURL(name, "cw", b.now().Add(time.Hour))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("x-ms-version", azureSASVersion)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload to %s: %w", b.loc, err)
+	}
+	defer resp.Body.Close()
+	return storageError(resp, "upload to", b.loc)
+}
+
+func (b *azureBackend) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return openSigned(ctx, b.client, b.sasURL(name, "r", b.now().Add(time.Minute)), b.loc)
+}
+
+func (b *azureBackend) SignedURL(name string, ttl time.Duration) (string, error) {
+	if err := checkSignedURLTTL(ttl); err != nil {
+		return "", err
+	}
+	return b.sasURL(name, "r", b.now().Add(ttl)), nil
+}
@@ -0,0 +1,208 @@
+package artifacts
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// unsignedPayload stands in for the body hash of presigned downloads
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// s3Backend keeps artifacts in an S3 bucket, or in any store that speaks the
+// S3 API with SigV4 signatures, such as GCS with HMAC keys or MinIO
+type s3Backend struct {
+	loc         Location
+	base        *url.URL // objects are addressed under it
+	region      string
+	credentials aws.CredentialsProvider
+	signer      *v4.Signer
+	client      *http.Client
+	now         func() time.Time
+}
+
+// newS3Backend uses the AWS credentials of the daemon: environment, shared
+// config or instance role. ?region= overrides the configured region, and
+// ?endpoint= addresses an S3 compatible store instead of AWS.
+func newS3Backend(ctx context.Context, loc Location) (*s3Backend, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config for %s: %w", loc, err)
+	}
+	region := loc.Query.Get("region")
+	if region == "" {
+		region = cfg.Region
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	endpoint := loc.Query.Get("endpoint")
+	if endpoint == "" && !strings.Contains(loc.Bucket, ".") {
+		// Virtual-hosted style, which AWS prefers over paths
+		return newSigV4Backend(loc, "https://"+loc.Bucket+".s3."+region+".amazonaws.com", region, cfg.Credentials)
+	}
+	if endpoint == "" {
+		// Buckets with dots don't match the wildcard certificate of
+		// virtual-hosted names
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	return newSigV4Backend(loc, strings.TrimSuffix(endpoint, "/")+"/"+loc.Bucket, region, cfg.Credentials)
+}
+
+// newGCSBackend uses the XML API of Cloud Storage, which accepts SigV4
+// signatures made with the HMAC key in TASKFLY_GCS_HMAC_ACCESS_ID and
+// TASKFLY_GCS_HMAC_SECRET
+func newGCSBackend(loc Location) (*s3Backend, error) {
+	accessID, secret := os.Getenv("TASKFLY_GCS_HMAC_ACCESS_ID"), os.Getenv("TASKFLY_GCS_HMAC_SECRET")
+	if accessID == "" || secret == "" {
+		return nil, fmt.Errorf("artifact storage %s needs an HMAC key in TASKFLY_GCS_HMAC_ACCESS_ID and TASKFLY_GCS_HMAC_SECRET", loc)
+	}
+	endpoint := loc.Query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	}
+	region := loc.Query.Get("region")
+	if region == "" {
+		region = "auto"
+	}
+	provider := credentials.NewStaticCredentialsProvider(accessID, secret, "")
+	return newSigV4Backend(loc, strings.TrimSuffix(endpoint, "/")+"/"+loc.Bucket, region, provider)
+}
+
+func newSigV4Backend(loc Location, base, region string, provider aws.CredentialsProvider) (*s3Backend, error) {
+	if provider == nil {
+		return nil, fmt.Errorf("artifact storage %s: no credentials found", loc)
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil || baseURL.Host == "" {
+		return nil, fmt.Errorf("artifact storage %s: invalid endpoint %q", loc, base)
+	}
+	return &s3Backend{
+		loc:         loc,
+		base:        baseURL,
+		region:      region,
+		credentials: provider,
+		signer: v4.NewSigner(func(o *v4.SignerOptions) {
+			// Object names are escaped once, as S3 expects
+			o.DisableURIPathEscaping = true
+		}),
+		client: &http.Client{},
+		now:    time.Now,
+	}, nil
+}
+
+// objectURL returns the URL of an artifact's object
+func (b *s3Backend) objectURL(name string) *url.URL {
+	u := *b.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.loc.object(name)
+	u.RawPath = ""
+	return &u
+}
+
+func (b *s3Backend) Put(ctx context.Context, name string, file *os.File, size int64, sum []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, b.objectURL(name).String(), file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	payloadHash := hex.EncodeToString(sum)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	creds, err := b.credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get credentials for %s: %w", b.loc, err)
+	}
+	if err := b.signer.SignHTTP(ctx, creds, req, payloadHash, "s3", b.region, b.now()); err != nil {
+		return fmt.Errorf("failed to sign upload to %s: %w", b.loc, err)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload to %s: %w", b.loc, err)
+	}
+	defer resp.Body.Close()
+	return storageError(resp, "upload to", b.loc)
+}
+
+func (b *s3Backend) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	signed, err := b.presign(ctx, name, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	return openSigned(ctx, b.client, signed, b.loc)
+}
+
+func (b *s3Backend) SignedURL(name string, ttl time.Duration) (string, error) {
+	return b.presign(context.Background(), name, ttl)
+}
+
+// presign returns a download URL signed for ttl
+func (b *s3Backend) presign(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	if err := checkSignedURLTTL(ttl); err != nil {
+		return "", err
+	}
+
+	u := b.objectURL(name)
+	query := u.Query()
+	query.Set("X-Amz-Expires", strconv.Itoa(int(ttl/time.Second)))
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	creds, err := b.credentials.Retrieve(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get credentials for %s: %w", b.loc, err)
+	}
+	signed, _, err := b.signer.PresignHTTP(ctx, creds, req, unsignedPayload, "s3", b.region, b.now())
+	if err != nil {
+		return "", fmt.Errorf("failed to sign URL of %s: %w", b.loc, err)
+	}
+	return signed, nil
+}
+
+// openSigned downloads an object through a signed URL
+func openSigned(ctx context.Context, client *http.Client, signed string, loc Location) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, signed, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download from %s: %w", loc, err)
+	}
+	if err := storageError(resp, "download from", loc); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// storageError turns an unsuccessful response of a bucket into an error,
+// with the start of the message the store sent along
+func storageError(resp *http.Response, action string, loc Location) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s answered %d", ErrNotFound, loc, resp.StatusCode)
+	}
+	return fmt.Errorf("failed to %s %s: %s: %s", action, loc, resp.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,157 @@
+package artifacts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNotSignable is returned by SignedURL for artifacts kept in the daemon's
+// directory, which the daemon serves and signs links for itself
+var ErrNotSignable = errors.New("artifacts kept on the daemon have no storage URL to sign")
+
+// MaxSignedURLTTL is the longest a signed download URL stays valid, the limit
+// S3 and GCS put on signed requests
+const MaxSignedURLTTL = 7 * 24 * time.Hour
+
+// Backend holds the contents of artifacts. The Cache keeps the index, the
+// limits and the waiters in its directory and hands the bytes to a backend.
+// Names are <deployment_id>/<key>, backends place them under their prefix.
+type Backend interface {
+	// Put stores size bytes read from file, whose SHA-256 is sum
+	Put(ctx context.Context, name string, file *os.File, size int64, sum []byte) error
+	// Open returns the contents of a stored artifact
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// SignedURL returns a URL anyone can download the artifact from for ttl
+	SignedURL(name string, ttl time.Duration) (string, error)
+}
+
+// checkSignedURLTTL rejects validity periods buckets don't accept
+func checkSignedURLTTL(ttl time.Duration) error {
+	if ttl < time.Second || ttl > MaxSignedURLTTL {
+		return fmt.Errorf("signed URLs are valid for 1s to %s, not %s", MaxSignedURLTTL, ttl.Round(time.Second))
+	}
+	return nil
+}
+
+// Location is where artifacts are kept: empty for the daemon's directory, or
+// a bucket URL such as s3://results/taskfly. Query parameters configure the
+// backend, credentials come from the daemon's environment.
+type Location struct {
+	Scheme string     // s3, gs or azblob, empty for the daemon's directory
+	Bucket string     // bucket, or storage account for azblob
+	Prefix string     // object name prefix, for azblob starting with the container
+	Query  url.Values // region and endpoint
+}
+
+// ParseLocation parses an artifact storage URL: "local" (or empty) for the
+// daemon's directory, s3://bucket/prefix, gs://bucket/prefix or
+// azblob://account/container/prefix
+func ParseLocation(location string) (Location, error) {
+	if location == "" || location == "local" {
+		return Location{}, nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return Location{}, fmt.Errorf("invalid artifact storage %q: %w", location, err)
+	}
+	if u.User != nil {
+		return Location{}, fmt.Errorf("invalid artifact storage %q: credentials come from the daemon's environment, not the URL", location)
+	}
+	loc := Location{
+		Scheme: u.Scheme,
+		Bucket: u.Host,
+		Prefix: strings.Trim(u.Path, "/"),
+		Query:  u.Query(),
+	}
+	if loc.Bucket == "" {
+		return Location{}, fmt.Errorf("invalid artifact storage %q: missing bucket", location)
+	}
+	switch loc.Scheme {
+	case "s3", "gs":
+	case "azblob":
+		if loc.Prefix == "" {
+			return Location{}, fmt.Errorf("invalid artifact storage %q: use azblob://account/container/prefix", location)
+		}
+	default:
+		return Location{}, fmt.Errorf("invalid artifact storage %q: use local, s3://, gs:// or azblob://", location)
+	}
+	for key := range loc.Query {
+		if key != "region" && key != "endpoint" {
+			return Location{}, fmt.Errorf("invalid artifact storage %q: unknown option %q", location, key)
+		}
+	}
+	return loc, nil
+}
+
+// Local reports whether artifacts are kept in the daemon's directory
+func (l Location) Local() bool {
+	return l.Scheme == ""
+}
+
+// String returns the URL the location was parsed from
+func (l Location) String() string {
+	if l.Local() {
+		return "local"
+	}
+	u := url.URL{Scheme: l.Scheme, Host: l.Bucket, Path: "/" + l.Prefix, RawQuery: l.Query.Encode()}
+	if l.Prefix == "" {
+		u.Path = ""
+	}
+	return u.String()
+}
+
+// Within reports whether l is other or a prefix below it. Options must match
+// exactly, so a location can't point the daemon's credentials at another
+// endpoint.
+func (l Location) Within(other Location) bool {
+	if l.Scheme != other.Scheme || l.Bucket != other.Bucket || l.Query.Encode() != other.Query.Encode() {
+		return false
+	}
+	return other.Prefix == "" || l.Prefix == other.Prefix || strings.HasPrefix(l.Prefix, other.Prefix+"/")
+}
+
+// object returns the object name of an artifact under the prefix
+func (l Location) object(name string) string {
+	if l.Prefix == "" {
+		return name
+	}
+	return l.Prefix + "/" + name
+}
+
+// OpenBackend returns the backend of a bucket location, reading its
+// credentials from the environment
+func OpenBackend(ctx context.Context, loc Location) (Backend, error) {
+	switch loc.Scheme {
+	case "s3":
+		return newS3Backend(ctx, loc)
+	case "gs":
+		return newGCSBackend(loc)
+	case "azblob":
+		return newAzureBackend(loc)
+	}
+	return nil, fmt.Errorf("artifact storage %s has no backend", loc)
+}
+
+// dirBackend keeps artifacts in a directory on the daemon
+type dirBackend struct {
+	dir string
+}
+
+func (b dirBackend) Put(ctx context.Context, name string, file *os.File, size int64, sum []byte) error {
+	return os.Rename(file.Name(), filepath.Join(b.dir, filepath.FromSlash(name)))
+}
+
+func (b dirBackend) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(b.dir, filepath.FromSlash(name)))
+}
+
+func (b dirBackend) SignedURL(name string, ttl time.Duration) (string, error) {
+	return "", ErrNotSignable
+}
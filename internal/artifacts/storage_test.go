@@ -0,0 +1,190 @@
+package artifacts
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLocation(t *testing.T) {
+	tests := []struct {
+		location string
+		want     Location
+		err      string
+	}{
+		{location: "", want: Location{}},
+		{location: "local", want: Location{}},
+		{location: "s3://results/taskfly/", want: Location{Scheme: "s3", Bucket: "results", Prefix: "taskfly", Query: url.Values{}}},
+		{location: "gs://results", want: Location{Scheme: "gs", Bucket: "results", Query: url.Values{}}},
+		{location: "azblob://account/container/runs?endpoint=http://127.0.0.1:10000/account", want: Location{
+			Scheme: "azblob", Bucket: "account", Prefix: "container/runs",
+			Query: url.Values{"endpoint": {"http://127.0.0.1:10000/account"}},
+		}},
+		{location: "azblob://account", err: "azblob://account/container/prefix"},
+		{location: "s3://key:secret@results", err: "credentials come from the daemon's environment"},
+		{location: "s3://results?acl=public-read", err: `unknown option "acl"`},
+		{location: "ftp://results", err: "use local, s3://, gs:// or azblob://"},
+		{location: "s3:///taskfly", err: "missing bucket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.location, func(t *testing.T) {
+			loc, err := ParseLocation(tt.location)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, loc)
+		})
+	}
+}
+
+func TestLocationWithin(t *testing.T) {
+	allowed := must(ParseLocation("s3://results/taskfly"))
+	for location, want := range map[string]bool{
+		"s3://results/taskfly":                true,
+		"s3://results/taskfly/team-a":         true,
+		"s3://results/taskfly-other":          false,
+		"s3://results":                        false,
+		"gs://results/taskfly":                false,
+		"s3://results/taskfly?endpoint=x.com": false,
+	} {
+		assert.Equal(t, want, must(ParseLocation(location)).Within(allowed), location)
+	}
+	assert.True(t, must(ParseLocation("s3://results/any")).Within(must(ParseLocation("s3://results"))))
+}
+
+// bucketServer is a fake bucket that keeps objects by path and records the
+// requests it received
+type bucketServer struct {
+	mu       sync.Mutex
+	objects  map[string]string
+	requests []*http.Request
+}
+
+func newBucketServer(t *testing.T) (*bucketServer, *httptest.Server) {
+	bucket := &bucketServer{objects: make(map[string]string)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucket.mu.Lock()
+		defer bucket.mu.Unlock()
+		bucket.requests = append(bucket.requests, r)
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			bucket.objects[r.URL.Path] = string(body)
+		case http.MethodGet:
+			object, ok := bucket.objects[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			io.WriteString(w, object)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return bucket, server
+}
+
+func TestCacheStoresInSigV4Bucket(t *testing.T) {
+	t.Setenv("TASKFLY_GCS_HMAC_ACCESS_ID", "GOOGTEST")
+	t.Setenv("TASKFLY_GCS_HMAC_SECRET", "secret")
+	bucket, server := newBucketServer(t)
+
+	c, err := New(t.TempDir(), 1024, time.Hour)
+	require.NoError(t, err)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	require.NoError(t, c.SetStorage(context.Background(), "gs://results/taskfly?endpoint="+server.URL))
+
+	entry, err := c.Put(context.Background(), "dep_1", "", "out.csv", "node_0", strings.NewReader("a,b"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "gs://results/taskfly?endpoint="+url.QueryEscape(server.URL), entry.Storage)
+	assert.Equal(t, "a,b", bucket.objects["/results/taskfly/dep_1/out.csv"])
+
+	upload := bucket.requests[0]
+	assert.True(t, strings.HasPrefix(upload.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=GOOGTEST/"))
+	assert.Equal(t, entry.SHA256, upload.Header.Get("X-Amz-Content-Sha256"))
+
+	assert.Equal(t, "a,b", readArtifact(t, c, "dep_1", "out.csv"))
+	download := bucket.requests[1].URL.Query()
+	assert.Equal(t, "60", download.Get("X-Amz-Expires"))
+	assert.NotEmpty(t, download.Get("X-Amz-Signature"))
+
+	signed, _, err := c.SignedURL(context.Background(), "dep_1", "out.csv", time.Hour)
+	require.NoError(t, err)
+	signedURL, err := url.Parse(signed)
+	require.NoError(t, err)
+	assert.Equal(t, "/results/taskfly/dep_1/out.csv", signedURL.Path)
+	assert.Equal(t, "3600", signedURL.Query().Get("X-Amz-Expires"))
+	_, _, err = c.SignedURL(context.Background(), "dep_1", "out.csv", 8*24*time.Hour)
+	assert.ErrorContains(t, err, "signed URLs are valid for")
+
+	// Expired artifacts leave the bucket's objects for its lifecycle rules
+	now = now.Add(2 * time.Hour)
+	assert.Equal(t, 1, c.Expire())
+	assert.Contains(t, bucket.objects, "/results/taskfly/dep_1/out.csv")
+}
+
+func TestCacheStoresInDeploymentStorage(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_KEY", base64.StdEncoding.EncodeToString([]byte("account key")))
+	bucket, server := newBucketServer(t)
+
+	c, err := New(t.TempDir(), 1024, time.Hour)
+	require.NoError(t, err)
+	storage := "azblob://account/container/runs?endpoint=" + server.URL + "/account"
+	require.NoError(t, c.CheckStorage(context.Background(), storage))
+
+	_, err = c.Put(context.Background(), "dep_1", storage, "out.csv", "node_0", strings.NewReader("a,b"), nil)
+	require.NoError(t, err)
+	_, err = c.Put(context.Background(), "dep_2", "", "out.csv", "node_0", strings.NewReader("local"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"/account/container/runs/dep_1/out.csv": "a,b"}, bucket.objects)
+
+	upload := bucket.requests[0]
+	assert.Equal(t, "BlockBlob", upload.Header.Get("x-ms-blob-type"))
+	assert.Equal(t, "cw", upload.URL.Query().Get("sp"))
+	assert.Equal(t, "https,http", upload.URL.Query().Get("spr"))
+
+	assert.Equal(t, "a,b", readArtifact(t, c, "dep_1", "out.csv"))
+	assert.Equal(t, "local", readArtifact(t, c, "dep_2", "out.csv"))
+
+	signed, _, err := c.SignedURL(context.Background(), "dep_1", "out.csv", time.Hour)
+	require.NoError(t, err)
+	query := must(url.Parse(signed)).Query()
+	assert.Equal(t, "r", query.Get("sp"))
+	assert.Equal(t, "b", query.Get("sr"))
+	assert.NotEqual(t, upload.URL.Query().Get("sig"), query.Get("sig"))
+
+	_, _, err = c.SignedURL(context.Background(), "dep_2", "out.csv", time.Hour)
+	assert.ErrorIs(t, err, ErrNotSignable)
+	_, _, err = c.SignedURL(context.Background(), "dep_2", "missing", time.Hour)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestCheckStorageNeedsCredentials(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_KEY", "")
+	t.Setenv("TASKFLY_GCS_HMAC_ACCESS_ID", "")
+
+	c, err := New(t.TempDir(), 1024, time.Hour)
+	require.NoError(t, err)
+	assert.ErrorContains(t, c.CheckStorage(context.Background(), "azblob://account/container"), "AZURE_STORAGE_KEY")
+	assert.ErrorContains(t, c.CheckStorage(context.Background(), "gs://results"), "TASKFLY_GCS_HMAC_ACCESS_ID")
+	assert.NoError(t, c.CheckStorage(context.Background(), "local"))
+}
+
+func must[T any](value T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
@@ -0,0 +1,143 @@
+// Package auth restricts what API tokens may do on the daemon
+package auth
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Scope limits the requests a token may make
+type Scope string
+
+const (
+	// ScopeAdmin may use every endpoint
+	ScopeAdmin Scope = "admin"
+
+	// ScopeRead may view deployments, nodes, logs, metrics and reports but
+	// not create, change or terminate anything. Routes that return
+	// configuration or files, which may hold secrets, are left out.
+	ScopeRead Scope = "read"
+
+	// ScopeLogs may only fetch and stream deployment logs
+	ScopeLogs Scope = "logs"
+)
+
+// logsRoute is the only route the logs scope may use
+const logsRoute = "/api/v1/deployments/:id/logs"
+
+// readRoutes are the routes the read scope may GET. Routes are denied
+// unless listed, so new ones need admin scope until they are added here.
+// Deployment archives, node configs, artifact URLs and the satellite proxy
+// are deliberately missing: they hand out taskfly.yml, secrets in node
+// configs or stored files.
+var readRoutes = map[string]bool{
+	"/api/v1/deployments":                     true,
+	"/api/v1/deployments/:id":                 true,
+	logsRoute:                                 true,
+	"/api/v1/deployments/:id/report":          true,
+	"/api/v1/deployments/:id/events":          true,
+	"/api/v1/deployments/:id/bundle/manifest": true,
+	"/api/v1/deployments/:id/export":          true,
+	"/api/v1/deployments/:id/metrics":         true,
+	"/api/v1/deployments/:id/artifacts":       true,
+	"/api/v1/recommendations":                 true,
+	"/api/v1/nodes/:id":                       true,
+	"/api/v1/nodes/by-instance/:id":           true,
+	"/api/v1/nodes/by-ip/:ip":                 true,
+	"/api/v1/health":                          true,
+	"/api/v1/stats":                           true,
+	"/api/v1/metrics":                         true,
+	"/api/v1/metrics/prometheus":              true,
+	"/api/v1/search":                          true,
+	"/api/v1/usage":                           true,
+	"/api/v1/cleanup/policy":                  true,
+	"/api/v1/satellites":                      true,
+}
+
+// Allows reports whether the scope permits a request. route is the matched
+// route pattern, such as /api/v1/deployments/:id.
+func (s Scope) Allows(method, route string) bool {
+	readOnly := method == http.MethodGet || method == http.MethodHead
+	switch s {
+	case ScopeAdmin:
+		return true
+	case ScopeRead:
+		return readOnly && readRoutes[route]
+	case ScopeLogs:
+		return readOnly && route == logsRoute
+	default:
+		return false
+	}
+}
+
+// Token is an API token and what it may do
+type Token struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+	Scope Scope  `yaml:"scope"`
+}
+
+// Tokens is the set of tokens accepted by the daemon
+type Tokens struct {
+	byHash map[[sha256.Size]byte]Token
+}
+
+// LoadTokens reads API tokens from a YAML file:
+//
+//	tokens:
+//	  - name: ci
+//	    token: "..."
+//	    scope: admin
+func LoadTokens(path string) (*Tokens, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API tokens: %w", err)
+	}
+
+	var file struct {
+		Tokens []Token `yaml:"tokens"`
+	}
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse API tokens: %w", err)
+	}
+	if len(file.Tokens) == 0 {
+		return nil, fmt.Errorf("no API tokens defined in %s", path)
+	}
+
+	tokens := &Tokens{byHash: make(map[[sha256.Size]byte]Token, len(file.Tokens))}
+	for i, token := range file.Tokens {
+		if token.Name == "" {
+			return nil, fmt.Errorf("tokens[%d]: name is required", i)
+		}
+		if len(token.Token) < 16 {
+			return nil, fmt.Errorf("token %s: must be at least 16 characters", token.Name)
+		}
+		switch token.Scope {
+		case ScopeAdmin, ScopeRead, ScopeLogs:
+		default:
+			return nil, fmt.Errorf("token %s: scope must be admin, read or logs, got %q", token.Name, token.Scope)
+		}
+
+		hash := sha256.Sum256([]byte(token.Token))
+		if _, exists := tokens.byHash[hash]; exists {
+			return nil, fmt.Errorf("token %s: token is used twice", token.Name)
+		}
+		tokens.byHash[hash] = token
+	}
+
+	return tokens, nil
+}
+
+// Lookup returns the token matching a presented secret. Secrets are compared
+// by hash so lookups don't leak how much of a token matched.
+func (t *Tokens) Lookup(secret string) (Token, bool) {
+	if secret == "" {
+		return Token{}, false
+	}
+	token, ok := t.byHash[sha256.Sum256([]byte(secret))]
+	return token, ok
+}
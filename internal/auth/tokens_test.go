@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTokens(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tokens.yml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadTokens(t *testing.T) {
+	tokens, err := LoadTokens(writeTokens(t, `
+tokens:
+  - name: ci
+    token: admin-secret-0123456789
+    scope: admin
+  - name: wallboard
+    token: read-secret-0123456789
+    scope: read
+`))
+	require.NoError(t, err)
+
+	token, ok := tokens.Lookup("read-secret-0123456789")
+	require.True(t, ok)
+	assert.Equal(t, "wallboard", token.Name)
+	assert.Equal(t, ScopeRead, token.Scope)
+
+	_, ok = tokens.Lookup("read-secret")
+	assert.False(t, ok)
+	_, ok = tokens.Lookup("")
+	assert.False(t, ok)
+}
+
+func TestLoadTokensRejectsInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown scope": "tokens:\n  - {name: a, token: secret-0123456789abc, scope: write}\n",
+		"short token":   "tokens:\n  - {name: a, token: short, scope: read}\n",
+		"missing name":  "tokens:\n  - {token: secret-0123456789abc, scope: read}\n",
+		"duplicate":     "tokens:\n  - {name: a, token: secret-0123456789abc, scope: read}\n  - {name: b, token: secret-0123456789abc, scope: admin}\n",
+		"empty":         "tokens: []\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadTokens(writeTokens(t, content))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestScopeAllows(t *testing.T) {
+	tests := []struct {
+		scope  Scope
+		method string
+		route  string
+		want   bool
+	}{
+		{ScopeAdmin, http.MethodPost, "/api/v1/deployments", true},
+		{ScopeAdmin, http.MethodDelete, "/api/v1/deployments/:id", true},
+		{ScopeRead, http.MethodGet, "/api/v1/deployments/:id", true},
+		{ScopeRead, http.MethodGet, "/api/v1/deployments/:id/logs", true},
+		{ScopeRead, http.MethodPost, "/api/v1/deployments", false},
+		{ScopeRead, http.MethodDelete, "/api/v1/deployments/:id", false},
+		{ScopeRead, http.MethodPost, "/api/v1/nodes/:id/quarantine", false},
+		{ScopeRead, http.MethodGet, "/api/v1/deployments/:id/archive", false},
+		{ScopeRead, http.MethodGet, "/api/v1/deployments/:id/nodes/:node/config", false},
+		{ScopeRead, http.MethodGet, "/api/v1/deployments/:id/artifacts/:key/url", false},
+		{ScopeRead, http.MethodGet, "/api/v1/satellites/:name/*", false},
+		{ScopeRead, http.MethodGet, "/api/v1/not-yet-listed", false},
+		{ScopeAdmin, http.MethodGet, "/api/v1/deployments/:id/archive", true},
+		{ScopeAdmin, http.MethodGet, "/api/v1/deployments/:id/nodes/:node/config", true},
+		{ScopeLogs, http.MethodGet, "/api/v1/deployments/:id/logs", true},
+		{ScopeLogs, http.MethodGet, "/api/v1/deployments/:id", false},
+		{ScopeLogs, http.MethodPost, "/api/v1/deployments/:id/logs", false},
+		{Scope(""), http.MethodGet, "/api/v1/deployments", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.scope.Allows(tt.method, tt.route), "%s %s %s", tt.scope, tt.method, tt.route)
+	}
+}
@@ -0,0 +1,630 @@
+// Package bundle reads the tar.gz and zip application bundles deployments
+// ship to their nodes
+package bundle
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Format is the archive format of a bundle
+type Format string
+
+const (
+	FormatTarGz Format = "tar.gz"
+	FormatZip   Format = "zip"
+)
+
+// DetectFormat returns the format of a bundle from its first bytes, whatever
+// the file is named
+func DetectFormat(path string) (Format, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open bundle: %w", err)
+	}
+	defer file.Close()
+
+	magic := make([]byte, 4)
+	n, _ := io.ReadFull(file, magic)
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return FormatTarGz, nil
+	case bytes.Equal(magic, []byte("PK\x03\x04")), bytes.Equal(magic, []byte("PK\x05\x06")):
+		// A local file header, or the end record of an empty archive
+		return FormatZip, nil
+	default:
+		return "", fmt.Errorf("%s is not a tar.gz or zip bundle", path)
+	}
+}
+
+// Digest returns the hex encoded sha256 of a bundle file, which the daemon
+// sends nodes and agents cache bundles by
+func Digest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Entry is one file of a bundle. Symlinks and hardlinks have no content
+// and name their target in Link.
+type Entry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Mode   string `json:"mode"`
+	SHA256 string `json:"sha256,omitempty"`
+	Link   string `json:"link,omitempty"`
+}
+
+// Manifest lists the files of a bundle with their digests
+type Manifest struct {
+	SHA256 string  `json:"sha256"` // digest of the bundle file itself
+	Size   int64   `json:"size"`   // compressed size in bytes
+	Files  []Entry `json:"files"`
+}
+
+// Inspect reads a bundle and returns its manifest, with files in the order
+// they are stored
+func Inspect(path string) (*Manifest, error) {
+	format, err := DetectFormat(path)
+	if err != nil {
+		return nil, err
+	}
+	if format == FormatZip {
+		return inspectZip(path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bundle: %w", err)
+	}
+	defer file.Close()
+
+	// Hash the compressed bytes while reading the archive
+	digest := sha256.New()
+	counter := &countingReader{r: io.TeeReader(file, digest)}
+
+	gzipReader, err := gzip.NewReader(counter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle: %w", err)
+	}
+	defer gzipReader.Close()
+
+	manifest := &Manifest{Files: []Entry{}}
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bundle: %w", err)
+		}
+		entry, ok, err := inspectEntry(header, tarReader)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			manifest.Files = append(manifest.Files, entry)
+		}
+	}
+
+	// Include any trailing padding after the tar end marker in the digest
+	if _, err := io.Copy(io.Discard, counter); err != nil {
+		return nil, fmt.Errorf("failed to read bundle: %w", err)
+	}
+	manifest.SHA256 = hex.EncodeToString(digest.Sum(nil))
+	manifest.Size = counter.n
+	return manifest, nil
+}
+
+// inspectZip returns the manifest of a zip bundle
+func inspectZip(path string) (*Manifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bundle: %w", err)
+	}
+	defer file.Close()
+
+	digest := sha256.New()
+	size, err := io.Copy(digest, file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle: %w", err)
+	}
+
+	zipReader, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle: %w", err)
+	}
+
+	manifest := &Manifest{Files: []Entry{}}
+	for _, f := range zipReader.File {
+		header, r, err := zipHeader(f)
+		if err != nil {
+			return nil, err
+		}
+		entry, ok, err := inspectEntry(header, r)
+		if r != nil {
+			r.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			manifest.Files = append(manifest.Files, entry)
+		}
+	}
+
+	manifest.SHA256 = hex.EncodeToString(digest.Sum(nil))
+	manifest.Size = size
+	return manifest, nil
+}
+
+// inspectEntry describes one archive entry, reporting false for entries the
+// manifest leaves out, such as directories
+func inspectEntry(header *tar.Header, r io.Reader) (Entry, bool, error) {
+	switch header.Typeflag {
+	case tar.TypeReg:
+	case tar.TypeSymlink, tar.TypeLink:
+		return Entry{
+			Path: header.Name,
+			Mode: header.FileInfo().Mode().String(),
+			Link: header.Linkname,
+		}, true, nil
+	default:
+		return Entry{}, false, nil
+	}
+
+	fileDigest := sha256.New()
+	size, err := io.Copy(fileDigest, r)
+	if err != nil {
+		return Entry{}, false, fmt.Errorf("failed to read %s from bundle: %w", header.Name, err)
+	}
+	return Entry{
+		Path:   header.Name,
+		Size:   size,
+		Mode:   header.FileInfo().Mode().String(),
+		SHA256: hex.EncodeToString(fileDigest.Sum(nil)),
+	}, true, nil
+}
+
+// Extract unpacks a tar.gz or zip bundle below destDir and returns the paths
+// of the files and links it created. Permission bits, including setuid,
+// setgid and sticky, are restored, and so are modification times other than
+// ModTime. Entries that would land outside destDir are rejected. Symlinks
+// pointing outside destDir and unsupported entry types are skipped and
+// returned as warnings.
+func Extract(path, destDir string) (extracted, warnings []string, err error) {
+	extraction, err := ExtractWith(path, destDir, ExtractOptions{})
+	return extraction.Extracted, extraction.Warnings, err
+}
+
+// ExtractOptions control how a bundle is unpacked
+type ExtractOptions struct {
+	// StripSpecialBits leaves setuid, setgid and sticky bits off what is
+	// extracted, for bundles from uploaders that mustn't place such files
+	// on this host. The bits of regular files are returned instead.
+	StripSpecialBits bool
+}
+
+// Extraction is what ExtractWith unpacked
+type Extraction struct {
+	Extracted []string // paths of the files and links created
+	Warnings  []string // entries that were skipped
+
+	// SpecialBits are the setuid, setgid and sticky bits StripSpecialBits
+	// left off regular files, by entry name with '/' separators
+	SpecialBits map[string]os.FileMode
+}
+
+// ExtractWith is Extract with options
+func ExtractWith(path, destDir string, opts ExtractOptions) (Extraction, error) {
+	format, err := DetectFormat(path)
+	if err != nil {
+		return Extraction{}, err
+	}
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return Extraction{}, fmt.Errorf("failed to create %s: %w", destDir, err)
+	}
+	root, err := filepath.EvalSymlinks(destDir)
+	if err != nil {
+		return Extraction{}, fmt.Errorf("failed to resolve %s: %w", destDir, err)
+	}
+	x := &extractor{destDir: destDir, root: root, opts: opts}
+
+	if format == FormatZip {
+		err = x.zip(path)
+	} else {
+		err = x.tarGz(path)
+	}
+	return Extraction{Extracted: x.extracted, Warnings: x.warnings, SpecialBits: x.specialBits}, err
+}
+
+// extractor unpacks the entries of one bundle
+type extractor struct {
+	destDir     string
+	root        string // destDir with symlinks resolved
+	opts        ExtractOptions
+	extracted   []string
+	warnings    []string
+	specialBits map[string]os.FileMode
+}
+
+// mode returns the mode to give an extracted entry, recording the special
+// bits of regular files when they are stripped
+func (x *extractor) mode(header *tar.Header) os.FileMode {
+	mode := fileMode(header)
+	special := mode & (os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if !x.opts.StripSpecialBits || special == 0 {
+		return mode
+	}
+	if header.Typeflag == tar.TypeReg {
+		if x.specialBits == nil {
+			x.specialBits = make(map[string]os.FileMode)
+		}
+		x.specialBits[filepath.ToSlash(filepath.Clean(header.Name))] = special
+	}
+	return mode &^ special
+}
+
+// tarGz unpacks a tar.gz bundle
+func (x *extractor) tarGz(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open bundle: %w", err)
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to read bundle: %w", err)
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read bundle: %w", err)
+		}
+		if err := x.entry(header, tarReader); err != nil {
+			return err
+		}
+	}
+}
+
+// zip unpacks a zip bundle
+func (x *extractor) zip(path string) error {
+	zipReader, err := zip.OpenReader(path)
+	if err != nil {
+		return fmt.Errorf("failed to read bundle: %w", err)
+	}
+	defer zipReader.Close()
+
+	for _, f := range zipReader.File {
+		header, r, err := zipHeader(f)
+		if err != nil {
+			return err
+		}
+		err = x.entry(header, r)
+		if r != nil {
+			r.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entry unpacks one archive entry, reading a regular file's content from r
+func (x *extractor) entry(header *tar.Header, r io.Reader) error {
+	target, err := safeJoin(x.destDir, header.Name)
+	if err != nil {
+		return err
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := mkdirInside(x.root, target); err != nil {
+			return err
+		}
+		if err := os.Chmod(target, x.mode(header)); err != nil {
+			return fmt.Errorf("failed to set mode of %s: %w", target, err)
+		}
+		return nil
+
+	case tar.TypeReg:
+		if err := prepareTarget(x.root, target); err != nil {
+			return err
+		}
+		if err := writeFile(target, r, x.mode(header)); err != nil {
+			return err
+		}
+
+	case tar.TypeSymlink:
+		if err := mkdirInside(x.root, filepath.Dir(target)); err != nil {
+			return err
+		}
+		if !x.symlinkInside(target, header.Linkname) {
+			x.warnings = append(x.warnings, fmt.Sprintf("skipped symlink %s -> %s: it points outside the bundle", header.Name, header.Linkname))
+			return nil
+		}
+		if err := prepareTarget(x.root, target); err != nil {
+			return err
+		}
+		if err := os.Symlink(filepath.FromSlash(header.Linkname), target); err != nil {
+			x.warnings = append(x.warnings, fmt.Sprintf("skipped symlink %s -> %s: %v", header.Name, header.Linkname, err))
+			return nil
+		}
+		x.extracted = append(x.extracted, target)
+		return nil
+
+	case tar.TypeLink:
+		source, err := safeJoin(x.destDir, header.Linkname)
+		if err != nil {
+			return err
+		}
+		// The source must be a file extracted earlier, not one reached
+		// through a symlink
+		if source, err = x.hardlinkSource(source); err != nil {
+			x.warnings = append(x.warnings, fmt.Sprintf("skipped hardlink %s -> %s: %v", header.Name, header.Linkname, err))
+			return nil
+		}
+		if err := prepareTarget(x.root, target); err != nil {
+			return err
+		}
+		if err := os.Link(source, target); err != nil {
+			x.warnings = append(x.warnings, fmt.Sprintf("skipped hardlink %s -> %s: %v", header.Name, header.Linkname, err))
+			return nil
+		}
+		x.extracted = append(x.extracted, target)
+		return nil
+
+	default:
+		x.warnings = append(x.warnings, fmt.Sprintf("skipped %s: unsupported entry type %q", header.Name, header.Typeflag))
+		return nil
+	}
+
+	if !header.ModTime.Equal(ModTime) {
+		if err := os.Chtimes(target, header.ModTime, header.ModTime); err != nil {
+			return fmt.Errorf("failed to set modification time of %s: %w", target, err)
+		}
+	}
+	x.extracted = append(x.extracted, target)
+	return nil
+}
+
+// symlinkInside reports whether a symlink at target pointing to linkname
+// stays inside root. The target's directory is resolved, so symlinks
+// extracted earlier can't make a link deeper than its name suggests. Only
+// leading ".." components are allowed, as one following a symlink would
+// climb from wherever that symlink points.
+func (x *extractor) symlinkInside(target, linkname string) bool {
+	linkname = filepath.ToSlash(linkname)
+	if linkname == "" || path.IsAbs(linkname) || filepath.IsAbs(filepath.FromSlash(linkname)) {
+		return false
+	}
+	climbing := true
+	for _, part := range strings.Split(linkname, "/") {
+		if part != ".." {
+			climbing = false
+		} else if !climbing {
+			return false
+		}
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Dir(target))
+	if err != nil || !inside(x.root, dir) {
+		return false
+	}
+	return inside(x.root, filepath.Join(dir, filepath.FromSlash(linkname)))
+}
+
+// hardlinkSource resolves the directory of a hardlink's source and checks
+// that the source is a regular file inside root
+func (x *extractor) hardlinkSource(source string) (string, error) {
+	dir, err := filepath.EvalSymlinks(filepath.Dir(source))
+	if err != nil {
+		return "", err
+	}
+	if !inside(x.root, dir) {
+		return "", fmt.Errorf("its source resolves outside the destination")
+	}
+	source = filepath.Join(dir, filepath.Base(source))
+	info, err := os.Lstat(source)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("its source is not a regular file")
+	}
+	return source, nil
+}
+
+// inside reports whether a resolved path is root or below it
+func inside(root, resolved string) bool {
+	rel, err := filepath.Rel(root, resolved)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// zipHeader describes a zip entry as a tar header, so both formats unpack
+// the same way, and opens its content. Symlinks carry their target as
+// content, which zipHeader reads into Linkname. Names written with Windows
+// separators are converted, and entries from tools that record no Unix
+// mode get 0644 for files and 0755 for directories rather than the
+// world-writable modes zip reports for them.
+func zipHeader(f *zip.File) (*tar.Header, io.ReadCloser, error) {
+	name := strings.ReplaceAll(f.Name, "\\", "/")
+	mode := f.Mode()
+	header := &tar.Header{
+		Name:    strings.TrimSuffix(name, "/"),
+		ModTime: ModTime,
+	}
+	if !f.Modified.IsZero() && f.ModifiedDate != 0 {
+		header.ModTime = f.Modified
+	}
+
+	unixMode := f.CreatorVersion>>8 == creatorUnix || f.CreatorVersion>>8 == creatorMacOSX
+	switch {
+	case mode.IsDir() || strings.HasSuffix(name, "/"):
+		header.Typeflag = tar.TypeDir
+		header.Mode = 0755
+		if unixMode {
+			header.Mode = tarMode(mode)
+		}
+		return header, nil, nil
+
+	case mode&fs.ModeSymlink != 0:
+		r, err := f.Open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s from bundle: %w", f.Name, err)
+		}
+		defer r.Close()
+		target, err := io.ReadAll(io.LimitReader(r, 4096))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s from bundle: %w", f.Name, err)
+		}
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = string(target)
+		header.Mode = 0777
+		return header, nil, nil
+
+	case mode.IsRegular():
+		r, err := f.Open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s from bundle: %w", f.Name, err)
+		}
+		header.Typeflag = tar.TypeReg
+		header.Size = int64(f.UncompressedSize64)
+		header.Mode = 0644
+		if unixMode {
+			header.Mode = tarMode(mode)
+		}
+		return header, r, nil
+
+	default:
+		// Entry types other than files, directories and symlinks are
+		// reported as unsupported
+		header.Typeflag = tar.TypeChar
+		return header, nil, nil
+	}
+}
+
+// Zip "version made by" hosts whose entries carry Unix modes
+const (
+	creatorUnix   = 3
+	creatorMacOSX = 19
+)
+
+// safeJoin joins an entry name to destDir, rejecting names that escape it
+func safeJoin(destDir, name string) (string, error) {
+	target := filepath.Join(destDir, name)
+	rel, err := filepath.Rel(destDir, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("bundle entry %s points outside the destination", name)
+	}
+	return target, nil
+}
+
+// prepareTarget creates the parent directory of an entry and removes what a
+// previous entry left at its path, so nothing is written through a symlink
+func prepareTarget(root, target string) error {
+	if err := mkdirInside(root, filepath.Dir(target)); err != nil {
+		return err
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to replace %s: %w", target, err)
+	}
+	return nil
+}
+
+// mkdirInside creates a directory after checking that symlinks extracted
+// earlier don't redirect it outside root
+func mkdirInside(root, dir string) error {
+	existing := dir
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", existing, err)
+	}
+	if !inside(root, resolved) {
+		return fmt.Errorf("%s resolves outside the destination through a symlink", dir)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+// fileMode returns the permission, setuid, setgid and sticky bits of an entry
+func fileMode(header *tar.Header) os.FileMode {
+	return header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// writeFile copies an entry's content to a new file and sets its mode
+// exactly, without the umask
+func writeFile(target string, r io.Reader, mode os.FileMode) error {
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", target, err)
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to extract %s: %w", target, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to extract %s: %w", target, err)
+	}
+	if err := os.Chmod(target, mode); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %w", target, err)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
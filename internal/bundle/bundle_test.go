@@ -0,0 +1,148 @@
+package bundle
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeBundle creates a tar.gz with the given files, in order
+func writeBundle(t *testing.T, files [][2]string) string {
+	path := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, f := range files {
+		require.NoError(t, tarWriter.WriteHeader(&tar.Header{
+			Name:     f[0],
+			Mode:     0755,
+			Size:     int64(len(f[1])),
+			Typeflag: tar.TypeReg,
+		}))
+		_, err := tarWriter.Write([]byte(f[1]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tarWriter.Close())
+	require.NoError(t, gzipWriter.Close())
+	return path
+}
+
+func sha(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestInspect(t *testing.T) {
+	path := writeBundle(t, [][2]string{
+		{"taskfly.yml", "cloud_provider: local\n"},
+		{"app/run.sh", "#!/bin/sh\necho hi\n"},
+	})
+
+	manifest, err := Inspect(path)
+	require.NoError(t, err)
+	require.Len(t, manifest.Files, 2)
+
+	assert.Equal(t, Entry{Path: "taskfly.yml", Size: 22, Mode: "-rwxr-xr-x", SHA256: sha("cloud_provider: local\n")}, manifest.Files[0])
+	assert.Equal(t, "app/run.sh", manifest.Files[1].Path)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, sha(string(data)), manifest.SHA256)
+	assert.Equal(t, int64(len(data)), manifest.Size)
+
+	digest, err := Digest(path)
+	require.NoError(t, err)
+	assert.Equal(t, manifest.SHA256, digest)
+}
+
+func TestInspectNotABundle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	require.NoError(t, os.WriteFile(path, []byte("plain text"), 0644))
+
+	_, err := Inspect(path)
+	assert.Error(t, err)
+}
+
+func TestExtract(t *testing.T) {
+	path := writeBundle(t, [][2]string{{"app/run.sh", "echo hi\n"}})
+	dest := t.TempDir()
+
+	extracted, warnings, err := Extract(path, dest)
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+	assert.Equal(t, []string{filepath.Join(dest, "app", "run.sh")}, extracted)
+
+	data, err := os.ReadFile(filepath.Join(dest, "app", "run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, "echo hi\n", string(data))
+}
+
+func TestExtractRejectsTraversal(t *testing.T) {
+	path := writeBundle(t, [][2]string{{"../escape.sh", "echo pwned\n"}})
+	dest := t.TempDir()
+
+	_, _, err := Extract(path, dest)
+	assert.Error(t, err)
+	assert.NoFileExists(t, filepath.Join(filepath.Dir(dest), "escape.sh"))
+}
+
+// writeWindowsZip creates a zip the way Windows tools do, with backslash
+// separators and no Unix modes
+func writeWindowsZip(t *testing.T, files [][2]string) string {
+	path := filepath.Join(t.TempDir(), "bundle.zip")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	zipWriter := zip.NewWriter(file)
+	for _, f := range files {
+		w, err := zipWriter.CreateHeader(&zip.FileHeader{Name: f[0], Method: zip.Deflate})
+		require.NoError(t, err)
+		_, err = w.Write([]byte(f[1]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zipWriter.Close())
+	return path
+}
+
+func TestExtractWindowsZip(t *testing.T) {
+	path := writeWindowsZip(t, [][2]string{
+		{"app\\", ""},
+		{"app\\run.sh", "echo hi\n"},
+	})
+	dest := t.TempDir()
+
+	extracted, warnings, err := Extract(path, dest)
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+	assert.Equal(t, []string{filepath.Join(dest, "app", "run.sh")}, extracted)
+
+	info, err := os.Stat(filepath.Join(dest, "app", "run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode())
+
+	manifest, err := Inspect(path)
+	require.NoError(t, err)
+	require.Len(t, manifest.Files, 1)
+	assert.Equal(t, Entry{Path: "app/run.sh", Size: 8, Mode: "-rw-r--r--", SHA256: sha("echo hi\n")}, manifest.Files[0])
+}
+
+func TestExtractZipRejectsTraversal(t *testing.T) {
+	path := writeWindowsZip(t, [][2]string{{"..\\escape.sh", "echo pwned\n"}})
+	dest := t.TempDir()
+
+	_, _, err := Extract(path, dest)
+	assert.Error(t, err)
+	assert.NoFileExists(t, filepath.Join(filepath.Dir(dest), "escape.sh"))
+}
@@ -0,0 +1,281 @@
+package bundle
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ModTime is the modification time of every bundle entry unless modification
+// times are preserved. Together with sorted entries and normalized owners, it
+// makes the same files always produce a byte-identical bundle.
+var ModTime = time.Unix(0, 0).UTC()
+
+// File is a file to add to a bundle
+type File struct {
+	Name string // path inside the bundle
+	Path string // path on disk
+
+	// SpecialBits are setuid, setgid and sticky bits to store in addition
+	// to those of the file on disk, e.g. ones stripped when it was extracted
+	SpecialBits fs.FileMode
+}
+
+// Options control how files are stored in a bundle
+type Options struct {
+	// Format of the bundle, FormatTarGz if empty
+	Format Format
+
+	// PreserveModTimes stores each file's modification time instead of
+	// ModTime. The bundle then changes whenever a file is touched.
+	PreserveModTimes bool
+}
+
+// entry is a file to store, with what Create found on disk
+type entry struct {
+	File
+	info     fs.FileInfo
+	link     string // symlink target, or the entry a hardlink points to
+	hardlink bool
+}
+
+// mode returns the mode an entry is stored with
+func (e entry) mode() fs.FileMode {
+	return e.info.Mode() | e.SpecialBits&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)
+}
+
+// Create writes files to a bundle at path. Entries are sorted by name and
+// duplicates are stored once. Permission bits, including setuid, setgid and
+// sticky, are kept; owners are not. Symlinks are stored as links when they
+// point inside the bundle, and files hardlinked to an earlier entry as
+// hardlinks (zip bundles, which have no hardlinks, store a copy). Symlinks
+// leaving the bundle and special files such as devices and sockets are
+// skipped, and returned as warnings.
+func Create(path string, files []File, opts Options) ([]string, error) {
+	format := opts.Format
+	if format == "" {
+		format = FormatTarGz
+	}
+	if format != FormatTarGz && format != FormatZip {
+		return nil, fmt.Errorf("unsupported bundle format %q, must be %s or %s", format, FormatTarGz, FormatZip)
+	}
+
+	entries, warnings, err := collect(files)
+	if err != nil {
+		return warnings, err
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return warnings, fmt.Errorf("failed to create bundle: %w", err)
+	}
+	defer out.Close()
+
+	if format == FormatZip {
+		err = writeZip(out, entries, opts)
+	} else {
+		err = writeTarGz(out, entries, opts)
+	}
+	if err != nil {
+		return warnings, err
+	}
+	return warnings, out.Close()
+}
+
+// collect sorts and deduplicates files and works out what to store for each
+func collect(files []File) ([]entry, []string, error) {
+	sorted := make([]File, 0, len(files))
+	seen := make(map[string]bool)
+	for _, file := range files {
+		name := filepath.ToSlash(filepath.Clean(file.Name))
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		sorted = append(sorted, File{Name: name, Path: file.Path, SpecialBits: file.SpecialBits})
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	var entries, regular []entry
+	var warnings []string
+	for _, file := range sorted {
+		info, err := os.Lstat(file.Path)
+		if err != nil {
+			return nil, warnings, fmt.Errorf("failed to stat %s: %w", file.Path, err)
+		}
+		e := entry{File: file, info: info}
+
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(file.Path)
+			if err != nil {
+				return nil, warnings, fmt.Errorf("failed to read symlink %s: %w", file.Path, err)
+			}
+			target = filepath.ToSlash(target)
+			if !linkInside(file.Name, target) {
+				warnings = append(warnings, fmt.Sprintf("skipped symlink %s -> %s: it points outside the bundle", file.Name, target))
+				continue
+			}
+			e.link = target
+
+		case info.Mode().IsRegular():
+			for _, stored := range regular {
+				if os.SameFile(stored.info, info) {
+					e.link = stored.Name
+					e.hardlink = true
+					break
+				}
+			}
+			if !e.hardlink {
+				regular = append(regular, e)
+			}
+
+		case info.IsDir():
+			// Directories are created from the paths of their files
+			continue
+
+		default:
+			warnings = append(warnings, fmt.Sprintf("skipped %s: unsupported file type %s", file.Name, info.Mode().Type()))
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, warnings, nil
+}
+
+// writeTarGz writes entries as a tar.gz bundle
+func writeTarGz(out io.Writer, entries []entry, opts Options) error {
+	// The zero gzip header carries no name or timestamp
+	gzipWriter := gzip.NewWriter(out)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	for _, e := range entries {
+		header := &tar.Header{
+			Name:    e.Name,
+			Mode:    tarMode(e.mode()),
+			ModTime: ModTime,
+			Format:  tar.FormatPAX,
+		}
+		if opts.PreserveModTimes {
+			header.ModTime = e.info.ModTime().UTC()
+		}
+
+		switch {
+		case e.hardlink:
+			header.Typeflag = tar.TypeLink
+			header.Linkname = e.link
+		case e.link != "":
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = e.link
+			header.Mode = 0777
+		default:
+			header.Typeflag = tar.TypeReg
+			header.Size = e.info.Size()
+		}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to add %s: %w", e.Name, err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if err := copyFile(tarWriter, e); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return nil
+}
+
+// writeZip writes entries as a zip bundle. Without preserved modification
+// times, entries carry no timestamp at all.
+func writeZip(out io.Writer, entries []entry, opts Options) error {
+	zipWriter := zip.NewWriter(out)
+
+	for _, e := range entries {
+		header := &zip.FileHeader{Name: e.Name, Method: zip.Deflate}
+		if opts.PreserveModTimes {
+			header.Modified = e.info.ModTime()
+		}
+
+		if e.link != "" && !e.hardlink {
+			header.SetMode(fs.ModeSymlink | 0777)
+			w, err := zipWriter.CreateHeader(header)
+			if err != nil {
+				return fmt.Errorf("failed to add %s: %w", e.Name, err)
+			}
+			if _, err := io.WriteString(w, e.link); err != nil {
+				return fmt.Errorf("failed to add %s: %w", e.Name, err)
+			}
+			continue
+		}
+
+		header.SetMode(e.mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky))
+		w, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			return fmt.Errorf("failed to add %s: %w", e.Name, err)
+		}
+		if err := copyFile(w, e); err != nil {
+			return err
+		}
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return nil
+}
+
+// copyFile copies the content of an entry's file
+func copyFile(w io.Writer, e entry) error {
+	in, err := os.Open(e.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", e.Path, err)
+	}
+	defer in.Close()
+
+	if _, err := io.Copy(w, in); err != nil {
+		return fmt.Errorf("failed to add %s: %w", e.Name, err)
+	}
+	return nil
+}
+
+// tarMode converts a file mode to the permission and setuid, setgid and
+// sticky bits of a tar header
+func tarMode(mode fs.FileMode) int64 {
+	bits := int64(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+// linkInside reports whether a relative symlink target, seen from the
+// symlink's name inside the bundle, stays inside the bundle
+func linkInside(name, target string) bool {
+	if target == "" || path.IsAbs(target) || filepath.IsAbs(target) {
+		return false
+	}
+	resolved := path.Join(path.Dir(name), target)
+	return resolved != ".." && !strings.HasPrefix(resolved, "../")
+}
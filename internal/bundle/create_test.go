@@ -0,0 +1,253 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateIsReproducible(t *testing.T) {
+	dir := t.TempDir()
+	run := filepath.Join(dir, "run.sh")
+	data := filepath.Join(dir, "data.txt")
+	require.NoError(t, os.WriteFile(run, []byte("#!/bin/sh\n"), 0700))
+	require.NoError(t, os.WriteFile(data, []byte("payload\n"), 0600))
+
+	first := filepath.Join(t.TempDir(), "first.tar.gz")
+	_, err := Create(first, []File{{Name: "run.sh", Path: run}, {Name: "data.txt", Path: data}}, Options{})
+	require.NoError(t, err)
+
+	// Touching the files and listing them in another order changes nothing
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(run, later, later))
+	require.NoError(t, os.Chtimes(data, later, later))
+
+	second := filepath.Join(t.TempDir(), "second.tar.gz")
+	_, err = Create(second, []File{{Name: "data.txt", Path: data}, {Name: "./run.sh", Path: run}, {Name: "run.sh", Path: run}}, Options{})
+	require.NoError(t, err)
+
+	firstData, err := os.ReadFile(first)
+	require.NoError(t, err)
+	secondData, err := os.ReadFile(second)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(firstData, secondData), "bundles differ")
+
+	manifest, err := Inspect(first)
+	require.NoError(t, err)
+	require.Len(t, manifest.Files, 2)
+	assert.Equal(t, "data.txt", manifest.Files[0].Path)
+	assert.Equal(t, "-rw-------", manifest.Files[0].Mode)
+	assert.Equal(t, "run.sh", manifest.Files[1].Path)
+	assert.Equal(t, "-rwx------", manifest.Files[1].Mode)
+}
+
+func TestCreateAndExtractLinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks and setuid bits need a Unix filesystem")
+	}
+
+	src := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "bin"), 0755))
+	tool := filepath.Join(src, "bin", "tool")
+	require.NoError(t, os.WriteFile(tool, []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.Chmod(tool, 0755|os.ModeSetuid))
+	require.NoError(t, os.Link(tool, filepath.Join(src, "bin", "tool-copy")))
+	require.NoError(t, os.Symlink("bin/tool", filepath.Join(src, "current")))
+	require.NoError(t, os.Symlink(outside, filepath.Join(src, "escape")))
+	require.NoError(t, os.Symlink("../../etc/passwd", filepath.Join(src, "bin", "passwd")))
+
+	stamp := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(tool, stamp, stamp))
+
+	var files []File
+	for _, name := range []string{"bin/tool", "bin/tool-copy", "current", "escape", "bin/passwd"} {
+		files = append(files, File{Name: name, Path: filepath.Join(src, name)})
+	}
+	path := filepath.Join(t.TempDir(), "links.tar.gz")
+	warnings, err := Create(path, files, Options{PreserveModTimes: true})
+	require.NoError(t, err)
+	assert.Len(t, warnings, 2)
+
+	manifest, err := Inspect(path)
+	require.NoError(t, err)
+	require.Len(t, manifest.Files, 3)
+	assert.Equal(t, "bin/tool", manifest.Files[0].Path)
+	assert.Equal(t, Entry{Path: "bin/tool-copy", Mode: "urwxr-xr-x", Link: "bin/tool"}, manifest.Files[1])
+	assert.Equal(t, "current", manifest.Files[2].Path)
+	assert.Equal(t, "bin/tool", manifest.Files[2].Link)
+
+	dest := t.TempDir()
+	extracted, warnings, err := Extract(path, dest)
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+	assert.Len(t, extracted, 3)
+
+	info, err := os.Stat(filepath.Join(dest, "bin", "tool"))
+	require.NoError(t, err)
+	assert.Equal(t, 0755|os.ModeSetuid, info.Mode())
+	assert.True(t, info.ModTime().Equal(stamp))
+
+	copyInfo, err := os.Stat(filepath.Join(dest, "bin", "tool-copy"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(info, copyInfo))
+
+	target, err := os.Readlink(filepath.Join(dest, "current"))
+	require.NoError(t, err)
+	assert.Equal(t, "bin/tool", target)
+}
+
+func TestExtractRejectsWritesThroughSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need a Unix filesystem")
+	}
+
+	// A symlink left in the destination must not redirect later entries
+	dest := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.Symlink(outside, filepath.Join(dest, "out")))
+
+	path := writeBundle(t, [][2]string{{"out/pwned.sh", "echo pwned\n"}})
+	_, _, err := Extract(path, dest)
+	assert.Error(t, err)
+	assert.NoFileExists(t, filepath.Join(outside, "pwned.sh"))
+}
+
+func TestCreateZip(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need a Unix filesystem")
+	}
+
+	src := t.TempDir()
+	run := filepath.Join(src, "run.sh")
+	require.NoError(t, os.WriteFile(run, []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.Symlink("run.sh", filepath.Join(src, "start.sh")))
+	require.NoError(t, os.Link(run, filepath.Join(src, "copy.sh")))
+	files := []File{
+		{Name: "run.sh", Path: run},
+		{Name: "start.sh", Path: filepath.Join(src, "start.sh")},
+		{Name: "copy.sh", Path: filepath.Join(src, "copy.sh")},
+	}
+
+	first := filepath.Join(t.TempDir(), "bundle.zip")
+	_, err := Create(first, files, Options{Format: FormatZip})
+	require.NoError(t, err)
+	second := filepath.Join(t.TempDir(), "bundle.zip")
+	_, err = Create(second, files, Options{Format: FormatZip})
+	require.NoError(t, err)
+
+	firstData, err := os.ReadFile(first)
+	require.NoError(t, err)
+	secondData, err := os.ReadFile(second)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(firstData, secondData), "bundles differ")
+
+	format, err := DetectFormat(first)
+	require.NoError(t, err)
+	assert.Equal(t, FormatZip, format)
+
+	dest := t.TempDir()
+	_, warnings, err := Extract(first, dest)
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+
+	info, err := os.Stat(filepath.Join(dest, "run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode())
+
+	// Zip has no hardlinks, so the second name holds a copy
+	copied, err := os.ReadFile(filepath.Join(dest, "copy.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\n", string(copied))
+
+	target, err := os.Readlink(filepath.Join(dest, "start.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, "run.sh", target)
+}
+
+func TestCreateRejectsUnknownFormat(t *testing.T) {
+	_, err := Create(filepath.Join(t.TempDir(), "bundle.rar"), nil, Options{Format: "rar"})
+	assert.Error(t, err)
+}
+
+func TestExtractStripsSpecialBits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("setuid bits need a Unix filesystem")
+	}
+
+	src := t.TempDir()
+	tool := filepath.Join(src, "tool")
+	require.NoError(t, os.WriteFile(tool, []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.Chmod(tool, 0755|os.ModeSetgid))
+	path := filepath.Join(t.TempDir(), "special.tar.gz")
+	_, err := Create(path, []File{{Name: "bin/tool", Path: tool}}, Options{})
+	require.NoError(t, err)
+
+	dest := t.TempDir()
+	extraction, err := ExtractWith(path, dest, ExtractOptions{StripSpecialBits: true})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]os.FileMode{"bin/tool": os.ModeSetgid}, extraction.SpecialBits)
+	info, err := os.Stat(filepath.Join(dest, "bin", "tool"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode())
+
+	// Bundling the file again with its recorded bits restores them
+	repacked := filepath.Join(t.TempDir(), "repacked.tar.gz")
+	_, err = Create(repacked, []File{{Name: "bin/tool", Path: filepath.Join(dest, "bin", "tool"), SpecialBits: extraction.SpecialBits["bin/tool"]}}, Options{})
+	require.NoError(t, err)
+	manifest, err := Inspect(repacked)
+	require.NoError(t, err)
+	require.Len(t, manifest.Files, 1)
+	assert.Equal(t, "grwxr-xr-x", manifest.Files[0].Mode)
+}
+
+func TestExtractRejectsSymlinkChains(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need a Unix filesystem")
+	}
+
+	// x -> . makes x/x/y land at the root, where ../../secret points
+	// outside, and the hardlink would copy the file it reaches
+	parent := t.TempDir()
+	dest := filepath.Join(parent, "a", "dest")
+	require.NoError(t, os.MkdirAll(filepath.Join(parent, "secret"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(parent, "secret", "tokens.yml"), []byte("token: hunter2\n"), 0600))
+
+	path := filepath.Join(t.TempDir(), "chain.tar.gz")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, header := range []*tar.Header{
+		{Name: "x", Typeflag: tar.TypeSymlink, Linkname: ".", Mode: 0777},
+		{Name: "x/x/y", Typeflag: tar.TypeSymlink, Linkname: "../../secret", Mode: 0777},
+		{Name: "stolen", Typeflag: tar.TypeLink, Linkname: "y/tokens.yml", Mode: 0600},
+	} {
+		require.NoError(t, tarWriter.WriteHeader(header))
+	}
+	require.NoError(t, tarWriter.Close())
+	require.NoError(t, gzipWriter.Close())
+	require.NoError(t, file.Close())
+
+	extracted, warnings, err := Extract(path, dest)
+	require.NoError(t, err)
+	assert.Len(t, extracted, 1)
+	assert.Len(t, warnings, 2)
+	assert.NoFileExists(t, filepath.Join(dest, "y"))
+	assert.NoFileExists(t, filepath.Join(dest, "stolen"))
+
+	// Links climb from the resolved directory, and only with leading ".."
+	x := &extractor{root: dest}
+	require.NoError(t, os.Mkdir(filepath.Join(dest, "lib"), 0755))
+	assert.True(t, x.symlinkInside(filepath.Join(dest, "lib", "z"), "../x"))
+	assert.False(t, x.symlinkInside(filepath.Join(dest, "x", "z"), "../z"))
+	assert.False(t, x.symlinkInside(filepath.Join(dest, "z"), "x/../secret"))
+}
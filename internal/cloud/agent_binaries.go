@@ -5,33 +5,78 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync"
 )
 
-// Agent binaries are embedded in the daemon binary and extracted at runtime
-// The daemon extracts agents to build/agent/ on startup
+// Agent binaries are embedded in the daemon binary and registered in memory
+// on startup, so serving them doesn't depend on the working directory or a
+// writable filesystem. AgentDir is only a fallback for platforms the daemon
+// doesn't embed.
 
-// GetAgentBinary returns the appropriate agent binary for the requested platform
-func GetAgentBinary(goos, goarch string) ([]byte, error) {
-	// Agent binaries are extracted by the daemon to build/agent/ relative to working directory
-	// The filename format matches what the build script creates: taskfly-agent-{os}-{arch}
-	binaryPath := filepath.Join("build", "agent", fmt.Sprintf("taskfly-agent-%s-%s", goos, goarch))
+// AgentDir is the directory agent binaries are loaded from when they aren't
+// registered. It is relative to the daemon's working directory unless set to
+// an absolute path, and unused when empty.
+var AgentDir = ""
+
+// agentRegistry holds the registered agent binaries by file name, and the
+// files they were written to for running them on this host
+var agentRegistry = struct {
+	sync.Mutex
+	binaries    map[string][]byte
+	executables map[string]string
+}{
+	binaries:    make(map[string][]byte),
+	executables: make(map[string]string),
+}
 
-	// Add .exe extension for Windows
+// agentFileName returns the file name of the agent binary for a platform,
+// matching what cmd/build-agents creates: taskfly-agent-{os}-{arch}
+func agentFileName(goos, goarch string) string {
+	name := fmt.Sprintf("taskfly-agent-%s-%s", goos, goarch)
 	if goos == "windows" {
-		binaryPath += ".exe"
+		name += ".exe"
 	}
+	return name
+}
 
-	// Check if binary exists
+// RegisterAgentBinary makes an agent binary available for a platform. Empty
+// binaries, which build-agents embeds for targets it didn't build, are
+// ignored.
+func RegisterAgentBinary(goos, goarch string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	agentRegistry.Lock()
+	defer agentRegistry.Unlock()
+	name := agentFileName(goos, goarch)
+	agentRegistry.binaries[name] = data
+	delete(agentRegistry.executables, name)
+}
+
+// GetAgentBinary returns the appropriate agent binary for the requested
+// platform, from the registry or else from AgentDir
+func GetAgentBinary(goos, goarch string) ([]byte, error) {
+	name := agentFileName(goos, goarch)
+	agentRegistry.Lock()
+	data, ok := agentRegistry.binaries[name]
+	agentRegistry.Unlock()
+	if ok {
+		return data, nil
+	}
+
+	if AgentDir == "" {
+		return nil, fmt.Errorf("agent binary for %s/%s is not embedded in the daemon", goos, goarch)
+	}
+	binaryPath := filepath.Join(AgentDir, name)
 	if _, err := os.Stat(binaryPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("agent binary not found at %s. The daemon should have extracted it on startup", binaryPath)
+		return nil, fmt.Errorf("agent binary for %s/%s is not embedded in the daemon nor found at %s", goos, goarch, binaryPath)
 	}
 
-	// Read the binary
 	data, err := os.ReadFile(binaryPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read agent binary: %w", err)
 	}
-
 	return data, nil
 }
 
@@ -39,3 +84,55 @@ func GetAgentBinary(goos, goarch string) ([]byte, error) {
 func GetAgentBinaryForCurrentPlatform() ([]byte, error) {
 	return GetAgentBinary(runtime.GOOS, runtime.GOARCH)
 }
+
+// AgentExecutable returns the path of an agent binary for this host that can
+// be run. A registered binary is written once to a private temporary
+// directory; otherwise the binary in AgentDir is used.
+func AgentExecutable() (string, error) {
+	name := agentFileName(runtime.GOOS, runtime.GOARCH)
+
+	agentRegistry.Lock()
+	defer agentRegistry.Unlock()
+
+	if data, ok := agentRegistry.binaries[name]; ok {
+		if path, ok := agentRegistry.executables[name]; ok {
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+		}
+		dir, err := os.MkdirTemp("", "taskfly-agents-")
+		if err != nil {
+			return "", fmt.Errorf("failed to create agent directory: %w", err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0755); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("failed to write agent binary: %w", err)
+		}
+		agentRegistry.executables[name] = path
+		return path, nil
+	}
+
+	if AgentDir == "" {
+		return "", fmt.Errorf("agent binary for %s/%s is not embedded in the daemon", runtime.GOOS, runtime.GOARCH)
+	}
+	path, err := filepath.Abs(filepath.Join(AgentDir, name))
+	if err != nil {
+		return "", fmt.Errorf("failed to locate agent binary: %w", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("agent binary for %s/%s is not embedded in the daemon nor found at %s", runtime.GOOS, runtime.GOARCH, path)
+	}
+	return path, nil
+}
+
+// RemoveAgentExecutables removes the agent binaries AgentExecutable wrote.
+// Agents still running from them keep running.
+func RemoveAgentExecutables() {
+	agentRegistry.Lock()
+	defer agentRegistry.Unlock()
+	for name, path := range agentRegistry.executables {
+		os.RemoveAll(filepath.Dir(path))
+		delete(agentRegistry.executables, name)
+	}
+}
@@ -0,0 +1,77 @@
+package cloud
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resetAgents empties the agent registry and AgentDir for a test
+func resetAgents(t *testing.T) {
+	previous := AgentDir
+	AgentDir = ""
+	agentRegistry.Lock()
+	binaries, executables := agentRegistry.binaries, agentRegistry.executables
+	agentRegistry.binaries, agentRegistry.executables = make(map[string][]byte), make(map[string]string)
+	agentRegistry.Unlock()
+
+	t.Cleanup(func() {
+		AgentDir = previous
+		RemoveAgentExecutables()
+		agentRegistry.Lock()
+		agentRegistry.binaries, agentRegistry.executables = binaries, executables
+		agentRegistry.Unlock()
+	})
+}
+
+func TestGetAgentBinaryFromRegistry(t *testing.T) {
+	resetAgents(t)
+
+	_, err := GetAgentBinary("linux", "arm64")
+	assert.ErrorContains(t, err, "not embedded")
+
+	// Empty placeholders aren't registered
+	RegisterAgentBinary("linux", "arm64", nil)
+	_, err = GetAgentBinary("linux", "arm64")
+	assert.Error(t, err)
+
+	RegisterAgentBinary("linux", "arm64", []byte("agent"))
+	data, err := GetAgentBinary("linux", "arm64")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("agent"), data)
+
+	// Platforms that aren't registered fall back to the agent directory
+	AgentDir = t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(AgentDir, "taskfly-agent-windows-amd64.exe"), []byte("windows"), 0755))
+	data, err = GetAgentBinary("windows", "amd64")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("windows"), data)
+	_, err = GetAgentBinary("darwin", "arm64")
+	assert.ErrorContains(t, err, AgentDir)
+}
+
+func TestAgentExecutableWritesRegisteredBinary(t *testing.T) {
+	resetAgents(t)
+
+	_, err := AgentExecutable()
+	assert.ErrorContains(t, err, "agent binary for")
+
+	RegisterAgentBinary(runtime.GOOS, runtime.GOARCH, []byte("#!/bin/sh\n"))
+	path, err := AgentExecutable()
+	require.NoError(t, err)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\n", string(data))
+
+	// The binary is only written once
+	again, err := AgentExecutable()
+	require.NoError(t, err)
+	assert.Equal(t, path, again)
+
+	RemoveAgentExecutables()
+	assert.NoFileExists(t, path)
+}
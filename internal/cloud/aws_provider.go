@@ -2,22 +2,44 @@ package cloud
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
 )
 
-// AWS provider uses SSH to deploy agent binaries directly
+// AWS provider uses SSH to deploy agent binaries directly, or EC2 user data
+// in egress-only mode so the daemon never has to dial the instance
+
+// Spread policies for the spread setting of the AWS provider
+const (
+	SpreadZones = "zones" // distinct availability zones, round-robin by node index
+	SpreadHosts = "hosts" // distinct physical hosts via a spread placement group
+)
+
+// defaultPlacementGroup is the spread placement group created when spreading
+// across hosts without a placement_group setting
+const defaultPlacementGroup = "taskfly-spread"
 
 // AWSProvider implements the Provider interface for AWS EC2
 type AWSProvider struct {
 	client       *ec2.Client
 	config       map[string]interface{}
 	configHelper *ProviderConfigHelper
+
+	// Zones and placement group are looked up once and shared by all nodes
+	zonesOnce sync.Once
+	zones     []string
+	zonesErr  error
+	groupOnce sync.Once
+	groupErr  error
 }
 
 // NewAWSProvider creates a new AWS provider
@@ -94,44 +116,52 @@ func (p *AWSProvider) ProvisionInstance(ctx context.Context, config InstanceConf
 	instanceType := p.configHelper.GetString("instance_type", "no-default")
 	keyName := p.configHelper.GetString("key_name", "")
 	securityGroups := p.configHelper.GetStringSlice("security_groups", []string{"default"})
-	subnetID := p.configHelper.GetString("subnet_id", "")
 
-	if keyName == "" {
-		return nil, fmt.Errorf("key_name is required for AWS provider")
+	// Pick the subnet and zone, spreading nodes across them if configured
+	subnetID, zone, err := p.spreadTarget(ctx, config.NodeIndex)
+	if err != nil {
+		return nil, err
 	}
 
-	// Get SSH configuration for agent deployment
+	// Get SSH configuration for agent deployment (unused in egress-only mode)
 	sshUser := p.configHelper.GetString("ssh_user", "ec2-user") // Default for Amazon Linux
 	sshKeyPath := p.configHelper.GetString("ssh_key_path", "")
-	if sshKeyPath == "" {
-		return nil, fmt.Errorf("ssh_key_path is required for AWS provider")
+	if !config.EgressOnly {
+		if keyName == "" {
+			return nil, fmt.Errorf("key_name is required for AWS provider")
+		}
+		if sshKeyPath == "" {
+			return nil, fmt.Errorf("ssh_key_path is required for AWS provider")
+		}
+	}
+
+	// Extra volumes are mounted by the bootstrap before the agent starts
+	rootVolume, volumes, err := ParseVolumes(p.config)
+	if err != nil {
+		return nil, err
+	}
+	config.SetupScript = BuildMountScript(volumes)
+
+	// Detect architecture from instance type
+	arch := DetectArchFromInstanceType(instanceType)
+	fmt.Printf("Detected architecture %s for instance type %s\n", arch, instanceType)
+
+	// Networking options for private-subnet and IPv6 deployments
+	associatePublicIP := p.configHelper.GetBool("associate_public_ip", true)
+	ipv6AddressCount := p.configHelper.GetInt("ipv6_address_count", 0)
+	_, associateSet := p.config["associate_public_ip"]
+	useNetworkInterface := associateSet || ipv6AddressCount > 0
+
+	if useNetworkInterface && subnetID == "" {
+		return nil, fmt.Errorf("subnet_id or subnet_ids is required when associate_public_ip or ipv6_address_count is set")
 	}
 
 	// Prepare run instances input
 	runInput := &ec2.RunInstancesInput{
 		ImageId:      aws.String(imageID),
 		InstanceType: types.InstanceType(instanceType),
-		KeyName:      aws.String(keyName),
 		MinCount:     aws.Int32(1),
 		MaxCount:     aws.Int32(1),
-		SecurityGroups: func() []string {
-			if subnetID != "" {
-				return nil // Use SecurityGroupIds for VPC
-			}
-			return securityGroups
-		}(),
-		SecurityGroupIds: func() []string {
-			if subnetID != "" {
-				return securityGroups
-			}
-			return nil
-		}(),
-		SubnetId: func() *string {
-			if subnetID != "" {
-				return aws.String(subnetID)
-			}
-			return nil
-		}(),
 		TagSpecifications: []types.TagSpecification{
 			{
 				ResourceType: types.ResourceTypeInstance,
@@ -153,6 +183,65 @@ func (p *AWSProvider) ProvisionInstance(ctx context.Context, config InstanceConf
 		},
 	}
 
+	if keyName != "" {
+		runInput.KeyName = aws.String(keyName)
+	}
+
+	if rootVolume != nil || len(volumes) > 0 {
+		mappings, err := p.blockDeviceMappings(ctx, imageID, rootVolume, volumes)
+		if err != nil {
+			return nil, err
+		}
+		runInput.BlockDeviceMappings = mappings
+		runInput.TagSpecifications = append(runInput.TagSpecifications, types.TagSpecification{
+			ResourceType: types.ResourceTypeVolume,
+			Tags: []types.Tag{
+				{Key: aws.String("CreatedBy"), Value: aws.String("TaskFly")},
+				{Key: aws.String("ProvisionToken"), Value: aws.String(config.ProvisionToken)},
+			},
+		})
+	}
+
+	if zone != "" {
+		runInput.Placement = &types.Placement{AvailabilityZone: aws.String(zone)}
+	}
+	if p.spreads(SpreadHosts) {
+		groupName := p.configHelper.GetString("placement_group", defaultPlacementGroup)
+		if err := p.ensurePlacementGroup(ctx, groupName); err != nil {
+			return nil, err
+		}
+		if runInput.Placement == nil {
+			runInput.Placement = &types.Placement{}
+		}
+		runInput.Placement.GroupName = aws.String(groupName)
+	}
+
+	if config.EgressOnly {
+		// The instance pulls and starts the agent itself on first boot
+		script := BuildBootstrapScript(config, "linux", arch)
+		runInput.UserData = aws.String(base64.StdEncoding.EncodeToString([]byte(script)))
+	}
+
+	if useNetworkInterface {
+		// Public IP and IPv6 settings can only be expressed on a network interface,
+		// in which case subnet and security groups must move there as well
+		networkInterface := types.InstanceNetworkInterfaceSpecification{
+			DeviceIndex:              aws.Int32(0),
+			SubnetId:                 aws.String(subnetID),
+			Groups:                   securityGroups,
+			AssociatePublicIpAddress: aws.Bool(associatePublicIP),
+		}
+		if ipv6AddressCount > 0 {
+			networkInterface.Ipv6AddressCount = aws.Int32(int32(ipv6AddressCount))
+		}
+		runInput.NetworkInterfaces = []types.InstanceNetworkInterfaceSpecification{networkInterface}
+	} else if subnetID != "" {
+		runInput.SubnetId = aws.String(subnetID)
+		runInput.SecurityGroupIds = securityGroups // Use SecurityGroupIds for VPC
+	} else {
+		runInput.SecurityGroups = securityGroups
+	}
+
 	// Launch the instance
 	result, err := p.client.RunInstances(ctx, runInput)
 	if err != nil {
@@ -166,42 +255,67 @@ func (p *AWSProvider) ProvisionInstance(ctx context.Context, config InstanceConf
 	instance := result.Instances[0]
 	instanceID := aws.ToString(instance.InstanceId)
 
+	// From here on a failure would leave an instance nobody tracks running
+	abandon := func(err error) (*InstanceInfo, error) {
+		p.terminateAbandoned(instanceID)
+		return nil, err
+	}
+
 	// Wait for the instance to be running
 	if err := p.waitForInstanceRunning(ctx, instanceID); err != nil {
-		return nil, fmt.Errorf("instance failed to start: %w", err)
+		return abandon(fmt.Errorf("instance failed to start: %w", err))
 	}
 
 	// Get the updated instance information with public IP
 	instanceInfo, err := p.getInstanceInfo(ctx, instanceID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get instance info: %w", err)
+		return abandon(fmt.Errorf("failed to get instance info: %w", err))
 	}
 
-	// Detect architecture from instance type
-	arch := DetectArchFromInstanceType(instanceType)
-	fmt.Printf("Detected architecture %s for instance type %s\n", arch, instanceType)
+	if config.EgressOnly {
+		// Nothing to dial: the agent registers once user data has run
+		return instanceInfo, nil
+	}
+
+	// Pick the address the daemon should SSH to
+	sshHost, err := selectSSHAddress(instanceInfo, p.configHelper.GetString("ssh_address", ""))
+	if err != nil {
+		return abandon(err)
+	}
 
 	// Deploy agent using unified deployment function
 	deployConfig := DeploymentConfig{
-		Host:           instanceInfo.IPAddress,
-		SSHUser:        sshUser,
-		SSHKeyPath:     sshKeyPath,
-		SSHPort:        22,
-		ProvisionToken: config.ProvisionToken,
-		DaemonURL:      config.DaemonURL,
-		TargetOS:       "linux",
-		TargetArch:     arch,
-		WaitForSSH:     true,
-		SSHTimeout:     5 * time.Minute,
+		Host:              sshHost,
+		SSHUser:           sshUser,
+		SSHKeyPath:        sshKeyPath,
+		SSHPort:           22,
+		ProvisionToken:    config.ProvisionToken,
+		DaemonURL:         config.DaemonURL,
+		DaemonInternalURL: config.DaemonInternalURL,
+		TargetOS:          "linux",
+		TargetArch:        arch,
+		WaitForSSH:        true,
+		SSHTimeout:        5 * time.Minute,
+		SetupScript:       config.SetupScript,
 	}
 
-	if err := DeployAgentToHost(deployConfig); err != nil {
-		return nil, fmt.Errorf("failed to deploy agent: %w", err)
+	if err := DeployAgentToHost(ctx, deployConfig); err != nil {
+		return abandon(fmt.Errorf("failed to deploy agent: %w", err))
 	}
 
 	return instanceInfo, nil
 }
 
+// terminateAbandoned terminates an instance whose provisioning failed. It
+// doesn't use the provisioning context, which may be what ended.
+func (p *AWSProvider) terminateAbandoned(instanceID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := p.TerminateInstance(ctx, instanceID); err != nil {
+		fmt.Printf("Failed to terminate instance %s after provisioning failed: %v\n", instanceID, err)
+	}
+}
+
 // GetInstanceStatus returns the status of an EC2 instance
 func (p *AWSProvider) GetInstanceStatus(ctx context.Context, instanceID string) (string, error) {
 	input := &ec2.DescribeInstancesInput{
@@ -209,6 +323,11 @@ func (p *AWSProvider) GetInstanceStatus(ctx context.Context, instanceID string)
 	}
 
 	result, err := p.client.DescribeInstances(ctx, input)
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidInstanceID.NotFound" {
+		// Terminated instances drop out of DescribeInstances after a while
+		return "terminated", nil
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to describe instance: %w", err)
 	}
@@ -235,6 +354,31 @@ func (p *AWSProvider) TerminateInstance(ctx context.Context, instanceID string)
 	return nil
 }
 
+// BakeImage creates an AMI of an instance. The image is available once its
+// snapshots complete, which takes several minutes.
+func (p *AWSProvider) BakeImage(ctx context.Context, instanceID, name string, reboot bool) (string, error) {
+	tags := []types.Tag{
+		{Key: aws.String("CreatedBy"), Value: aws.String("TaskFly")},
+		{Key: aws.String("SourceInstance"), Value: aws.String(instanceID)},
+	}
+
+	result, err := p.client.CreateImage(ctx, &ec2.CreateImageInput{
+		InstanceId:  aws.String(instanceID),
+		Name:        aws.String(name),
+		Description: aws.String(fmt.Sprintf("Baked by TaskFly from %s", instanceID)),
+		NoReboot:    aws.Bool(!reboot),
+		TagSpecifications: []types.TagSpecification{
+			{ResourceType: types.ResourceTypeImage, Tags: tags},
+			{ResourceType: types.ResourceTypeSnapshot, Tags: tags},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create image: %w", err)
+	}
+
+	return aws.ToString(result.ImageId), nil
+}
+
 // waitForInstanceRunning waits for an instance to be in running state
 func (p *AWSProvider) waitForInstanceRunning(ctx context.Context, instanceID string) error {
 	waiter := ec2.NewInstanceRunningWaiter(p.client)
@@ -263,14 +407,183 @@ func (p *AWSProvider) getInstanceInfo(ctx context.Context, instanceID string) (*
 
 	instance := result.Reservations[0].Instances[0]
 
+	availabilityZone := ""
+	if instance.Placement != nil {
+		availabilityZone = aws.ToString(instance.Placement.AvailabilityZone)
+	}
+
+	privateIP := aws.ToString(instance.PrivateIpAddress)
+	ipv6Address := aws.ToString(instance.Ipv6Address)
+
+	// Prefer the public address, then private IPv4, then IPv6 for IPv6-only subnets
 	ipAddress := aws.ToString(instance.PublicIpAddress)
 	if ipAddress == "" {
-		ipAddress = aws.ToString(instance.PrivateIpAddress)
+		ipAddress = privateIP
+	}
+	if ipAddress == "" {
+		ipAddress = ipv6Address
 	}
 
 	return &InstanceInfo{
-		InstanceID: instanceID,
-		IPAddress:  ipAddress,
-		Status:     string(instance.State.Name),
+		InstanceID:       instanceID,
+		IPAddress:        ipAddress,
+		PrivateIPAddress: privateIP,
+		IPv6Address:      ipv6Address,
+		AvailabilityZone: availabilityZone,
+		Status:           string(instance.State.Name),
 	}, nil
 }
+
+// blockDeviceMappings builds the root volume override and extra EBS volumes.
+// Volumes are deleted with the instance unless marked keep.
+func (p *AWSProvider) blockDeviceMappings(ctx context.Context, imageID string, root *RootVolume, volumes []Volume) ([]types.BlockDeviceMapping, error) {
+	var mappings []types.BlockDeviceMapping
+
+	if root != nil {
+		// The root device name differs between AMIs (/dev/xvda, /dev/sda1)
+		result, err := p.client.DescribeImages(ctx, &ec2.DescribeImagesInput{ImageIds: []string{imageID}})
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe image %s: %w", imageID, err)
+		}
+		if len(result.Images) == 0 || result.Images[0].RootDeviceName == nil {
+			return nil, fmt.Errorf("image %s not found or has no root device", imageID)
+		}
+
+		ebs := &types.EbsBlockDevice{DeleteOnTermination: aws.Bool(true)}
+		if root.SizeGB > 0 {
+			ebs.VolumeSize = aws.Int32(int32(root.SizeGB))
+		}
+		if root.Type != "" {
+			ebs.VolumeType = types.VolumeType(root.Type)
+		}
+		mappings = append(mappings, types.BlockDeviceMapping{
+			DeviceName: result.Images[0].RootDeviceName,
+			Ebs:        ebs,
+		})
+	}
+
+	for _, volume := range volumes {
+		mappings = append(mappings, types.BlockDeviceMapping{
+			DeviceName: aws.String(volume.Device),
+			Ebs: &types.EbsBlockDevice{
+				VolumeSize:          aws.Int32(int32(volume.SizeGB)),
+				VolumeType:          types.VolumeType(volume.Type),
+				DeleteOnTermination: aws.Bool(!volume.Keep),
+			},
+		})
+	}
+
+	return mappings, nil
+}
+
+// spreads reports whether the spread setting includes policy
+func (p *AWSProvider) spreads(policy string) bool {
+	for _, configured := range p.configHelper.GetStringSlice("spread", nil) {
+		if configured == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// spreadTarget returns the subnet and availability zone to launch a node in.
+// Nodes are assigned to subnet_ids round-robin. Without subnets, spreading
+// across zones places them round-robin in availability_zones, or in all
+// available zones of the region if none are listed.
+func (p *AWSProvider) spreadTarget(ctx context.Context, nodeIndex int) (subnetID, zone string, err error) {
+	if subnetIDs := p.configHelper.GetStringSlice("subnet_ids", nil); len(subnetIDs) > 0 {
+		// The subnet determines the zone
+		return roundRobin(subnetIDs, nodeIndex), "", nil
+	}
+
+	subnetID = p.configHelper.GetString("subnet_id", "")
+	if !p.spreads(SpreadZones) {
+		return subnetID, "", nil
+	}
+	if subnetID != "" {
+		return "", "", fmt.Errorf("spreading across zones requires subnet_ids with one subnet per zone instead of subnet_id")
+	}
+
+	zones := p.configHelper.GetStringSlice("availability_zones", nil)
+	if len(zones) == 0 {
+		if zones, err = p.availableZones(ctx); err != nil {
+			return "", "", err
+		}
+	}
+	return "", roundRobin(zones, nodeIndex), nil
+}
+
+// availableZones lists the availability zones of the region that are up
+func (p *AWSProvider) availableZones(ctx context.Context) ([]string, error) {
+	p.zonesOnce.Do(func() {
+		result, err := p.client.DescribeAvailabilityZones(ctx, &ec2.DescribeAvailabilityZonesInput{
+			Filters: []types.Filter{
+				{Name: aws.String("state"), Values: []string{"available"}},
+				{Name: aws.String("zone-type"), Values: []string{"availability-zone"}},
+			},
+		})
+		if err != nil {
+			p.zonesErr = fmt.Errorf("failed to describe availability zones: %w", err)
+			return
+		}
+		for _, az := range result.AvailabilityZones {
+			p.zones = append(p.zones, aws.ToString(az.ZoneName))
+		}
+		if len(p.zones) == 0 {
+			p.zonesErr = fmt.Errorf("no availability zones available in region")
+		}
+	})
+	return p.zones, p.zonesErr
+}
+
+// ensurePlacementGroup creates the spread placement group unless it exists.
+// AWS limits spread groups to seven running instances per zone.
+func (p *AWSProvider) ensurePlacementGroup(ctx context.Context, name string) error {
+	p.groupOnce.Do(func() {
+		_, err := p.client.CreatePlacementGroup(ctx, &ec2.CreatePlacementGroupInput{
+			GroupName: aws.String(name),
+			Strategy:  types.PlacementStrategySpread,
+		})
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidPlacementGroup.Duplicate" {
+			err = nil
+		}
+		if err != nil {
+			p.groupErr = fmt.Errorf("failed to create placement group %s: %w", name, err)
+		}
+	})
+	return p.groupErr
+}
+
+// roundRobin picks the item for a node index, cycling through items
+func roundRobin(items []string, index int) string {
+	return items[index%len(items)]
+}
+
+// selectSSHAddress picks the instance address to SSH to based on the ssh_address setting
+// ("public", "private" or "ipv6"). An empty setting uses the instance's primary address.
+func selectSSHAddress(info *InstanceInfo, addressType string) (string, error) {
+	var host string
+	switch addressType {
+	case "":
+		host = info.IPAddress
+	case "public":
+		if info.IPAddress != info.PrivateIPAddress && info.IPAddress != info.IPv6Address {
+			host = info.IPAddress
+		}
+	case "private":
+		host = info.PrivateIPAddress
+	case "ipv6":
+		host = info.IPv6Address
+	default:
+		return "", fmt.Errorf("unsupported ssh_address '%s' (expected public, private or ipv6)", addressType)
+	}
+
+	if host == "" {
+		if addressType == "" {
+			addressType = "usable"
+		}
+		return "", fmt.Errorf("instance %s has no %s address to connect to", info.InstanceID, addressType)
+	}
+	return host, nil
+}
@@ -121,4 +121,85 @@ func TestProviderFactoryAWS(t *testing.T) {
 	require.NoError(t, err)
 	assert.NotNil(t, provider)
 	assert.Equal(t, "aws", provider.GetProviderName())
-}
\ No newline at end of file
+}
+
+// TestSelectSSHAddress tests SSH address selection for public, private and IPv6 instances
+func TestSelectSSHAddress(t *testing.T) {
+	dualStack := &InstanceInfo{
+		InstanceID:       "i-dual",
+		IPAddress:        "203.0.113.10",
+		PrivateIPAddress: "10.0.1.10",
+		IPv6Address:      "2001:db8::10",
+	}
+	privateOnly := &InstanceInfo{
+		InstanceID:       "i-private",
+		IPAddress:        "10.0.1.20",
+		PrivateIPAddress: "10.0.1.20",
+	}
+
+	host, err := selectSSHAddress(dualStack, "")
+	require.NoError(t, err)
+	assert.Equal(t, "203.0.113.10", host)
+
+	host, err = selectSSHAddress(dualStack, "private")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.1.10", host)
+
+	host, err = selectSSHAddress(dualStack, "ipv6")
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::10", host)
+
+	// A private-only instance has no public address to offer
+	_, err = selectSSHAddress(privateOnly, "public")
+	assert.Error(t, err)
+
+	_, err = selectSSHAddress(privateOnly, "ipv6")
+	assert.Error(t, err)
+
+	_, err = selectSSHAddress(dualStack, "bogus")
+	assert.Error(t, err)
+}
+
+func TestSpreadTarget(t *testing.T) {
+	ctx := context.Background()
+	provider := func(config map[string]interface{}) *AWSProvider {
+		return &AWSProvider{config: config, configHelper: NewProviderConfigHelper(config)}
+	}
+
+	// Subnets are assigned round-robin and determine the zone
+	p := provider(map[string]interface{}{
+		"spread":     []interface{}{"zones"},
+		"subnet_ids": []interface{}{"subnet-a", "subnet-b"},
+	})
+	for index, expected := range []string{"subnet-a", "subnet-b", "subnet-a"} {
+		subnetID, zone, err := p.spreadTarget(ctx, index)
+		require.NoError(t, err)
+		assert.Equal(t, expected, subnetID)
+		assert.Empty(t, zone)
+	}
+
+	// Without subnets nodes are placed in the listed zones
+	p = provider(map[string]interface{}{
+		"spread":             []interface{}{"zones", "hosts"},
+		"availability_zones": []interface{}{"us-east-1a", "us-east-1b", "us-east-1c"},
+	})
+	_, zone, err := p.spreadTarget(ctx, 4)
+	require.NoError(t, err)
+	assert.Equal(t, "us-east-1b", zone)
+	assert.True(t, p.spreads(SpreadHosts))
+
+	// A single subnet pins every node to one zone
+	p = provider(map[string]interface{}{
+		"spread":    []interface{}{"zones"},
+		"subnet_id": "subnet-a",
+	})
+	_, _, err = p.spreadTarget(ctx, 0)
+	assert.Error(t, err)
+
+	// Without spread the configured subnet is used as before
+	p = provider(map[string]interface{}{"subnet_id": "subnet-a"})
+	subnetID, zone, err := p.spreadTarget(ctx, 3)
+	require.NoError(t, err)
+	assert.Equal(t, "subnet-a", subnetID)
+	assert.Empty(t, zone)
+}
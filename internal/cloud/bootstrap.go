@@ -0,0 +1,81 @@
+package cloud
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Network modes control how the daemon reaches nodes during provisioning
+const (
+	// NetworkModeDirect deploys agents by dialing nodes over SSH (default)
+	NetworkModeDirect = "direct"
+
+	// NetworkModeEgressOnly guarantees the daemon never dials nodes. Agents are
+	// bootstrapped by the provider (e.g. EC2 user data), download themselves from
+	// the daemon and drive every further interaction over outbound connections.
+	NetworkModeEgressOnly = "egress_only"
+)
+
+// ValidateNetworkMode checks that a provider can honor the requested network mode
+func ValidateNetworkMode(providerName, mode string) error {
+	switch mode {
+	case "", NetworkModeDirect:
+		return nil
+	case NetworkModeEgressOnly:
+		if providerName == "local" {
+			return fmt.Errorf("local provider deploys agents over SSH and cannot be used with network_mode '%s'", mode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported network_mode '%s' (expected %s or %s)", mode, NetworkModeDirect, NetworkModeEgressOnly)
+	}
+}
+
+// BuildBootstrapScript returns a shell script that downloads the agent from the
+// daemon and starts it. It is used as instance user data in egress-only mode so
+// the node pulls everything it needs without any inbound connection.
+func BuildBootstrapScript(config InstanceConfig, targetOS, targetArch string) string {
+	daemonURLs := []string{config.DaemonURL}
+	if config.DaemonInternalURL != "" && config.DaemonInternalURL != config.DaemonURL {
+		daemonURLs = append(daemonURLs, config.DaemonInternalURL)
+	}
+
+	agentPath := fmt.Sprintf("/tmp/taskfly-agent-%s", config.ProvisionToken)
+	logPath := fmt.Sprintf("/tmp/taskfly-agent-%s.log", config.ProvisionToken)
+
+	agentArgs := fmt.Sprintf("--token=%s --daemon=\"$DAEMON_URL\"", config.ProvisionToken)
+	if len(daemonURLs) > 1 {
+		agentArgs += fmt.Sprintf(" --daemon-fallback='%s'", daemonURLs[1])
+	}
+
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	b.WriteString("# TaskFly egress-only bootstrap: the agent is pulled from the daemon\n")
+	b.WriteString(config.SetupScript)
+	fmt.Fprintf(&b, "for DAEMON_URL in %s; do\n", quoteShellWords(daemonURLs))
+	fmt.Fprintf(&b, "  AGENT_URL=\"$DAEMON_URL/api/v1/nodes/agent?token=%s&os=%s&arch=%s\"\n", config.ProvisionToken, targetOS, targetArch)
+	b.WriteString("  for attempt in 1 2 3 4 5 6 7 8 9 10; do\n")
+	fmt.Fprintf(&b, "    if command -v curl >/dev/null 2>&1; then curl -fsSL -o %s \"$AGENT_URL\" && break; ", agentPath)
+	fmt.Fprintf(&b, "else wget -q -O %s \"$AGENT_URL\" && break; fi\n", agentPath)
+	b.WriteString("    sleep 6\n")
+	b.WriteString("  done\n")
+	fmt.Fprintf(&b, "  if [ -s %s ]; then\n", agentPath)
+	fmt.Fprintf(&b, "    chmod +x %s\n", agentPath)
+	fmt.Fprintf(&b, "    nohup %s %s > %s 2>&1 &\n", agentPath, agentArgs, logPath)
+	b.WriteString("    exit 0\n")
+	b.WriteString("  fi\n")
+	b.WriteString("done\n")
+	b.WriteString("echo 'TaskFly bootstrap failed: could not download agent from daemon' >&2\n")
+	b.WriteString("exit 1\n")
+
+	return b.String()
+}
+
+// quoteShellWords single-quotes each word so URLs survive shell expansion
+func quoteShellWords(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = "'" + strings.ReplaceAll(w, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
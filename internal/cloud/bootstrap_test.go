@@ -0,0 +1,30 @@
+package cloud
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestValidateNetworkMode tests provider support for network modes
+func TestValidateNetworkMode(t *testing.T) {
+	assert.NoError(t, ValidateNetworkMode("aws", ""))
+	assert.NoError(t, ValidateNetworkMode("local", NetworkModeDirect))
+	assert.NoError(t, ValidateNetworkMode("aws", NetworkModeEgressOnly))
+	assert.Error(t, ValidateNetworkMode("local", NetworkModeEgressOnly))
+	assert.Error(t, ValidateNetworkMode("aws", "inbound"))
+}
+
+// TestBuildBootstrapScript tests the egress-only bootstrap script
+func TestBuildBootstrapScript(t *testing.T) {
+	script := BuildBootstrapScript(InstanceConfig{
+		ProvisionToken:    "pt-123",
+		DaemonURL:         "http://203.0.113.5:8080",
+		DaemonInternalURL: "http://10.0.0.5:8080",
+	}, "linux", "arm64")
+
+	assert.Contains(t, script, "'http://203.0.113.5:8080' 'http://10.0.0.5:8080'")
+	assert.Contains(t, script, "/api/v1/nodes/agent?token=pt-123&os=linux&arch=arm64")
+	assert.Contains(t, script, "--token=pt-123")
+	assert.Contains(t, script, "--daemon-fallback='http://10.0.0.5:8080'")
+}
@@ -0,0 +1,198 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxHostBundles is how many bundle digests are remembered per host. It
+	// matches the number of bundles agents keep in their cache.
+	MaxHostBundles = 5
+
+	// BundleIndexRetention is how long hosts that stopped being deployed to
+	// are remembered
+	BundleIndexRetention = 30 * 24 * time.Hour
+)
+
+// HostBundles holds the digests of the bundles cached on a host, most
+// recently used last
+type HostBundles struct {
+	Digests   []string  `json:"digests"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// BundleIndex remembers which bundles the agents on static hosts have cached,
+// so repeated deployments to a fixed fleet can be placed on hosts that skip
+// the download
+type BundleIndex struct {
+	mu    sync.Mutex
+	hosts map[string]*HostBundles // key is the host as configured, without brackets
+	path  string
+}
+
+// NewBundleIndex creates a bundle index persisted to path, loading existing
+// entries
+func NewBundleIndex(path string) (*BundleIndex, error) {
+	b := &BundleIndex{
+		hosts: make(map[string]*HostBundles),
+		path:  path,
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle index: %w", err)
+	}
+	if err := json.Unmarshal(data, &b.hosts); err != nil {
+		return nil, fmt.Errorf("failed to parse bundle index: %w", err)
+	}
+
+	return b, nil
+}
+
+// Record replaces the bundles known to be cached on a host with the ones its
+// agent reported and saves the index
+func (b *BundleIndex) Record(host string, digests []string) error {
+	if b == nil || host == "" {
+		return nil
+	}
+
+	b.mu.Lock()
+	if len(digests) > MaxHostBundles {
+		digests = digests[len(digests)-MaxHostBundles:]
+	}
+	b.hosts[hostKey(host)] = &HostBundles{
+		Digests:   append([]string(nil), digests...),
+		UpdatedAt: time.Now(),
+	}
+	b.mu.Unlock()
+
+	return b.Save()
+}
+
+// Add marks a bundle as cached on a host after its agent downloaded it and
+// saves the index
+func (b *BundleIndex) Add(host, digest string) error {
+	if b == nil || host == "" || digest == "" {
+		return nil
+	}
+
+	b.mu.Lock()
+	entry, exists := b.hosts[hostKey(host)]
+	if !exists {
+		entry = &HostBundles{}
+		b.hosts[hostKey(host)] = entry
+	}
+	digests := []string{}
+	for _, cached := range entry.Digests {
+		if cached != digest {
+			digests = append(digests, cached)
+		}
+	}
+	digests = append(digests, digest)
+	if len(digests) > MaxHostBundles {
+		digests = digests[len(digests)-MaxHostBundles:]
+	}
+	entry.Digests = digests
+	entry.UpdatedAt = time.Now()
+	b.mu.Unlock()
+
+	return b.Save()
+}
+
+// Holds reports whether a host is known to have a bundle cached
+func (b *BundleIndex) Holds(host, digest string) bool {
+	if b == nil || digest == "" {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, exists := b.hosts[hostKey(host)]
+	if !exists {
+		return false
+	}
+	for _, cached := range entry.Digests {
+		if cached == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// AssignHosts picks the hosts count nodes run on out of a larger set of
+// configured hosts, preferring the ones that have the bundle cached. The
+// picked hosts keep their configured order, so node indices still map to
+// hosts in the order they were listed. With no more hosts than nodes, the
+// configured hosts are returned as they are.
+func (b *BundleIndex) AssignHosts(hosts []string, count int, digest string) []string {
+	if count >= len(hosts) || digest == "" {
+		return hosts
+	}
+
+	picked := make([]int, 0, count)
+	for i, host := range hosts {
+		if len(picked) < count && b.Holds(host, digest) {
+			picked = append(picked, i)
+		}
+	}
+	for i, host := range hosts {
+		if len(picked) < count && !b.Holds(host, digest) {
+			picked = append(picked, i)
+		}
+	}
+	sort.Ints(picked)
+
+	assigned := make([]string, len(picked))
+	for i, index := range picked {
+		assigned[i] = hosts[index]
+	}
+	return assigned
+}
+
+// Save drops hosts not deployed to within the retention period and writes
+// the rest to disk
+func (b *BundleIndex) Save() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	cutoff := time.Now().Add(-BundleIndexRetention)
+	for host, entry := range b.hosts {
+		if entry.UpdatedAt.Before(cutoff) {
+			delete(b.hosts, host)
+		}
+	}
+	data, err := json.MarshalIndent(b.hosts, "", "  ")
+	b.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal bundle index: %w", err)
+	}
+
+	// Write to temp file first, then atomically rename
+	tempFile := b.path + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write temp bundle index: %w", err)
+	}
+	if err := os.Rename(tempFile, b.path); err != nil {
+		return fmt.Errorf("failed to rename bundle index: %w", err)
+	}
+
+	return nil
+}
+
+// hostKey normalizes a host the way the local provider connects to it, so
+// "[fd00::10]" and "fd00::10" are the same host
+func hostKey(host string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
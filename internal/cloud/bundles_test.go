@@ -0,0 +1,54 @@
+package cloud
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBundleIndexAssignHosts(t *testing.T) {
+	index, err := NewBundleIndex(filepath.Join(t.TempDir(), "bundle_cache.json"))
+	require.NoError(t, err)
+	hosts := []string{"10.0.0.1", "10.0.0.2", "[fd00::3]", "10.0.0.4"}
+
+	// Without cached bundles the first hosts are used
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, index.AssignHosts(hosts, 2, "abc"))
+
+	require.NoError(t, index.Record("fd00::3", []string{"abc"}))
+	require.NoError(t, index.Add("10.0.0.4", "abc"))
+	assert.True(t, index.Holds("[fd00::3]", "abc"))
+	assert.Equal(t, []string{"[fd00::3]", "10.0.0.4"}, index.AssignHosts(hosts, 2, "abc"))
+	assert.Equal(t, []string{"10.0.0.1", "[fd00::3]", "10.0.0.4"}, index.AssignHosts(hosts, 3, "abc"))
+
+	// With as many nodes as hosts every host is used in order
+	assert.Equal(t, hosts, index.AssignHosts(hosts, 4, "abc"))
+	assert.Equal(t, []string{"10.0.0.1"}, index.AssignHosts(hosts, 1, "other"))
+}
+
+func TestBundleIndexPersistsAndCaps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bundle_cache.json")
+	index, err := NewBundleIndex(path)
+	require.NoError(t, err)
+
+	for i := 0; i < MaxHostBundles+2; i++ {
+		require.NoError(t, index.Add("10.0.0.1", fmt.Sprintf("digest-%d", i)))
+	}
+	require.NoError(t, index.Add("10.0.0.1", "digest-3"))
+
+	reloaded, err := NewBundleIndex(path)
+	require.NoError(t, err)
+	assert.False(t, reloaded.Holds("10.0.0.1", "digest-1"))
+	assert.True(t, reloaded.Holds("10.0.0.1", "digest-2"))
+	assert.Equal(t, []string{"digest-2", "digest-4", "digest-5", "digest-6", "digest-3"}, reloaded.hosts["10.0.0.1"].Digests)
+
+	// Agents report what they actually have cached
+	require.NoError(t, reloaded.Record("10.0.0.1", nil))
+	assert.False(t, reloaded.Holds("10.0.0.1", "digest-3"))
+
+	var missing *BundleIndex
+	assert.False(t, missing.Holds("10.0.0.1", "digest-3"))
+	assert.NoError(t, missing.Add("10.0.0.1", "digest-3"))
+}
@@ -1,27 +1,31 @@
 package cloud
 
 import (
+	"context"
 	"fmt"
 	"time"
 )
 
 // DeploymentConfig contains all information needed to deploy an agent to a host
 type DeploymentConfig struct {
-	Host           string
-	SSHUser        string
-	SSHKeyPath     string
-	SSHPort        int
-	ProvisionToken string
-	DaemonURL      string
-	TargetOS       string
-	TargetArch     string
-	WaitForSSH     bool
-	SSHTimeout     time.Duration
+	Host              string
+	SSHUser           string
+	SSHKeyPath        string
+	SSHPort           int
+	ProvisionToken    string
+	DaemonURL         string
+	DaemonInternalURL string
+	TargetOS          string
+	TargetArch        string
+	WaitForSSH        bool
+	SSHTimeout        time.Duration
+	SetupScript       string // Optional commands run as root before the agent starts
 }
 
 // DeployAgentToHost is a unified function that both AWS and Local providers can use
-// It handles: SSH connection, agent binary retrieval, and deployment
-func DeployAgentToHost(config DeploymentConfig) error {
+// It handles: SSH connection, agent binary retrieval, and deployment, and
+// gives up once ctx ends
+func DeployAgentToHost(ctx context.Context, config DeploymentConfig) error {
 	// Set defaults
 	if config.SSHPort == 0 {
 		config.SSHPort = 22
@@ -39,13 +43,13 @@ func DeployAgentToHost(config DeploymentConfig) error {
 	// Wait for SSH if requested (typically for AWS)
 	if config.WaitForSSH {
 		fmt.Printf("Waiting for SSH to become available on %s...\n", config.Host)
-		if err := WaitForSSH(config.Host, config.SSHUser, config.SSHKeyPath, config.SSHPort, config.SSHTimeout); err != nil {
+		if err := WaitForSSH(ctx, config.Host, config.SSHUser, config.SSHKeyPath, config.SSHPort, config.SSHTimeout); err != nil {
 			return fmt.Errorf("SSH did not become available: %w", err)
 		}
 	} else {
 		// Test SSH connection (typically for Local)
 		fmt.Printf("Testing SSH connection to %s@%s...\n", config.SSHUser, config.Host)
-		if err := TestSSHConnection(config.Host, config.SSHUser, config.SSHKeyPath, config.SSHPort); err != nil {
+		if err := TestSSHConnection(ctx, config.Host, config.SSHUser, config.SSHKeyPath, config.SSHPort); err != nil {
 			return fmt.Errorf("failed to connect to host: %w", err)
 		}
 	}
@@ -60,16 +64,18 @@ func DeployAgentToHost(config DeploymentConfig) error {
 	// Deploy agent via SSH
 	fmt.Printf("Deploying agent to %s@%s...\n", config.SSHUser, config.Host)
 	deployConfig := SSHDeploymentConfig{
-		Host:           config.Host,
-		Port:           config.SSHPort,
-		User:           config.SSHUser,
-		KeyPath:        config.SSHKeyPath,
-		ProvisionToken: config.ProvisionToken,
-		DaemonURL:      config.DaemonURL,
-		AgentBinary:    agentBinary,
+		Host:              config.Host,
+		Port:              config.SSHPort,
+		User:              config.SSHUser,
+		KeyPath:           config.SSHKeyPath,
+		ProvisionToken:    config.ProvisionToken,
+		DaemonURL:         config.DaemonURL,
+		DaemonInternalURL: config.DaemonInternalURL,
+		AgentBinary:       agentBinary,
+		SetupScript:       config.SetupScript,
 	}
 
-	if err := DeployAgentViaSSH(deployConfig); err != nil {
+	if err := DeployAgentViaSSH(ctx, deployConfig); err != nil {
 		return fmt.Errorf("failed to deploy agent: %w", err)
 	}
 
@@ -1,3 +1,3 @@
 package cloud
 
-//go:generate go run ../../cmd/build-agents/main.go
+//go:generate go run ../../cmd/build-agents
@@ -0,0 +1,85 @@
+package cloud
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// InstanceIdentity is the part of an EC2 instance identity document the
+// daemon checks at registration
+type InstanceIdentity struct {
+	InstanceID string `json:"instanceId"`
+	AccountID  string `json:"accountId"`
+	Region     string `json:"region"`
+	ImageID    string `json:"imageId"`
+}
+
+// LoadIdentityCertificates reads the AWS public certificates instance identity
+// signatures are checked against. The file holds one or more PEM certificates,
+// typically the RSA certificates of every region nodes are launched in.
+func LoadIdentityCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity certificates: %w", err)
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse identity certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return certs, nil
+}
+
+// VerifyInstanceIdentity checks the base64 RSA-SHA256 signature of an instance
+// identity document, as served by the instance metadata service, against
+// certs and returns the parsed document
+func VerifyInstanceIdentity(document, signature string, certs []*x509.Certificate) (*InstanceIdentity, error) {
+	if document == "" || signature == "" {
+		return nil, fmt.Errorf("instance identity document and signature are required")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(signature), ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid instance identity signature: %w", err)
+	}
+
+	verified := false
+	for _, cert := range certs {
+		if cert.CheckSignature(x509.SHA256WithRSA, []byte(document), sig) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("instance identity signature does not match any trusted certificate")
+	}
+
+	var identity InstanceIdentity
+	if err := json.Unmarshal([]byte(document), &identity); err != nil {
+		return nil, fmt.Errorf("invalid instance identity document: %w", err)
+	}
+	if identity.InstanceID == "" {
+		return nil, fmt.Errorf("instance identity document has no instance ID")
+	}
+	return &identity, nil
+}
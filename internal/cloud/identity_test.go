@@ -0,0 +1,96 @@
+package cloud
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// identityCertificate creates a self-signed certificate standing in for an
+// AWS region certificate
+func identityCertificate(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Amazon Web Services LLC"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return key, cert
+}
+
+// signIdentity signs a document the way the instance metadata service does
+func signIdentity(t *testing.T, key *rsa.PrivateKey, document string) string {
+	digest := sha256.Sum256([]byte(document))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// TestVerifyInstanceIdentity tests accepting signed documents and rejecting
+// tampered or foreign ones
+func TestVerifyInstanceIdentity(t *testing.T) {
+	key, cert := identityCertificate(t)
+	_, otherCert := identityCertificate(t)
+	document := `{"instanceId": "i-0abc123", "accountId": "123456789012", "region": "us-east-1", "imageId": "ami-0123"}`
+	signature := signIdentity(t, key, document)
+
+	identity, err := VerifyInstanceIdentity(document, signature, []*x509.Certificate{otherCert, cert})
+	require.NoError(t, err)
+	assert.Equal(t, "i-0abc123", identity.InstanceID)
+	assert.Equal(t, "123456789012", identity.AccountID)
+	assert.Equal(t, "us-east-1", identity.Region)
+
+	// The metadata service wraps the signature over several lines
+	_, err = VerifyInstanceIdentity(document, signature[:40]+"\n"+signature[40:], []*x509.Certificate{cert})
+	assert.NoError(t, err)
+
+	tampered := `{"instanceId": "i-0evil", "accountId": "123456789012", "region": "us-east-1", "imageId": "ami-0123"}`
+	_, err = VerifyInstanceIdentity(tampered, signature, []*x509.Certificate{cert})
+	assert.Error(t, err)
+
+	_, err = VerifyInstanceIdentity(document, signature, []*x509.Certificate{otherCert})
+	assert.Error(t, err)
+
+	_, err = VerifyInstanceIdentity(document, "", []*x509.Certificate{cert})
+	assert.Error(t, err)
+}
+
+// TestLoadIdentityCertificates tests reading a bundle of PEM certificates
+func TestLoadIdentityCertificates(t *testing.T) {
+	_, first := identityCertificate(t)
+	_, second := identityCertificate(t)
+
+	path := filepath.Join(t.TempDir(), "aws-identity.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: first.Raw})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: second.Raw})...)
+	require.NoError(t, os.WriteFile(path, data, 0600))
+
+	certs, err := LoadIdentityCertificates(path)
+	require.NoError(t, err)
+	assert.Len(t, certs, 2)
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	require.NoError(t, os.WriteFile(empty, []byte("not a certificate"), 0600))
+	_, err = LoadIdentityCertificates(empty)
+	assert.Error(t, err)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -29,10 +30,15 @@ func (p *LocalProvider) GetProviderName() string {
 
 // ProvisionInstance for local provider means connecting to an existing host via SSH
 func (p *LocalProvider) ProvisionInstance(ctx context.Context, config InstanceConfig) (*InstanceInfo, error) {
-	var host string
+	if config.EgressOnly {
+		return nil, ValidateNetworkMode(p.GetProviderName(), NetworkModeEgressOnly)
+	}
+
+	// A host picked by the orchestrator takes precedence
+	host := config.Host
 
-	// Check for multiple hosts first
-	if hostsInterface, ok := p.config["hosts"]; ok {
+	// Check for multiple hosts next
+	if hostsInterface, ok := p.config["hosts"]; ok && host == "" {
 		if hostSlice, ok := hostsInterface.([]interface{}); ok {
 			if len(hostSlice) > config.NodeIndex {
 				if hostStr, ok := hostSlice[config.NodeIndex].(string); ok {
@@ -53,6 +59,9 @@ func (p *LocalProvider) ProvisionInstance(ctx context.Context, config InstanceCo
 		return nil, fmt.Errorf("host not specified in local provider config (checked both 'host' and 'hosts[%d]')", config.NodeIndex)
 	}
 
+	// Accept bracketed IPv6 literals such as "[fd00::10]"
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
 	sshUser, ok := p.config["ssh_user"].(string)
 	if !ok || sshUser == "" {
 		return nil, fmt.Errorf("ssh_user not specified in local provider config")
@@ -78,19 +87,20 @@ func (p *LocalProvider) ProvisionInstance(ctx context.Context, config InstanceCo
 
 	// Deploy agent using unified deployment function
 	deployConfig := DeploymentConfig{
-		Host:           host,
-		SSHUser:        sshUser,
-		SSHKeyPath:     sshKeyPath,
-		SSHPort:        22,
-		ProvisionToken: config.ProvisionToken,
-		DaemonURL:      config.DaemonURL,
-		TargetOS:       targetOS,
-		TargetArch:     targetArch,
-		WaitForSSH:     false, // Local hosts should already be accessible
-		SSHTimeout:     0,
+		Host:              host,
+		SSHUser:           sshUser,
+		SSHKeyPath:        sshKeyPath,
+		SSHPort:           22,
+		ProvisionToken:    config.ProvisionToken,
+		DaemonURL:         config.DaemonURL,
+		DaemonInternalURL: config.DaemonInternalURL,
+		TargetOS:          targetOS,
+		TargetArch:        targetArch,
+		WaitForSSH:        false, // Local hosts should already be accessible
+		SSHTimeout:        0,
 	}
 
-	if err := DeployAgentToHost(deployConfig); err != nil {
+	if err := DeployAgentToHost(ctx, deployConfig); err != nil {
 		return nil, fmt.Errorf("failed to deploy agent: %w", err)
 	}
 
@@ -0,0 +1,106 @@
+package cloud
+
+import (
+	"sort"
+	"strings"
+)
+
+// InstanceSpec describes the size and approximate price of an instance type
+type InstanceSpec struct {
+	VCPUs       int
+	MemoryGiB   float64
+	HourlyPrice float64
+}
+
+// awsInstanceTypes holds sizes and approximate on-demand Linux prices in USD
+// for us-east-1. They are only used for cost estimates and right-sizing
+// suggestions.
+var awsInstanceTypes = map[string]InstanceSpec{
+	"t2.micro":   {1, 1, 0.0116},
+	"t2.small":   {1, 2, 0.023},
+	"t2.medium":  {2, 4, 0.0464},
+	"t2.large":   {2, 8, 0.0928},
+	"t3.nano":    {2, 0.5, 0.0052},
+	"t3.micro":   {2, 1, 0.0104},
+	"t3.small":   {2, 2, 0.0208},
+	"t3.medium":  {2, 4, 0.0416},
+	"t3.large":   {2, 8, 0.0832},
+	"t3.xlarge":  {4, 16, 0.1664},
+	"t3.2xlarge": {8, 32, 0.3328},
+	"t3a.micro":  {2, 1, 0.0094},
+	"t3a.small":  {2, 2, 0.0188},
+	"t3a.medium": {2, 4, 0.0376},
+	"t3a.large":  {2, 8, 0.0752},
+	"t4g.micro":  {2, 1, 0.0084},
+	"t4g.small":  {2, 2, 0.0168},
+	"t4g.medium": {2, 4, 0.0336},
+	"t4g.large":  {2, 8, 0.0672},
+	"m5.large":   {2, 8, 0.096},
+	"m5.xlarge":  {4, 16, 0.192},
+	"m5.2xlarge": {8, 32, 0.384},
+	"m5.4xlarge": {16, 64, 0.768},
+	"m6i.large":  {2, 8, 0.096},
+	"m6i.xlarge": {4, 16, 0.192},
+	"m6g.large":  {2, 8, 0.077},
+	"m6g.xlarge": {4, 16, 0.154},
+	"m7g.large":  {2, 8, 0.0816},
+	"c5.large":   {2, 4, 0.085},
+	"c5.xlarge":  {4, 8, 0.17},
+	"c5.2xlarge": {8, 16, 0.34},
+	"c5.4xlarge": {16, 32, 0.68},
+	"c6i.large":  {2, 4, 0.085},
+	"c6g.large":  {2, 4, 0.068},
+	"c7g.large":  {2, 4, 0.0725},
+	"r5.large":   {2, 16, 0.126},
+	"r5.xlarge":  {4, 32, 0.252},
+	"r6i.large":  {2, 16, 0.126},
+	"r6g.large":  {2, 16, 0.1008},
+}
+
+// HourlyPrice returns the estimated hourly price of an instance type in USD.
+// The second return value is false when no estimate is known.
+func HourlyPrice(provider, instanceType string) (float64, bool) {
+	if provider == "local" || provider == "mock" || provider == ProviderSimulate {
+		return 0, true
+	}
+	spec, ok := LookupInstance(provider, instanceType)
+	return spec.HourlyPrice, ok
+}
+
+// LookupInstance returns the size and price of a known instance type
+func LookupInstance(provider, instanceType string) (InstanceSpec, bool) {
+	if provider != "aws" {
+		return InstanceSpec{}, false
+	}
+	spec, ok := awsInstanceTypes[instanceType]
+	return spec, ok
+}
+
+// CheapestInstance returns the cheapest known instance type in the same
+// family as instanceType (e.g. t3 for t3.large) with at least the given
+// vCPUs and memory. Staying in the family keeps the CPU architecture and
+// AMI compatible.
+func CheapestInstance(provider, instanceType string, vcpus, memoryGiB float64) (string, bool) {
+	if provider != "aws" {
+		return "", false
+	}
+	family, _, found := strings.Cut(instanceType, ".")
+	if !found {
+		return "", false
+	}
+
+	candidates := make([]string, 0)
+	for name, spec := range awsInstanceTypes {
+		if strings.HasPrefix(name, family+".") && float64(spec.VCPUs) >= vcpus && spec.MemoryGiB >= memoryGiB {
+			candidates = append(candidates, name)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return awsInstanceTypes[candidates[i]].HourlyPrice < awsInstanceTypes[candidates[j]].HourlyPrice
+	})
+	return candidates[0], true
+}
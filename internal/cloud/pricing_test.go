@@ -0,0 +1,37 @@
+package cloud
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCheapestInstance tests that suggestions stay within the instance family
+func TestCheapestInstance(t *testing.T) {
+	tests := []struct {
+		name         string
+		instanceType string
+		vcpus        float64
+		memoryGiB    float64
+		expected     string
+		found        bool
+	}{
+		{"downsize within t3", "t3.xlarge", 1, 3, "t3.medium", true},
+		{"upsize for cpu", "t3.small", 3, 1, "t3.xlarge", true},
+		{"same size", "m5.large", 2, 8, "m5.large", true},
+		{"nothing large enough", "c6g.large", 4, 4, "", false},
+		{"unknown family", "z1d.large", 1, 1, "", false},
+		{"not an instance type", "large", 1, 1, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			suggested, found := CheapestInstance("aws", tt.instanceType, tt.vcpus, tt.memoryGiB)
+			assert.Equal(t, tt.found, found)
+			assert.Equal(t, tt.expected, suggested)
+		})
+	}
+
+	_, found := CheapestInstance("local", "t3.large", 1, 1)
+	assert.False(t, found)
+}
@@ -0,0 +1,142 @@
+package cloud
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ProviderSimulate is the provider of deployments created with --simulate.
+// It replaces the configured provider, which is validated but never called.
+const ProviderSimulate = "simulate"
+
+// processStopTimeout is how long a simulated node's agent gets to exit after
+// being asked to before it is killed
+const processStopTimeout = 10 * time.Second
+
+// agentProcess is the agent of a simulated node
+type agentProcess struct {
+	cmd  *exec.Cmd
+	done chan struct{} // closed once the agent has exited and is cleaned up
+}
+
+// agentProcesses holds the agent processes of all simulated nodes by
+// instance ID. Providers are created per operation, so the processes can't
+// live on the provider.
+var agentProcesses sync.Map
+
+// ProcessProvider implements the Provider interface by running the real
+// agent as a process on the daemon host, with a temporary working directory
+// per node. The agent registers, downloads the bundle and runs its script
+// like on a real instance.
+type ProcessProvider struct{}
+
+// NewProcessProvider creates a new simulate provider
+func NewProcessProvider() *ProcessProvider {
+	return &ProcessProvider{}
+}
+
+// GetProviderName returns the provider name
+func (p *ProcessProvider) GetProviderName() string {
+	return ProviderSimulate
+}
+
+// ProvisionInstance starts an agent process for the node. Its output goes to
+// /tmp/taskfly-agent-<provision token>.log like on bootstrapped instances. The
+// working directory is removed when the agent exits, unless the deployment is
+// debugged.
+func (p *ProcessProvider) ProvisionInstance(ctx context.Context, config InstanceConfig) (*InstanceInfo, error) {
+	binary, err := AgentExecutable()
+	if err != nil {
+		return nil, err
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, fmt.Errorf("failed to generate instance ID: %w", err)
+	}
+	instanceID := "sim-" + hex.EncodeToString(suffix)
+
+	workDir, err := os.MkdirTemp("", fmt.Sprintf("taskfly-simulate-node%d-", config.NodeIndex))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create working directory: %w", err)
+	}
+	logFile, err := os.Create(filepath.Join(os.TempDir(), fmt.Sprintf("taskfly-agent-%s.log", config.ProvisionToken)))
+	if err != nil {
+		os.RemoveAll(workDir)
+		return nil, fmt.Errorf("failed to create agent log: %w", err)
+	}
+
+	args := []string{"--token=" + config.ProvisionToken, "--daemon=" + config.DaemonURL, "--workdir=" + workDir}
+	if config.DaemonInternalURL != "" && config.DaemonInternalURL != config.DaemonURL {
+		args = append(args, "--daemon-fallback="+config.DaemonInternalURL)
+	}
+	cmd := exec.Command(binary, args...)
+	cmd.Dir = workDir
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		os.RemoveAll(workDir)
+		return nil, fmt.Errorf("failed to start agent: %w", err)
+	}
+
+	// The agent exits when its node is shut down, which ends the simulated
+	// instance like a terminated machine
+	process := &agentProcess{cmd: cmd, done: make(chan struct{})}
+	agentProcesses.Store(instanceID, process)
+	go func() {
+		cmd.Wait()
+		logFile.Close()
+		if !config.Debug {
+			os.RemoveAll(workDir)
+		}
+		agentProcesses.Delete(instanceID)
+		close(process.done)
+	}()
+
+	return &InstanceInfo{
+		InstanceID:       instanceID,
+		IPAddress:        "127.0.0.1",
+		PrivateIPAddress: "127.0.0.1",
+		Status:           "running",
+	}, nil
+}
+
+// GetInstanceStatus reports whether a node's agent process is still running.
+// Processes started before a daemon restart count as terminated.
+func (p *ProcessProvider) GetInstanceStatus(ctx context.Context, instanceID string) (string, error) {
+	if _, ok := agentProcesses.Load(instanceID); !ok {
+		return "terminated", nil
+	}
+	return "running", nil
+}
+
+// TerminateInstance stops a node's agent, which stops its script. The node's
+// working directory is removed once the agent has exited, unless the
+// deployment is debugged.
+func (p *ProcessProvider) TerminateInstance(ctx context.Context, instanceID string) error {
+	value, ok := agentProcesses.Load(instanceID)
+	if !ok {
+		return nil
+	}
+	process := value.(*agentProcess)
+
+	// Let the agent push its last logs and stop the script, then kill it
+	if err := process.cmd.Process.Signal(os.Interrupt); err != nil {
+		process.cmd.Process.Kill()
+	}
+	select {
+	case <-process.done:
+	case <-time.After(processStopTimeout):
+		process.cmd.Process.Kill()
+		<-process.done
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAgent installs a shell script as the agent binary of this platform. It
+// records its arguments and sleeps until it is stopped.
+func fakeAgent(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake agent is a shell script")
+	}
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s\nexec sleep 60\n", argsFile)
+	binary := filepath.Join(dir, fmt.Sprintf("taskfly-agent-%s-%s", runtime.GOOS, runtime.GOARCH))
+	require.NoError(t, os.WriteFile(binary, []byte(script), 0755))
+
+	previous := AgentDir
+	AgentDir = dir
+	t.Cleanup(func() { AgentDir = previous })
+	return argsFile
+}
+
+func TestProcessProviderRunsAgent(t *testing.T) {
+	argsFile := fakeAgent(t)
+	ctx := context.Background()
+	provider := NewProcessProvider()
+
+	info, err := provider.ProvisionInstance(ctx, InstanceConfig{ProvisionToken: "pt_test", DaemonURL: "http://127.0.0.1:8080"})
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(filepath.Join(os.TempDir(), "taskfly-agent-pt_test.log")) })
+
+	var args string
+	require.Eventually(t, func() bool {
+		data, err := os.ReadFile(argsFile)
+		args = strings.TrimSpace(string(data))
+		return err == nil && args != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, args, "--token=pt_test --daemon=http://127.0.0.1:8080 --workdir=")
+	workDir := strings.SplitN(args, "--workdir=", 2)[1]
+	assert.DirExists(t, workDir)
+
+	status, err := provider.GetInstanceStatus(ctx, info.InstanceID)
+	require.NoError(t, err)
+	assert.Equal(t, "running", status)
+
+	// Terminating stops the agent and removes its working directory
+	require.NoError(t, provider.TerminateInstance(ctx, info.InstanceID))
+	status, err = provider.GetInstanceStatus(ctx, info.InstanceID)
+	require.NoError(t, err)
+	assert.Equal(t, "terminated", status)
+	assert.NoDirExists(t, workDir)
+}
+
+func TestProcessProviderKeepsDebugWorkDir(t *testing.T) {
+	argsFile := fakeAgent(t)
+	ctx := context.Background()
+	provider := NewProcessProvider()
+
+	info, err := provider.ProvisionInstance(ctx, InstanceConfig{ProvisionToken: "pt_debug", DaemonURL: "http://127.0.0.1:8080", Debug: true})
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(filepath.Join(os.TempDir(), "taskfly-agent-pt_debug.log")) })
+
+	var args string
+	require.Eventually(t, func() bool {
+		data, err := os.ReadFile(argsFile)
+		args = strings.TrimSpace(string(data))
+		return err == nil && args != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	workDir := strings.SplitN(args, "--workdir=", 2)[1]
+	t.Cleanup(func() { os.RemoveAll(workDir) })
+
+	require.NoError(t, provider.TerminateInstance(ctx, info.InstanceID))
+	assert.DirExists(t, workDir)
+}
+
+func TestProcessProviderMissingAgent(t *testing.T) {
+	previous := AgentDir
+	AgentDir = t.TempDir()
+	t.Cleanup(func() { AgentDir = previous })
+
+	_, err := NewProcessProvider().ProvisionInstance(context.Background(), InstanceConfig{ProvisionToken: "pt_missing"})
+	assert.ErrorContains(t, err, "agent binary for")
+}
@@ -3,6 +3,7 @@ package cloud
 import (
 	"context"
 	"fmt"
+	"time"
 )
 
 // InstanceConfig represents the configuration for provisioning an instance
@@ -21,16 +22,23 @@ type InstanceConfig struct {
 	Host string
 
 	// Bootstrap configuration
-	ProvisionToken string
-	DaemonURL      string
-	NodeConfig     map[string]interface{} // Node-specific configuration/environment variables
+	ProvisionToken    string
+	DaemonURL         string
+	DaemonInternalURL string                 // Optional fallback callback URL reachable from private networks
+	NodeConfig        map[string]interface{} // Node-specific configuration/environment variables
+	EgressOnly        bool                   // Bootstrap without the daemon ever dialing the node
+	SetupScript       string                 // Commands run as root before the agent starts, set by providers
+	Debug             bool                   // The deployment is debugged, working directories are kept
 }
 
 // InstanceInfo represents information about a provisioned instance
 type InstanceInfo struct {
-	InstanceID string
-	IPAddress  string
-	Status     string
+	InstanceID       string
+	IPAddress        string // Address used to reach the instance (public when available)
+	PrivateIPAddress string // Private/internal IPv4 address, if any
+	IPv6Address      string // Primary IPv6 address, if any
+	AvailabilityZone string // Zone the instance runs in, if the provider has zones
+	Status           string
 }
 
 // Provider defines the interface for cloud providers
@@ -48,6 +56,59 @@ type Provider interface {
 	GetProviderName() string
 }
 
+// ImageBaker is implemented by providers that can save an instance as a
+// machine image new deployments can be launched from
+type ImageBaker interface {
+	// BakeImage starts creating an image of an instance and returns its ID.
+	// Without reboot the filesystem may not be consistent.
+	BakeImage(ctx context.Context, instanceID, name string, reboot bool) (string, error)
+}
+
+// OwnsInstances reports whether a provider creates the instances it runs
+// nodes on. Instances of such providers have to be terminated once they are
+// no longer needed, while those of the local provider are existing hosts that
+// are left alone.
+func OwnsInstances(providerName string) bool {
+	return providerName != "local"
+}
+
+// InstanceTerminated reports whether an instance status returned by
+// GetInstanceStatus means the instance is gone or irreversibly on its way out
+func InstanceTerminated(status string) bool {
+	return status == "terminated" || status == "shutting-down"
+}
+
+// provisionTimeouts are how long provisioning one node may take by default,
+// per provider. AWS covers the instance starting, SSH coming up and the agent
+// upload.
+var provisionTimeouts = map[string]time.Duration{
+	"aws":            15 * time.Minute,
+	"local":          5 * time.Minute,
+	"mock":           5 * time.Minute,
+	ProviderSimulate: time.Minute,
+}
+
+// DefaultProvisionTimeout applies to providers without a default of their own
+const DefaultProvisionTimeout = 10 * time.Minute
+
+// ProvisionTimeout returns how long ProvisionInstance may take for one node:
+// provision_timeout of the provider's instance config, such as "20m", or
+// else the provider's default
+func ProvisionTimeout(providerName string, config map[string]interface{}) (time.Duration, error) {
+	if value, ok := config["provision_timeout"]; ok {
+		text, _ := value.(string)
+		timeout, err := time.ParseDuration(text)
+		if err != nil || timeout <= 0 {
+			return 0, fmt.Errorf("provision_timeout must be a duration such as 10m")
+		}
+		return timeout, nil
+	}
+	if timeout, ok := provisionTimeouts[providerName]; ok {
+		return timeout, nil
+	}
+	return DefaultProvisionTimeout, nil
+}
+
 // ProviderFactory creates cloud providers
 type ProviderFactory struct{}
 
@@ -58,6 +119,10 @@ func (f *ProviderFactory) NewProvider(providerName string, config map[string]int
 		return NewAWSProvider(config)
 	case "local":
 		return NewLocalProvider(config)
+	case "mock":
+		return NewSimulatedProvider(config)
+	case ProviderSimulate:
+		return NewProcessProvider(), nil
 	default:
 		return nil, fmt.Errorf("unsupported cloud provider: %s", providerName)
 	}
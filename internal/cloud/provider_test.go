@@ -0,0 +1,28 @@
+package cloud
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvisionTimeout(t *testing.T) {
+	timeout, err := ProvisionTimeout("aws", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, timeout)
+
+	timeout, err = ProvisionTimeout("unknown", nil)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultProvisionTimeout, timeout)
+
+	timeout, err = ProvisionTimeout("local", map[string]interface{}{"provision_timeout": "90s"})
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Second, timeout)
+
+	for _, value := range []interface{}{"soon", "0s", "-1m", 30} {
+		_, err := ProvisionTimeout("aws", map[string]interface{}{"provision_timeout": value})
+		assert.Error(t, err, "provision_timeout %v", value)
+	}
+}
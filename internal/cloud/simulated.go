@@ -0,0 +1,498 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/signing"
+)
+
+// The mock provider launches no machines. Each "instance" is a goroutine in
+// the daemon that speaks the agent protocol to the daemon's API, so
+// deployments go through registration, status updates and heartbeats like
+// real ones. Faults are injected per node with configurable rates.
+
+// SimulationConfig is the instance_config of the mock provider
+type SimulationConfig struct {
+	// TimeScale divides every simulated duration, e.g. 60 runs a simulated
+	// minute in a second. Heartbeats are not scaled, since the daemon judges
+	// liveness in real time.
+	TimeScale float64
+
+	// Seed makes the injected faults repeatable: with the same seed, node N
+	// always gets the same faults. 0 picks faults at random.
+	Seed int64
+
+	ProvisionTime     time.Duration // how long ProvisionInstance takes
+	BootTime          time.Duration // from provisioning to agent registration
+	RunTime           time.Duration // how long the workload runs
+	SlowBootTime      time.Duration // boot time of nodes with a slow boot
+	HeartbeatInterval time.Duration // real time between heartbeats
+
+	// Probability of each fault per node, between 0 and 1
+	ProvisionErrorRate float64 // ProvisionInstance fails
+	SlowBootRate       float64 // the node boots in SlowBootTime
+	CrashRate          float64 // the instance dies during the run
+	HeartbeatLossRate  float64 // heartbeats stop during the run, the workload finishes
+	FailureRate        float64 // the workload exits with code 1
+}
+
+// ParseSimulationConfig reads the instance_config of the mock provider
+func ParseSimulationConfig(config map[string]interface{}) (*SimulationConfig, error) {
+	helper := NewProviderConfigHelper(config)
+	sim := &SimulationConfig{
+		TimeScale: 1,
+		Seed:      int64(helper.GetInt("seed", 0)),
+	}
+
+	if value, ok := config["time_scale"]; ok {
+		scale, ok := toFloat(value)
+		if !ok || scale <= 0 {
+			return nil, fmt.Errorf("time_scale must be a number greater than 0")
+		}
+		sim.TimeScale = scale
+	}
+
+	durations := []struct {
+		key   string
+		value *time.Duration
+		def   time.Duration
+	}{
+		{"provision_time", &sim.ProvisionTime, 2 * time.Second},
+		{"boot_time", &sim.BootTime, 30 * time.Second},
+		{"run_time", &sim.RunTime, time.Minute},
+		{"slow_boot_time", &sim.SlowBootTime, 10 * time.Minute},
+		{"heartbeat_interval", &sim.HeartbeatInterval, 3 * time.Second},
+	}
+	for _, d := range durations {
+		*d.value = d.def
+		value, ok := config[d.key]
+		if !ok {
+			continue
+		}
+		text, _ := value.(string)
+		parsed, err := time.ParseDuration(text)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("%s must be a duration such as 30s or 5m", d.key)
+		}
+		*d.value = parsed
+	}
+	if sim.HeartbeatInterval <= 0 {
+		return nil, fmt.Errorf("heartbeat_interval must be greater than 0")
+	}
+
+	rates := []struct {
+		key   string
+		value *float64
+	}{
+		{"provision_error_rate", &sim.ProvisionErrorRate},
+		{"slow_boot_rate", &sim.SlowBootRate},
+		{"crash_rate", &sim.CrashRate},
+		{"heartbeat_loss_rate", &sim.HeartbeatLossRate},
+		{"failure_rate", &sim.FailureRate},
+	}
+	for _, r := range rates {
+		value, ok := config[r.key]
+		if !ok {
+			continue
+		}
+		rate, ok := toFloat(value)
+		if !ok || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("%s must be a number between 0 and 1", r.key)
+		}
+		*r.value = rate
+	}
+
+	return sim, nil
+}
+
+// toFloat converts a number from YAML or JSON
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// scaled compresses a simulated duration by the time scale
+func (s *SimulationConfig) scaled(d time.Duration) time.Duration {
+	return time.Duration(float64(d) / s.TimeScale)
+}
+
+// simulatedFaults are the faults picked for one node
+type simulatedFaults struct {
+	provisionError bool
+	slowBoot       bool
+	crash          bool
+	heartbeatLoss  bool
+	failure        bool
+
+	// faultAt is the fraction of the run after which a crash or heartbeat
+	// loss happens
+	faultAt float64
+}
+
+// pickFaults draws the faults of a node. With a seed the draw only depends on
+// the seed and the node index, not on the order nodes are provisioned in.
+func (s *SimulationConfig) pickFaults(nodeIndex int) simulatedFaults {
+	var rng *mathrand.Rand
+	if s.Seed != 0 {
+		rng = mathrand.New(mathrand.NewPCG(uint64(s.Seed), uint64(nodeIndex)))
+	} else {
+		rng = mathrand.New(mathrand.NewPCG(mathrand.Uint64(), mathrand.Uint64()))
+	}
+
+	// Always draw every value, so one rate doesn't shift the others
+	return simulatedFaults{
+		provisionError: rng.Float64() < s.ProvisionErrorRate,
+		slowBoot:       rng.Float64() < s.SlowBootRate,
+		crash:          rng.Float64() < s.CrashRate,
+		heartbeatLoss:  rng.Float64() < s.HeartbeatLossRate,
+		failure:        rng.Float64() < s.FailureRate,
+		faultAt:        0.2 + 0.6*rng.Float64(),
+	}
+}
+
+// simulatedInstance is a running mock instance
+type simulatedInstance struct {
+	mu     sync.Mutex
+	status string
+	cancel context.CancelFunc
+}
+
+func (i *simulatedInstance) setStatus(status string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.status = status
+}
+
+func (i *simulatedInstance) getStatus() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.status
+}
+
+// simulatedInstances holds the mock instances of all deployments. Providers
+// are created per operation, so the instances can't live on the provider.
+var simulatedInstances sync.Map // instance ID -> *simulatedInstance
+
+// SimulatedProvider implements the Provider interface with simulated
+// instances for testing and failure rehearsals
+type SimulatedProvider struct {
+	config *SimulationConfig
+	client *http.Client
+}
+
+// NewSimulatedProvider creates a new mock provider
+func NewSimulatedProvider(config map[string]interface{}) (*SimulatedProvider, error) {
+	sim, err := ParseSimulationConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mock provider config: %w", err)
+	}
+	return &SimulatedProvider{
+		config: sim,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// GetProviderName returns the provider name
+func (p *SimulatedProvider) GetProviderName() string {
+	return "mock"
+}
+
+// ProvisionInstance starts a simulated instance whose agent registers with
+// config.ProvisionToken once it has booted
+func (p *SimulatedProvider) ProvisionInstance(ctx context.Context, config InstanceConfig) (*InstanceInfo, error) {
+	faults := p.config.pickFaults(config.NodeIndex)
+
+	select {
+	case <-time.After(p.config.scaled(p.config.ProvisionTime)):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if faults.provisionError {
+		return nil, fmt.Errorf("mock provider: injected provision error for node %d", config.NodeIndex)
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, fmt.Errorf("failed to generate instance ID: %w", err)
+	}
+	instanceID := "mock-" + hex.EncodeToString(suffix)
+
+	agentCtx, cancel := context.WithCancel(context.Background())
+	instance := &simulatedInstance{status: "running", cancel: cancel}
+	simulatedInstances.Store(instanceID, instance)
+
+	agent := &simulatedAgent{
+		provider: p,
+		config:   config,
+		faults:   faults,
+		instance: instance,
+	}
+	go agent.run(agentCtx)
+
+	return &InstanceInfo{
+		InstanceID:       instanceID,
+		IPAddress:        "127.0.0.1",
+		PrivateIPAddress: "127.0.0.1",
+		AvailabilityZone: "mock-zone-a",
+		Status:           "running",
+	}, nil
+}
+
+// GetInstanceStatus returns the status of a simulated instance. Instances
+// lost with a daemon restart count as terminated.
+func (p *SimulatedProvider) GetInstanceStatus(ctx context.Context, instanceID string) (string, error) {
+	value, ok := simulatedInstances.Load(instanceID)
+	if !ok {
+		return "terminated", nil
+	}
+	return value.(*simulatedInstance).getStatus(), nil
+}
+
+// TerminateInstance stops a simulated instance's agent
+func (p *SimulatedProvider) TerminateInstance(ctx context.Context, instanceID string) error {
+	value, ok := simulatedInstances.Load(instanceID)
+	if !ok {
+		return nil
+	}
+	instance := value.(*simulatedInstance)
+	instance.cancel()
+	instance.setStatus("terminated")
+	return nil
+}
+
+// simulatedAgent plays the agent of a simulated instance
+type simulatedAgent struct {
+	provider *SimulatedProvider
+	config   InstanceConfig
+	faults   simulatedFaults
+	instance *simulatedInstance
+
+	authToken     string
+	signingSecret string
+	heartbeatURL  string
+	statusURL     string
+	progressURL   string
+}
+
+// run boots, registers and runs the simulated workload until it finishes,
+// the instance crashes or the daemon shuts the node down
+func (a *simulatedAgent) run(ctx context.Context) {
+	sim := a.provider.config
+	boot := sim.BootTime
+	if a.faults.slowBoot {
+		boot = sim.SlowBootTime
+	}
+	if !sleepContext(ctx, sim.scaled(boot)) {
+		return
+	}
+
+	if err := a.register(ctx); err != nil {
+		// A real agent that can't register never shows up either
+		return
+	}
+
+	// Heartbeats run until the node is shut down, or are lost midway
+	ctx, shutdown := context.WithCancel(ctx)
+	defer shutdown()
+	runTime := sim.scaled(sim.RunTime)
+	faultAfter := time.Duration(float64(runTime) * a.faults.faultAt)
+	heartbeatsUntil := time.Time{}
+	if a.faults.heartbeatLoss {
+		heartbeatsUntil = time.Now().Add(faultAfter)
+	}
+	go a.heartbeatLoop(ctx, shutdown, heartbeatsUntil)
+
+	for _, phase := range []struct{ status, message string }{
+		{"downloading_assets", "Downloading deployment bundle (simulated)"},
+		{"extracting", "Extracting deployment bundle (simulated)"},
+		{"running", "Executing deployment script (simulated)"},
+	} {
+		if err := a.sendStatus(ctx, phase.status, phase.message, nil); err != nil {
+			return
+		}
+	}
+
+	if a.faults.crash {
+		if !sleepContext(ctx, faultAfter) {
+			return
+		}
+		// The instance dies without a word to the daemon
+		a.instance.setStatus("terminated")
+		a.instance.cancel()
+		return
+	}
+
+	// Report progress along the way, like a workload using the progress URL
+	const steps = 10
+	for step := 1; step <= steps; step++ {
+		if !sleepContext(ctx, runTime/steps) {
+			return
+		}
+		a.post(ctx, a.progressURL, map[string]interface{}{"progress": float64(step * 100 / steps)})
+	}
+
+	exitCode := 0
+	status, message := "completed", "Deployment script completed successfully (simulated)"
+	if a.faults.failure {
+		exitCode = 1
+		status, message = "failed", "Deployment script failed: exit status 1 (simulated)"
+	}
+	if err := a.sendStatus(ctx, status, message, &exitCode); err != nil {
+		return
+	}
+
+	// Stay up like a finished agent until the daemon shuts the node down
+	<-ctx.Done()
+}
+
+// register exchanges the provision token for the node's credentials, trying
+// the internal daemon URL if the public one fails
+func (a *simulatedAgent) register(ctx context.Context) error {
+	urls := []string{a.config.DaemonURL}
+	if a.config.DaemonInternalURL != "" && a.config.DaemonInternalURL != a.config.DaemonURL {
+		urls = append(urls, a.config.DaemonInternalURL)
+	}
+
+	var lastErr error
+	for _, url := range urls {
+		var result struct {
+			AuthToken     string `json:"auth_token"`
+			SigningSecret string `json:"signing_secret"`
+			HeartbeatURL  string `json:"heartbeat_url"`
+			StatusURL     string `json:"status_url"`
+			ProgressURL   string `json:"progress_url"`
+		}
+		body := map[string]interface{}{
+			"provision_token": a.config.ProvisionToken,
+			"ip":              "127.0.0.1",
+		}
+		resp, err := a.post(ctx, url+"/api/v1/nodes/register", body)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := json.Unmarshal(resp, &result); err != nil {
+			lastErr = fmt.Errorf("failed to parse registration response: %w", err)
+			continue
+		}
+		a.authToken = result.AuthToken
+		a.signingSecret = result.SigningSecret
+		a.heartbeatURL = result.HeartbeatURL
+		a.statusURL = result.StatusURL
+		a.progressURL = result.ProgressURL
+		return nil
+	}
+	return lastErr
+}
+
+// heartbeatLoop sends heartbeats until ctx ends or, if until is set, until
+// then. shutdown is called when the daemon asks the node to shut down.
+func (a *simulatedAgent) heartbeatLoop(ctx context.Context, shutdown context.CancelFunc, until time.Time) {
+	ticker := time.NewTicker(a.provider.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !until.IsZero() && time.Now().After(until) {
+			return
+		}
+
+		resp, err := a.post(ctx, a.heartbeatURL, map[string]interface{}{})
+		if errors.Is(err, errUnauthorized) {
+			// Revoked or deployment gone, like the real agent
+			shutdown()
+			return
+		}
+		if err != nil {
+			continue
+		}
+		var result struct {
+			Shutdown bool `json:"shutdown"`
+		}
+		if json.Unmarshal(resp, &result) == nil && result.Shutdown {
+			shutdown()
+			return
+		}
+	}
+}
+
+// sendStatus reports a phase change to the daemon
+func (a *simulatedAgent) sendStatus(ctx context.Context, status, message string, exitCode *int) error {
+	body := map[string]interface{}{"status": status, "message": message}
+	if exitCode != nil {
+		body["exit_code"] = *exitCode
+	}
+	_, err := a.post(ctx, a.statusURL, body)
+	return err
+}
+
+// errUnauthorized is returned by post when the daemon rejects the node's token
+var errUnauthorized = errors.New("daemon rejected the node's auth token")
+
+// post sends an authorized, and when required signed, JSON request to the
+// daemon and returns the response body
+func (a *simulatedAgent) post(ctx context.Context, url string, body interface{}) ([]byte, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+a.authToken)
+	}
+	if a.signingSecret != "" {
+		signing.SignRequest(req, a.signingSecret, data, time.Now())
+	}
+
+	resp, err := a.provider.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && a.authToken != "" {
+		return nil, errUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("daemon returned %s: %s", resp.Status, respBody)
+	}
+	return respBody, nil
+}
+
+// sleepContext waits for d and reports whether ctx is still alive
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,223 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDaemon records what simulated agents send to the node API
+type fakeDaemon struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	statuses   []string
+	exitCode   *int
+	heartbeats int
+	shutdown   bool
+}
+
+func newFakeDaemon(t *testing.T) *fakeDaemon {
+	d := &fakeDaemon{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/nodes/register", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"auth_token":    "token",
+			"heartbeat_url": d.URL + "/api/v1/nodes/heartbeat",
+			"status_url":    d.URL + "/api/v1/nodes/status",
+			"progress_url":  d.URL + "/api/v1/nodes/progress",
+		})
+	})
+	mux.HandleFunc("/api/v1/nodes/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.heartbeats++
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "shutdown": d.shutdown})
+	})
+	mux.HandleFunc("/api/v1/nodes/status", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Status   string `json:"status"`
+			ExitCode *int   `json:"exit_code"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.statuses = append(d.statuses, req.Status)
+		if req.ExitCode != nil {
+			d.exitCode = req.ExitCode
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/api/v1/nodes/progress", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+	d.Server = httptest.NewServer(mux)
+	t.Cleanup(d.Close)
+	return d
+}
+
+func (d *fakeDaemon) lastStatus() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.statuses) == 0 {
+		return ""
+	}
+	return d.statuses[len(d.statuses)-1]
+}
+
+// fastSimulation returns a mock provider config that runs a node in about
+// 100ms, plus the given settings
+func fastSimulation(settings map[string]interface{}) map[string]interface{} {
+	config := map[string]interface{}{
+		"time_scale":         1000,
+		"provision_time":     "1s",
+		"boot_time":          "10s",
+		"run_time":           "100s",
+		"heartbeat_interval": "10ms",
+	}
+	for key, value := range settings {
+		config[key] = value
+	}
+	return config
+}
+
+func TestParseSimulationConfig(t *testing.T) {
+	sim, err := ParseSimulationConfig(map[string]interface{}{})
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, sim.TimeScale)
+	assert.Equal(t, time.Minute, sim.RunTime)
+	assert.Equal(t, 3*time.Second, sim.HeartbeatInterval)
+
+	sim, err = ParseSimulationConfig(map[string]interface{}{"time_scale": 60, "crash_rate": 0.25, "boot_time": "2m"})
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Second, sim.scaled(sim.BootTime))
+	assert.Equal(t, 0.25, sim.CrashRate)
+
+	for _, config := range []map[string]interface{}{
+		{"time_scale": 0},
+		{"crash_rate": 1.5},
+		{"failure_rate": "often"},
+		{"run_time": "forever"},
+		{"heartbeat_interval": "0s"},
+	} {
+		_, err := ParseSimulationConfig(config)
+		assert.Error(t, err, "%v", config)
+	}
+}
+
+func TestSimulationSeedRepeatsFaults(t *testing.T) {
+	sim, err := ParseSimulationConfig(map[string]interface{}{"seed": 42, "crash_rate": 0.5, "failure_rate": 0.5})
+	require.NoError(t, err)
+	for node := 0; node < 10; node++ {
+		assert.Equal(t, sim.pickFaults(node), sim.pickFaults(node))
+	}
+}
+
+func TestSimulatedProviderRunsNode(t *testing.T) {
+	daemon := newFakeDaemon(t)
+	provider, err := NewSimulatedProvider(fastSimulation(nil))
+	require.NoError(t, err)
+
+	info, err := provider.ProvisionInstance(context.Background(), InstanceConfig{ProvisionToken: "pt", DaemonURL: daemon.URL})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return daemon.lastStatus() == "completed" }, 2*time.Second, 10*time.Millisecond)
+	daemon.mu.Lock()
+	assert.Equal(t, []string{"downloading_assets", "extracting", "running", "completed"}, daemon.statuses)
+	assert.Equal(t, 0, *daemon.exitCode)
+	daemon.mu.Unlock()
+
+	status, err := provider.GetInstanceStatus(context.Background(), info.InstanceID)
+	require.NoError(t, err)
+	assert.Equal(t, "running", status)
+
+	require.NoError(t, provider.TerminateInstance(context.Background(), info.InstanceID))
+	status, err = provider.GetInstanceStatus(context.Background(), info.InstanceID)
+	require.NoError(t, err)
+	assert.Equal(t, "terminated", status)
+}
+
+func TestSimulatedProviderInjectsFaults(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("provision error", func(t *testing.T) {
+		provider, err := NewSimulatedProvider(fastSimulation(map[string]interface{}{"provision_error_rate": 1}))
+		require.NoError(t, err)
+		_, err = provider.ProvisionInstance(ctx, InstanceConfig{NodeIndex: 3})
+		assert.ErrorContains(t, err, "injected provision error for node 3")
+	})
+
+	t.Run("workload failure", func(t *testing.T) {
+		daemon := newFakeDaemon(t)
+		provider, err := NewSimulatedProvider(fastSimulation(map[string]interface{}{"failure_rate": 1}))
+		require.NoError(t, err)
+		_, err = provider.ProvisionInstance(ctx, InstanceConfig{DaemonURL: daemon.URL})
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool { return daemon.lastStatus() == "failed" }, 2*time.Second, 10*time.Millisecond)
+		daemon.mu.Lock()
+		assert.Equal(t, 1, *daemon.exitCode)
+		daemon.mu.Unlock()
+	})
+
+	t.Run("crash", func(t *testing.T) {
+		daemon := newFakeDaemon(t)
+		provider, err := NewSimulatedProvider(fastSimulation(map[string]interface{}{"crash_rate": 1}))
+		require.NoError(t, err)
+		info, err := provider.ProvisionInstance(ctx, InstanceConfig{DaemonURL: daemon.URL})
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			status, _ := provider.GetInstanceStatus(ctx, info.InstanceID)
+			return status == "terminated"
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.Equal(t, "running", daemon.lastStatus())
+	})
+
+	t.Run("heartbeat loss", func(t *testing.T) {
+		daemon := newFakeDaemon(t)
+		provider, err := NewSimulatedProvider(fastSimulation(map[string]interface{}{"heartbeat_loss_rate": 1}))
+		require.NoError(t, err)
+		_, err = provider.ProvisionInstance(ctx, InstanceConfig{DaemonURL: daemon.URL})
+		require.NoError(t, err)
+
+		// The workload still finishes, but heartbeats stopped before it did
+		require.Eventually(t, func() bool { return daemon.lastStatus() == "completed" }, 2*time.Second, 10*time.Millisecond)
+		daemon.mu.Lock()
+		heartbeats := daemon.heartbeats
+		daemon.mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		daemon.mu.Lock()
+		assert.Equal(t, heartbeats, daemon.heartbeats)
+		daemon.mu.Unlock()
+	})
+}
+
+func TestSimulatedAgentStopsOnShutdown(t *testing.T) {
+	daemon := newFakeDaemon(t)
+	daemon.shutdown = true
+	provider, err := NewSimulatedProvider(fastSimulation(map[string]interface{}{"run_time": "1h"}))
+	require.NoError(t, err)
+	_, err = provider.ProvisionInstance(context.Background(), InstanceConfig{DaemonURL: daemon.URL})
+	require.NoError(t, err)
+
+	// The first heartbeat carries the shutdown signal, so the workload never
+	// finishes and no more heartbeats are sent
+	require.Eventually(t, func() bool {
+		daemon.mu.Lock()
+		defer daemon.mu.Unlock()
+		return daemon.heartbeats == 1
+	}, 2*time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	daemon.mu.Lock()
+	assert.Equal(t, 1, daemon.heartbeats)
+	daemon.mu.Unlock()
+	assert.NotEqual(t, "completed", daemon.lastStatus())
+}
@@ -1,9 +1,12 @@
 package cloud
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -11,17 +14,21 @@ import (
 
 // SSHDeploymentConfig contains configuration for SSH-based agent deployment
 type SSHDeploymentConfig struct {
-	Host           string
-	Port           int
-	User           string
-	KeyPath        string
-	ProvisionToken string
-	DaemonURL      string
-	AgentBinary    []byte
+	Host              string
+	Port              int
+	User              string
+	KeyPath           string
+	ProvisionToken    string
+	DaemonURL         string
+	DaemonInternalURL string
+	AgentBinary       []byte
+	SetupScript       string
 }
 
-// getSSHClient creates an SSH client with common configuration
-func getSSHClient(host, user, keyPath string, port int, timeout time.Duration) (*ssh.Client, error) {
+// getSSHClient creates an SSH client with common configuration. timeout
+// bounds the dial; the connection is closed once ctx ends, which aborts
+// whatever the client is doing.
+func getSSHClient(ctx context.Context, host, user, keyPath string, port int, timeout time.Duration) (*ssh.Client, error) {
 	if port == 0 {
 		port = 22
 	}
@@ -54,23 +61,38 @@ func getSSHClient(host, user, keyPath string, port int, timeout time.Duration) (
 			ssh.PublicKeys(signer),
 		},
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // TODO: Add proper host key verification
-		Timeout:         timeout,
 	}
 
-	// Connect to host
-	addr := fmt.Sprintf("%s:%d", host, port)
-	return ssh.Dial("tcp", addr, sshConfig)
+	// Connect to host (JoinHostPort brackets IPv6 literals)
+	addr := net.JoinHostPort(host, fmt.Sprintf("%d", port))
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	context.AfterFunc(ctx, func() { conn.Close() })
+
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return ssh.NewClient(clientConn, chans, reqs), nil
 }
 
-// DeployAgentViaSSH deploys the agent binary to a remote host via SSH and executes it
-func DeployAgentViaSSH(config SSHDeploymentConfig) error {
+// DeployAgentViaSSH deploys the agent binary to a remote host via SSH and
+// executes it. The deployment is aborted once ctx ends.
+func DeployAgentViaSSH(ctx context.Context, config SSHDeploymentConfig) error {
 	// Default port
 	if config.Port == 0 {
 		config.Port = 22
 	}
 
 	// Connect to host
-	client, err := getSSHClient(config.Host, config.User, config.KeyPath, config.Port, 30*time.Second)
+	client, err := getSSHClient(ctx, config.Host, config.User, config.KeyPath, config.Port, 30*time.Second)
 	if err != nil {
 		return fmt.Errorf("failed to connect: %w", err)
 	}
@@ -85,8 +107,15 @@ func DeployAgentViaSSH(config SSHDeploymentConfig) error {
 		return fmt.Errorf("failed to upload agent binary: %w", err)
 	}
 
-	// Step 2: Execute agent
-	if err := executeAgent(client, agentPath, logPath, config.ProvisionToken, config.DaemonURL); err != nil {
+	// Step 2: Prepare the host (e.g. mount data volumes) before the agent starts
+	if config.SetupScript != "" {
+		if err := runSetupScript(client, config.SetupScript); err != nil {
+			return fmt.Errorf("failed to run setup script: %w", err)
+		}
+	}
+
+	// Step 3: Execute agent
+	if err := executeAgent(client, agentPath, logPath, config.ProvisionToken, config.DaemonURL, config.DaemonInternalURL); err != nil {
 		return fmt.Errorf("failed to execute agent: %w", err)
 	}
 
@@ -128,19 +157,25 @@ func uploadAgentBinary(client *ssh.Client, agentBinary []byte, agentPath string)
 }
 
 // executeAgent starts the agent in the background via SSH with unique paths
-func executeAgent(client *ssh.Client, agentPath, logPath, token, daemonURL string) error {
+func executeAgent(client *ssh.Client, agentPath, logPath, token, daemonURL, daemonInternalURL string) error {
 	session, err := client.NewSession()
 	if err != nil {
 		return fmt.Errorf("failed to create session: %w", err)
 	}
 	defer session.Close()
 
+	// URLs are quoted so bracketed IPv6 hosts are not treated as shell globs.
+	// The internal callback URL lets agents in private subnets fall back to it.
+	agentArgs := fmt.Sprintf("--token=%s --daemon='%s'", token, daemonURL)
+	if daemonInternalURL != "" && daemonInternalURL != daemonURL {
+		agentArgs += fmt.Sprintf(" --daemon-fallback='%s'", daemonInternalURL)
+	}
+
 	// Execute agent in background with nohup using unique paths
 	cmd := fmt.Sprintf(
-		"nohup %s --token=%s --daemon=%s > %s 2>&1 &",
+		"nohup %s %s > %s 2>&1 &",
 		agentPath,
-		token,
-		daemonURL,
+		agentArgs,
 		logPath,
 	)
 
@@ -152,16 +187,35 @@ func executeAgent(client *ssh.Client, agentPath, logPath, token, daemonURL strin
 	return nil
 }
 
-// WaitForSSH waits for SSH to become available on the host
-func WaitForSSH(host, user, keyPath string, port int, timeout time.Duration) error {
+// runSetupScript pipes a script to a root shell, using sudo unless already root
+func runSetupScript(client *ssh.Client, script string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	session.Stdin = strings.NewReader(script)
+	output, err := session.CombinedOutput(`if [ "$(id -u)" -eq 0 ]; then sh -s; else sudo -n sh -s; fi`)
+	if err != nil {
+		return fmt.Errorf("%w\nOutput: %s", err, string(output))
+	}
+
+	return nil
+}
+
+// WaitForSSH waits for SSH to become available on the host, for at most
+// timeout or until ctx ends
+func WaitForSSH(ctx context.Context, host, user, keyPath string, port int, timeout time.Duration) error {
 	if port == 0 {
 		port = 22
 	}
 
-	deadline := time.Now().Add(timeout)
+	wait, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	for time.Now().Before(deadline) {
-		client, err := getSSHClient(host, user, keyPath, port, 5*time.Second)
+	for {
+		client, err := getSSHClient(wait, host, user, keyPath, port, 5*time.Second)
 		if err == nil {
 			// Successfully connected, test with a simple command
 			session, err := client.NewSession()
@@ -173,19 +227,24 @@ func WaitForSSH(host, user, keyPath string, port int, timeout time.Duration) err
 			client.Close()
 		}
 
-		time.Sleep(5 * time.Second)
+		select {
+		case <-time.After(5 * time.Second):
+		case <-wait.Done():
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("SSH did not become available within %v", timeout)
+		}
 	}
-
-	return fmt.Errorf("SSH did not become available within %v", timeout)
 }
 
 // TestSSHConnection tests if SSH connection works
-func TestSSHConnection(host, user, keyPath string, port int) error {
+func TestSSHConnection(ctx context.Context, host, user, keyPath string, port int) error {
 	if port == 0 {
 		port = 22
 	}
 
-	client, err := getSSHClient(host, user, keyPath, port, 10*time.Second)
+	client, err := getSSHClient(ctx, host, user, keyPath, port, 10*time.Second)
 	if err != nil {
 		return fmt.Errorf("failed to connect: %w", err)
 	}
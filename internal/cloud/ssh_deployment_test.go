@@ -0,0 +1,59 @@
+package cloud
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// silentListener accepts connections but never speaks SSH
+func silentListener(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestGetSSHClientAbortsHandshake(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = getSSHClient(ctx, "127.0.0.1", "taskfly", keyPath, silentListener(t), time.Minute)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestWaitForSSHGivesUp(t *testing.T) {
+	port := silentListener(t)
+	keyPath := filepath.Join(t.TempDir(), "missing")
+
+	start := time.Now()
+	err := WaitForSSH(context.Background(), "127.0.0.1", "taskfly", keyPath, port, 100*time.Millisecond)
+	assert.ErrorContains(t, err, "did not become available within 100ms")
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// Cancelling the context stops waiting before the timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	err = WaitForSSH(ctx, "127.0.0.1", "taskfly", keyPath, port, time.Minute)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
@@ -0,0 +1,151 @@
+package cloud
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Volume is an additional block device attached to each node, formatted and
+// mounted before the agent starts
+type Volume struct {
+	Device     string // Device name requested from the provider, e.g. /dev/sdf
+	SizeGB     int
+	Type       string // Provider volume type, e.g. gp3
+	MountPoint string
+	Filesystem string // mkfs type used when the volume has none yet
+	Keep       bool   // Keep the volume when the node is terminated
+}
+
+// RootVolume overrides the size and type of a node's root volume
+type RootVolume struct {
+	SizeGB int
+	Type   string
+}
+
+// ParseVolumes reads the root_volume and volumes settings of a provider
+// configuration. Volumes without a device are assigned /dev/sdf onwards.
+func ParseVolumes(config map[string]interface{}) (*RootVolume, []Volume, error) {
+	var root *RootVolume
+	if value, ok := config["root_volume"]; ok {
+		settings, ok := stringMap(value)
+		if !ok {
+			return nil, nil, fmt.Errorf("root_volume must be a mapping")
+		}
+		helper := NewProviderConfigHelper(settings)
+		root = &RootVolume{
+			SizeGB: helper.GetInt("size_gb", 0),
+			Type:   helper.GetString("type", ""),
+		}
+		if root.SizeGB < 0 {
+			return nil, nil, fmt.Errorf("root_volume.size_gb must be positive")
+		}
+	}
+
+	value, ok := config["volumes"]
+	if !ok {
+		return root, nil, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("volumes must be a list")
+	}
+
+	volumes := make([]Volume, 0, len(list))
+	devices := make(map[string]bool)
+	for i, item := range list {
+		settings, ok := stringMap(item)
+		if !ok {
+			return nil, nil, fmt.Errorf("volumes[%d] must be a mapping", i)
+		}
+		helper := NewProviderConfigHelper(settings)
+		volume := Volume{
+			Device:     helper.GetString("device", fmt.Sprintf("/dev/sd%c", 'f'+i)),
+			SizeGB:     helper.GetInt("size_gb", 0),
+			Type:       helper.GetString("type", "gp3"),
+			MountPoint: helper.GetString("mount_point", ""),
+			Filesystem: helper.GetString("filesystem", "ext4"),
+			Keep:       helper.GetBool("keep", false),
+		}
+
+		if volume.SizeGB <= 0 {
+			return nil, nil, fmt.Errorf("volumes[%d].size_gb is required", i)
+		}
+		if !path.IsAbs(volume.MountPoint) {
+			return nil, nil, fmt.Errorf("volumes[%d].mount_point must be an absolute path", i)
+		}
+		if _, hasDevice := settings["device"]; !hasDevice && 'f'+i > 'p' {
+			return nil, nil, fmt.Errorf("volumes[%d] needs an explicit device, /dev/sdf to /dev/sdp are taken", i)
+		}
+		if devices[volume.Device] {
+			return nil, nil, fmt.Errorf("volumes[%d].device %s is used twice", i, volume.Device)
+		}
+		devices[volume.Device] = true
+
+		volumes = append(volumes, volume)
+	}
+
+	return root, volumes, nil
+}
+
+// stringMap converts a nested YAML mapping, which yaml.v2 decodes with
+// interface{} keys, to a string-keyed map
+func stringMap(value interface{}) (map[string]interface{}, bool) {
+	switch m := value.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(m))
+		for key, v := range m {
+			result[fmt.Sprintf("%v", key)] = v
+		}
+		return result, true
+	default:
+		return nil, false
+	}
+}
+
+// BuildMountScript returns shell commands, run as root, that wait for each
+// volume to appear, create a filesystem on it if it has none and mount it.
+// Besides the requested name, the device is looked up as /dev/xvdX and, on
+// Nitro instances that expose EBS as NVMe, by the name nvme-cli reports.
+func BuildMountScript(volumes []Volume) string {
+	if len(volumes) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("# TaskFly data volumes\n")
+	b.WriteString("find_volume() {\n")
+	b.WriteString("  name=${1#/dev/}\n")
+	b.WriteString("  for candidate in /dev/$name /dev/xvd${name#sd}; do\n")
+	b.WriteString("    [ -b \"$candidate\" ] && { echo \"$candidate\"; return 0; }\n")
+	b.WriteString("  done\n")
+	b.WriteString("  if command -v nvme >/dev/null 2>&1; then\n")
+	b.WriteString("    for candidate in /dev/nvme*n1; do\n")
+	b.WriteString("      [ -b \"$candidate\" ] || continue\n")
+	b.WriteString("      nvme id-ctrl -v \"$candidate\" 2>/dev/null | grep -Eq \"\\\"(/dev/)?($name|xvd${name#sd})[^a-z]\" && { echo \"$candidate\"; return 0; }\n")
+	b.WriteString("    done\n")
+	b.WriteString("  fi\n")
+	b.WriteString("  return 1\n")
+	b.WriteString("}\n")
+	b.WriteString("mount_volume() {\n")
+	b.WriteString("  dev=\"\"\n")
+	b.WriteString("  for attempt in $(seq 1 30); do\n")
+	b.WriteString("    dev=$(find_volume \"$1\") && break\n")
+	b.WriteString("    sleep 2\n")
+	b.WriteString("  done\n")
+	b.WriteString("  [ -n \"$dev\" ] || { echo \"TaskFly: volume $1 not found\" >&2; return 1; }\n")
+	b.WriteString("  blkid \"$dev\" >/dev/null 2>&1 || mkfs -t \"$3\" \"$dev\" || return 1\n")
+	b.WriteString("  mkdir -p \"$2\" && mount \"$dev\" \"$2\" || return 1\n")
+	b.WriteString("  echo \"UUID=$(blkid -s UUID -o value \"$dev\") $2 $3 defaults,nofail 0 2\" >> /etc/fstab\n")
+	b.WriteString("}\n")
+	for _, volume := range volumes {
+		fmt.Fprintf(&b, "mount_volume %s %s %s || exit 1\n",
+			quoteShellWords([]string{volume.Device}),
+			quoteShellWords([]string{volume.MountPoint}),
+			quoteShellWords([]string{volume.Filesystem}))
+	}
+
+	return b.String()
+}
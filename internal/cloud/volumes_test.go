@@ -0,0 +1,59 @@
+package cloud
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseVolumes tests reading root and data volume settings
+func TestParseVolumes(t *testing.T) {
+	root, volumes, err := ParseVolumes(map[string]interface{}{
+		"root_volume": map[interface{}]interface{}{"size_gb": 50, "type": "gp3"},
+		"volumes": []interface{}{
+			map[interface{}]interface{}{"size_gb": 100, "mount_point": "/data"},
+			map[string]interface{}{"size_gb": 20, "mount_point": "/scratch", "type": "io2", "keep": true, "device": "/dev/sdx"},
+		},
+	})
+	require.NoError(t, err)
+	require.NotNil(t, root)
+	assert.Equal(t, 50, root.SizeGB)
+	assert.Equal(t, "gp3", root.Type)
+
+	require.Len(t, volumes, 2)
+	assert.Equal(t, Volume{Device: "/dev/sdf", SizeGB: 100, Type: "gp3", MountPoint: "/data", Filesystem: "ext4"}, volumes[0])
+	assert.Equal(t, "/dev/sdx", volumes[1].Device)
+	assert.True(t, volumes[1].Keep)
+
+	root, volumes, err = ParseVolumes(map[string]interface{}{})
+	require.NoError(t, err)
+	assert.Nil(t, root)
+	assert.Empty(t, volumes)
+
+	_, _, err = ParseVolumes(map[string]interface{}{
+		"volumes": []interface{}{map[string]interface{}{"size_gb": 10, "mount_point": "data"}},
+	})
+	assert.Error(t, err, "relative mount point")
+
+	_, _, err = ParseVolumes(map[string]interface{}{
+		"volumes": []interface{}{map[string]interface{}{"mount_point": "/data"}},
+	})
+	assert.Error(t, err, "missing size")
+}
+
+// TestBuildMountScript tests that volumes are mounted before the agent starts
+func TestBuildMountScript(t *testing.T) {
+	assert.Empty(t, BuildMountScript(nil))
+
+	script := BuildMountScript([]Volume{{Device: "/dev/sdf", MountPoint: "/data", Filesystem: "xfs"}})
+	assert.Contains(t, script, "mount_volume '/dev/sdf' '/data' 'xfs' || exit 1")
+
+	bootstrap := BuildBootstrapScript(InstanceConfig{
+		ProvisionToken: "pt-123",
+		DaemonURL:      "http://203.0.113.5:8080",
+		SetupScript:    script,
+	}, "linux", "amd64")
+	assert.Less(t, strings.Index(bootstrap, "mount_volume '/dev/sdf'"), strings.Index(bootstrap, "nohup"))
+}
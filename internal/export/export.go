@@ -0,0 +1,185 @@
+// Package export writes deployment telemetry as CSV or Parquet tables and in
+// the Prometheus text format
+package export
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Supported export formats
+const (
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+)
+
+// MetricsRow is one metrics sample of a node
+type MetricsRow struct {
+	NodeID      string    `parquet:"node_id"`
+	Timestamp   time.Time `parquet:"timestamp"`
+	CPUCores    int64     `parquet:"cpu_cores"`
+	CPUUsage    float64   `parquet:"cpu_usage"`
+	MemoryTotal int64     `parquet:"memory_total"`
+	MemoryUsed  int64     `parquet:"memory_used"`
+	LoadAvg1    float64   `parquet:"load_avg_1"`
+	LoadAvg5    float64   `parquet:"load_avg_5"`
+	LoadAvg15   float64   `parquet:"load_avg_15"`
+}
+
+var metricsHeader = []string{
+	"node_id", "timestamp", "cpu_cores", "cpu_usage", "memory_total",
+	"memory_used", "load_avg_1", "load_avg_5", "load_avg_15",
+}
+
+func (r MetricsRow) record() []string {
+	return []string{
+		r.NodeID,
+		r.Timestamp.Format(time.RFC3339Nano),
+		strconv.FormatInt(r.CPUCores, 10),
+		formatFloat(r.CPUUsage),
+		strconv.FormatInt(r.MemoryTotal, 10),
+		strconv.FormatInt(r.MemoryUsed, 10),
+		formatFloat(r.LoadAvg1),
+		formatFloat(r.LoadAvg5),
+		formatFloat(r.LoadAvg15),
+	}
+}
+
+// ResultRow is the outcome of a single node
+type ResultRow struct {
+	NodeID           string     `parquet:"node_id"`
+	Status           string     `parquet:"status"`
+	ExitCode         *int64     `parquet:"exit_code,optional"`
+	StartedAt        *time.Time `parquet:"started_at,optional"`
+	FinishedAt       *time.Time `parquet:"finished_at,optional"`
+	DurationSeconds  float64    `parquet:"duration_seconds"`
+	InstanceID       string     `parquet:"instance_id"`
+	InstanceType     string     `parquet:"instance_type"`
+	IPAddress        string     `parquet:"ip_address"`
+	PeakCPUUsage     *float64   `parquet:"peak_cpu_usage,optional"`
+	PeakMemoryUsed   *int64     `parquet:"peak_memory_used,optional"`
+	PeakLoadAvg1     *float64   `parquet:"peak_load_avg_1,optional"`
+	EstimatedCostUSD *float64   `parquet:"estimated_cost_usd,optional"`
+	ErrorMessage     string     `parquet:"error_message"`
+}
+
+var resultsHeader = []string{
+	"node_id", "status", "exit_code", "started_at", "finished_at", "duration_seconds",
+	"instance_id", "instance_type", "ip_address", "peak_cpu_usage", "peak_memory_used",
+	"peak_load_avg_1", "estimated_cost_usd", "error_message",
+}
+
+func (r ResultRow) record() []string {
+	return []string{
+		r.NodeID,
+		r.Status,
+		formatOptional(r.ExitCode, func(v int64) string { return strconv.FormatInt(v, 10) }),
+		formatOptional(r.StartedAt, func(v time.Time) string { return v.Format(time.RFC3339Nano) }),
+		formatOptional(r.FinishedAt, func(v time.Time) string { return v.Format(time.RFC3339Nano) }),
+		formatFloat(r.DurationSeconds),
+		r.InstanceID,
+		r.InstanceType,
+		r.IPAddress,
+		formatOptional(r.PeakCPUUsage, formatFloat),
+		formatOptional(r.PeakMemoryUsed, func(v int64) string { return strconv.FormatInt(v, 10) }),
+		formatOptional(r.PeakLoadAvg1, formatFloat),
+		formatOptional(r.EstimatedCostUSD, formatFloat),
+		r.ErrorMessage,
+	}
+}
+
+// Metrics writes metrics samples in the given format
+func Metrics(w io.Writer, format string, samples []state.MetricsSample) error {
+	rows := make([]MetricsRow, len(samples))
+	for i, sample := range samples {
+		rows[i] = MetricsRow{
+			NodeID:      sample.NodeID,
+			Timestamp:   sample.Timestamp,
+			CPUCores:    int64(sample.CPUCores),
+			CPUUsage:    sample.CPUUsage,
+			MemoryTotal: int64(sample.MemoryTotal),
+			MemoryUsed:  int64(sample.MemoryUsed),
+			LoadAvg1:    sample.LoadAvg1,
+			LoadAvg5:    sample.LoadAvg5,
+			LoadAvg15:   sample.LoadAvg15,
+		}
+	}
+	return write(w, format, metricsHeader, rows)
+}
+
+// Results writes per-node outcomes from a deployment report in the given format
+func Results(w io.Writer, format string, report *state.DeploymentReport) error {
+	rows := make([]ResultRow, len(report.Nodes))
+	for i, node := range report.Nodes {
+		row := ResultRow{
+			NodeID:           node.NodeID,
+			Status:           string(node.Status),
+			StartedAt:        node.StartedAt,
+			FinishedAt:       node.FinishedAt,
+			DurationSeconds:  node.Duration,
+			InstanceID:       node.InstanceID,
+			InstanceType:     node.InstanceType,
+			IPAddress:        node.IPAddress,
+			EstimatedCostUSD: node.EstimatedCost,
+			ErrorMessage:     node.ErrorMessage,
+		}
+		if node.ExitCode != nil {
+			code := int64(*node.ExitCode)
+			row.ExitCode = &code
+		}
+		if node.Peak != nil {
+			memory := int64(node.Peak.MemoryUsed)
+			row.PeakCPUUsage = &node.Peak.CPUUsage
+			row.PeakMemoryUsed = &memory
+			row.PeakLoadAvg1 = &node.Peak.LoadAvg1
+		}
+		rows[i] = row
+	}
+	return write(w, format, resultsHeader, rows)
+}
+
+// row is implemented by every exported table row
+type row interface {
+	record() []string
+}
+
+func write[T row](w io.Writer, format string, header []string, rows []T) error {
+	switch format {
+	case FormatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(header); err != nil {
+			return fmt.Errorf("failed to write csv header: %w", err)
+		}
+		for _, r := range rows {
+			if err := writer.Write(r.record()); err != nil {
+				return fmt.Errorf("failed to write csv row: %w", err)
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	case FormatParquet:
+		if err := parquet.Write(w, rows); err != nil {
+			return fmt.Errorf("failed to write parquet: %w", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported export format %q", format)
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func formatOptional[T any](v *T, format func(T) string) string {
+	if v == nil {
+		return ""
+	}
+	return format(*v)
+}
@@ -0,0 +1,334 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+)
+
+// durationBuckets are the upper bounds in seconds of the deployment duration
+// histogram, from a minute to a day
+var durationBuckets = []float64{60, 300, 900, 1800, 3600, 7200, 14400, 43200, 86400}
+
+// deploymentStatuses and nodeStatuses are always exported, even at zero, so
+// dashboards don't show gaps
+var (
+	deploymentStatuses = []state.DeploymentStatus{
+		state.StatusPending, state.StatusProvisioning, state.StatusRunning, state.StatusCompleted,
+		state.StatusFailed, state.StatusTerminating, state.StatusTerminated,
+	}
+	nodeStatuses = []state.NodeStatus{
+		state.NodeStatusPending, state.NodeStatusProvisioning, state.NodeStatusBooting,
+		state.NodeStatusRegistering, state.NodeStatusDownloading, state.NodeStatusExtracting, state.NodeStatusRunning,
+		state.NodeStatusCompleted, state.NodeStatusFailed, state.NodeStatusTerminating,
+		state.NodeStatusTerminated,
+	}
+	finishedStatuses = []state.DeploymentStatus{state.StatusCompleted, state.StatusFailed, state.StatusTerminated}
+)
+
+// histogram is a cumulative Prometheus histogram over durationBuckets
+type histogram struct {
+	counts []float64
+	count  float64
+	sum    float64
+}
+
+func (h *histogram) observe(value float64) {
+	if h.counts == nil {
+		h.counts = make([]float64, len(durationBuckets))
+	}
+	for i, bound := range durationBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// FinishCounter counts deployments and their nodes as they finish, so failure
+// rates and durations outlive the cleanup of finished deployments. Counts
+// start at zero when the daemon starts, like any Prometheus counter.
+type FinishCounter struct {
+	mu          sync.Mutex
+	seen        map[string]bool // deployments already counted
+	deployments map[state.DeploymentStatus]float64
+	nodes       map[state.NodeStatus]float64
+	durations   map[state.DeploymentStatus]*histogram
+}
+
+// NewFinishCounter creates a counter that ignores deployments which already
+// finished, so a daemon restart doesn't count them again
+func NewFinishCounter(existing []*state.Deployment) *FinishCounter {
+	f := &FinishCounter{
+		seen:        make(map[string]bool),
+		deployments: make(map[state.DeploymentStatus]float64),
+		nodes:       make(map[state.NodeStatus]float64),
+		durations:   make(map[state.DeploymentStatus]*histogram),
+	}
+	for _, deployment := range existing {
+		if finished(deployment.Status) {
+			f.seen[deployment.ID] = true
+		}
+	}
+	return f
+}
+
+// Observe counts deployments that finished since the last call. nodes holds
+// the nodes of each deployment by ID.
+func (f *FinishCounter) Observe(deployments []*state.Deployment, nodes map[string][]*state.Node) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	present := make(map[string]bool, len(deployments))
+	for _, deployment := range deployments {
+		present[deployment.ID] = true
+		if f.seen[deployment.ID] || !finished(deployment.Status) {
+			continue
+		}
+		f.seen[deployment.ID] = true
+
+		f.deployments[deployment.Status]++
+		for _, node := range nodes[deployment.ID] {
+			f.nodes[node.Status]++
+		}
+		if deployment.CompletedAt != nil && deployment.Status != state.StatusTerminated {
+			h := f.durations[deployment.Status]
+			if h == nil {
+				h = &histogram{}
+				f.durations[deployment.Status] = h
+			}
+			h.observe(deployment.CompletedAt.Sub(deployment.CreatedAt).Seconds())
+		}
+	}
+
+	// Deleted deployments can't finish again
+	for id := range f.seen {
+		if !present[id] {
+			delete(f.seen, id)
+		}
+	}
+}
+
+// finished reports whether a deployment reached a final status
+func finished(status state.DeploymentStatus) bool {
+	return status == state.StatusCompleted || status == state.StatusFailed || status == state.StatusTerminated
+}
+
+// promWriter builds the Prometheus text exposition format
+type promWriter struct {
+	b strings.Builder
+}
+
+func (p *promWriter) family(name, kind, help string) {
+	fmt.Fprintf(&p.b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one sample. labels alternate between names and values.
+func (p *promWriter) sample(name string, value float64, labels ...string) {
+	p.b.WriteString(name)
+	if len(labels) > 0 {
+		p.b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.b.WriteByte(',')
+			}
+			fmt.Fprintf(&p.b, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		p.b.WriteByte('}')
+	}
+	p.b.WriteByte(' ')
+	p.b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	p.b.WriteByte('\n')
+}
+
+// escapeLabel escapes a label value as the exposition format requires
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// WritePrometheus writes deployment and node gauges and the finish counters in
+// the Prometheus text exposition format. nodes holds the nodes of each
+// deployment by ID.
+func WritePrometheus(w io.Writer, deployments []*state.Deployment, nodes map[string][]*state.Node, finishes *FinishCounter) error {
+	var p promWriter
+
+	sort.Slice(deployments, func(i, j int) bool { return deployments[i].ID < deployments[j].ID })
+	var allNodes []*state.Node
+	for _, deployment := range deployments {
+		allNodes = append(allNodes, nodes[deployment.ID]...)
+	}
+
+	deploymentCounts := make(map[state.DeploymentStatus]int)
+	for _, deployment := range deployments {
+		deploymentCounts[deployment.Status]++
+	}
+	p.family("taskfly_deployments", "gauge", "Deployments known to the daemon by status.")
+	for _, status := range deploymentStatuses {
+		p.sample("taskfly_deployments", float64(deploymentCounts[status]), "status", string(status))
+	}
+
+	nodeCounts := make(map[state.NodeStatus]int)
+	for _, node := range allNodes {
+		nodeCounts[node.Status]++
+	}
+	p.family("taskfly_nodes", "gauge", "Nodes of known deployments by status.")
+	for _, status := range nodeStatuses {
+		p.sample("taskfly_nodes", float64(nodeCounts[status]), "status", string(status))
+	}
+
+	// Provision tokens of provisioned nodes whose agent hasn't registered
+	now := time.Now()
+	tokenCounts := make(map[string]int)
+	for _, node := range allNodes {
+		switch {
+		case state.Registered(node):
+		case node.ClaimDeadline != nil && now.After(*node.ClaimDeadline):
+			tokenCounts["expired"]++
+		case node.Status == state.NodeStatusBooting || node.Status == state.NodeStatusRegistering:
+			tokenCounts["waiting"]++
+		}
+	}
+	p.family("taskfly_unclaimed_provision_tokens", "gauge", "Provision tokens of provisioned nodes whose agent hasn't registered, waiting or expired.")
+	for _, tokenState := range []string{"waiting", "expired"} {
+		p.sample("taskfly_unclaimed_provision_tokens", float64(tokenCounts[tokenState]), "state", tokenState)
+	}
+
+	p.family("taskfly_deployment_progress_percent", "gauge", "Mean completion percentage of the nodes of an unfinished deployment.")
+	for _, deployment := range deployments {
+		if !finished(deployment.Status) {
+			p.sample("taskfly_deployment_progress_percent", deployment.Progress,
+				"deployment_id", deployment.ID, "template_id", deployment.TemplateID)
+		}
+	}
+
+	p.family("taskfly_node_info", "gauge", "Node metadata, always 1.")
+	for _, node := range allNodes {
+		p.sample("taskfly_node_info", 1,
+			"deployment_id", node.DeploymentID, "node_id", node.NodeID, "node_index", strconv.Itoa(node.NodeIndex),
+			"status", string(node.Status), "instance_id", node.InstanceID, "availability_zone", node.AvailabilityZone)
+	}
+
+	nodeGauges := []struct {
+		name, help string
+		value      func(*state.SystemMetrics) float64
+	}{
+		{"taskfly_node_cpu_usage_percent", "CPU usage of a node in percent.", func(m *state.SystemMetrics) float64 { return m.CPUUsage }},
+		{"taskfly_node_cpu_cores", "CPU cores of a node.", func(m *state.SystemMetrics) float64 { return float64(m.CPUCores) }},
+		{"taskfly_node_memory_used_bytes", "Memory used on a node.", func(m *state.SystemMetrics) float64 { return float64(m.MemoryUsed) }},
+		{"taskfly_node_memory_total_bytes", "Memory of a node.", func(m *state.SystemMetrics) float64 { return float64(m.MemoryTotal) }},
+		{"taskfly_node_load1", "One minute load average of a node.", func(m *state.SystemMetrics) float64 { return m.LoadAvg1 }},
+		{"taskfly_node_metrics_timestamp_seconds", "When a node last reported metrics, as a Unix timestamp.", func(m *state.SystemMetrics) float64 { return float64(m.Timestamp.Unix()) }},
+	}
+	for _, gauge := range nodeGauges {
+		p.family(gauge.name, "gauge", gauge.help)
+		for _, node := range allNodes {
+			if node.Metrics != nil {
+				p.sample(gauge.name, gauge.value(node.Metrics), "deployment_id", node.DeploymentID, "node_id", node.NodeID)
+			}
+		}
+	}
+
+	p.family("taskfly_node_custom", "gauge", "Workload metrics reported by a node's telemetry hooks.")
+	for _, node := range allNodes {
+		if node.Metrics == nil {
+			continue
+		}
+		names := make([]string, 0, len(node.Metrics.Custom))
+		for name := range node.Metrics.Custom {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p.sample("taskfly_node_custom", node.Metrics.Custom[name],
+				"deployment_id", node.DeploymentID, "node_id", node.NodeID, "metric", name)
+		}
+	}
+
+	p.family("taskfly_node_progress_percent", "gauge", "Completion percentage a node's workload last reported.")
+	for _, node := range allNodes {
+		if node.Progress != nil {
+			p.sample("taskfly_node_progress_percent", node.Progress.Percent, "deployment_id", node.DeploymentID, "node_id", node.NodeID)
+		}
+	}
+
+	finishes.mu.Lock()
+	p.family("taskfly_deployments_finished_total", "counter", "Deployments that finished since the daemon started, by final status.")
+	for _, status := range finishedStatuses {
+		p.sample("taskfly_deployments_finished_total", finishes.deployments[status], "status", string(status))
+	}
+	p.family("taskfly_nodes_finished_total", "counter", "Nodes of deployments that finished since the daemon started, by final status.")
+	for _, status := range []state.NodeStatus{state.NodeStatusCompleted, state.NodeStatusFailed, state.NodeStatusTerminated} {
+		p.sample("taskfly_nodes_finished_total", finishes.nodes[status], "status", string(status))
+	}
+	p.family("taskfly_deployment_duration_seconds", "histogram", "Time from creation to completion of finished deployments.")
+	for _, status := range []state.DeploymentStatus{state.StatusCompleted, state.StatusFailed} {
+		h := finishes.durations[status]
+		if h == nil {
+			h = &histogram{counts: make([]float64, len(durationBuckets))}
+		}
+		for i, bound := range durationBuckets {
+			p.sample("taskfly_deployment_duration_seconds_bucket", h.counts[i],
+				"status", string(status), "le", strconv.FormatFloat(bound, 'g', -1, 64))
+		}
+		p.sample("taskfly_deployment_duration_seconds_bucket", h.count, "status", string(status), "le", "+Inf")
+		p.sample("taskfly_deployment_duration_seconds_sum", h.sum, "status", string(status))
+		p.sample("taskfly_deployment_duration_seconds_count", h.count, "status", string(status))
+	}
+	finishes.mu.Unlock()
+
+	_, err := io.WriteString(w, p.b.String())
+	return err
+}
+
+// DaemonMemory is what the daemon holds in memory and the log pushes it
+// rejected to stay within its limits
+type DaemonMemory struct {
+	Usage             state.MemoryUsage
+	HeapBytes         uint64
+	RejectedLogPushes int64
+}
+
+// WriteMemoryMetrics writes the daemon's memory gauges in the Prometheus text
+// exposition format
+func WriteMemoryMetrics(w io.Writer, memory DaemonMemory) error {
+	var p promWriter
+	usage := memory.Usage
+
+	p.family("taskfly_daemon_heap_bytes", "gauge", "Bytes of allocated heap objects of the daemon.")
+	p.sample("taskfly_daemon_heap_bytes", float64(memory.HeapBytes))
+
+	p.family("taskfly_store_entries", "gauge", "Entries the state store holds in memory by kind.")
+	p.sample("taskfly_store_entries", float64(usage.Deployments), "kind", "deployments")
+	p.sample("taskfly_store_entries", float64(usage.Nodes), "kind", "nodes")
+	p.sample("taskfly_store_entries", float64(usage.LogEntries), "kind", "log_entries")
+	p.sample("taskfly_store_entries", float64(usage.MetricsSamples), "kind", "metrics_samples")
+
+	p.family("taskfly_log_buffer_bytes", "gauge", "Estimated memory taken by the log buffers of all deployments.")
+	p.sample("taskfly_log_buffer_bytes", float64(usage.LogBytes))
+	p.family("taskfly_log_buffer_limit_bytes", "gauge", "Limits of the log buffers, in total and per deployment. Zero means unlimited.")
+	p.sample("taskfly_log_buffer_limit_bytes", float64(usage.LogLimits.Total), "scope", "total")
+	p.sample("taskfly_log_buffer_limit_bytes", float64(usage.LogLimits.PerDeployment), "scope", "deployment")
+
+	ids := make([]string, 0, len(usage.ByDeployment))
+	for id := range usage.ByDeployment {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	p.family("taskfly_deployment_log_buffer_bytes", "gauge", "Estimated memory taken by the log buffer of a deployment.")
+	for _, id := range ids {
+		p.sample("taskfly_deployment_log_buffer_bytes", float64(usage.ByDeployment[id].LogBytes), "deployment_id", id)
+	}
+
+	p.family("taskfly_log_pushes_rejected_total", "counter", "Log pushes answered with 429 because the log buffers were full, since the daemon started.")
+	p.sample("taskfly_log_pushes_rejected_total", float64(memory.RejectedLogPushes))
+
+	_, err := io.WriteString(w, p.b.String())
+	return err
+}
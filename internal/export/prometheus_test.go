@@ -0,0 +1,100 @@
+package export
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	created := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	completed := created.Add(10 * time.Minute)
+
+	running := &state.Deployment{ID: "dep_b", Status: state.StatusRunning, Progress: 40, TemplateID: "tpl"}
+	done := &state.Deployment{ID: "dep_a", Status: state.StatusCompleted, CreatedAt: created, CompletedAt: &completed}
+	nodes := map[string][]*state.Node{
+		"dep_b": {{
+			NodeID:       "dep_b_node_0",
+			DeploymentID: "dep_b",
+			Status:       state.NodeStatusRunning,
+			Metrics: &state.SystemMetrics{
+				CPUUsage: 12.5,
+				Custom:   map[string]float64{"rows": 42},
+			},
+		}},
+		"dep_a": {
+			{NodeID: "dep_a_node_0", DeploymentID: "dep_a", Status: state.NodeStatusCompleted},
+			{NodeID: "dep_a_node_2", DeploymentID: "dep_a", Status: state.NodeStatusFailed, ClaimDeadline: &created},
+			{NodeID: "dep_a_node_1", DeploymentID: "dep_a", Status: state.NodeStatusFailed},
+		},
+	}
+
+	finishes := NewFinishCounter(nil)
+	deployments := []*state.Deployment{running, done}
+	finishes.Observe(deployments, nodes)
+	finishes.Observe(deployments, nodes) // counted once
+
+	var b strings.Builder
+	require.NoError(t, WritePrometheus(&b, deployments, nodes, finishes))
+	out := b.String()
+
+	assert.Contains(t, out, "# TYPE taskfly_deployments gauge\n")
+	assert.Contains(t, out, `taskfly_deployments{status="running"} 1`)
+	assert.Contains(t, out, `taskfly_nodes{status="failed"} 2`)
+	assert.Contains(t, out, `taskfly_deployment_progress_percent{deployment_id="dep_b",template_id="tpl"} 40`)
+	assert.NotContains(t, out, `taskfly_deployment_progress_percent{deployment_id="dep_a"`)
+	assert.Contains(t, out, `taskfly_node_cpu_usage_percent{deployment_id="dep_b",node_id="dep_b_node_0"} 12.5`)
+	assert.Contains(t, out, `taskfly_node_custom{deployment_id="dep_b",node_id="dep_b_node_0",metric="rows"} 42`)
+	assert.Contains(t, out, `taskfly_deployments_finished_total{status="completed"} 1`)
+	assert.Contains(t, out, `taskfly_nodes_finished_total{status="failed"} 2`)
+	assert.Contains(t, out, `taskfly_unclaimed_provision_tokens{state="waiting"} 0`)
+	assert.Contains(t, out, `taskfly_unclaimed_provision_tokens{state="expired"} 1`)
+	assert.Contains(t, out, `taskfly_deployment_duration_seconds_bucket{status="completed",le="300"} 0`)
+	assert.Contains(t, out, `taskfly_deployment_duration_seconds_bucket{status="completed",le="900"} 1`)
+	assert.Contains(t, out, `taskfly_deployment_duration_seconds_sum{status="completed"} 600`)
+}
+
+func TestFinishCounterIgnoresExisting(t *testing.T) {
+	done := &state.Deployment{ID: "dep_a", Status: state.StatusFailed}
+	finishes := NewFinishCounter([]*state.Deployment{done})
+	finishes.Observe([]*state.Deployment{done}, nil)
+
+	var b strings.Builder
+	require.NoError(t, WritePrometheus(&b, nil, nil, finishes))
+	assert.Contains(t, b.String(), `taskfly_deployments_finished_total{status="failed"} 0`)
+}
+
+func TestEscapeLabel(t *testing.T) {
+	assert.Equal(t, `a\"b\\c\nd`, escapeLabel("a\"b\\c\nd"))
+}
+
+func TestWriteMemoryMetrics(t *testing.T) {
+	var b strings.Builder
+	require.NoError(t, WriteMemoryMetrics(&b, DaemonMemory{
+		Usage: state.MemoryUsage{
+			Deployments: 2,
+			LogEntries:  30,
+			LogBytes:    4096,
+			LogLimits:   state.LogLimits{Total: 8192},
+			ByDeployment: map[string]state.DeploymentMemory{
+				"dep_b": {LogBytes: 1024},
+				"dep_a": {LogBytes: 3072},
+			},
+		},
+		HeapBytes:         1 << 20,
+		RejectedLogPushes: 3,
+	}))
+	out := b.String()
+
+	assert.Contains(t, out, "taskfly_daemon_heap_bytes 1.048576e+06\n")
+	assert.Contains(t, out, `taskfly_store_entries{kind="log_entries"} 30`)
+	assert.Contains(t, out, "taskfly_log_buffer_bytes 4096\n")
+	assert.Contains(t, out, `taskfly_log_buffer_limit_bytes{scope="total"} 8192`)
+	assert.Contains(t, out, `taskfly_log_buffer_limit_bytes{scope="deployment"} 0`)
+	assert.Contains(t, out, "taskfly_deployment_log_buffer_bytes{deployment_id=\"dep_a\"} 3072\ntaskfly_deployment_log_buffer_bytes{deployment_id=\"dep_b\"} 1024\n")
+	assert.Contains(t, out, "# TYPE taskfly_log_pushes_rejected_total counter\ntaskfly_log_pushes_rejected_total 3\n")
+}
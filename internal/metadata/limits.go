@@ -0,0 +1,221 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Limits on the configuration handed to each node at registration
+const (
+	// MaxEnvValueBytes is the largest value exported as an environment
+	// variable. Larger values have to be listed in file_keys.
+	MaxEnvValueBytes = 32 << 10
+
+	// MaxNodeConfigBytes is the largest JSON encoded configuration of a
+	// single node, file-delivered values included
+	MaxNodeConfigBytes = 1 << 20
+)
+
+// envNamePattern matches the names the agent can safely export. Config keys
+// are upper-cased first.
+var envNamePattern = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*$`)
+
+// reservedEnvNames are variables the workload relies on that node config may
+// not replace. Names starting with TASKFLY_ are reserved for the agent.
+var reservedEnvNames = map[string]bool{
+	"PATH":                  true,
+	"HOME":                  true,
+	"USER":                  true,
+	"SHELL":                 true,
+	"PWD":                   true,
+	"IFS":                   true,
+	"LD_PRELOAD":            true,
+	"LD_LIBRARY_PATH":       true,
+	"DYLD_INSERT_LIBRARIES": true,
+	"DYLD_LIBRARY_PATH":     true,
+}
+
+// EnvName returns the environment variable a config key is exported as
+func EnvName(key string) string {
+	return strings.ToUpper(key)
+}
+
+// FileEnvName returns the environment variable holding the path of a
+// file-delivered config key
+func FileEnvName(key string) string {
+	return EnvName(key) + "_FILE"
+}
+
+// EnvValue renders a config value the way the agent exports it: strings as
+// they are, numbers and booleans formatted and lists JSON encoded
+func EnvValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case int, int64, float64, bool:
+		return fmt.Sprintf("%v", v)
+	default:
+		if data, err := json.Marshal(v); err == nil {
+			return string(data)
+		}
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// validateFileKeys checks that each file key is safe to export and is set by
+// global_metadata, distributed_lists or config_template
+func validateFileKeys(config NodesConfig) error {
+	for _, key := range config.FileKeys {
+		if key == ScriptArgsKey || key == EntryCommandKey {
+			return fmt.Errorf("file_keys: %s is passed on the command line and can't be delivered as a file", key)
+		}
+		if err := validateEnvName(FileEnvName(key)); err != nil {
+			return fmt.Errorf("file_keys: key '%s' %w", key, err)
+		}
+
+		_, global := config.GlobalMetadata[key]
+		_, distributed := config.DistributedLists[key]
+		_, template := config.ConfigTemplate[key]
+		if !global && !distributed && !template {
+			return fmt.Errorf("file_keys: key '%s' is not set by global_metadata, distributed_lists or config_template", key)
+		}
+	}
+	return nil
+}
+
+// validateEnvName checks that name can be exported to the workload
+func validateEnvName(name string) error {
+	if !envNamePattern.MatchString(name) {
+		return fmt.Errorf("is exported as %s, which is not a valid environment variable name (letters, digits and underscores, not starting with a digit)", name)
+	}
+	if reservedEnvNames[name] || strings.HasPrefix(name, "TASKFLY_") {
+		return fmt.Errorf("is exported as %s, which is reserved", name)
+	}
+	return nil
+}
+
+// ValidateNodeConfig checks a node configuration changed after its deployment
+// was created against the same rules as generated ones. fileKeys are the keys
+// delivered as files.
+func ValidateNodeConfig(config map[string]interface{}, fileKeys []string) error {
+	files := make(map[string]bool, len(fileKeys))
+	for _, key := range fileKeys {
+		files[key] = true
+	}
+	return validateNodeConfig(config, files)
+}
+
+// validateNodeConfig checks the configuration generated for a node against
+// the limits. Keys in fileKeys may hold any value; the others are exported as
+// environment variables and must be simple values or lists of them, no
+// larger than MaxEnvValueBytes. Nested maps are converted so the config can
+// be JSON encoded.
+func validateNodeConfig(config map[string]interface{}, fileKeys map[string]bool) error {
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	names := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value := jsonValue(config[key])
+		config[key] = value
+
+		if key == ScriptArgsKey || key == EntryCommandKey {
+			continue
+		}
+
+		name := EnvName(key)
+		if other, exists := names[name]; exists {
+			return fmt.Errorf("config keys '%s' and '%s' are both exported as %s", other, key, name)
+		}
+		names[name] = key
+
+		if fileKeys[key] {
+			continue
+		}
+		if err := validateEnvName(name); err != nil {
+			return fmt.Errorf("config key '%s' %w", key, err)
+		}
+		if !isEnvValue(value) {
+			return fmt.Errorf("config key '%s' holds a %s, which can't be exported as an environment variable; list it under nodes.file_keys to deliver it as a file", key, describeValue(value))
+		}
+		rendered := EnvValue(value)
+		if strings.ContainsRune(rendered, 0) {
+			return fmt.Errorf("config key '%s' contains a NUL byte, which can't be exported as an environment variable; list it under nodes.file_keys to deliver it as a file", key)
+		}
+		if len(rendered) > MaxEnvValueBytes {
+			return fmt.Errorf("config key '%s' is %d bytes, more than the %d allowed in an environment variable; list it under nodes.file_keys to deliver it as a file", key, len(rendered), MaxEnvValueBytes)
+		}
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	if len(data) > MaxNodeConfigBytes {
+		return fmt.Errorf("config is %d bytes, more than the %d allowed per node; ship large data in the bundle instead", len(data), MaxNodeConfigBytes)
+	}
+	return nil
+}
+
+// isEnvValue reports whether a value is simple or a list of simple values
+func isEnvValue(value interface{}) bool {
+	switch v := value.(type) {
+	case string, int, int64, float64, bool, nil:
+		return true
+	case []string:
+		return true
+	case []interface{}:
+		for _, item := range v {
+			switch item.(type) {
+			case string, int, int64, float64, bool:
+			default:
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// describeValue names the kind of a value that isEnvValue rejects
+func describeValue(value interface{}) string {
+	if _, ok := value.(map[string]interface{}); ok {
+		return "map"
+	}
+	if _, ok := value.([]interface{}); ok {
+		return "list of non-simple values"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// jsonValue converts the map[interface{}]interface{} values YAML produces for
+// nested maps to map[string]interface{}, recursively
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[fmt.Sprintf("%v", key)] = jsonValue(item)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = jsonValue(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = jsonValue(item)
+		}
+		return result
+	}
+	return value
+}
@@ -0,0 +1,92 @@
+package metadata
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateNodeConfigsRejectsUnsafeConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]interface{}
+		fileKeys []string
+		err      string
+	}{
+		{
+			name:     "invalid name",
+			metadata: map[string]interface{}{"db-url": "postgres://"},
+			err:      "node 0: config key 'db-url' is exported as DB-URL, which is not a valid environment variable name (letters, digits and underscores, not starting with a digit)",
+		},
+		{
+			name:     "reserved name",
+			metadata: map[string]interface{}{"path": "/opt/bin"},
+			err:      "node 0: config key 'path' is exported as PATH, which is reserved",
+		},
+		{
+			name:     "agent name",
+			metadata: map[string]interface{}{"taskfly_progress_url": "http://example.com"},
+			err:      "node 0: config key 'taskfly_progress_url' is exported as TASKFLY_PROGRESS_URL, which is reserved",
+		},
+		{
+			name:     "same name",
+			metadata: map[string]interface{}{"region": "a", "REGION": "b"},
+			err:      "node 0: config keys 'REGION' and 'region' are both exported as REGION",
+		},
+		{
+			name:     "map",
+			metadata: map[string]interface{}{"settings": map[interface{}]interface{}{"retries": 3}},
+			err:      "node 0: config key 'settings' holds a map, which can't be exported as an environment variable; list it under nodes.file_keys to deliver it as a file",
+		},
+		{
+			name:     "large value",
+			metadata: map[string]interface{}{"certificate": strings.Repeat("x", MaxEnvValueBytes+1)},
+			err:      "node 0: config key 'certificate' is 32769 bytes, more than the 32768 allowed in an environment variable; list it under nodes.file_keys to deliver it as a file",
+		},
+		{
+			name:     "large config",
+			metadata: map[string]interface{}{"certificate": strings.Repeat("x", MaxNodeConfigBytes)},
+			fileKeys: []string{"certificate"},
+			err:      "node 0: config is 1048594 bytes, more than the 1048576 allowed per node; ship large data in the bundle instead",
+		},
+		{
+			name:     "unknown file key",
+			metadata: map[string]interface{}{"region": "a"},
+			fileKeys: []string{"regoin"},
+			err:      "file_keys: key 'regoin' is not set by global_metadata, distributed_lists or config_template",
+		},
+		{
+			name:     "invalid file key",
+			metadata: map[string]interface{}{"../secret": "a"},
+			fileKeys: []string{"../secret"},
+			err:      "file_keys: key '../secret' is exported as ../SECRET_FILE, which is not a valid environment variable name (letters, digits and underscores, not starting with a digit)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := GenerateNodeConfigs(NodesConfig{Count: 1, GlobalMetadata: tt.metadata, FileKeys: tt.fileKeys}, "dep_1")
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestGenerateNodeConfigsAllowsFileKeys(t *testing.T) {
+	nodes, err := GenerateNodeConfigs(NodesConfig{
+		Count: 2,
+		GlobalMetadata: map[string]interface{}{
+			"settings":    map[interface{}]interface{}{"retries": 3, "hosts": []interface{}{"a", "b"}},
+			"certificate": strings.Repeat("x", MaxEnvValueBytes+1),
+		},
+		DistributedLists: map[string][]interface{}{"shards": {1, 2, 3}},
+		FileKeys:         []string{"settings", "certificate"},
+	}, "dep_1")
+	require.NoError(t, err)
+
+	// Nested YAML maps are converted so the config can be sent as JSON
+	assert.Equal(t, map[string]interface{}{"retries": 3, "hosts": []interface{}{"a", "b"}}, nodes[0].Config["settings"])
+	assert.Equal(t, `{"hosts":["a","b"],"retries":3}`, EnvValue(nodes[1].Config["settings"]))
+	assert.Equal(t, []interface{}{1, 3}, nodes[0].Config["shards"])
+}
@@ -3,6 +3,8 @@ package metadata
 import (
 	"fmt"
 	"strings"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
 )
 
 // NodeConfig represents the configuration for a single node
@@ -12,14 +14,29 @@ type NodeConfig struct {
 	TotalNodes   int                    `json:"total_nodes"`
 	DeploymentID string                 `json:"deployment_id"`
 	Config       map[string]interface{} `json:"config"`
+	Sources      state.ConfigSources    `json:"sources,omitempty"` // where each key of Config came from
 }
 
+// Reserved config keys that parameterize the workload command line instead of
+// being exported as environment variables
+const (
+	// ScriptArgsKey holds extra arguments passed to the node's script
+	ScriptArgsKey = "script_args"
+
+	// EntryCommandKey replaces remote_script_to_run with another command for the node
+	EntryCommandKey = "entry_command"
+)
+
 // NodesConfig represents the enhanced nodes configuration
 type NodesConfig struct {
 	Count            int                      `yaml:"count"`
 	GlobalMetadata   map[string]interface{}   `yaml:"global_metadata"`
 	DistributedLists map[string][]interface{} `yaml:"distributed_lists"`
 	ConfigTemplate   map[string]interface{}   `yaml:"config_template"`
+
+	// FileKeys lists config keys the agent writes to files instead of
+	// exporting them as environment variables
+	FileKeys []string `yaml:"file_keys"`
 }
 
 // GenerateNodeConfigs creates individual configurations for each node
@@ -28,6 +45,11 @@ func GenerateNodeConfigs(nodesConfig NodesConfig, deploymentID string) ([]NodeCo
 		return nil, err
 	}
 
+	fileKeys := make(map[string]bool, len(nodesConfig.FileKeys))
+	for _, key := range nodesConfig.FileKeys {
+		fileKeys[key] = true
+	}
+
 	nodeConfigs := make([]NodeConfig, nodesConfig.Count)
 
 	for i := 0; i < nodesConfig.Count; i++ {
@@ -38,11 +60,13 @@ func GenerateNodeConfigs(nodesConfig NodesConfig, deploymentID string) ([]NodeCo
 			TotalNodes:   nodesConfig.Count,
 			DeploymentID: deploymentID,
 			Config:       make(map[string]interface{}),
+			Sources:      make(state.ConfigSources),
 		}
 
 		// Copy global metadata
 		for key, value := range nodesConfig.GlobalMetadata {
 			nodeConfig.Config[key] = value
+			nodeConfig.Sources[key] = state.ConfigSource{From: state.ConfigFromGlobalMetadata}
 		}
 
 		// Distribute list items to this node in round-robin fashion
@@ -53,8 +77,10 @@ func GenerateNodeConfigs(nodesConfig NodesConfig, deploymentID string) ([]NodeCo
 
 			// Collect all items that should go to this node (round-robin)
 			var nodeItems []interface{}
+			var itemIndexes []int
 			for itemIndex := i; itemIndex < len(listItems); itemIndex += nodesConfig.Count {
 				item := listItems[itemIndex]
+				itemIndexes = append(itemIndexes, itemIndex)
 
 				// Only allow simple types (strings, numbers, booleans)
 				switch item.(type) {
@@ -68,6 +94,11 @@ func GenerateNodeConfigs(nodesConfig NodesConfig, deploymentID string) ([]NodeCo
 			// Always store as array for consistency
 			if len(nodeItems) > 0 {
 				nodeConfig.Config[listName] = nodeItems
+				nodeConfig.Sources[listName] = state.ConfigSource{
+					From:      state.ConfigFromDistributedLists,
+					Items:     itemIndexes,
+					Overrides: nodeConfig.Sources[listName].From,
+				}
 			}
 		}
 
@@ -76,6 +107,21 @@ func GenerateNodeConfigs(nodesConfig NodesConfig, deploymentID string) ([]NodeCo
 		for key, value := range nodesConfig.ConfigTemplate {
 			processedValue := processSimpleTemplate(value, nodeConfig)
 			nodeConfig.Config[key] = processedValue
+			nodeConfig.Sources[key] = state.ConfigSource{
+				From:      state.ConfigFromConfigTemplate,
+				Template:  jsonValue(value),
+				Overrides: nodeConfig.Sources[key].From,
+			}
+		}
+
+		// Normalize script argument and entry command overrides
+		if err := normalizeCommandOverrides(nodeConfig.Config); err != nil {
+			return nil, fmt.Errorf("node %d: %w", i, err)
+		}
+
+		// Check what the agent will export or write to files
+		if err := validateNodeConfig(nodeConfig.Config, fileKeys); err != nil {
+			return nil, fmt.Errorf("node %d: %w", i, err)
 		}
 
 		nodeConfigs[i] = nodeConfig
@@ -139,6 +185,62 @@ func processSimpleTemplate(value interface{}, nodeConfig NodeConfig) interface{}
 	}
 }
 
+// normalizeCommandOverrides converts script_args and entry_command to string
+// slices so the agent can pass them straight to the workload
+func normalizeCommandOverrides(config map[string]interface{}) error {
+	if value, ok := config[ScriptArgsKey]; ok {
+		args, err := toArgList(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", ScriptArgsKey, err)
+		}
+		config[ScriptArgsKey] = args
+	}
+
+	if value, ok := config[EntryCommandKey]; ok {
+		var command []string
+		if str, ok := value.(string); ok {
+			command = strings.Fields(str)
+		} else {
+			var err error
+			if command, err = toArgList(value); err != nil {
+				return fmt.Errorf("invalid %s: %w", EntryCommandKey, err)
+			}
+			// A single item (e.g. from a distributed list) is a full command line
+			if len(command) == 1 {
+				command = strings.Fields(command[0])
+			}
+		}
+		if len(command) == 0 {
+			return fmt.Errorf("%s cannot be empty", EntryCommandKey)
+		}
+		config[EntryCommandKey] = command
+	}
+
+	return nil
+}
+
+// toArgList converts a list of simple values (or a single one) to strings
+func toArgList(value interface{}) ([]string, error) {
+	items, ok := value.([]interface{})
+	if !ok {
+		items = []interface{}{value}
+	}
+
+	args := make([]string, 0, len(items))
+	for _, item := range items {
+		switch v := item.(type) {
+		case string:
+			args = append(args, v)
+		case int, int64, float64, bool:
+			args = append(args, fmt.Sprintf("%v", v))
+		default:
+			return nil, fmt.Errorf("contains complex type %T - only simple types (string, int, float, bool) are supported", item)
+		}
+	}
+
+	return args, nil
+}
+
 // ValidateNodesConfig validates the nodes configuration
 func ValidateNodesConfig(config NodesConfig) error {
 	if config.Count <= 0 {
@@ -152,5 +254,5 @@ func ValidateNodesConfig(config NodesConfig) error {
 		}
 	}
 
-	return nil
+	return validateFileKeys(config)
 }
@@ -0,0 +1,40 @@
+package metadata
+
+import (
+	"testing"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateNodeConfigsRecordsSources(t *testing.T) {
+	nodes, err := GenerateNodeConfigs(NodesConfig{
+		Count: 2,
+		GlobalMetadata: map[string]interface{}{
+			"bucket": "data",
+			"region": "us-east-1",
+		},
+		DistributedLists: map[string][]interface{}{
+			"shards": {"a", "b", "c"},
+			"region": {"eu-west-1"},
+		},
+		ConfigTemplate: map[string]interface{}{
+			"output": "s3://{bucket}/out-{node_index}",
+		},
+	}, "dep_1")
+	require.NoError(t, err)
+
+	assert.Equal(t, state.ConfigSources{
+		"bucket": {From: state.ConfigFromGlobalMetadata},
+		"region": {From: state.ConfigFromDistributedLists, Items: []int{0}, Overrides: state.ConfigFromGlobalMetadata},
+		"shards": {From: state.ConfigFromDistributedLists, Items: []int{0, 2}},
+		"output": {From: state.ConfigFromConfigTemplate, Template: "s3://{bucket}/out-{node_index}"},
+	}, nodes[0].Sources)
+	assert.Equal(t, "s3://data/out-0", nodes[0].Config["output"])
+
+	// Lists shorter than the node count leave the global value in place
+	assert.Equal(t, "us-east-1", nodes[1].Config["region"])
+	assert.Equal(t, state.ConfigSource{From: state.ConfigFromGlobalMetadata}, nodes[1].Sources["region"])
+	assert.Equal(t, []int{1}, nodes[1].Sources["shards"].Items)
+}
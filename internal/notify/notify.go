@@ -0,0 +1,107 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Event is a notification about a deployment or one of its nodes
+type Event struct {
+	Kind         string    `json:"kind"`
+	DeploymentID string    `json:"deployment_id"`
+	NodeID       string    `json:"node_id,omitempty"`
+	Summary      string    `json:"summary"`
+	Hint         string    `json:"hint,omitempty"`
+	DocsURL      string    `json:"docs_url,omitempty"`
+	Time         time.Time `json:"time"`
+
+	// Text renders the event as one message for chat webhooks (Slack,
+	// Mattermost) that only look at this field
+	Text string `json:"text"`
+}
+
+// Notifier delivers events as JSON POSTs to webhooks
+type Notifier struct {
+	urls   []string
+	client *http.Client
+}
+
+// New creates a notifier posting to urls. Without urls it returns nil, and
+// sending to a nil notifier does nothing.
+func New(urls []string, timeout time.Duration) *Notifier {
+	if len(urls) == 0 {
+		return nil
+	}
+	return &Notifier{
+		urls:   urls,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Send posts an event to every webhook and returns the failures
+func (n *Notifier) Send(ctx context.Context, event Event) error {
+	if n == nil {
+		return nil
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Text == "" {
+		event.Text = renderText(event)
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	var errs []error
+	for _, url := range n.urls {
+		if err := n.post(ctx, url, body); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// post delivers a notification body to one webhook
+func (n *Notifier) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create notification request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to notify %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook %s returned %s: %s", url, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+// renderText formats an event as a single chat message
+func renderText(event Event) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[TaskFly] %s", event.Summary)
+	if event.Hint != "" {
+		fmt.Fprintf(&b, "\n%s", event.Hint)
+	}
+	if event.DocsURL != "" {
+		fmt.Fprintf(&b, "\nSee %s", event.DocsURL)
+	}
+	return b.String()
+}
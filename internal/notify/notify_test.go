@@ -0,0 +1,58 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendPostsToAllWebhooks(t *testing.T) {
+	var received []Event
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		received = append(received, event)
+	})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+
+	notifier := New([]string{first.URL, second.URL}, time.Second)
+	err := notifier.Send(context.Background(), Event{
+		Kind:         "node_stalled",
+		DeploymentID: "dep_1",
+		Summary:      "Node dep_1_node_0 stuck in booting",
+		Hint:         "Check that nodes can reach the daemon",
+		DocsURL:      "https://example.com/docs#booting",
+	})
+	require.NoError(t, err)
+
+	require.Len(t, received, 2)
+	assert.Equal(t, "node_stalled", received[0].Kind)
+	assert.False(t, received[0].Time.IsZero())
+	assert.Contains(t, received[0].Text, "Node dep_1_node_0 stuck in booting")
+	assert.Contains(t, received[0].Text, "https://example.com/docs#booting")
+}
+
+func TestSendReportsFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	err := New([]string{server.URL}, time.Second).Send(context.Background(), Event{Summary: "test"})
+	assert.ErrorContains(t, err, "403")
+}
+
+func TestNilNotifier(t *testing.T) {
+	notifier := New(nil, time.Second)
+	assert.Nil(t, notifier)
+	assert.NoError(t, notifier.Send(context.Background(), Event{Summary: "dropped"}))
+}
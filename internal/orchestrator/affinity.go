@@ -0,0 +1,93 @@
+package orchestrator
+
+import "github.com/JustinTimperio/TaskFly/internal/state"
+
+// assignHosts picks the host of each node of a local deployment, indexed by
+// node index. When more hosts are configured than there are nodes, hosts
+// whose agents have the deployment's bundle cached are preferred. It returns
+// nil when the local provider should pick hosts itself.
+func (o *Orchestrator) assignHosts(deploymentID string, count int, config *TaskFlyConfig) []string {
+	if config.CloudProvider != "local" || o.bundles == nil {
+		return nil
+	}
+	configured, ok := config.InstanceConfig["local"]["hosts"].([]interface{})
+	if !ok || len(configured) <= count {
+		return nil
+	}
+	hosts := make([]string, 0, len(configured))
+	for _, host := range configured {
+		if host, ok := host.(string); ok && host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) <= count {
+		return nil
+	}
+
+	deployment, err := o.store.GetDeployment(deploymentID)
+	if err != nil || deployment.BundleDigest == "" {
+		return nil
+	}
+
+	log := o.deploymentLog(deploymentID, config.Debug)
+	assigned := o.bundles.AssignHosts(hosts, count, deployment.BundleDigest)
+	cached := 0
+	for _, host := range assigned {
+		if o.bundles.Holds(host, deployment.BundleDigest) {
+			cached++
+		}
+	}
+	log.Infof("Placing %d nodes on %d of %d hosts, %d of which have the bundle cached", count, len(assigned), len(hosts), cached)
+	log.Debugf("Hosts of deployment %s: %v", deploymentID, assigned)
+	return assigned
+}
+
+// RecordCachedBundles remembers the bundles the agent of a node reported
+// having cached when it registered. Only hosts of local deployments are
+// tracked, since cloud instances don't outlive their deployment.
+func (o *Orchestrator) RecordCachedBundles(deployment *state.Deployment, node *state.Node, digests []string) {
+	host := o.nodeHost(deployment, node)
+	if host == "" {
+		return
+	}
+	if err := o.bundles.Record(host, digests); err != nil {
+		o.logger.Warnf("Failed to record bundles cached on %s: %v", host, err)
+	}
+}
+
+// RecordBundleServed remembers that the agent of a node downloaded its
+// deployment's bundle and will have it cached
+func (o *Orchestrator) RecordBundleServed(deployment *state.Deployment, node *state.Node) {
+	host := o.nodeHost(deployment, node)
+	if host == "" {
+		return
+	}
+	if err := o.bundles.Add(host, deployment.BundleDigest); err != nil {
+		o.logger.Warnf("Failed to record bundle cached on %s: %v", host, err)
+	}
+}
+
+// nodeHost returns the host a node of a local deployment runs on. Agents can
+// register before the provider returns, so the host picked when provisioning
+// is used until the node's address is stored.
+func (o *Orchestrator) nodeHost(deployment *state.Deployment, node *state.Node) string {
+	if o.bundles == nil || deployment.CloudProvider != "local" {
+		return ""
+	}
+	if host, ok := o.nodeHosts.Load(node.NodeID); ok {
+		return host.(string)
+	}
+	return node.IPAddress
+}
+
+// configuredHost returns the host the local provider picks for a node index
+// when the orchestrator doesn't assign one
+func configuredHost(instanceConfig map[string]interface{}, nodeIndex int) string {
+	if hosts, ok := instanceConfig["hosts"].([]interface{}); ok && nodeIndex < len(hosts) {
+		if host, ok := hosts[nodeIndex].(string); ok && host != "" {
+			return host
+		}
+	}
+	host, _ := instanceConfig["host"].(string)
+	return host
+}
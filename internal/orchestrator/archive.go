@@ -0,0 +1,173 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/bundle"
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/JustinTimperio/TaskFly/internal/variables"
+	"gopkg.in/yaml.v2"
+)
+
+// ArchiveManifestName is the file in a deployment archive that describes the
+// exported deployment
+const ArchiveManifestName = "taskfly-export.json"
+
+// archiveVersion is the version of the deployment archive format
+const archiveVersion = 1
+
+// ErrArchiveUnavailable is returned by ExportDeployment when the files of a
+// deployment are gone or predate exports
+var ErrArchiveUnavailable = errors.New("deployment files are not available for export")
+
+// ArchiveManifest describes the deployment a deployment archive was exported
+// from. Archives carry the deployment's taskfly.yml and application files, so
+// uploading one creates the same deployment again with fresh nodes.
+type ArchiveManifest struct {
+	Version        int                    `json:"version"`
+	DeploymentID   string                 `json:"deployment_id"`
+	Daemon         string                 `json:"daemon"`
+	ExportedAt     time.Time              `json:"exported_at"`
+	Namespace      string                 `json:"namespace,omitempty"`
+	Status         state.DeploymentStatus `json:"status"`
+	CloudProvider  string                 `json:"cloud_provider"`
+	TotalNodes     int                    `json:"total_nodes"`
+	NodesCompleted int                    `json:"nodes_completed"`
+	NodesFailed    int                    `json:"nodes_failed"`
+	TemplateID     string                 `json:"template_id,omitempty"`
+	KeepFailed     int                    `json:"keep_failed,omitempty"`
+	CreatedAt      time.Time              `json:"created_at"`
+	CompletedAt    *time.Time             `json:"completed_at,omitempty"`
+	Variables      map[string]string      `json:"variables,omitempty"` // used where the import gives no --var; sensitive ones are left out
+}
+
+// ExportDeployment writes a deployment archive to archivePath: a bundle with
+// the deployment's taskfly.yml, its application files and an
+// ArchiveManifestName file. Nodes and their state are not exported.
+func (o *Orchestrator) ExportDeployment(deploymentID, archivePath string) (*ArchiveManifest, error) {
+	deployment, err := o.store.GetDeployment(deploymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	// taskfly.yml is kept next to the application files since deployment
+	// archives were added, until the deployment's files are cleaned up
+	extractDir := filepath.Join(o.workingDir, deploymentID)
+	configPath := filepath.Join(extractDir, "taskfly.yml")
+	configData, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, ErrArchiveUnavailable
+	}
+	vars := make(map[string]string, len(deployment.Variables))
+	for name, value := range deployment.Variables {
+		vars[name] = variables.Format(value)
+	}
+	if _, configData, err = substituteVariables(configData, vars); err != nil {
+		return nil, fmt.Errorf("failed to substitute variables of taskfly.yml: %w", err)
+	}
+	var config TaskFlyConfig
+	if err := yaml.Unmarshal(configData, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse taskfly.yml: %w", err)
+	}
+
+	files, err := applicationFiles(extractDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list application files: %w", err)
+	}
+
+	manifest := &ArchiveManifest{
+		Version:        archiveVersion,
+		DeploymentID:   deployment.ID,
+		Daemon:         o.daemonURL,
+		ExportedAt:     o.clock.Now().UTC(),
+		Namespace:      deployment.Namespace,
+		Status:         deployment.Status,
+		CloudProvider:  deployment.CloudProvider,
+		TotalNodes:     deployment.TotalNodes,
+		NodesCompleted: deployment.NodesCompleted,
+		NodesFailed:    deployment.NodesFailed,
+		TemplateID:     deployment.TemplateID,
+		KeepFailed:     deployment.KeepFailed,
+		CreatedAt:      deployment.CreatedAt,
+		CompletedAt:    deployment.CompletedAt,
+	}
+	// Sensitive values must be given again on import
+	exported := make(map[string]string, len(vars))
+	for name, value := range vars {
+		exported[name] = value
+	}
+	for _, name := range deployment.SensitiveVariables {
+		delete(exported, name)
+	}
+	if len(exported) > 0 {
+		manifest.Variables = exported
+	}
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	manifestFile, err := os.CreateTemp("", "taskfly-export-*.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write archive manifest: %w", err)
+	}
+	defer os.Remove(manifestFile.Name())
+	if _, err := manifestFile.Write(manifestData); err != nil {
+		manifestFile.Close()
+		return nil, fmt.Errorf("failed to write archive manifest: %w", err)
+	}
+	if err := manifestFile.Chmod(0644); err != nil {
+		manifestFile.Close()
+		return nil, fmt.Errorf("failed to write archive manifest: %w", err)
+	}
+	if err := manifestFile.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write archive manifest: %w", err)
+	}
+
+	files = append(files,
+		bundle.File{Name: "taskfly.yml", Path: configPath},
+		bundle.File{Name: ArchiveManifestName, Path: manifestFile.Name()},
+	)
+	warnings, err := bundle.Create(archivePath, files, bundle.Options{PreserveModTimes: config.PreserveMtimes})
+	for _, warning := range warnings {
+		o.logger.Warnf("Archive of deployment %s: %s", deploymentID, warning)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive: %w", err)
+	}
+	return manifest, nil
+}
+
+// readArchiveManifest reads and removes the manifest of an extracted
+// deployment archive, so it doesn't reach the nodes. Plain bundles have none.
+func readArchiveManifest(extractDir string) (*ArchiveManifest, error) {
+	path := filepath.Join(extractDir, ArchiveManifestName)
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("invalid %s in bundle", ArchiveManifestName)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", ArchiveManifestName, err)
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, fmt.Errorf("failed to remove %s from worker files: %w", ArchiveManifestName, err)
+	}
+
+	var manifest ArchiveManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", ArchiveManifestName, err)
+	}
+	if manifest.Version > archiveVersion {
+		return nil, fmt.Errorf("deployment archive version %d is newer than this daemon supports (%d)", manifest.Version, archiveVersion)
+	}
+	return &manifest, nil
+}
@@ -0,0 +1,27 @@
+package orchestrator
+
+import "errors"
+
+// errArtifactStorageDisabled rejects deployments choosing an artifact storage
+// on daemons that don't check the choice
+var errArtifactStorageDisabled = errors.New("this daemon doesn't let deployments choose where artifacts are kept")
+
+// SetArtifactStorage sets how the artifact_storage a deployment chooses is
+// checked, such as against the locations the daemon allows. Without it
+// deployments can't choose. It must be called before the orchestrator is
+// used.
+func (o *Orchestrator) SetArtifactStorage(check func(location string) error) {
+	o.artifactStorage = check
+}
+
+// checkArtifactStorage checks the artifact_storage of a deployment's
+// configuration. Deployments that don't choose keep the daemon's.
+func (o *Orchestrator) checkArtifactStorage(location string) error {
+	if location == "" {
+		return nil
+	}
+	if o.artifactStorage == nil {
+		return errArtifactStorageDisabled
+	}
+	return o.artifactStorage(location)
+}
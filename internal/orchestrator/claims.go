@@ -0,0 +1,133 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/cloud"
+	"github.com/JustinTimperio/TaskFly/internal/state"
+)
+
+// DefaultClaimTimeout is how long agents have to register once their node was
+// provisioned, unless the daemon is configured otherwise. It is generous, so
+// hosts that are only slow to boot don't fail.
+const DefaultClaimTimeout = 30 * time.Minute
+
+// SetClaimTimeout sets how long agents have to register once their node was
+// provisioned. 0 keeps provision tokens valid until the node registers. It
+// must be called before the orchestrator is used.
+func (o *Orchestrator) SetClaimTimeout(timeout time.Duration) {
+	o.claimTimeout = timeout
+}
+
+// unclaimed reports whether a node was provisioned but its agent hasn't
+// registered yet. Nodes still being provisioned are left to the provisioning
+// timeout.
+func unclaimed(node *state.Node) bool {
+	if state.Registered(node) {
+		return false
+	}
+	return node.Status == state.NodeStatusBooting || node.Status == state.NodeStatusRegistering
+}
+
+// startClaimDeadline gives the agent of a node that was just provisioned
+// until the claim timeout to register
+func (o *Orchestrator) startClaimDeadline(node *state.Node) {
+	if o.claimTimeout <= 0 {
+		return
+	}
+	if err := o.store.SetClaimDeadline(node.DeploymentID, node.NodeID, o.clock.Now().Add(o.claimTimeout)); err != nil {
+		o.logger.Errorf("Failed to set claim deadline of node %s: %v", node.NodeID, err)
+	}
+}
+
+// ExpireUnclaimedNodes fails provisioned nodes whose agent didn't register
+// before the claim deadline, so their provision tokens can't be used anymore
+// and the deployment doesn't wait for them forever. Instances TaskFly
+// created for them are terminated. Failed nodes are not replaced, the
+// deployment finishes without them. Unclaimed nodes without a deadline,
+// e.g. provisioned before the daemon restarted with a claim timeout, get
+// one. Returns the number of nodes failed.
+func (o *Orchestrator) ExpireUnclaimedNodes() int {
+	if o.claimTimeout <= 0 {
+		return 0
+	}
+
+	now := o.clock.Now()
+	expired := 0
+	for _, deployment := range o.store.GetAllDeployments() {
+		if deployment.Status == state.StatusTerminating || deployment.Status == state.StatusTerminated {
+			continue
+		}
+
+		nodes, err := o.store.GetNodesByDeployment(deployment.ID)
+		if err != nil {
+			o.logger.Errorf("Failed to get nodes of deployment %s: %v", deployment.ID, err)
+			continue
+		}
+
+		var provider cloud.Provider
+		failed := false
+		for _, node := range nodes {
+			if !unclaimed(node) {
+				continue
+			}
+			if node.ClaimDeadline == nil {
+				o.startClaimDeadline(node)
+				continue
+			}
+			if now.Before(*node.ClaimDeadline) {
+				continue
+			}
+
+			message := fmt.Sprintf("agent did not register within %s of provisioning, provision token expired", o.claimTimeout)
+			owned := node.InstanceID != "" && cloud.OwnsInstances(deployment.CloudProvider)
+			if owned {
+				message += fmt.Sprintf("; instance %s is terminated", node.InstanceID)
+			} else if node.InstanceID != "" {
+				message += fmt.Sprintf("; check the agent log on instance %s", node.InstanceID)
+			}
+			o.deploymentLog(deployment.ID, deployment.Debug).Warnf("Node %s: %s", node.NodeID, message)
+			if err := o.store.UpdateNodeStatus(deployment.ID, node.NodeID, state.NodeStatusFailed, message); err != nil {
+				o.logger.Errorf("Failed to fail unclaimed node %s: %v", node.NodeID, err)
+				continue
+			}
+			failed = true
+			expired++
+
+			if !owned {
+				continue
+			}
+			if provider == nil {
+				if provider, err = o.providers.NewProvider(deployment.CloudProvider, providerConfig(deployment)); err != nil {
+					o.logger.Errorf("Failed to create provider for deployment %s: %v", deployment.ID, err)
+					continue
+				}
+			}
+			o.terminateUnclaimed(node, provider)
+		}
+		if failed {
+			o.RecordCompletionReport(deployment.ID)
+		}
+	}
+
+	return expired
+}
+
+// terminateUnclaimed terminates the instance of a node whose agent never
+// registered, so it doesn't keep running unnoticed. The node is marked for
+// shutdown first, in case its agent comes up after all.
+func (o *Orchestrator) terminateUnclaimed(node *state.Node, provider cloud.Provider) {
+	if err := o.store.MarkNodeForShutdown(node.DeploymentID, node.NodeID); err != nil {
+		o.logger.Errorf("Failed to mark unclaimed node %s for shutdown: %v", node.NodeID, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := ensureTerminated(ctx, provider, node.InstanceID); err != nil {
+		o.logger.Errorf("Failed to terminate instance %s of unclaimed node %s: %v", node.InstanceID, node.NodeID, err)
+		return
+	}
+	o.logger.Infof("Terminated instance %s of unclaimed node %s", node.InstanceID, node.NodeID)
+}
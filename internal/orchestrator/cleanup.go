@@ -0,0 +1,171 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+)
+
+// minCleanupInterval keeps a misconfigured policy from scanning all
+// deployments in a tight loop
+const minCleanupInterval = time.Minute
+
+// CleanupPolicy controls the periodic cleanup of finished deployments:
+// completed, failed and terminated ones
+type CleanupPolicy struct {
+	// Interval is how often cleanup runs, 0 turns it off
+	Interval time.Duration
+	// FilesAfter is how long after it finished a deployment's bundle and
+	// extracted files are removed. Its state stays, so it is still listed
+	// and reported, but it can't be exported anymore.
+	FilesAfter time.Duration
+	// RemoveState also removes the deployment and its nodes from the state
+	// store StateAfter after it finished, after terminating what is left of
+	// its instances
+	RemoveState bool
+	StateAfter  time.Duration
+}
+
+// DefaultCleanupPolicy is what the daemon did before cleanup was
+// configurable: files go after an hour, state within ten minutes
+var DefaultCleanupPolicy = CleanupPolicy{
+	Interval:    10 * time.Minute,
+	FilesAfter:  time.Hour,
+	RemoveState: true,
+}
+
+// Validate rejects negative durations and intervals that would run cleanup
+// more than once a minute
+func (p CleanupPolicy) Validate() error {
+	if p.Interval < 0 || p.FilesAfter < 0 || p.StateAfter < 0 {
+		return fmt.Errorf("cleanup durations can't be negative")
+	}
+	if p.Interval > 0 && p.Interval < minCleanupInterval {
+		return fmt.Errorf("cleanup interval must be at least %s, or 0 to turn cleanup off", minCleanupInterval)
+	}
+	return nil
+}
+
+// CleanupRun is the outcome of one cleanup
+type CleanupRun struct {
+	At           time.Time `json:"at"`
+	FilesRemoved int       `json:"files_removed"` // deployments whose files were removed
+	StateRemoved int       `json:"state_removed"` // deployments removed from state
+	Failed       int       `json:"failed"`        // deployments whose instances couldn't be terminated
+}
+
+// SetCleanupPolicy replaces the cleanup policy. A running RunCleanup picks
+// it up right away, waiting the new interval from now.
+func (o *Orchestrator) SetCleanupPolicy(policy CleanupPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+
+	o.cleanupMu.Lock()
+	o.cleanupPolicy = policy
+	o.cleanupMu.Unlock()
+
+	select {
+	case o.cleanupChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// CleanupPolicy returns the cleanup policy and the outcome of the last
+// cleanup, nil before the first
+func (o *Orchestrator) CleanupPolicy() (CleanupPolicy, *CleanupRun) {
+	o.cleanupMu.Lock()
+	defer o.cleanupMu.Unlock()
+	return o.cleanupPolicy, o.lastCleanup
+}
+
+// RunCleanup cleans up finished deployments by the cleanup policy until ctx
+// is done
+func (o *Orchestrator) RunCleanup(ctx context.Context) {
+	for {
+		policy, _ := o.CleanupPolicy()
+		var due <-chan time.Time
+		if policy.Interval > 0 {
+			due = o.clock.After(policy.Interval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.cleanupChanged:
+		case <-due:
+			run := o.CleanupFinished()
+			if run.FilesRemoved > 0 || run.StateRemoved > 0 || run.Failed > 0 {
+				o.logger.Infof("Periodic cleanup: files of %d deployments removed, %d deployments removed, %d failed",
+					run.FilesRemoved, run.StateRemoved, run.Failed)
+			}
+		}
+	}
+}
+
+// CleanupFinished applies the cleanup policy once. Deployments whose nodes
+// are kept for idle shutdown or debugging are left for a later run.
+func (o *Orchestrator) CleanupFinished() CleanupRun {
+	policy, _ := o.CleanupPolicy()
+	now := o.clock.Now()
+	run := CleanupRun{At: now}
+
+	for _, dep := range o.store.GetAllDeployments() {
+		if dep.Status != state.StatusCompleted && dep.Status != state.StatusFailed && dep.Status != state.StatusTerminated {
+			continue
+		}
+		finishedAt := dep.UpdatedAt
+		if dep.CompletedAt != nil {
+			finishedAt = *dep.CompletedAt
+		}
+		age := now.Sub(finishedAt)
+
+		removeState := policy.RemoveState && age >= policy.StateAfter
+		removeFiles := age >= policy.FilesAfter && o.hasDeploymentFiles(dep.ID)
+		if !removeState && !removeFiles {
+			continue
+		}
+		if o.awaitingIdleShutdown(dep) {
+			o.logger.Debugf("Keeping deployment %s until its nodes are shut down", dep.ID)
+			continue
+		}
+
+		if removeState {
+			if err := o.CleanupDeployment(dep.ID); err != nil {
+				o.logger.Errorf("Failed to cleanup deployment %s: %v", dep.ID, err)
+				run.Failed++
+			} else {
+				run.StateRemoved++
+			}
+			continue
+		}
+
+		// Files are only removed once no instance is left, so a leftover
+		// instance stays traceable and is retried on the next run
+		if err := o.terminateInstances(dep); err != nil {
+			o.logger.Errorf("Keeping files of deployment %s: %v", dep.ID, err)
+			run.Failed++
+			continue
+		}
+		o.logger.Infof("Cleaning up files of old deployment: %s", dep.ID)
+		o.cleanupDeploymentFiles(dep.ID)
+		run.FilesRemoved++
+	}
+
+	o.cleanupMu.Lock()
+	o.lastCleanup = &run
+	o.cleanupMu.Unlock()
+	return run
+}
+
+// hasDeploymentFiles reports whether the extraction directory of a
+// deployment, which holds its worker bundle, is still there
+func (o *Orchestrator) hasDeploymentFiles(deploymentID string) bool {
+	_, err := os.Stat(filepath.Join(o.workingDir, deploymentID))
+	return err == nil
+}
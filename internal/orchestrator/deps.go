@@ -0,0 +1,69 @@
+package orchestrator
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/cloud"
+)
+
+// ProviderFactory creates the cloud provider a deployment runs on.
+// *cloud.ProviderFactory creates the real ones.
+type ProviderFactory interface {
+	NewProvider(providerName string, config map[string]interface{}) (cloud.Provider, error)
+}
+
+// Clock tells the orchestrator the time and lets it wait
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// IDGenerator generates deployment IDs and provision tokens
+type IDGenerator interface {
+	// NewID returns a new unique ID with the given prefix, e.g. dep_1a2b3c4d
+	NewID(prefix string) (string, error)
+}
+
+// Dependencies are what the orchestrator relies on beyond its state store.
+// Tests replace them to control providers, time and IDs; nil fields keep the
+// current ones.
+type Dependencies struct {
+	Providers ProviderFactory
+	Clock     Clock
+	IDs       IDGenerator
+}
+
+// SetDependencies replaces the dependencies of the orchestrator. It must be
+// called before the orchestrator is used.
+func (o *Orchestrator) SetDependencies(deps Dependencies) {
+	if deps.Providers != nil {
+		o.providers = deps.Providers
+	}
+	if deps.Clock != nil {
+		o.clock = deps.Clock
+	}
+	if deps.IDs != nil {
+		o.ids = deps.IDs
+	}
+}
+
+// systemClock is the real time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// randomIDs generates IDs from 4 random bytes
+type randomIDs struct{}
+
+func (randomIDs) NewID(prefix string) (string, error) {
+	bytes := make([]byte, 4)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s_%s", prefix, hex.EncodeToString(bytes)), nil
+}
@@ -1,62 +1,148 @@
 package orchestrator
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"context"
-	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/JustinTimperio/TaskFly/internal/bundle"
 	"github.com/JustinTimperio/TaskFly/internal/cloud"
 	"github.com/JustinTimperio/TaskFly/internal/metadata"
+	"github.com/JustinTimperio/TaskFly/internal/policy"
+	"github.com/JustinTimperio/TaskFly/internal/report"
 	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/JustinTimperio/TaskFly/internal/variables"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
 // TaskFlyConfig represents the taskfly.yml configuration
 type TaskFlyConfig struct {
-	CloudProvider     string                            `yaml:"cloud_provider"`
-	InstanceConfig    map[string]map[string]interface{} `yaml:"instance_config"`
-	ApplicationFiles  []string                          `yaml:"application_files"`
-	RemoteDestDir     string                            `yaml:"remote_dest_dir"`
-	RemoteScriptToRun string                            `yaml:"remote_script_to_run"`
-	BundleName        string                            `yaml:"bundle_name"`
-	Nodes             metadata.NodesConfig              `yaml:"nodes"`
+	CloudProvider           string                            `yaml:"cloud_provider"`
+	InstanceConfig          map[string]map[string]interface{} `yaml:"instance_config"`
+	ApplicationFiles        []string                          `yaml:"application_files"`
+	RemoteDestDir           string                            `yaml:"remote_dest_dir"`
+	RemoteScriptToRun       string                            `yaml:"remote_script_to_run"`
+	RemoteScriptArgs        []string                          `yaml:"remote_script_args"`
+	RemoteScriptInterpreter string                            `yaml:"remote_script_interpreter"`
+	BundleName              string                            `yaml:"bundle_name"`
+	PreserveMtimes          bool                              `yaml:"preserve_mtimes"`
+	NetworkMode             string                            `yaml:"network_mode"`
+	Labels                  map[string]string                 `yaml:"labels"`
+	TelemetryHooks          TelemetryHooksConfig              `yaml:"telemetry_hooks"`
+	IdleShutdown            IdleShutdownConfig                `yaml:"idle_shutdown"`
+	Watchdog                WatchdogConfig                    `yaml:"watchdog"`
+	Limits                  LimitsConfig                      `yaml:"limits"`
+	KeepFailed              string                            `yaml:"keep_failed"`
+	ArtifactStorage         string                            `yaml:"artifact_storage"`
+	Debug                   bool                              `yaml:"debug"`
+	Variables               map[string]variables.Variable     `yaml:"variables"`
+	Nodes                   metadata.NodesConfig              `yaml:"nodes"`
+}
+
+// sensitiveVariables returns the sorted names of the variables declared
+// sensitive
+func (c *TaskFlyConfig) sensitiveVariables() []string {
+	var names []string
+	for name, variable := range c.Variables {
+		if variable.Sensitive {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TelemetryHooksConfig configures the executables agents run periodically to
+// report custom metrics and health checks
+type TelemetryHooksConfig struct {
+	Dir      string `yaml:"dir" json:"dir"`           // relative to remote_dest_dir
+	Interval int    `yaml:"interval" json:"interval"` // seconds between runs
+	Timeout  int    `yaml:"timeout" json:"timeout"`   // seconds per hook run
 }
 
 // Orchestrator manages the deployment lifecycle
 type Orchestrator struct {
-	store      state.StateStore
-	workingDir string
-	logger     *logrus.Logger
-	daemonURL  string
+	store             state.StateStore
+	workingDir        string
+	logger            *logrus.Logger
+	daemonURL         string
+	daemonInternalURL string             // Optional callback URL for agents in private subnets
+	envPolicy         *policy.EnvPolicy  // Optional restrictions on variables distributed to nodes
+	admission         *policy.OPA        // Optional admission policy evaluated before provisioning
+	timings           *report.Timings    // Optional node durations of past deployments per template
+	bundles           *cloud.BundleIndex // Optional bundles cached on static hosts
+
+	// nodeHosts holds the host of local nodes being provisioned, by node ID
+	nodeHosts sync.Map
+
+	// provisioning holds the context.CancelFunc of deployments whose nodes
+	// are still being provisioned, by deployment ID
+	provisioning sync.Map
+
+	// claimTimeout is how long agents have to register once their node was
+	// provisioned, 0 for no limit
+	claimTimeout time.Duration
+
+	// artifactStorage checks the artifact storage a deployment chooses, nil
+	// when deployments can't choose
+	artifactStorage func(location string) error
+
+	// cleanupPolicy controls the periodic cleanup of finished deployments,
+	// cleanupChanged wakes RunCleanup when it changes
+	cleanupMu      sync.Mutex
+	cleanupPolicy  CleanupPolicy
+	cleanupChanged chan struct{}
+	lastCleanup    *CleanupRun
+
+	providers ProviderFactory
+	clock     Clock
+	ids       IDGenerator
 }
 
 // NewOrchestrator creates a new orchestrator instance
-func NewOrchestrator(store state.StateStore, workingDir string, daemonURL string) *Orchestrator {
+func NewOrchestrator(store state.StateStore, workingDir string, daemonURL string, daemonInternalURL string, envPolicy *policy.EnvPolicy, admission *policy.OPA, timings *report.Timings, bundles *cloud.BundleIndex) *Orchestrator {
 	logger := logrus.New()
 	logger.SetLevel(logrus.InfoLevel)
 
 	return &Orchestrator{
-		store:      store,
-		workingDir: workingDir,
-		logger:     logger,
-		daemonURL:  daemonURL,
+		store:             store,
+		workingDir:        workingDir,
+		logger:            logger,
+		daemonURL:         daemonURL,
+		daemonInternalURL: daemonInternalURL,
+		envPolicy:         envPolicy,
+		admission:         admission,
+		timings:           timings,
+		bundles:           bundles,
+		providers:         &cloud.ProviderFactory{},
+		clock:             systemClock{},
+		ids:               randomIDs{},
+		cleanupPolicy:     DefaultCleanupPolicy,
+		cleanupChanged:    make(chan struct{}, 1),
 	}
 }
 
 // ProcessDeployment processes an uploaded bundle and creates a deployment
-func (o *Orchestrator) ProcessDeployment(bundlePath string) (*state.Deployment, error) {
+// accounted to owner. A positive keepFailed overrides keep_failed of the
+// bundle's configuration. With simulate, the configuration is checked as
+// usual but the nodes run as agent processes on the daemon host. uploadID is
+// recorded on the deployment if the client named its upload. vars are the
+// values of the input variables taskfly.yml declares, as text.
+func (o *Orchestrator) ProcessDeployment(bundlePath string, owner state.Owner, keepFailed time.Duration, simulate bool, uploadID string, vars map[string]string) (*state.Deployment, error) {
 	o.logger.Infof("Processing deployment bundle: %s", bundlePath)
 
 	// Generate deployment ID
-	deploymentID, err := generateID("dep")
+	deploymentID, err := o.ids.NewID("dep")
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate deployment ID: %w", err)
 	}
@@ -68,46 +154,146 @@ func (o *Orchestrator) ProcessDeployment(bundlePath string) (*state.Deployment,
 	}
 
 	// Extract and parse configuration
-	config, workerBundlePath, err := o.extractAndParseConfig(bundlePath, deploymentDir)
+	config, values, workerBundlePath, archive, err := o.extractAndParseConfig(bundlePath, deploymentDir, vars)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse configuration: %w", err)
 	}
 
+	// The simulate provider runs the bundle's script on this host, so it is
+	// only used through the simulate option, which the daemon gates behind
+	// --allow-simulate, never named by the configuration itself
+	if config.CloudProvider == cloud.ProviderSimulate {
+		return nil, fmt.Errorf("cloud_provider %q can't be configured, use taskfly up --simulate", cloud.ProviderSimulate)
+	}
+
+	// Agents cache bundles by digest, and nodes of local deployments are
+	// placed on hosts that have it cached
+	bundleDigest, err := bundle.Digest(workerBundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash worker bundle: %w", err)
+	}
+
 	// Validate nodes configuration
 	if err := metadata.ValidateNodesConfig(config.Nodes); err != nil {
 		return nil, fmt.Errorf("invalid nodes configuration: %w", err)
 	}
 
+	if _, err := cloud.ProvisionTimeout(config.CloudProvider, config.InstanceConfig[config.CloudProvider]); err != nil {
+		return nil, fmt.Errorf("invalid instance_config: %w", err)
+	}
+
+	// Resolve how long failed nodes are kept for debugging
+	if keepFailed <= 0 {
+		if keepFailed, err = ParseKeepFailed(config.KeepFailed); err != nil {
+			return nil, fmt.Errorf("invalid keep_failed: %w", err)
+		}
+	}
+
+	limits, err := config.Limits.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("invalid limits: %w", err)
+	}
+
+	if err := o.checkArtifactStorage(config.ArtifactStorage); err != nil {
+		return nil, fmt.Errorf("invalid artifact_storage: %w", err)
+	}
+
+	// Make sure the configured entry script actually shipped in the bundle
+	if config.RemoteScriptToRun != "" {
+		if err := checkEntryScript(deploymentDir, config.RemoteScriptToRun); err != nil {
+			return nil, err
+		}
+	}
+
+	// Make sure the provider can honor the requested network mode
+	if err := cloud.ValidateNetworkMode(config.CloudProvider, config.NetworkMode); err != nil {
+		return nil, fmt.Errorf("invalid network mode: %w", err)
+	}
+
+	// Generate node configurations and check what they would distribute
+	// before anything is recorded
+	nodeConfigs, err := metadata.GenerateNodeConfigs(config.Nodes, deploymentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate node configurations: %w", err)
+	}
+	if err := o.envPolicy.Check(nodeConfigs); err != nil {
+		return nil, err
+	}
+
+	// Let the admission policy reject or flag the deployment
+	policyWarnings, err := o.admission.Admit(context.Background(), admissionInput(deploymentID, owner, config))
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range policyWarnings {
+		o.logger.Warnf("Deployment %s flagged by admission policy: %s", deploymentID, warning)
+	}
+
+	// Everything above checked the configured provider, the nodes of a
+	// simulation run on this host instead. Its template ID differs from the
+	// real deployment's, so simulated timings don't skew estimates.
+	simulatedProvider := ""
+	if simulate {
+		simulatedProvider = config.CloudProvider
+		config.CloudProvider = cloud.ProviderSimulate
+		o.logger.Infof("Deployment %s simulates %d %s nodes on the daemon host", deploymentID, config.Nodes.Count, simulatedProvider)
+	}
+
 	// Create deployment record
 	deployment := &state.Deployment{
-		ID:            deploymentID,
-		Status:        state.StatusPending,
-		CloudProvider: config.CloudProvider,
-		TotalNodes:    config.Nodes.Count,
-		BundlePath:    workerBundlePath, // Use worker bundle path (without taskfly.yml)
+		Owner:              owner,
+		ID:                 deploymentID,
+		Status:             state.StatusPending,
+		CloudProvider:      config.CloudProvider,
+		TotalNodes:         config.Nodes.Count,
+		TemplateID:         templateID(config),
+		BundlePath:         workerBundlePath, // Use worker bundle path (without taskfly.yml)
+		BundleDigest:       bundleDigest,
+		PolicyWarnings:     policyWarnings,
+		KeepFailed:         int(keepFailed.Seconds()),
+		Debug:              config.Debug,
+		UploadID:           uploadID,
+		Variables:          values,
+		SensitiveVariables: config.sensitiveVariables(),
 		Config: map[string]interface{}{
-			"cloud_provider":       config.CloudProvider,
-			"instance_config":      config.InstanceConfig,
-			"remote_dest_dir":      config.RemoteDestDir,
-			"remote_script_to_run": config.RemoteScriptToRun,
+			"cloud_provider":            config.CloudProvider,
+			"instance_config":           config.InstanceConfig,
+			"remote_dest_dir":           config.RemoteDestDir,
+			"remote_script_to_run":      config.RemoteScriptToRun,
+			"remote_script_args":        config.RemoteScriptArgs,
+			"remote_script_interpreter": config.RemoteScriptInterpreter,
+			"network_mode":              config.NetworkMode,
+			"labels":                    config.Labels,
+			"telemetry_hooks":           config.TelemetryHooks,
+			"idle_shutdown":             config.IdleShutdown,
+			"watchdog":                  config.Watchdog,
+			"config_files":              config.Nodes.FileKeys,
+			"limits":                    limits,
 		},
 	}
+	if config.ArtifactStorage != "" {
+		deployment.Config["artifact_storage"] = config.ArtifactStorage
+	}
+	if simulatedProvider != "" {
+		deployment.Config["simulated_provider"] = simulatedProvider
+	}
+	if archive != nil {
+		deployment.ImportedFrom = &state.ImportSource{
+			DeploymentID: archive.DeploymentID,
+			Daemon:       archive.Daemon,
+			ExportedAt:   archive.ExportedAt,
+		}
+		o.logger.Infof("Deployment %s is imported from deployment %s on %s", deploymentID, archive.DeploymentID, archive.Daemon)
+	}
 
 	// Store the deployment
 	if err := o.store.CreateDeployment(deployment); err != nil {
 		return nil, fmt.Errorf("failed to create deployment record: %w", err)
 	}
 
-	// Generate node configurations
-	nodeConfigs, err := metadata.GenerateNodeConfigs(config.Nodes, deploymentID)
-	if err != nil {
-		o.store.UpdateDeploymentStatus(deploymentID, state.StatusFailed, err.Error())
-		return nil, fmt.Errorf("failed to generate node configurations: %w", err)
-	}
-
 	// Create node records
 	for _, nodeConfig := range nodeConfigs {
-		provisionToken, err := generateID("pt")
+		provisionToken, err := o.ids.NewID("pt")
 		if err != nil {
 			o.store.UpdateDeploymentStatus(deploymentID, state.StatusFailed, err.Error())
 			return nil, fmt.Errorf("failed to generate provision token: %w", err)
@@ -119,6 +305,7 @@ func (o *Orchestrator) ProcessDeployment(bundlePath string) (*state.Deployment,
 			DeploymentID:   deploymentID,
 			Status:         state.NodeStatusPending,
 			Config:         nodeConfig.Config,
+			ConfigSources:  nodeConfig.Sources,
 			ProvisionToken: provisionToken,
 		}
 
@@ -128,7 +315,7 @@ func (o *Orchestrator) ProcessDeployment(bundlePath string) (*state.Deployment,
 		}
 	}
 
-	o.logger.Infof("Created deployment %s with %d nodes", deploymentID, len(nodeConfigs))
+	o.deploymentLog(deploymentID, config.Debug).Infof("Created deployment %s with %d nodes", deploymentID, len(nodeConfigs))
 
 	// Start the deployment process in a goroutine
 	go o.executeDeployment(deploymentID, config)
@@ -136,20 +323,46 @@ func (o *Orchestrator) ProcessDeployment(bundlePath string) (*state.Deployment,
 	return deployment, nil
 }
 
+// admissionInput describes a parsed deployment to the admission policy
+func admissionInput(deploymentID string, owner state.Owner, config *TaskFlyConfig) policy.AdmissionInput {
+	providerConfig := config.InstanceConfig[config.CloudProvider]
+	instanceType, _ := providerConfig["instance_type"].(string)
+
+	input := policy.AdmissionInput{
+		DeploymentID:      deploymentID,
+		Namespace:         owner.Namespace,
+		APIKeyID:          owner.APIKeyID,
+		CloudProvider:     config.CloudProvider,
+		InstanceType:      instanceType,
+		InstanceConfig:    providerConfig,
+		NodeCount:         config.Nodes.Count,
+		NetworkMode:       config.NetworkMode,
+		RemoteScriptToRun: config.RemoteScriptToRun,
+		Labels:            config.Labels,
+	}
+	if price, ok := cloud.HourlyPrice(config.CloudProvider, instanceType); ok {
+		cost := price * float64(config.Nodes.Count)
+		input.EstimatedHourlyCost = &cost
+	}
+
+	return input
+}
+
 // executeDeployment runs the deployment process in the background
 func (o *Orchestrator) executeDeployment(deploymentID string, config *TaskFlyConfig) {
-	o.logger.Infof("Starting deployment execution for %s", deploymentID)
+	log := o.deploymentLog(deploymentID, config.Debug)
+	log.Infof("Starting deployment execution for %s", deploymentID)
 
 	// Update deployment status to provisioning
 	if err := o.store.UpdateDeploymentStatus(deploymentID, state.StatusProvisioning); err != nil {
-		o.logger.Errorf("Failed to update deployment status: %v", err)
+		log.Errorf("Failed to update deployment status: %v", err)
 		return
 	}
 
 	// Get all nodes for this deployment
 	nodes, err := o.store.GetNodesByDeployment(deploymentID)
 	if err != nil {
-		o.logger.Errorf("Failed to get nodes for deployment %s: %v", deploymentID, err)
+		log.Errorf("Failed to get nodes for deployment %s: %v", deploymentID, err)
 		o.store.UpdateDeploymentStatus(deploymentID, state.StatusFailed, err.Error())
 		return
 	}
@@ -160,54 +373,132 @@ func (o *Orchestrator) executeDeployment(deploymentID string, config *TaskFlyCon
 
 // provisionNodes provisions nodes using real cloud providers
 func (o *Orchestrator) provisionNodes(deploymentID string, nodes []*state.Node, config *TaskFlyConfig) {
-	o.logger.Infof("Provisioning %d nodes for deployment %s using %s provider", len(nodes), deploymentID, config.CloudProvider)
+	log := o.deploymentLog(deploymentID, config.Debug)
+	log.Infof("Provisioning %d nodes for deployment %s using %s provider", len(nodes), deploymentID, config.CloudProvider)
 
 	// Create the appropriate cloud provider
-	provider, err := o.createProvider(config.CloudProvider, config.InstanceConfig[config.CloudProvider])
+	provider, err := o.providers.NewProvider(config.CloudProvider, config.InstanceConfig[config.CloudProvider])
+	if err != nil {
+		log.Errorf("Failed to create cloud provider: %v", err)
+		o.store.UpdateDeploymentStatus(deploymentID, state.StatusFailed, err.Error())
+		return
+	}
+
+	// Checked when the deployment was created
+	timeout, err := cloud.ProvisionTimeout(config.CloudProvider, config.InstanceConfig[config.CloudProvider])
 	if err != nil {
-		o.logger.Errorf("Failed to create cloud provider: %v", err)
+		log.Errorf("Failed to resolve provisioning timeout: %v", err)
 		o.store.UpdateDeploymentStatus(deploymentID, state.StatusFailed, err.Error())
 		return
 	}
 
+	// Terminating the deployment cancels the provisioning still going on
+	ctx, cancel := context.WithCancel(context.Background())
+	o.provisioning.Store(deploymentID, cancel)
+
+	// Pick the hosts of local nodes, preferring ones with the bundle cached
+	hosts := o.assignHosts(deploymentID, len(nodes), config)
+
 	// Provision each node concurrently
+	var wg sync.WaitGroup
 	for _, node := range nodes {
-		go o.provisionSingleNode(node, provider, config)
+		host := ""
+		if node.NodeIndex < len(hosts) {
+			host = hosts[node.NodeIndex]
+		}
+		wg.Add(1)
+		go func(node *state.Node) {
+			defer wg.Done()
+			o.provisionSingleNode(ctx, node, provider, config, host, timeout)
+		}(node)
 	}
+	go func() {
+		wg.Wait()
+		o.provisioning.Delete(deploymentID)
+		cancel()
+	}()
 
-	// Update deployment status to running
+	// Update deployment status to running, unless all nodes failed already
 	// The deployment will automatically transition based on node completion
 	o.store.UpdateDeploymentStatus(deploymentID, state.StatusRunning)
-	o.logger.Infof("Started provisioning for deployment %s", deploymentID)
+	log.Infof("Started provisioning for deployment %s", deploymentID)
 }
 
-// provisionSingleNode provisions a single node
-func (o *Orchestrator) provisionSingleNode(node *state.Node, provider cloud.Provider, config *TaskFlyConfig) {
-	o.logger.Infof("Provisioning node %s", node.NodeID)
+// ErrProvisionTimeout is the error of nodes whose provisioning took longer
+// than the provisioning timeout of their provider
+var ErrProvisionTimeout = errors.New("provisioning timed out")
+
+// provisionSingleNode provisions a single node, on host if one was assigned.
+// Provisioning gives up after timeout or once ctx is cancelled because the
+// deployment is terminated.
+func (o *Orchestrator) provisionSingleNode(ctx context.Context, node *state.Node, provider cloud.Provider, config *TaskFlyConfig, host string, timeout time.Duration) {
+	log := o.deploymentLog(node.DeploymentID, config.Debug)
+	log.Infof("Provisioning node %s", node.NodeID)
+	log.Debugf("Node %s (index %d) has config %v", node.NodeID, node.NodeIndex, node.Config)
+
+	// Remember which host a local node runs on for the bundles its agent
+	// reports when registering
+	if config.CloudProvider == "local" {
+		nodeHost := host
+		if nodeHost == "" {
+			nodeHost = configuredHost(config.InstanceConfig["local"], node.NodeIndex)
+		}
+		o.nodeHosts.Store(node.NodeID, nodeHost)
+		defer o.nodeHosts.Delete(node.NodeID)
+	}
 
 	// Update node status to provisioning
 	o.store.UpdateNodeStatus(node.DeploymentID, node.NodeID, state.NodeStatusProvisioning)
 
 	// Provision the instance
-	ctx := context.Background()
-	instanceInfo, err := provider.ProvisionInstance(ctx, cloud.InstanceConfig{
-		NodeIndex:      node.NodeIndex,
-		ProvisionToken: node.ProvisionToken,
-		DaemonURL:      o.daemonURL,
-		NodeConfig:     node.Config,
+	nodeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	instanceInfo, err := provider.ProvisionInstance(nodeCtx, cloud.InstanceConfig{
+		NodeIndex:         node.NodeIndex,
+		Host:              host,
+		ProvisionToken:    node.ProvisionToken,
+		DaemonURL:         o.daemonURL,
+		DaemonInternalURL: o.daemonInternalURL,
+		NodeConfig:        node.Config,
+		EgressOnly:        config.NetworkMode == cloud.NetworkModeEgressOnly,
+		Debug:             config.Debug,
 	})
 
+	if ctx.Err() != nil {
+		// The deployment was terminated, and its cleanup may already have
+		// missed an instance that was launched regardless
+		log.Infof("Provisioning of node %s cancelled, deployment %s is terminated", node.NodeID, node.DeploymentID)
+		if err == nil && cloud.OwnsInstances(config.CloudProvider) {
+			cleanupCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := ensureTerminated(cleanupCtx, provider, instanceInfo.InstanceID); err != nil {
+				log.Errorf("Failed to terminate instance %s of cancelled node %s: %v", instanceInfo.InstanceID, node.NodeID, err)
+			}
+		}
+		return
+	}
+
 	if err != nil {
-		o.logger.Errorf("Failed to provision node %s: %v", node.NodeID, err)
+		if errors.Is(nodeCtx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w after %s: %v", ErrProvisionTimeout, timeout, err)
+		}
+		log.Errorf("Failed to provision node %s: %v", node.NodeID, err)
 		o.store.UpdateNodeStatus(node.DeploymentID, node.NodeID, state.NodeStatusFailed, err.Error())
+		o.RecordCompletionReport(node.DeploymentID)
 		return
 	}
 
 	// Update node with instance information
-	o.store.UpdateNodeInstanceInfo(node.DeploymentID, node.NodeID, instanceInfo.InstanceID, instanceInfo.IPAddress)
+	o.store.UpdateNodeInstanceInfo(node.DeploymentID, node.NodeID, instanceInfo.InstanceID,
+		instanceInfo.IPAddress, instanceInfo.PrivateIPAddress, instanceInfo.IPv6Address, instanceInfo.AvailabilityZone)
+	// The agent may have registered already, in which case the store keeps
+	// its later status
 	o.store.UpdateNodeStatus(node.DeploymentID, node.NodeID, state.NodeStatusBooting)
+	o.startClaimDeadline(node)
 
-	o.logger.Infof("Node %s provisioned: %s (%s)", node.NodeID, instanceInfo.InstanceID, instanceInfo.IPAddress)
+	log.Infof("Node %s provisioned: %s (%s)", node.NodeID, instanceInfo.InstanceID, instanceInfo.IPAddress)
+	log.Debugf("Instance of node %s: private IP %q, IPv6 %q, zone %q, status %s", node.NodeID,
+		instanceInfo.PrivateIPAddress, instanceInfo.IPv6Address, instanceInfo.AvailabilityZone, instanceInfo.Status)
 
 	// For local provider, the node is ready immediately
 	// For cloud providers, we wait for the node to register itself
@@ -216,120 +507,197 @@ func (o *Orchestrator) provisionSingleNode(node *state.Node, provider cloud.Prov
 	}
 }
 
-// createProvider creates the appropriate cloud provider
-func (o *Orchestrator) createProvider(providerName string, config map[string]interface{}) (cloud.Provider, error) {
-	switch providerName {
-	case "local":
-		return cloud.NewLocalProvider(config)
-	case "aws":
-		return cloud.NewAWSProvider(config)
-	default:
-		return nil, fmt.Errorf("unsupported cloud provider: %s", providerName)
+// checkEntryScript makes sure remote_script_to_run names a file inside the
+// extracted bundle. Paths leaving the bundle are rejected before anything is
+// looked up, so the daemon's own files can't be probed through it.
+func checkEntryScript(bundleDir, script string) error {
+	if filepath.IsAbs(script) {
+		return fmt.Errorf("remote_script_to_run '%s' must be relative to the bundle", script)
+	}
+	scriptPath := filepath.Join(bundleDir, script)
+	if !insideDir(bundleDir, scriptPath) {
+		return fmt.Errorf("remote_script_to_run '%s' is outside the bundle", script)
 	}
-}
 
-// extractAndParseConfig extracts the bundle and parses taskfly.yml
-func (o *Orchestrator) extractAndParseConfig(bundlePath, extractDir string) (*TaskFlyConfig, string, error) {
-	// Open the bundle file
-	file, err := os.Open(bundlePath)
+	resolved, err := filepath.EvalSymlinks(scriptPath)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to open bundle: %w", err)
+		return fmt.Errorf("remote_script_to_run '%s' not found in bundle", script)
+	}
+	resolvedDir, err := filepath.EvalSymlinks(bundleDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve bundle directory: %w", err)
+	}
+	if !insideDir(resolvedDir, resolved) {
+		return fmt.Errorf("remote_script_to_run '%s' is outside the bundle", script)
 	}
-	defer file.Close()
 
-	// Create gzip reader
-	gzipReader, err := gzip.NewReader(file)
+	info, err := os.Stat(resolved)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to create gzip reader: %w", err)
+		return fmt.Errorf("remote_script_to_run '%s' not found in bundle", script)
 	}
-	defer gzipReader.Close()
+	if info.IsDir() {
+		return fmt.Errorf("remote_script_to_run '%s' is a directory", script)
+	}
+	return nil
+}
 
-	// Create tar reader
-	tarReader := tar.NewReader(gzipReader)
+// insideDir reports whether path lies strictly below dir
+func insideDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || filepath.IsAbs(rel) {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
 
-	var configData []byte
+// extractAndParseConfig extracts the bundle and parses taskfly.yml with vars
+// substituted, returning the values of its variables. If the bundle is a
+// deployment archive, it also returns the archive's manifest, whose
+// variables are used where vars give no value.
+func (o *Orchestrator) extractAndParseConfig(bundlePath, extractDir string, vars map[string]string) (*TaskFlyConfig, map[string]interface{}, string, *ArchiveManifest, error) {
+	// Extract everything, keeping symlinks, hardlinks and modes for the
+	// worker bundle. Setuid, setgid and sticky bits are left off the files
+	// on this host and recorded so the worker bundle still carries them.
+	extraction, err := bundle.ExtractWith(bundlePath, extractDir, bundle.ExtractOptions{StripSpecialBits: true})
+	for _, warning := range extraction.Warnings {
+		o.logger.Warnf("Bundle %s: %s", filepath.Base(bundlePath), warning)
+	}
+	if err != nil {
+		return nil, nil, "", nil, fmt.Errorf("failed to extract bundle: %w", err)
+	}
+	if err := writeSpecialBits(extractDir, extraction.SpecialBits); err != nil {
+		return nil, nil, "", nil, err
+	}
 
-	// Extract files and look for taskfly.yml
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, "", fmt.Errorf("failed to read tar entry: %w", err)
-		}
+	// Read taskfly.yml. It stays in the extraction directory so the
+	// deployment can be exported, but is left out of the worker bundle.
+	configPath := filepath.Join(extractDir, "taskfly.yml")
+	info, err := os.Lstat(configPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, nil, "", nil, fmt.Errorf("taskfly.yml not found in bundle")
+	}
+	configData, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, nil, "", nil, fmt.Errorf("failed to read taskfly.yml from bundle: %w", err)
+	}
 
-		// Create the extracted file path
-		extractPath := filepath.Join(extractDir, header.Name)
-
-		switch header.Typeflag {
-		case tar.TypeReg:
-			// If this is taskfly.yml, read its content but don't extract it to worker bundle directory
-			if header.Name == "taskfly.yml" {
-				// Read the config data directly from tar
-				configData, err = io.ReadAll(tarReader)
-				if err != nil {
-					return nil, "", fmt.Errorf("failed to read taskfly.yml from bundle: %w", err)
-				}
-			} else {
-				// Create directories if needed
-				if err := os.MkdirAll(filepath.Dir(extractPath), 0755); err != nil {
-					return nil, "", fmt.Errorf("failed to create directory: %w", err)
-				}
-
-				// Extract all other files (application files) to the worker bundle directory
-				outFile, err := os.Create(extractPath)
-				if err != nil {
-					return nil, "", fmt.Errorf("failed to create file %s: %w", extractPath, err)
-				}
-
-				if _, err := io.Copy(outFile, tarReader); err != nil {
-					outFile.Close()
-					return nil, "", fmt.Errorf("failed to extract file %s: %w", extractPath, err)
-				}
-				outFile.Close()
-			}
+	manifest, err := readArchiveManifest(extractDir)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	if manifest != nil && len(manifest.Variables) > 0 {
+		merged := make(map[string]string, len(manifest.Variables)+len(vars))
+		for name, value := range manifest.Variables {
+			merged[name] = value
+		}
+		for name, value := range vars {
+			merged[name] = value
 		}
+		vars = merged
 	}
 
-	if configData == nil {
-		return nil, "", fmt.Errorf("taskfly.yml not found in bundle")
+	// Substitute the input variables and parse the configuration
+	values, configData, err := substituteVariables(configData, vars)
+	if err != nil {
+		return nil, nil, "", nil, err
 	}
-
-	// Parse the configuration
 	var config TaskFlyConfig
 	if err := yaml.Unmarshal(configData, &config); err != nil {
-		return nil, "", fmt.Errorf("failed to parse taskfly.yml: %w", err)
+		return nil, nil, "", nil, fmt.Errorf("failed to parse taskfly.yml: %w", err)
 	}
 
-	// Create a worker bundle (tar.gz) from the extracted files (excluding taskfly.yml)
+	// Create a worker bundle from the extracted files (excluding taskfly.yml).
+	// It is always a tar.gz, even if a zip bundle was uploaded.
 	workerBundlePath := filepath.Join(extractDir, "worker_bundle.tar.gz")
-	if err := o.createWorkerBundle(extractDir, workerBundlePath); err != nil {
-		return nil, "", fmt.Errorf("failed to create worker bundle: %w", err)
+	if err := o.createWorkerBundle(extractDir, workerBundlePath, bundle.Options{PreserveModTimes: config.PreserveMtimes}); err != nil {
+		return nil, nil, "", nil, fmt.Errorf("failed to create worker bundle: %w", err)
 	}
 
-	return &config, workerBundlePath, nil
+	return &config, values, workerBundlePath, manifest, nil
+}
+
+// substituteVariables resolves the variables taskfly.yml declares from vars
+// and substitutes them into it
+func substituteVariables(configData []byte, vars map[string]string) (map[string]interface{}, []byte, error) {
+	declared, err := variables.Declared(configData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid variables in taskfly.yml: %w", err)
+	}
+	values, err := variables.Resolve(declared, vars)
+	if err != nil {
+		return nil, nil, err
+	}
+	configData, err = variables.Substitute(configData, values)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(values) == 0 {
+		values = nil
+	}
+	return values, configData, nil
 }
 
-// createWorkerBundle creates a tar.gz bundle from the extracted application files
-func (o *Orchestrator) createWorkerBundle(extractDir, workerBundlePath string) error {
-	// Create the worker bundle file
-	bundleFile, err := os.Create(workerBundlePath)
+// createWorkerBundle creates a tar.gz bundle from the extracted application
+// files, excluding taskfly.yml
+func (o *Orchestrator) createWorkerBundle(extractDir, workerBundlePath string, opts bundle.Options) error {
+	files, err := applicationFiles(extractDir)
 	if err != nil {
-		return fmt.Errorf("failed to create worker bundle file: %w", err)
+		return err
 	}
-	defer bundleFile.Close()
 
-	// Create gzip writer
-	gzipWriter := gzip.NewWriter(bundleFile)
-	defer gzipWriter.Close()
+	warnings, err := bundle.Create(workerBundlePath, files, opts)
+	for _, warning := range warnings {
+		o.logger.Warnf("Worker bundle %s: %s", workerBundlePath, warning)
+	}
+	return err
+}
 
-	// Create tar writer
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer tarWriter.Close()
+// specialBitsName is the file in an extraction directory recording the
+// setuid, setgid and sticky bits left off the extracted files
+const specialBitsName = "special_bits.json"
 
-	// Walk through the extracted directory and add all files except taskfly.yml
-	return filepath.Walk(extractDir, func(path string, info os.FileInfo, err error) error {
+// writeSpecialBits records the special bits stripped from the files of an
+// extraction directory, by entry name. The record is written even when empty
+// so that a file of the same name in the bundle is never taken for it.
+func writeSpecialBits(extractDir string, specialBits map[string]os.FileMode) error {
+	data, err := json.Marshal(specialBits)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(extractDir, specialBitsName), data, 0600); err != nil {
+		return fmt.Errorf("failed to record special bits of bundle: %w", err)
+	}
+	return nil
+}
+
+// readSpecialBits returns the special bits recorded for the files of an
+// extraction directory
+func readSpecialBits(extractDir string) (map[string]os.FileMode, error) {
+	data, err := os.ReadFile(filepath.Join(extractDir, specialBitsName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read special bits of bundle: %w", err)
+	}
+	var specialBits map[string]os.FileMode
+	if err := json.Unmarshal(data, &specialBits); err != nil {
+		return nil, fmt.Errorf("failed to parse special bits of bundle: %w", err)
+	}
+	return specialBits, nil
+}
+
+// applicationFiles lists the application files in an extraction directory:
+// everything but taskfly.yml, the worker bundle and the record of special
+// bits, which are given back to the files they were stripped from
+func applicationFiles(extractDir string) ([]bundle.File, error) {
+	specialBits, err := readSpecialBits(extractDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []bundle.File
+	err = filepath.Walk(extractDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -338,8 +706,11 @@ func (o *Orchestrator) createWorkerBundle(extractDir, workerBundlePath string) e
 		if info.IsDir() || filepath.Base(path) == "worker_bundle.tar.gz" {
 			return nil
 		}
+		if path == filepath.Join(extractDir, specialBitsName) {
+			return nil
+		}
 
-		// Skip taskfly.yml (though it shouldn't be extracted anyway)
+		// Skip taskfly.yml, nodes don't need it
 		if filepath.Base(path) == "taskfly.yml" {
 			return nil
 		}
@@ -350,33 +721,98 @@ func (o *Orchestrator) createWorkerBundle(extractDir, workerBundlePath string) e
 			return err
 		}
 
-		// Create tar header
-		header, err := tar.FileInfoHeader(info, info.Name())
-		if err != nil {
-			return err
-		}
-		header.Name = relPath
+		files = append(files, bundle.File{Name: relPath, Path: path, SpecialBits: specialBits[filepath.ToSlash(relPath)]})
+		return nil
+	})
+	return files, err
+}
 
-		// Write header
-		if err := tarWriter.WriteHeader(header); err != nil {
-			return err
-		}
+// RecordCompletionReport generates and stores the summary report once a
+// deployment has finished. It does nothing while nodes are still working or
+// when a report was already recorded.
+func (o *Orchestrator) RecordCompletionReport(deploymentID string) {
+	deployment, err := o.store.GetDeployment(deploymentID)
+	if err != nil || deployment.Report != nil {
+		return
+	}
+	if deployment.Status != state.StatusCompleted && deployment.Status != state.StatusFailed {
+		return
+	}
 
-		// Open and copy file content
-		file, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
+	nodes, err := o.store.GetNodesByDeployment(deploymentID)
+	if err != nil {
+		o.logger.Errorf("Failed to get nodes for report of deployment %s: %v", deploymentID, err)
+		return
+	}
 
-		_, err = io.Copy(tarWriter, file)
-		return err
-	})
+	summary := report.Build(deployment, nodes, o.daemonURL, o.clock.Now())
+	if err := o.store.SetDeploymentReport(deploymentID, summary); err != nil {
+		o.logger.Errorf("Failed to store report for deployment %s: %v", deploymentID, err)
+		return
+	}
+
+	o.logger.Infof("Recorded completion report for deployment %s", deploymentID)
+
+	if err := o.timings.Record(deployment, summary); err != nil {
+		o.logger.Errorf("Failed to record timings of deployment %s: %v", deploymentID, err)
+	}
+}
+
+// ErrBakeUnsupported is returned when the deployment's provider cannot create images
+var ErrBakeUnsupported = errors.New("provider does not support baking images")
+
+// BakeImage snapshots the instance of a node into a machine image of the
+// deployment's provider and returns the image ID. An empty name defaults to
+// one derived from the deployment and node index.
+func (o *Orchestrator) BakeImage(deployment *state.Deployment, node *state.Node, name string, reboot bool) (string, error) {
+	provider, err := o.providers.NewProvider(deployment.CloudProvider, providerConfig(deployment))
+	if err != nil {
+		return "", fmt.Errorf("failed to create provider: %w", err)
+	}
+	baker, ok := provider.(cloud.ImageBaker)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrBakeUnsupported, deployment.CloudProvider)
+	}
+
+	if name == "" {
+		name = fmt.Sprintf("taskfly-%s-node%d-%s", deployment.ID, node.NodeIndex, o.clock.Now().UTC().Format("20060102-150405"))
+	}
+
+	imageID, err := baker.BakeImage(context.Background(), node.InstanceID, name, reboot)
+	if err != nil {
+		return "", err
+	}
+
+	o.logger.Infof("Baking image %s (%s) from node %s (instance: %s)", imageID, name, node.NodeID, node.InstanceID)
+	return imageID, nil
+}
+
+// providerConfig returns the instance configuration of a deployment's
+// provider. Deployments loaded from disk hold it as generic JSON maps.
+func providerConfig(deployment *state.Deployment) map[string]interface{} {
+	switch instanceConfig := deployment.Config["instance_config"].(type) {
+	case map[string]map[string]interface{}:
+		return instanceConfig[deployment.CloudProvider]
+	case map[string]interface{}:
+		config, _ := instanceConfig[deployment.CloudProvider].(map[string]interface{})
+		return config
+	}
+	return nil
 }
 
 // TerminateDeployment initiates termination of a deployment
 func (o *Orchestrator) TerminateDeployment(deploymentID string) error {
-	o.logger.Infof("Terminating deployment %s", deploymentID)
+	debug := false
+	if deployment, err := o.store.GetDeployment(deploymentID); err == nil {
+		debug = deployment.Debug
+	}
+	log := o.deploymentLog(deploymentID, debug)
+	log.Infof("Terminating deployment %s", deploymentID)
+
+	// Stop provisioning nodes that would only be torn down again
+	if cancel, ok := o.provisioning.LoadAndDelete(deploymentID); ok {
+		cancel.(context.CancelFunc)()
+	}
 
 	// Get all nodes for this deployment before deletion
 	nodes, err := o.store.GetNodesByDeployment(deploymentID)
@@ -386,25 +822,22 @@ func (o *Orchestrator) TerminateDeployment(deploymentID string) error {
 
 	// Mark all nodes for shutdown so agents receive shutdown signal in heartbeat
 	for _, node := range nodes {
-		o.logger.Infof("Marking node %s for shutdown (instance: %s)", node.NodeID, node.InstanceID)
+		log.Infof("Marking node %s for shutdown (instance: %s)", node.NodeID, node.InstanceID)
 		if err := o.store.MarkNodeForShutdown(node.DeploymentID, node.NodeID); err != nil {
-			o.logger.Errorf("Failed to mark node %s for shutdown: %v", node.NodeID, err)
+			log.Errorf("Failed to mark node %s for shutdown: %v", node.NodeID, err)
 		}
 	}
 
 	// Wait a bit for agents to receive shutdown signal, then cleanup
 	go func() {
 		// Give agents 10 seconds to receive shutdown signal and gracefully terminate
-		time.Sleep(10 * time.Second)
-
-		o.cleanupDeploymentFiles(deploymentID)
-		o.logger.Infof("Deployment %s files cleaned up", deploymentID)
+		<-o.clock.After(10 * time.Second)
 
-		// Delete deployment from state store (removes from state.json)
-		if err := o.store.DeleteDeployment(deploymentID); err != nil {
-			o.logger.Errorf("Failed to delete deployment %s from state: %v", deploymentID, err)
-		} else {
-			o.logger.Infof("Deployment %s removed from state", deploymentID)
+		// Terminates the instances and removes the deployment from state
+		// once that is confirmed. Otherwise the periodic cleanup retries.
+		if err := o.CleanupDeployment(deploymentID); err != nil {
+			log.Errorf("Failed to clean up terminated deployment %s: %v", deploymentID, err)
+			o.store.UpdateDeploymentStatus(deploymentID, state.StatusTerminated, err.Error())
 		}
 	}()
 
@@ -437,21 +870,10 @@ func (o *Orchestrator) cleanupDeploymentFiles(deploymentID string) {
 	}
 }
 
-// CleanupCompletedDeployments removes files for completed deployments
-func (o *Orchestrator) CleanupCompletedDeployments() {
-	deployments := o.store.GetAllDeployments()
-	for _, dep := range deployments {
-		if dep.Status == state.StatusCompleted || dep.Status == state.StatusFailed {
-			// Only cleanup deployments that completed more than 1 hour ago
-			if dep.CompletedAt != nil && time.Since(*dep.CompletedAt) > time.Hour {
-				o.logger.Infof("Cleaning up old deployment: %s", dep.ID)
-				o.cleanupDeploymentFiles(dep.ID)
-			}
-		}
-	}
-}
-
-// CleanupDeployment removes deployment files and extracted directories
+// CleanupDeployment terminates the instances of a deployment, then removes
+// its files, extracted directories and state. If termination of any instance
+// cannot be confirmed, nothing is removed so the instance stays traceable and
+// ErrTerminationUnconfirmed is returned.
 func (o *Orchestrator) CleanupDeployment(deploymentID string) error {
 	o.logger.Infof("Cleaning up deployment: %s", deploymentID)
 
@@ -461,6 +883,11 @@ func (o *Orchestrator) CleanupDeployment(deploymentID string) error {
 		return fmt.Errorf("failed to get deployment: %w", err)
 	}
 
+	// Make sure no instance outlives the state that tracks it
+	if err := o.terminateInstances(deployment); err != nil {
+		return err
+	}
+
 	// Remove bundle file if it exists
 	if deployment.BundlePath != "" {
 		if err := os.Remove(deployment.BundlePath); err != nil && !os.IsNotExist(err) {
@@ -488,6 +915,71 @@ func (o *Orchestrator) CleanupDeployment(deploymentID string) error {
 	return nil
 }
 
+// ErrTerminationUnconfirmed is returned by CleanupDeployment when the provider
+// cannot confirm that the instances of a deployment were terminated
+var ErrTerminationUnconfirmed = errors.New("instance termination could not be confirmed")
+
+// terminateInstances terminates every instance of a deployment that is not
+// already gone and confirms the termination with the provider
+func (o *Orchestrator) terminateInstances(deployment *state.Deployment) error {
+	if !cloud.OwnsInstances(deployment.CloudProvider) {
+		return nil
+	}
+
+	nodes, err := o.store.GetNodesByDeployment(deployment.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get nodes: %w", err)
+	}
+
+	var provider cloud.Provider
+	var unconfirmed []string
+	for _, node := range nodes {
+		if node.InstanceID == "" {
+			continue
+		}
+		if provider == nil {
+			if provider, err = o.providers.NewProvider(deployment.CloudProvider, providerConfig(deployment)); err != nil {
+				return fmt.Errorf("%w: failed to create provider: %v", ErrTerminationUnconfirmed, err)
+			}
+		}
+
+		if err := ensureTerminated(context.Background(), provider, node.InstanceID); err != nil {
+			o.logger.Warnf("Could not confirm termination of instance %s of node %s: %v", node.InstanceID, node.NodeID, err)
+			unconfirmed = append(unconfirmed, node.InstanceID)
+		}
+	}
+
+	if len(unconfirmed) > 0 {
+		return fmt.Errorf("%w: %s", ErrTerminationUnconfirmed, strings.Join(unconfirmed, ", "))
+	}
+	return nil
+}
+
+// ensureTerminated terminates an instance unless the provider reports it
+// gone, then checks that it is shutting down
+func ensureTerminated(ctx context.Context, provider cloud.Provider, instanceID string) error {
+	status, err := provider.GetInstanceStatus(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	if cloud.InstanceTerminated(status) {
+		return nil
+	}
+
+	if err := provider.TerminateInstance(ctx, instanceID); err != nil {
+		return err
+	}
+
+	status, err = provider.GetInstanceStatus(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	if !cloud.InstanceTerminated(status) {
+		return fmt.Errorf("instance is still %s after termination request", status)
+	}
+	return nil
+}
+
 // CleanupAllCompleted cleans up all completed, failed, or terminated deployments
 func (o *Orchestrator) CleanupAllCompleted() (int, int, error) {
 	o.logger.Info("Cleaning up all completed deployments")
@@ -501,6 +993,11 @@ func (o *Orchestrator) CleanupAllCompleted() (int, int, error) {
 			dep.Status == state.StatusFailed ||
 			dep.Status == state.StatusTerminated {
 
+			if o.awaitingIdleShutdown(dep) {
+				o.logger.Debugf("Keeping deployment %s until its nodes are shut down", dep.ID)
+				continue
+			}
+
 			if err := o.CleanupDeployment(dep.ID); err != nil {
 				o.logger.Errorf("Failed to cleanup deployment %s: %v", dep.ID, err)
 				failed++
@@ -514,11 +1011,20 @@ func (o *Orchestrator) CleanupAllCompleted() (int, int, error) {
 	return cleaned, failed, nil
 }
 
-// generateID generates a random ID with the given prefix
-func generateID(prefix string) (string, error) {
-	bytes := make([]byte, 4)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
+// templateID fingerprints a configuration so deployments of the same template
+// can be compared. Labels, the bundle name, keep_failed and debug don't change
+// what nodes run and are left out.
+func templateID(config *TaskFlyConfig) string {
+	fingerprint := *config
+	fingerprint.Labels = nil
+	fingerprint.BundleName = ""
+	fingerprint.KeepFailed = ""
+	fingerprint.Debug = false
+
+	data, err := yaml.Marshal(fingerprint)
+	if err != nil {
+		return ""
 	}
-	return fmt.Sprintf("%s_%s", prefix, hex.EncodeToString(bytes)), nil
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
 }
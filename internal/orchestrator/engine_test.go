@@ -0,0 +1,701 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/bundle"
+	"github.com/JustinTimperio/TaskFly/internal/cloud"
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock only moves when advanced
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the clock forward and fires the timers that are due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, timer := range c.waiters {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+// Waiting returns the number of timers that haven't fired
+func (c *fakeClock) Waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// sequentialIDs numbers IDs across prefixes: dep_1, pt_2, ...
+type sequentialIDs struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (g *sequentialIDs) NewID(prefix string) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.next++
+	return fmt.Sprintf("%s_%d", prefix, g.next), nil
+}
+
+// fakeProvider keeps instances in memory. With block, provisioning waits
+// until its context ends; with stuck, termination requests are ignored.
+type fakeProvider struct {
+	mu        sync.Mutex
+	block     bool
+	stuck     bool
+	instances map[string]string // status by instance ID
+	cancelled int
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{instances: make(map[string]string)}
+}
+
+func (p *fakeProvider) NewProvider(providerName string, config map[string]interface{}) (cloud.Provider, error) {
+	return p, nil
+}
+
+func (p *fakeProvider) ProvisionInstance(ctx context.Context, config cloud.InstanceConfig) (*cloud.InstanceInfo, error) {
+	p.mu.Lock()
+	block := p.block
+	p.mu.Unlock()
+	if block {
+		<-ctx.Done()
+		p.mu.Lock()
+		p.cancelled++
+		p.mu.Unlock()
+		return nil, ctx.Err()
+	}
+
+	id := fmt.Sprintf("i-%d", config.NodeIndex)
+	p.mu.Lock()
+	p.instances[id] = "running"
+	p.mu.Unlock()
+	return &cloud.InstanceInfo{InstanceID: id, IPAddress: "127.0.0.1", Status: "running"}, nil
+}
+
+func (p *fakeProvider) GetInstanceStatus(ctx context.Context, instanceID string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status, ok := p.instances[instanceID]
+	if !ok {
+		return "terminated", nil
+	}
+	return status, nil
+}
+
+func (p *fakeProvider) TerminateInstance(ctx context.Context, instanceID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.stuck {
+		p.instances[instanceID] = "terminated"
+	}
+	return nil
+}
+
+func (p *fakeProvider) GetProviderName() string {
+	return "fake"
+}
+
+func (p *fakeProvider) status(instanceID string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.instances[instanceID]
+}
+
+// newTestOrchestrator returns an orchestrator on an in-memory store with a
+// fake provider, clock and IDs
+func newTestOrchestrator(t *testing.T) (*Orchestrator, *state.Store, *fakeProvider, *fakeClock) {
+	store := state.NewStore()
+	provider := newFakeProvider()
+	clock := &fakeClock{now: time.Now()}
+	o := NewOrchestrator(store, t.TempDir(), "http://127.0.0.1:8080", "", nil, nil, nil, nil)
+	o.SetDependencies(Dependencies{Providers: provider, Clock: clock, IDs: &sequentialIDs{}})
+	return o, store, provider, clock
+}
+
+// createDeployment adds a pending deployment with count nodes to the store
+func createDeployment(t *testing.T, store *state.Store, id string, count int) {
+	require.NoError(t, store.CreateDeployment(&state.Deployment{
+		ID:            id,
+		Status:        state.StatusPending,
+		CloudProvider: "fake",
+		TotalNodes:    count,
+	}))
+	for i := 0; i < count; i++ {
+		require.NoError(t, store.CreateNode(&state.Node{
+			NodeID:       fmt.Sprintf("%s_node_%d", id, i),
+			NodeIndex:    i,
+			DeploymentID: id,
+			Status:       state.NodeStatusPending,
+		}))
+	}
+}
+
+// nodeStatuses returns the status of each node of a deployment
+func nodeStatuses(t *testing.T, store *state.Store, id string) []state.NodeStatus {
+	nodes, err := store.GetNodesByDeployment(id)
+	require.NoError(t, err)
+	statuses := make([]state.NodeStatus, len(nodes))
+	for i, node := range nodes {
+		statuses[i] = node.Status
+	}
+	return statuses
+}
+
+func TestProcessDeploymentProvisionsNodes(t *testing.T) {
+	o, store, provider, _ := newTestOrchestrator(t)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "taskfly.yml"), []byte(`cloud_provider: fake
+remote_dest_dir: /tmp/app
+remote_script_to_run: run.sh
+nodes:
+  count: 2
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "run.sh"), []byte("#!/bin/sh\n"), 0755))
+	bundlePath := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	_, err := bundle.Create(bundlePath, []bundle.File{
+		{Name: "taskfly.yml", Path: filepath.Join(dir, "taskfly.yml")},
+		{Name: "run.sh", Path: filepath.Join(dir, "run.sh")},
+	}, bundle.Options{})
+	require.NoError(t, err)
+
+	deployment, err := o.ProcessDeployment(bundlePath, state.Owner{}, 0, false, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "dep_1", deployment.ID)
+
+	assert.Eventually(t, func() bool {
+		statuses := nodeStatuses(t, store, "dep_1")
+		return len(statuses) == 2 && statuses[0] == state.NodeStatusBooting && statuses[1] == state.NodeStatusBooting
+	}, time.Second, 10*time.Millisecond)
+
+	nodes, err := store.GetNodesByDeployment("dep_1")
+	require.NoError(t, err)
+	for _, node := range nodes {
+		assert.Equal(t, fmt.Sprintf("pt_%d", node.NodeIndex+2), node.ProvisionToken)
+		assert.Equal(t, fmt.Sprintf("i-%d", node.NodeIndex), node.InstanceID)
+		assert.Equal(t, "running", provider.status(node.InstanceID))
+	}
+}
+
+func TestProvisioningTimesOut(t *testing.T) {
+	o, store, provider, _ := newTestOrchestrator(t)
+	provider.block = true
+	createDeployment(t, store, "dep_slow", 2)
+
+	o.executeDeployment("dep_slow", &TaskFlyConfig{
+		CloudProvider:  "fake",
+		InstanceConfig: map[string]map[string]interface{}{"fake": {"provision_timeout": "50ms"}},
+	})
+
+	require.Eventually(t, func() bool {
+		deployment, err := store.GetDeployment("dep_slow")
+		return err == nil && deployment.Status == state.StatusFailed && deployment.Report != nil
+	}, 2*time.Second, 10*time.Millisecond)
+
+	nodes, err := store.GetNodesByDeployment("dep_slow")
+	require.NoError(t, err)
+	for _, node := range nodes {
+		assert.Equal(t, state.NodeStatusFailed, node.Status)
+		assert.Equal(t, "provisioning timed out after 50ms: context deadline exceeded", node.ErrorMessage)
+	}
+}
+
+func TestTerminateDeploymentCancelsProvisioning(t *testing.T) {
+	o, store, provider, clock := newTestOrchestrator(t)
+	provider.block = true
+	createDeployment(t, store, "dep_cancel", 2)
+
+	o.executeDeployment("dep_cancel", &TaskFlyConfig{CloudProvider: "fake"})
+	require.NoError(t, o.TerminateDeployment("dep_cancel"))
+
+	require.Eventually(t, func() bool {
+		provider.mu.Lock()
+		defer provider.mu.Unlock()
+		return provider.cancelled == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// Cancelled nodes aren't failed, their deployment is being removed
+	for _, status := range nodeStatuses(t, store, "dep_cancel") {
+		assert.Equal(t, state.NodeStatusProvisioning, status)
+	}
+
+	// Agents get 10 seconds to stop before the deployment is cleaned up
+	require.Eventually(t, func() bool { return clock.Waiting() == 1 }, time.Second, 10*time.Millisecond)
+	clock.Advance(9 * time.Second)
+	_, err := store.GetDeployment("dep_cancel")
+	require.NoError(t, err)
+
+	clock.Advance(time.Second)
+	assert.Eventually(t, func() bool {
+		_, err := store.GetDeployment("dep_cancel")
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCleanupDeploymentConfirmsTermination(t *testing.T) {
+	o, store, provider, _ := newTestOrchestrator(t)
+	createDeployment(t, store, "dep_cleanup", 2)
+	o.executeDeployment("dep_cleanup", &TaskFlyConfig{CloudProvider: "fake"})
+	require.Eventually(t, func() bool {
+		statuses := nodeStatuses(t, store, "dep_cleanup")
+		return statuses[0] == state.NodeStatusBooting && statuses[1] == state.NodeStatusBooting
+	}, time.Second, 10*time.Millisecond)
+
+	// Instances that keep running keep the deployment
+	provider.stuck = true
+	err := o.CleanupDeployment("dep_cleanup")
+	assert.ErrorIs(t, err, ErrTerminationUnconfirmed)
+	_, err = store.GetDeployment("dep_cleanup")
+	require.NoError(t, err)
+
+	provider.stuck = false
+	require.NoError(t, o.CleanupDeployment("dep_cleanup"))
+	_, err = store.GetDeployment("dep_cleanup")
+	assert.Error(t, err)
+	assert.Equal(t, "terminated", provider.status("i-0"))
+	assert.Equal(t, "terminated", provider.status("i-1"))
+}
+
+func TestShutdownIdleNodesAfterGrace(t *testing.T) {
+	o, store, provider, clock := newTestOrchestrator(t)
+	createDeployment(t, store, "dep_idle", 1)
+	o.executeDeployment("dep_idle", &TaskFlyConfig{CloudProvider: "fake"})
+	require.Eventually(t, func() bool {
+		return nodeStatuses(t, store, "dep_idle")[0] == state.NodeStatusBooting
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, store.UpdateNodeStatus("dep_idle", "dep_idle_node_0", state.NodeStatusCompleted))
+
+	clock.Advance(defaultIdleGrace - time.Minute)
+	assert.Equal(t, 0, o.ShutdownIdleNodes())
+	assert.Equal(t, "running", provider.status("i-0"))
+
+	clock.Advance(2 * time.Minute)
+	assert.Equal(t, 1, o.ShutdownIdleNodes())
+	assert.Equal(t, "terminated", provider.status("i-0"))
+}
+
+func TestExpireUnclaimedNodes(t *testing.T) {
+	o, store, provider, clock := newTestOrchestrator(t)
+	o.SetClaimTimeout(15 * time.Minute)
+	createDeployment(t, store, "dep_claim", 2)
+	o.executeDeployment("dep_claim", &TaskFlyConfig{CloudProvider: "fake"})
+	require.Eventually(t, func() bool {
+		statuses := nodeStatuses(t, store, "dep_claim")
+		return statuses[0] == state.NodeStatusBooting && statuses[1] == state.NodeStatusBooting
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, store.RegisterNode("dep_claim", "dep_claim_node_1", state.NodeToken{AuthToken: "token"}, "127.0.0.1"))
+
+	clock.Advance(14 * time.Minute)
+	assert.Equal(t, 0, o.ExpireUnclaimedNodes())
+	assert.Equal(t, "running", provider.status("i-0"))
+
+	clock.Advance(2 * time.Minute)
+	assert.Equal(t, 1, o.ExpireUnclaimedNodes())
+	node, err := store.GetNode("dep_claim_node_0")
+	require.NoError(t, err)
+	assert.Equal(t, state.NodeStatusFailed, node.Status)
+	assert.Equal(t, "agent did not register within 15m0s of provisioning, provision token expired; instance i-0 is terminated", node.ErrorMessage)
+	assert.True(t, node.ShouldShutdown)
+	assert.Equal(t, "terminated", provider.status("i-0"))
+	assert.Equal(t, state.NodeStatusBooting, nodeStatuses(t, store, "dep_claim")[1])
+	assert.Equal(t, "running", provider.status("i-1"))
+
+	// The agent can't register once its token expired, even before the sweep
+	require.NoError(t, store.SetClaimDeadline("dep_claim", "dep_claim_node_0", time.Now().Add(-time.Second)))
+	err = store.RegisterNode("dep_claim", "dep_claim_node_0", state.NodeToken{AuthToken: "late"}, "127.0.0.1")
+	assert.ErrorIs(t, err, state.ErrProvisionTokenExpired)
+}
+
+func TestUnclaimedNodesWaitWithoutClaimTimeout(t *testing.T) {
+	o, store, provider, clock := newTestOrchestrator(t)
+	createDeployment(t, store, "dep_wait", 1)
+	o.executeDeployment("dep_wait", &TaskFlyConfig{CloudProvider: "fake"})
+	require.Eventually(t, func() bool {
+		return nodeStatuses(t, store, "dep_wait")[0] == state.NodeStatusBooting
+	}, time.Second, 10*time.Millisecond)
+
+	clock.Advance(24 * time.Hour)
+	assert.Equal(t, 0, o.ExpireUnclaimedNodes())
+	assert.Equal(t, state.NodeStatusBooting, nodeStatuses(t, store, "dep_wait")[0])
+	assert.Equal(t, "running", provider.status("i-0"))
+}
+
+func TestReconfigureNodes(t *testing.T) {
+	o, store, _, _ := newTestOrchestrator(t)
+	createDeployment(t, store, "dep_config", 2)
+	require.NoError(t, store.UpdateNodeStatus("dep_config", "dep_config_node_0", state.NodeStatusRunning))
+	require.NoError(t, store.UpdateNodeStatus("dep_config", "dep_config_node_1", state.NodeStatusRunning))
+	deployment, err := store.GetDeployment("dep_config")
+	require.NoError(t, err)
+	nodes, err := store.GetNodesByDeployment("dep_config")
+	require.NoError(t, err)
+
+	versions, err := o.ReconfigureNodes(deployment, nodes, map[string]interface{}{"batch_size": 10, "region": "us-east-1"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"dep_config_node_0": 1, "dep_config_node_1": 1}, versions)
+
+	// A nil value removes the key
+	nodes, err = store.GetNodesByDeployment("dep_config")
+	require.NoError(t, err)
+	versions, err = o.ReconfigureNodes(deployment, nodes[:1], map[string]interface{}{"region": nil})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"dep_config_node_0": 2}, versions)
+	node, err := store.GetNode("dep_config_node_0")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"batch_size": 10}, node.Config)
+	assert.Equal(t, state.ConfigSources{"batch_size": {From: state.ConfigFromReconfigure, Version: 1}}, node.ConfigSources)
+
+	// Keys used at start, invalid values and finished nodes are rejected
+	// without changing any node
+	_, err = o.ReconfigureNodes(deployment, nodes, map[string]interface{}{"script_args": "--fast"})
+	assert.EqualError(t, err, "script_args is used when the node starts and can't be changed")
+	_, err = o.ReconfigureNodes(deployment, nodes, map[string]interface{}{"path": "/opt/bin"})
+	assert.EqualError(t, err, "node dep_config_node_0: config key 'path' is exported as PATH, which is reserved")
+
+	require.NoError(t, store.UpdateNodeStatus("dep_config", "dep_config_node_1", state.NodeStatusCompleted))
+	nodes, err = store.GetNodesByDeployment("dep_config")
+	require.NoError(t, err)
+	_, err = o.ReconfigureNodes(deployment, nodes, map[string]interface{}{"batch_size": 20})
+	assert.ErrorIs(t, err, ErrNotReconfigurable)
+	node, err = store.GetNode("dep_config_node_0")
+	require.NoError(t, err)
+	assert.Equal(t, 2, node.ConfigVersion)
+}
+
+func TestProcessDeploymentChecksArtifactStorage(t *testing.T) {
+	o, _, _, _ := newTestOrchestrator(t)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "taskfly.yml"), []byte(`cloud_provider: fake
+artifact_storage: s3://results/runs
+nodes:
+  count: 1
+`), 0644))
+	bundlePath := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	_, err := bundle.Create(bundlePath, []bundle.File{
+		{Name: "taskfly.yml", Path: filepath.Join(dir, "taskfly.yml")},
+	}, bundle.Options{})
+	require.NoError(t, err)
+
+	// Without a check, deployments can't choose
+	_, err = o.ProcessDeployment(bundlePath, state.Owner{}, 0, false, "", nil)
+	assert.ErrorIs(t, err, errArtifactStorageDisabled)
+
+	o.SetArtifactStorage(func(location string) error {
+		if location != "s3://results/runs" {
+			return fmt.Errorf("%s is not allowed", location)
+		}
+		return nil
+	})
+	deployment, err := o.ProcessDeployment(bundlePath, state.Owner{}, 0, false, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "s3://results/runs", deployment.Config["artifact_storage"])
+}
+
+func TestProcessDeploymentRejectsConfiguredSimulate(t *testing.T) {
+	o, store, _, _ := newTestOrchestrator(t)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "taskfly.yml"), []byte(`variables:
+  provider:
+    default: fake
+cloud_provider: ${var.provider}
+nodes:
+  count: 1
+`), 0644))
+	bundlePath := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	_, err := bundle.Create(bundlePath, []bundle.File{
+		{Name: "taskfly.yml", Path: filepath.Join(dir, "taskfly.yml")},
+	}, bundle.Options{})
+	require.NoError(t, err)
+
+	// Neither the configuration nor a variable can pick the provider that
+	// runs scripts on the daemon host, with or without the simulate option
+	for _, simulate := range []bool{false, true} {
+		_, err = o.ProcessDeployment(bundlePath, state.Owner{}, 0, simulate, "", map[string]string{"provider": "simulate"})
+		assert.ErrorContains(t, err, `cloud_provider "simulate" can't be configured`)
+	}
+	assert.Empty(t, store.GetAllDeployments())
+
+	deployment, err := o.ProcessDeployment(bundlePath, state.Owner{}, 0, true, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "simulate", deployment.CloudProvider)
+}
+
+func TestProcessDeploymentSubstitutesVariables(t *testing.T) {
+	o, store, _, _ := newTestOrchestrator(t)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "taskfly.yml"), []byte(`cloud_provider: fake
+variables:
+  nodes:
+    type: int
+  dataset:
+    default: sample
+nodes:
+  count: ${var.nodes}
+  global_metadata:
+    input: s3://data/${var.dataset}
+`), 0644))
+	bundlePath := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	_, err := bundle.Create(bundlePath, []bundle.File{
+		{Name: "taskfly.yml", Path: filepath.Join(dir, "taskfly.yml")},
+	}, bundle.Options{})
+	require.NoError(t, err)
+
+	_, err = o.ProcessDeployment(bundlePath, state.Owner{}, 0, false, "", nil)
+	assert.ErrorContains(t, err, "no value for variables nodes")
+	_, err = o.ProcessDeployment(bundlePath, state.Owner{}, 0, false, "", map[string]string{"nodes": "two"})
+	assert.ErrorContains(t, err, `variable nodes: "two" is not an integer`)
+
+	deployment, err := o.ProcessDeployment(bundlePath, state.Owner{}, 0, false, "", map[string]string{"nodes": "2"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, deployment.TotalNodes)
+	assert.Equal(t, map[string]interface{}{"nodes": 2, "dataset": "sample"}, deployment.Variables)
+	nodes, err := store.GetNodesByDeployment(deployment.ID)
+	require.NoError(t, err)
+	require.Len(t, nodes, 2)
+	assert.Equal(t, "s3://data/sample", nodes[0].Config["input"])
+
+	// Archives carry the values, so imports need no --var
+	archivePath := filepath.Join(t.TempDir(), "archive.tar.gz")
+	manifest, err := o.ExportDeployment(deployment.ID, archivePath)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"nodes": "2", "dataset": "sample"}, manifest.Variables)
+	imported, err := o.ProcessDeployment(archivePath, state.Owner{}, 0, false, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, imported.TotalNodes)
+}
+
+func TestCleanupFinishedFollowsPolicy(t *testing.T) {
+	o, store, _, clock := newTestOrchestrator(t)
+	for _, id := range []string{"dep_old", "dep_running"} {
+		createDeployment(t, store, id, 1)
+		require.NoError(t, os.MkdirAll(filepath.Join(o.workingDir, id), 0755))
+	}
+	require.NoError(t, store.UpdateDeploymentStatus("dep_old", state.StatusCompleted))
+	require.NoError(t, store.UpdateDeploymentStatus("dep_running", state.StatusRunning))
+
+	require.NoError(t, o.SetCleanupPolicy(CleanupPolicy{
+		Interval:    time.Hour,
+		FilesAfter:  time.Hour,
+		RemoveState: false,
+	}))
+	clock.Advance(30 * time.Minute)
+	assert.Equal(t, CleanupRun{At: clock.Now()}, o.CleanupFinished())
+
+	// Files go, the history stays
+	clock.Advance(time.Hour)
+	run := o.CleanupFinished()
+	assert.Equal(t, 1, run.FilesRemoved)
+	assert.Equal(t, 0, run.StateRemoved)
+	assert.NoDirExists(t, filepath.Join(o.workingDir, "dep_old"))
+	assert.DirExists(t, filepath.Join(o.workingDir, "dep_running"))
+	_, err := store.GetDeployment("dep_old")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, o.CleanupFinished().FilesRemoved)
+
+	require.NoError(t, o.SetCleanupPolicy(CleanupPolicy{RemoveState: true, StateAfter: 24 * time.Hour}))
+	assert.Equal(t, 0, o.CleanupFinished().StateRemoved)
+	clock.Advance(23 * time.Hour)
+	assert.Equal(t, 1, o.CleanupFinished().StateRemoved)
+	_, err = store.GetDeployment("dep_old")
+	assert.Error(t, err)
+	_, err = store.GetDeployment("dep_running")
+	assert.NoError(t, err)
+
+	_, lastRun := o.CleanupPolicy()
+	require.NotNil(t, lastRun)
+	assert.Equal(t, clock.Now(), lastRun.At)
+}
+
+func TestRunCleanupPicksUpPolicyChanges(t *testing.T) {
+	o, store, _, clock := newTestOrchestrator(t)
+	createDeployment(t, store, "dep_done", 1)
+	require.NoError(t, store.UpdateDeploymentStatus("dep_done", state.StatusFailed))
+
+	require.NoError(t, o.SetCleanupPolicy(CleanupPolicy{RemoveState: true}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go o.RunCleanup(ctx)
+
+	// Without an interval nothing runs
+	clock.Advance(24 * time.Hour)
+	_, err := store.GetDeployment("dep_done")
+	require.NoError(t, err)
+
+	require.NoError(t, o.SetCleanupPolicy(CleanupPolicy{Interval: time.Minute, RemoveState: true}))
+	require.Eventually(t, func() bool { return clock.Waiting() > 0 }, time.Second, 10*time.Millisecond)
+	clock.Advance(time.Minute)
+	require.Eventually(t, func() bool {
+		_, err := store.GetDeployment("dep_done")
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCleanupPolicyValidate(t *testing.T) {
+	assert.NoError(t, DefaultCleanupPolicy.Validate())
+	assert.NoError(t, CleanupPolicy{}.Validate())
+	assert.ErrorContains(t, CleanupPolicy{Interval: 30 * time.Second}.Validate(), "at least 1m0s")
+	assert.ErrorContains(t, CleanupPolicy{StateAfter: -time.Hour}.Validate(), "can't be negative")
+}
+
+func TestProcessDeploymentStripsSpecialBits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("setuid bits need a Unix filesystem")
+	}
+	o, _, _, _ := newTestOrchestrator(t)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "taskfly.yml"), []byte("cloud_provider: fake\nnodes:\n  count: 1\n"), 0644))
+	tool := filepath.Join(dir, "tool")
+	require.NoError(t, os.WriteFile(tool, []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.Chmod(tool, 0755|os.ModeSetuid))
+	bundlePath := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	_, err := bundle.Create(bundlePath, []bundle.File{
+		{Name: "taskfly.yml", Path: filepath.Join(dir, "taskfly.yml")},
+		{Name: "bin/tool", Path: tool},
+	}, bundle.Options{})
+	require.NoError(t, err)
+
+	deployment, err := o.ProcessDeployment(bundlePath, state.Owner{}, 0, false, "", nil)
+	require.NoError(t, err)
+
+	// The daemon host gets no setuid file, but the nodes and exports do
+	info, err := os.Stat(filepath.Join(o.workingDir, deployment.ID, "bin", "tool"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode())
+
+	archivePath := filepath.Join(t.TempDir(), "archive.tar.gz")
+	_, err = o.ExportDeployment(deployment.ID, archivePath)
+	require.NoError(t, err)
+	for _, path := range []string{filepath.Join(o.workingDir, deployment.ID, "worker_bundle.tar.gz"), archivePath} {
+		manifest, err := bundle.Inspect(path)
+		require.NoError(t, err)
+		paths := make(map[string]string)
+		for _, file := range manifest.Files {
+			paths[file.Path] = file.Mode
+		}
+		assert.Equal(t, "urwxr-xr-x", paths["bin/tool"], path)
+		assert.NotContains(t, paths, "special_bits.json", path)
+	}
+}
+
+func TestExportLeavesOutSensitiveVariables(t *testing.T) {
+	o, _, _, _ := newTestOrchestrator(t)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "taskfly.yml"), []byte(`cloud_provider: fake
+variables:
+  dataset: {}
+  api_key:
+    sensitive: true
+nodes:
+  count: 1
+  global_metadata:
+    input: s3://data/${var.dataset}
+    api_key: ${var.api_key}
+`), 0644))
+	bundlePath := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	_, err := bundle.Create(bundlePath, []bundle.File{
+		{Name: "taskfly.yml", Path: filepath.Join(dir, "taskfly.yml")},
+	}, bundle.Options{})
+	require.NoError(t, err)
+
+	deployment, err := o.ProcessDeployment(bundlePath, state.Owner{}, 0, false, "", map[string]string{"dataset": "sample", "api_key": "hunter2"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"api_key"}, deployment.SensitiveVariables)
+
+	archivePath := filepath.Join(t.TempDir(), "archive.tar.gz")
+	manifest, err := o.ExportDeployment(deployment.ID, archivePath)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"dataset": "sample"}, manifest.Variables)
+
+	// Imports give sensitive values again, and take the rest from the archive
+	_, err = o.ProcessDeployment(archivePath, state.Owner{}, 0, false, "", nil)
+	assert.ErrorContains(t, err, "no value for variables api_key")
+	imported, err := o.ProcessDeployment(archivePath, state.Owner{}, 0, false, "", map[string]string{"api_key": "hunter3"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"dataset": "sample", "api_key": "hunter3"}, imported.Variables)
+}
+
+func TestCheckEntryScript(t *testing.T) {
+	root := t.TempDir()
+	bundleDir := filepath.Join(root, "bundle")
+	require.NoError(t, os.MkdirAll(filepath.Join(bundleDir, "scripts"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(bundleDir, "scripts", "run.sh"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "secret"), []byte("secret\n"), 0600))
+	require.NoError(t, os.Symlink("../secret", filepath.Join(bundleDir, "escape.sh")))
+
+	tests := []struct {
+		script  string
+		wantErr string
+	}{
+		{script: "scripts/run.sh"},
+		{script: "./scripts/../scripts/run.sh"},
+		// Existing files outside the bundle are rejected like missing ones
+		{script: "../secret", wantErr: "is outside the bundle"},
+		{script: "../../etc/passwd", wantErr: "is outside the bundle"},
+		{script: "/etc/passwd", wantErr: "must be relative to the bundle"},
+		{script: ".", wantErr: "is outside the bundle"},
+		{script: "escape.sh", wantErr: "is outside the bundle"},
+		{script: "missing.sh", wantErr: "not found in bundle"},
+		{script: "scripts", wantErr: "is a directory"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.script, func(t *testing.T) {
+			err := checkEntryScript(bundleDir, tt.script)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
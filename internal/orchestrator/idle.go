@@ -0,0 +1,208 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/cloud"
+	"github.com/JustinTimperio/TaskFly/internal/state"
+)
+
+const (
+	// defaultIdleGrace is how long a node stays up after its workload finished
+	defaultIdleGrace = 10 * time.Minute
+
+	// defaultIdleCPUThreshold is the CPU usage in percent below which a node counts as idle
+	defaultIdleCPUThreshold = 5.0
+)
+
+// IdleShutdownConfig controls the automatic shutdown of nodes that have
+// nothing left to do. It is on by default.
+type IdleShutdownConfig struct {
+	Disabled     bool    `yaml:"disabled" json:"disabled"`           // keep idle nodes running
+	Grace        int     `yaml:"grace" json:"grace"`                 // seconds to keep a node after its workload finished
+	CPUThreshold float64 `yaml:"cpu_threshold" json:"cpu_threshold"` // percent below which the CPU counts as idle
+	CPUIdle      int     `yaml:"cpu_idle" json:"cpu_idle"`           // seconds of idle CPU before a running node is stopped, 0 disables
+}
+
+// grace returns the configured grace period or the default
+func (c IdleShutdownConfig) grace() time.Duration {
+	if c.Grace > 0 {
+		return time.Duration(c.Grace) * time.Second
+	}
+	return defaultIdleGrace
+}
+
+// cpuThreshold returns the configured idle CPU threshold or the default
+func (c IdleShutdownConfig) cpuThreshold() float64 {
+	if c.CPUThreshold > 0 {
+		return c.CPUThreshold
+	}
+	return defaultIdleCPUThreshold
+}
+
+// idleShutdownConfig reads the idle shutdown settings stored on a deployment.
+// Deployments loaded from disk hold them as a generic JSON map.
+func idleShutdownConfig(deployment *state.Deployment) IdleShutdownConfig {
+	var config IdleShutdownConfig
+	switch value := deployment.Config["idle_shutdown"].(type) {
+	case IdleShutdownConfig:
+		config = value
+	case map[string]interface{}:
+		if data, err := json.Marshal(value); err == nil {
+			json.Unmarshal(data, &config)
+		}
+	}
+	return config
+}
+
+// ShutdownIdleNodes shuts down nodes whose workload finished more than the
+// grace period ago and, if configured, running nodes whose CPU has been idle
+// for the configured time. Quarantined nodes are skipped until their
+// quarantine ends and then shut down even with idle shutdown disabled. The
+// agent is told to stop and the instance is terminated. Returns the number of
+// nodes shut down.
+func (o *Orchestrator) ShutdownIdleNodes() int {
+	now := o.clock.Now()
+	shutDown := 0
+
+	for _, deployment := range o.store.GetAllDeployments() {
+		if deployment.Status == state.StatusTerminating || deployment.Status == state.StatusTerminated {
+			continue
+		}
+		config := idleShutdownConfig(deployment)
+
+		nodes, err := o.store.GetNodesByDeployment(deployment.ID)
+		if err != nil {
+			o.logger.Errorf("Failed to get nodes of deployment %s: %v", deployment.ID, err)
+			continue
+		}
+
+		var provider cloud.Provider
+		for _, node := range nodes {
+			if node.ShouldShutdown {
+				continue
+			}
+
+			var reason string
+			switch {
+			case quarantined(node, now):
+				continue
+			case node.QuarantinedUntil != nil:
+				reason = fmt.Sprintf("quarantine ended at %s", node.QuarantinedUntil.Format(time.RFC3339))
+			case !config.Disabled:
+				reason = o.idleReason(deployment, node, config, now)
+			}
+			if reason == "" {
+				continue
+			}
+
+			if provider == nil {
+				if provider, err = o.providers.NewProvider(deployment.CloudProvider, providerConfig(deployment)); err != nil {
+					o.logger.Errorf("Failed to create provider for deployment %s: %v", deployment.ID, err)
+					break
+				}
+			}
+			o.shutdownIdleNode(node, provider, reason)
+			shutDown++
+		}
+	}
+
+	return shutDown
+}
+
+// idleReason explains why a node is idle, or returns "" if it is not
+func (o *Orchestrator) idleReason(deployment *state.Deployment, node *state.Node, config IdleShutdownConfig, now time.Time) string {
+	switch node.Status {
+	case state.NodeStatusCompleted, state.NodeStatusFailed:
+		if node.FinishedAt != nil && now.Sub(*node.FinishedAt) >= config.grace() {
+			return fmt.Sprintf("idle: workload %s more than %s ago", node.Status, config.grace())
+		}
+	case state.NodeStatusRunning:
+		if config.CPUIdle <= 0 {
+			return ""
+		}
+		window := time.Duration(config.CPUIdle) * time.Second
+		samples, err := o.store.GetMetricsHistory(deployment.ID, node.NodeID)
+		if err != nil {
+			return ""
+		}
+		if cpuIdleSince(samples, now.Add(-window), config.cpuThreshold()) {
+			return fmt.Sprintf("idle: CPU below %.0f%% for %s", config.cpuThreshold(), window)
+		}
+	}
+	return ""
+}
+
+// cpuIdleSince reports whether every sample since start is below threshold.
+// The history must reach back to start, otherwise idleness is not proven.
+func cpuIdleSince(samples []state.MetricsSample, start time.Time, threshold float64) bool {
+	if len(samples) == 0 || samples[0].Timestamp.After(start) {
+		return false
+	}
+
+	recent := 0
+	for _, sample := range samples {
+		if sample.Timestamp.Before(start) {
+			continue
+		}
+		if sample.CPUUsage >= threshold {
+			return false
+		}
+		recent++
+	}
+	return recent > 0
+}
+
+// shutdownIdleNode stops the agent of an idle node and terminates its
+// instance. Running nodes are marked completed so the deployment can finish.
+func (o *Orchestrator) shutdownIdleNode(node *state.Node, provider cloud.Provider, reason string) {
+	o.logger.Infof("Shutting down node %s (instance: %s): %s", node.NodeID, node.InstanceID, reason)
+
+	if err := o.store.MarkNodeIdle(node.DeploymentID, node.NodeID, reason); err != nil {
+		o.logger.Errorf("Failed to mark node %s for shutdown: %v", node.NodeID, err)
+		return
+	}
+	if node.Status == state.NodeStatusRunning {
+		o.store.UpdateNodeStatus(node.DeploymentID, node.NodeID, state.NodeStatusCompleted, reason)
+		o.RecordCompletionReport(node.DeploymentID)
+	}
+
+	if node.InstanceID == "" {
+		return
+	}
+	if err := provider.TerminateInstance(context.Background(), node.InstanceID); err != nil {
+		o.logger.Errorf("Failed to terminate instance %s of idle node %s: %v", node.InstanceID, node.NodeID, err)
+	}
+}
+
+// awaitingIdleShutdown reports whether a finished deployment still has nodes
+// that idle shutdown will stop, including quarantined ones. With idle
+// shutdown disabled, nodes on instances TaskFly created are kept until
+// `taskfly down`. The periodic cleanup leaves such deployments alone, since
+// it would terminate the nodes.
+func (o *Orchestrator) awaitingIdleShutdown(deployment *state.Deployment) bool {
+	disabled := idleShutdownConfig(deployment).Disabled
+
+	nodes, err := o.store.GetNodesByDeployment(deployment.ID)
+	if err != nil {
+		return false
+	}
+	for _, node := range nodes {
+		if node.ShouldShutdown || node.InstanceID == "" {
+			continue
+		}
+		if node.QuarantinedUntil != nil {
+			return true
+		}
+		if disabled && cloud.OwnsInstances(deployment.CloudProvider) {
+			return true
+		}
+		if !disabled && (node.Status == state.NodeStatusCompleted || node.Status == state.NodeStatusFailed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package orchestrator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultLimitsCheckInterval is how often agents measure the working
+// directory when limits don't say
+const defaultLimitsCheckInterval = 30
+
+// LimitsConfig caps what the workload of a node may write (limits in
+// taskfly.yml). Sizes are given like "10GB" or "512MiB"; empty means no limit.
+type LimitsConfig struct {
+	MaxWorkdirSize string `yaml:"max_workdir_size"` // total size of the working directory
+	MaxOutputSize  string `yaml:"max_output_size"`  // stdout and stderr of the workload together
+	CheckInterval  int    `yaml:"check_interval"`   // seconds between working directory measurements
+}
+
+// NodeLimits are the resolved limits sent to agents at registration
+type NodeLimits struct {
+	MaxWorkdirBytes int64 `json:"max_workdir_bytes,omitempty"`
+	MaxOutputBytes  int64 `json:"max_output_bytes,omitempty"`
+	CheckInterval   int   `json:"check_interval,omitempty"`
+}
+
+// Resolve parses the configured sizes
+func (c LimitsConfig) Resolve() (NodeLimits, error) {
+	var limits NodeLimits
+	var err error
+	if limits.MaxWorkdirBytes, err = ParseSize(c.MaxWorkdirSize); err != nil {
+		return limits, fmt.Errorf("max_workdir_size: %w", err)
+	}
+	if limits.MaxOutputBytes, err = ParseSize(c.MaxOutputSize); err != nil {
+		return limits, fmt.Errorf("max_output_size: %w", err)
+	}
+	if c.CheckInterval < 0 {
+		return limits, fmt.Errorf("check_interval must not be negative")
+	}
+	if limits.MaxWorkdirBytes > 0 {
+		limits.CheckInterval = c.CheckInterval
+		if limits.CheckInterval == 0 {
+			limits.CheckInterval = defaultLimitsCheckInterval
+		}
+	}
+	return limits, nil
+}
+
+// sizeUnits are the multipliers of the suffixes ParseSize accepts
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+	{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000}, {"TB", 1000 * 1000 * 1000 * 1000},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// ParseSize parses a size such as "10GB", "1.5GiB" or "4096" (bytes). KB, MB,
+// GB and TB are decimal, KiB, MiB, GiB and TiB and the single letters K, M, G
+// and T binary. An empty value is 0.
+func ParseSize(value string) (int64, error) {
+	trimmed := strings.ToUpper(strings.TrimSpace(value))
+	if trimmed == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(trimmed, unit.suffix) {
+			trimmed = strings.TrimSpace(strings.TrimSuffix(trimmed, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	number, err := strconv.ParseFloat(trimmed, 64)
+	if err != nil || number <= 0 {
+		return 0, fmt.Errorf("invalid size %q, use a positive number with an optional unit such as 512MB or 10GiB", value)
+	}
+	return int64(number * float64(multiplier)), nil
+}
@@ -0,0 +1,44 @@
+package orchestrator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"":       0,
+		"4096":   4096,
+		"512MB":  512 * 1000 * 1000,
+		"10 GiB": 10 << 30,
+		"1.5gib": 3 << 29,
+		"2g":     2 << 30,
+		"100KB":  100 * 1000,
+	}
+	for value, expected := range tests {
+		size, err := ParseSize(value)
+		require.NoError(t, err, value)
+		assert.Equal(t, expected, size, value)
+	}
+
+	for _, value := range []string{"lots", "-1GB", "0", "10XB"} {
+		_, err := ParseSize(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestLimitsResolve(t *testing.T) {
+	limits, err := LimitsConfig{MaxWorkdirSize: "1GiB", MaxOutputSize: "10MiB"}.Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, NodeLimits{MaxWorkdirBytes: 1 << 30, MaxOutputBytes: 10 << 20, CheckInterval: defaultLimitsCheckInterval}, limits)
+
+	// Without a working directory limit there is nothing to check
+	limits, err = LimitsConfig{MaxOutputSize: "1MB", CheckInterval: 5}.Resolve()
+	require.NoError(t, err)
+	assert.Equal(t, NodeLimits{MaxOutputBytes: 1000 * 1000}, limits)
+
+	_, err = LimitsConfig{MaxWorkdirSize: "big"}.Resolve()
+	assert.EqualError(t, err, `max_workdir_size: invalid size "big", use a positive number with an optional unit such as 512MB or 10GiB`)
+}
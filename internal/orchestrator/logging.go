@@ -0,0 +1,37 @@
+package orchestrator
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// debugLoggers holds a debug level copy of each logger that logged for a
+// deployment with debug: true
+var debugLoggers sync.Map
+
+// DeploymentLog returns a log entry tagged with a deployment's ID. For
+// deployments with debug: true it logs debug messages even when logger is at
+// a higher level, so they can be debugged on a daemon that isn't.
+func DeploymentLog(logger *logrus.Logger, deploymentID string, debug bool) *logrus.Entry {
+	if debug && !logger.IsLevelEnabled(logrus.DebugLevel) {
+		value, ok := debugLoggers.Load(logger)
+		if !ok {
+			value, _ = debugLoggers.LoadOrStore(logger, &logrus.Logger{
+				Out:          logger.Out,
+				Hooks:        logger.Hooks,
+				Formatter:    logger.Formatter,
+				ReportCaller: logger.ReportCaller,
+				ExitFunc:     logger.ExitFunc,
+				Level:        logrus.DebugLevel,
+			})
+		}
+		logger = value.(*logrus.Logger)
+	}
+	return logger.WithField("deployment_id", deploymentID)
+}
+
+// deploymentLog returns the orchestrator's log entry for a deployment
+func (o *Orchestrator) deploymentLog(deploymentID string, debug bool) *logrus.Entry {
+	return DeploymentLog(o.logger, deploymentID, debug)
+}
@@ -0,0 +1,63 @@
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+)
+
+const (
+	// DefaultQuarantine is how long a quarantined node is kept by default
+	DefaultQuarantine = 2 * time.Hour
+
+	// MaxQuarantine bounds how long a node can be kept for debugging
+	MaxQuarantine = 24 * time.Hour
+)
+
+// ErrNotQuarantinable is returned for nodes that are not failed or whose
+// instance is already gone
+var ErrNotQuarantinable = errors.New("only failed nodes with a running instance can be quarantined")
+
+// QuarantineNode keeps a failed node alive for the given time so it can be
+// inspected. Idle shutdown and the periodic cleanup leave it alone until
+// then, after which idle shutdown terminates it. Quarantining again extends
+// or shortens the time. Returns when the quarantine ends.
+func (o *Orchestrator) QuarantineNode(node *state.Node, duration time.Duration) (time.Time, error) {
+	if duration <= 0 || duration > MaxQuarantine {
+		return time.Time{}, fmt.Errorf("quarantine duration must be between 0 and %s", MaxQuarantine)
+	}
+	if node.Status != state.NodeStatusFailed || node.InstanceID == "" || node.ShouldShutdown {
+		return time.Time{}, ErrNotQuarantinable
+	}
+
+	until := o.clock.Now().Add(duration)
+	if err := o.store.QuarantineNode(node.DeploymentID, node.NodeID, until); err != nil {
+		return time.Time{}, err
+	}
+
+	o.logger.Infof("Quarantined node %s (instance: %s) until %s", node.NodeID, node.InstanceID, until.Format(time.RFC3339))
+	return until, nil
+}
+
+// ParseKeepFailed parses a keep_failed window such as "2h". An empty value
+// means failed nodes are not kept.
+func ParseKeepFailed(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if duration <= 0 || duration > MaxQuarantine {
+		return 0, fmt.Errorf("must be between 0 and %s", MaxQuarantine)
+	}
+	return duration, nil
+}
+
+// quarantined reports whether a node is still kept for debugging
+func quarantined(node *state.Node, now time.Time) bool {
+	return node.QuarantinedUntil != nil && now.Before(*node.QuarantinedUntil)
+}
@@ -0,0 +1,97 @@
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/JustinTimperio/TaskFly/internal/metadata"
+	"github.com/JustinTimperio/TaskFly/internal/state"
+)
+
+// ErrNotReconfigurable is returned for nodes whose workload already finished
+var ErrNotReconfigurable = errors.New("only nodes that haven't finished can be reconfigured")
+
+// Reconfigurable reports whether a node's config can still change
+func Reconfigurable(node *state.Node) bool {
+	switch node.Status {
+	case state.NodeStatusCompleted, state.NodeStatusFailed, state.NodeStatusTerminating, state.NodeStatusTerminated:
+		return false
+	}
+	return true
+}
+
+// ReconfigureNodes changes the config of nodes of a deployment while they
+// run. changes sets keys, or removes them with a nil value. The agents pick up
+// the new config with their next heartbeat. Every node is checked against the
+// config limits and the environment variable policy before any is changed.
+// Returns the new config version of each node by ID.
+func (o *Orchestrator) ReconfigureNodes(deployment *state.Deployment, nodes []*state.Node, changes map[string]interface{}) (map[string]int, error) {
+	if len(changes) == 0 {
+		return nil, fmt.Errorf("no config changes given")
+	}
+	for key := range changes {
+		if key == metadata.ScriptArgsKey || key == metadata.EntryCommandKey {
+			return nil, fmt.Errorf("%s is used when the node starts and can't be changed", key)
+		}
+	}
+
+	fileKeys := stringSlice(deployment.Config["config_files"])
+	configs := make([]metadata.NodeConfig, len(nodes))
+	for i, node := range nodes {
+		if !Reconfigurable(node) {
+			return nil, fmt.Errorf("node %s (status: %s): %w", node.NodeID, node.Status, ErrNotReconfigurable)
+		}
+
+		// The store shares config maps between copies of a node, so the
+		// update goes to a new map
+		config := make(map[string]interface{}, len(node.Config)+len(changes))
+		for key, value := range node.Config {
+			config[key] = value
+		}
+		for key, value := range changes {
+			if value == nil {
+				delete(config, key)
+			} else {
+				config[key] = value
+			}
+		}
+		if err := metadata.ValidateNodeConfig(config, fileKeys); err != nil {
+			return nil, fmt.Errorf("node %s: %w", node.NodeID, err)
+		}
+		configs[i] = metadata.NodeConfig{NodeID: node.NodeID, NodeIndex: node.NodeIndex, DeploymentID: deployment.ID, Config: config}
+	}
+	if err := o.envPolicy.Check(configs); err != nil {
+		return nil, err
+	}
+
+	log := o.deploymentLog(deployment.ID, deployment.Debug)
+	versions := make(map[string]int, len(nodes))
+	for _, config := range configs {
+		version, err := o.store.UpdateNodeConfig(deployment.ID, config.NodeID, config.Config)
+		if err != nil {
+			return versions, fmt.Errorf("failed to update config of node %s: %w", config.NodeID, err)
+		}
+		versions[config.NodeID] = version
+		log.Infof("Updated config of node %s to version %d", config.NodeID, version)
+		log.Debugf("Node %s has config %v", config.NodeID, config.Config)
+	}
+	return versions, nil
+}
+
+// stringSlice reads a list of strings stored in a deployment's config.
+// Deployments loaded from disk hold it as []interface{}.
+func stringSlice(value interface{}) []string {
+	switch v := value.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/notify"
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+// troubleshootingURL is the page watchdog alerts link to
+const troubleshootingURL = "https://github.com/JustinTimperio/TaskFly/blob/main/docs/TROUBLESHOOTING.md"
+
+// Kinds of watchdog alerts
+const (
+	AlertDeploymentStuck = "deployment_stuck"
+	AlertNodeStuck       = "node_stuck"
+	AlertNodeSilent      = "node_silent"
+)
+
+// WatchdogConfig overrides the daemon's watchdog thresholds for a deployment
+type WatchdogConfig struct {
+	Disabled       bool `yaml:"disabled" json:"disabled"`
+	PendingTimeout int  `yaml:"pending_timeout" json:"pending_timeout"` // seconds a deployment may stay pending or provisioning
+	StalledAfter   int  `yaml:"stalled_after" json:"stalled_after"`     // seconds a node may keep its status or go without heartbeats
+}
+
+// stuckHint explains likely causes of a status not progressing and links to
+// the matching troubleshooting section
+type stuckHint struct {
+	hint   string
+	anchor string
+}
+
+var stuckHints = map[string]stuckHint{
+	"deployment/" + string(state.StatusPending): {
+		"Provisioning has not started. Check the daemon log for bundle or configuration errors.",
+		"deployment-stuck-in-pending",
+	},
+	"deployment/" + string(state.StatusProvisioning): {
+		"Instances are not coming up. Look for cloud API errors, exhausted quotas or capacity shortages in the daemon log.",
+		"deployment-stuck-in-provisioning",
+	},
+	"node/" + string(state.NodeStatusPending): {
+		"The node is waiting to be provisioned. Check the daemon log for provider errors.",
+		"deployment-stuck-in-pending",
+	},
+	"node/" + string(state.NodeStatusProvisioning): {
+		"The instance launch or agent deployment is slow. Check the security group allows SSH from the daemon and ssh_key_path matches key_name.",
+		"node-stuck-in-provisioning",
+	},
+	"node/" + string(state.NodeStatusBooting): {
+		"The agent has not registered. Check the node can reach the daemon IP and port, and read /tmp/taskfly-agent-*.log on the node.",
+		"node-stuck-in-booting",
+	},
+	"node/" + string(state.NodeStatusRegistering): {
+		"The node registered but has not fetched its bundle. Check the bundle size and the node's bandwidth to the daemon.",
+		"node-stuck-in-registering-or-downloading",
+	},
+	"node/" + string(state.NodeStatusDownloading): {
+		"The bundle download is slow or failing. Check the bundle size and the node's bandwidth to the daemon.",
+		"node-stuck-in-registering-or-downloading",
+	},
+	"node/" + string(state.NodeStatusExtracting): {
+		"Extracting the bundle is slow or hanging. Check the bundle size and the free disk space on the node.",
+		"node-stuck-in-registering-or-downloading",
+	},
+	"node/" + AlertNodeSilent: {
+		"The agent stopped sending heartbeats. The instance may have crashed, run out of memory or been terminated outside TaskFly.",
+		"node-stopped-sending-heartbeats",
+	},
+}
+
+// Watchdog alerts when deployments or nodes stop making progress. Each
+// condition is reported once until it clears.
+type Watchdog struct {
+	store          state.StateStore
+	notifier       *notify.Notifier
+	logger         *logrus.Logger
+	pendingTimeout time.Duration
+	stalledAfter   time.Duration
+	alerted        map[string]bool // keys of conditions already reported
+}
+
+// NewWatchdog creates a watchdog with default thresholds. Deployments can
+// override them in taskfly.yml.
+func NewWatchdog(store state.StateStore, notifier *notify.Notifier, pendingTimeout, stalledAfter time.Duration) *Watchdog {
+	logger := logrus.New()
+	logger.SetLevel(logrus.InfoLevel)
+
+	return &Watchdog{
+		store:          store,
+		notifier:       notifier,
+		logger:         logger,
+		pendingTimeout: pendingTimeout,
+		stalledAfter:   stalledAfter,
+		alerted:        make(map[string]bool),
+	}
+}
+
+// Check looks for stuck deployments and nodes, alerts on new findings and
+// returns the number of alerts sent. It is not safe for concurrent use.
+func (w *Watchdog) Check(now time.Time) int {
+	var alerts []alert
+	stuck := make(map[string]bool)
+
+	for _, deployment := range w.store.GetAllDeployments() {
+		config := watchdogConfig(deployment)
+		if config.Disabled {
+			continue
+		}
+		pendingTimeout, stalledAfter := w.pendingTimeout, w.stalledAfter
+		if config.PendingTimeout > 0 {
+			pendingTimeout = time.Duration(config.PendingTimeout) * time.Second
+		}
+		if config.StalledAfter > 0 {
+			stalledAfter = time.Duration(config.StalledAfter) * time.Second
+		}
+
+		if deployment.Status == state.StatusPending || deployment.Status == state.StatusProvisioning {
+			if age := now.Sub(deployment.CreatedAt); pendingTimeout > 0 && age >= pendingTimeout {
+				key := AlertDeploymentStuck + "/" + deployment.ID
+				stuck[key] = true
+				alerts = append(alerts, newAlert(key, AlertDeploymentStuck, deployment.ID, "",
+					fmt.Sprintf("Deployment %s has been %s for %s", deployment.ID, deployment.Status, age.Round(time.Minute)),
+					"deployment/"+string(deployment.Status)))
+			}
+			continue
+		}
+		if deployment.Status != state.StatusRunning || stalledAfter <= 0 {
+			continue
+		}
+
+		nodes, err := w.store.GetNodesByDeployment(deployment.ID)
+		if err != nil {
+			continue
+		}
+		for _, node := range nodes {
+			kind, summary, hintKey := nodeStall(node, stalledAfter, now)
+			if kind == "" {
+				continue
+			}
+			key := kind + "/" + node.NodeID
+			stuck[key] = true
+			alerts = append(alerts, newAlert(key, kind, deployment.ID, node.NodeID, summary, hintKey))
+		}
+	}
+
+	// Forget conditions that cleared so they are reported again if they recur
+	for key := range w.alerted {
+		if !stuck[key] {
+			delete(w.alerted, key)
+		}
+	}
+
+	sent := 0
+	for _, alert := range alerts {
+		if w.alerted[alert.key] {
+			continue
+		}
+		w.alerted[alert.key] = true
+		w.logger.Warnf("Watchdog: %s", alert.event.Summary)
+		if err := w.notifier.Send(context.Background(), alert.event); err != nil {
+			w.logger.Errorf("Failed to send watchdog alert: %v", err)
+		}
+		sent++
+	}
+	return sent
+}
+
+// nodeStall reports whether a node is stuck in a transitional status or
+// stopped sending heartbeats while running
+func nodeStall(node *state.Node, stalledAfter time.Duration, now time.Time) (kind, summary, hintKey string) {
+	switch node.Status {
+	case state.NodeStatusPending, state.NodeStatusProvisioning, state.NodeStatusBooting,
+		state.NodeStatusRegistering, state.NodeStatusDownloading, state.NodeStatusExtracting:
+		changed := node.StatusChangedAt
+		if changed.IsZero() {
+			changed = node.LastUpdate
+		}
+		if age := now.Sub(changed); age >= stalledAfter {
+			return AlertNodeStuck, fmt.Sprintf("Node %s has been %s for %s", node.NodeID, node.Status, age.Round(time.Minute)), "node/" + string(node.Status)
+		}
+	case state.NodeStatusRunning:
+		if age := now.Sub(node.LastUpdate); age >= stalledAfter {
+			return AlertNodeSilent, fmt.Sprintf("Node %s has not sent a heartbeat for %s", node.NodeID, age.Round(time.Minute)), "node/" + AlertNodeSilent
+		}
+	}
+	return "", "", ""
+}
+
+// alert is a stuck condition found by a check, identified by key
+type alert struct {
+	key   string
+	event notify.Event
+}
+
+// newAlert builds an alert with the hint and documentation link for hintKey
+func newAlert(key, kind, deploymentID, nodeID, summary, hintKey string) alert {
+	event := notify.Event{
+		Kind:         kind,
+		DeploymentID: deploymentID,
+		NodeID:       nodeID,
+		Summary:      summary,
+	}
+	if hint, ok := stuckHints[hintKey]; ok {
+		event.Hint = hint.hint
+		event.DocsURL = troubleshootingURL + "#" + hint.anchor
+	}
+	return alert{key: key, event: event}
+}
+
+// watchdogConfig reads the watchdog settings stored on a deployment.
+// Deployments loaded from disk hold them as a generic JSON map.
+func watchdogConfig(deployment *state.Deployment) WatchdogConfig {
+	var config WatchdogConfig
+	switch value := deployment.Config["watchdog"].(type) {
+	case WatchdogConfig:
+		config = value
+	case map[string]interface{}:
+		if data, err := json.Marshal(value); err == nil {
+			json.Unmarshal(data, &config)
+		}
+	}
+	return config
+}
@@ -0,0 +1,154 @@
+// Package policy enforces daemon-wide rules on submitted deployments
+package policy
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/JustinTimperio/TaskFly/internal/metadata"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPolicy restricts the environment variables a deployment may distribute
+// to its nodes. The agent exports node config keys upper-cased, so names are
+// matched upper-cased as well.
+type EnvPolicy struct {
+	// AllowNames lists glob patterns; when set, only matching names may be used
+	AllowNames []string `yaml:"allow_names"`
+
+	// DenyNames lists glob patterns of names that may never be used
+	DenyNames []string `yaml:"deny_names"`
+
+	// DenyValues lists regular expressions values may not match. Values of
+	// script_args and entry_command are checked too since they also reach
+	// the node.
+	DenyValues []string `yaml:"deny_values"`
+
+	denyValues []*regexp.Regexp
+}
+
+// Violation is one node config entry rejected by the policy
+type Violation struct {
+	Name   string
+	Reason string
+	Nodes  int
+}
+
+// Error lists all policy violations of a deployment
+type Error struct {
+	Violations []Violation
+}
+
+func (e *Error) Error() string {
+	parts := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		parts = append(parts, fmt.Sprintf("%s %s (%d node(s))", v.Name, v.Reason, v.Nodes))
+	}
+	return "environment variable policy violated: " + strings.Join(parts, "; ")
+}
+
+// LoadEnvPolicy reads and compiles an environment variable policy from a
+// YAML file
+func LoadEnvPolicy(policyPath string) (*EnvPolicy, error) {
+	data, err := os.ReadFile(policyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read env policy: %w", err)
+	}
+
+	var p EnvPolicy
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse env policy: %w", err)
+	}
+
+	for _, patterns := range [][]string{p.AllowNames, p.DenyNames} {
+		for i, pattern := range patterns {
+			patterns[i] = strings.ToUpper(pattern)
+			if _, err := path.Match(patterns[i], ""); err != nil {
+				return nil, fmt.Errorf("invalid name pattern %q: %w", pattern, err)
+			}
+		}
+	}
+
+	for _, pattern := range p.DenyValues {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value pattern %q: %w", pattern, err)
+		}
+		p.denyValues = append(p.denyValues, re)
+	}
+
+	return &p, nil
+}
+
+// Check returns an *Error listing every variable in the generated node
+// configs that the policy rejects. A nil policy allows everything.
+func (p *EnvPolicy) Check(nodes []metadata.NodeConfig) error {
+	if p == nil {
+		return nil
+	}
+
+	counts := make(map[Violation]int)
+	for _, node := range nodes {
+		for key, value := range node.Config {
+			name := strings.ToUpper(key)
+			for _, reason := range p.violations(key, name, value) {
+				counts[Violation{Name: name, Reason: reason}]++
+			}
+		}
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+
+	violations := make([]Violation, 0, len(counts))
+	for v, n := range counts {
+		v.Nodes = n
+		violations = append(violations, v)
+	}
+	sort.Slice(violations, func(i, j int) bool {
+		if violations[i].Name != violations[j].Name {
+			return violations[i].Name < violations[j].Name
+		}
+		return violations[i].Reason < violations[j].Reason
+	})
+
+	return &Error{Violations: violations}
+}
+
+// violations returns why a single config entry is rejected. Values are never
+// included since they may be the very secrets the policy protects.
+func (p *EnvPolicy) violations(key, name string, value interface{}) []string {
+	var reasons []string
+
+	if key != metadata.ScriptArgsKey && key != metadata.EntryCommandKey {
+		if len(p.AllowNames) > 0 && matchName(p.AllowNames, name) == "" {
+			reasons = append(reasons, "is not allowed by allow_names")
+		}
+		if pattern := matchName(p.DenyNames, name); pattern != "" {
+			reasons = append(reasons, fmt.Sprintf("is denied by deny_names pattern %q", pattern))
+		}
+	}
+
+	str := metadata.EnvValue(value)
+	for _, re := range p.denyValues {
+		if re.MatchString(str) {
+			reasons = append(reasons, fmt.Sprintf("has a value matching deny_values pattern %q", re.String()))
+		}
+	}
+
+	return reasons
+}
+
+// matchName returns the first pattern matching name, or "" if none does
+func matchName(patterns []string, name string) string {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return pattern
+		}
+	}
+	return ""
+}
@@ -0,0 +1,133 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AdmissionInput is the document a new deployment is evaluated as
+type AdmissionInput struct {
+	DeploymentID      string                 `json:"deployment_id"`
+	Namespace         string                 `json:"namespace"`
+	APIKeyID          string                 `json:"api_key_id"`
+	CloudProvider     string                 `json:"cloud_provider"`
+	InstanceType      string                 `json:"instance_type"`
+	InstanceConfig    map[string]interface{} `json:"instance_config"`
+	NodeCount         int                    `json:"node_count"`
+	NetworkMode       string                 `json:"network_mode"`
+	RemoteScriptToRun string                 `json:"remote_script_to_run"`
+	Labels            map[string]string      `json:"labels"`
+
+	// EstimatedHourlyCost is the on-demand price of all nodes, nil when the
+	// instance type has no known price
+	EstimatedHourlyCost *float64 `json:"estimated_hourly_cost_usd"`
+}
+
+// Decision is the result document a policy returns. A deployment is rejected
+// when allow is false or deny is non-empty; warn messages are recorded on the
+// deployment without blocking it.
+type Decision struct {
+	Allow *bool    `json:"allow"`
+	Deny  []string `json:"deny"`
+	Warn  []string `json:"warn"`
+}
+
+// AdmissionError is returned when a policy rejects a deployment
+type AdmissionError struct {
+	Reasons []string
+}
+
+func (e *AdmissionError) Error() string {
+	if len(e.Reasons) == 0 {
+		return "deployment rejected by admission policy"
+	}
+	return "deployment rejected by admission policy: " + strings.Join(e.Reasons, "; ")
+}
+
+// OPA evaluates deployments against a rego policy served by an Open Policy
+// Agent through its REST Data API
+type OPA struct {
+	url      string
+	client   *http.Client
+	failOpen bool
+}
+
+// NewOPA creates an admission client for the decision at url, e.g.
+// http://localhost:8181/v1/data/taskfly/admission. With failOpen, deployments
+// are admitted with a warning when OPA cannot be reached instead of being
+// rejected.
+func NewOPA(url string, timeout time.Duration, failOpen bool) *OPA {
+	return &OPA{
+		url:      url,
+		client:   &http.Client{Timeout: timeout},
+		failOpen: failOpen,
+	}
+}
+
+// Admit evaluates input and returns the warnings to record on the deployment,
+// or an *AdmissionError when the policy rejects it
+func (o *OPA) Admit(ctx context.Context, input AdmissionInput) ([]string, error) {
+	if o == nil {
+		return nil, nil
+	}
+
+	decision, err := o.evaluate(ctx, input)
+	if err != nil {
+		if o.failOpen {
+			return []string{fmt.Sprintf("admission policy not evaluated: %v", err)}, nil
+		}
+		return nil, &AdmissionError{Reasons: []string{fmt.Sprintf("policy could not be evaluated: %v", err)}}
+	}
+
+	if len(decision.Deny) > 0 || (decision.Allow != nil && !*decision.Allow) {
+		return nil, &AdmissionError{Reasons: decision.Deny}
+	}
+
+	return decision.Warn, nil
+}
+
+// evaluate queries the policy decision for input
+func (o *OPA) evaluate(ctx context.Context, input AdmissionInput) (*Decision, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal policy input: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create policy request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query OPA: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OPA response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OPA returned %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	var result struct {
+		Result *Decision `json:"result"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse OPA response: %w", err)
+	}
+	if result.Result == nil {
+		return nil, fmt.Errorf("policy decision at %s is undefined", o.url)
+	}
+
+	return result.Result, nil
+}
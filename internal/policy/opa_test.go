@@ -0,0 +1,85 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// opaServer answers decision queries with a rego-like rule evaluated in Go
+func opaServer(t *testing.T, decide func(input AdmissionInput) map[string]interface{}) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Input AdmissionInput `json:"input"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": decide(body.Input)})
+	}))
+}
+
+// TestOPAAdmit tests rejecting, flagging and admitting deployments
+func TestOPAAdmit(t *testing.T) {
+	server := opaServer(t, func(input AdmissionInput) map[string]interface{} {
+		decision := map[string]interface{}{"deny": []string{}, "warn": []string{}}
+		if input.NodeCount > 10 {
+			decision["deny"] = []string{"at most 10 nodes are allowed"}
+		}
+		if input.EstimatedHourlyCost != nil && *input.EstimatedHourlyCost > 0.1 {
+			decision["warn"] = []string{"deployment costs more than $0.10/hour"}
+		}
+		return decision
+	})
+	defer server.Close()
+
+	opa := NewOPA(server.URL, time.Second, false)
+	cost := 0.5
+
+	warnings, err := opa.Admit(context.Background(), AdmissionInput{NodeCount: 2, EstimatedHourlyCost: &cost})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"deployment costs more than $0.10/hour"}, warnings)
+
+	_, err = opa.Admit(context.Background(), AdmissionInput{NodeCount: 20})
+	var admissionErr *AdmissionError
+	require.ErrorAs(t, err, &admissionErr)
+	assert.Equal(t, []string{"at most 10 nodes are allowed"}, admissionErr.Reasons)
+
+	var disabled *OPA
+	warnings, err = disabled.Admit(context.Background(), AdmissionInput{NodeCount: 20})
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+}
+
+// TestOPAAllowFalse tests that allow = false rejects without reasons
+func TestOPAAllowFalse(t *testing.T) {
+	server := opaServer(t, func(AdmissionInput) map[string]interface{} {
+		return map[string]interface{}{"allow": false}
+	})
+	defer server.Close()
+
+	_, err := NewOPA(server.URL, time.Second, false).Admit(context.Background(), AdmissionInput{})
+	assert.EqualError(t, err, "deployment rejected by admission policy")
+}
+
+// TestOPAUnavailable tests fail-closed and fail-open behavior
+func TestOPAUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`)) // undefined decision
+	}))
+	defer server.Close()
+
+	_, err := NewOPA(server.URL, time.Second, false).Admit(context.Background(), AdmissionInput{})
+	var admissionErr *AdmissionError
+	require.ErrorAs(t, err, &admissionErr)
+
+	warnings, err := NewOPA(server.URL, time.Second, true).Admit(context.Background(), AdmissionInput{})
+	require.NoError(t, err)
+	require.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "undefined")
+}
@@ -0,0 +1,160 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// SecretHeader carries the relay secret satellites authenticate with. The
+// central daemon knows each satellite by its secret.
+const SecretHeader = "X-TaskFly-Relay-Secret"
+
+// apiKeyHeader carries the API token relayed requests are made with on the
+// satellite
+const apiKeyHeader = "X-TaskFly-API-Key"
+
+// PollWait is how long the central daemon holds a poll open waiting for a
+// request
+const PollWait = 25 * time.Second
+
+// Client connects a satellite to a central daemon
+type Client struct {
+	centralURL string
+	secret     string
+	localURL   string
+	apiKey     string
+
+	// poll outlasts PollWait, local bounds requests to the satellite's API
+	poll  *http.Client
+	local *http.Client
+}
+
+// NewClient creates a client for the satellite with secret, relaying requests
+// from the central daemon at centralURL to the satellite's API at localURL.
+// The requests are made with apiKey, an API token of the satellite, if it is
+// set.
+func NewClient(centralURL, secret, localURL, apiKey string, timeout time.Duration) *Client {
+	return &Client{
+		centralURL: centralURL,
+		secret:     secret,
+		localURL:   localURL,
+		apiKey:     apiKey,
+		poll:       &http.Client{Timeout: PollWait + 15*time.Second},
+		local:      &http.Client{Timeout: timeout},
+	}
+}
+
+// Poll waits for the next request from the central daemon. It returns nil
+// when the poll ends without one.
+func (c *Client) Poll(ctx context.Context) (*Request, error) {
+	resp, err := c.post(ctx, "/api/v1/relay/poll", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	var req Request
+	if err := json.NewDecoder(resp.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("failed to parse relayed request: %w", err)
+	}
+	return &req, nil
+}
+
+// Respond sends the response to a relayed request back to the central daemon
+func (c *Client) Respond(ctx context.Context, response *Response) error {
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	resp, err := c.post(ctx, "/api/v1/relay/respond", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
+
+// Forward runs a relayed request against the satellite's own API with the
+// satellite's relay API key. Credentials the request carries are dropped:
+// they were issued by the central daemon and mean nothing here. Failures
+// become 502 responses, so the caller at the central daemon sees them.
+func (c *Client) Forward(ctx context.Context, req *Request) *Response {
+	response := &Response{ID: req.ID}
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, c.localURL+req.Path, bytes.NewReader(req.Body))
+	if err != nil {
+		return errorResponse(response, err)
+	}
+	for name, values := range req.Header {
+		for _, value := range values {
+			httpReq.Header.Add(name, value)
+		}
+	}
+	httpReq.Header.Del("Authorization")
+	httpReq.Header.Del(apiKeyHeader)
+	if c.apiKey != "" {
+		httpReq.Header.Set(apiKeyHeader, c.apiKey)
+	}
+
+	resp, err := c.local.Do(httpReq)
+	if err != nil {
+		return errorResponse(response, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errorResponse(response, err)
+	}
+	response.Status = resp.StatusCode
+	response.Header = resp.Header
+	response.Body = body
+	return response
+}
+
+// post sends an authenticated POST for this satellite to the central daemon
+func (c *Client) post(ctx context.Context, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.centralURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(SecretHeader, c.secret)
+	req.Header.Set("Content-Type", "application/json")
+	return c.poll.Do(req)
+}
+
+// responseError describes an unexpected response from the central daemon
+func responseError(resp *http.Response) error {
+	var result struct {
+		Error string `json:"error"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&result) == nil && result.Error != "" {
+		return fmt.Errorf("central daemon returned %s: %s", resp.Status, result.Error)
+	}
+	return fmt.Errorf("central daemon returned %s", resp.Status)
+}
+
+// errorResponse turns a failure to reach the satellite's API into a 502
+func errorResponse(response *Response, err error) *Response {
+	body, _ := json.Marshal(map[string]string{"error": "Satellite API request failed: " + err.Error()})
+	response.Status = http.StatusBadGateway
+	response.Header = http.Header{"Content-Type": []string{"application/json"}}
+	response.Body = body
+	return response
+}
@@ -0,0 +1,238 @@
+// Package relay lets a satellite daemon that can't accept inbound
+// connections serve its API through a central daemon. The satellite long-polls
+// the central daemon for requests, runs them against its own API and posts
+// the responses back.
+package relay
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSatelliteOffline is returned for satellites that aren't polling
+	ErrSatelliteOffline = errors.New("satellite is offline")
+
+	// ErrTimeout is returned when a satellite doesn't answer in time
+	ErrTimeout = errors.New("satellite did not respond in time")
+
+	// ErrUnknownRequest is returned for responses to requests that timed
+	// out or were never sent
+	ErrUnknownRequest = errors.New("unknown relay request")
+)
+
+// Request is an API request relayed to a satellite
+type Request struct {
+	ID     string      `json:"id"`
+	Method string      `json:"method"`
+	Path   string      `json:"path"` // path and query on the satellite
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// Response is a satellite's answer to a Request
+type Response struct {
+	ID     string      `json:"id"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// Satellite describes a satellite registered with a Hub
+type Satellite struct {
+	Name     string    `json:"name"`
+	Address  string    `json:"address"` // where its last poll came from
+	LastSeen time.Time `json:"last_seen"`
+	Online   bool      `json:"online"`
+}
+
+// satellite is the state the hub keeps for one satellite
+type satellite struct {
+	name     string
+	address  string
+	lastSeen time.Time
+	polling  int
+	queue    chan *Request
+}
+
+// Hub holds the satellites polling a central daemon and hands them requests
+type Hub struct {
+	mu         sync.Mutex
+	satellites map[string]*satellite
+	pending    map[string]pendingRequest
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	// offlineAfter is how long a satellite that isn't polling still counts
+	// as online
+	offlineAfter time.Duration
+}
+
+// pendingRequest is a request waiting for its satellite's response
+type pendingRequest struct {
+	satellite string
+	response  chan *Response
+}
+
+// NewHub creates a hub. Satellites count as offline once they haven't
+// polled for offlineAfter.
+func NewHub(offlineAfter time.Duration) *Hub {
+	return &Hub{
+		satellites:   make(map[string]*satellite),
+		pending:      make(map[string]pendingRequest),
+		done:         make(chan struct{}),
+		offlineAfter: offlineAfter,
+	}
+}
+
+// Close ends all open polls, so a shutting down daemon isn't held up by them
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+// get returns a satellite, registering it on first use. h.mu must be held.
+func (h *Hub) get(name string) *satellite {
+	sat, ok := h.satellites[name]
+	if !ok {
+		sat = &satellite{name: name, queue: make(chan *Request, 64)}
+		h.satellites[name] = sat
+	}
+	return sat
+}
+
+// Poll registers a satellite and waits up to wait for a request for it. It
+// returns nil if none arrives or ctx ends first. A request returned by Poll
+// is lost if the satellite never receives it; its caller then times out.
+func (h *Hub) Poll(ctx context.Context, name, address string, wait time.Duration) *Request {
+	h.mu.Lock()
+	sat := h.get(name)
+	sat.address = address
+	sat.lastSeen = time.Now()
+	sat.polling++
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		sat.polling--
+		sat.lastSeen = time.Now()
+		h.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case req := <-sat.queue:
+			// Drop requests whose caller gave up while they were queued,
+			// so the satellite doesn't run them after all
+			h.mu.Lock()
+			_, waiting := h.pending[req.ID]
+			h.mu.Unlock()
+			if waiting {
+				return req
+			}
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-h.done:
+			return nil
+		}
+	}
+}
+
+// Respond delivers a satellite's response to the request waiting for it
+func (h *Hub) Respond(name string, resp *Response) error {
+	h.mu.Lock()
+	pending, ok := h.pending[resp.ID]
+	if ok && pending.satellite == name {
+		delete(h.pending, resp.ID)
+	}
+	h.mu.Unlock()
+
+	if !ok || pending.satellite != name {
+		return ErrUnknownRequest
+	}
+	pending.response <- resp
+	return nil
+}
+
+// Do relays a request to a satellite and waits for its response until ctx
+// ends
+func (h *Hub) Do(ctx context.Context, name string, req *Request) (*Response, error) {
+	id, err := newRequestID()
+	if err != nil {
+		return nil, err
+	}
+	req.ID = id
+
+	h.mu.Lock()
+	sat, ok := h.satellites[name]
+	if !ok || !h.online(sat, time.Now()) {
+		h.mu.Unlock()
+		return nil, ErrSatelliteOffline
+	}
+	pending := pendingRequest{satellite: name, response: make(chan *Response, 1)}
+	h.pending[id] = pending
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.pending, id)
+		h.mu.Unlock()
+	}()
+
+	select {
+	case sat.queue <- req:
+	case <-ctx.Done():
+		return nil, ErrTimeout
+	}
+
+	select {
+	case resp := <-pending.response:
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ErrTimeout
+	}
+}
+
+// Satellites lists the registered satellites by name
+func (h *Hub) Satellites() []Satellite {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	satellites := make([]Satellite, 0, len(h.satellites))
+	for _, sat := range h.satellites {
+		satellites = append(satellites, Satellite{
+			Name:     sat.name,
+			Address:  sat.address,
+			LastSeen: sat.lastSeen,
+			Online:   h.online(sat, now),
+		})
+	}
+	sort.Slice(satellites, func(i, j int) bool { return satellites[i].Name < satellites[j].Name })
+	return satellites
+}
+
+// online reports whether a satellite is polling or polled recently. h.mu must
+// be held.
+func (h *Hub) online(sat *satellite, now time.Time) bool {
+	return sat.polling > 0 || now.Sub(sat.lastSeen) < h.offlineAfter
+}
+
+// newRequestID returns a random ID for a relayed request
+func newRequestID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
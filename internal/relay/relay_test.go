@@ -0,0 +1,140 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve answers relayed requests for a satellite like its poll loop would
+func serve(hub *Hub, name string, handle func(*Request) *Response) {
+	go func() {
+		for {
+			req := hub.Poll(context.Background(), name, "10.0.0.5", time.Second)
+			select {
+			case <-hub.done:
+				return
+			default:
+			}
+			if req == nil {
+				continue
+			}
+			if err := hub.Respond(name, handle(req)); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func TestHubRelaysRequests(t *testing.T) {
+	hub := NewHub(time.Minute)
+	defer hub.Close()
+	serve(hub, "lab", func(req *Request) *Response {
+		return &Response{ID: req.ID, Status: http.StatusOK, Body: []byte(req.Method + " " + req.Path)}
+	})
+
+	// Wait for the satellite's first poll to register it
+	require.Eventually(t, func() bool { return len(hub.Satellites()) == 1 }, time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := hub.Do(ctx, "lab", &Request{Method: http.MethodGet, Path: "/api/v1/deployments"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.Status)
+	assert.Equal(t, "GET /api/v1/deployments", string(resp.Body))
+
+	satellites := hub.Satellites()
+	assert.Equal(t, "lab", satellites[0].Name)
+	assert.Equal(t, "10.0.0.5", satellites[0].Address)
+	assert.True(t, satellites[0].Online)
+}
+
+func TestHubUnknownSatellite(t *testing.T) {
+	hub := NewHub(time.Minute)
+	_, err := hub.Do(context.Background(), "lab", &Request{Method: http.MethodGet, Path: "/api/v1/health"})
+	assert.ErrorIs(t, err, ErrSatelliteOffline)
+}
+
+func TestHubDropsExpiredRequests(t *testing.T) {
+	hub := NewHub(time.Minute)
+	defer hub.Close()
+
+	// Register the satellite without taking requests yet
+	hub.Poll(context.Background(), "lab", "10.0.0.5", time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := hub.Do(ctx, "lab", &Request{Method: http.MethodPost, Path: "/api/v1/deployments"})
+	assert.ErrorIs(t, err, ErrTimeout)
+
+	// The request that timed out in the queue never reaches the satellite
+	assert.Nil(t, hub.Poll(context.Background(), "lab", "10.0.0.5", 50*time.Millisecond))
+}
+
+func TestHubRejectsResponsesFromOtherSatellites(t *testing.T) {
+	hub := NewHub(time.Minute)
+	defer hub.Close()
+	hub.Poll(context.Background(), "lab", "10.0.0.5", time.Millisecond)
+
+	go func() {
+		req := hub.Poll(context.Background(), "lab", "10.0.0.5", time.Second)
+		assert.ErrorIs(t, hub.Respond("other", &Response{ID: req.ID, Status: http.StatusOK}), ErrUnknownRequest)
+		assert.NoError(t, hub.Respond("lab", &Response{ID: req.ID, Status: http.StatusNoContent}))
+	}()
+
+	resp, err := hub.Do(context.Background(), "lab", &Request{Method: http.MethodGet, Path: "/api/v1/health"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.Status)
+}
+
+func TestClientForward(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(r.Method + " " + r.URL.RequestURI() + " " + r.Header.Get("X-TaskFly-Namespace") + " " +
+			r.Header.Get("X-TaskFly-API-Key") + " " + r.Header.Get("Authorization") + " " + string(body)))
+	}))
+	defer local.Close()
+
+	client := NewClient("http://central.invalid", "secret", local.URL, "satellite-key", time.Second)
+	resp := client.Forward(context.Background(), &Request{
+		ID:     "abc",
+		Method: http.MethodPost,
+		Path:   "/api/v1/deployments?dry_run=true",
+		Header: http.Header{"X-Taskfly-Namespace": []string{"research"}},
+		Body:   []byte("payload"),
+	})
+	assert.Equal(t, "abc", resp.ID)
+	assert.Equal(t, http.StatusCreated, resp.Status)
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "POST /api/v1/deployments?dry_run=true research satellite-key  payload", string(resp.Body))
+
+	// Credentials of the central daemon are never replayed on the satellite
+	resp = client.Forward(context.Background(), &Request{
+		ID:     "ghi",
+		Method: http.MethodGet,
+		Path:   "/api/v1/deployments",
+		Header: http.Header{"X-Taskfly-Api-Key": []string{"central-key"}, "Authorization": []string{"Bearer central-key"}},
+	})
+	assert.Equal(t, "GET /api/v1/deployments  satellite-key  ", string(resp.Body))
+	client = NewClient("http://central.invalid", "secret", local.URL, "", time.Second)
+	resp = client.Forward(context.Background(), &Request{
+		ID:     "jkl",
+		Method: http.MethodGet,
+		Path:   "/api/v1/deployments",
+		Header: http.Header{"X-Taskfly-Api-Key": []string{"central-key"}, "Authorization": []string{"Bearer central-key"}},
+	})
+	assert.Equal(t, "GET /api/v1/deployments    ", string(resp.Body))
+
+	// A satellite API that can't be reached answers 502
+	local.Close()
+	resp = client.Forward(context.Background(), &Request{ID: "def", Method: http.MethodGet, Path: "/api/v1/health"})
+	assert.Equal(t, http.StatusBadGateway, resp.Status)
+}
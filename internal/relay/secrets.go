@@ -0,0 +1,78 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v2"
+)
+
+// namePattern limits satellite names to what fits in a URL path segment
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,62}$`)
+
+// Secrets are the satellites allowed to relay through a central daemon, each
+// with its own secret. A satellite is known by the secret it presents, so one
+// satellite can't poll for or answer the requests of another.
+type Secrets struct {
+	byHash map[[sha256.Size]byte]string
+}
+
+// LoadSecrets reads the satellites and their secrets from a YAML file:
+//
+//	satellites:
+//	  - name: lab
+//	    secret: "..."
+func LoadSecrets(path string) (*Secrets, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read relay satellites: %w", err)
+	}
+
+	var file struct {
+		Satellites []struct {
+			Name   string `yaml:"name"`
+			Secret string `yaml:"secret"`
+		} `yaml:"satellites"`
+	}
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse relay satellites: %w", err)
+	}
+	if len(file.Satellites) == 0 {
+		return nil, fmt.Errorf("no satellites defined in %s", path)
+	}
+
+	secrets := &Secrets{byHash: make(map[[sha256.Size]byte]string, len(file.Satellites))}
+	names := make(map[string]bool, len(file.Satellites))
+	for i, sat := range file.Satellites {
+		if !namePattern.MatchString(sat.Name) {
+			return nil, fmt.Errorf("satellites[%d]: name %q must be letters, digits, '.', '_' and '-'", i, sat.Name)
+		}
+		if names[sat.Name] {
+			return nil, fmt.Errorf("satellite %s: name is used twice", sat.Name)
+		}
+		if len(sat.Secret) < 16 {
+			return nil, fmt.Errorf("satellite %s: secret must be at least 16 characters", sat.Name)
+		}
+
+		hash := sha256.Sum256([]byte(sat.Secret))
+		if _, exists := secrets.byHash[hash]; exists {
+			return nil, fmt.Errorf("satellite %s: secret is used twice", sat.Name)
+		}
+		secrets.byHash[hash] = sat.Name
+		names[sat.Name] = true
+	}
+
+	return secrets, nil
+}
+
+// Lookup returns the name of the satellite a secret belongs to. Secrets are
+// compared by hash so lookups don't leak how much of a secret matched.
+func (s *Secrets) Lookup(secret string) (string, bool) {
+	if secret == "" {
+		return "", false
+	}
+	name, ok := s.byHash[sha256.Sum256([]byte(secret))]
+	return name, ok
+}
@@ -0,0 +1,53 @@
+package relay
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSecrets writes a satellites file and returns its path
+func writeSecrets(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "satellites.yml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadSecrets(t *testing.T) {
+	secrets, err := LoadSecrets(writeSecrets(t, `satellites:
+  - name: lab
+    secret: lab-secret-0123456789
+  - name: edge.eu-1
+    secret: edge-secret-0123456789
+`))
+	require.NoError(t, err)
+
+	name, ok := secrets.Lookup("lab-secret-0123456789")
+	assert.True(t, ok)
+	assert.Equal(t, "lab", name)
+	name, ok = secrets.Lookup("edge-secret-0123456789")
+	assert.True(t, ok)
+	assert.Equal(t, "edge.eu-1", name)
+
+	_, ok = secrets.Lookup("lab-secret-012345678")
+	assert.False(t, ok)
+	_, ok = secrets.Lookup("")
+	assert.False(t, ok)
+}
+
+func TestLoadSecretsRejectsInvalid(t *testing.T) {
+	for content, want := range map[string]string{
+		"satellites: []\n": "no satellites defined",
+		"satellites:\n  - name: ../lab\n    secret: lab-secret-0123456789\n":                                                  `name "../lab" must be`,
+		"satellites:\n  - name: lab\n    secret: short\n":                                                                     "secret must be at least 16 characters",
+		"satellites:\n  - name: lab\n    secret: lab-secret-0123456789\n  - name: lab\n    secret: other-secret-0123456789\n": "name is used twice",
+		"satellites:\n  - name: lab\n    secret: lab-secret-0123456789\n  - name: edge\n    secret: lab-secret-0123456789\n":  "secret is used twice",
+		"satellites:\n  - name: lab\n    token: lab-secret-0123456789\n":                                                      "field token not found",
+	} {
+		_, err := LoadSecrets(writeSecrets(t, content))
+		assert.ErrorContains(t, err, want, content)
+	}
+}
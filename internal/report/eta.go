@@ -0,0 +1,246 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+)
+
+const (
+	// maxTimingSamples is how many durations are kept per template
+	maxTimingSamples = 50
+
+	// TimingRetention is how long timings of templates that stopped being
+	// deployed are kept
+	TimingRetention = 90 * 24 * time.Hour
+)
+
+// Sources of a completion estimate
+const (
+	SourceProgress = "progress" // extrapolated from the progress nodes reported
+	SourceHistory  = "history"  // taken from past deployments of the same template
+	SourceMixed    = "mixed"
+)
+
+// Estimate is the predicted completion time of a deployment
+type Estimate struct {
+	CompletesAt      time.Time `json:"completes_at"`
+	RemainingSeconds float64   `json:"remaining_seconds"`
+	Source           string    `json:"source"`
+}
+
+// TemplateTiming holds durations observed on successful deployments of one
+// template, newest last
+type TemplateTiming struct {
+	StartupSeconds  []float64 `json:"startup_seconds"`  // deployment creation to workload start
+	WorkloadSeconds []float64 `json:"workload_seconds"` // workload start to completion
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// Timings records how long nodes of past deployments took per template so
+// the history outlives the deployments, which are cleaned up soon after
+// they finish
+type Timings struct {
+	mu        sync.Mutex
+	templates map[string]*TemplateTiming // key is the deployment's template ID
+	path      string
+}
+
+// NewTimings creates a timing history persisted to path, loading existing samples
+func NewTimings(path string) (*Timings, error) {
+	t := &Timings{
+		templates: make(map[string]*TemplateTiming),
+		path:      path,
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read timings: %w", err)
+	}
+	if err := json.Unmarshal(data, &t.templates); err != nil {
+		return nil, fmt.Errorf("failed to parse timings: %w", err)
+	}
+
+	return t, nil
+}
+
+// Record adds the node durations of a successfully completed deployment to
+// the history of its template and saves it
+func (t *Timings) Record(deployment *state.Deployment, report *state.DeploymentReport) error {
+	if t == nil || deployment.TemplateID == "" || report.Status != state.StatusCompleted {
+		return nil
+	}
+
+	t.mu.Lock()
+	timing, exists := t.templates[deployment.TemplateID]
+	if !exists {
+		timing = &TemplateTiming{}
+		t.templates[deployment.TemplateID] = timing
+	}
+	for _, node := range report.Nodes {
+		if node.Status != state.NodeStatusCompleted || node.StartedAt == nil {
+			continue
+		}
+		timing.StartupSeconds = appendSample(timing.StartupSeconds, node.StartedAt.Sub(deployment.CreatedAt).Seconds())
+		timing.WorkloadSeconds = appendSample(timing.WorkloadSeconds, node.Duration)
+	}
+	timing.UpdatedAt = time.Now()
+	t.mu.Unlock()
+
+	return t.Save()
+}
+
+// Save drops templates not deployed within the retention period and writes
+// the rest to disk
+func (t *Timings) Save() error {
+	t.mu.Lock()
+	cutoff := time.Now().Add(-TimingRetention)
+	for id, timing := range t.templates {
+		if timing.UpdatedAt.Before(cutoff) {
+			delete(t.templates, id)
+		}
+	}
+	data, err := json.MarshalIndent(t.templates, "", "  ")
+	t.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal timings: %w", err)
+	}
+
+	// Write to temp file first, then atomically rename
+	tempFile := t.path + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write temp timings: %w", err)
+	}
+	if err := os.Rename(tempFile, t.path); err != nil {
+		return fmt.Errorf("failed to rename timings: %w", err)
+	}
+
+	return nil
+}
+
+// medians returns the median startup and workload durations of a template
+func (t *Timings) medians(templateID string) (startup, workload time.Duration, ok bool) {
+	if t == nil || templateID == "" {
+		return 0, 0, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	timing, exists := t.templates[templateID]
+	if !exists || len(timing.WorkloadSeconds) == 0 {
+		return 0, 0, false
+	}
+	return seconds(median(timing.StartupSeconds)), seconds(median(timing.WorkloadSeconds)), true
+}
+
+// EstimateCompletion predicts when the last unfinished node of a deployment
+// completes. Nodes that reported progress are extrapolated from their rate so
+// far; the others are assumed to take as long as nodes of earlier deployments
+// of the same template. Without either for every unfinished node there is no
+// estimate and nil is returned, as it is for finished deployments.
+func EstimateCompletion(deployment *state.Deployment, nodes []*state.Node, history *Timings, now time.Time) *Estimate {
+	switch deployment.Status {
+	case state.StatusCompleted, state.StatusFailed, state.StatusTerminating, state.StatusTerminated:
+		return nil
+	}
+
+	startup, workload, haveHistory := history.medians(deployment.TemplateID)
+
+	var completesAt time.Time
+	sources := make(map[string]bool)
+	unfinished := 0
+
+	for _, node := range nodes {
+		switch node.Status {
+		case state.NodeStatusCompleted, state.NodeStatusFailed, state.NodeStatusTerminating, state.NodeStatusTerminated:
+			continue
+		}
+		unfinished++
+
+		var end time.Time
+		switch {
+		case node.Progress != nil && node.Progress.Percent > 0:
+			started := deployment.CreatedAt
+			if node.StartedAt != nil {
+				started = *node.StartedAt
+			}
+			elapsed := now.Sub(started)
+			remaining := time.Duration(float64(elapsed) * (100 - node.Progress.Percent) / node.Progress.Percent)
+			end = now.Add(remaining)
+			sources[SourceProgress] = true
+		case haveHistory:
+			started := deployment.CreatedAt.Add(startup)
+			if node.StartedAt != nil {
+				started = *node.StartedAt
+			} else if started.Before(now) {
+				started = now
+			}
+			end = started.Add(workload)
+			if end.Before(now) {
+				// Running longer than usual; all we know is that it isn't done
+				end = now
+			}
+			sources[SourceHistory] = true
+		default:
+			return nil
+		}
+
+		if end.After(completesAt) {
+			completesAt = end
+		}
+	}
+
+	if unfinished == 0 {
+		return nil
+	}
+
+	source := SourceMixed
+	if len(sources) == 1 {
+		for only := range sources {
+			source = only
+		}
+	}
+
+	return &Estimate{
+		CompletesAt:      completesAt,
+		RemainingSeconds: completesAt.Sub(now).Seconds(),
+		Source:           source,
+	}
+}
+
+// appendSample adds a duration, dropping the oldest beyond maxTimingSamples
+func appendSample(samples []float64, value float64) []float64 {
+	samples = append(samples, value)
+	if len(samples) > maxTimingSamples {
+		samples = samples[len(samples)-maxTimingSamples:]
+	}
+	return samples
+}
+
+// median returns the median of values, or 0 when there are none
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// seconds converts fractional seconds to a duration
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,68 @@
+package report
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateCompletionFromProgress(t *testing.T) {
+	now := time.Now()
+	started := now.Add(-10 * time.Minute)
+	deployment := &state.Deployment{Status: state.StatusRunning, CreatedAt: started}
+	nodes := []*state.Node{
+		{Status: state.NodeStatusRunning, StartedAt: &started, Progress: &state.NodeProgress{Percent: 50}},
+		{Status: state.NodeStatusRunning, StartedAt: &started, Progress: &state.NodeProgress{Percent: 25}},
+		{Status: state.NodeStatusCompleted},
+	}
+
+	estimate := EstimateCompletion(deployment, nodes, nil, now)
+	require.NotNil(t, estimate)
+	assert.Equal(t, SourceProgress, estimate.Source)
+	assert.InDelta(t, (30 * time.Minute).Seconds(), estimate.RemainingSeconds, 1)
+}
+
+func TestEstimateCompletionWithoutData(t *testing.T) {
+	now := time.Now()
+	deployment := &state.Deployment{Status: state.StatusRunning, CreatedAt: now, TemplateID: "abc"}
+	nodes := []*state.Node{{Status: state.NodeStatusRunning}}
+
+	assert.Nil(t, EstimateCompletion(deployment, nodes, nil, now))
+
+	deployment.Status = state.StatusCompleted
+	assert.Nil(t, EstimateCompletion(deployment, nodes, nil, now))
+}
+
+func TestTimingsRecordAndEstimate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timings.json")
+	timings, err := NewTimings(path)
+	require.NoError(t, err)
+
+	created := time.Now().Add(-time.Hour)
+	for _, workload := range []float64{600, 1200, 900} {
+		started := created.Add(2 * time.Minute)
+		deployment := &state.Deployment{TemplateID: "abc", CreatedAt: created}
+		report := &state.DeploymentReport{
+			Status: state.StatusCompleted,
+			Nodes:  []state.NodeReport{{Status: state.NodeStatusCompleted, StartedAt: &started, Duration: workload}},
+		}
+		require.NoError(t, timings.Record(deployment, report))
+	}
+
+	// Reload to check the history was persisted
+	timings, err = NewTimings(path)
+	require.NoError(t, err)
+
+	now := time.Now()
+	deployment := &state.Deployment{Status: state.StatusProvisioning, CreatedAt: now, TemplateID: "abc"}
+	nodes := []*state.Node{{Status: state.NodeStatusProvisioning}}
+
+	estimate := EstimateCompletion(deployment, nodes, timings, now)
+	require.NotNil(t, estimate)
+	assert.Equal(t, SourceHistory, estimate.Source)
+	assert.InDelta(t, (17 * time.Minute).Seconds(), estimate.RemainingSeconds, 1)
+}
@@ -0,0 +1,90 @@
+package report
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/JustinTimperio/TaskFly/internal/cloud"
+	"github.com/JustinTimperio/TaskFly/internal/state"
+)
+
+// Suggested instance types are sized so the observed peaks stay below these
+// utilization targets
+const (
+	targetCPUPercent    = 70
+	targetMemoryPercent = 80
+)
+
+// Recommend compares the peak CPU and memory usage of nodes with the size of
+// the instance type they ran on and suggests the cheapest type in the same
+// family that fits the busiest node. Nodes without metrics or with unknown
+// instance types are ignored.
+func Recommend(provider string, nodes []state.NodeReport) []state.Recommendation {
+	type usage struct {
+		nodes      int
+		peakCPU    float64
+		peakMemory float64
+	}
+	byType := make(map[string]*usage)
+
+	for _, node := range nodes {
+		if node.Peak == nil {
+			continue
+		}
+		spec, ok := cloud.LookupInstance(provider, node.InstanceType)
+		if !ok {
+			continue
+		}
+
+		memoryTotal := float64(node.MemoryTotal)
+		if memoryTotal == 0 {
+			memoryTotal = spec.MemoryGiB * 1024 * 1024 * 1024
+		}
+
+		u, exists := byType[node.InstanceType]
+		if !exists {
+			u = &usage{}
+			byType[node.InstanceType] = u
+		}
+		u.nodes++
+		u.peakCPU = max(u.peakCPU, node.Peak.CPUUsage)
+		u.peakMemory = max(u.peakMemory, math.Min(float64(node.Peak.MemoryUsed)/memoryTotal*100, 100))
+	}
+
+	recommendations := make([]state.Recommendation, 0)
+	for instanceType, u := range byType {
+		spec, _ := cloud.LookupInstance(provider, instanceType)
+		vcpus := float64(spec.VCPUs) * u.peakCPU / targetCPUPercent
+		memoryGiB := spec.MemoryGiB * u.peakMemory / targetMemoryPercent
+
+		suggested, ok := cloud.CheapestInstance(provider, instanceType, vcpus, memoryGiB)
+		if !ok || suggested == instanceType {
+			continue
+		}
+		suggestedSpec, _ := cloud.LookupInstance(provider, suggested)
+		savings := spec.HourlyPrice - suggestedSpec.HourlyPrice
+
+		change := fmt.Sprintf("saves ~$%.4f/hour per node", savings)
+		if savings < 0 {
+			change = fmt.Sprintf("~$%.4f/hour more per node", -savings)
+		}
+
+		recommendations = append(recommendations, state.Recommendation{
+			InstanceType:  instanceType,
+			SuggestedType: suggested,
+			Nodes:         u.nodes,
+			PeakCPU:       u.peakCPU,
+			PeakMemory:    u.peakMemory,
+			HourlySavings: savings,
+			Message: fmt.Sprintf("%d %s node(s) peaked at %.0f%% CPU and %.0f%% memory; consider %s (%s)",
+				u.nodes, instanceType, u.peakCPU, u.peakMemory, suggested, change),
+		})
+	}
+
+	sort.Slice(recommendations, func(i, j int) bool {
+		return recommendations[i].InstanceType < recommendations[j].InstanceType
+	})
+
+	return recommendations
+}
@@ -0,0 +1,116 @@
+package report
+
+import (
+	"testing"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const gib = 1024 * 1024 * 1024
+
+func TestRecommend(t *testing.T) {
+	node := func(instanceType string, memoryTotal uint64, cpu float64, memoryUsed uint64) state.NodeReport {
+		return state.NodeReport{
+			InstanceType: instanceType,
+			MemoryTotal:  memoryTotal,
+			Peak:         &state.PeakMetrics{CPUUsage: cpu, MemoryUsed: memoryUsed},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		provider string
+		nodes    []state.NodeReport
+		want     []state.Recommendation
+		message  []string
+	}{
+		{
+			// The busiest node sets the peaks: 35% of 4 vCPUs at a 70% target
+			// needs 2 vCPUs, 12.5% of 16 GiB at an 80% target needs 2.5 GiB
+			name:     "scales peaks to targets",
+			provider: "aws",
+			nodes: []state.NodeReport{
+				node("t3.xlarge", 16*gib, 35, 1*gib),
+				node("t3.xlarge", 16*gib, 20, 2*gib),
+			},
+			want: []state.Recommendation{{
+				InstanceType: "t3.xlarge", SuggestedType: "t3.medium", Nodes: 2,
+				PeakCPU: 35, PeakMemory: 12.5, HourlySavings: 0.1664 - 0.0416,
+			}},
+			message: []string{"2 t3.xlarge node(s) peaked at 35% CPU and 12% memory; consider t3.medium (saves ~$0.1248/hour per node)"},
+		},
+		{
+			// Without a reported total, 6 GiB is measured against the 16 GiB
+			// of an m5.xlarge
+			name:     "memory falls back to the instance size",
+			provider: "aws",
+			nodes:    []state.NodeReport{node("m5.xlarge", 0, 10, 6*gib)},
+			want: []state.Recommendation{{
+				InstanceType: "m5.xlarge", SuggestedType: "m5.large", Nodes: 1,
+				PeakCPU: 10, PeakMemory: 37.5, HourlySavings: 0.192 - 0.096,
+			}},
+			message: []string{"1 m5.xlarge node(s) peaked at 10% CPU and 38% memory; consider m5.large (saves ~$0.0960/hour per node)"},
+		},
+		{
+			name:     "larger type costs more",
+			provider: "aws",
+			nodes:    []state.NodeReport{node("c5.large", 4*gib, 95, 1*gib)},
+			want: []state.Recommendation{{
+				InstanceType: "c5.large", SuggestedType: "c5.xlarge", Nodes: 1,
+				PeakCPU: 95, PeakMemory: 25, HourlySavings: 0.085 - 0.17,
+			}},
+			message: []string{"1 c5.large node(s) peaked at 95% CPU and 25% memory; consider c5.xlarge (~$0.0850/hour more per node)"},
+		},
+		{
+			// 60% of 2 vCPUs and 50% of 8 GiB still need a t3.large
+			name:     "skips the current type",
+			provider: "aws",
+			nodes:    []state.NodeReport{node("t3.large", 8*gib, 60, 4*gib)},
+		},
+		{
+			name:     "ignores nodes without metrics or known types",
+			provider: "aws",
+			nodes: []state.NodeReport{
+				{InstanceType: "t3.xlarge", MemoryTotal: 16 * gib},
+				node("x9.huge", 16*gib, 5, 1*gib),
+				node("", 16*gib, 5, 1*gib),
+			},
+		},
+		{
+			name:     "unknown provider",
+			provider: "gcp",
+			nodes:    []state.NodeReport{node("t3.xlarge", 16*gib, 5, 1*gib)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Recommend(tt.provider, tt.nodes)
+			require.Len(t, got, len(tt.want))
+			for i, want := range tt.want {
+				assert.Equal(t, want.InstanceType, got[i].InstanceType)
+				assert.Equal(t, want.SuggestedType, got[i].SuggestedType)
+				assert.Equal(t, want.Nodes, got[i].Nodes)
+				assert.InDelta(t, want.PeakCPU, got[i].PeakCPU, 0.001)
+				assert.InDelta(t, want.PeakMemory, got[i].PeakMemory, 0.001)
+				assert.InDelta(t, want.HourlySavings, got[i].HourlySavings, 0.0001)
+				assert.Equal(t, tt.message[i], got[i].Message)
+			}
+		})
+	}
+}
+
+func TestRecommendSortsByInstanceType(t *testing.T) {
+	nodes := []state.NodeReport{
+		{InstanceType: "t3.xlarge", MemoryTotal: 16 * gib, Peak: &state.PeakMetrics{CPUUsage: 10, MemoryUsed: gib}},
+		{InstanceType: "m5.xlarge", MemoryTotal: 16 * gib, Peak: &state.PeakMetrics{CPUUsage: 10, MemoryUsed: gib}},
+		{InstanceType: "c5.large", MemoryTotal: 4 * gib, Peak: &state.PeakMetrics{CPUUsage: 95, MemoryUsed: gib}},
+	}
+
+	got := Recommend("aws", nodes)
+	require.Len(t, got, 3)
+	assert.Equal(t, []string{"c5.large", "m5.xlarge", "t3.xlarge"},
+		[]string{got[0].InstanceType, got[1].InstanceType, got[2].InstanceType})
+}
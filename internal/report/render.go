@@ -0,0 +1,195 @@
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+)
+
+// Supported report formats
+const (
+	FormatJSON     = "json"
+	FormatMarkdown = "markdown"
+	FormatHTML     = "html"
+)
+
+// Markdown renders a report as a Markdown document
+func Markdown(r *state.DeploymentReport) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# Deployment Report: %s\n\n", r.DeploymentID)
+	fmt.Fprintf(&b, "| | |\n|---|---|\n")
+	fmt.Fprintf(&b, "| Status | %s |\n", r.Status)
+	fmt.Fprintf(&b, "| Cloud Provider | %s |\n", r.CloudProvider)
+	fmt.Fprintf(&b, "| Nodes | %d total, %d completed, %d failed |\n", r.TotalNodes, r.NodesCompleted, r.NodesFailed)
+	fmt.Fprintf(&b, "| Created | %s |\n", formatTime(&r.CreatedAt))
+	fmt.Fprintf(&b, "| Completed | %s |\n", formatTime(r.CompletedAt))
+	fmt.Fprintf(&b, "| Duration | %s |\n", formatSeconds(r.Duration))
+	fmt.Fprintf(&b, "| Estimated Cost | %s |\n", formatCost(r.EstimatedCost))
+	fmt.Fprintf(&b, "| Logs | [all nodes](%s) |\n\n", r.LogsURL)
+
+	fmt.Fprintf(&b, "## Nodes\n\n")
+	fmt.Fprintf(&b, "| Node | Status | Exit Code | Duration | Peak CPU | Peak Memory | Peak Load | Instance | Est. Cost | Logs |\n")
+	fmt.Fprintf(&b, "|---|---|---|---|---|---|---|---|---|---|\n")
+	for _, n := range r.Nodes {
+		cpu, mem, load := formatPeak(n)
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %s | %s | %s | %s | [logs](%s) |\n",
+			n.NodeID, n.Status, formatExitCode(n.ExitCode), formatSeconds(n.Duration),
+			cpu, mem, load, formatInstance(n), formatCost(n.EstimatedCost), n.LogsURL)
+	}
+
+	var failures []state.NodeReport
+	for _, n := range r.Nodes {
+		if n.Status == state.NodeStatusFailed && n.ErrorMessage != "" {
+			failures = append(failures, n)
+		}
+	}
+	if len(failures) > 0 {
+		fmt.Fprintf(&b, "\n## Failures\n\n")
+		for _, n := range failures {
+			fmt.Fprintf(&b, "- **%s**: %s\n", n.NodeID, n.ErrorMessage)
+		}
+	}
+
+	if len(r.Recommendations) > 0 {
+		fmt.Fprintf(&b, "\n## Right-Sizing\n\n")
+		for _, rec := range r.Recommendations {
+			fmt.Fprintf(&b, "- %s\n", rec.Message)
+		}
+	}
+
+	fmt.Fprintf(&b, "\n_Generated %s. Costs are on-demand estimates from provisioning to node completion._\n", formatTime(&r.GeneratedAt))
+	return b.String()
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"time":     formatTime,
+	"seconds":  formatSeconds,
+	"cost":     formatCost,
+	"exitCode": formatExitCode,
+	"instance": formatInstance,
+	"peakCPU": func(n state.NodeReport) string {
+		cpu, _, _ := formatPeak(n)
+		return cpu
+	},
+	"peakMemory": func(n state.NodeReport) string {
+		_, mem, _ := formatPeak(n)
+		return mem
+	},
+	"peakLoad": func(n state.NodeReport) string {
+		_, _, load := formatPeak(n)
+		return load
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Deployment Report: {{.DeploymentID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: left; }
+th { background: #f0f0f0; }
+.failed { color: #c00; }
+.completed { color: #080; }
+</style>
+</head>
+<body>
+<h1>Deployment Report: {{.DeploymentID}}</h1>
+<table>
+<tr><th>Status</th><td class="{{.Status}}">{{.Status}}</td></tr>
+<tr><th>Cloud Provider</th><td>{{.CloudProvider}}</td></tr>
+<tr><th>Nodes</th><td>{{.TotalNodes}} total, {{.NodesCompleted}} completed, {{.NodesFailed}} failed</td></tr>
+<tr><th>Created</th><td>{{time .CreatedAt}}</td></tr>
+<tr><th>Completed</th><td>{{time .CompletedAt}}</td></tr>
+<tr><th>Duration</th><td>{{seconds .Duration}}</td></tr>
+<tr><th>Estimated Cost</th><td>{{cost .EstimatedCost}}</td></tr>
+<tr><th>Logs</th><td><a href="{{.LogsURL}}">all nodes</a></td></tr>
+</table>
+<h2>Nodes</h2>
+<table>
+<tr><th>Node</th><th>Status</th><th>Exit Code</th><th>Duration</th><th>Peak CPU</th><th>Peak Memory</th><th>Peak Load</th><th>Instance</th><th>Est. Cost</th><th>Error</th><th>Logs</th></tr>
+{{range .Nodes}}<tr><td>{{.NodeID}}</td><td class="{{.Status}}">{{.Status}}</td><td>{{exitCode .ExitCode}}</td><td>{{seconds .Duration}}</td><td>{{peakCPU .}}</td><td>{{peakMemory .}}</td><td>{{peakLoad .}}</td><td>{{instance .}}</td><td>{{cost .EstimatedCost}}</td><td>{{.ErrorMessage}}</td><td><a href="{{.LogsURL}}">logs</a></td></tr>
+{{end}}</table>
+{{if .Recommendations}}<h2>Right-Sizing</h2>
+<ul>
+{{range .Recommendations}}<li>{{.Message}}</li>
+{{end}}</ul>
+{{end}}<p><em>Generated {{time .GeneratedAt}}. Costs are on-demand estimates from provisioning to node completion.</em></p>
+</body>
+</html>
+`))
+
+// HTML renders a report as a standalone HTML page
+func HTML(r *state.DeploymentReport) (string, error) {
+	var buf bytes.Buffer
+	if err := htmlTemplate.Execute(&buf, r); err != nil {
+		return "", fmt.Errorf("failed to render report: %w", err)
+	}
+	return buf.String(), nil
+}
+
+func formatTime(t interface{}) string {
+	var value *time.Time
+	switch v := t.(type) {
+	case time.Time:
+		value = &v
+	case *time.Time:
+		value = v
+	}
+	if value == nil || value.IsZero() {
+		return "-"
+	}
+	return value.Format(time.RFC3339)
+}
+
+func formatSeconds(seconds float64) string {
+	if seconds <= 0 {
+		return "-"
+	}
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+}
+
+func formatCost(cost *float64) string {
+	if cost == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("$%.4f", *cost)
+}
+
+func formatExitCode(code *int) string {
+	if code == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d", *code)
+}
+
+func formatInstance(n state.NodeReport) string {
+	parts := []string{}
+	for _, part := range []string{n.InstanceType, n.InstanceID} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+	return strings.Join(parts, " ")
+}
+
+func formatPeak(n state.NodeReport) (string, string, string) {
+	if n.Peak == nil {
+		return "-", "-", "-"
+	}
+
+	mem := fmt.Sprintf("%.2f GB", float64(n.Peak.MemoryUsed)/1024/1024/1024)
+	if n.MemoryTotal > 0 {
+		mem += fmt.Sprintf(" (%.0f%%)", float64(n.Peak.MemoryUsed)/float64(n.MemoryTotal)*100)
+	}
+
+	return fmt.Sprintf("%.1f%%", n.Peak.CPUUsage), mem, fmt.Sprintf("%.2f", n.Peak.LoadAvg1)
+}
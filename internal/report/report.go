@@ -0,0 +1,129 @@
+// Package report builds and renders deployment completion summaries
+package report
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/cloud"
+	"github.com/JustinTimperio/TaskFly/internal/state"
+)
+
+// Build summarizes a deployment and its nodes as of now. Log links point at
+// the daemon's log endpoint under daemonURL.
+func Build(deployment *state.Deployment, nodes []*state.Node, daemonURL string, now time.Time) *state.DeploymentReport {
+	logsURL := fmt.Sprintf("%s/api/v1/deployments/%s/logs", daemonURL, url.PathEscape(deployment.ID))
+
+	end := now
+	if deployment.CompletedAt != nil {
+		end = *deployment.CompletedAt
+	}
+
+	report := &state.DeploymentReport{
+		DeploymentID:   deployment.ID,
+		Status:         deployment.Status,
+		CloudProvider:  deployment.CloudProvider,
+		TotalNodes:     deployment.TotalNodes,
+		NodesCompleted: deployment.NodesCompleted,
+		NodesFailed:    deployment.NodesFailed,
+		CreatedAt:      deployment.CreatedAt,
+		CompletedAt:    deployment.CompletedAt,
+		Duration:       end.Sub(deployment.CreatedAt).Seconds(),
+		LogsURL:        logsURL,
+		GeneratedAt:    now,
+		Nodes:          make([]state.NodeReport, 0, len(nodes)),
+	}
+
+	var totalCost float64
+	costKnown := len(nodes) > 0
+
+	for _, node := range nodes {
+		nodeReport := state.NodeReport{
+			NodeID:       node.NodeID,
+			Status:       node.Status,
+			InstanceID:   node.InstanceID,
+			InstanceType: InstanceType(deployment, node),
+			IPAddress:    node.IPAddress,
+			StartedAt:    node.StartedAt,
+			FinishedAt:   node.FinishedAt,
+			ExitCode:     node.ExitCode,
+			ErrorMessage: node.ErrorMessage,
+			Peak:         node.PeakMetrics,
+			LogsURL:      logsURL + "?node=" + url.QueryEscape(node.NodeID),
+		}
+		if node.SystemInfo != nil {
+			nodeReport.MemoryTotal = node.SystemInfo.MemoryTotal
+		}
+
+		// Workload duration runs from the start of the workload to the terminal status
+		nodeEnd := now
+		if node.FinishedAt != nil {
+			nodeEnd = *node.FinishedAt
+		}
+		if node.StartedAt != nil {
+			nodeReport.Duration = nodeEnd.Sub(*node.StartedAt).Seconds()
+		}
+
+		// Instances are billed from provisioning, which starts with the deployment
+		if price, ok := cloud.HourlyPrice(deployment.CloudProvider, nodeReport.InstanceType); ok {
+			cost := nodeEnd.Sub(deployment.CreatedAt).Hours() * price
+			nodeReport.EstimatedCost = &cost
+			totalCost += cost
+		} else {
+			costKnown = false
+		}
+
+		report.Nodes = append(report.Nodes, nodeReport)
+	}
+
+	if costKnown {
+		report.EstimatedCost = &totalCost
+	}
+	report.Recommendations = Recommend(deployment.CloudProvider, report.Nodes)
+
+	return report
+}
+
+// InstanceType returns the instance type a node runs on, preferring what the
+// agent reported from cloud metadata over the deployment's instance_config
+func InstanceType(deployment *state.Deployment, node *state.Node) string {
+	if node.SystemInfo != nil && node.SystemInfo.Cloud != nil && node.SystemInfo.Cloud.InstanceType != "" {
+		return node.SystemInfo.Cloud.InstanceType
+	}
+	return configuredInstanceType(deployment)
+}
+
+// Labels returns the labels of a deployment's taskfly.yml, which are a
+// string map in memory and a generic one when loaded from disk
+func Labels(deployment *state.Deployment) map[string]string {
+	switch labels := deployment.Config["labels"].(type) {
+	case map[string]string:
+		return labels
+	case map[string]interface{}:
+		converted := make(map[string]string, len(labels))
+		for key, value := range labels {
+			if text, ok := value.(string); ok {
+				converted[key] = text
+			}
+		}
+		return converted
+	}
+	return nil
+}
+
+// configuredInstanceType reads the instance type from the deployment's
+// instance_config, which is a nested map in memory and a generic one when
+// loaded from disk
+func configuredInstanceType(deployment *state.Deployment) string {
+	var providerConfig map[string]interface{}
+	switch config := deployment.Config["instance_config"].(type) {
+	case map[string]map[string]interface{}:
+		providerConfig = config[deployment.CloudProvider]
+	case map[string]interface{}:
+		providerConfig, _ = config[deployment.CloudProvider].(map[string]interface{})
+	}
+
+	instanceType, _ := providerConfig["instance_type"].(string)
+	return instanceType
+}
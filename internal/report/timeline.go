@@ -0,0 +1,63 @@
+package report
+
+import (
+	"sort"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+)
+
+// EventCreated is the status of the first event of every timeline
+const EventCreated = "created"
+
+// Event is one entry of a deployment's timeline. Events without a node ID
+// belong to the deployment itself.
+type Event struct {
+	Time    time.Time `json:"time"`
+	NodeID  string    `json:"node_id,omitempty"`
+	Status  string    `json:"status"`
+	Message string    `json:"message,omitempty"`
+
+	// PreviousStatus is the phase the node (or deployment) left, and
+	// PreviousSeconds how long it spent there
+	PreviousStatus  string  `json:"previous_status,omitempty"`
+	PreviousSeconds float64 `json:"previous_seconds,omitempty"`
+}
+
+// Timeline merges the creation and completion of a deployment with the phase
+// history of its nodes into one chronological list
+func Timeline(deployment *state.Deployment, nodes []*state.Node) []Event {
+	events := []Event{{Time: deployment.CreatedAt, Status: EventCreated}}
+
+	for _, node := range nodes {
+		for i, phase := range node.Phases {
+			event := Event{
+				Time:    phase.At,
+				NodeID:  node.NodeID,
+				Status:  string(phase.Status),
+				Message: phase.Message,
+			}
+			if i > 0 {
+				previous := node.Phases[i-1]
+				event.PreviousStatus = string(previous.Status)
+				event.PreviousSeconds = phase.At.Sub(previous.At).Seconds()
+			}
+			events = append(events, event)
+		}
+	}
+
+	if deployment.CompletedAt != nil {
+		events = append(events, Event{
+			Time:            *deployment.CompletedAt,
+			Status:          string(deployment.Status),
+			Message:         deployment.ErrorMessage,
+			PreviousStatus:  EventCreated,
+			PreviousSeconds: deployment.CompletedAt.Sub(deployment.CreatedAt).Seconds(),
+		})
+	}
+
+	// Stable keeps the creation first and each node's phases in order when
+	// timestamps tie
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events
+}
@@ -0,0 +1,54 @@
+package report
+
+import (
+	"testing"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeline(t *testing.T) {
+	created := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return created.Add(time.Duration(minutes) * time.Minute) }
+	completed := at(30)
+
+	deployment := &state.Deployment{ID: "dep", Status: state.StatusCompleted, CreatedAt: created, CompletedAt: &completed}
+	nodes := []*state.Node{
+		{NodeID: "a", Phases: []state.PhaseChange{
+			{Status: state.NodeStatusPending, At: created},
+			{Status: state.NodeStatusRunning, At: at(5), Message: "Executing deployment script"},
+			{Status: state.NodeStatusCompleted, At: at(30)},
+		}},
+		{NodeID: "b", Phases: []state.PhaseChange{
+			{Status: state.NodeStatusPending, At: created},
+			{Status: state.NodeStatusRunning, At: at(2)},
+		}},
+	}
+
+	events := Timeline(deployment, nodes)
+	require.Len(t, events, 7)
+
+	assert.Equal(t, EventCreated, events[0].Status)
+	assert.Empty(t, events[0].NodeID)
+
+	var statuses []string
+	for _, event := range events {
+		statuses = append(statuses, event.NodeID+":"+event.Status)
+	}
+	assert.Equal(t, []string{":created", "a:pending", "b:pending", "b:running", "a:running", "a:completed", ":completed"}, statuses)
+
+	assert.Equal(t, string(state.NodeStatusPending), events[4].PreviousStatus)
+	assert.Equal(t, (5 * time.Minute).Seconds(), events[4].PreviousSeconds)
+	assert.Equal(t, "Executing deployment script", events[4].Message)
+	assert.Equal(t, (30 * time.Minute).Seconds(), events[6].PreviousSeconds)
+}
+
+func TestTimelineWithoutPhases(t *testing.T) {
+	deployment := &state.Deployment{ID: "dep", Status: state.StatusRunning, CreatedAt: time.Now()}
+
+	events := Timeline(deployment, []*state.Node{{NodeID: "a"}})
+	require.Len(t, events, 1)
+	assert.Equal(t, EventCreated, events[0].Status)
+}
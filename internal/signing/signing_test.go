@@ -0,0 +1,76 @@
+package signing
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signedRequest(t *testing.T, secret, body string, at time.Time) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, "http://daemon:8080/api/v1/nodes/heartbeat", strings.NewReader(body))
+	require.NoError(t, err)
+	SignRequest(req, secret, []byte(body), at)
+	return req
+}
+
+func TestVerify(t *testing.T) {
+	secret, err := NewSecret()
+	require.NoError(t, err)
+	now := time.Now()
+	body := `{"metrics":{"cpu_cores":4}}`
+
+	v := NewVerifier()
+	req := signedRequest(t, secret, body, now)
+	assert.NoError(t, v.Verify(req, secret, []byte(body), now))
+
+	// The same request again is a replay
+	assert.ErrorIs(t, v.Verify(req, secret, []byte(body), now), ErrReplayed)
+
+	// A tampered body, another secret or another path don't match
+	req = signedRequest(t, secret, body, now.Add(time.Millisecond))
+	assert.ErrorIs(t, v.Verify(req, secret, []byte(`{"metrics":{"cpu_cores":8}}`), now), ErrBadSignature)
+	assert.ErrorIs(t, v.Verify(req, "other-secret", []byte(body), now), ErrBadSignature)
+	req.URL.Path = "/api/v1/nodes/status"
+	assert.ErrorIs(t, v.Verify(req, secret, []byte(body), now), ErrBadSignature)
+}
+
+func TestVerifyRejectsStaleAndUnsigned(t *testing.T) {
+	secret, err := NewSecret()
+	require.NoError(t, err)
+	now := time.Now()
+	v := NewVerifier()
+
+	req := signedRequest(t, secret, "", now.Add(-MaxSkew-time.Second))
+	assert.ErrorIs(t, v.Verify(req, secret, nil, now), ErrExpired)
+
+	req = signedRequest(t, secret, "", now.Add(MaxSkew+time.Second))
+	assert.ErrorIs(t, v.Verify(req, secret, nil, now), ErrExpired)
+
+	req, err = http.NewRequest(http.MethodGet, "http://daemon:8080/api/v1/nodes/assets", nil)
+	require.NoError(t, err)
+	assert.ErrorIs(t, v.Verify(req, secret, nil, now), ErrUnsigned)
+}
+
+func TestVerifyDigest(t *testing.T) {
+	secret, err := NewSecret()
+	require.NoError(t, err)
+	now := time.Now()
+	body := []byte("large artifact streamed from disk")
+	bodyHash := sha256.Sum256(body)
+	v := NewVerifier()
+
+	// Signatures from the digest match those from the body either way
+	req := signedRequest(t, secret, string(body), now)
+	assert.NoError(t, v.VerifyDigest(req, secret, bodyHash[:], now))
+
+	req, err = http.NewRequest(http.MethodPut, "http://daemon:8080/api/v1/nodes/artifacts/app.bin", nil)
+	require.NoError(t, err)
+	SignRequestDigest(req, secret, bodyHash[:], now)
+	assert.NoError(t, v.Verify(req, secret, body, now))
+}
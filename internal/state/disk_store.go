@@ -5,31 +5,66 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
 
-// DiskStore implements persistent state storage using JSON files
+// DiskStore implements persistent state storage using JSON files. Each
+// deployment is stored with its nodes in deployments/<id>.json, so an update
+// rewrites only the file of its deployment. Changes that must survive a crash
+// (creation, statuses, credentials, instance IDs, shutdown marks) are written
+// before the update returns. Frequent ones like heartbeats mark the
+// deployment dirty and are written by a background flush every flushInterval.
 type DiskStore struct {
 	mu          sync.RWMutex
 	deployments map[string]*Deployment
 	nodes       map[string]*Node
 	nodesByDep  map[string][]*Node
-	logs        map[string][]LogEntry // In-memory only, not persisted
-	maxLogsPerDeployment int
+	logs        *logBuffer // In-memory only, not persisted
+	metricsHistory map[string][]MetricsSample // In-memory only, not persisted
+	maxMetricsPerDep     int
 	dataDir     string
+	hooks       transitionHooks
+
+	dirty    map[string]bool // deployments with changes not written yet
+	version  uint64          // incremented with every snapshot
+	skipped  []string        // unreadable files set aside by load
+
+	writeMu sync.Mutex        // serializes file writes
+	written map[string]uint64 // version of the last write per deployment
+
+	stop    chan struct{}
+	stopped chan struct{}
 }
 
-// persisted state structure for JSON serialization
-type persistedState struct {
+// deploymentFile is the content of deployments/<id>.json
+type deploymentFile struct {
+	Deployment *Deployment `json:"deployment"`
+	Nodes      []*Node     `json:"nodes"`
+}
+
+// deploymentSnapshot is a deployment file ready to be written, or removed if
+// data is nil
+type deploymentSnapshot struct {
+	id      string
+	version uint64
+	data    []byte
+}
+
+// legacyState is the single state.json written by older daemons
+type legacyState struct {
 	Deployments map[string]*Deployment `json:"deployments"`
 	Nodes       map[string]*Node       `json:"nodes"`
 }
 
+// flushInterval is how often dirty deployments are written to disk
+const flushInterval = time.Second
+
 // NewDiskStore creates a new disk-backed state store
 func NewDiskStore(dataDir string) (*DiskStore, error) {
 	// Create data directory if it doesn't exist
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
+	if err := os.MkdirAll(filepath.Join(dataDir, "deployments"), 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
@@ -37,86 +72,270 @@ func NewDiskStore(dataDir string) (*DiskStore, error) {
 		deployments: make(map[string]*Deployment),
 		nodes:       make(map[string]*Node),
 		nodesByDep:  make(map[string][]*Node),
-		logs:        make(map[string][]LogEntry),
-		maxLogsPerDeployment: 10000,
+		logs:        newLogBuffer(10000),
+		metricsHistory: make(map[string][]MetricsSample),
+		maxMetricsPerDep:     20000,
 		dataDir:     dataDir,
+		dirty:       make(map[string]bool),
+		written:     make(map[string]uint64),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
 	}
 
 	// Load existing state from disk
 	if err := store.load(); err != nil {
 		return nil, fmt.Errorf("failed to load state: %w", err)
 	}
+	if err := store.migrateLegacyState(); err != nil {
+		return nil, fmt.Errorf("failed to migrate state.json: %w", err)
+	}
 
+	go store.flushLoop()
 	return store, nil
 }
 
-// load reads state from disk
+// deploymentPath returns the file a deployment is stored in
+func (s *DiskStore) deploymentPath(deploymentID string) string {
+	return filepath.Join(s.dataDir, "deployments", deploymentID+".json")
+}
+
+// load reads the deployment files. Temp files left by a crash during a write
+// are removed, since the file they were replacing is still intact. Files that
+// can't be parsed are renamed to <name>.corrupt and reported by SkippedFiles.
 func (s *DiskStore) load() error {
-	stateFile := filepath.Join(s.dataDir, "state.json")
+	dir := filepath.Join(s.dataDir, "deployments")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read state directory: %w", err)
+	}
 
-	// Check if state file exists
-	if _, err := os.Stat(stateFile); os.IsNotExist(err) {
-		// No state file yet, start fresh
-		return nil
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(path)
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		var file deploymentFile
+		if err := json.Unmarshal(data, &file); err != nil || file.Deployment == nil {
+			if err := os.Rename(path, path+".corrupt"); err != nil {
+				return fmt.Errorf("failed to set aside unreadable %s: %w", name, err)
+			}
+			s.skipped = append(s.skipped, name)
+			continue
+		}
+
+		s.deployments[file.Deployment.ID] = file.Deployment
+		s.nodesByDep[file.Deployment.ID] = make([]*Node, 0, len(file.Nodes))
+		for _, node := range file.Nodes {
+			s.nodes[node.NodeID] = node
+			s.nodesByDep[node.DeploymentID] = append(s.nodesByDep[node.DeploymentID], node)
+		}
 	}
 
+	return nil
+}
+
+// migrateLegacyState moves the deployments of a state.json written by an
+// older daemon into deployment files and renames it to state.json.migrated.
+// Deployments that already have a file are kept as they are.
+func (s *DiskStore) migrateLegacyState() error {
+	stateFile := filepath.Join(s.dataDir, "state.json")
 	data, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to read state file: %w", err)
+		return err
 	}
 
-	var state persistedState
-	if err := json.Unmarshal(data, &state); err != nil {
-		return fmt.Errorf("failed to unmarshal state: %w", err)
+	var legacy legacyState
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
 	}
 
-	// Restore deployments
-	s.deployments = state.Deployments
-	if s.deployments == nil {
-		s.deployments = make(map[string]*Deployment)
+	for id, deployment := range legacy.Deployments {
+		if _, exists := s.deployments[id]; exists {
+			continue
+		}
+		s.deployments[id] = deployment
+		s.nodesByDep[id] = make([]*Node, 0)
+	}
+	for _, node := range legacy.Nodes {
+		if _, exists := s.nodes[node.NodeID]; exists || legacy.Deployments[node.DeploymentID] == nil {
+			continue
+		}
+		s.nodes[node.NodeID] = node
+		s.nodesByDep[node.DeploymentID] = append(s.nodesByDep[node.DeploymentID], node)
+	}
+	for id := range legacy.Deployments {
+		if err := s.persist(id); err != nil {
+			return err
+		}
 	}
 
-	// Restore nodes
-	s.nodes = state.Nodes
-	if s.nodes == nil {
-		s.nodes = make(map[string]*Node)
+	return os.Rename(stateFile, stateFile+".migrated")
+}
+
+// SkippedFiles returns the deployment files that couldn't be read at startup
+// and were renamed to <name>.corrupt
+func (s *DiskStore) SkippedFiles() []string {
+	return s.skipped
+}
+
+// markDirty schedules a deployment for the next background flush (must be
+// called with lock held)
+func (s *DiskStore) markDirty(deploymentID string) {
+	s.dirty[deploymentID] = true
+}
+
+// persist writes a deployment, or removes its file if it was deleted, before
+// returning (must be called with lock held)
+func (s *DiskStore) persist(deploymentID string) error {
+	delete(s.dirty, deploymentID)
+	snapshot, err := s.snapshot(deploymentID)
+	if err != nil {
+		return err
 	}
+	return s.write(snapshot)
+}
 
-	// Rebuild nodesByDep index
-	s.nodesByDep = make(map[string][]*Node)
-	for _, node := range s.nodes {
-		s.nodesByDep[node.DeploymentID] = append(s.nodesByDep[node.DeploymentID], node)
+// snapshot serializes a deployment and its nodes (must be called with lock
+// held)
+func (s *DiskStore) snapshot(deploymentID string) (deploymentSnapshot, error) {
+	s.version++
+	snapshot := deploymentSnapshot{id: deploymentID, version: s.version}
+
+	deployment, exists := s.deployments[deploymentID]
+	if !exists {
+		return snapshot, nil
+	}
+	data, err := json.MarshalIndent(deploymentFile{Deployment: deployment, Nodes: s.nodesByDep[deploymentID]}, "", "  ")
+	if err != nil {
+		return snapshot, fmt.Errorf("failed to marshal deployment %s: %w", deploymentID, err)
+	}
+	snapshot.data = data
+	return snapshot, nil
+}
+
+// write stores a snapshot. Snapshots older than the last one written for
+// the deployment are dropped, so a slow background flush can't overwrite a
+// newer write.
+func (s *DiskStore) write(snapshot deploymentSnapshot) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if snapshot.version <= s.written[snapshot.id] {
+		return nil
+	}
+
+	path := s.deploymentPath(snapshot.id)
+	if snapshot.data == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove state of deployment %s: %w", snapshot.id, err)
+		}
+	} else if err := writeFileAtomic(path, snapshot.data); err != nil {
+		return fmt.Errorf("failed to write state of deployment %s: %w", snapshot.id, err)
 	}
 
+	s.written[snapshot.id] = snapshot.version
 	return nil
 }
 
-// save writes current state to disk
-func (s *DiskStore) save() error {
-	state := persistedState{
-		Deployments: s.deployments,
-		Nodes:       s.nodes,
+// writeFileAtomic writes data to a temp file, syncs it and renames it over
+// path, so a crash leaves either the old or the new content
+func writeFileAtomic(path string, data []byte) error {
+	tempFile := path + ".tmp"
+	file, err := os.OpenFile(tempFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile, path); err != nil {
+		return err
 	}
 
-	data, err := json.MarshalIndent(state, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal state: %w", err)
+	// Make the rename itself durable
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
 	}
+	return nil
+}
 
-	stateFile := filepath.Join(s.dataDir, "state.json")
-	tempFile := stateFile + ".tmp"
+// Flush writes all dirty deployments. Serializing happens under the lock,
+// writing the files doesn't block other updates. Deployments that fail to
+// write stay dirty for the next flush.
+func (s *DiskStore) Flush() error {
+	s.mu.Lock()
+	snapshots := make([]deploymentSnapshot, 0, len(s.dirty))
+	var firstErr error
+	for id := range s.dirty {
+		snapshot, err := s.snapshot(id)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+		delete(s.dirty, id)
+	}
+	s.mu.Unlock()
 
-	// Write to temp file first
-	if err := os.WriteFile(tempFile, data, 0644); err != nil {
-		return fmt.Errorf("failed to write temp state file: %w", err)
+	for _, snapshot := range snapshots {
+		if err := s.write(snapshot); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			s.mu.Lock()
+			s.dirty[snapshot.id] = true
+			s.mu.Unlock()
+		}
 	}
+	return firstErr
+}
 
-	// Atomic rename
-	if err := os.Rename(tempFile, stateFile); err != nil {
-		return fmt.Errorf("failed to rename state file: %w", err)
+// flushLoop flushes dirty deployments every flushInterval until Close
+func (s *DiskStore) flushLoop() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Failed deployments stay dirty and are retried
+			s.Flush()
+		case <-s.stop:
+			return
+		}
 	}
+}
 
-	return nil
+// Close stops the background flush and writes the remaining changes
+func (s *DiskStore) Close() error {
+	close(s.stop)
+	<-s.stopped
+	return s.Flush()
 }
 
 // CreateDeployment creates a new deployment record and persists to disk
@@ -133,14 +352,20 @@ func (s *DiskStore) CreateDeployment(deployment *Deployment) error {
 	s.deployments[deployment.ID] = deployment
 	s.nodesByDep[deployment.ID] = make([]*Node, 0)
 
-	return s.save()
+	return s.persist(deployment.ID)
 }
 
-// FindNodeByAuthToken finds a node and its deployment by auth token
+// FindNodeByAuthToken finds a node and its deployment by auth token. Expired
+// tokens are rejected.
 func (s *DiskStore) FindNodeByAuthToken(authToken string) (*Node, *Deployment, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	// Unregistered and revoked nodes have no token
+	if authToken == "" {
+		return nil, nil, fmt.Errorf("node with auth token not found")
+	}
+
 	for _, dep := range s.deployments {
 		nodesInDep, ok := s.nodesByDep[dep.ID]
 		if !ok {
@@ -148,6 +373,9 @@ func (s *DiskStore) FindNodeByAuthToken(authToken string) (*Node, *Deployment, e
 		}
 		for _, node := range nodesInDep {
 			if node.AuthToken == authToken {
+				if node.AuthExpiresAt != nil && time.Now().After(*node.AuthExpiresAt) {
+					return nil, nil, fmt.Errorf("auth token of node %s expired", node.NodeID)
+				}
 				// Return copies to be safe
 				nodeCopy := *node
 				depCopy := *dep
@@ -187,6 +415,11 @@ func (s *DiskStore) GetAllDeployments() []*Deployment {
 	return deployments
 }
 
+// OnTransition registers a hook called after each status change
+func (s *DiskStore) OnTransition(hook TransitionHook) {
+	s.hooks.add(hook)
+}
+
 // UpdateDeploymentStatus updates the status of a deployment and persists to disk
 func (s *DiskStore) UpdateDeploymentStatus(deploymentID string, status DeploymentStatus, errorMessage ...string) error {
 	s.mu.Lock()
@@ -197,11 +430,17 @@ func (s *DiskStore) UpdateDeploymentStatus(deploymentID string, status Deploymen
 		return fmt.Errorf("deployment %s not found", deploymentID)
 	}
 
-	deployment.Status = status
+	message := ""
+	if len(errorMessage) > 0 {
+		message = errorMessage[0]
+	}
+	if err := setDeploymentStatus(&s.hooks, deployment, status, message); err != nil {
+		return err
+	}
 	deployment.UpdatedAt = time.Now()
 
 	if len(errorMessage) > 0 {
-		deployment.ErrorMessage = errorMessage[0]
+		deployment.ErrorMessage = message
 	}
 
 	if status == StatusCompleted || status == StatusFailed || status == StatusTerminated {
@@ -209,7 +448,22 @@ func (s *DiskStore) UpdateDeploymentStatus(deploymentID string, status Deploymen
 		deployment.CompletedAt = &now
 	}
 
-	return s.save()
+	return s.persist(deploymentID)
+}
+
+// SetDeploymentReport stores the completion report of a deployment and persists to disk
+func (s *DiskStore) SetDeploymentReport(deploymentID string, report *DeploymentReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deployment, exists := s.deployments[deploymentID]
+	if !exists {
+		return fmt.Errorf("deployment %s not found", deploymentID)
+	}
+
+	deployment.Report = report
+
+	return s.persist(deploymentID)
 }
 
 // CreateNode creates a new node record and persists to disk
@@ -222,10 +476,12 @@ func (s *DiskStore) CreateNode(node *Node) error {
 	}
 
 	node.LastUpdate = time.Now()
+	node.StatusChangedAt = node.LastUpdate
+	recordPhase(node, node.Status, "")
 	s.nodes[node.NodeID] = node
 	s.nodesByDep[node.DeploymentID] = append(s.nodesByDep[node.DeploymentID], node)
 
-	return s.save()
+	return s.persist(node.DeploymentID)
 }
 
 // GetNode retrieves a node by ID
@@ -275,20 +531,72 @@ func (s *DiskStore) UpdateNodeStatus(deploymentID, nodeID string, status NodeSta
 		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
 	}
 
-	node.Status = status
+	message := ""
+	if len(errorMessage) > 0 {
+		message = errorMessage[0]
+	}
+	if err := setNodeStatus(&s.hooks, s.deployments[deploymentID], node, status, message); err != nil {
+		return err
+	}
 	node.LastUpdate = time.Now()
 	if len(errorMessage) > 0 {
-		node.ErrorMessage = errorMessage[0]
+		node.ErrorMessage = message
 	}
+	recordNodeTiming(node, status)
 
 	// Update deployment completion counts and status
 	s.checkDeploymentCompletion(deploymentID)
 
-	return s.save()
+	return s.persist(deploymentID)
+}
+
+// RegisterNode gives a node its first credentials and persists to disk.
+// Returns ErrAlreadyRegistered if the node registered before.
+func (s *DiskStore) RegisterNode(deploymentID, nodeID string, token NodeToken, remoteAddr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	if err := claimRegistration(node, token, remoteAddr); err != nil {
+		return err
+	}
+
+	return s.persist(deploymentID)
+}
+
+// RetryRegistration replaces the credentials of a node that registers again
+// shortly after its first registration and persists to disk. Returns
+// ErrAlreadyRegistered if the node may not retry.
+func (s *DiskStore) RetryRegistration(deploymentID, nodeID string, token NodeToken, remoteAddr string, instanceVerified bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	if err := retryRegistration(node, token, remoteAddr, instanceVerified); err != nil {
+		return err
+	}
+
+	return s.persist(deploymentID)
 }
 
-// UpdateNodeAuthToken updates the auth token of a node and persists to disk
-func (s *DiskStore) UpdateNodeAuthToken(deploymentID, nodeID, authToken string) error {
+// UpdateNodeAuthToken replaces the credentials of a node and persists to disk
+func (s *DiskStore) UpdateNodeAuthToken(deploymentID, nodeID string, token NodeToken) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -301,13 +609,36 @@ func (s *DiskStore) UpdateNodeAuthToken(deploymentID, nodeID, authToken string)
 		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
 	}
 
-	node.AuthToken = authToken
+	node.AuthToken = token.AuthToken
+	node.AuthExpiresAt = token.ExpiresAt
+	node.RefreshToken = token.RefreshToken
+	node.RefreshExpiresAt = token.RefreshExpiresAt
+	node.SigningSecret = token.SigningSecret
 	node.LastUpdate = time.Now()
 
-	return s.save()
+	return s.persist(deploymentID)
+}
+
+// RotateNodeToken replaces the credentials of the node holding refreshToken,
+// persists them and returns a copy of the node. Each refresh token is
+// exchanged at most once; an exchanged or expired one gets
+// ErrInvalidRefreshToken.
+func (s *DiskStore) RotateNodeToken(refreshToken string, token NodeToken) (*Node, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := rotateToken(s.nodes, refreshToken, token)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.persist(node.DeploymentID); err != nil {
+		return nil, err
+	}
+	nodeCopy := *node
+	return &nodeCopy, nil
 }
 
-// UpdateNodeLastSeen updates the last seen time of a node and persists to disk
+// UpdateNodeLastSeen records a heartbeat from a node and writes it with the next flush
 func (s *DiskStore) UpdateNodeLastSeen(deploymentID, nodeID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -321,12 +652,15 @@ func (s *DiskStore) UpdateNodeLastSeen(deploymentID, nodeID string) error {
 		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
 	}
 
-	node.LastUpdate = time.Now()
+	now := time.Now()
+	node.LastUpdate = now
+	node.LastHeartbeat = &now
 
-	return s.save()
+	s.markDirty(deploymentID)
+	return nil
 }
 
-// UpdateNodeMessage updates the message of a node and persists to disk
+// UpdateNodeMessage updates the message of a node and writes it with the next flush
 func (s *DiskStore) UpdateNodeMessage(deploymentID, nodeID, message string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -343,11 +677,12 @@ func (s *DiskStore) UpdateNodeMessage(deploymentID, nodeID, message string) erro
 	node.ErrorMessage = message
 	node.LastUpdate = time.Now()
 
-	return s.save()
+	s.markDirty(deploymentID)
+	return nil
 }
 
-// UpdateNodeInstanceInfo updates the instance ID and IP address of a node and persists to disk
-func (s *DiskStore) UpdateNodeInstanceInfo(deploymentID, nodeID, instanceID, ipAddress string) error {
+// UpdateNodeInstanceInfo updates the instance ID, IP addresses and zone of a node and persists to disk
+func (s *DiskStore) UpdateNodeInstanceInfo(deploymentID, nodeID, instanceID, ipAddress, privateIP, ipv6Address, availabilityZone string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -362,9 +697,84 @@ func (s *DiskStore) UpdateNodeInstanceInfo(deploymentID, nodeID, instanceID, ipA
 
 	node.InstanceID = instanceID
 	node.IPAddress = ipAddress
+	node.PrivateIPAddress = privateIP
+	node.IPv6Address = ipv6Address
+	node.AvailabilityZone = availabilityZone
 	node.LastUpdate = time.Now()
 
-	return s.save()
+	return s.persist(deploymentID)
+}
+
+// UpdateNodeSystemInfo records the static host facts reported by a node and writes it with the next flush
+func (s *DiskStore) UpdateNodeSystemInfo(deploymentID, nodeID string, info *SystemInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	node.SystemInfo = info
+	if node.AvailabilityZone == "" && info != nil && info.Cloud != nil {
+		// Providers without zone information learn it from the agent
+		node.AvailabilityZone = info.Cloud.AvailabilityZone
+	}
+	node.LastUpdate = time.Now()
+
+	s.markDirty(deploymentID)
+	return nil
+}
+
+// UpdateNodeExitCode records the exit code of a node's workload and writes it with the next flush
+func (s *DiskStore) UpdateNodeExitCode(deploymentID, nodeID string, exitCode int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	node.ExitCode = &exitCode
+	node.LastUpdate = time.Now()
+
+	s.markDirty(deploymentID)
+	return nil
+}
+
+// UpdateNodeProgress records the completion percentage reported by a node's
+// workload (not persisted to disk)
+func (s *DiskStore) UpdateNodeProgress(deploymentID, nodeID string, percent float64, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	node.Progress = &NodeProgress{Percent: percent, Message: message, UpdatedAt: time.Now()}
+	node.LastUpdate = time.Now()
+	if deployment, exists := s.deployments[deploymentID]; exists {
+		deployment.Progress = deploymentProgress(s.nodesByDep[deploymentID])
+	}
+
+	// Workloads may report progress often; like metrics it is written out
+	// with the next persisted change
+	return nil
 }
 
 // MarkNodeForShutdown marks a node to be shut down and persists to disk
@@ -384,7 +794,90 @@ func (s *DiskStore) MarkNodeForShutdown(deploymentID, nodeID string) error {
 	node.ShouldShutdown = true
 	node.LastUpdate = time.Now()
 
-	return s.save()
+	return s.persist(deploymentID)
+}
+
+// MarkNodeIdle marks an idle node to be shut down, records why and persists to disk
+func (s *DiskStore) MarkNodeIdle(deploymentID, nodeID, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	now := time.Now()
+	node.ShouldShutdown = true
+	node.ShutdownReason = reason
+	node.ShutdownAt = &now
+	node.LastUpdate = now
+
+	return s.persist(deploymentID)
+}
+
+// UpdateNodeConfig replaces the config of a node, returns its new config
+// version and persists to disk
+func (s *DiskStore) UpdateNodeConfig(deploymentID, nodeID string, config map[string]interface{}) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return 0, fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return 0, fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	replaceConfig(node, config)
+
+	return node.ConfigVersion, s.persist(deploymentID)
+}
+
+// SetClaimDeadline sets when the provision token of a node that hasn't
+// registered yet expires and persists to disk
+func (s *DiskStore) SetClaimDeadline(deploymentID, nodeID string, deadline time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	setClaimDeadline(node, deadline)
+
+	return s.persist(deploymentID)
+}
+
+// QuarantineNode keeps a node out of automatic shutdown until the given time and persists to disk
+func (s *DiskStore) QuarantineNode(deploymentID, nodeID string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	node.QuarantinedUntil = &until
+	node.LastUpdate = time.Now()
+
+	return s.persist(deploymentID)
 }
 
 // checkDeploymentCompletion updates deployment status based on node states (must be called with lock held)
@@ -397,8 +890,7 @@ func (s *DiskStore) checkDeploymentCompletion(deploymentID string) {
 	nodes := s.nodesByDep[deploymentID]
 	completed := 0
 	failed := 0
-	running := 0
-	other := 0
+	active := 0
 
 	for _, node := range nodes {
 		switch node.Status {
@@ -406,33 +898,26 @@ func (s *DiskStore) checkDeploymentCompletion(deploymentID string) {
 			completed++
 		case NodeStatusFailed:
 			failed++
-		case NodeStatusRunning:
-			running++
 		default:
-			other++
+			active++
 		}
 	}
 
 	// Update deployment counters
 	deployment.NodesCompleted = completed
 	deployment.NodesFailed = failed
+	deployment.Progress = deploymentProgress(nodes)
 	deployment.UpdatedAt = time.Now()
 
-	// Update deployment status based on node states
-	if completed+failed == deployment.TotalNodes {
-		// All nodes are done (either completed or failed)
-		if failed > 0 {
-			deployment.Status = StatusFailed
-		} else {
-			deployment.Status = StatusCompleted
-		}
+	// Update deployment status based on node states, unless the deployment
+	// is already finished or being terminated
+	status := completionStatus(deployment, completed, failed, active)
+	if status == deployment.Status || setDeploymentStatus(&s.hooks, deployment, status, "") != nil {
+		return
+	}
+	if status == StatusCompleted || status == StatusFailed {
 		now := time.Now()
 		deployment.CompletedAt = &now
-	} else if running > 0 || other > 0 {
-		// Some nodes are still working
-		if deployment.Status == StatusProvisioning {
-			deployment.Status = StatusRunning
-		}
 	}
 }
 
@@ -455,10 +940,12 @@ func (s *DiskStore) DeleteDeployment(deploymentID string) error {
 		delete(s.nodesByDep, deploymentID)
 	}
 
-	// Remove the deployment
+	// Remove the deployment, its metrics history and logs
 	delete(s.deployments, deploymentID)
+	delete(s.metricsHistory, deploymentID)
+	s.logs.clear(deploymentID)
 
-	return s.save()
+	return s.persist(deploymentID)
 }
 
 // GetStats returns basic statistics about the store
@@ -471,15 +958,10 @@ func (s *DiskStore) GetStats() map[string]interface{} {
 		statusCounts[dep.Status]++
 	}
 
-	totalLogs := 0
-	for _, logs := range s.logs {
-		totalLogs += len(logs)
-	}
-
 	return map[string]interface{}{
 		"total_deployments": len(s.deployments),
 		"total_nodes":       len(s.nodes),
-		"total_logs":        totalLogs,
+		"total_logs":        s.logs.count(),
 		"deployment_status": statusCounts,
 	}
 }
@@ -494,19 +976,7 @@ func (s *DiskStore) AppendLogs(deploymentID string, logs []LogEntry) error {
 		return fmt.Errorf("deployment %s not found", deploymentID)
 	}
 
-	// Get existing logs
-	existingLogs := s.logs[deploymentID]
-
-	// Append new logs
-	existingLogs = append(existingLogs, logs...)
-
-	// Trim to max size (keep most recent)
-	if len(existingLogs) > s.maxLogsPerDeployment {
-		existingLogs = existingLogs[len(existingLogs)-s.maxLogsPerDeployment:]
-	}
-
-	s.logs[deploymentID] = existingLogs
-	return nil
+	return s.logs.append(deploymentID, logs)
 }
 
 // GetLogs retrieves logs for a deployment, optionally filtered by node and time
@@ -519,31 +989,7 @@ func (s *DiskStore) GetLogs(deploymentID string, nodeID string, since time.Time,
 		return nil, fmt.Errorf("deployment %s not found", deploymentID)
 	}
 
-	allLogs := s.logs[deploymentID]
-	if allLogs == nil {
-		return []LogEntry{}, nil
-	}
-
-	// Filter logs
-	var filtered []LogEntry
-	for _, log := range allLogs {
-		// Filter by node if specified
-		if nodeID != "" && log.NodeID != nodeID {
-			continue
-		}
-		// Filter by time if specified
-		if !since.IsZero() && log.Timestamp.Before(since) {
-			continue
-		}
-		filtered = append(filtered, log)
-	}
-
-	// Apply limit
-	if limit > 0 && len(filtered) > limit {
-		filtered = filtered[len(filtered)-limit:]
-	}
-
-	return filtered, nil
+	return s.logs.filter(deploymentID, nodeID, since, limit), nil
 }
 
 // ClearLogs removes all logs for a deployment
@@ -551,10 +997,28 @@ func (s *DiskStore) ClearLogs(deploymentID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	delete(s.logs, deploymentID)
+	s.logs.clear(deploymentID)
 	return nil
 }
 
+// SetLogLimits sets how many bytes of logs are kept per deployment and in
+// total. Deployments over the new limit are trimmed on their next append.
+func (s *DiskStore) SetLogLimits(limits LogLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.logs.maxBytes = limits.PerDeployment
+	s.logs.maxTotalBytes = limits.Total
+}
+
+// MemoryUsage estimates what the store holds in memory
+func (s *DiskStore) MemoryUsage() MemoryUsage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return memoryUsage(s.deployments, s.nodesByDep, s.logs, s.metricsHistory)
+}
+
 // UpdateNodeMetrics updates the metrics for a node (not persisted to disk)
 func (s *DiskStore) UpdateNodeMetrics(deploymentID, nodeID string, metrics *SystemMetrics) error {
 	s.mu.Lock()
@@ -571,8 +1035,53 @@ func (s *DiskStore) UpdateNodeMetrics(deploymentID, nodeID string, metrics *Syst
 
 	metrics.Timestamp = time.Now()
 	node.Metrics = metrics
+	recordPeakMetrics(node, metrics)
+	s.metricsHistory[deploymentID] = appendMetricsSample(s.metricsHistory[deploymentID],
+		MetricsSample{NodeID: nodeID, SystemMetrics: *metrics}, s.maxMetricsPerDep)
 	node.LastUpdate = time.Now()
 
 	// Note: Metrics are not persisted to disk to avoid excessive I/O
 	return nil
 }
+
+// UpdateNodeHealthChecks replaces the health check results of a node
+func (s *DiskStore) UpdateNodeHealthChecks(deploymentID, nodeID string, checks []HealthCheck) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	node.HealthChecks = checks
+
+	// Like metrics, health checks arrive with every heartbeat and are not
+	// persisted on their own
+	return nil
+}
+
+// GetMetricsHistory returns the retained metrics samples of a deployment,
+// optionally filtered by node
+func (s *DiskStore) GetMetricsHistory(deploymentID string, nodeID string) ([]MetricsSample, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, exists := s.deployments[deploymentID]; !exists {
+		return nil, fmt.Errorf("deployment %s not found", deploymentID)
+	}
+
+	var samples []MetricsSample
+	for _, sample := range s.metricsHistory[deploymentID] {
+		if nodeID != "" && sample.NodeID != nodeID {
+			continue
+		}
+		samples = append(samples, sample)
+	}
+
+	return samples, nil
+}
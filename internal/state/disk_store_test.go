@@ -0,0 +1,151 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDiskStore opens a disk store in dir and closes it with the test
+func newTestDiskStore(t *testing.T, dir string) *DiskStore {
+	store, err := NewDiskStore(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// readDeploymentFile parses the file a deployment is stored in
+func readDeploymentFile(t *testing.T, dir, deploymentID string) deploymentFile {
+	data, err := os.ReadFile(filepath.Join(dir, "deployments", deploymentID+".json"))
+	require.NoError(t, err)
+	var file deploymentFile
+	require.NoError(t, json.Unmarshal(data, &file))
+	return file
+}
+
+func TestDiskStoreWritesDeploymentFiles(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestDiskStore(t, dir)
+
+	require.NoError(t, store.CreateDeployment(&Deployment{ID: "dep_1", Status: StatusProvisioning, TotalNodes: 1}))
+	require.NoError(t, store.CreateDeployment(&Deployment{ID: "dep_2", Status: StatusProvisioning, TotalNodes: 1}))
+	require.NoError(t, store.CreateNode(&Node{NodeID: "node_0", DeploymentID: "dep_1", Status: NodeStatusPending}))
+	require.NoError(t, store.UpdateNodeStatus("dep_1", "node_0", NodeStatusRunning))
+
+	// Status changes are written before the update returns
+	file := readDeploymentFile(t, dir, "dep_1")
+	require.Len(t, file.Nodes, 1)
+	assert.Equal(t, NodeStatusRunning, file.Nodes[0].Status)
+	assert.Equal(t, StatusRunning, file.Deployment.Status)
+
+	// Heartbeats wait for the next flush and only touch their deployment
+	before, err := os.Stat(filepath.Join(dir, "deployments", "dep_2.json"))
+	require.NoError(t, err)
+	require.NoError(t, store.UpdateNodeLastSeen("dep_1", "node_0"))
+	assert.Nil(t, readDeploymentFile(t, dir, "dep_1").Nodes[0].LastHeartbeat)
+
+	require.NoError(t, store.Flush())
+	assert.NotNil(t, readDeploymentFile(t, dir, "dep_1").Nodes[0].LastHeartbeat)
+	after, err := os.Stat(filepath.Join(dir, "deployments", "dep_2.json"))
+	require.NoError(t, err)
+	assert.Equal(t, before.ModTime(), after.ModTime())
+
+	require.NoError(t, store.DeleteDeployment("dep_2"))
+	assert.NoFileExists(t, filepath.Join(dir, "deployments", "dep_2.json"))
+}
+
+func TestDiskStoreCloseWritesPendingChanges(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStore(dir)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateDeployment(&Deployment{ID: "dep_1", Status: StatusProvisioning, TotalNodes: 1}))
+	require.NoError(t, store.CreateNode(&Node{NodeID: "node_0", DeploymentID: "dep_1", Status: NodeStatusPending}))
+	require.NoError(t, store.UpdateNodeMessage("dep_1", "node_0", "downloading bundle"))
+	require.NoError(t, store.Close())
+
+	reopened := newTestDiskStore(t, dir)
+	node, err := reopened.GetNode("node_0")
+	require.NoError(t, err)
+	assert.Equal(t, "downloading bundle", node.ErrorMessage)
+	nodes, err := reopened.GetNodesByDeployment("dep_1")
+	require.NoError(t, err)
+	assert.Len(t, nodes, 1)
+}
+
+func TestDiskStoreRecovery(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStore(dir)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateDeployment(&Deployment{ID: "dep_ok", Status: StatusProvisioning}))
+	require.NoError(t, store.Close())
+
+	// A crash during a write leaves a temp file next to the intact one, and
+	// a damaged file must not keep the daemon from starting
+	deployments := filepath.Join(dir, "deployments")
+	require.NoError(t, os.WriteFile(filepath.Join(deployments, "dep_ok.json.tmp"), []byte(`{"deploym`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(deployments, "dep_bad.json"), []byte(`{"deploym`), 0644))
+
+	reopened := newTestDiskStore(t, dir)
+	assert.Equal(t, []string{"dep_bad.json"}, reopened.SkippedFiles())
+	_, err = reopened.GetDeployment("dep_ok")
+	assert.NoError(t, err)
+	_, err = reopened.GetDeployment("dep_bad")
+	assert.Error(t, err)
+	assert.NoFileExists(t, filepath.Join(deployments, "dep_ok.json.tmp"))
+	assert.FileExists(t, filepath.Join(deployments, "dep_bad.json.corrupt"))
+}
+
+func TestDiskStoreMigratesLegacyState(t *testing.T) {
+	dir := t.TempDir()
+	legacy := legacyState{
+		Deployments: map[string]*Deployment{"dep_1": {ID: "dep_1", Status: StatusRunning, TotalNodes: 1}},
+		Nodes:       map[string]*Node{"node_0": {NodeID: "node_0", DeploymentID: "dep_1", Status: NodeStatusRunning, AuthToken: "secret"}},
+	}
+	data, err := json.Marshal(legacy)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "state.json"), data, 0644))
+
+	store := newTestDiskStore(t, dir)
+	node, deployment, err := store.FindNodeByAuthToken("secret")
+	require.NoError(t, err)
+	assert.Equal(t, "node_0", node.NodeID)
+	assert.Equal(t, "dep_1", deployment.ID)
+
+	assert.NoFileExists(t, filepath.Join(dir, "state.json"))
+	assert.FileExists(t, filepath.Join(dir, "state.json.migrated"))
+	assert.Len(t, readDeploymentFile(t, dir, "dep_1").Nodes, 1)
+}
+
+func TestDiskStoreRotateNodeToken(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestDiskStore(t, dir)
+	require.NoError(t, store.CreateDeployment(&Deployment{ID: "dep_1", Status: StatusRunning, TotalNodes: 2}))
+	require.NoError(t, store.CreateNode(&Node{NodeID: "node_0", DeploymentID: "dep_1", Status: NodeStatusRunning}))
+	require.NoError(t, store.CreateNode(&Node{NodeID: "node_1", DeploymentID: "dep_1", Status: NodeStatusRunning}))
+
+	later := time.Now().Add(time.Hour)
+	earlier := time.Now().Add(-time.Second)
+	require.NoError(t, store.RegisterNode("dep_1", "node_0", NodeToken{AuthToken: "auth-0", RefreshToken: "refresh-0", RefreshExpiresAt: &later}, "127.0.0.1"))
+	require.NoError(t, store.RegisterNode("dep_1", "node_1", NodeToken{AuthToken: "auth-1", RefreshToken: "refresh-1", RefreshExpiresAt: &earlier}, "127.0.0.1"))
+
+	node, err := store.RotateNodeToken("refresh-0", NodeToken{AuthToken: "auth-0b", RefreshToken: "refresh-0b", RefreshExpiresAt: &later})
+	require.NoError(t, err)
+	assert.Equal(t, "node_0", node.NodeID)
+	assert.Equal(t, "refresh-0b", readDeploymentFile(t, dir, "dep_1").Nodes[0].RefreshToken)
+	_, _, err = store.FindNodeByAuthToken("auth-0")
+	assert.Error(t, err)
+
+	// Refresh tokens work once, and not after they expired
+	_, err = store.RotateNodeToken("refresh-0", NodeToken{AuthToken: "auth-0c", RefreshToken: "refresh-0c"})
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	_, err = store.RotateNodeToken("refresh-1", NodeToken{AuthToken: "auth-1b", RefreshToken: "refresh-1b"})
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	assert.ErrorContains(t, err, "refresh token of node node_1 expired")
+	_, err = store.RotateNodeToken("", NodeToken{})
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+}
@@ -0,0 +1,38 @@
+package state
+
+import "time"
+
+// Liveness tells whether a node's agent is still reporting, independent of
+// the node's lifecycle status
+type Liveness string
+
+const (
+	LivenessOnline  Liveness = "online"  // heartbeat within StaleAfter
+	LivenessStale   Liveness = "stale"   // heartbeats stopped recently
+	LivenessOffline Liveness = "offline" // no heartbeat within OfflineAfter, or never
+)
+
+const (
+	// StaleAfter is how long a node may go without a heartbeat before it is
+	// stale. Agents send one every few seconds.
+	StaleAfter = 30 * time.Second
+
+	// OfflineAfter is how long a node may go without a heartbeat before it
+	// is offline
+	OfflineAfter = 5 * time.Minute
+)
+
+// NodeLiveness derives the liveness of a node from its last heartbeat
+func NodeLiveness(node *Node, now time.Time) Liveness {
+	if node.LastHeartbeat == nil {
+		return LivenessOffline
+	}
+	switch silent := now.Sub(*node.LastHeartbeat); {
+	case silent < StaleAfter:
+		return LivenessOnline
+	case silent < OfflineAfter:
+		return LivenessStale
+	default:
+		return LivenessOffline
+	}
+}
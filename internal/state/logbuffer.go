@@ -0,0 +1,194 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrLogBufferFull is returned by AppendLogs when storing the logs would take
+// the log buffers of all deployments past their total limit. Callers should
+// have the sender retry later rather than drop the logs.
+var ErrLogBufferFull = errors.New("log buffers are full")
+
+// logEntryOverhead approximates what a LogEntry costs beyond its strings: the
+// struct, its timestamp and the string headers
+const logEntryOverhead = 96
+
+// logEntrySize estimates the memory a log entry takes
+func logEntrySize(entry LogEntry) int64 {
+	return int64(logEntryOverhead + len(entry.Message) + len(entry.NodeID) + len(entry.DeploymentID) + len(entry.Stream))
+}
+
+// logBuffer keeps the most recent log entries of each deployment in memory.
+// Each deployment keeps at most maxEntries entries and maxBytes bytes,
+// dropping its oldest entries beyond that. Appends that would take all
+// deployments together past maxTotalBytes fail instead, since dropping
+// other deployments' logs to make room would hide them silently.
+type logBuffer struct {
+	entries       map[string][]LogEntry // key is deployment_id
+	bytes         map[string]int64      // estimated size of entries, by deployment_id
+	totalBytes    int64
+	maxEntries    int
+	maxBytes      int64 // per deployment, 0 for no limit
+	maxTotalBytes int64 // 0 for no limit
+}
+
+func newLogBuffer(maxEntries int) *logBuffer {
+	return &logBuffer{
+		entries:    make(map[string][]LogEntry),
+		bytes:      make(map[string]int64),
+		maxEntries: maxEntries,
+	}
+}
+
+// append adds entries to a deployment's buffer, dropping its oldest entries
+// beyond the per deployment limits
+func (b *logBuffer) append(deploymentID string, logs []LogEntry) error {
+	size := b.bytes[deploymentID]
+	// Appending only writes past the stored length, so the buffer is
+	// unchanged if the append is rejected
+	updated := append(b.entries[deploymentID], logs...)
+	for _, entry := range logs {
+		size += logEntrySize(entry)
+	}
+
+	// Trim to max size (keep most recent)
+	drop := 0
+	if len(updated) > b.maxEntries {
+		drop = len(updated) - b.maxEntries
+		for _, entry := range updated[:drop] {
+			size -= logEntrySize(entry)
+		}
+	}
+	for b.maxBytes > 0 && size > b.maxBytes && drop < len(updated) {
+		size -= logEntrySize(updated[drop])
+		drop++
+	}
+
+	growth := size - b.bytes[deploymentID]
+	if b.maxTotalBytes > 0 && growth > 0 && b.totalBytes+growth > b.maxTotalBytes {
+		return fmt.Errorf("%w: %d of %d bytes used, %d more needed", ErrLogBufferFull, b.totalBytes, b.maxTotalBytes, growth)
+	}
+
+	// Release the dropped entries' messages, the array outlives them
+	clear(updated[:drop])
+	b.entries[deploymentID] = updated[drop:]
+	b.bytes[deploymentID] = size
+	b.totalBytes += growth
+	return nil
+}
+
+// clear removes a deployment's entries
+func (b *logBuffer) clear(deploymentID string) {
+	b.totalBytes -= b.bytes[deploymentID]
+	delete(b.entries, deploymentID)
+	delete(b.bytes, deploymentID)
+}
+
+// filter returns a deployment's entries of a node (all nodes if empty) since
+// a time (all if zero), the most recent limit of them if limit is positive
+func (b *logBuffer) filter(deploymentID, nodeID string, since time.Time, limit int) []LogEntry {
+	allLogs := b.entries[deploymentID]
+	if allLogs == nil {
+		return []LogEntry{}
+	}
+
+	var filtered []LogEntry
+	for _, log := range allLogs {
+		// Filter by node if specified
+		if nodeID != "" && log.NodeID != nodeID {
+			continue
+		}
+		// Filter by time if specified
+		if !since.IsZero() && log.Timestamp.Before(since) {
+			continue
+		}
+		filtered = append(filtered, log)
+	}
+
+	// Apply limit
+	if limit > 0 && len(filtered) > limit {
+		filtered = filtered[len(filtered)-limit:]
+	}
+	return filtered
+}
+
+// count returns the number of entries held for all deployments
+func (b *logBuffer) count() int {
+	total := 0
+	for _, logs := range b.entries {
+		total += len(logs)
+	}
+	return total
+}
+
+// MemoryUsage estimates what a store holds in memory
+type MemoryUsage struct {
+	Deployments    int                         `json:"deployments"`
+	Nodes          int                         `json:"nodes"`
+	LogEntries     int                         `json:"log_entries"`
+	LogBytes       int64                       `json:"log_bytes"`
+	MetricsSamples int                         `json:"metrics_samples"`
+	LogLimits      LogLimits                   `json:"log_limits"`
+	ByDeployment   map[string]DeploymentMemory `json:"by_deployment"`
+}
+
+// DeploymentMemory estimates what a store holds in memory for a deployment
+type DeploymentMemory struct {
+	Nodes          int   `json:"nodes"`
+	LogEntries     int   `json:"log_entries"`
+	LogBytes       int64 `json:"log_bytes"`
+	MetricsSamples int   `json:"metrics_samples"`
+}
+
+// LogLimits bound the memory log buffers take, in bytes. Zero means no limit.
+type LogLimits struct {
+	PerDeployment int64 `json:"per_deployment"`
+	Total         int64 `json:"total"`
+}
+
+// TopDeployments returns the IDs of the deployments holding the most log
+// bytes, largest first, at most n of them
+func (u MemoryUsage) TopDeployments(n int) []string {
+	ids := make([]string, 0, len(u.ByDeployment))
+	for id := range u.ByDeployment {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := u.ByDeployment[ids[i]], u.ByDeployment[ids[j]]
+		if a.LogBytes != b.LogBytes {
+			return a.LogBytes > b.LogBytes
+		}
+		return ids[i] < ids[j]
+	})
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	return ids
+}
+
+// memoryUsage reports the usage of a store's maps. Must be called with the
+// store's lock held.
+func memoryUsage(deployments map[string]*Deployment, nodesByDep map[string][]*Node, logs *logBuffer, metrics map[string][]MetricsSample) MemoryUsage {
+	usage := MemoryUsage{
+		Deployments:  len(deployments),
+		LogBytes:     logs.totalBytes,
+		LogLimits:    LogLimits{PerDeployment: logs.maxBytes, Total: logs.maxTotalBytes},
+		ByDeployment: make(map[string]DeploymentMemory, len(deployments)),
+	}
+	for id := range deployments {
+		dep := DeploymentMemory{
+			Nodes:          len(nodesByDep[id]),
+			LogEntries:     len(logs.entries[id]),
+			LogBytes:       logs.bytes[id],
+			MetricsSamples: len(metrics[id]),
+		}
+		usage.Nodes += dep.Nodes
+		usage.LogEntries += dep.LogEntries
+		usage.MetricsSamples += dep.MetricsSamples
+		usage.ByDeployment[id] = dep
+	}
+	return usage
+}
@@ -0,0 +1,69 @@
+package state
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logLines returns n log entries whose messages are size bytes long
+func logLines(n, size int) []LogEntry {
+	logs := make([]LogEntry, n)
+	for i := range logs {
+		logs[i] = LogEntry{NodeID: "node_0", Message: strings.Repeat("x", size)}
+	}
+	return logs
+}
+
+func TestAppendLogsEnforcesLimits(t *testing.T) {
+	store := NewStore()
+	require.NoError(t, store.CreateDeployment(&Deployment{ID: "dep_1", Status: StatusRunning}))
+	require.NoError(t, store.CreateDeployment(&Deployment{ID: "dep_2", Status: StatusRunning}))
+
+	entrySize := logEntrySize(logLines(1, 1000)[0])
+	store.SetLogLimits(LogLimits{PerDeployment: 4 * entrySize, Total: 6 * entrySize})
+
+	// A deployment over its limit drops its oldest entries
+	require.NoError(t, store.AppendLogs("dep_1", logLines(3, 1000)))
+	require.NoError(t, store.AppendLogs("dep_1", logLines(3, 1000)))
+	usage := store.MemoryUsage()
+	assert.Equal(t, 4, usage.ByDeployment["dep_1"].LogEntries)
+	assert.Equal(t, 4*entrySize, usage.LogBytes)
+
+	// Growing past the total limit is refused and keeps what was stored
+	require.NoError(t, store.AppendLogs("dep_2", logLines(2, 1000)))
+	err := store.AppendLogs("dep_2", logLines(1, 1000))
+	assert.ErrorIs(t, err, ErrLogBufferFull)
+	logs, err := store.GetLogs("dep_2", "", time.Time{}, 0)
+	require.NoError(t, err)
+	assert.Len(t, logs, 2)
+
+	// A full deployment still rotates, since that doesn't grow the total
+	require.NoError(t, store.AppendLogs("dep_1", logLines(2, 1000)))
+
+	// Deleting a deployment frees its logs
+	require.NoError(t, store.DeleteDeployment("dep_1"))
+	usage = store.MemoryUsage()
+	assert.Equal(t, 2*entrySize, usage.LogBytes)
+	assert.Equal(t, 1, usage.Deployments)
+	assert.Equal(t, 2, usage.LogEntries)
+	require.NoError(t, store.AppendLogs("dep_2", logLines(1, 1000)))
+}
+
+func TestMemoryUsageTopDeployments(t *testing.T) {
+	store := NewStore()
+	for _, id := range []string{"dep_a", "dep_b", "dep_c"} {
+		require.NoError(t, store.CreateDeployment(&Deployment{ID: id, Status: StatusRunning}))
+	}
+	require.NoError(t, store.CreateNode(&Node{NodeID: "node_0", DeploymentID: "dep_b"}))
+	require.NoError(t, store.AppendLogs("dep_b", logLines(2, 100)))
+	require.NoError(t, store.AppendLogs("dep_c", logLines(1, 100)))
+
+	usage := store.MemoryUsage()
+	assert.Equal(t, []string{"dep_b", "dep_c"}, usage.TopDeployments(2))
+	assert.Equal(t, 1, usage.Nodes)
+	assert.Equal(t, 1, usage.ByDeployment["dep_b"].Nodes)
+}
@@ -0,0 +1,108 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SensitiveValue stands in for the values of sensitive variables wherever a
+// deployment leaves the daemon
+const SensitiveValue = "(sensitive)"
+
+// Redacted returns a copy of the deployment for API responses and trace
+// files. The values of sensitive variables are withheld from Variables and
+// from the configuration they were substituted into. The stored deployment
+// keeps them, since nodes and exports need the real configuration.
+func (d *Deployment) Redacted() *Deployment {
+	redacted := *d
+	if len(d.SensitiveVariables) == 0 {
+		return &redacted
+	}
+
+	redacted.Variables = make(map[string]interface{}, len(d.Variables))
+	for name, value := range d.Variables {
+		redacted.Variables[name] = value
+	}
+	for _, name := range d.SensitiveVariables {
+		if _, ok := redacted.Variables[name]; ok {
+			redacted.Variables[name] = SensitiveValue
+		}
+	}
+
+	secrets := d.sensitiveValues()
+	if d.Config != nil {
+		redacted.Config = redactValue(d.Config, secrets).(map[string]interface{})
+	}
+	return &redacted
+}
+
+// Redact replaces the values of the deployment's sensitive variables in s,
+// such as a recorded request or response body
+func (d *Deployment) Redact(s string) string {
+	for _, secret := range d.sensitiveValues() {
+		s = strings.ReplaceAll(s, secret, SensitiveValue)
+	}
+	return s
+}
+
+// sensitiveValues returns the values of sensitive variables as they appear
+// in the substituted configuration
+func (d *Deployment) sensitiveValues() []string {
+	var secrets []string
+	for _, name := range d.SensitiveVariables {
+		value, ok := d.Variables[name]
+		if !ok || value == nil {
+			continue
+		}
+		if secret := fmt.Sprint(value); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// redactValue copies a configuration value with sensitive values replaced,
+// whether a whole value or part of a string
+func redactValue(value interface{}, secrets []string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			redacted[key] = redactValue(item, secrets)
+		}
+		return redacted
+	case map[interface{}]interface{}:
+		redacted := make(map[interface{}]interface{}, len(v))
+		for key, item := range v {
+			redacted[key] = redactValue(item, secrets)
+		}
+		return redacted
+	case map[string]string:
+		redacted := make(map[string]string, len(v))
+		for key, item := range v {
+			redacted[key] = redactValue(item, secrets).(string)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, item := range v {
+			redacted[i] = redactValue(item, secrets)
+		}
+		return redacted
+	case string:
+		for _, secret := range secrets {
+			v = strings.ReplaceAll(v, secret, SensitiveValue)
+		}
+		return v
+	case nil:
+		return nil
+	default:
+		text := fmt.Sprint(v)
+		for _, secret := range secrets {
+			if text == secret {
+				return SensitiveValue
+			}
+		}
+		return v
+	}
+}
@@ -0,0 +1,37 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeploymentRedacted(t *testing.T) {
+	deployment := &Deployment{
+		ID:                 "dep_1",
+		Variables:          map[string]interface{}{"dataset": "sample", "api_key": "hunter2", "port": 8443},
+		SensitiveVariables: []string{"api_key", "port"},
+		Config: map[string]interface{}{
+			"nodes": map[string]interface{}{
+				"instance_config": map[interface{}]interface{}{"user_data": "API_KEY=hunter2 ./run.sh"},
+				"labels":          map[string]string{"key": "hunter2"},
+				"ports":           []interface{}{8443, 22},
+			},
+			"dataset": "sample",
+		},
+	}
+
+	redacted := deployment.Redacted()
+	assert.Equal(t, map[string]interface{}{"dataset": "sample", "api_key": SensitiveValue, "port": SensitiveValue}, redacted.Variables)
+	nodes := redacted.Config["nodes"].(map[string]interface{})
+	assert.Equal(t, "API_KEY=(sensitive) ./run.sh", nodes["instance_config"].(map[interface{}]interface{})["user_data"])
+	assert.Equal(t, map[string]string{"key": SensitiveValue}, nodes["labels"])
+	assert.Equal(t, []interface{}{SensitiveValue, 22}, nodes["ports"])
+	assert.Equal(t, "sample", redacted.Config["dataset"])
+	assert.Equal(t, `{"token":"(sensitive)"}`, deployment.Redact(`{"token":"hunter2"}`))
+
+	// The deployment itself is untouched
+	assert.Equal(t, "hunter2", deployment.Variables["api_key"])
+	assert.Equal(t, "API_KEY=hunter2 ./run.sh",
+		deployment.Config["nodes"].(map[string]interface{})["instance_config"].(map[interface{}]interface{})["user_data"])
+}
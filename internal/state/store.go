@@ -1,7 +1,9 @@
 package state
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
 	"sync"
 	"time"
 )
@@ -28,6 +30,7 @@ const (
 	NodeStatusBooting      NodeStatus = "booting"
 	NodeStatusRegistering  NodeStatus = "registering"
 	NodeStatusDownloading  NodeStatus = "downloading_assets"
+	NodeStatusExtracting   NodeStatus = "extracting"
 	NodeStatusRunning      NodeStatus = "running"
 	NodeStatusCompleted    NodeStatus = "completed"
 	NodeStatusFailed       NodeStatus = "failed"
@@ -35,6 +38,43 @@ const (
 	NodeStatusTerminated   NodeStatus = "terminated"
 )
 
+// maxPhases is how many lifecycle phase changes are kept per node
+const maxPhases = 50
+
+// ErrAlreadyRegistered is returned when a node's provision token is used again
+// after the node registered
+var ErrAlreadyRegistered = errors.New("node is already registered")
+
+// RegistrationRetryWindow is how long after registering a node may register
+// again to get fresh credentials, in case the response to its first attempt
+// was lost
+const RegistrationRetryWindow = 2 * time.Minute
+
+// ErrProvisionTokenExpired is returned when a node registers after its
+// provision token expired
+var ErrProvisionTokenExpired = errors.New("provision token expired")
+
+// ErrInvalidRefreshToken is returned when a refresh token matches no node,
+// was already exchanged or expired
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+// NodeToken holds the credentials a node authenticates with. The zero value
+// revokes them.
+type NodeToken struct {
+	AuthToken        string
+	ExpiresAt        *time.Time // nil if the auth token doesn't expire
+	RefreshToken     string
+	RefreshExpiresAt *time.Time // nil if the refresh token doesn't expire
+	SigningSecret    string
+}
+
+// PhaseChange records a node entering a lifecycle phase
+type PhaseChange struct {
+	Status  NodeStatus `json:"status"`
+	At      time.Time  `json:"at"`
+	Message string     `json:"message,omitempty"`
+}
+
 // LogEntry represents a single log line from a node
 type LogEntry struct {
 	Timestamp    time.Time `json:"timestamp"`
@@ -48,45 +88,247 @@ type LogEntry struct {
 type SystemMetrics struct {
 	CPUCores    int       `json:"cpu_cores"`
 	CPUUsage    float64   `json:"cpu_usage"`
+	CPUPerCore  []float64 `json:"cpu_per_core,omitempty"`
 	MemoryTotal uint64    `json:"memory_total"`
 	MemoryUsed  uint64    `json:"memory_used"`
 	LoadAvg1    float64   `json:"load_avg_1"`
 	LoadAvg5    float64   `json:"load_avg_5"`
 	LoadAvg15   float64   `json:"load_avg_15"`
 	Timestamp   time.Time `json:"timestamp"`
+
+	// Custom holds workload metrics contributed by the node's telemetry hooks
+	Custom map[string]float64 `json:"custom,omitempty"`
+}
+
+// MetricsSample is a single metrics report from a node, kept for export
+type MetricsSample struct {
+	NodeID string `json:"node_id"`
+	SystemMetrics
+}
+
+// Health check statuses reported by telemetry hooks
+const (
+	HealthOK       = "ok"
+	HealthWarning  = "warning"
+	HealthCritical = "critical"
+)
+
+// HealthCheck is the latest result of a custom health check run on a node
+type HealthCheck struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	Message   string    `json:"message,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// NodeProgress is the latest completion percentage a node's workload reported
+type NodeProgress struct {
+	Percent   float64   `json:"percent"`
+	Message   string    `json:"message,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Where the keys of a node's config come from
+const (
+	ConfigFromGlobalMetadata   = "global_metadata"
+	ConfigFromDistributedLists = "distributed_lists"
+	ConfigFromConfigTemplate   = "config_template"
+	ConfigFromReconfigure      = "reconfigure"
+)
+
+// ConfigSource records where a key of a node's config came from
+type ConfigSource struct {
+	From      string      `json:"from"`
+	Items     []int       `json:"items,omitempty"`     // indexes of the distributed list items the node received
+	Template  interface{} `json:"template,omitempty"`  // config_template value before it was rendered
+	Overrides string      `json:"overrides,omitempty"` // source whose value this one replaced
+	Version   int         `json:"version,omitempty"`   // config version that reconfigured the key
+}
+
+// ConfigSources maps the keys of a node's config to their source
+type ConfigSources map[string]ConfigSource
+
+// PeakMetrics tracks the highest resource usage observed on a node
+type PeakMetrics struct {
+	CPUUsage   float64 `json:"cpu_usage"`
+	MemoryUsed uint64  `json:"memory_used"`
+	LoadAvg1   float64 `json:"load_avg_1"`
+}
+
+// CloudMetadata describes the cloud instance a node is running on
+type CloudMetadata struct {
+	Provider         string `json:"provider,omitempty"`
+	InstanceID       string `json:"instance_id,omitempty"`
+	InstanceType     string `json:"instance_type,omitempty"`
+	Region           string `json:"region,omitempty"`
+	AvailabilityZone string `json:"availability_zone,omitempty"`
+	ImageID          string `json:"image_id,omitempty"`
+}
+
+// SystemInfo represents static host facts reported by a node at registration
+type SystemInfo struct {
+	Hostname      string         `json:"hostname,omitempty"`
+	OS            string         `json:"os"`
+	OSVersion     string         `json:"os_version,omitempty"`
+	KernelVersion string         `json:"kernel_version,omitempty"`
+	Arch          string         `json:"arch"`
+	CPUModel      string         `json:"cpu_model,omitempty"`
+	CPUCores      int            `json:"cpu_cores"`
+	MemoryTotal   uint64         `json:"memory_total"`
+	DiskTotal     uint64         `json:"disk_total"`
+	BootTime      time.Time      `json:"boot_time,omitzero"`
+	AgentVersion  string         `json:"agent_version,omitempty"`
+	Cloud         *CloudMetadata `json:"cloud,omitempty"`
 }
 
 // Node represents a single node in a deployment
 type Node struct {
-	NodeID         string                 `json:"node_id"`
-	NodeIndex      int                    `json:"node_index"`
-	DeploymentID   string                 `json:"deployment_id"`
-	Status         NodeStatus             `json:"status"`
-	IPAddress      string                 `json:"ip_address,omitempty"`
-	InstanceID     string                 `json:"instance_id,omitempty"`
-	Config         map[string]interface{} `json:"config"`
-	ProvisionToken string                 `json:"provision_token,omitempty"`
-	AuthToken      string                 `json:"auth_token,omitempty"`
-	ShouldShutdown bool                   `json:"should_shutdown"`
-	LastUpdate     time.Time              `json:"last_update"`
-	ErrorMessage   string                 `json:"error_message,omitempty"`
-	Metrics        *SystemMetrics         `json:"metrics,omitempty"`
+	NodeID           string                 `json:"node_id"`
+	NodeIndex        int                    `json:"node_index"`
+	DeploymentID     string                 `json:"deployment_id"`
+	Status           NodeStatus             `json:"status"`
+	IPAddress        string                 `json:"ip_address,omitempty"`
+	PrivateIPAddress string                 `json:"private_ip_address,omitempty"`
+	IPv6Address      string                 `json:"ipv6_address,omitempty"`
+	AvailabilityZone string                 `json:"availability_zone,omitempty"`
+	InstanceID       string                 `json:"instance_id,omitempty"`
+	Config           map[string]interface{} `json:"config"`
+	ConfigVersion    int                    `json:"config_version,omitempty"` // incremented by each update of Config
+	ConfigSources    ConfigSources          `json:"config_sources,omitempty"` // where each key of Config came from
+	ProvisionToken   string                 `json:"provision_token,omitempty"`
+	AuthToken        string                 `json:"auth_token,omitempty"`
+	AuthExpiresAt    *time.Time             `json:"auth_expires_at,omitempty"`    // auth token is rejected after this
+	RefreshToken     string                 `json:"refresh_token,omitempty"`      // exchanged once for a new auth token
+	RefreshExpiresAt *time.Time             `json:"refresh_expires_at,omitempty"` // refresh token is rejected after this
+	SigningSecret    string                 `json:"signing_secret,omitempty"`     // HMAC key for the node's requests
+	ShouldShutdown   bool                   `json:"should_shutdown"`
+	LastUpdate       time.Time              `json:"last_update"`
+	LastHeartbeat    *time.Time             `json:"last_heartbeat,omitempty"`
+	StatusChangedAt  time.Time              `json:"status_changed_at"`
+	ErrorMessage     string                 `json:"error_message,omitempty"`
+	Metrics          *SystemMetrics         `json:"metrics,omitempty"`
+	SystemInfo       *SystemInfo            `json:"system_info,omitempty"`
+	PeakMetrics      *PeakMetrics           `json:"peak_metrics,omitempty"`
+	StartedAt        *time.Time             `json:"started_at,omitempty"`
+	FinishedAt       *time.Time             `json:"finished_at,omitempty"`
+	ExitCode         *int                   `json:"exit_code,omitempty"`
+	HealthChecks     []HealthCheck          `json:"health_checks,omitempty"`
+	Progress         *NodeProgress          `json:"progress,omitempty"`
+	ShutdownReason   string                 `json:"shutdown_reason,omitempty"` // why the node was shut down automatically
+	ShutdownAt       *time.Time             `json:"shutdown_at,omitempty"`
+	QuarantinedUntil *time.Time             `json:"quarantined_until,omitempty"` // kept for debugging until then
+	RegisteredAt     *time.Time             `json:"registered_at,omitempty"`     // provision token was used
+	RegisteredFrom   string                 `json:"registered_from,omitempty"`   // address the node registered from
+	ClaimDeadline    *time.Time             `json:"claim_deadline,omitempty"`    // unused provision token is rejected after this
+	Phases           []PhaseChange          `json:"phases,omitempty"`            // lifecycle phase history, oldest first
+}
+
+// Owner identifies the API key and namespace a deployment is accounted to
+type Owner struct {
+	APIKeyID  string `json:"api_key_id,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
 }
 
 // Deployment represents a complete deployment with all its nodes
 type Deployment struct {
+	Owner
 	ID             string                 `json:"deployment_id"`
 	Status         DeploymentStatus       `json:"status"`
 	CloudProvider  string                 `json:"cloud_provider"`
 	TotalNodes     int                    `json:"total_nodes"`
 	NodesCompleted int                    `json:"nodes_completed"`
 	NodesFailed    int                    `json:"nodes_failed"`
+	Progress       float64                `json:"progress"` // mean completion percentage of all nodes
+	TemplateID     string                 `json:"template_id,omitempty"`
 	BundlePath     string                 `json:"bundle_path,omitempty"`
+	BundleDigest   string                 `json:"bundle_digest,omitempty"` // sha256 of the bundle nodes download
 	Config         map[string]interface{} `json:"config,omitempty"`
 	CreatedAt      time.Time              `json:"created_at"`
 	UpdatedAt      time.Time              `json:"updated_at"`
 	CompletedAt    *time.Time             `json:"completed_at,omitempty"`
 	ErrorMessage   string                 `json:"error_message,omitempty"`
+	PolicyWarnings []string               `json:"policy_warnings,omitempty"`
+	Report         *DeploymentReport      `json:"report,omitempty"`
+
+	// KeepFailed is how long instances of failed nodes are kept for debugging,
+	// in seconds. KeepFailedUntil is when the last of them will be shut down.
+	KeepFailed      int        `json:"keep_failed,omitempty"`
+	KeepFailedUntil *time.Time `json:"keep_failed_until,omitempty"`
+
+	// ImportedFrom is set for deployments created from an exported archive
+	ImportedFrom *ImportSource `json:"imported_from,omitempty"`
+
+	// UploadID is the ID the CLI gave the upload that created the deployment,
+	// so an interrupted upload can be matched to it
+	UploadID string `json:"upload_id,omitempty"`
+
+	// Variables are the values of the input variables taskfly.yml declares,
+	// as they were substituted into the configuration
+	Variables map[string]interface{} `json:"variables,omitempty"`
+
+	// SensitiveVariables are the names of Variables declared sensitive, whose
+	// values Redacted withholds from the API and trace files, and deployment
+	// archives leave out
+	SensitiveVariables []string `json:"sensitive_variables,omitempty"`
+
+	// Debug turns on verbose logging for the deployment on the daemon and its
+	// agents, and agents keep their working directories
+	Debug bool `json:"debug,omitempty"`
+}
+
+// ImportSource names the deployment an imported deployment was exported from
+type ImportSource struct {
+	DeploymentID string    `json:"deployment_id"`
+	Daemon       string    `json:"daemon,omitempty"`
+	ExportedAt   time.Time `json:"exported_at"`
+}
+
+// DeploymentReport summarizes a finished deployment for sharing
+type DeploymentReport struct {
+	DeploymentID    string           `json:"deployment_id"`
+	Status          DeploymentStatus `json:"status"`
+	CloudProvider   string           `json:"cloud_provider"`
+	TotalNodes      int              `json:"total_nodes"`
+	NodesCompleted  int              `json:"nodes_completed"`
+	NodesFailed     int              `json:"nodes_failed"`
+	CreatedAt       time.Time        `json:"created_at"`
+	CompletedAt     *time.Time       `json:"completed_at,omitempty"`
+	Duration        float64          `json:"duration_seconds"`
+	EstimatedCost   *float64         `json:"estimated_cost_usd,omitempty"`
+	LogsURL         string           `json:"logs_url"`
+	GeneratedAt     time.Time        `json:"generated_at"`
+	Nodes           []NodeReport     `json:"nodes"`
+	Recommendations []Recommendation `json:"recommendations,omitempty"`
+}
+
+// NodeReport summarizes a single node within a deployment report
+type NodeReport struct {
+	NodeID        string       `json:"node_id"`
+	Status        NodeStatus   `json:"status"`
+	InstanceID    string       `json:"instance_id,omitempty"`
+	InstanceType  string       `json:"instance_type,omitempty"`
+	IPAddress     string       `json:"ip_address,omitempty"`
+	StartedAt     *time.Time   `json:"started_at,omitempty"`
+	FinishedAt    *time.Time   `json:"finished_at,omitempty"`
+	Duration      float64      `json:"duration_seconds"`
+	ExitCode      *int         `json:"exit_code,omitempty"`
+	ErrorMessage  string       `json:"error_message,omitempty"`
+	MemoryTotal   uint64       `json:"memory_total,omitempty"`
+	Peak          *PeakMetrics `json:"peak,omitempty"`
+	EstimatedCost *float64     `json:"estimated_cost_usd,omitempty"`
+	LogsURL       string       `json:"logs_url"`
+}
+
+// Recommendation suggests a better fitting instance type based on the peak
+// usage observed on nodes of one instance type
+type Recommendation struct {
+	InstanceType  string  `json:"instance_type"`
+	SuggestedType string  `json:"suggested_type"`
+	Nodes         int     `json:"nodes"`
+	PeakCPU       float64 `json:"peak_cpu"`
+	PeakMemory    float64 `json:"peak_memory_percent"`
+	HourlySavings float64 `json:"hourly_savings_usd"` // per node, negative when the suggestion costs more
+	Message       string  `json:"message"`
 }
 
 // StateStore defines the interface for state storage implementations
@@ -96,45 +338,75 @@ type StateStore interface {
 	GetDeployment(deploymentID string) (*Deployment, error)
 	GetAllDeployments() []*Deployment
 	UpdateDeploymentStatus(deploymentID string, status DeploymentStatus, errorMessage ...string) error
+	SetDeploymentReport(deploymentID string, report *DeploymentReport) error
 	CreateNode(node *Node) error
 	GetNode(nodeID string) (*Node, error)
 	GetNodesByDeployment(deploymentID string) ([]*Node, error)
 	UpdateNodeStatus(deploymentID, nodeID string, status NodeStatus, errorMessage ...string) error
-	UpdateNodeAuthToken(deploymentID, nodeID, authToken string) error
+	RegisterNode(deploymentID, nodeID string, token NodeToken, remoteAddr string) error
+	RetryRegistration(deploymentID, nodeID string, token NodeToken, remoteAddr string, instanceVerified bool) error
+	UpdateNodeAuthToken(deploymentID, nodeID string, token NodeToken) error
+	RotateNodeToken(refreshToken string, token NodeToken) (*Node, error)
 	UpdateNodeLastSeen(deploymentID, nodeID string) error
 	UpdateNodeMessage(deploymentID, nodeID, message string) error
-	UpdateNodeInstanceInfo(deploymentID, nodeID, instanceID, ipAddress string) error
+	UpdateNodeInstanceInfo(deploymentID, nodeID, instanceID, ipAddress, privateIP, ipv6Address, availabilityZone string) error
+	UpdateNodeSystemInfo(deploymentID, nodeID string, info *SystemInfo) error
+	UpdateNodeExitCode(deploymentID, nodeID string, exitCode int) error
+	UpdateNodeProgress(deploymentID, nodeID string, percent float64, message string) error
+	UpdateNodeConfig(deploymentID, nodeID string, config map[string]interface{}) (int, error)
 	MarkNodeForShutdown(deploymentID, nodeID string) error
+	MarkNodeIdle(deploymentID, nodeID, reason string) error
+	QuarantineNode(deploymentID, nodeID string, until time.Time) error
+	SetClaimDeadline(deploymentID, nodeID string, deadline time.Time) error
 	DeleteDeployment(deploymentID string) error
 	GetStats() map[string]interface{}
 
-	// Log management
+	// OnTransition registers a hook called after each status change of a
+	// deployment or node. Status updates the lifecycle doesn't allow fail
+	// with ErrInvalidTransition.
+	OnTransition(hook TransitionHook)
+
+	// Close writes changes that haven't been persisted yet. The store must
+	// not be updated afterwards.
+	Close() error
+
+	// Log management. AppendLogs fails with ErrLogBufferFull when the logs
+	// don't fit in the limits set with SetLogLimits.
 	AppendLogs(deploymentID string, logs []LogEntry) error
 	GetLogs(deploymentID string, nodeID string, since time.Time, limit int) ([]LogEntry, error)
 	ClearLogs(deploymentID string) error
+	SetLogLimits(limits LogLimits)
+
+	// MemoryUsage estimates what the store holds in memory
+	MemoryUsage() MemoryUsage
 
 	// Metrics management
 	UpdateNodeMetrics(deploymentID, nodeID string, metrics *SystemMetrics) error
+	UpdateNodeHealthChecks(deploymentID, nodeID string, checks []HealthCheck) error
+	GetMetricsHistory(deploymentID string, nodeID string) ([]MetricsSample, error)
 }
 
 // Store manages all deployment and node state in memory
 type Store struct {
-	mu                   sync.RWMutex
-	deployments          map[string]*Deployment
-	nodes                map[string]*Node      // key is node_id
-	nodesByDep           map[string][]*Node    // key is deployment_id
-	logs                 map[string][]LogEntry // key is deployment_id, circular buffer
-	maxLogsPerDeployment int
+	mu               sync.RWMutex
+	deployments      map[string]*Deployment
+	nodes            map[string]*Node           // key is node_id
+	nodesByDep       map[string][]*Node         // key is deployment_id
+	logs             *logBuffer                 // key is deployment_id, circular buffer
+	metricsHistory   map[string][]MetricsSample // key is deployment_id, circular buffer
+	maxMetricsPerDep int
+	hooks            transitionHooks
 }
 
 // NewStore creates a new in-memory state store
 func NewStore() *Store {
 	return &Store{
-		deployments:          make(map[string]*Deployment),
-		nodes:                make(map[string]*Node),
-		nodesByDep:           make(map[string][]*Node),
-		logs:                 make(map[string][]LogEntry),
-		maxLogsPerDeployment: 10000, // Keep last 10K log entries per deployment
+		deployments:      make(map[string]*Deployment),
+		nodes:            make(map[string]*Node),
+		nodesByDep:       make(map[string][]*Node),
+		logs:             newLogBuffer(10000), // Keep last 10K log entries per deployment
+		metricsHistory:   make(map[string][]MetricsSample),
+		maxMetricsPerDep: 20000, // Keep last 20K metrics samples per deployment
 	}
 }
 
@@ -155,11 +427,17 @@ func (s *Store) CreateDeployment(deployment *Deployment) error {
 	return nil
 }
 
-// FindNodeByAuthToken finds a node and its deployment by auth token
+// FindNodeByAuthToken finds a node and its deployment by auth token. Expired
+// tokens are rejected.
 func (s *Store) FindNodeByAuthToken(authToken string) (*Node, *Deployment, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	// Unregistered and revoked nodes have no token
+	if authToken == "" {
+		return nil, nil, fmt.Errorf("node with auth token not found")
+	}
+
 	for _, dep := range s.deployments {
 		nodesInDep, ok := s.nodesByDep[dep.ID]
 		if !ok {
@@ -167,6 +445,9 @@ func (s *Store) FindNodeByAuthToken(authToken string) (*Node, *Deployment, error
 		}
 		for _, node := range nodesInDep {
 			if node.AuthToken == authToken {
+				if node.AuthExpiresAt != nil && time.Now().After(*node.AuthExpiresAt) {
+					return nil, nil, fmt.Errorf("auth token of node %s expired", node.NodeID)
+				}
 				// Return copies to be safe
 				nodeCopy := *node
 				depCopy := *dep
@@ -208,6 +489,16 @@ func (s *Store) GetAllDeployments() []*Deployment {
 	return deployments
 }
 
+// OnTransition registers a hook called after each status change
+func (s *Store) OnTransition(hook TransitionHook) {
+	s.hooks.add(hook)
+}
+
+// Close does nothing, the in-memory store has nothing to write
+func (s *Store) Close() error {
+	return nil
+}
+
 // UpdateDeploymentStatus updates the status of a deployment
 func (s *Store) UpdateDeploymentStatus(deploymentID string, status DeploymentStatus, errorMessage ...string) error {
 	s.mu.Lock()
@@ -218,11 +509,17 @@ func (s *Store) UpdateDeploymentStatus(deploymentID string, status DeploymentSta
 		return fmt.Errorf("deployment %s not found", deploymentID)
 	}
 
-	deployment.Status = status
+	message := ""
+	if len(errorMessage) > 0 {
+		message = errorMessage[0]
+	}
+	if err := setDeploymentStatus(&s.hooks, deployment, status, message); err != nil {
+		return err
+	}
 	deployment.UpdatedAt = time.Now()
 
 	if len(errorMessage) > 0 {
-		deployment.ErrorMessage = errorMessage[0]
+		deployment.ErrorMessage = message
 	}
 
 	if status == StatusCompleted || status == StatusFailed || status == StatusTerminated {
@@ -233,6 +530,20 @@ func (s *Store) UpdateDeploymentStatus(deploymentID string, status DeploymentSta
 	return nil
 }
 
+// SetDeploymentReport stores the completion report of a deployment
+func (s *Store) SetDeploymentReport(deploymentID string, report *DeploymentReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deployment, exists := s.deployments[deploymentID]
+	if !exists {
+		return fmt.Errorf("deployment %s not found", deploymentID)
+	}
+
+	deployment.Report = report
+	return nil
+}
+
 // CreateNode creates a new node record
 func (s *Store) CreateNode(node *Node) error {
 	s.mu.Lock()
@@ -243,6 +554,8 @@ func (s *Store) CreateNode(node *Node) error {
 	}
 
 	node.LastUpdate = time.Now()
+	node.StatusChangedAt = node.LastUpdate
+	recordPhase(node, node.Status, "")
 	s.nodes[node.NodeID] = node
 	s.nodesByDep[node.DeploymentID] = append(s.nodesByDep[node.DeploymentID], node)
 
@@ -298,11 +611,18 @@ func (s *Store) UpdateNodeStatus(deploymentID, nodeID string, status NodeStatus,
 		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
 	}
 
-	node.Status = status
+	message := ""
+	if len(errorMessage) > 0 {
+		message = errorMessage[0]
+	}
+	if err := setNodeStatus(&s.hooks, s.deployments[deploymentID], node, status, message); err != nil {
+		return err
+	}
 	node.LastUpdate = time.Now()
 	if len(errorMessage) > 0 {
-		node.ErrorMessage = errorMessage[0]
+		node.ErrorMessage = message
 	}
+	recordNodeTiming(node, status)
 
 	// Update deployment completion counts and status
 	s.checkDeploymentCompletion(deploymentID)
@@ -310,8 +630,29 @@ func (s *Store) UpdateNodeStatus(deploymentID, nodeID string, status NodeStatus,
 	return nil
 }
 
-// UpdateNodeAuthToken updates the auth token of a node
-func (s *Store) UpdateNodeAuthToken(deploymentID, nodeID, authToken string) error {
+// RegisterNode gives a node its first credentials. Provision tokens are single
+// use: it returns ErrAlreadyRegistered if the node registered before.
+func (s *Store) RegisterNode(deploymentID, nodeID string, token NodeToken, remoteAddr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	return claimRegistration(node, token, remoteAddr)
+}
+
+// RetryRegistration replaces the credentials of a node that registered less
+// than RegistrationRetryWindow ago and hasn't sent a heartbeat since, when it
+// registers again from the same address or from its verified instance. It
+// returns ErrAlreadyRegistered otherwise.
+func (s *Store) RetryRegistration(deploymentID, nodeID string, token NodeToken, remoteAddr string, instanceVerified bool) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -324,12 +665,48 @@ func (s *Store) UpdateNodeAuthToken(deploymentID, nodeID, authToken string) erro
 		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
 	}
 
-	node.AuthToken = authToken
+	return retryRegistration(node, token, remoteAddr, instanceVerified)
+}
+
+// UpdateNodeAuthToken replaces the credentials of a node
+func (s *Store) UpdateNodeAuthToken(deploymentID, nodeID string, token NodeToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	node.AuthToken = token.AuthToken
+	node.AuthExpiresAt = token.ExpiresAt
+	node.RefreshToken = token.RefreshToken
+	node.RefreshExpiresAt = token.RefreshExpiresAt
+	node.SigningSecret = token.SigningSecret
 	node.LastUpdate = time.Now()
 	return nil
 }
 
-// UpdateNodeLastSeen updates the last seen time of a node
+// RotateNodeToken replaces the credentials of the node holding refreshToken
+// and returns a copy of the node. Each refresh token is exchanged at most
+// once; an exchanged or expired one gets ErrInvalidRefreshToken.
+func (s *Store) RotateNodeToken(refreshToken string, token NodeToken) (*Node, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := rotateToken(s.nodes, refreshToken, token)
+	if err != nil {
+		return nil, err
+	}
+	nodeCopy := *node
+	return &nodeCopy, nil
+}
+
+// UpdateNodeLastSeen records a heartbeat from a node
 func (s *Store) UpdateNodeLastSeen(deploymentID, nodeID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -343,7 +720,9 @@ func (s *Store) UpdateNodeLastSeen(deploymentID, nodeID string) error {
 		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
 	}
 
-	node.LastUpdate = time.Now()
+	now := time.Now()
+	node.LastUpdate = now
+	node.LastHeartbeat = &now
 	return nil
 }
 
@@ -366,8 +745,8 @@ func (s *Store) UpdateNodeMessage(deploymentID, nodeID, message string) error {
 	return nil
 }
 
-// UpdateNodeInstanceInfo updates the instance ID and IP address of a node
-func (s *Store) UpdateNodeInstanceInfo(deploymentID, nodeID, instanceID, ipAddress string) error {
+// UpdateNodeInstanceInfo updates the instance ID, IP addresses and zone of a node
+func (s *Store) UpdateNodeInstanceInfo(deploymentID, nodeID, instanceID, ipAddress, privateIP, ipv6Address, availabilityZone string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -382,7 +761,74 @@ func (s *Store) UpdateNodeInstanceInfo(deploymentID, nodeID, instanceID, ipAddre
 
 	node.InstanceID = instanceID
 	node.IPAddress = ipAddress
+	node.PrivateIPAddress = privateIP
+	node.IPv6Address = ipv6Address
+	node.AvailabilityZone = availabilityZone
+	node.LastUpdate = time.Now()
+	return nil
+}
+
+// UpdateNodeSystemInfo records the static host facts reported by a node
+func (s *Store) UpdateNodeSystemInfo(deploymentID, nodeID string, info *SystemInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	node.SystemInfo = info
+	if node.AvailabilityZone == "" && info != nil && info.Cloud != nil {
+		// Providers without zone information learn it from the agent
+		node.AvailabilityZone = info.Cloud.AvailabilityZone
+	}
+	node.LastUpdate = time.Now()
+	return nil
+}
+
+// UpdateNodeExitCode records the exit code of a node's workload
+func (s *Store) UpdateNodeExitCode(deploymentID, nodeID string, exitCode int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	node.ExitCode = &exitCode
+	node.LastUpdate = time.Now()
+	return nil
+}
+
+// UpdateNodeProgress records the completion percentage reported by a node's workload
+func (s *Store) UpdateNodeProgress(deploymentID, nodeID string, percent float64, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	node.Progress = &NodeProgress{Percent: percent, Message: message, UpdatedAt: time.Now()}
 	node.LastUpdate = time.Now()
+	if deployment, exists := s.deployments[deploymentID]; exists {
+		deployment.Progress = deploymentProgress(s.nodesByDep[deploymentID])
+	}
 	return nil
 }
 
@@ -405,6 +851,85 @@ func (s *Store) MarkNodeForShutdown(deploymentID, nodeID string) error {
 	return nil
 }
 
+// MarkNodeIdle marks an idle node to be shut down and records why
+func (s *Store) MarkNodeIdle(deploymentID, nodeID, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	now := time.Now()
+	node.ShouldShutdown = true
+	node.ShutdownReason = reason
+	node.ShutdownAt = &now
+	node.LastUpdate = now
+	return nil
+}
+
+// QuarantineNode keeps a node out of automatic shutdown until the given time
+func (s *Store) QuarantineNode(deploymentID, nodeID string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	node.QuarantinedUntil = &until
+	node.LastUpdate = time.Now()
+	return nil
+}
+
+// UpdateNodeConfig replaces the config of a node and returns its new config
+// version
+func (s *Store) UpdateNodeConfig(deploymentID, nodeID string, config map[string]interface{}) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return 0, fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return 0, fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	replaceConfig(node, config)
+	return node.ConfigVersion, nil
+}
+
+// SetClaimDeadline sets when the provision token of a node that hasn't
+// registered yet expires
+func (s *Store) SetClaimDeadline(deploymentID, nodeID string, deadline time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	setClaimDeadline(node, deadline)
+	return nil
+}
+
 // Helper to check if all nodes in a deployment are done
 func (s *Store) checkDeploymentCompletion(deploymentID string) {
 	deployment, exists := s.deployments[deploymentID]
@@ -415,8 +940,7 @@ func (s *Store) checkDeploymentCompletion(deploymentID string) {
 	nodes := s.nodesByDep[deploymentID]
 	completed := 0
 	failed := 0
-	running := 0
-	other := 0
+	active := 0
 
 	for _, node := range nodes {
 		switch node.Status {
@@ -424,34 +948,46 @@ func (s *Store) checkDeploymentCompletion(deploymentID string) {
 			completed++
 		case NodeStatusFailed:
 			failed++
-		case NodeStatusRunning:
-			running++
 		default:
-			other++
+			active++
 		}
 	}
 
 	// Update deployment counters
 	deployment.NodesCompleted = completed
 	deployment.NodesFailed = failed
+	deployment.Progress = deploymentProgress(nodes)
 	deployment.UpdatedAt = time.Now()
 
-	// Update deployment status based on node states
-	if completed+failed == deployment.TotalNodes {
-		// All nodes are done (either completed or failed)
-		if failed > 0 {
-			deployment.Status = StatusFailed
-		} else {
-			deployment.Status = StatusCompleted
-		}
+	// Update deployment status based on node states, unless the deployment
+	// is already finished or being terminated
+	status := completionStatus(deployment, completed, failed, active)
+	if status == deployment.Status || setDeploymentStatus(&s.hooks, deployment, status, "") != nil {
+		return
+	}
+	if status == StatusCompleted || status == StatusFailed {
 		now := time.Now()
 		deployment.CompletedAt = &now
-	} else if running > 0 || other > 0 {
-		// Some nodes are still working
-		if deployment.Status == StatusProvisioning {
-			deployment.Status = StatusRunning
+	}
+}
+
+// deploymentProgress averages the completion percentage over all nodes.
+// Finished nodes count as 100%, nodes that never reported progress as 0%.
+func deploymentProgress(nodes []*Node) float64 {
+	if len(nodes) == 0 {
+		return 0
+	}
+
+	total := 0.0
+	for _, node := range nodes {
+		switch {
+		case node.Status == NodeStatusCompleted || node.Status == NodeStatusFailed:
+			total += 100
+		case node.Progress != nil:
+			total += node.Progress.Percent
 		}
 	}
+	return total / float64(len(nodes))
 }
 
 // DeleteDeployment removes a deployment and all its nodes from the store
@@ -473,8 +1009,10 @@ func (s *Store) DeleteDeployment(deploymentID string) error {
 		delete(s.nodesByDep, deploymentID)
 	}
 
-	// Remove the deployment
+	// Remove the deployment, its metrics history and logs
 	delete(s.deployments, deploymentID)
+	delete(s.metricsHistory, deploymentID)
+	s.logs.clear(deploymentID)
 
 	return nil
 }
@@ -489,15 +1027,10 @@ func (s *Store) GetStats() map[string]interface{} {
 		statusCounts[dep.Status]++
 	}
 
-	totalLogs := 0
-	for _, logs := range s.logs {
-		totalLogs += len(logs)
-	}
-
 	return map[string]interface{}{
 		"total_deployments": len(s.deployments),
 		"total_nodes":       len(s.nodes),
-		"total_logs":        totalLogs,
+		"total_logs":        s.logs.count(),
 		"deployment_status": statusCounts,
 	}
 }
@@ -512,19 +1045,7 @@ func (s *Store) AppendLogs(deploymentID string, logs []LogEntry) error {
 		return fmt.Errorf("deployment %s not found", deploymentID)
 	}
 
-	// Get existing logs
-	existingLogs := s.logs[deploymentID]
-
-	// Append new logs
-	existingLogs = append(existingLogs, logs...)
-
-	// Trim to max size (keep most recent)
-	if len(existingLogs) > s.maxLogsPerDeployment {
-		existingLogs = existingLogs[len(existingLogs)-s.maxLogsPerDeployment:]
-	}
-
-	s.logs[deploymentID] = existingLogs
-	return nil
+	return s.logs.append(deploymentID, logs)
 }
 
 // GetLogs retrieves logs for a deployment, optionally filtered by node and time
@@ -537,31 +1058,7 @@ func (s *Store) GetLogs(deploymentID string, nodeID string, since time.Time, lim
 		return nil, fmt.Errorf("deployment %s not found", deploymentID)
 	}
 
-	allLogs := s.logs[deploymentID]
-	if allLogs == nil {
-		return []LogEntry{}, nil
-	}
-
-	// Filter logs
-	var filtered []LogEntry
-	for _, log := range allLogs {
-		// Filter by node if specified
-		if nodeID != "" && log.NodeID != nodeID {
-			continue
-		}
-		// Filter by time if specified
-		if !since.IsZero() && log.Timestamp.Before(since) {
-			continue
-		}
-		filtered = append(filtered, log)
-	}
-
-	// Apply limit
-	if limit > 0 && len(filtered) > limit {
-		filtered = filtered[len(filtered)-limit:]
-	}
-
-	return filtered, nil
+	return s.logs.filter(deploymentID, nodeID, since, limit), nil
 }
 
 // ClearLogs removes all logs for a deployment
@@ -569,10 +1066,28 @@ func (s *Store) ClearLogs(deploymentID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	delete(s.logs, deploymentID)
+	s.logs.clear(deploymentID)
 	return nil
 }
 
+// SetLogLimits sets how many bytes of logs are kept per deployment and in
+// total. Deployments over the new limit are trimmed on their next append.
+func (s *Store) SetLogLimits(limits LogLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.logs.maxBytes = limits.PerDeployment
+	s.logs.maxTotalBytes = limits.Total
+}
+
+// MemoryUsage estimates what the store holds in memory
+func (s *Store) MemoryUsage() MemoryUsage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return memoryUsage(s.deployments, s.nodesByDep, s.logs, s.metricsHistory)
+}
+
 // UpdateNodeMetrics updates the metrics for a node
 func (s *Store) UpdateNodeMetrics(deploymentID, nodeID string, metrics *SystemMetrics) error {
 	s.mu.Lock()
@@ -589,7 +1104,221 @@ func (s *Store) UpdateNodeMetrics(deploymentID, nodeID string, metrics *SystemMe
 
 	metrics.Timestamp = time.Now()
 	node.Metrics = metrics
+	recordPeakMetrics(node, metrics)
+	s.metricsHistory[deploymentID] = appendMetricsSample(s.metricsHistory[deploymentID],
+		MetricsSample{NodeID: nodeID, SystemMetrics: *metrics}, s.maxMetricsPerDep)
 	node.LastUpdate = time.Now()
 
 	return nil
 }
+
+// recordNodeTiming stamps when a node started running its workload and when
+// it reached a terminal state
+func recordNodeTiming(node *Node, status NodeStatus) {
+	now := time.Now()
+	switch status {
+	case NodeStatusRunning:
+		if node.StartedAt == nil {
+			node.StartedAt = &now
+		}
+	case NodeStatusCompleted, NodeStatusFailed, NodeStatusTerminated:
+		if node.FinishedAt == nil {
+			node.FinishedAt = &now
+		}
+	}
+}
+
+// recordPhase appends a phase change to a node's history, dropping the
+// oldest entries beyond maxPhases
+func recordPhase(node *Node, status NodeStatus, message string) {
+	node.Phases = append(node.Phases, PhaseChange{Status: status, At: node.StatusChangedAt, Message: message})
+	if len(node.Phases) > maxPhases {
+		node.Phases = node.Phases[len(node.Phases)-maxPhases:]
+	}
+}
+
+// rotateToken finds the node holding a refresh token that hasn't expired and
+// replaces its credentials
+func rotateToken(nodes map[string]*Node, refreshToken string, token NodeToken) (*Node, error) {
+	// Unregistered and revoked nodes have no refresh token
+	if refreshToken == "" {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	now := time.Now()
+	for _, node := range nodes {
+		if node.RefreshToken != refreshToken {
+			continue
+		}
+		if node.RefreshExpiresAt != nil && now.After(*node.RefreshExpiresAt) {
+			return nil, fmt.Errorf("%w: refresh token of node %s expired", ErrInvalidRefreshToken, node.NodeID)
+		}
+		node.AuthToken = token.AuthToken
+		node.AuthExpiresAt = token.ExpiresAt
+		node.RefreshToken = token.RefreshToken
+		node.RefreshExpiresAt = token.RefreshExpiresAt
+		node.SigningSecret = token.SigningSecret
+		node.LastUpdate = now
+		return node, nil
+	}
+	return nil, ErrInvalidRefreshToken
+}
+
+// claimRegistration marks a node registered and sets its credentials, unless
+// it registered before or its provision token expired. Nodes registered by
+// older daemons have no RegisteredAt but do have an auth token.
+func claimRegistration(node *Node, token NodeToken, remoteAddr string) error {
+	if Registered(node) {
+		return ErrAlreadyRegistered
+	}
+
+	now := time.Now()
+	if node.ClaimDeadline != nil && now.After(*node.ClaimDeadline) {
+		return ErrProvisionTokenExpired
+	}
+
+	node.RegisteredAt = &now
+	node.RegisteredFrom = remoteAddr
+	node.AuthToken = token.AuthToken
+	node.AuthExpiresAt = token.ExpiresAt
+	node.RefreshToken = token.RefreshToken
+	node.RefreshExpiresAt = token.RefreshExpiresAt
+	node.SigningSecret = token.SigningSecret
+	node.LastUpdate = now
+	return nil
+}
+
+// retryRegistration gives a node that registers again fresh credentials,
+// if it may retry. The first registration's time and address are kept, so
+// retries don't extend the window.
+func retryRegistration(node *Node, token NodeToken, remoteAddr string, instanceVerified bool) error {
+	now := time.Now()
+	if node.RegisteredAt == nil || node.LastHeartbeat != nil || now.Sub(*node.RegisteredAt) > RegistrationRetryWindow {
+		return ErrAlreadyRegistered
+	}
+	if !instanceVerified && node.RegisteredFrom != remoteAddr {
+		return ErrAlreadyRegistered
+	}
+
+	node.AuthToken = token.AuthToken
+	node.AuthExpiresAt = token.ExpiresAt
+	node.RefreshToken = token.RefreshToken
+	node.RefreshExpiresAt = token.RefreshExpiresAt
+	node.SigningSecret = token.SigningSecret
+	node.LastUpdate = now
+	return nil
+}
+
+// Registered reports whether a node has used its provision token
+func Registered(node *Node) bool {
+	return node.RegisteredAt != nil || node.AuthToken != ""
+}
+
+// replaceConfig sets the config of a node and bumps its version. The map is
+// replaced rather than changed, since copies of the node share it.
+func replaceConfig(node *Node, config map[string]interface{}) {
+	node.ConfigVersion++
+
+	// Copies of the node share the sources map, so it is replaced as well
+	sources := make(ConfigSources, len(config))
+	for key, value := range config {
+		if previous, existed := node.Config[key]; existed && reflect.DeepEqual(previous, value) {
+			if source, known := node.ConfigSources[key]; known {
+				sources[key] = source
+			}
+			continue
+		}
+		sources[key] = ConfigSource{From: ConfigFromReconfigure, Overrides: node.ConfigSources[key].From, Version: node.ConfigVersion}
+	}
+
+	node.Config = config
+	node.ConfigSources = sources
+	node.LastUpdate = time.Now()
+}
+
+// setClaimDeadline sets when the provision token of a node expires, unless the
+// node registered already
+func setClaimDeadline(node *Node, deadline time.Time) {
+	if Registered(node) {
+		return
+	}
+	node.ClaimDeadline = &deadline
+	node.LastUpdate = time.Now()
+}
+
+// keepFailedNode quarantines a node that just failed for the deployment's
+// keep_failed window and records when the window ends on the deployment
+func keepFailedNode(deployment *Deployment, node *Node) {
+	if deployment == nil || deployment.KeepFailed <= 0 || node.QuarantinedUntil != nil {
+		return
+	}
+
+	until := time.Now().Add(time.Duration(deployment.KeepFailed) * time.Second)
+	node.QuarantinedUntil = &until
+	if deployment.KeepFailedUntil == nil || until.After(*deployment.KeepFailedUntil) {
+		deployment.KeepFailedUntil = &until
+	}
+}
+
+// recordPeakMetrics folds a metrics sample into the node's peak usage. The
+// peaks are replaced rather than mutated since copies returned by GetNode
+// share the pointer.
+func recordPeakMetrics(node *Node, metrics *SystemMetrics) {
+	peak := PeakMetrics{}
+	if node.PeakMetrics != nil {
+		peak = *node.PeakMetrics
+	}
+	peak.CPUUsage = max(peak.CPUUsage, metrics.CPUUsage)
+	peak.MemoryUsed = max(peak.MemoryUsed, metrics.MemoryUsed)
+	peak.LoadAvg1 = max(peak.LoadAvg1, metrics.LoadAvg1)
+	node.PeakMetrics = &peak
+}
+
+// UpdateNodeHealthChecks replaces the health check results of a node
+func (s *Store) UpdateNodeHealthChecks(deploymentID, nodeID string, checks []HealthCheck) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, exists := s.nodes[nodeID]
+	if !exists {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+
+	if node.DeploymentID != deploymentID {
+		return fmt.Errorf("node %s does not belong to deployment %s", nodeID, deploymentID)
+	}
+
+	node.HealthChecks = checks
+	return nil
+}
+
+// GetMetricsHistory returns the retained metrics samples of a deployment,
+// optionally filtered by node
+func (s *Store) GetMetricsHistory(deploymentID string, nodeID string) ([]MetricsSample, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, exists := s.deployments[deploymentID]; !exists {
+		return nil, fmt.Errorf("deployment %s not found", deploymentID)
+	}
+
+	var samples []MetricsSample
+	for _, sample := range s.metricsHistory[deploymentID] {
+		if nodeID != "" && sample.NodeID != nodeID {
+			continue
+		}
+		samples = append(samples, sample)
+	}
+
+	return samples, nil
+}
+
+// appendMetricsSample adds a sample to a history buffer, dropping the oldest
+// samples beyond limit
+func appendMetricsSample(history []MetricsSample, sample MetricsSample, limit int) []MetricsSample {
+	history = append(history, sample)
+	if len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	return history
+}
@@ -0,0 +1,243 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Deployments and nodes move forward through their lifecycle. A status may
+// skip ahead, since agents can register before the orchestrator learns that
+// their instance is up, but never go back. Finished ones can only be
+// terminated, and terminated ones don't change anymore. Setting the current
+// status again is always allowed; it updates the message.
+
+// deploymentPhases are the active statuses of a deployment in lifecycle order
+var deploymentPhases = []DeploymentStatus{StatusPending, StatusProvisioning, StatusRunning}
+
+// nodePhases are the active statuses of a node in lifecycle order
+var nodePhases = []NodeStatus{
+	NodeStatusPending,
+	NodeStatusProvisioning,
+	NodeStatusBooting,
+	NodeStatusRegistering,
+	NodeStatusDownloading,
+	NodeStatusExtracting,
+	NodeStatusRunning,
+}
+
+// ErrInvalidTransition is matched by the errors of status updates the
+// lifecycle doesn't allow
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// TransitionError is returned when a deployment or node can't change from
+// its status to the requested one
+type TransitionError struct {
+	DeploymentID string
+	NodeID       string // empty for deployments
+	From         string
+	To           string
+}
+
+func (e *TransitionError) Error() string {
+	if e.NodeID != "" {
+		return fmt.Sprintf("node %s cannot change from %s to %s", e.NodeID, e.From, e.To)
+	}
+	return fmt.Sprintf("deployment %s cannot change from %s to %s", e.DeploymentID, e.From, e.To)
+}
+
+// Is makes errors.Is(err, ErrInvalidTransition) match
+func (e *TransitionError) Is(target error) bool {
+	return target == ErrInvalidTransition
+}
+
+// phaseIndex returns the position of status among phases, or -1
+func phaseIndex[S comparable](phases []S, status S) int {
+	for i, phase := range phases {
+		if phase == status {
+			return i
+		}
+	}
+	return -1
+}
+
+// ValidDeploymentStatus reports whether status is a known deployment status
+func ValidDeploymentStatus(status DeploymentStatus) bool {
+	switch status {
+	case StatusCompleted, StatusFailed, StatusTerminating, StatusTerminated:
+		return true
+	}
+	return phaseIndex(deploymentPhases, status) >= 0
+}
+
+// ValidNodeStatus reports whether status is a known node status
+func ValidNodeStatus(status NodeStatus) bool {
+	switch status {
+	case NodeStatusCompleted, NodeStatusFailed, NodeStatusTerminating, NodeStatusTerminated:
+		return true
+	}
+	return phaseIndex(nodePhases, status) >= 0
+}
+
+// CanTransitionDeployment reports whether a deployment may change from one
+// status to another
+func CanTransitionDeployment(from, to DeploymentStatus) bool {
+	if !ValidDeploymentStatus(to) {
+		return false
+	}
+	if from == to || to == StatusTerminated {
+		return true
+	}
+
+	switch from {
+	case StatusCompleted, StatusFailed:
+		return to == StatusTerminating
+	case StatusTerminating, StatusTerminated:
+		return false
+	}
+	switch to {
+	case StatusCompleted, StatusFailed, StatusTerminating:
+		return true
+	}
+	return phaseIndex(deploymentPhases, to) > phaseIndex(deploymentPhases, from)
+}
+
+// CanTransitionNode reports whether a node may change from one status to
+// another
+func CanTransitionNode(from, to NodeStatus) bool {
+	if !ValidNodeStatus(to) {
+		return false
+	}
+	if from == to || to == NodeStatusTerminated {
+		return true
+	}
+
+	switch from {
+	case NodeStatusCompleted, NodeStatusFailed:
+		return to == NodeStatusTerminating
+	case NodeStatusTerminating, NodeStatusTerminated:
+		return false
+	}
+	switch to {
+	case NodeStatusCompleted, NodeStatusFailed, NodeStatusTerminating:
+		return true
+	}
+	return phaseIndex(nodePhases, to) > phaseIndex(nodePhases, from)
+}
+
+// Transition is a status change of a deployment, or of one of its nodes if
+// NodeID is set
+type Transition struct {
+	DeploymentID string
+	NodeID       string
+	From         string
+	To           string
+	Message      string
+	At           time.Time
+}
+
+// TransitionHook is called after a status change was stored
+type TransitionHook func(Transition)
+
+// transitionHooks delivers the transitions of a store to its hooks. They are
+// called one at a time on their own goroutine, in the order the transitions
+// happened, so they may use the store.
+type transitionHooks struct {
+	mu      sync.Mutex
+	hooks   []TransitionHook
+	pending []Transition
+	wake    chan struct{}
+}
+
+// add registers a hook and starts delivery with the first one
+func (h *transitionHooks) add(hook TransitionHook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hooks = append(h.hooks, hook)
+	if h.wake == nil {
+		h.wake = make(chan struct{}, 1)
+		go h.deliver()
+	}
+}
+
+// emit queues a transition for the hooks. It never blocks, so it can be
+// called with the store locked.
+func (h *transitionHooks) emit(transition Transition) {
+	h.mu.Lock()
+	if len(h.hooks) == 0 {
+		h.mu.Unlock()
+		return
+	}
+	h.pending = append(h.pending, transition)
+	h.mu.Unlock()
+
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver calls the hooks with the queued transitions
+func (h *transitionHooks) deliver() {
+	for range h.wake {
+		h.mu.Lock()
+		pending, hooks := h.pending, h.hooks
+		h.pending = nil
+		h.mu.Unlock()
+
+		for _, transition := range pending {
+			for _, hook := range hooks {
+				hook(transition)
+			}
+		}
+	}
+}
+
+// setDeploymentStatus changes the status of a deployment if the lifecycle
+// allows it and queues the transition for the hooks
+func setDeploymentStatus(hooks *transitionHooks, deployment *Deployment, status DeploymentStatus, message string) error {
+	from := deployment.Status
+	if !CanTransitionDeployment(from, status) {
+		return &TransitionError{DeploymentID: deployment.ID, From: string(from), To: string(status)}
+	}
+	deployment.Status = status
+	if from != status {
+		hooks.emit(Transition{DeploymentID: deployment.ID, From: string(from), To: string(status), Message: message, At: time.Now()})
+	}
+	return nil
+}
+
+// setNodeStatus changes the status of a node if the lifecycle allows it,
+// records the phase change and queues the transition for the hooks. The
+// deployment of the node may be nil.
+func setNodeStatus(hooks *transitionHooks, deployment *Deployment, node *Node, status NodeStatus, message string) error {
+	from := node.Status
+	if !CanTransitionNode(from, status) {
+		return &TransitionError{DeploymentID: node.DeploymentID, NodeID: node.NodeID, From: string(from), To: string(status)}
+	}
+	if from != status {
+		node.StatusChangedAt = time.Now()
+		recordPhase(node, status, message)
+		if status == NodeStatusFailed {
+			keepFailedNode(deployment, node)
+		}
+		hooks.emit(Transition{DeploymentID: node.DeploymentID, NodeID: node.NodeID, From: string(from), To: string(status), Message: message, At: node.StatusChangedAt})
+	}
+	node.Status = status
+	return nil
+}
+
+// completionStatus derives the status of a deployment from its nodes, or
+// returns its current status if the nodes don't change it
+func completionStatus(deployment *Deployment, completed, failed, active int) DeploymentStatus {
+	switch {
+	case completed+failed == deployment.TotalNodes && failed > 0:
+		return StatusFailed
+	case completed+failed == deployment.TotalNodes:
+		return StatusCompleted
+	case active > 0 && deployment.Status == StatusProvisioning:
+		return StatusRunning
+	}
+	return deployment.Status
+}
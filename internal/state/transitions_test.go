@@ -0,0 +1,95 @@
+package state
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanTransitionNode(t *testing.T) {
+	allowed := [][2]NodeStatus{
+		{NodeStatusPending, NodeStatusProvisioning},
+		{NodeStatusProvisioning, NodeStatusRegistering}, // agent registered before provisioning returned
+		{NodeStatusRunning, NodeStatusRunning},
+		{NodeStatusRunning, NodeStatusCompleted},
+		{NodeStatusBooting, NodeStatusFailed},
+		{NodeStatusFailed, NodeStatusTerminating},
+		{NodeStatusCompleted, NodeStatusTerminated},
+		{NodeStatusTerminated, NodeStatusTerminated},
+	}
+	for _, transition := range allowed {
+		assert.True(t, CanTransitionNode(transition[0], transition[1]), "%s to %s", transition[0], transition[1])
+	}
+
+	rejected := [][2]NodeStatus{
+		{NodeStatusTerminated, NodeStatusRunning},
+		{NodeStatusRegistering, NodeStatusBooting},
+		{NodeStatusFailed, NodeStatusCompleted},
+		{NodeStatusCompleted, NodeStatusRunning},
+		{NodeStatusTerminating, NodeStatusFailed},
+		{NodeStatusRunning, "bogus"},
+	}
+	for _, transition := range rejected {
+		assert.False(t, CanTransitionNode(transition[0], transition[1]), "%s to %s", transition[0], transition[1])
+	}
+}
+
+func TestCanTransitionDeployment(t *testing.T) {
+	assert.True(t, CanTransitionDeployment(StatusPending, StatusFailed))
+	assert.True(t, CanTransitionDeployment(StatusProvisioning, StatusRunning))
+	assert.True(t, CanTransitionDeployment(StatusCompleted, StatusTerminated))
+	assert.False(t, CanTransitionDeployment(StatusFailed, StatusRunning))
+	assert.False(t, CanTransitionDeployment(StatusRunning, StatusProvisioning))
+	assert.False(t, CanTransitionDeployment(StatusTerminated, StatusCompleted))
+}
+
+func TestStoreRejectsInvalidTransitions(t *testing.T) {
+	store := NewStore()
+
+	var mu sync.Mutex
+	var transitions []Transition
+	store.OnTransition(func(transition Transition) {
+		mu.Lock()
+		defer mu.Unlock()
+		transitions = append(transitions, transition)
+	})
+
+	require.NoError(t, store.CreateDeployment(&Deployment{ID: "dep_1", Status: StatusProvisioning, TotalNodes: 1}))
+	require.NoError(t, store.CreateNode(&Node{NodeID: "node_0", DeploymentID: "dep_1", Status: NodeStatusPending}))
+
+	require.NoError(t, store.UpdateNodeStatus("dep_1", "node_0", NodeStatusRunning))
+	require.NoError(t, store.UpdateNodeStatus("dep_1", "node_0", NodeStatusFailed, "exit code 1"))
+
+	err := store.UpdateNodeStatus("dep_1", "node_0", NodeStatusRunning)
+	assert.ErrorIs(t, err, ErrInvalidTransition)
+	assert.EqualError(t, err, "node node_0 cannot change from failed to running")
+
+	// The last node failing finished the deployment, which can't run again
+	err = store.UpdateDeploymentStatus("dep_1", StatusRunning)
+	assert.EqualError(t, err, "deployment dep_1 cannot change from failed to running")
+	deployment, err := store.GetDeployment("dep_1")
+	require.NoError(t, err)
+	assert.Equal(t, StatusFailed, deployment.Status)
+
+	// Hooks see each change once, in order
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(transitions) == 4
+	}, time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, Transition{DeploymentID: "dep_1", NodeID: "node_0", From: "pending", To: "running"}, withoutTime(transitions[0]))
+	assert.Equal(t, Transition{DeploymentID: "dep_1", From: "provisioning", To: "running"}, withoutTime(transitions[1]))
+	assert.Equal(t, Transition{DeploymentID: "dep_1", NodeID: "node_0", From: "running", To: "failed", Message: "exit code 1"}, withoutTime(transitions[2]))
+	assert.Equal(t, Transition{DeploymentID: "dep_1", From: "running", To: "failed"}, withoutTime(transitions[3]))
+}
+
+// withoutTime clears the time of a transition for comparison
+func withoutTime(transition Transition) Transition {
+	transition.At = time.Time{}
+	return transition
+}
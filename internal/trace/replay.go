@@ -0,0 +1,145 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+)
+
+// credentialKeys are the response fields carrying node credentials, which
+// differ between the recording and the replay
+var credentialKeys = []string{"auth_token", "refresh_token"}
+
+// Result is the outcome of replaying one trace entry
+type Result struct {
+	Entry  *Entry
+	Status int      // status the replay answered, zero for snapshots
+	After  *After   // replayed state, nil for snapshots
+	Diffs  []string // how the replay differs from the recording
+}
+
+// Replayer sends the requests of a trace to a daemon's node API handler
+// backed by an in-memory store
+type Replayer struct {
+	store      *state.Store
+	handler    http.Handler
+	bundlePath string
+
+	// tokens maps the credentials handed out during the recording to the
+	// ones handed out during the replay
+	tokens map[string]string
+}
+
+// NewReplayer creates a replayer. Deployments are restored with bundlePath
+// as their bundle, so asset downloads succeed without the original bundle.
+func NewReplayer(store *state.Store, handler http.Handler, bundlePath string) *Replayer {
+	return &Replayer{
+		store:      store,
+		handler:    handler,
+		bundlePath: bundlePath,
+		tokens:     make(map[string]string),
+	}
+}
+
+// Step replays a single entry: it restores a snapshot, or sends a request and
+// compares the response and resulting state with the recorded ones
+func (r *Replayer) Step(entry *Entry) (*Result, error) {
+	if entry.Snapshot != nil {
+		return &Result{Entry: entry}, r.restore(entry.Snapshot)
+	}
+	if entry.Request == nil {
+		return nil, fmt.Errorf("trace entry at %s has neither a snapshot nor a request", entry.At)
+	}
+
+	recorded := entry.Request
+	target := recorded.Path
+	if recorded.Query != "" {
+		target += "?" + recorded.Query
+	}
+	req := httptest.NewRequest(recorded.Method, target, strings.NewReader(r.substitute(recorded.Body)))
+	if recorded.Authorization != "" {
+		req.Header.Set("Authorization", r.substitute(recorded.Authorization))
+	}
+	if recorded.ContentType != "" {
+		req.Header.Set("Content-Type", recorded.ContentType)
+	}
+	rec := httptest.NewRecorder()
+	r.handler.ServeHTTP(rec, req)
+
+	result := &Result{Entry: entry, Status: rec.Code}
+	if rec.Code != recorded.Status {
+		result.Diffs = append(result.Diffs, fmt.Sprintf("answered %d, recorded %d", rec.Code, recorded.Status))
+	}
+	r.learnCredentials(recorded.Response, rec.Body.Bytes())
+
+	if entry.After != nil {
+		result.After = Capture(r.store, entry.After.DeploymentID, entry.After.NodeID)
+		result.Diffs = append(result.Diffs, entry.After.Diff(result.After)...)
+	}
+	return result, nil
+}
+
+// restore replaces a deployment and its nodes with a snapshot of them.
+// Token expiry is dropped, since it was relative to the time of recording.
+func (r *Replayer) restore(snap *Snapshot) error {
+	if snap.Deployment == nil {
+		return fmt.Errorf("snapshot has no deployment")
+	}
+	dep := snap.Deployment
+	if _, err := r.store.GetDeployment(dep.ID); err == nil {
+		if err := r.store.DeleteDeployment(dep.ID); err != nil {
+			return err
+		}
+	}
+
+	createdAt := dep.CreatedAt
+	if r.bundlePath != "" {
+		dep.BundlePath = r.bundlePath
+	}
+	if err := r.store.CreateDeployment(dep); err != nil {
+		return err
+	}
+	dep.CreatedAt = createdAt
+
+	for _, node := range snap.Nodes {
+		phases := node.Phases
+		node.AuthExpiresAt = nil
+		node.RefreshExpiresAt = nil
+		if err := r.store.CreateNode(node); err != nil {
+			return err
+		}
+		node.Phases = phases
+	}
+
+	// Credentials of restored nodes are the recorded ones again
+	r.tokens = make(map[string]string)
+	return nil
+}
+
+// substitute replaces recorded credentials with the replayed ones
+func (r *Replayer) substitute(text string) string {
+	for recorded, replayed := range r.tokens {
+		text = strings.ReplaceAll(text, recorded, replayed)
+	}
+	return text
+}
+
+// learnCredentials maps the credentials of a recorded registration or token
+// refresh to the ones the replay handed out instead
+func (r *Replayer) learnCredentials(recordedBody string, replayedBody []byte) {
+	var recorded, replayed map[string]interface{}
+	if json.Unmarshal([]byte(recordedBody), &recorded) != nil || json.Unmarshal(replayedBody, &replayed) != nil {
+		return
+	}
+	for _, key := range credentialKeys {
+		from, _ := recorded[key].(string)
+		to, _ := replayed[key].(string)
+		if from != "" && to != "" {
+			r.tokens[from] = to
+		}
+	}
+}
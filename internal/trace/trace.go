@@ -0,0 +1,194 @@
+// Package trace records the node-facing API traffic of deployments to trace
+// files and replays them against a fresh state store, to reproduce state
+// machine bugs outside the daemon they happened on
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+)
+
+// FileSuffix is the suffix of trace files, which are named after their
+// deployment
+const FileSuffix = ".trace.jsonl"
+
+// maxLine bounds a single entry when reading a trace, such as a large log push
+const maxLine = 64 << 20
+
+// Entry is one line of a trace: either a snapshot of the deployment or a
+// request a node made
+type Entry struct {
+	At       time.Time `json:"at"`
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+	Request  *Request  `json:"request,omitempty"`
+	After    *After    `json:"after,omitempty"` // state once the request was handled
+}
+
+// Snapshot is the deployment and its nodes as stored when recording started
+type Snapshot struct {
+	Deployment *state.Deployment `json:"deployment"`
+	Nodes      []*state.Node     `json:"nodes"`
+}
+
+// Request is a node's API request and the daemon's response. Signatures
+// aren't kept since they can't be verified again.
+type Request struct {
+	Method        string `json:"method"`
+	Path          string `json:"path"`
+	Query         string `json:"query,omitempty"`
+	Authorization string `json:"authorization,omitempty"`
+	ContentType   string `json:"content_type,omitempty"`
+	Body          string `json:"body,omitempty"`
+	Status        int    `json:"status"`
+	Response      string `json:"response,omitempty"` // omitted for downloads
+}
+
+// After is the state of the requesting node and its deployment after a
+// request
+type After struct {
+	DeploymentID     string                 `json:"deployment_id"`
+	NodeID           string                 `json:"node_id"`
+	NodeStatus       state.NodeStatus       `json:"node_status"`
+	Shutdown         bool                   `json:"shutdown"`
+	DeploymentStatus state.DeploymentStatus `json:"deployment_status"`
+}
+
+// Capture reads the state of a node and its deployment from a store
+func Capture(store state.StateStore, deploymentID, nodeID string) *After {
+	after := &After{DeploymentID: deploymentID, NodeID: nodeID}
+	if node, err := store.GetNode(nodeID); err == nil {
+		after.NodeStatus = node.Status
+		after.Shutdown = node.ShouldShutdown
+	}
+	if dep, err := store.GetDeployment(deploymentID); err == nil {
+		after.DeploymentStatus = dep.Status
+	}
+	return after
+}
+
+// Diff lists how the state after a replayed request differs from the
+// recorded one
+func (a *After) Diff(replayed *After) []string {
+	var diffs []string
+	if a.NodeStatus != replayed.NodeStatus {
+		diffs = append(diffs, fmt.Sprintf("node %s is %s, recorded %s", a.NodeID, replayed.NodeStatus, a.NodeStatus))
+	}
+	if a.Shutdown != replayed.Shutdown {
+		diffs = append(diffs, fmt.Sprintf("node %s shutdown is %t, recorded %t", a.NodeID, replayed.Shutdown, a.Shutdown))
+	}
+	if a.DeploymentStatus != replayed.DeploymentStatus {
+		diffs = append(diffs, fmt.Sprintf("deployment is %s, recorded %s", replayed.DeploymentStatus, a.DeploymentStatus))
+	}
+	return diffs
+}
+
+// Recorder appends node traffic to one trace file per deployment in a
+// directory. Trace files hold node credentials and are only readable by the
+// daemon's user.
+type Recorder struct {
+	dir string
+
+	mu      sync.Mutex
+	started map[string]bool // deployments snapshotted by this recorder
+}
+
+// NewRecorder creates a recorder writing to dir
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create trace directory: %w", err)
+	}
+	return &Recorder{dir: dir, started: make(map[string]bool)}, nil
+}
+
+// Path returns the trace file of a deployment
+func (r *Recorder) Path(deploymentID string) string {
+	return filepath.Join(r.dir, deploymentID+FileSuffix)
+}
+
+// Begin writes a snapshot of a deployment before its first request recorded
+// by this recorder. A daemon restarted with recording appends a new snapshot,
+// which the replay resumes from. The values of sensitive variables are left
+// out of the snapshot.
+func (r *Recorder) Begin(deploymentID string, snapshot func() (*Snapshot, error)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.started[deploymentID] {
+		return nil
+	}
+	snap, err := snapshot()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot deployment %s: %w", deploymentID, err)
+	}
+	if snap.Deployment != nil {
+		snap.Deployment = snap.Deployment.Redacted()
+	}
+	if err := r.append(deploymentID, &Entry{At: time.Now(), Snapshot: snap}); err != nil {
+		return err
+	}
+	r.started[deploymentID] = true
+	return nil
+}
+
+// Record appends a request to the trace of a deployment. Callers redact
+// sensitive values from the bodies with Deployment.Redact.
+func (r *Recorder) Record(deploymentID string, entry *Entry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.append(deploymentID, entry)
+}
+
+func (r *Recorder) append(deploymentID string, entry *Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode trace entry: %w", err)
+	}
+
+	file, err := os.OpenFile(r.Path(deploymentID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open trace file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write trace entry: %w", err)
+	}
+	return nil
+}
+
+// ReadFile reads the entries of a trace file
+func ReadFile(path string) ([]*Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace: %w", err)
+	}
+	defer file.Close()
+
+	var entries []*Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLine)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("invalid trace entry on line %d: %w", line, err)
+		}
+		entries = append(entries, &entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read trace: %w", err)
+	}
+	if len(entries) == 0 || entries[0].Snapshot == nil {
+		return nil, fmt.Errorf("trace does not start with a deployment snapshot")
+	}
+	return entries, nil
+}
@@ -0,0 +1,171 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nodeAPI is a minimal node API that hands out a new auth token on every
+// registration, like the daemon does
+func nodeAPI(store *state.Store) http.Handler {
+	issued := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/nodes/register", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ProvisionToken string `json:"provision_token"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		for _, node := range mustNodes(store, "dep_1") {
+			if node.ProvisionToken != req.ProvisionToken {
+				continue
+			}
+			issued++
+			token := state.NodeToken{AuthToken: fmt.Sprintf("auth-%d-%d", issued, time.Now().UnixNano())}
+			if err := store.RegisterNode("dep_1", node.NodeID, token, ""); err != nil {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			store.UpdateNodeStatus("dep_1", node.NodeID, state.NodeStatusRegistering)
+			json.NewEncoder(w).Encode(map[string]string{"auth_token": token.AuthToken})
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	mux.HandleFunc("/api/v1/nodes/status", func(w http.ResponseWriter, r *http.Request) {
+		node, dep, err := store.FindNodeByAuthToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Status state.NodeStatus `json:"status"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		store.UpdateNodeStatus(dep.ID, node.NodeID, req.Status)
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+	return mux
+}
+
+func mustNodes(store *state.Store, deploymentID string) []*state.Node {
+	nodes, _ := store.GetNodesByDeployment(deploymentID)
+	return nodes
+}
+
+func testSnapshot() *Snapshot {
+	return &Snapshot{
+		Deployment: &state.Deployment{ID: "dep_1", Status: state.StatusRunning, TotalNodes: 1},
+		Nodes: []*state.Node{
+			{NodeID: "node_0", DeploymentID: "dep_1", Status: state.NodeStatusBooting, ProvisionToken: "pt_0"},
+		},
+	}
+}
+
+func TestRecorderWritesTrace(t *testing.T) {
+	recorder, err := NewRecorder(t.TempDir())
+	require.NoError(t, err)
+
+	snapshots := 0
+	snapshot := func() (*Snapshot, error) {
+		snapshots++
+		return testSnapshot(), nil
+	}
+	require.NoError(t, recorder.Begin("dep_1", snapshot))
+	require.NoError(t, recorder.Begin("dep_1", snapshot))
+	require.NoError(t, recorder.Record("dep_1", &Entry{
+		At:      time.Now(),
+		Request: &Request{Method: http.MethodPost, Path: "/api/v1/nodes/heartbeat", Status: http.StatusOK},
+		After:   &After{DeploymentID: "dep_1", NodeID: "node_0", NodeStatus: state.NodeStatusRunning},
+	}))
+	assert.Equal(t, 1, snapshots)
+
+	info, err := os.Stat(recorder.Path("dep_1"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	entries, err := ReadFile(recorder.Path("dep_1"))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "dep_1", entries[0].Snapshot.Deployment.ID)
+	assert.Equal(t, "/api/v1/nodes/heartbeat", entries[1].Request.Path)
+	assert.Equal(t, state.NodeStatusRunning, entries[1].After.NodeStatus)
+}
+
+func TestReadFileRequiresSnapshot(t *testing.T) {
+	path := t.TempDir() + "/dep_1" + FileSuffix
+	require.NoError(t, os.WriteFile(path, []byte(`{"request":{"method":"POST","path":"/api/v1/nodes/status","status":200}}`+"\n"), 0600))
+	_, err := ReadFile(path)
+	assert.ErrorContains(t, err, "snapshot")
+}
+
+func TestReplayerMapsCredentials(t *testing.T) {
+	store := state.NewStore()
+	replayer := NewReplayer(store, nodeAPI(store), "")
+
+	entries := []*Entry{
+		{Snapshot: testSnapshot()},
+		{
+			Request: &Request{Method: http.MethodPost, Path: "/api/v1/nodes/register", Body: `{"provision_token":"pt_0"}`, Status: http.StatusOK, Response: `{"auth_token":"auth-recorded"}`},
+			After:   &After{DeploymentID: "dep_1", NodeID: "node_0", NodeStatus: state.NodeStatusRegistering, DeploymentStatus: state.StatusRunning},
+		},
+		{
+			Request: &Request{Method: http.MethodPost, Path: "/api/v1/nodes/status", Authorization: "Bearer auth-recorded", Body: `{"status":"running"}`, Status: http.StatusOK},
+			After:   &After{DeploymentID: "dep_1", NodeID: "node_0", NodeStatus: state.NodeStatusRunning, DeploymentStatus: state.StatusRunning},
+		},
+	}
+	for _, entry := range entries {
+		result, err := replayer.Step(entry)
+		require.NoError(t, err)
+		assert.Empty(t, result.Diffs)
+	}
+
+	node, err := store.GetNode("node_0")
+	require.NoError(t, err)
+	assert.Equal(t, state.NodeStatusRunning, node.Status)
+}
+
+func TestReplayerReportsDivergence(t *testing.T) {
+	store := state.NewStore()
+	replayer := NewReplayer(store, nodeAPI(store), "")
+	_, err := replayer.Step(&Entry{Snapshot: testSnapshot()})
+	require.NoError(t, err)
+
+	// The recording saw the node fail, but replaying its status update
+	// without a registration is rejected
+	result, err := replayer.Step(&Entry{
+		Request: &Request{Method: http.MethodPost, Path: "/api/v1/nodes/status", Authorization: "Bearer auth-unknown", Body: `{"status":"failed"}`, Status: http.StatusOK},
+		After:   &After{DeploymentID: "dep_1", NodeID: "node_0", NodeStatus: state.NodeStatusFailed, DeploymentStatus: state.StatusRunning},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, result.Status)
+	assert.Equal(t, []string{
+		"answered 401, recorded 200",
+		"node node_0 is booting, recorded failed",
+	}, result.Diffs)
+}
+
+func TestRecorderRedactsSnapshot(t *testing.T) {
+	recorder, err := NewRecorder(t.TempDir())
+	require.NoError(t, err)
+
+	require.NoError(t, recorder.Begin("dep_1", func() (*Snapshot, error) {
+		snap := testSnapshot()
+		snap.Deployment.Variables = map[string]interface{}{"api_key": "hunter2"}
+		snap.Deployment.SensitiveVariables = []string{"api_key"}
+		snap.Deployment.Config = map[string]interface{}{"user_data": "API_KEY=hunter2"}
+		return snap, nil
+	}))
+
+	data, err := os.ReadFile(recorder.Path("dep_1"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "hunter2")
+}
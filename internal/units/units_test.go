@@ -0,0 +1,15 @@
+package units
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "0 B", FormatSize(0))
+	assert.Equal(t, "1023 B", FormatSize(1023))
+	assert.Equal(t, "1.0 KiB", FormatSize(1024))
+	assert.Equal(t, "1.5 MiB", FormatSize(3<<19))
+	assert.Equal(t, "2.0 GiB", FormatSize(2<<30))
+}
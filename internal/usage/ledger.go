@@ -0,0 +1,302 @@
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/cloud"
+	"github.com/JustinTimperio/TaskFly/internal/state"
+)
+
+// LedgerRetention is how long stopped node records are kept, long enough
+// for year-over-year monthly reports
+const LedgerRetention = 400 * 24 * time.Hour
+
+// NodeRecord is the lifetime of one node as observed by the daemon
+type NodeRecord struct {
+	NodeID       string `json:"node_id"`
+	DeploymentID string `json:"deployment_id"`
+	state.Owner
+	Provider     string            `json:"provider"`
+	InstanceType string            `json:"instance_type,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"` // of the node's deployment
+	StartedAt    time.Time         `json:"started_at"`
+	StoppedAt    *time.Time        `json:"stopped_at,omitempty"`
+	LastSeen     time.Time         `json:"last_seen"`
+}
+
+// ActiveNode describes a node currently occupying an instance
+type ActiveNode struct {
+	NodeID       string
+	DeploymentID string
+	Owner        state.Owner
+	Provider     string
+	InstanceType string
+	Labels       map[string]string
+}
+
+// InstanceUsage is the node time of one provider and instance type
+type InstanceUsage struct {
+	Provider      string   `json:"provider"`
+	InstanceType  string   `json:"instance_type"`
+	NodeHours     float64  `json:"node_hours"`
+	EstimatedCost *float64 `json:"estimated_cost_usd,omitempty"`
+}
+
+// LabelUsage is the node time of deployments carrying one label
+type LabelUsage struct {
+	Label             string  `json:"label"`
+	Value             string  `json:"value"`
+	NodeHours         float64 `json:"node_hours"`
+	EstimatedCost     float64 `json:"estimated_cost_usd"`
+	UnpricedNodeHours float64 `json:"unpriced_node_hours,omitempty"`
+}
+
+// Ledger records start and stop times of nodes so node hours survive the
+// deployments they belonged to
+type Ledger struct {
+	mu      sync.Mutex
+	records map[string]*NodeRecord // key is node_id
+	path    string
+}
+
+// NewLedger creates a ledger persisted to path, loading existing records
+func NewLedger(path string) (*Ledger, error) {
+	l := &Ledger{
+		records: make(map[string]*NodeRecord),
+		path:    path,
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read node ledger: %w", err)
+	}
+
+	var records []*NodeRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse node ledger: %w", err)
+	}
+	for _, record := range records {
+		l.records[record.NodeID] = record
+	}
+
+	return l, nil
+}
+
+// Observe opens records for newly active nodes and closes records of nodes
+// that are no longer active. Stopped nodes are closed at the last time they
+// were seen active, so accuracy is bounded by the observation interval.
+func (l *Ledger) Observe(now time.Time, active []ActiveNode) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	seen := make(map[string]bool, len(active))
+	for _, node := range active {
+		seen[node.NodeID] = true
+
+		record, exists := l.records[node.NodeID]
+		if !exists || record.StoppedAt != nil {
+			record = &NodeRecord{
+				NodeID:       node.NodeID,
+				DeploymentID: node.DeploymentID,
+				Owner:        node.Owner,
+				Provider:     node.Provider,
+				Labels:       node.Labels,
+				StartedAt:    now,
+			}
+			l.records[node.NodeID] = record
+		}
+		record.LastSeen = now
+		if node.InstanceType != "" {
+			record.InstanceType = node.InstanceType
+		}
+	}
+
+	for nodeID, record := range l.records {
+		if record.StoppedAt == nil && !seen[nodeID] {
+			stoppedAt := record.LastSeen
+			record.StoppedAt = &stoppedAt
+		}
+	}
+}
+
+// Save drops records stopped before the retention period and writes the
+// rest to disk
+func (l *Ledger) Save() error {
+	l.mu.Lock()
+	cutoff := time.Now().Add(-LedgerRetention)
+	records := make([]NodeRecord, 0, len(l.records))
+	for nodeID, record := range l.records {
+		if record.StoppedAt != nil && record.StoppedAt.Before(cutoff) {
+			delete(l.records, nodeID)
+			continue
+		}
+		records = append(records, *record)
+	}
+	l.mu.Unlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].StartedAt.Before(records[j].StartedAt)
+	})
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal node ledger: %w", err)
+	}
+
+	// Write to temp file first, then atomically rename
+	tempFile := l.path + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write temp node ledger: %w", err)
+	}
+	if err := os.Rename(tempFile, l.path); err != nil {
+		return fmt.Errorf("failed to rename node ledger: %w", err)
+	}
+
+	return nil
+}
+
+// hoursIn returns copies of all records overlapping [since, until), clamped
+// to the window. Open records run until now.
+func (l *Ledger) hoursIn(since, until time.Time, now time.Time) []NodeRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var overlapping []NodeRecord
+	for _, record := range l.records {
+		end := now
+		if record.StoppedAt != nil {
+			end = *record.StoppedAt
+		}
+		start := record.StartedAt
+		if start.Before(since) {
+			start = since
+		}
+		if end.After(until) {
+			end = until
+		}
+		if !end.After(start) {
+			continue
+		}
+
+		clamped := *record
+		clamped.StartedAt = start
+		clamped.StoppedAt = &end
+		overlapping = append(overlapping, clamped)
+	}
+
+	return overlapping
+}
+
+// Summarize combines request counters and node hours for [since, until)
+// into per-owner entries and breakdowns by provider and instance type and by
+// deployment label, limited to namespace unless it is empty. Spend is estimated from on-demand
+// prices; node hours of instance types without a known price are reported
+// separately.
+func Summarize(t *Tracker, l *Ledger, since, until time.Time, namespace string) ([]Entry, []InstanceUsage, []LabelUsage) {
+	entries := make(map[state.Owner]*Entry)
+	entry := func(owner state.Owner) *Entry {
+		if entries[owner] == nil {
+			entries[owner] = &Entry{Owner: owner}
+		}
+		return entries[owner]
+	}
+
+	for owner, counters := range t.totals(since, until) {
+		if namespace != "" && owner.Namespace != namespace {
+			continue
+		}
+		e := entry(owner)
+		e.Requests = counters.Requests
+		e.BundleBytes = counters.BundleBytes
+	}
+
+	type instanceKey struct{ provider, instanceType string }
+	instances := make(map[instanceKey]*InstanceUsage)
+	type labelKey struct{ label, value string }
+	labels := make(map[labelKey]*LabelUsage)
+
+	for _, record := range l.hoursIn(since, until, time.Now()) {
+		if namespace != "" && record.Namespace != namespace {
+			continue
+		}
+		hours := record.StoppedAt.Sub(record.StartedAt).Hours()
+		price, priced := cloud.HourlyPrice(record.Provider, record.InstanceType)
+
+		e := entry(record.Owner)
+		e.NodeHours += hours
+		if priced {
+			e.EstimatedCost += hours * price
+		} else {
+			e.UnpricedNodeHours += hours
+		}
+
+		key := instanceKey{record.Provider, record.InstanceType}
+		usage, ok := instances[key]
+		if !ok {
+			usage = &InstanceUsage{Provider: record.Provider, InstanceType: record.InstanceType}
+			if priced {
+				usage.EstimatedCost = new(float64)
+			}
+			instances[key] = usage
+		}
+		usage.NodeHours += hours
+		if priced {
+			*usage.EstimatedCost += hours * price
+		}
+
+		for label, value := range record.Labels {
+			key := labelKey{label, value}
+			usage, ok := labels[key]
+			if !ok {
+				usage = &LabelUsage{Label: label, Value: value}
+				labels[key] = usage
+			}
+			usage.NodeHours += hours
+			if priced {
+				usage.EstimatedCost += hours * price
+			} else {
+				usage.UnpricedNodeHours += hours
+			}
+		}
+	}
+
+	ownerEntries := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		ownerEntries = append(ownerEntries, *e)
+	}
+	sort.Slice(ownerEntries, func(i, j int) bool {
+		if ownerEntries[i].Namespace != ownerEntries[j].Namespace {
+			return ownerEntries[i].Namespace < ownerEntries[j].Namespace
+		}
+		return ownerEntries[i].APIKeyID < ownerEntries[j].APIKeyID
+	})
+
+	instanceUsage := make([]InstanceUsage, 0, len(instances))
+	for _, usage := range instances {
+		instanceUsage = append(instanceUsage, *usage)
+	}
+	sort.Slice(instanceUsage, func(i, j int) bool {
+		return instanceUsage[i].NodeHours > instanceUsage[j].NodeHours
+	})
+
+	labelUsage := make([]LabelUsage, 0, len(labels))
+	for _, usage := range labels {
+		labelUsage = append(labelUsage, *usage)
+	}
+	sort.Slice(labelUsage, func(i, j int) bool {
+		if labelUsage[i].Label != labelUsage[j].Label {
+			return labelUsage[i].Label < labelUsage[j].Label
+		}
+		return labelUsage[i].Value < labelUsage[j].Value
+	})
+
+	return ownerEntries, instanceUsage, labelUsage
+}
@@ -0,0 +1,109 @@
+package usage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLedgerMonthlySummary tests node hours and spend split at month boundaries
+func TestLedgerMonthlySummary(t *testing.T) {
+	dir := t.TempDir()
+	tracker, err := NewTracker(filepath.Join(dir, "usage.json"))
+	require.NoError(t, err)
+	ledger, err := NewLedger(filepath.Join(dir, "node_ledger.json"))
+	require.NoError(t, err)
+
+	research := state.Owner{APIKeyID: "key-a", Namespace: "research"}
+	node := ActiveNode{NodeID: "n0", DeploymentID: "dep", Owner: research, Provider: "aws", InstanceType: "t3.micro"}
+
+	// Node runs from 22:00 on the last day of a month to 02:00 on the first
+	// day of the next one, recently enough to be within retention
+	now := time.Now().UTC()
+	month := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+	start := month.Add(-2 * time.Hour)
+	ledger.Observe(start, []ActiveNode{node})
+	ledger.Observe(start.Add(4*time.Hour), []ActiveNode{node})
+	ledger.Observe(start.Add(5*time.Hour), nil)
+
+	entries, instances, _ := Summarize(tracker, ledger, month, month.AddDate(0, 1, 0), "")
+	require.Len(t, entries, 1)
+	assert.Equal(t, research, entries[0].Owner)
+	assert.InDelta(t, 2.0, entries[0].NodeHours, 0.001)
+	assert.InDelta(t, 2*0.0104, entries[0].EstimatedCost, 0.0001)
+	require.Len(t, instances, 1)
+	assert.Equal(t, "t3.micro", instances[0].InstanceType)
+
+	entries, _, _ = Summarize(tracker, ledger, month, month.AddDate(0, 1, 0), "other")
+	assert.Empty(t, entries)
+
+	// Records survive a restart
+	require.NoError(t, ledger.Save())
+	reloaded, err := NewLedger(filepath.Join(dir, "node_ledger.json"))
+	require.NoError(t, err)
+	entries, _, _ = Summarize(tracker, reloaded, month.AddDate(0, -1, 0), month, "")
+	require.Len(t, entries, 1)
+	assert.InDelta(t, 2.0, entries[0].NodeHours, 0.001)
+}
+
+// TestLedgerUnknownPrice tests that unpriced instance types are reported separately
+func TestLedgerUnknownPrice(t *testing.T) {
+	dir := t.TempDir()
+	tracker, err := NewTracker(filepath.Join(dir, "usage.json"))
+	require.NoError(t, err)
+	ledger, err := NewLedger(filepath.Join(dir, "node_ledger.json"))
+	require.NoError(t, err)
+
+	node := ActiveNode{NodeID: "n0", Provider: "aws", InstanceType: "x9.huge"}
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	ledger.Observe(start, []ActiveNode{node})
+	ledger.Observe(start.Add(time.Hour), []ActiveNode{node})
+	ledger.Observe(start.Add(2*time.Hour), nil)
+
+	entries, instances, _ := Summarize(tracker, ledger, start, start.AddDate(0, 1, 0), "")
+	require.Len(t, entries, 1)
+	assert.InDelta(t, 1.0, entries[0].UnpricedNodeHours, 0.001)
+	assert.Zero(t, entries[0].EstimatedCost)
+	assert.Nil(t, instances[0].EstimatedCost)
+}
+
+// TestLedgerLabelSummary tests node hours and spend per deployment label
+func TestLedgerLabelSummary(t *testing.T) {
+	dir := t.TempDir()
+	tracker, err := NewTracker(filepath.Join(dir, "usage.json"))
+	require.NoError(t, err)
+	ledger, err := NewLedger(filepath.Join(dir, "node_ledger.json"))
+	require.NoError(t, err)
+
+	nodes := []ActiveNode{
+		{NodeID: "n0", Provider: "aws", InstanceType: "t3.micro", Labels: map[string]string{"team": "ml", "env": "prod"}},
+		{NodeID: "n1", Provider: "aws", InstanceType: "t3.micro", Labels: map[string]string{"team": "ml"}},
+		{NodeID: "n2", Provider: "aws", InstanceType: "x9.huge", Labels: map[string]string{"team": "web"}},
+		{NodeID: "n3", Provider: "aws", InstanceType: "t3.micro"},
+	}
+	start := time.Now().UTC().Add(-24 * time.Hour)
+	ledger.Observe(start, nodes)
+	ledger.Observe(start.Add(2*time.Hour), nodes)
+	ledger.Observe(start.Add(3*time.Hour), nil)
+
+	// Labels are recorded with the nodes and survive a restart
+	require.NoError(t, ledger.Save())
+	ledger, err = NewLedger(filepath.Join(dir, "node_ledger.json"))
+	require.NoError(t, err)
+
+	_, _, labels := Summarize(tracker, ledger, start, start.Add(24*time.Hour), "")
+	require.Len(t, labels, 3)
+	assert.Equal(t, "env", labels[0].Label)
+	assert.Equal(t, "prod", labels[0].Value)
+	assert.InDelta(t, 2.0, labels[0].NodeHours, 0.001)
+	assert.Equal(t, "ml", labels[1].Value)
+	assert.InDelta(t, 4.0, labels[1].NodeHours, 0.001)
+	assert.InDelta(t, 4*0.0104, labels[1].EstimatedCost, 0.0001)
+	assert.Equal(t, "web", labels[2].Value)
+	assert.Zero(t, labels[2].EstimatedCost)
+	assert.InDelta(t, 2.0, labels[2].UnpricedNodeHours, 0.001)
+}
@@ -0,0 +1,179 @@
+// Package usage accounts API requests, bundle uploads and node hours per API
+// key and namespace for chargeback on shared daemons
+package usage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/JustinTimperio/TaskFly/internal/state"
+)
+
+// Retention is how long hourly usage buckets are kept
+const Retention = 90 * 24 * time.Hour
+
+// Counters holds the usage accumulated in one hourly bucket
+type Counters struct {
+	Requests    int64 `json:"requests"`
+	BundleBytes int64 `json:"bundle_bytes"`
+}
+
+// Entry is the usage of one API key and namespace over a time window
+type Entry struct {
+	state.Owner
+	Requests          int64   `json:"requests"`
+	BundleBytes       int64   `json:"bundle_bytes"`
+	NodeHours         float64 `json:"node_hours"`
+	EstimatedCost     float64 `json:"estimated_cost_usd"`
+	UnpricedNodeHours float64 `json:"unpriced_node_hours,omitempty"`
+}
+
+// bucket is the persisted form of one owner's counters for an hour
+type bucket struct {
+	Hour time.Time `json:"hour"`
+	state.Owner
+	Counters
+}
+
+// Tracker accumulates usage in hourly buckets and persists them as JSON
+type Tracker struct {
+	mu      sync.Mutex
+	buckets map[time.Time]map[state.Owner]*Counters
+	path    string
+}
+
+// KeyID returns a stable, non-secret identifier for an API key so raw keys
+// never end up in usage data
+func KeyID(apiKey string) string {
+	if apiKey == "" {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	return "key-" + hex.EncodeToString(sum[:6])
+}
+
+// NewTracker creates a tracker persisted to path, loading existing usage
+func NewTracker(path string) (*Tracker, error) {
+	t := &Tracker{
+		buckets: make(map[time.Time]map[state.Owner]*Counters),
+		path:    path,
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage file: %w", err)
+	}
+
+	var persisted []bucket
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return nil, fmt.Errorf("failed to parse usage file: %w", err)
+	}
+	for _, b := range persisted {
+		t.counters(b.Hour, b.Owner).add(b.Counters)
+	}
+
+	return t, nil
+}
+
+// RecordRequest counts an API request
+func (t *Tracker) RecordRequest(owner state.Owner) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.counters(time.Now(), owner).Requests++
+}
+
+// RecordBundle counts bytes of an uploaded deployment bundle
+func (t *Tracker) RecordBundle(owner state.Owner, bytes int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.counters(time.Now(), owner).BundleBytes += bytes
+}
+
+// totals sums counters per owner for buckets starting in [since, until)
+func (t *Tracker) totals(since, until time.Time) map[state.Owner]Counters {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	totals := make(map[state.Owner]Counters)
+	for hour, owners := range t.buckets {
+		if hour.Before(since.Truncate(time.Hour)) || !hour.Before(until) {
+			continue
+		}
+		for owner, counters := range owners {
+			total := totals[owner]
+			total.add(*counters)
+			totals[owner] = total
+		}
+	}
+
+	return totals
+}
+
+// Save drops buckets older than the retention period and writes the rest
+// to disk
+func (t *Tracker) Save() error {
+	t.mu.Lock()
+	cutoff := time.Now().Add(-Retention)
+	var persisted []bucket
+	for hour, owners := range t.buckets {
+		if hour.Before(cutoff) {
+			delete(t.buckets, hour)
+			continue
+		}
+		for owner, counters := range owners {
+			persisted = append(persisted, bucket{Hour: hour, Owner: owner, Counters: *counters})
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(persisted, func(i, j int) bool {
+		return persisted[i].Hour.Before(persisted[j].Hour)
+	})
+
+	data, err := json.MarshalIndent(persisted, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal usage: %w", err)
+	}
+
+	// Write to temp file first, then atomically rename
+	tempFile := t.path + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write temp usage file: %w", err)
+	}
+	if err := os.Rename(tempFile, t.path); err != nil {
+		return fmt.Errorf("failed to rename usage file: %w", err)
+	}
+
+	return nil
+}
+
+// counters returns the bucket for the hour containing at, creating it if
+// needed. Callers must hold t.mu.
+func (t *Tracker) counters(at time.Time, owner state.Owner) *Counters {
+	hour := at.UTC().Truncate(time.Hour)
+	owners, ok := t.buckets[hour]
+	if !ok {
+		owners = make(map[state.Owner]*Counters)
+		t.buckets[hour] = owners
+	}
+	counters, ok := owners[owner]
+	if !ok {
+		counters = &Counters{}
+		owners[owner] = counters
+	}
+	return counters
+}
+
+func (c *Counters) add(other Counters) {
+	c.Requests += other.Requests
+	c.BundleBytes += other.BundleBytes
+}
@@ -1,11 +1,15 @@
 package validation
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/JustinTimperio/TaskFly/internal/cloud"
+	"github.com/JustinTimperio/TaskFly/internal/orchestrator"
+	"github.com/JustinTimperio/TaskFly/internal/variables"
 	"gopkg.in/yaml.v2"
 )
 
@@ -58,13 +62,19 @@ func (r *ValidationResult) AddInfo(field, message string) {
 
 // TaskFlyConfig represents the taskfly.yml configuration
 type TaskFlyConfig struct {
-	CloudProvider     string                            `yaml:"cloud_provider"`
-	InstanceConfig    map[string]map[string]interface{} `yaml:"instance_config"`
-	ApplicationFiles  []string                          `yaml:"application_files"`
-	RemoteDestDir     string                            `yaml:"remote_dest_dir"`
-	RemoteScriptToRun string                            `yaml:"remote_script_to_run"`
-	BundleName        string                            `yaml:"bundle_name"`
-	Nodes             NodesConfig                       `yaml:"nodes"`
+	CloudProvider           string                            `yaml:"cloud_provider"`
+	InstanceConfig          map[string]map[string]interface{} `yaml:"instance_config"`
+	ApplicationFiles        []string                          `yaml:"application_files"`
+	RemoteDestDir           string                            `yaml:"remote_dest_dir"`
+	RemoteScriptToRun       string                            `yaml:"remote_script_to_run"`
+	RemoteScriptArgs        []string                          `yaml:"remote_script_args"`
+	RemoteScriptInterpreter string                            `yaml:"remote_script_interpreter"`
+	BundleName              string                            `yaml:"bundle_name"`
+	NetworkMode             string                            `yaml:"network_mode"`
+	KeepFailed              string                            `yaml:"keep_failed"`
+	Limits                  orchestrator.LimitsConfig         `yaml:"limits"`
+	Debug                   bool                              `yaml:"debug"`
+	Nodes                   NodesConfig                       `yaml:"nodes"`
 }
 
 // NodesConfig represents the nodes configuration
@@ -82,13 +92,39 @@ type Validator struct {
 	result     *ValidationResult
 }
 
-// NewValidator creates a new validator
-func NewValidator(configPath string) (*Validator, error) {
+// NewValidator creates a new validator. vars are values of the input
+// variables the config declares; missing or invalid ones are reported as
+// errors and validated with their defaults or zero values.
+func NewValidator(configPath string, vars map[string]string) (*Validator, error) {
 	data, err := os.ReadFile(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
+	result := &ValidationResult{Valid: true}
+	declared, err := variables.Declared(data)
+	if err != nil {
+		return nil, err
+	}
+	values, err := variables.Resolve(declared, vars)
+	if err != nil {
+		result.AddError("variables", err.Error())
+		if values == nil {
+			values = make(map[string]interface{}, len(declared))
+		}
+	}
+	for _, variable := range declared {
+		if _, ok := values[variable.Name]; !ok {
+			values[variable.Name] = variable.Zero()
+			if !variable.Required() {
+				values[variable.Name] = variable.Default
+			}
+		}
+	}
+	if data, err = variables.Substitute(data, values); err != nil {
+		return nil, err
+	}
+
 	var config TaskFlyConfig
 	if err := yaml.Unmarshal(data, &config); err != nil {
 		return nil, fmt.Errorf("failed to parse YAML: %w", err)
@@ -97,7 +133,7 @@ func NewValidator(configPath string) (*Validator, error) {
 	return &Validator{
 		config:     &config,
 		configPath: configPath,
-		result:     &ValidationResult{Valid: true},
+		result:     result,
 	}, nil
 }
 
@@ -105,9 +141,12 @@ func NewValidator(configPath string) (*Validator, error) {
 func (v *Validator) Validate() *ValidationResult {
 	v.validateCloudProvider()
 	v.validateInstanceConfig()
+	v.validateNetworkMode()
 	v.validateApplicationFiles()
 	v.validateNodesConfig()
 	v.validateRemoteConfig()
+	v.validateKeepFailed()
+	v.validateLimits()
 	v.checkCommonIssues()
 
 	return v.result
@@ -119,8 +158,13 @@ func (v *Validator) validateCloudProvider() {
 		v.result.AddError("cloud_provider", "cloud_provider is required")
 		return
 	}
+	if v.config.CloudProvider == cloud.ProviderSimulate {
+		v.result.AddError("cloud_provider",
+			fmt.Sprintf("cloud_provider '%s' can't be configured, use taskfly up --simulate", cloud.ProviderSimulate))
+		return
+	}
 
-	supportedProviders := []string{"aws", "local"}
+	supportedProviders := []string{"aws", "local", "mock"}
 	found := false
 	for _, p := range supportedProviders {
 		if v.config.CloudProvider == p {
@@ -156,13 +200,53 @@ func (v *Validator) validateInstanceConfig() {
 		v.validateAWSConfig(providerConfig)
 	case "local":
 		v.validateLocalConfig(providerConfig)
+	case "mock":
+		v.validateMockConfig(providerConfig)
+	}
+}
+
+// isEgressOnly reports whether the daemon must never dial nodes
+func (v *Validator) isEgressOnly() bool {
+	return v.config.NetworkMode == "egress_only"
+}
+
+// validateNetworkMode validates the network_mode field against the provider
+func (v *Validator) validateNetworkMode() {
+	switch v.config.NetworkMode {
+	case "", "direct":
+		return
+	case "egress_only":
+	default:
+		v.result.AddError("network_mode",
+			fmt.Sprintf("unsupported network_mode '%s'. Supported: direct, egress_only", v.config.NetworkMode))
+		return
+	}
+
+	if v.config.CloudProvider == "local" {
+		v.result.AddError("network_mode",
+			"local provider deploys agents over SSH and cannot be used with network_mode 'egress_only'")
+		return
+	}
+
+	providerConfig := v.config.InstanceConfig[v.config.CloudProvider]
+	for _, field := range []string{"ssh_key_path", "ssh_user", "ssh_address"} {
+		if _, ok := providerConfig[field]; ok {
+			v.result.AddWarning(fmt.Sprintf("instance_config.%s.%s", v.config.CloudProvider, field),
+				fmt.Sprintf("%s is ignored in egress_only mode, the daemon never connects to nodes", field))
+		}
 	}
+
+	v.result.AddInfo("network_mode",
+		"nodes bootstrap via user data and need outbound HTTP access to the daemon; no inbound ports are required")
 }
 
 // validateAWSConfig validates AWS-specific configuration
 func (v *Validator) validateAWSConfig(config map[string]interface{}) {
-	// Required fields
+	// Required fields (no key pair is needed when the daemon never SSHes in)
 	requiredFields := []string{"image_id", "instance_type", "key_name"}
+	if v.isEgressOnly() {
+		requiredFields = []string{"image_id", "instance_type"}
+	}
 	for _, field := range requiredFields {
 		if val, ok := config[field]; !ok || val == "" {
 			v.result.AddError(fmt.Sprintf("instance_config.aws.%s", field),
@@ -205,6 +289,72 @@ func (v *Validator) validateAWSConfig(config map[string]interface{}) {
 		}
 	}
 
+	// Check private subnet / IPv6 networking options
+	subnetID, _ := config["subnet_id"].(string)
+	subnetIDs, _ := config["subnet_ids"].([]interface{})
+	if subnetID != "" && len(subnetIDs) > 0 {
+		v.result.AddError("instance_config.aws.subnet_ids",
+			"subnet_id and subnet_ids are mutually exclusive")
+	}
+	hasSubnet := subnetID != "" || len(subnetIDs) > 0
+	if _, ok := config["associate_public_ip"]; ok && !hasSubnet {
+		v.result.AddError("instance_config.aws.associate_public_ip",
+			"subnet_id or subnet_ids is required when associate_public_ip is set")
+	}
+	if count, ok := config["ipv6_address_count"].(int); ok && count > 0 && !hasSubnet {
+		v.result.AddError("instance_config.aws.ipv6_address_count",
+			"subnet_id or subnet_ids is required when ipv6_address_count is set")
+	}
+
+	// Check root and data volumes
+	if _, volumes, err := cloud.ParseVolumes(config); err != nil {
+		v.result.AddError("instance_config.aws.volumes", err.Error())
+	} else {
+		for _, volume := range volumes {
+			if volume.Keep {
+				v.result.AddInfo("instance_config.aws.volumes",
+					fmt.Sprintf("volume %s (%s) is kept after teardown and keeps incurring storage costs", volume.Device, volume.MountPoint))
+			}
+		}
+	}
+
+	// Check spread policies
+	if spread, ok := config["spread"].([]interface{}); ok {
+		for _, policy := range spread {
+			switch policy {
+			case "zones":
+				if subnetID != "" {
+					v.result.AddError("instance_config.aws.spread",
+						"spreading across zones requires subnet_ids with one subnet per zone instead of subnet_id")
+				}
+				if len(subnetIDs) > 0 {
+					v.result.AddInfo("instance_config.aws.subnet_ids",
+						"nodes are spread over subnet_ids; use subnets in distinct availability zones")
+				}
+			case "hosts":
+				if v.config.Nodes.Count > 7 {
+					v.result.AddWarning("instance_config.aws.spread",
+						"spread placement groups allow at most 7 running instances per availability zone")
+				}
+			default:
+				v.result.AddError("instance_config.aws.spread",
+					fmt.Sprintf("invalid spread policy '%v', must be one of: zones, hosts", policy))
+			}
+		}
+	}
+	if sshAddress, ok := config["ssh_address"].(string); ok && sshAddress != "" {
+		switch sshAddress {
+		case "public", "private", "ipv6":
+		default:
+			v.result.AddError("instance_config.aws.ssh_address",
+				fmt.Sprintf("invalid ssh_address '%s', must be one of: public, private, ipv6", sshAddress))
+		}
+	}
+	if publicIP, ok := config["associate_public_ip"].(bool); ok && !publicIP {
+		v.result.AddInfo("instance_config.aws.associate_public_ip",
+			"instances will have no public IP; the daemon must be reachable via --daemon-internal-ip")
+	}
+
 	// Check SSH key path
 	if keyName, ok := config["key_name"].(string); ok && keyName != "" {
 		v.result.AddInfo("instance_config.aws.key_name",
@@ -217,12 +367,22 @@ func (v *Validator) validateAWSConfig(config map[string]interface{}) {
 	}
 
 	// Check SSH user
-	if _, ok := config["ssh_user"]; !ok {
+	if _, ok := config["ssh_user"]; !ok && !v.isEgressOnly() {
 		v.result.AddWarning("instance_config.aws.ssh_user",
 			"ssh_user not specified, defaulting to 'ubuntu' (may vary by AMI)")
 	}
 }
 
+// validateMockConfig validates the mock provider's timings and fault rates
+func (v *Validator) validateMockConfig(config map[string]interface{}) {
+	if _, err := cloud.ParseSimulationConfig(config); err != nil {
+		v.result.AddError("instance_config.mock", err.Error())
+		return
+	}
+	v.result.AddInfo("cloud_provider",
+		"mock provider simulates nodes inside the daemon, no instances are launched")
+}
+
 // validateLocalConfig validates local provider configuration
 func (v *Validator) validateLocalConfig(config map[string]interface{}) {
 	// Check for host or hosts
@@ -420,6 +580,23 @@ func (v *Validator) validateNodesConfig() {
 	if v.config.Nodes.ConfigTemplate != nil {
 		v.validateTemplateVariables(v.config.Nodes.ConfigTemplate)
 	}
+
+	// Check command line overrides
+	if value, ok := v.config.Nodes.ConfigTemplate["script_args"]; ok {
+		if _, isMap := value.(map[interface{}]interface{}); isMap {
+			v.result.AddError("nodes.config_template.script_args",
+				"script_args must be a list of simple values")
+		}
+	}
+	if value, ok := v.config.Nodes.ConfigTemplate["entry_command"]; ok {
+		if _, isMap := value.(map[interface{}]interface{}); isMap {
+			v.result.AddError("nodes.config_template.entry_command",
+				"entry_command must be a string or a list of simple values")
+		} else if v.config.RemoteScriptToRun != "" {
+			v.result.AddInfo("nodes.config_template.entry_command",
+				"entry_command replaces remote_script_to_run on every node")
+		}
+	}
 }
 
 // isListReferenced checks if a distributed list is referenced in the config template
@@ -512,11 +689,33 @@ func (v *Validator) validateRemoteConfig() {
 	if v.config.RemoteDestDir == "" {
 		v.result.AddWarning("remote_dest_dir",
 			"remote_dest_dir not specified, will use default")
+	} else if !strings.HasPrefix(v.config.RemoteDestDir, "/") {
+		v.result.AddError("remote_dest_dir",
+			fmt.Sprintf("remote_dest_dir must be an absolute path: %s", v.config.RemoteDestDir))
+	} else {
+		switch filepath.Clean(v.config.RemoteDestDir) {
+		case "/", "/bin", "/boot", "/dev", "/etc", "/lib", "/lib64", "/proc", "/root",
+			"/sbin", "/sys", "/usr", "/usr/bin", "/usr/lib", "/usr/sbin", "/var":
+			v.result.AddError("remote_dest_dir",
+				fmt.Sprintf("remote_dest_dir points at a system directory: %s", v.config.RemoteDestDir))
+		default:
+			v.result.AddInfo("remote_dest_dir",
+				"nodes fall back to /tmp/taskfly-<token> if the directory cannot be created or written")
+		}
 	}
 
 	if v.config.RemoteScriptToRun == "" {
 		v.result.AddInfo("remote_script_to_run",
 			"no remote script specified, nodes will only register with daemon")
+		if len(v.config.RemoteScriptArgs) > 0 || v.config.RemoteScriptInterpreter != "" {
+			v.result.AddWarning("remote_script_args",
+				"remote_script_args/remote_script_interpreter are ignored without remote_script_to_run")
+		}
+	} else if strings.HasPrefix(v.config.RemoteScriptToRun, "/") || strings.HasPrefix(filepath.Clean(v.config.RemoteScriptToRun), "..") {
+		v.result.AddError("remote_script_to_run",
+			"remote_script_to_run must be a path relative to the bundle root")
+	} else {
+		v.validateScript()
 	}
 
 	if v.config.BundleName == "" {
@@ -525,6 +724,58 @@ func (v *Validator) validateRemoteConfig() {
 	}
 }
 
+// scriptInterpreters are the interpreters remote_script_interpreter can name;
+// anything else is used as a command line
+var scriptInterpreters = map[string]bool{"bash": true, "sh": true, "python3": true, "pwsh": true}
+
+// scriptExtensions are the extensions agents pick an interpreter by for
+// scripts without a shebang
+var scriptExtensions = map[string]bool{".sh": true, ".bash": true, ".py": true, ".ps1": true}
+
+// validateScript reports how agents will run remote_script_to_run
+func (v *Validator) validateScript() {
+	interpreter := v.config.RemoteScriptInterpreter
+	if fields := strings.Fields(interpreter); len(fields) > 0 && !scriptInterpreters[interpreter] && !filepath.IsAbs(fields[0]) {
+		v.result.AddInfo("remote_script_interpreter",
+			fmt.Sprintf("'%s' is run as a command line; bash, sh, python3 and pwsh are resolved on each node", interpreter))
+	}
+
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(v.configPath), v.config.RemoteScriptToRun))
+	if err != nil || bytes.IndexByte(data, 0) >= 0 {
+		// Missing scripts are reported with the application files
+		return
+	}
+	if bytes.Contains(data, []byte("\r\n")) {
+		v.result.AddInfo("remote_script_to_run",
+			"script has CRLF (Windows) line endings, agents convert them to LF before running it")
+	}
+	if interpreter == "" && !bytes.HasPrefix(data, []byte("#!")) && !scriptExtensions[strings.ToLower(filepath.Ext(v.config.RemoteScriptToRun))] {
+		v.result.AddInfo("remote_script_to_run",
+			"script has no shebang line and no remote_script_interpreter, agents run it with sh")
+	}
+}
+
+// validateKeepFailed validates the keep_failed window
+func (v *Validator) validateKeepFailed() {
+	if _, err := orchestrator.ParseKeepFailed(v.config.KeepFailed); err != nil {
+		v.result.AddError("keep_failed",
+			fmt.Sprintf("invalid duration '%s': %v", v.config.KeepFailed, err))
+	}
+}
+
+// validateLimits validates the workload size limits
+func (v *Validator) validateLimits() {
+	limits, err := v.config.Limits.Resolve()
+	if err != nil {
+		v.result.AddError("limits", err.Error())
+		return
+	}
+	if limits.MaxWorkdirBytes == 0 && v.config.Limits.CheckInterval > 0 {
+		v.result.AddWarning("limits.check_interval",
+			"has no effect without max_workdir_size")
+	}
+}
+
 // checkCommonIssues checks for common configuration issues
 func (v *Validator) checkCommonIssues() {
 	// Check if using default values that might need customization
@@ -533,6 +784,11 @@ func (v *Validator) checkCommonIssues() {
 			"using default /tmp directory, files may be cleaned up by system")
 	}
 
+	if v.config.Debug {
+		v.result.AddInfo("debug",
+			"agents log verbosely and keep their working directories, turn debug off for production runs")
+	}
+
 	// Check for common security issues
 	if v.config.CloudProvider == "aws" {
 		if awsConfig, ok := v.config.InstanceConfig["aws"]; ok {
@@ -0,0 +1,337 @@
+// Package variables resolves the input variables a taskfly.yml declares and
+// substitutes them into the configuration, so one file serves runs that
+// differ in a dataset, a node count or an instance type:
+//
+//	variables:
+//	  dataset:
+//	    description: S3 prefix of the input
+//	  nodes:
+//	    type: int
+//	    default: 4
+//	nodes:
+//	  count: ${var.nodes}
+//	  global_metadata:
+//	    input: s3://data/${var.dataset}
+package variables
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Types of variables
+const (
+	TypeString = "string"
+	TypeInt    = "int"
+	TypeFloat  = "float"
+	TypeBool   = "bool"
+)
+
+// namePattern limits names to what can follow "var." in a reference
+var namePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// referencePattern matches ${var.name} and its escaped form $${var.name}
+var referencePattern = regexp.MustCompile(`\$?\$\{var\.([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+// Variable is an input a taskfly.yml declares under variables
+type Variable struct {
+	Name        string        `yaml:"-" json:"name"`
+	Type        string        `yaml:"type" json:"type"` // string, int, float or bool; string if empty
+	Description string        `yaml:"description" json:"description,omitempty"`
+	Default     interface{}   `yaml:"default" json:"default,omitempty"` // nil if the variable is required
+	Options     []interface{} `yaml:"options" json:"options,omitempty"` // allowed values, any if empty
+
+	// Sensitive values, such as credentials, are withheld from the daemon's
+	// API, trace files and deployment archives, and prompts don't echo them
+	Sensitive bool `yaml:"sensitive" json:"sensitive,omitempty"`
+}
+
+// Declared returns the variables a taskfly.yml declares, in the order they
+// are declared
+func Declared(data []byte) ([]Variable, error) {
+	var doc struct {
+		Variables yaml.MapSlice `yaml:"variables"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse variables: %w", err)
+	}
+
+	declared := make([]Variable, 0, len(doc.Variables))
+	for _, item := range doc.Variables {
+		name, _ := item.Key.(string)
+		if !namePattern.MatchString(name) {
+			return nil, fmt.Errorf("variable name %v must be letters, digits and '_', not starting with a digit", item.Key)
+		}
+		// Declarations are re-encoded to decode them into a Variable, since
+		// the MapSlice keeps them generic
+		raw, err := yaml.Marshal(item.Value)
+		if err != nil {
+			return nil, fmt.Errorf("variable %s: %w", name, err)
+		}
+		variable := Variable{Name: name}
+		if err := yaml.UnmarshalStrict(raw, &variable); err != nil {
+			return nil, fmt.Errorf("variable %s: %w", name, err)
+		}
+		if err := variable.check(); err != nil {
+			return nil, fmt.Errorf("variable %s: %w", name, err)
+		}
+		declared = append(declared, variable)
+	}
+	return declared, nil
+}
+
+// check validates a declaration and converts its default and options to its
+// type
+func (v *Variable) check() error {
+	switch v.Type {
+	case "":
+		v.Type = TypeString
+	case TypeString, TypeInt, TypeFloat, TypeBool:
+	default:
+		return fmt.Errorf("unknown type %q, use string, int, float or bool", v.Type)
+	}
+	for i, option := range v.Options {
+		converted, err := v.convert(option)
+		if err != nil {
+			return fmt.Errorf("option %v: %w", option, err)
+		}
+		v.Options[i] = converted
+	}
+	if v.Default != nil {
+		converted, err := v.convert(v.Default)
+		if err != nil {
+			return fmt.Errorf("default: %w", err)
+		}
+		if err := v.checkOption(converted); err != nil {
+			return fmt.Errorf("default: %w", err)
+		}
+		v.Default = converted
+	}
+	return nil
+}
+
+// Required reports whether the variable has no default
+func (v Variable) Required() bool {
+	return v.Default == nil
+}
+
+// Parse converts a value given as text, from a flag, the environment or a
+// prompt, to the variable's type and checks it against the options
+func (v Variable) Parse(text string) (interface{}, error) {
+	value, err := v.convert(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.checkOption(value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Zero returns the zero value of the variable's type
+func (v Variable) Zero() interface{} {
+	switch v.Type {
+	case TypeInt:
+		return 0
+	case TypeFloat:
+		return 0.0
+	case TypeBool:
+		return false
+	}
+	return ""
+}
+
+// convert converts text or a YAML scalar to the variable's type
+func (v Variable) convert(value interface{}) (interface{}, error) {
+	text := fmt.Sprint(value)
+	switch v.Type {
+	case TypeInt:
+		switch n := value.(type) {
+		case int:
+			return n, nil
+		case float64:
+			if n == math.Trunc(n) {
+				return int(n), nil
+			}
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(text))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", text)
+		}
+		return n, nil
+	case TypeFloat:
+		switch n := value.(type) {
+		case int:
+			return float64(n), nil
+		case float64:
+			return n, nil
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", text)
+		}
+		return n, nil
+	case TypeBool:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+		b, err := strconv.ParseBool(strings.TrimSpace(text))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not true or false", text)
+		}
+		return b, nil
+	}
+	switch value.(type) {
+	case map[interface{}]interface{}, []interface{}, yaml.MapSlice:
+		return nil, fmt.Errorf("%v is not a string", value)
+	}
+	return text, nil
+}
+
+// checkOption rejects values the options don't list
+func (v Variable) checkOption(value interface{}) error {
+	if len(v.Options) == 0 {
+		return nil
+	}
+	options := make([]string, len(v.Options))
+	for i, option := range v.Options {
+		if option == value {
+			return nil
+		}
+		options[i] = fmt.Sprint(option)
+	}
+	return fmt.Errorf("%v is not one of %s", value, strings.Join(options, ", "))
+}
+
+// Format returns a value as text, the form Parse accepts. Numbers read back
+// from JSON are float64, so whole ones are formatted as integers.
+func Format(value interface{}) string {
+	if f, ok := value.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// MissingError lists required variables without a value
+type MissingError struct {
+	Names []string
+}
+
+func (e *MissingError) Error() string {
+	return fmt.Sprintf("no value for variables %s, set them with --var name=value or TASKFLY_VAR_<name>", strings.Join(e.Names, ", "))
+}
+
+// Resolve returns the value of each declared variable: the given text parsed
+// to the variable's type, else its default. Required variables without a
+// value are left out and reported as a *MissingError after all others were
+// resolved, so callers can fill them in. Values for undeclared variables are
+// rejected.
+func Resolve(declared []Variable, given map[string]string) (map[string]interface{}, error) {
+	byName := make(map[string]bool, len(declared))
+	values := make(map[string]interface{}, len(declared))
+	var missing []string
+	for _, variable := range declared {
+		byName[variable.Name] = true
+		text, ok := given[variable.Name]
+		switch {
+		case ok:
+			value, err := variable.Parse(text)
+			if err != nil {
+				return nil, fmt.Errorf("variable %s: %w", variable.Name, err)
+			}
+			values[variable.Name] = value
+		case !variable.Required():
+			values[variable.Name] = variable.Default
+		default:
+			missing = append(missing, variable.Name)
+		}
+	}
+
+	var undeclared []string
+	for name := range given {
+		if !byName[name] {
+			undeclared = append(undeclared, name)
+		}
+	}
+	if len(undeclared) > 0 {
+		sort.Strings(undeclared)
+		return nil, fmt.Errorf("taskfly.yml declares no variables %s", strings.Join(undeclared, ", "))
+	}
+	if len(missing) > 0 {
+		return values, &MissingError{Names: missing}
+	}
+	return values, nil
+}
+
+// Substitute replaces references to variables in the values of a taskfly.yml.
+// A value that is only a reference takes the variable's type, so
+// "count: ${var.nodes}" stays an integer; references within text are
+// formatted into it. $${var.name} stands for the text ${var.name}.
+// Configurations without references are returned unchanged.
+func Substitute(data []byte, values map[string]interface{}) ([]byte, error) {
+	if !referencePattern.Match(data) {
+		return data, nil
+	}
+
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var undeclared []string
+	for i, item := range doc {
+		// Leave the declarations alone, descriptions may show references
+		if item.Key == "variables" {
+			continue
+		}
+		doc[i].Value = substitute(item.Value, values, &undeclared)
+	}
+	if len(undeclared) > 0 {
+		return nil, fmt.Errorf("taskfly.yml refers to undeclared variables %s, declare them under variables", strings.Join(undeclared, ", "))
+	}
+	return yaml.Marshal(doc)
+}
+
+// substitute replaces references in the strings of a YAML value, collecting
+// the names of undeclared variables
+func substitute(node interface{}, values map[string]interface{}, undeclared *[]string) interface{} {
+	switch node := node.(type) {
+	case string:
+		if match := referencePattern.FindStringSubmatch(node); match != nil && match[0] == node && !strings.HasPrefix(node, "$$") {
+			if value, ok := values[match[1]]; ok {
+				return value
+			}
+		}
+		return referencePattern.ReplaceAllStringFunc(node, func(reference string) string {
+			if strings.HasPrefix(reference, "$$") {
+				return reference[1:]
+			}
+			name := referencePattern.FindStringSubmatch(reference)[1]
+			value, ok := values[name]
+			if !ok {
+				for _, seen := range *undeclared {
+					if seen == name {
+						return reference
+					}
+				}
+				*undeclared = append(*undeclared, name)
+				return reference
+			}
+			return Format(value)
+		})
+	case yaml.MapSlice:
+		for i, item := range node {
+			node[i].Value = substitute(item.Value, values, undeclared)
+		}
+	case []interface{}:
+		for i, item := range node {
+			node[i] = substitute(item, values, undeclared)
+		}
+	}
+	return node
+}
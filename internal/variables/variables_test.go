@@ -0,0 +1,113 @@
+package variables
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+const config = `variables:
+  dataset:
+    description: S3 prefix of the input, like ${var.dataset}
+  nodes:
+    type: int
+    default: 4
+  instance:
+    default: t3.micro
+    options: [t3.micro, t3.large]
+  debug:
+    type: bool
+    default: false
+nodes:
+  count: ${var.nodes}
+  global_metadata:
+    input: s3://data/${var.dataset}/part
+    debug: ${var.debug}
+    literal: $${var.dataset}
+  instance_type: ${var.instance}
+`
+
+func TestDeclared(t *testing.T) {
+	declared, err := Declared([]byte(config))
+	require.NoError(t, err)
+	require.Len(t, declared, 4)
+
+	assert.Equal(t, Variable{Name: "dataset", Type: TypeString, Description: "S3 prefix of the input, like ${var.dataset}"}, declared[0])
+	assert.True(t, declared[0].Required())
+	assert.Equal(t, 4, declared[1].Default)
+	assert.Equal(t, []interface{}{"t3.micro", "t3.large"}, declared[2].Options)
+	assert.Equal(t, false, declared[3].Default)
+
+	secret, err := Declared([]byte("variables:\n  api_key:\n    sensitive: true\n"))
+	require.NoError(t, err)
+	require.Len(t, secret, 1)
+	assert.True(t, secret[0].Sensitive)
+
+	none, err := Declared([]byte("nodes:\n  count: 1\n"))
+	require.NoError(t, err)
+	assert.Empty(t, none)
+}
+
+func TestDeclaredRejectsInvalid(t *testing.T) {
+	for config, want := range map[string]string{
+		"variables:\n  1st: {}\n":                                 "variable name 1st",
+		"variables:\n  x:\n    type: list\n":                      `unknown type "list"`,
+		"variables:\n  x:\n    type: int\n    default: many\n":    `default: "many" is not an integer`,
+		"variables:\n  x:\n    default: c\n    options: [a, b]\n": "default: c is not one of a, b",
+		"variables:\n  x:\n    required: true\n":                  "field required not found",
+	} {
+		_, err := Declared([]byte(config))
+		assert.ErrorContains(t, err, want, config)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	declared, err := Declared([]byte(config))
+	require.NoError(t, err)
+
+	values, err := Resolve(declared, map[string]string{"dataset": "runs/7", "nodes": "8"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"dataset": "runs/7", "nodes": 8, "instance": "t3.micro", "debug": false}, values)
+
+	values, err = Resolve(declared, map[string]string{"debug": "true"})
+	var missing *MissingError
+	require.ErrorAs(t, err, &missing)
+	assert.Equal(t, []string{"dataset"}, missing.Names)
+	assert.Equal(t, true, values["debug"])
+
+	_, err = Resolve(declared, map[string]string{"dataset": "x", "nodes": "eight"})
+	assert.ErrorContains(t, err, `variable nodes: "eight" is not an integer`)
+	_, err = Resolve(declared, map[string]string{"dataset": "x", "instance": "m5.large"})
+	assert.ErrorContains(t, err, "m5.large is not one of t3.micro, t3.large")
+	_, err = Resolve(declared, map[string]string{"dataset": "x", "region": "eu"})
+	assert.ErrorContains(t, err, "declares no variables region")
+}
+
+func TestSubstitute(t *testing.T) {
+	data, err := Substitute([]byte(config), map[string]interface{}{"dataset": "runs/7", "nodes": 8, "instance": "t3.large", "debug": true})
+	require.NoError(t, err)
+
+	var doc struct {
+		Variables map[string]map[string]interface{} `yaml:"variables"`
+		Nodes     struct {
+			Count          int                    `yaml:"count"`
+			GlobalMetadata map[string]interface{} `yaml:"global_metadata"`
+			InstanceType   string                 `yaml:"instance_type"`
+		} `yaml:"nodes"`
+	}
+	require.NoError(t, yaml.Unmarshal(data, &doc))
+	assert.Equal(t, 8, doc.Nodes.Count)
+	assert.Equal(t, "t3.large", doc.Nodes.InstanceType)
+	assert.Equal(t, map[string]interface{}{"input": "s3://data/runs/7/part", "debug": true, "literal": "${var.dataset}"}, doc.Nodes.GlobalMetadata)
+	assert.Equal(t, "S3 prefix of the input, like ${var.dataset}", doc.Variables["dataset"]["description"])
+
+	plain := []byte("nodes:\n  count: 1 # kept as written\n")
+	data, err = Substitute(plain, nil)
+	require.NoError(t, err)
+	assert.Equal(t, plain, data)
+
+	_, err = Substitute([]byte("nodes:\n  count: ${var.nodes}\n  name: ${var.name}-${var.nodes}\n"), map[string]interface{}{})
+	assert.EqualError(t, err, "taskfly.yml refers to undeclared variables nodes, name, declare them under variables")
+}